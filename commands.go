@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// Builds the replicators, then runs the command with them, and exits with its exit code when not 0
+func withReplicators(run func(replicators []replicate.Replicator) int) func(*cobra.Command, []string) error {
+	return func(command *cobra.Command, args []string) error {
+		_, _, _, replicators, err := newReplicators(command.Context(), false)
+		if err != nil {
+			return err
+		}
+		if code := run(replicators); code != 0 {
+			os.Exit(code)
+		}
+		return nil
+	}
+}
+
+// The "audit" subcommand
+func newAuditCommand() *cobra.Command {
+	var format, output string
+	command := &cobra.Command{
+		Use:   "audit",
+		Short: "Report the inconsistencies of the replications, without mutating anything",
+		Long:  "Report the inconsistencies of the replications, without mutating anything.\nExits with 0 if consistent, 1 if any issue is found, 2 on error.",
+		Args:  cobra.NoArgs,
+		RunE: withReplicators(func(replicators []replicate.Replicator) int {
+			return runAudit(replicators, format, output)
+		}),
+	}
+	command.Flags().StringVar(&format, "format", "text", "format of the report: text or json")
+	command.Flags().StringVar(&output, "output", "-", "file to write the report to, \"-\" for stdout")
+	return command
+}
+
+// Runs the "audit" subcommand: reports the inconsistencies without mutating anything
+// Returns the exit code: 0 if consistent, 1 if any issue is found, 2 on error
+func runAudit(replicators []replicate.Replicator, format string, output string) int {
+	reports := []replicate.ConsistencyReport{}
+	issues := 0
+	for _, replicator := range replicators {
+		checker, ok := replicator.(replicate.ConsistencyChecker)
+		if !ok {
+			logger.Info("replicator cannot be audited", "replicator", fmt.Sprintf("%T", replicator))
+			continue
+		}
+		if err := checker.LoadStores(); err != nil {
+			logger.Error(err, "could not load objects")
+			return 2
+		}
+		report := checker.CheckConsistency()
+		issues += len(report.Issues)
+		reports = append(reports, report)
+	}
+
+	var writer io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			logger.Error(err, "could not create report", "path", output)
+			return 2
+		}
+		defer file.Close()
+		writer = file
+	}
+	if err := replicate.WriteConsistencyReports(writer, reports, format); err != nil {
+		logger.Error(err, "could not write report")
+		return 2
+	}
+	if issues > 0 {
+		logger.Info("inconsistencies found", "issues", issues)
+		return 1
+	}
+	return 0
+}
+
+// The "check" subcommand
+func newCheckCommand() *cobra.Command {
+	var path, namespace, format string
+	command := &cobra.Command{
+		Use:   "check -f <path>",
+		Short: "Check the annotations of local manifests against the cluster, without mutating anything",
+		Long:  "Check the annotations of local manifests against the cluster, without mutating anything.\nExits with 0 if valid, 1 if any issue is found, 2 on error.",
+		Args:  cobra.NoArgs,
+		RunE: withReplicators(func(replicators []replicate.Replicator) int {
+			return runCheck(replicators, path, namespace, format)
+		}),
+	}
+	command.Flags().StringVarP(&path, "filename", "f", "", "file or directory of the manifests to check, read recursively")
+	command.Flags().StringVar(&namespace, "namespace", "default", "namespace of the manifests without namespace")
+	command.Flags().StringVar(&format, "format", "text", "format of the report: text or json")
+	_ = command.MarkFlagRequired("filename")
+	return command
+}
+
+// Runs the "check" subcommand: checks the annotations of local manifests against the cluster, without mutating anything
+// Returns the exit code: 0 if valid, 1 if any issue is found, 2 on error
+func runCheck(replicators []replicate.Replicator, path string, namespace string, format string) int {
+	manifests, err := replicate.ReadManifests(path, namespace)
+	if err != nil {
+		logger.Error(err, "could not read manifests", "path", path)
+		return 2
+	}
+	checkers := []replicate.ManifestChecker{}
+	for _, replicator := range replicators {
+		checker, ok := replicator.(replicate.ManifestChecker)
+		if !ok {
+			logger.Info("replicator cannot check manifests", "replicator", fmt.Sprintf("%T", replicator))
+			continue
+		}
+		if err := checker.LoadStores(); err != nil {
+			logger.Error(err, "could not load objects")
+			return 2
+		}
+		checkers = append(checkers, checker)
+	}
+
+	reports := []replicate.ManifestReport{}
+	issues := 0
+	for _, manifest := range manifests {
+		for _, checker := range checkers {
+			if report, ok := checker.CheckManifest(manifest); ok {
+				issues += len(report.Issues)
+				reports = append(reports, report)
+			}
+		}
+	}
+	if err := replicate.WriteManifestReports(os.Stdout, reports, format); err != nil {
+		logger.Error(err, "could not write report")
+		return 2
+	}
+	if issues > 0 {
+		logger.Info("issues found", "issues", issues)
+		return 1
+	}
+	return 0
+}
+
+// The "repair" subcommand
+func newRepairCommand() *cobra.Command {
+	var scope replicate.ReconcileScope
+	command := &cobra.Command{
+		Use:   "repair",
+		Short: "Run a single full reconcile pass",
+		Long:  "Run a single full reconcile pass.\nExits with 0 on success, 1 if any action failed, 2 on error.",
+		Args:  cobra.NoArgs,
+		RunE: withReplicators(func(replicators []replicate.Replicator) int {
+			return runRepair(replicators, scope)
+		}),
+	}
+	command.Flags().StringVar(&scope.Namespace, "namespace", "", "only reconcile the objects of this namespace")
+	command.Flags().StringVar(&scope.Source, "source", "", "only reconcile this source, as namespace/name, and its targets")
+	return command
+}
+
+// Runs the "repair" subcommand: a single full reconcile pass
+// Returns the exit code: 0 on success, 1 if any action failed, 2 on error
+func runRepair(replicators []replicate.Replicator, scope replicate.ReconcileScope) int {
+	failed := 0
+	for _, replicator := range replicators {
+		reconciler, ok := replicator.(replicate.Reconciler)
+		if !ok {
+			logger.Info("replicator cannot be repaired", "replicator", fmt.Sprintf("%T", replicator))
+			continue
+		}
+		if err := reconciler.LoadStores(); err != nil {
+			logger.Error(err, "could not load objects")
+			return 2
+		}
+		count, err := reconciler.Reconcile(scope)
+		if err != nil {
+			logger.Error(err, "could not reconcile")
+			return 2
+		}
+		failed += count
+	}
+	if failed > 0 {
+		logger.Info("some actions failed", "failedActions", failed)
+		return 1
+	}
+	return 0
+}
+
+// The "plan" subcommand
+func newPlanCommand() *cobra.Command {
+	var source, format string
+	command := &cobra.Command{
+		Use:   "plan --source <namespace>/<name>",
+		Short: "Print the actions the replicators would perform for a source, without performing them",
+		Long:  "Print the actions the replicators would perform for a source, without performing them.\nExits with 0 on success, 2 on error.",
+		Args:  cobra.NoArgs,
+		RunE: withReplicators(func(replicators []replicate.Replicator) int {
+			return runPlan(replicators, source, format)
+		}),
+	}
+	command.Flags().StringVar(&source, "source", "", "source to plan, as namespace/name")
+	command.Flags().StringVar(&format, "format", "text", "format of the plan: text or json")
+	_ = command.MarkFlagRequired("source")
+	return command
+}
+
+// Runs the "plan" subcommand: prints the actions the replicators would perform for a source, without performing them
+// Returns the exit code: 0 on success, 2 on error
+func runPlan(replicators []replicate.Replicator, source string, format string) int {
+	plans := []replicate.Plan{}
+	for _, replicator := range replicators {
+		planner, ok := replicator.(replicate.Planner)
+		if !ok {
+			logger.Info("replicator cannot plan", "replicator", fmt.Sprintf("%T", replicator))
+			continue
+		}
+		if err := planner.LoadStores(); err != nil {
+			logger.Error(err, "could not load objects")
+			return 2
+		}
+		plan, err := planner.Plan(source)
+		if err != nil {
+			logger.Error(err, "could not plan", "source", source)
+			return 2
+		}
+		plans = append(plans, plan)
+	}
+	if err := replicate.WritePlans(os.Stdout, plans, format); err != nil {
+		logger.Error(err, "could not write plan")
+		return 2
+	}
+	return 0
+}
+
+// The "migrate-annotations" subcommand
+func newMigrateAnnotationsCommand() *cobra.Command {
+	var migration replicate.AnnotationsMigration
+	var qps float64
+	var burst int
+	command := &cobra.Command{
+		Use:     "migrate-annotations --from <prefix>",
+		Aliases: []string{"migrate"},
+		Short:   "Rewrite the annotations of all the objects from a prefix to another one",
+		Long:    "Rewrite the annotations of all the objects from a prefix to another one.\nExits with 0 on success, 1 if any object failed, 2 on error.",
+		Args:    cobra.NoArgs,
+		PreRunE: func(command *cobra.Command, args []string) error {
+			if migration.To == "" {
+				migration.To = f.AnnotationsPrefix
+			}
+			if migration.From == "" {
+				return fmt.Errorf("invalid --from \"%s\": prefix expected", migration.From)
+			} else if strings.TrimSuffix(migration.From, "/") == strings.TrimSuffix(migration.To, "/") {
+				return fmt.Errorf("invalid --to \"%s\": same as --from", migration.To)
+			}
+			if qps > 0 {
+				migration.Limiter = flowcontrol.NewTokenBucketRateLimiter(float32(qps), burst)
+			}
+			return nil
+		},
+		RunE: withReplicators(func(replicators []replicate.Replicator) int {
+			return runMigrateAnnotations(replicators, migration)
+		}),
+	}
+	command.Flags().StringVar(&migration.From, "from", "", "prefix of the annotations to migrate, such as \"replicator.v1.mittwald.de\"")
+	command.Flags().StringVar(&migration.To, "to", "", "prefix to migrate the annotations to, --annotations-prefix if empty")
+	command.Flags().BoolVar(&migration.DryRun, "dry-run", false, "only log the objects that would be migrated")
+	command.Flags().Float64Var(&qps, "qps", 5, "maximum objects migrated per second, 0 for no limit")
+	command.Flags().IntVar(&burst, "burst", 10, "maximum burst of objects migrated")
+	_ = command.MarkFlagRequired("from")
+	return command
+}
+
+// Runs the "migrate-annotations" subcommand: rewrites the annotations of all the objects from a prefix to another one
+// Returns the exit code: 0 on success, 1 if any object failed, 2 on error
+func runMigrateAnnotations(replicators []replicate.Replicator, migration replicate.AnnotationsMigration) int {
+	failed := 0
+	for _, replicator := range replicators {
+		migrator, ok := replicator.(replicate.AnnotationsMigrator)
+		if !ok {
+			logger.Info("replicator cannot be migrated", "replicator", fmt.Sprintf("%T", replicator))
+			continue
+		}
+		if err := migrator.LoadStores(); err != nil {
+			logger.Error(err, "could not load objects")
+			return 2
+		}
+		_, count := migrator.MigrateAnnotations(migration)
+		failed += count
+	}
+	if failed > 0 {
+		logger.Info("some objects failed", "failedObjects", failed)
+		return 1
+	}
+	return 0
+}
+
+// The "doctor" subcommand
+func newDoctorCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor",
+		Short: "Check that all the permissions needed by the replicators are granted",
+		Long:  "Check that all the permissions needed by the replicators are granted, and list the missing ones.\nExits with 0 if all are granted, 1 if any is missing, 2 on error.",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			_, client, _, replicators, err := newReplicators(command.Context(), false)
+			if err != nil {
+				return err
+			}
+			if code := runDoctor(command.Context(), client, replicators); code != 0 {
+				os.Exit(code)
+			}
+			return nil
+		},
+	}
+}
+
+// Runs the "doctor" subcommand: prints the missing permissions
+// Returns the exit code: 0 if all are granted, 1 if any is missing, 2 on error
+func runDoctor(ctx context.Context, client kubernetes.Interface, replicators []replicate.Replicator) int {
+	var checkpoints *replicate.Checkpoints
+	if f.Checkpoint != "" {
+		var err error
+		if checkpoints, err = replicate.NewCheckpoints(client, f.Checkpoint, f.CheckpointInterval, logger); err != nil {
+			logger.Error(err, "invalid checkpoint", "checkpoint", f.Checkpoint)
+			return 2
+		}
+		checkpoints.ForShard(f.Shard)
+	}
+	denied, err := deniedPermissions(ctx, client, replicators, checkpoints)
+	if err != nil {
+		logger.Error(err, "could not check permissions")
+		return 2
+	}
+	for _, permission := range denied {
+		fmt.Printf("missing permission to %s\n", permission)
+	}
+	if len(denied) > 0 {
+		logger.Info("permissions missing", "missing", len(denied))
+		return 1
+	}
+	fmt.Println("all the permissions are granted")
+	return 0
+}
+
+// Reviews the permissions needed by the replicators, by the checkpoints if any and by the leader election,
+// and returns the denied ones
+func deniedPermissions(ctx context.Context, client kubernetes.Interface, replicators []replicate.Replicator, checkpoints *replicate.Checkpoints) ([]replicate.Permission, error) {
+	needed := []replicate.Permission{}
+	for _, replicator := range replicators {
+		if requirer, ok := replicator.(replicate.PermissionsRequirer); ok {
+			needed = append(needed, requirer.Permissions()...)
+		}
+	}
+	if checkpoints != nil {
+		needed = append(needed, checkpoints.Permissions()...)
+	}
+	if f.ControllerRuntime && f.LeaderElect {
+		needed = append(needed, leaderElectionPermissions()...)
+	}
+	return replicate.CheckPermissions(logr.NewContext(ctx, logger), client, needed)
+}
+
+// Waits for the started replicators to handle all the initially listed objects, then saves the checkpoint if any, for --once
+// Returns the exit code: 0 on success, 1 if any action failed, 2 if an informer stopped, if stopped before the end of the pass, or if the checkpoint could not be saved
+func runOnce(ctx context.Context, replicators []replicate.Replicator, gate *replicate.StartupGate, checkpoints *replicate.Checkpoints) int {
+	// stopped on SIGTERM, the startup gate being stopped too, it would never open
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		// checked first, the deletions held back are queued before it opens
+		opened := gate.Opened()
+		for _, replicator := range replicators {
+			if err := replicator.Stalled(0); err != nil {
+				return false, err
+			} else if !replicator.Ready() {
+				return false, nil
+			}
+		}
+		return opened, nil
+	}, ctx.Done())
+	if err != nil {
+		logger.Error(err, "could not reconcile")
+		return 2
+	}
+	// saved before returning, the loop of the checkpoints may stop before its last save
+	if checkpoints != nil {
+		if err := checkpoints.Save(ctx, replicators); err != nil {
+			logger.Error(err, "could not save checkpoint")
+			return 2
+		}
+	}
+	failed := 0
+	for _, replicator := range replicators {
+		failed += replicator.Status().FailedActions
+	}
+	if failed > 0 {
+		logger.Info("some actions failed", "failedActions", failed)
+		return 1
+	}
+	logger.Info("reconciled")
+	return 0
+}
+
+// The "verify-audit-log" subcommand
+func newVerifyAuditLogCommand() *cobra.Command {
+	var previous string
+	command := &cobra.Command{
+		Use:   "verify-audit-log",
+		Short: "Verify the chain of the entries of the --audit-log file, with the key of --audit-log-key-file",
+		Long:  "Verify the chain of the entries of the --audit-log file, with the key of --audit-log-key-file.\nExits with 0 if valid, 1 if the chain is broken, 2 on error.",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if code := runVerifyAuditLog(f.AuditLog, previous); code != 0 {
+				os.Exit(code)
+			}
+			return nil
+		},
+	}
+	command.Flags().StringVar(&previous, "previous", "", "hash of the last entry of the previous file, empty if the file starts the log")
+	return command
+}
+
+// Runs the "verify-audit-log" subcommand: verifies the chain of the entries of the audit log file
+// Returns the exit code: 0 if valid, 1 if the chain is broken, 2 on error
+func runVerifyAuditLog(path string, previous string) int {
+	if path == "" || path == "-" {
+		logger.Error(fmt.Errorf("requires the file of --audit-log"), "could not verify audit log")
+		return 2
+	}
+	key, err := readAuditLogKey()
+	if err != nil {
+		logger.Error(err, "could not verify audit log")
+		return 2
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Error(err, "could not open audit log", "path", path)
+		return 2
+	}
+	defer file.Close()
+	count, err := replicate.VerifyAuditLog(file, key, previous)
+	if err != nil {
+		logger.Error(err, "audit log is not valid", "path", path, "validEntries", count)
+		return 1
+	}
+	logger.Info("audit log is valid", "path", path, "entries", count)
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// onceReplicator is a started replicator, which already handled its objects
+type onceReplicator struct {
+	replicate.Replicator
+	stalled error
+	failed  int
+}
+
+func (r *onceReplicator) Stalled(threshold time.Duration) error {
+	return r.stalled
+}
+
+func (r *onceReplicator) Ready() bool {
+	return true
+}
+
+func (r *onceReplicator) Status() replicate.ReplicatorStatus {
+	return replicate.ReplicatorStatus{FailedActions: r.failed}
+}
+
+func TestRunOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	checkpoints, err := replicate.NewCheckpoints(nil, path, time.Hour, logr.Discard())
+	require.NoError(t, err)
+
+	r := &onceReplicator{}
+	assert.Equal(t, 0, runOnce(context.TODO(), []replicate.Replicator{r}, nil, nil), "no checkpoint")
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "no checkpoint")
+
+	// saved before returning, even if some actions failed
+	r.failed = 1
+	assert.Equal(t, 1, runOnce(context.TODO(), []replicate.Replicator{r}, nil, checkpoints))
+	_, err = os.Stat(path)
+	assert.NoError(t, err, "saved")
+	require.NoError(t, os.Remove(path))
+
+	r.failed = 0
+	assert.Equal(t, 0, runOnce(context.TODO(), []replicate.Replicator{r}, nil, checkpoints))
+	_, err = os.Stat(path)
+	assert.NoError(t, err, "saved")
+
+	// not saved when the pass did not complete
+	require.NoError(t, os.Remove(path))
+	r.stalled = fmt.Errorf("informer stopped")
+	assert.Equal(t, 2, runOnce(context.TODO(), []replicate.Replicator{r}, nil, checkpoints))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "not saved")
+
+	// fails when it cannot be saved
+	r.stalled = nil
+	checkpoints, err = replicate.NewCheckpoints(nil, filepath.Join(dir, "missing", "checkpoint"), time.Hour, logr.Discard())
+	require.NoError(t, err)
+	assert.Equal(t, 2, runOnce(context.TODO(), []replicate.Replicator{r}, nil, checkpoints))
+}
+
+func TestRunOnce_stopped(t *testing.T) {
+	// the startup gate is stopped too, and never opens
+	gate := replicate.NewStartupGate(time.Hour, logr.Discard())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, 2, runOnce(ctx, []replicate.Replicator{&onceReplicator{}}, gate, nil))
+}
@@ -1,17 +1,258 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Prefix of the environment variables setting the flags, such as K8S_REPLICATOR_RESYNC_PERIOD for --resync-period
+const envPrefix = "K8S_REPLICATOR_"
 
 type flags struct {
-	AnnotationsPrefix string
-	KubeConfig        string
-	ResyncPeriodS     string
-	ResyncPeriod      time.Duration
-	ReplicatorsS      string
-	Replicators       []string
-	LabelsS           string
-	Labels            map[string]string
-	StatusAddress     string
-	AllowAll          bool
-	IgnoreUnknown     bool
+	AnnotationsPrefix     string
+	CompatPrefixes        string
+	CompatWrite           bool
+	KubeConfig            string
+	ResyncPeriodS         string
+	ResyncPeriod          time.Duration
+	ResyncJitter          float64
+	WatchStallThresholdS  string
+	WatchStallThreshold   time.Duration
+	ReplicatorsS          string
+	Replicators           []string
+	LabelsS               string
+	Labels                map[string]string
+	AnnotationsS          string
+	Annotations           map[string]string
+	ManagedByLabel        string
+	SourceLabel           string
+	CreateNamespaces      bool
+	CreatableNamespaces   string
+	NamespaceLabelsS      string
+	NamespaceLabels       map[string]string
+	NamespacePrioritiesS  string
+	NamespacePriorities   []labels.Selector
+	CanarySoak            time.Duration
+	StatusAddress         string
+	AllowAll              bool
+	IgnoreUnknown         bool
+	EnablePprof           bool
+	EnableResync          bool
+	EnableTopology        bool
+	EnablePlan            bool
+	ControllerRuntime     bool
+	LeaderElect           bool
+	LeaderNamespace       string
+	HealthProbeAddress    string
+	LogLevel              string
+	LogFormat             string
+	LogDedupWindowS       string
+	LogDedupWindow        time.Duration
+	AuditLog              string
+	AuditLogKeyFile       string
+	NotifyWebhookURL      string
+	NotifyIntervalS       string
+	NotifyInterval        time.Duration
+	SourceStatus          bool
+	SourceStatusIntervalS string
+	SourceStatusInterval  time.Duration
+	TargetConditions      bool
+	StatusResources       bool
+	Once                  bool
+	ShardIndexS           string
+	Shard                 replicate.Shard
+	ControllerID          string
+	RetryBudget           int
+	RetryBaseDelayS       string
+	RetryBaseDelay        time.Duration
+	RetryMaxDelayS        string
+	RetryMaxDelay         time.Duration
+	ServerSideApply       bool
+	OrphanPolicy          string
+	DeletePropagationS    string
+	DeletePropagation     metav1.DeletionPropagation
+	OrphanGCIntervalS     string
+	OrphanGCInterval      time.Duration
+	StartupDeleteDelayS   string
+	StartupDeleteDelay    time.Duration
+	StripLastApplied      bool
+	ListPageSize          int64
+	Protobuf              bool
+	KubeAPIQPS            float64
+	KubeAPIBurst          int
+	KubeAPIMutationQPS    float64
+	KubeAPIMutationBurst  int
+	ConcurrentSyncs       int
+	NamespaceDebounce     time.Duration
+	NamespaceBatchSize    int
+	MaxQueueLength        int
+	SourceQPS             float64
+	SourceBurst           int
+	FailureThreshold      int
+	TargetBackoff         time.Duration
+	RequestTimeout        time.Duration
+	DifferentialResync    bool
+	Checkpoint            string
+	CheckpointInterval    time.Duration
+	StartupGrace          time.Duration
+	StartupGraceUpdates   bool
+	DegradedThreshold     time.Duration
+	RestartFailures       int
+	ClustersNamespace     string
+	ClusterName           string
+	ClustersInterval      time.Duration
+	ClusterCRD            bool
+	ExternalProviders     string
+	ExternalInterval      time.Duration
+	ExternalNamespaces    string
+	AWSRegion             string
+	GCPProject            string
+	Exporters             string
+	VaultAddress          string
+	VaultRole             string
+	ExportURL             string
+	DecryptSOPS           bool
+	SOPSAgeKeys           string
+	SOPSNamespaces        string
+	SealedSecrets         bool
+	SealedInterval        time.Duration
+	ReplicateSealed       bool
+	TLSNamespace          string
+	TLSInterval           time.Duration
+	ArgoCDIgnore          bool
+	ArgoCDApp             string
+	ArgoCDInstanceLabel   string
+	FluxCompat            bool
+	FluxAdopt             bool
+	ExcludeFromBackup     bool
+	BackupLabelsS         string
+	BackupLabels          map[string]string
+	KubedCompat           bool
+	Config                string
+	CheckPermissions      bool
+	KubeContext           string
+	Impersonate           string
+	ImpersonateGroups     []string
+	// the options overriding the global ones, by replicator
+	ReplicatorFlags       map[string]*replicatorFlags
+}
+
+// The options of a replicator, the global ones unless overridden
+type replicatorFlags struct {
+	ResyncPeriod time.Duration
+	AllowAll     bool
+	LabelsS      string
+	Labels       map[string]string
+}
+
+// Returns the environment variable setting a flag
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Reads a YAML config file, whose keys are the names of the flags, without dashes
+// The lists are joined with commas, and the maps joined as comma separated key=value
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &values, func(decoder *json.Decoder) *json.Decoder {
+		decoder.UseNumber()
+		return decoder
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]string{}
+	for name, value := range values {
+		switch value := value.(type) {
+		case nil:
+			config[name] = ""
+		case []interface{}:
+			items := []string{}
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			config[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			items := []string{}
+			for key, item := range value {
+				items = append(items, fmt.Sprintf("%s=%v", key, item))
+			}
+			sort.Strings(items)
+			config[name] = strings.Join(items, ",")
+		default:
+			config[name] = fmt.Sprint(value)
+		}
+	}
+	return config, nil
+}
+
+// Sets the flags not set on the command line from their environment variable, else from the config file
+// The command line has precedence over the environment, which has precedence over the config file
+func applyConfig(flagSet *pflag.FlagSet, config map[string]string) error {
+	for name := range config {
+		if flagSet.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %s in config file", name)
+		}
+	}
+	var err error
+	flagSet.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed {
+			return
+		}
+		if value, ok := os.LookupEnv(flagEnv(flag.Name)); ok {
+			if setErr := flagSet.Set(flag.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s \"%s\": %s", flagEnv(flag.Name), value, setErr)
+			}
+		} else if value, ok := config[flag.Name]; ok {
+			if setErr := flagSet.Set(flag.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s \"%s\" in config file: %s", flag.Name, value, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// Returns the names of a comma separated list, without the empty ones
+func splitNames(list string) []string {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the labels, or annotations, of a comma separated list of key=value, the flag is only used in the error
+func splitLabels(list string, flagName string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, labelValue := range strings.Split(list, ",") {
+		labelValue = strings.Trim(labelValue, " ")
+		if labelValue == "" {
+			continue
+		} else if parts := strings.Split(labelValue, "="); len(parts) != 2 {
+		} else if label := strings.Trim(parts[0], " "); label == "" {
+		} else if value := strings.Trim(parts[1], " "); value == "" {
+		} else {
+			labels[label] = value
+			continue
+		}
+		return nil, fmt.Errorf("invalid --%s \"%s\": format key=value expected", flagName, labelValue)
+	}
+	return labels, nil
 }
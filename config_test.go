@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected map[string]string
+		err      bool
+	}{{
+		name:     "scalars",
+		content:  "resync-period: 10m\nlog-level: 2\ncreate-target-namespaces: true\nannotations-prefix:\n",
+		expected: map[string]string{"resync-period": "10m", "log-level": "2", "create-target-namespaces": "true", "annotations-prefix": ""},
+	}, {
+		name:     "list joined with commas",
+		content:  "run-replicators: [secret, configmap]\n",
+		expected: map[string]string{"run-replicators": "secret,configmap"},
+	}, {
+		name:     "map joined as sorted key=value",
+		content:  "labels:\n  team: infra\n  app: replicator\n",
+		expected: map[string]string{"labels": "app=replicator,team=infra"},
+	}, {
+		name:     "large number kept as it is",
+		content:  "list-page-size: 10000000000\n",
+		expected: map[string]string{"list-page-size": "10000000000"},
+	}, {
+		name:    "invalid YAML",
+		content: "resync-period: [\n",
+		err:     true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(test.content), 0600))
+			config, err := readConfigFile(path)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, config)
+		})
+	}
+
+	_, err := readConfigFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		config   map[string]string
+		expected map[string]string
+		err      string
+	}{{
+		name:     "defaults",
+		expected: map[string]string{"resync-period": "30m0s", "run-replicators": "all"},
+	}, {
+		name:     "config file",
+		config:   map[string]string{"resync-period": "10m"},
+		expected: map[string]string{"resync-period": "10m0s", "run-replicators": "all"},
+	}, {
+		name:     "environment over config file",
+		env:      map[string]string{"K8S_REPLICATOR_RESYNC_PERIOD": "20m"},
+		config:   map[string]string{"resync-period": "10m", "run-replicators": "secret"},
+		expected: map[string]string{"resync-period": "20m0s", "run-replicators": "secret"},
+	}, {
+		name:     "flags over environment and config file",
+		args:     []string{"--resync-period", "40m"},
+		env:      map[string]string{"K8S_REPLICATOR_RESYNC_PERIOD": "20m", "K8S_REPLICATOR_RUN_REPLICATORS": "configmap"},
+		config:   map[string]string{"resync-period": "10m", "run-replicators": "secret"},
+		expected: map[string]string{"resync-period": "40m0s", "run-replicators": "configmap"},
+	}, {
+		name:     "empty environment variable",
+		env:      map[string]string{"K8S_REPLICATOR_RUN_REPLICATORS": ""},
+		config:   map[string]string{"run-replicators": "secret"},
+		expected: map[string]string{"resync-period": "30m0s", "run-replicators": ""},
+	}, {
+		name:   "unknown flag in config file",
+		config: map[string]string{"unknown": "value"},
+		err:    "unknown flag unknown in config file",
+	}, {
+		name: "invalid environment variable",
+		env:  map[string]string{"K8S_REPLICATOR_RESYNC_PERIOD": "never"},
+		err:  "invalid K8S_REPLICATOR_RESYNC_PERIOD \"never\"",
+	}, {
+		name:   "invalid config file value",
+		config: map[string]string{"resync-period": "never"},
+		err:    "invalid resync-period \"never\" in config file",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			flagSet := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			flagSet.Duration("resync-period", 30*time.Minute, "")
+			flagSet.String("run-replicators", "all", "")
+			require.NoError(t, flagSet.Parse(test.args))
+			err := applyConfig(flagSet, test.config)
+			if test.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.err)
+				return
+			}
+			require.NoError(t, err)
+			for name, value := range test.expected {
+				assert.Equal(t, value, flagSet.Lookup(name).Value.String(), name)
+			}
+		})
+	}
+}
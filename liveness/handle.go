@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/olli-ai/k8s-replicator/replicate"
 )
@@ -12,29 +13,46 @@ type response struct {
 	NotReady []string `json:"notReady"`
 }
 
+type verboseStatus struct {
+	replicate.ReplicatorStatus
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type verboseResponse struct {
+	Healthy     bool            `json:"healthy"`
+	Replicators []verboseStatus `json:"replicators"`
+}
+
 // Handler implements a HTTP response handler that reports on the current
 // liveness status of the controller
 type Handler struct {
+	Replicators    []replicate.Replicator
+	// an informer receiving nothing for longer is reported as stalled, 0 to disable
+	StallThreshold time.Duration
+}
+
+// ReadinessHandler implements a HTTP response handler that reports if the
+// controller is ready: synced, and done with the initially listed objects
+type ReadinessHandler struct {
 	Replicators []replicate.Replicator
 }
 
-func (h *Handler) notReadyComponents() []string {
+func notReadyComponents(replicators []replicate.Replicator, ready func(replicate.Replicator) bool) []string {
 	notReady := make([]string, 0)
 
-	for i := range h.Replicators {
-		synced := h.Replicators[i].Synced()
-
-		if !synced {
-			notReady = append(notReady, fmt.Sprintf("%T", h.Replicators[i]))
+	for i := range replicators {
+		if !ready(replicators[i]) {
+			notReady = append(notReady, fmt.Sprintf("%T", replicators[i]))
 		}
 	}
 
 	return notReady
 }
 
-func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+func serveStatus(res http.ResponseWriter, notReady []string) {
 	r := response{
-		NotReady: h.notReadyComponents(),
+		NotReady: notReady,
 	}
 
 	if len(r.NotReady) > 0 {
@@ -46,3 +64,56 @@ func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	enc := json.NewEncoder(res)
 	_ = enc.Encode(&r)
 }
+
+// Serves the detailed status of each replicator
+func (h *Handler) serveVerbose(res http.ResponseWriter) {
+	r := verboseResponse{
+		Healthy:     true,
+		Replicators: make([]verboseStatus, 0, len(h.Replicators)),
+	}
+	for i := range h.Replicators {
+		status := verboseStatus{
+			ReplicatorStatus: h.Replicators[i].Status(),
+			Healthy:          true,
+		}
+		if err := h.Replicators[i].Stalled(h.StallThreshold); err != nil {
+			status.Healthy = false
+			status.Error = err.Error()
+		} else if err := h.Replicators[i].Healthy(); err != nil {
+			status.Healthy = false
+			status.Error = err.Error()
+		}
+		r.Healthy = r.Healthy && status.Healthy
+		r.Replicators = append(r.Replicators, status)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if r.Healthy {
+		res.WriteHeader(http.StatusOK)
+	} else {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	enc := json.NewEncoder(res)
+	_ = enc.Encode(&r)
+}
+
+func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if verbose := req.URL.Query().Get("verbose"); verbose != "" && verbose != "0" && verbose != "false" {
+		h.serveVerbose(res)
+		return
+	}
+	notReady := make([]string, 0)
+	for i := range h.Replicators {
+		if err := h.Replicators[i].Healthy(); err != nil {
+			notReady = append(notReady, fmt.Sprintf("%T: %s", h.Replicators[i], err))
+		} else if err := h.Replicators[i].Stalled(h.StallThreshold); err != nil {
+			notReady = append(notReady, fmt.Sprintf("%T: %s", h.Replicators[i], err))
+		}
+	}
+	serveStatus(res, notReady)
+}
+
+func (h *ReadinessHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	serveStatus(res, notReadyComponents(h.Replicators, replicate.Replicator.Ready))
+}
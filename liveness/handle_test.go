@@ -1,9 +1,13 @@
 package liveness
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/olli-ai/k8s-replicator/replicate"
 
@@ -11,16 +15,56 @@ import (
 )
 
 type MockReplicator struct {
-	synced bool
+	synced  bool
+	ready   bool
+	stalled error
 }
 
 func (r *MockReplicator) Start() {
 }
 
+func (r *MockReplicator) Run(ctx context.Context) error {
+	return nil
+}
+
+func (r *MockReplicator) Stop() {
+}
+
+func (r *MockReplicator) Healthy() error {
+	if !r.synced {
+		return fmt.Errorf("not synced")
+	}
+	return nil
+}
+
+func (r *MockReplicator) Stats() replicate.ReplicatorStats {
+	return replicate.ReplicatorStats{}
+}
+
 func (r *MockReplicator) Synced() bool {
 	return r.synced
 }
 
+func (r *MockReplicator) Ready() bool {
+	return r.ready
+}
+
+func (r *MockReplicator) Stalled(threshold time.Duration) error {
+	return r.stalled
+}
+
+func (r *MockReplicator) Resync() bool {
+	return true
+}
+
+func (r *MockReplicator) Status() replicate.ReplicatorStatus {
+	return replicate.ReplicatorStatus{
+		Resource: "mock",
+		Synced:   r.synced,
+		Ready:    r.ready,
+	}
+}
+
 func buildReqRes(t *testing.T) (*http.Request, *httptest.ResponseRecorder) {
 	req, err := http.NewRequest("GET", "/status", nil)
 	res := httptest.NewRecorder()
@@ -58,3 +102,103 @@ func TestReturns503IfOneReplicatorIsNotSynced(t *testing.T) {
 
 	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
 }
+
+func TestReturns503WithTheErrorOfAnUnhealthyReplicator(t *testing.T) {
+	req, res := buildReqRes(t)
+
+	handler := Handler{
+		Replicators: []replicate.Replicator{
+			&MockReplicator{synced: true},
+			&MockReplicator{synced: false},
+		},
+	}
+
+	handler.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Contains(t, res.Body.String(), "*liveness.MockReplicator: not synced")
+}
+
+func TestReadinessReturns200IfAllReplicatorsAreReady(t *testing.T) {
+	req, res := buildReqRes(t)
+
+	handler := ReadinessHandler{
+		Replicators: []replicate.Replicator{
+			&MockReplicator{synced: true, ready: true},
+			&MockReplicator{synced: true, ready: true},
+		},
+	}
+
+	handler.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestReadinessReturns503IfOneReplicatorIsNotReady(t *testing.T) {
+	req, res := buildReqRes(t)
+
+	handler := ReadinessHandler{
+		Replicators: []replicate.Replicator{
+			&MockReplicator{synced: true, ready: true},
+			&MockReplicator{synced: true, ready: false},
+		},
+	}
+
+	handler.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+}
+
+func TestReturns503IfOneReplicatorIsStalled(t *testing.T) {
+	req, res := buildReqRes(t)
+
+	handler := Handler{
+		Replicators: []replicate.Replicator{
+			&MockReplicator{synced: true},
+			&MockReplicator{synced: true, stalled: fmt.Errorf("secret informer stopped")},
+		},
+		StallThreshold: time.Minute,
+	}
+
+	handler.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Contains(t, res.Body.String(), "secret informer stopped")
+}
+
+func TestVerboseReturnsStatusPerReplicator(t *testing.T) {
+	for _, example := range []struct {
+		replicators []replicate.Replicator
+		code        int
+		healthy     []bool
+	}{
+		{
+			[]replicate.Replicator{&MockReplicator{synced: true}, &MockReplicator{synced: true}},
+			http.StatusOK, []bool{true, true},
+		},
+		{
+			[]replicate.Replicator{&MockReplicator{synced: true}, &MockReplicator{synced: false}},
+			http.StatusServiceUnavailable, []bool{true, false},
+		},
+	} {
+		req, err := http.NewRequest("GET", "/healthz?verbose=1", nil)
+		assert.Nil(t, err)
+		res := httptest.NewRecorder()
+
+		handler := Handler{
+			Replicators: example.replicators,
+		}
+
+		handler.ServeHTTP(res, req)
+
+		assert.Equal(t, example.code, res.Code)
+		r := verboseResponse{}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &r))
+		healthy := []bool{}
+		for _, status := range r.Replicators {
+			assert.Equal(t, "mock", status.Resource)
+			healthy = append(healthy, status.Healthy)
+		}
+		assert.Equal(t, example.healthy, healthy)
+	}
+}
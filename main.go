@@ -1,122 +1,871 @@
 package main
 
 import (
-	"flag"
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/olli-ai/k8s-replicator/liveness"
 	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 var f flags
+var logger logr.Logger
 
-func init() {
+// Adds the flags shared by all the commands
+func addFlags(flagSet *pflag.FlagSet) {
+	flagSet.StringVar(&f.AnnotationsPrefix, "annotations-prefix", "k8s-replicator", "prefix for all annotations")
+	flagSet.StringVar(&f.CompatPrefixes, "compat-prefixes", "", "comma-separated legacy prefixes whose annotations are read along with the prefixed ones, in order of precedence, such as \""+replicate.MittwaldPrefix+"\"")
+	flagSet.BoolVar(&f.CompatWrite, "write-compat-annotations", false, "write the annotations of the replicator with the legacy prefixes of --compat-prefixes too, to be able to roll back")
+	flagSet.StringVar(&f.KubeConfig, "kube-config", "", "path to Kubernetes config file")
+	flagSet.StringVar(&f.ResyncPeriodS, "resync-period", "30m", "resynchronization period")
+	flagSet.Float64Var(&f.ResyncJitter, "resync-jitter", 0.1, "maximum fraction of the resynchronization period randomly added to it, per replicator")
+	flagSet.StringVar(&f.ReplicatorsS, "run-replicators", "all", "replicators to run")
+	flagSet.StringVar(&f.LabelsS, "create-with-labels", "app.kubernetes.io/managed-by=k8s-replicator", "labels to add to created resources")
+	flagSet.StringVar(&f.StatusAddress, "status-address", ":9102", "listen address for status and monitoring server")
+	flagSet.BoolVar(&f.AllowAll, "allow-all", false, "allow replication of all secrets by default (CAUTION: only use when you know what you're doing)")
+	flagSet.BoolVar(&f.IgnoreUnknown, "ignore-unknown", false, "unkown annotations with the same prefix do not raise an error")
+	flagSet.StringVar(&f.WatchStallThresholdS, "watch-stall-threshold", "20m", "report unhealthy when an informer receives nothing for longer, 0 to only detect stopped informers")
+	flagSet.BoolVar(&f.EnablePprof, "enable-pprof", false, "serve the pprof profiling endpoints at /debug/pprof/ on the status server")
+	flagSet.BoolVar(&f.EnableResync, "enable-resync-endpoint", false, "serve the unauthenticated /resync endpoint forcing a resync on POST on the status server")
+	flagSet.BoolVar(&f.EnablePlan, "enable-plan-endpoint", false, "serve the unauthenticated /plan endpoint computing the actions for a source on the status server")
+	flagSet.BoolVar(&f.EnableTopology, "enable-topology-endpoint", false, "serve the unauthenticated /topology and /topology/graph endpoints listing the sources and their targets on the status server")
+	flagSet.BoolVar(&f.ControllerRuntime, "controller-runtime", false, "run the replicators as controllers of a controller-runtime manager, with its cache, leader election and health probes")
+	flagSet.BoolVar(&f.LeaderElect, "leader-elect", false, "with --controller-runtime, only run the replicators in the elected replica")
+	flagSet.StringVar(&f.LeaderNamespace, "leader-election-namespace", "", "namespace of the leader election lease, empty for the namespace of the pod")
+	flagSet.StringVar(&f.HealthProbeAddress, "health-probe-address", ":8081", "with --controller-runtime, listen address for the /healthz and /readyz probes of the manager")
+	flagSet.StringVar(&f.LogLevel, "log-level", "info", "minimum level of the logs: error, info or debug")
+	flagSet.StringVar(&f.LogFormat, "log-format", "text", "format of the logs: text or json")
+	flagSet.StringVar(&f.AuditLog, "audit-log", "", "file to append the audit log of all the performed actions to, \"-\" for stdout")
+	flagSet.StringVar(&f.AuditLogKeyFile, "audit-log-key-file", "", "file holding the key of the HMAC-SHA256 hashes chaining the entries of the audit log, such that they cannot be forged without it")
+	flagSet.StringVar(&f.NotifyWebhookURL, "notify-webhook-url", "", "webhook to send the replication failures to")
+	flagSet.StringVar(&f.NotifyIntervalS, "notify-interval", "5m", "interval between batches of notifications")
+	flagSet.StringVar(&f.LogDedupWindowS, "log-dedup-window", "1h", "period during which a repeated error about the same object is logged only once, 0 to disable")
+	flagSet.BoolVar(&f.SourceStatus, "source-status", false, "write a summary of the replication status onto the sources")
+	flagSet.StringVar(&f.SourceStatusIntervalS, "source-status-interval", "1m", "minimum interval between two status writes on the same source")
+	flagSet.BoolVar(&f.TargetConditions, "target-conditions", false, "write the state of the replication onto the targets")
+	flagSet.BoolVar(&f.StatusResources, "status-resources", false, "write the status of each source onto a ReplicationStatus resource in its namespace")
+	flagSet.BoolVar(&f.Once, "once", false, "exit after one full reconcile pass, with a non-zero code if any action failed")
+	flagSet.StringVar(&f.ShardIndexS, "shard-index", "0", "index of this instance when sharding, \"auto\" for the ordinal of a StatefulSet pod")
+	flagSet.IntVar(&f.Shard.Count, "shard-count", 1, "count of instances sharing the sources by namespace")
+	flagSet.StringVar(&f.ControllerID, "controller-id", "", "identity recorded on the targets, targets recorded with another identity are not modified")
+	flagSet.IntVar(&f.RetryBudget, "retry-budget", 5, "how many times a failed object is retried before waiting for its next change, 0 to retry it until it succeeds")
+	flagSet.StringVar(&f.RetryBaseDelayS, "retry-base-delay", "5ms", "delay before the first retry of a failed object, doubled on each retry")
+	flagSet.StringVar(&f.RetryMaxDelayS, "retry-max-delay", "5m", "maximum delay between two retries of a failed object")
+	flagSet.BoolVar(&f.ServerSideApply, "server-side-apply", true, "server-side apply the installs and updates, false to fall back to plain updates")
+	flagSet.StringVar(&f.OrphanPolicy, "orphan-policy", "ignore", "what to do with the targets whose source does not target them anymore: delete, disown or ignore")
+	flagSet.StringVar(&f.OrphanGCIntervalS, "orphan-gc-interval", "1h", "interval between two collections of the orphaned targets, 0 to disable")
+	flagSet.StringVar(&f.StartupDeleteDelayS, "startup-delete-delay", "30s", "delay after all the replicators are ready before deleting any target")
+	flagSet.BoolVar(&f.StripLastApplied, "strip-last-applied", false, "do not store the last applied configuration of kubectl on the targets created by replication, it is then removed from the updated targets")
+	flagSet.Int64Var(&f.ListPageSize, "list-page-size", 500, "count of secrets or configMaps per page of the lists, 0 to list all of them at once")
+	flagSet.BoolVar(&f.Protobuf, "protobuf", true, "talk protobuf instead of json with the API server, cheaper for large secrets and configMaps")
+	flagSet.Float64Var(&f.KubeAPIQPS, "kube-api-qps", 5, "maximum queries per second to the API server")
+	flagSet.IntVar(&f.KubeAPIBurst, "kube-api-burst", 10, "maximum burst of queries to the API server")
+	flagSet.Float64Var(&f.KubeAPIMutationQPS, "kube-api-mutation-qps", 0, "maximum creations, updates and deletions per second, on top of --kube-api-qps, 0 to disable")
+	flagSet.IntVar(&f.KubeAPIMutationBurst, "kube-api-mutation-burst", 10, "maximum burst of creations, updates and deletions")
+	flagSet.IntVar(&f.ConcurrentSyncs, "concurrent-syncs", 4, "how many targets of a source are synced at once, one at once per namespace")
+	flagSet.DurationVar(&f.NamespaceDebounce, "namespace-debounce", time.Second, "how long the added namespaces are aggregated before being handled by batches, 0 to handle them one by one")
+	flagSet.IntVar(&f.NamespaceBatchSize, "namespace-batch-size", 50, "maximum count of added namespaces handled per batch, 0 for no limit")
+	flagSet.IntVar(&f.MaxQueueLength, "max-queue-length", 10000, "maximum count of items in the work queue of each replicator, the events are dropped and recomputed beyond, 0 for no limit")
+	flagSet.Float64Var(&f.SourceQPS, "source-qps", 0, "how many times per second each secret or configMap may be handled, 0 for no limit")
+	flagSet.IntVar(&f.SourceBurst, "source-burst", 5, "how many times each secret or configMap may be handled at once, beyond --source-qps")
+	flagSet.IntVar(&f.FailureThreshold, "target-failure-threshold", 0, "consecutive failures after which a target is backed off, while the other targets are still replicated, 0 to never back off")
+	flagSet.DurationVar(&f.TargetBackoff, "target-backoff", time.Minute, "how long a failing target is first backed off, doubled each time it fails again, up to an hour")
+	flagSet.DurationVar(&f.RequestTimeout, "request-timeout", 30*time.Second, "how long each request to kubernetes may take before being cancelled, 0 for no limit")
+	flagSet.BoolVar(&f.DifferentialResync, "differential-resync", false, "skip on periodic resync the objects which did not change, nor their targets and sources, since last handled successfully")
+	flagSet.StringVar(&f.Checkpoint, "checkpoint", "", "file, or \"configmap:<namespace>/<name>\", where the states of the handled objects are checkpointed, such that the unchanged ones are not handled again after a restart, empty to disable")
+	flagSet.DurationVar(&f.CheckpointInterval, "checkpoint-interval", time.Minute, "how often the states of the handled objects are checkpointed")
+	flagSet.DurationVar(&f.StartupGrace, "startup-grace", 0, "minimum observe-only window after startup, during which the intended deletions are only logged and counted")
+	flagSet.BoolVar(&f.StartupGraceUpdates, "startup-grace-updates", false, "hold back the updates of the existing targets too during the startup safety window")
+	flagSet.DurationVar(&f.DegradedThreshold, "degraded-threshold", 10*time.Minute, "suspend the deletions when an informer receives nothing for longer, or keeps failing, 0 to never suspend them")
+	flagSet.IntVar(&f.RestartFailures, "informer-restart-failures", 10, "consecutive failures of the lists and watches after which an informer is restarted, 0 to never restart it")
+	flagSet.StringVar(&f.ClustersNamespace, "clusters-namespace", "", "namespace of the secrets holding the kubeconfigs of the remote clusters, named after them, empty to never push to remote clusters")
+	flagSet.StringVar(&f.ClusterName, "cluster-name", "", "name of this cluster, recorded on the targets pushed to the remote clusters")
+	flagSet.DurationVar(&f.ClustersInterval, "clusters-interval", time.Minute, "how often the remote clusters are loaded again from their secrets and checked")
+	flagSet.BoolVar(&f.ClusterCRD, "cluster-crd", false, "read the remote clusters from the ReplicationCluster resources too, and report their status onto them")
+	flagSet.StringVar(&f.ExternalProviders, "external-providers", "", "comma separated providers of the external stores the sources may be pulled from: aws-secretsmanager, aws-ssm, gcp-secretmanager, azure-keyvault, empty to never pull them")
+	flagSet.StringVar(&f.ExternalNamespaces, "external-allowed-namespaces", "", "comma separated names or patterns of the namespaces whose sources may be pulled from the external stores, required by --external-providers")
+	flagSet.DurationVar(&f.ExternalInterval, "external-interval", 5*time.Minute, "how often the sources are pulled again from the external stores")
+	flagSet.StringVar(&f.AWSRegion, "aws-region", os.Getenv("AWS_REGION"), "region of the AWS external stores")
+	flagSet.StringVar(&f.GCPProject, "gcp-project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "project of the GCP secrets not named with their project")
+	flagSet.StringVar(&f.Exporters, "exporters", "", "comma separated exporters the sources may be exported to: vault, s3, http, empty to never export them")
+	flagSet.StringVar(&f.VaultAddress, "vault-address", os.Getenv("VAULT_ADDR"), "address of the Vault the sources are exported to")
+	flagSet.StringVar(&f.VaultRole, "vault-role", "", "role to log in to Vault with the kubernetes auth method, empty to use VAULT_TOKEN")
+	flagSet.StringVar(&f.ExportURL, "export-url", "", "base URL the sources are put under by the http exporter")
+	flagSet.BoolVar(&f.DecryptSOPS, "decrypt-sops", false, "decrypt the SOPS-encrypted secrets with the decrypt-sops annotation before replicating them")
+	flagSet.StringVar(&f.SOPSAgeKeys, "sops-age-keys", os.Getenv("SOPS_AGE_KEY_FILE"), "file of the age identities decrypting the SOPS documents, such as a mounted secret, empty to only use AWS KMS")
+	flagSet.StringVar(&f.SOPSNamespaces, "sops-allowed-namespaces", "", "comma separated names or patterns of the namespaces whose secrets may be decrypted, required by --decrypt-sops")
+	flagSet.BoolVar(&f.SealedSecrets, "sealed-secrets", false, "replicate the secrets unsealed from SealedSecrets with the replication annotations of their SealedSecret")
+	flagSet.DurationVar(&f.SealedInterval, "sealed-secrets-interval", time.Minute, "how often the changes of the SealedSecrets which could not be handled yet are handled again")
+	flagSet.BoolVar(&f.ReplicateSealed, "replicate-sealed", false, "replicate the cluster-wide SealedSecrets themselves instead of their unsealed secrets, for the targets managed by GitOps")
+	flagSet.StringVar(&f.TLSNamespace, "tls-secrets-namespace", "", "the central namespace whose secrets are replicated to the namespaces referencing them as TLS secrets of their Ingresses or Gateways, empty to disable")
+	flagSet.DurationVar(&f.TLSInterval, "tls-secrets-interval", time.Minute, "the resync period of the informers of the Ingresses, the Gateways and the TLS secrets")
+	flagSet.BoolVar(&f.ArgoCDIgnore, "argocd-ignore", false, "annotate the created targets such that ArgoCD ignores them during its diffs and prunes")
+	flagSet.StringVar(&f.ArgoCDApp, "argocd-app", "", "the ArgoCD application the created targets are tracked to, ignored during its diffs and prunes, empty to not track them")
+	flagSet.StringVar(&f.ArgoCDInstanceLabel, "argocd-instance-label", replicate.ArgoCDInstanceLabel, "the label tracking the resources of the ArgoCD application")
+	flagSet.BoolVar(&f.FluxCompat, "flux-compat", false, "keep the Flux labels of the existing targets only, and refuse to adopt the targets managed by Flux")
+	flagSet.BoolVar(&f.FluxAdopt, "flux-adopt", false, "with --flux-compat, adopt the targets managed by Flux as any other one")
+	flagSet.BoolVar(&f.ExcludeFromBackup, "exclude-from-backup", false, "label the created targets such that they are excluded from the backups, since they can be replicated again")
+	flagSet.StringVar(&f.BackupLabelsS, "backup-exclusion-labels", "velero.io/exclude-from-backup=true", "the labels excluding the created targets from the backups, with --exclude-from-backup")
+	flagSet.BoolVar(&f.KubedCompat, "kubed-compat", false, "replicate the sources synced by kubed to the namespaces of their kubed.appscode.com/sync label selector")
+	flagSet.StringVar(&f.Config, "config", "", "YAML file of the flags by name, such as \"resync-period: 10m\", overridden by the "+envPrefix+"* environment variables, themselves overridden by the command line")
+	flagSet.BoolVar(&f.CheckPermissions, "check-permissions", false, "check on startup that all the needed permissions are granted, and exit listing the missing ones otherwise")
+	flagSet.StringVar(&f.KubeContext, "kube-context", "", "context of the Kubernetes config file to use, empty for its current context")
+	flagSet.StringVar(&f.Impersonate, "as", "", "user to impersonate for the requests to the API server")
+	flagSet.StringSliceVar(&f.ImpersonateGroups, "as-group", nil, "group to impersonate for the requests to the API server, with --as, repeated or comma separated for several groups")
+	flagSet.StringVar(&f.AnnotationsS, "create-with-annotations", "", "annotations to add to created resources, the ones of the replicator have precedence")
+	flagSet.StringVar(&f.ManagedByLabel, "managed-by-label", "", "label=value stamped on all the targets, such as \"app.kubernetes.io/managed-by=k8s-replicator\", empty to disable")
+	flagSet.StringVar(&f.SourceLabel, "source-label", "", "label stamped on all the targets with their source as value, \"<namespace>.<name>\", empty to disable")
+	flagSet.StringVar(&f.DeletePropagationS, "delete-propagation", "", "propagation policy of the deletions of targets: orphan, background or foreground, empty for the default of the API server")
+	flagSet.BoolVar(&f.CreateNamespaces, "create-target-namespaces", false, "create the missing namespaces of the explicit replicate-to targets, instead of cancelling their replication")
+	flagSet.StringVar(&f.CreatableNamespaces, "creatable-target-namespaces", "", "comma separated names or patterns of the namespaces that may be created, required by --create-target-namespaces")
+	flagSet.StringVar(&f.NamespaceLabelsS, "target-namespace-labels", "", "labels to add to the namespaces created with --create-target-namespaces")
+	flagSet.StringVar(&f.NamespacePrioritiesS, "namespace-priorities", "", "label selectors of the namespaces whose targets are synced first, in order, separated by \";\", such as \"tier=critical;tier=high\", the other namespaces last")
+	flagSet.DurationVar(&f.CanarySoak, "canary-soak", 10*time.Minute, "how long the canary targets of a changed source with the replicate-canary annotation soak before its other targets receive it, 0 to wait for its canary-approved-version annotation")
+
+	f.ReplicatorFlags = map[string]*replicatorFlags{}
+	for _, name := range replicatorNames() {
+		replicatorFlags := &replicatorFlags{}
+		f.ReplicatorFlags[name] = replicatorFlags
+		flagSet.DurationVar(&replicatorFlags.ResyncPeriod, "resync-period-"+name, 0, "resynchronization period of the "+name+" replicator, instead of --resync-period")
+		flagSet.BoolVar(&replicatorFlags.AllowAll, "allow-all-"+name, false, "allow replication of all the "+name+"s by default, instead of --allow-all")
+		flagSet.StringVar(&replicatorFlags.LabelsS, "create-with-labels-"+name, "", "labels to add to the created "+name+"s, instead of --create-with-labels")
+	}
+}
+
+// Completes the flags from the environment and the config file, validates them, and sets up the logger and the annotations accordingly
+func setUp(command *cobra.Command, args []string) error {
 	var err error
-	flag.StringVar(&f.AnnotationsPrefix, "annotations-prefix", "k8s-replicator", "prefix for all annotations")
-	flag.StringVar(&f.KubeConfig, "kube-config", "", "path to Kubernetes config file")
-	flag.StringVar(&f.ResyncPeriodS, "resync-period", "30m", "resynchronization period")
-	flag.StringVar(&f.ReplicatorsS, "run-replicators", "all", "replicators to run")
-	flag.StringVar(&f.LabelsS, "create-with-labels", "app.kubernetes.io/managed-by=k8s-replicator", "labels to add to created resources")
-	flag.StringVar(&f.StatusAddress, "status-address", ":9102", "listen address for status and monitoring server")
-	flag.BoolVar(&f.AllowAll, "allow-all", false, "allow replication of all secrets by default (CAUTION: only use when you know what you're doing)")
-	flag.BoolVar(&f.IgnoreUnknown, "ignore-unknown", false, "unkown annotations with the same prefix do not raise an error")
-	flag.Parse()
-
-	replicate.PrefixAnnotations(f.AnnotationsPrefix)
+
+	flagSet := command.Root().PersistentFlags()
+	config := map[string]string{}
+	if value, ok := os.LookupEnv(flagEnv("config")); ok && !flagSet.Changed("config") {
+		f.Config = value
+	}
+	if f.Config != "" {
+		if config, err = readConfigFile(f.Config); err != nil {
+			return fmt.Errorf("invalid --config \"%s\": %s", f.Config, err)
+		}
+		delete(config, "config")
+	}
+	if err = applyConfig(flagSet, config); err != nil {
+		return err
+	}
+
+	if logger, err = replicate.NewLogger(f.LogLevel, f.LogFormat, os.Stderr); err != nil {
+		return fmt.Errorf("invalid logging options: %s", err)
+	}
+	if f.LogDedupWindow, err = time.ParseDuration(f.LogDedupWindowS); err != nil {
+		return fmt.Errorf("invalid --log-dedup-window \"%s\": %s", f.LogDedupWindowS, err)
+	}
+	logger = replicate.RateLimitLogger(logger, f.LogDedupWindow)
 
 	if f.ResyncPeriod, err = time.ParseDuration(f.ResyncPeriodS); err != nil {
-		panic(fmt.Errorf("invalid --resync-period \"%s\": %s", f.ResyncPeriodS, err))
+		return fmt.Errorf("invalid --resync-period \"%s\": %s", f.ResyncPeriodS, err)
 	}
 
-	for _, replicator := range strings.Split(f.ReplicatorsS, ",") {
-		if replicator = strings.Trim(replicator, " "); replicator != "" {
-			f.Replicators = append(f.Replicators, strings.ToLower(replicator))
+	if f.ResyncJitter < 0 {
+		return fmt.Errorf("invalid --resync-jitter \"%g\": must not be negative", f.ResyncJitter)
+	}
+
+	if f.WatchStallThreshold, err = time.ParseDuration(f.WatchStallThresholdS); err != nil {
+		return fmt.Errorf("invalid --watch-stall-threshold \"%s\": %s", f.WatchStallThresholdS, err)
+	}
+
+	if f.NotifyInterval, err = time.ParseDuration(f.NotifyIntervalS); err != nil {
+		return fmt.Errorf("invalid --notify-interval \"%s\": %s", f.NotifyIntervalS, err)
+	} else if f.NotifyInterval <= 0 {
+		return fmt.Errorf("invalid --notify-interval \"%s\": must be positive", f.NotifyIntervalS)
+	}
+
+	if f.SourceStatusInterval, err = time.ParseDuration(f.SourceStatusIntervalS); err != nil {
+		return fmt.Errorf("invalid --source-status-interval \"%s\": %s", f.SourceStatusIntervalS, err)
+	}
+
+	if f.RetryBudget < 0 {
+		return fmt.Errorf("invalid --retry-budget \"%d\": must not be negative", f.RetryBudget)
+	}
+	if f.RetryBaseDelay, err = time.ParseDuration(f.RetryBaseDelayS); err != nil {
+		return fmt.Errorf("invalid --retry-base-delay \"%s\": %s", f.RetryBaseDelayS, err)
+	}
+	if f.RetryMaxDelay, err = time.ParseDuration(f.RetryMaxDelayS); err != nil {
+		return fmt.Errorf("invalid --retry-max-delay \"%s\": %s", f.RetryMaxDelayS, err)
+	}
+
+	if err = replicate.ValidateOrphanPolicy(f.OrphanPolicy); err != nil {
+		return fmt.Errorf("invalid --orphan-policy \"%s\": %s", f.OrphanPolicy, err)
+	}
+	if f.OrphanGCInterval, err = time.ParseDuration(f.OrphanGCIntervalS); err != nil {
+		return fmt.Errorf("invalid --orphan-gc-interval \"%s\": %s", f.OrphanGCIntervalS, err)
+	}
+
+	if f.KubeAPIQPS <= 0 {
+		return fmt.Errorf("invalid --kube-api-qps \"%g\": must be positive", f.KubeAPIQPS)
+	} else if f.KubeAPIBurst <= 0 {
+		return fmt.Errorf("invalid --kube-api-burst \"%d\": must be positive", f.KubeAPIBurst)
+	} else if f.KubeAPIMutationQPS < 0 {
+		return fmt.Errorf("invalid --kube-api-mutation-qps \"%g\": must not be negative", f.KubeAPIMutationQPS)
+	} else if f.KubeAPIMutationBurst <= 0 {
+		return fmt.Errorf("invalid --kube-api-mutation-burst \"%d\": must be positive", f.KubeAPIMutationBurst)
+	}
+
+	if f.ConcurrentSyncs < 1 {
+		return fmt.Errorf("invalid --concurrent-syncs \"%d\": must be positive", f.ConcurrentSyncs)
+	}
+
+	if f.NamespaceDebounce < 0 {
+		return fmt.Errorf("invalid --namespace-debounce \"%s\": must not be negative", f.NamespaceDebounce)
+	}
+
+	if f.NamespaceBatchSize < 0 {
+		return fmt.Errorf("invalid --namespace-batch-size \"%d\": must not be negative", f.NamespaceBatchSize)
+	}
+
+	if f.MaxQueueLength < 0 {
+		return fmt.Errorf("invalid --max-queue-length \"%d\": must not be negative", f.MaxQueueLength)
+	}
+
+	if f.SourceQPS < 0 {
+		return fmt.Errorf("invalid --source-qps \"%g\": must not be negative", f.SourceQPS)
+	}
+
+	if f.SourceBurst < 1 {
+		return fmt.Errorf("invalid --source-burst \"%d\": must be positive", f.SourceBurst)
+	}
+
+	if f.FailureThreshold < 0 {
+		return fmt.Errorf("invalid --target-failure-threshold \"%d\": must not be negative", f.FailureThreshold)
+	}
+
+	if f.TargetBackoff <= 0 {
+		return fmt.Errorf("invalid --target-backoff \"%s\": must be positive", f.TargetBackoff)
+	}
+	if f.RequestTimeout < 0 {
+		return fmt.Errorf("invalid --request-timeout \"%s\": must not be negative", f.RequestTimeout)
+	}
+	if f.LeaderElect && !f.ControllerRuntime {
+		return fmt.Errorf("invalid --leader-elect: requires --controller-runtime")
+	}
+	if f.LeaderElect && f.Once {
+		return fmt.Errorf("invalid --leader-elect: cannot be used with --once")
+	}
+
+	if f.AuditLogKeyFile != "" && f.AuditLog == "" {
+		return fmt.Errorf("invalid --audit-log-key-file \"%s\": requires --audit-log", f.AuditLogKeyFile)
+	}
+
+	if f.Checkpoint != "" && !f.DifferentialResync {
+		return fmt.Errorf("invalid --checkpoint \"%s\": requires --differential-resync", f.Checkpoint)
+	}
+
+	if f.CheckpointInterval <= 0 {
+		return fmt.Errorf("invalid --checkpoint-interval \"%s\": must be positive", f.CheckpointInterval)
+	}
+
+	if f.StartupGrace < 0 {
+		return fmt.Errorf("invalid --startup-grace \"%s\": must not be negative", f.StartupGrace)
+	}
+
+	if f.DegradedThreshold < 0 {
+		return fmt.Errorf("invalid --degraded-threshold \"%s\": must not be negative", f.DegradedThreshold)
+	}
+	if f.RestartFailures < 0 {
+		return fmt.Errorf("invalid --informer-restart-failures \"%d\": must not be negative", f.RestartFailures)
+	}
+
+	if f.ExternalProviders != "" && len(splitNames(f.ExternalNamespaces)) == 0 {
+		return fmt.Errorf("invalid --external-providers \"%s\": requires --external-allowed-namespaces", f.ExternalProviders)
+	}
+	if f.CreateNamespaces && len(splitNames(f.CreatableNamespaces)) == 0 {
+		return fmt.Errorf("invalid --create-target-namespaces: requires --creatable-target-namespaces")
+	}
+	if f.DecryptSOPS && len(splitNames(f.SOPSNamespaces)) == 0 {
+		return fmt.Errorf("invalid --decrypt-sops: requires --sops-allowed-namespaces")
+	}
+
+	if f.ClustersNamespace != "" && f.ClusterName == "" {
+		return fmt.Errorf("invalid --clusters-namespace \"%s\": requires --cluster-name", f.ClustersNamespace)
+	} else if f.ClusterCRD && f.ClusterName == "" {
+		return fmt.Errorf("invalid --cluster-crd \"%t\": requires --cluster-name", f.ClusterCRD)
+	} else if strings.Contains(f.ClusterName, "/") {
+		return fmt.Errorf("invalid --cluster-name \"%s\": must not contain \"/\"", f.ClusterName)
+	}
+	if f.ClustersInterval <= 0 {
+		return fmt.Errorf("invalid --clusters-interval \"%s\": must be positive", f.ClustersInterval)
+	}
+	if f.ExternalInterval <= 0 {
+		return fmt.Errorf("invalid --external-interval \"%s\": must be positive", f.ExternalInterval)
+	}
+	if f.SealedInterval <= 0 {
+		return fmt.Errorf("invalid --sealed-secrets-interval \"%s\": must be positive", f.SealedInterval)
+	}
+	if f.TLSInterval <= 0 {
+		return fmt.Errorf("invalid --tls-secrets-interval \"%s\": must be positive", f.TLSInterval)
+	}
+
+	if f.ListPageSize < 0 {
+		return fmt.Errorf("invalid --list-page-size \"%d\": must not be negative", f.ListPageSize)
+	}
+
+	if f.StartupDeleteDelay, err = time.ParseDuration(f.StartupDeleteDelayS); err != nil {
+		return fmt.Errorf("invalid --startup-delete-delay \"%s\": %s", f.StartupDeleteDelayS, err)
+	}
+
+	if f.ShardIndexS == "auto" {
+		hostname, _ := os.Hostname()
+		if f.Shard.Index, err = replicate.ShardIndexFromHostname(hostname); err != nil {
+			return fmt.Errorf("invalid --shard-index \"%s\": %s", f.ShardIndexS, err)
 		}
+	} else if f.Shard.Index, err = strconv.Atoi(f.ShardIndexS); err != nil {
+		return fmt.Errorf("invalid --shard-index \"%s\": %s", f.ShardIndexS, err)
+	}
+	if err = f.Shard.Validate(); err != nil {
+		return fmt.Errorf("invalid --shard-index \"%s\" or --shard-count \"%d\": %s", f.ShardIndexS, f.Shard.Count, err)
 	}
 
-	f.Labels = map[string]string{}
-	for _, labelValue := range strings.Split(f.LabelsS, ",") {
-		labelValue = strings.Trim(labelValue, " ")
-		if labelValue == "" {
-			continue
-		} else if parts := strings.Split(labelValue, "="); len(parts) != 2 {
-		} else if label := strings.Trim(parts[0], " "); label == "" {
-		} else if value := strings.Trim(parts[1], " "); value == "" {
-		} else {
-			f.Labels[label] = value
+	if len(f.ImpersonateGroups) > 0 && f.Impersonate == "" {
+		return fmt.Errorf("invalid --as-group \"%s\": requires --as", strings.Join(f.ImpersonateGroups, ","))
+	}
+
+	f.Replicators = nil
+	for _, replicator := range strings.Split(f.ReplicatorsS, ",") {
+		if replicator = strings.ToLower(strings.Trim(replicator, " ")); replicator == "" {
 			continue
+		} else if replicate.Registered(replicator) == nil && replicator != "all" {
+			return fmt.Errorf("invalid --run-replicators \"%s\": no replicator %s", f.ReplicatorsS, replicator)
 		}
-		panic(fmt.Errorf("invalid --labels \"%s\": format label=value expected", labelValue))
+		f.Replicators = append(f.Replicators, replicator)
+	}
+
+	if f.Labels, err = splitLabels(f.LabelsS, "create-with-labels"); err != nil {
+		return err
+	}
+	if f.BackupLabels, err = splitLabels(f.BackupLabelsS, "backup-exclusion-labels"); err != nil {
+		return err
+	}
+	if f.Annotations, err = splitLabels(f.AnnotationsS, "create-with-annotations"); err != nil {
+		return err
+	}
+	for annotation := range f.Annotations {
+		if strings.HasPrefix(annotation, strings.TrimSuffix(f.AnnotationsPrefix, "/")+"/") {
+			return fmt.Errorf("invalid --create-with-annotations \"%s\": must not have the prefix of the replicator", f.AnnotationsS)
+		}
+	}
+	// the managed-by label is added to the labels of all the replicators
+	managedBy, err := splitLabels(f.ManagedByLabel, "managed-by-label")
+	if err != nil {
+		return err
+	} else if len(managedBy) > 1 {
+		return fmt.Errorf("invalid --managed-by-label \"%s\": a single label=value expected", f.ManagedByLabel)
+	}
+	for label, value := range managedBy {
+		f.Labels[label] = value
+	}
+	if errs := validation.IsQualifiedName(f.SourceLabel); f.SourceLabel != "" && len(errs) > 0 {
+		return fmt.Errorf("invalid --source-label \"%s\": %s", f.SourceLabel, strings.Join(errs, ", "))
+	}
+	if f.NamespaceLabels, err = splitLabels(f.NamespaceLabelsS, "target-namespace-labels"); err != nil {
+		return err
+	}
+	if f.NamespacePriorities, err = replicate.ParseNamespacePriorities(f.NamespacePrioritiesS); err != nil {
+		return fmt.Errorf("invalid --namespace-priorities \"%s\": %s", f.NamespacePrioritiesS, err)
+	}
+	if f.CanarySoak < 0 {
+		return fmt.Errorf("invalid --canary-soak \"%s\": must not be negative", f.CanarySoak)
+	}
+	if f.DeletePropagation, err = replicate.ParsePropagationPolicy(f.DeletePropagationS); err != nil {
+		return fmt.Errorf("invalid --delete-propagation \"%s\": %s", f.DeletePropagationS, err)
 	}
-}
 
-type newReplicatorFunc func(kubernetes.Interface, replicate.ReplicatorOptions, time.Duration) replicate.Replicator
+	// the options not overridden for a replicator are the global ones
+	for name, replicatorFlags := range f.ReplicatorFlags {
+		if !flagSet.Changed("resync-period-" + name) {
+			replicatorFlags.ResyncPeriod = f.ResyncPeriod
+		} else if replicatorFlags.ResyncPeriod <= 0 {
+			return fmt.Errorf("invalid --resync-period-%s \"%s\": must be positive", name, replicatorFlags.ResyncPeriod)
+		}
+		if !flagSet.Changed("allow-all-" + name) {
+			replicatorFlags.AllowAll = f.AllowAll
+		}
+		if !flagSet.Changed("create-with-labels-" + name) {
+			replicatorFlags.Labels = f.Labels
+		} else if replicatorFlags.Labels, err = splitLabels(replicatorFlags.LabelsS, "create-with-labels-"+name); err != nil {
+			return err
+		}
+		for label, value := range managedBy {
+			replicatorFlags.Labels[label] = value
+		}
+	}
+	return nil
+}
 
-// All the new replicator function, key must be lower case
-var newReplicatorFuncs map[string]newReplicatorFunc = map[string]newReplicatorFunc{
-	"configmap": replicate.NewConfigMapReplicator,
-	"secret": replicate.NewSecretReplicator,
+// Returns the sorted names of the registered replicators
+// The other replicators must be registered with replicate.Register before the flags are added
+func replicatorNames() []string {
+	return replicate.RegisteredNames()
 }
 
+// The context of the commands is cancelled on SIGINT or SIGTERM, cancelling the pending requests to kubernetes
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := newRootCommand().ExecuteContext(ctx)
+	stop()
+	if err != nil {
+		os.Exit(2)
+	}
+}
+
+// The root command runs the controller, as the "run" command
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:               "k8s-replicator",
+		Short:             "Replicate secrets and configMaps across namespaces",
+		Args:              cobra.NoArgs,
+		SilenceUsage:      true,
+		PersistentPreRunE: setUp,
+		RunE:              runController,
+	}
+	addFlags(root.PersistentFlags())
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "run",
+			Short: "Run the controller, the default command",
+			Args:  cobra.NoArgs,
+			RunE:  runController,
+		},
+		newAuditCommand(),
+		newRepairCommand(),
+		newCheckCommand(),
+		newPlanCommand(),
+		newMigrateAnnotationsCommand(),
+		newDoctorCommand(),
+		newVerifyAuditLogCommand(),
+		newVersionCommand(),
+	)
+	return root
+}
+
+// Returns the key of the audit log read from --audit-log-key-file, nil without it
+func readAuditLogKey() ([]byte, error) {
+	if f.AuditLogKeyFile == "" {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(f.AuditLogKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit log key \"%s\": %s", f.AuditLogKeyFile, err)
+	}
+	if key = bytes.TrimSpace(key); len(key) == 0 {
+		return nil, fmt.Errorf("invalid audit log key \"%s\": empty", f.AuditLogKeyFile)
+	}
+	return key, nil
+}
+
+// Builds the client and the replicators from the flags
+// The startup gate and the notifier are only set for the controller, the commands list all the objects before acting,
+// and the background loops are only run by the controller, as they write onto the cluster
+func newReplicators(ctx context.Context, controller bool) (*rest.Config, kubernetes.Interface, replicate.ReplicatorOptions, []replicate.Replicator, error) {
 	var config *rest.Config
 	var err error
 	var client kubernetes.Interface
+	var options replicate.ReplicatorOptions
+
+	info := getVersionInfo()
+	logger.Info("starting k8s-replicator", "version", info.Version, "commit", info.Commit, "buildDate", info.BuildDate, "goVersion", info.GoVersion)
 
-	if f.KubeConfig == "" {
-		log.Printf("using in-cluster configuration")
+	if f.KubeConfig == "" && f.KubeContext == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		logger.Info("using in-cluster configuration")
 		config, err = rest.InClusterConfig()
 	} else {
-		log.Printf("using configuration from '%s'", f.KubeConfig)
-		config, err = clientcmd.BuildConfigFromFlags("", f.KubeConfig)
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if f.KubeConfig == "" {
+			// out of a cluster, such as a kubectl plugin
+			logger.Info("using default configuration", "context", f.KubeContext)
+		} else {
+			logger.Info("using configuration from file", "path", f.KubeConfig, "context", f.KubeContext)
+			loadingRules.ExplicitPath = f.KubeConfig
+		}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: f.KubeContext}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
 	}
 	if err != nil {
-		panic(err)
+		return nil, nil, options, nil, fmt.Errorf("could not load kubernetes configuration: %s", err)
+	}
+	if f.Impersonate != "" {
+		logger.Info("impersonating", "user", f.Impersonate, "groups", f.ImpersonateGroups)
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: f.Impersonate,
+			Groups:   f.ImpersonateGroups,
+		}
+	}
+	config.QPS = float32(f.KubeAPIQPS)
+	config.Burst = f.KubeAPIBurst
+	if f.KubeAPIMutationQPS > 0 {
+		replicate.LimitMutations(config, float32(f.KubeAPIMutationQPS), f.KubeAPIMutationBurst)
+	}
+	if f.Protobuf {
+		// the core resources support protobuf, the other ones fall back to json
+		config.AcceptContentTypes = runtime.ContentTypeProtobuf + "," + runtime.ContentTypeJSON
+		config.ContentType = runtime.ContentTypeProtobuf
 	}
 
 	client = kubernetes.NewForConfigOrDie(config)
-	options := replicate.ReplicatorOptions{
-		AllowAll:      f.AllowAll,
-		IgnoreUnknown: f.IgnoreUnknown,
-		Labels:        f.Labels,
+	options = replicate.ReplicatorOptions{
+		Prefixes:         append([]string{f.AnnotationsPrefix}, splitNames(f.CompatPrefixes)...),
+		CompatWrite:      f.CompatWrite,
+		AllowAll:         f.AllowAll,
+		IgnoreUnknown:    f.IgnoreUnknown,
+		Labels:           f.Labels,
+		Annotations:      f.Annotations,
+		SourceLabel:      f.SourceLabel,
+		CreateNamespaces: f.CreateNamespaces,
+		NamespaceLabels:  f.NamespaceLabels,
+		SourceStatus:     f.SourceStatus,
+		StatusInterval:   f.SourceStatusInterval,
+		TargetConditions: f.TargetConditions,
+		StatusResources:  f.StatusResources,
+		Shard:            f.Shard,
+		ControllerID:     f.ControllerID,
+		RetryBudget:      f.RetryBudget,
+		RetryBaseDelay:   f.RetryBaseDelay,
+		RetryMaxDelay:    f.RetryMaxDelay,
+		ServerSideApply:  f.ServerSideApply,
+		OrphanPolicy:     f.OrphanPolicy,
+		Propagation:      f.DeletePropagation,
+		OrphanGCInterval: f.OrphanGCInterval,
+		StripLastApplied: f.StripLastApplied,
+		ListPageSize:     f.ListPageSize,
+		ConcurrentSyncs:  f.ConcurrentSyncs,
+		Priorities:       f.NamespacePriorities,
+		CanarySoak:       f.CanarySoak,
+		NamespaceDelay:   f.NamespaceDebounce,
+		NamespaceBatch:   f.NamespaceBatchSize,
+		ResyncJitter:     f.ResyncJitter,
+		MaxQueueLength:   f.MaxQueueLength,
+		SourceQPS:        float32(f.SourceQPS),
+		SourceBurst:      f.SourceBurst,
+		FailureThreshold: f.FailureThreshold,
+		FailureBackoff:   f.TargetBackoff,
+		RequestTimeout:   f.RequestTimeout,
+		SkipUnchanged:    f.DifferentialResync,
+		DegradedAfter:    f.DegradedThreshold,
+		RestartFailures:  f.RestartFailures,
+		ExternalInterval: f.ExternalInterval,
+		Kubed:            f.KubedCompat,
+		Informers:        replicate.NewSharedInformers(client, metadata.NewForConfigOrDie(config), f.ResyncPeriod),
+	}
+	if f.CreateNamespaces {
+		options.CreatableNamespaces, err = replicate.ParseNamespacePatterns(f.CreatableNamespaces)
+		if err != nil {
+			return nil, nil, options, nil, fmt.Errorf("invalid --creatable-target-namespaces \"%s\": %s", f.CreatableNamespaces, err)
+		}
+	}
+	if controller {
+		options.StartupGate = replicate.NewStartupGate(f.StartupDeleteDelay, logger)
+		options.StartupGate.SetGrace(f.StartupGrace, f.StartupGraceUpdates)
+	}
+	if f.AuditLog != "" {
+		hostname, _ := os.Hostname()
+		actor := fmt.Sprintf("%s/%s", replicate.EventComponent, hostname)
+		key, err := readAuditLogKey()
+		if err != nil {
+			return nil, nil, options, nil, err
+		}
+		if options.AuditLog, err = replicate.OpenAuditLog(f.AuditLog, actor, key); err != nil {
+			return nil, nil, options, nil, fmt.Errorf("could not open audit log \"%s\": %s", f.AuditLog, err)
+		}
+		logger.Info("writing audit log", "path", f.AuditLog)
+	}
+	if f.ClustersNamespace != "" || f.ClusterCRD {
+		options.Clusters = replicate.NewClusters(client, f.ClustersNamespace, f.ClusterName, f.ClustersInterval, f.ClusterCRD, logger)
+		if err := options.Clusters.Load(ctx); err != nil {
+			logger.Error(err, "could not load clusters", "namespace", f.ClustersNamespace)
+		}
+	}
+	externalOptions := replicate.ExternalOptions{
+		AWSRegion:    f.AWSRegion,
+		GCPProject:   f.GCPProject,
+		VaultAddress: f.VaultAddress,
+		VaultRole:    f.VaultRole,
+		ExportURL:    f.ExportURL,
+	}
+	if f.ExternalProviders != "" {
+		options.ExternalSources, err = replicate.NewExternalProviders(splitNames(f.ExternalProviders), externalOptions)
+		if err != nil {
+			return nil, nil, options, nil, fmt.Errorf("invalid --external-providers \"%s\": %s", f.ExternalProviders, err)
+		}
+		options.ExternalAllowed, err = replicate.ParseExternalNamespaces(f.ExternalNamespaces)
+		if err != nil {
+			return nil, nil, options, nil, fmt.Errorf("invalid --external-allowed-namespaces \"%s\": %s", f.ExternalNamespaces, err)
+		}
+	}
+	if f.Exporters != "" {
+		options.Exporters, err = replicate.NewExternalExporters(splitNames(f.Exporters), externalOptions)
+		if err != nil {
+			return nil, nil, options, nil, fmt.Errorf("invalid --exporters \"%s\": %s", f.Exporters, err)
+		}
+	}
+	if f.DecryptSOPS {
+		options.Decrypter, err = replicate.NewSOPSDecrypter(f.SOPSAgeKeys, splitNames(f.SOPSNamespaces))
+		if err != nil {
+			return nil, nil, options, nil, fmt.Errorf("invalid --sops-age-keys \"%s\" or --sops-allowed-namespaces \"%s\": %s",
+				f.SOPSAgeKeys, f.SOPSNamespaces, err)
+		}
+	}
+	if f.SealedSecrets || f.ReplicateSealed {
+		options.SealedSecrets = replicate.NewSealedSecrets(client, dynamic.NewForConfigOrDie(config), f.SealedInterval, f.ReplicateSealed, logger)
+	}
+	if f.TLSNamespace != "" {
+		options.TLSReferences = replicate.NewTLSReferences(client, dynamic.NewForConfigOrDie(config), f.TLSNamespace, f.TLSInterval, logger)
+	}
+	if f.ArgoCDIgnore || f.ArgoCDApp != "" {
+		options.ArgoCD = replicate.NewArgoCDMetadata(f.ArgoCDApp, f.ArgoCDInstanceLabel)
+	}
+	if f.FluxCompat {
+		options.Flux = replicate.NewFluxCompat(f.FluxAdopt)
+	}
+	if f.ExcludeFromBackup {
+		options.BackupLabels = f.BackupLabels
+	}
+	if controller && f.NotifyWebhookURL != "" {
+		options.Notifier = replicate.NewWebhookNotifier(f.NotifyWebhookURL, f.NotifyInterval, logger)
 	}
 
-	selectedReplicatorFuncs := map[string]newReplicatorFunc{}
+	selected := map[string]bool{}
 	for _, replicator := range(f.Replicators) {
 		if replicator == "all" {
-			for key, value := range newReplicatorFuncs {
-				selectedReplicatorFuncs[key] = value
+			for _, name := range replicatorNames() {
+				selected[name] = true
 			}
-		} else if value, ok := newReplicatorFuncs[replicator]; ok {
-			selectedReplicatorFuncs[replicator] = value
 		} else {
-			panic(fmt.Errorf("no replicator %s", replicator))
+			selected[replicator] = true
 		}
 	}
 
+	// in the order of their names, such that they start, checkpoint and check their permissions in a stable order
 	replicators := []replicate.Replicator{}
-	for _, newReplicator := range(selectedReplicatorFuncs) {
-		replicators = append(replicators, newReplicator(client, options, f.ResyncPeriod))
+	for _, name := range replicatorNames() {
+		if !selected[name] {
+			continue
+		}
+		newReplicator := replicate.Registered(name)
+		replicatorFlags := f.ReplicatorFlags[name]
+		replicatorOptions := options
+		replicatorOptions.AllowAll = replicatorFlags.AllowAll
+		replicator, err := newReplicator(client,
+			replicate.WithOptions(replicatorOptions),
+			replicate.WithLabels(replicatorFlags.Labels),
+			replicate.WithResyncPeriod(replicatorFlags.ResyncPeriod),
+			replicate.WithLogger(logger),
+			replicate.WithMetricsRegistry(prometheus.DefaultRegisterer),
+		)
+		if err != nil {
+			return nil, nil, options, nil, err
+		}
+		replicators = append(replicators, replicator)
+	}
+	return config, client, options, replicators, nil
+}
+
+// Runs the loops of the remote clusters, of the SealedSecrets and of the TLS references until stopped
+// They write onto the cluster or trigger the replicators, so with --leader-elect only the elected replica runs them
+func runBackground(options replicate.ReplicatorOptions, stop <-chan struct{}) {
+	if options.Clusters != nil {
+		go options.Clusters.Run(stop)
+	}
+	if options.SealedSecrets != nil {
+		go options.SealedSecrets.Run(stop)
+	}
+	if options.TLSReferences != nil {
+		go options.TLSReferences.Run(stop)
+	}
+}
+
+// Runs the controller until killed, or until one full reconcile pass with --once
+func runController(command *cobra.Command, args []string) error {
+	// cancelled on SIGTERM, or once the pass of --once is done
+	ctx, cancel := context.WithCancel(command.Context())
+	defer cancel()
+	config, client, options, replicators, err := newReplicators(ctx, true)
+	if err != nil {
+		return err
+	}
+	info := getVersionInfo()
+	prometheus.MustRegister(newBuildInfoMetric(info))
+
+	var checkpoints *replicate.Checkpoints
+	if f.Checkpoint != "" {
+		if checkpoints, err = replicate.NewCheckpoints(client, f.Checkpoint, f.CheckpointInterval, logger); err != nil {
+			return fmt.Errorf("invalid --checkpoint \"%s\": %s", f.Checkpoint, err)
+		}
+		checkpoints.ForShard(f.Shard)
+	}
+	if f.CheckPermissions {
+		if denied, err := deniedPermissions(ctx, client, replicators, checkpoints); err != nil {
+			logger.Error(err, "could not check permissions")
+		} else if len(denied) > 0 {
+			return replicate.MissingPermissionsError(denied)
+		}
 	}
 
-	log.Printf("Starting replicators with prefix \"%s\"", f.AnnotationsPrefix)
-	for _, replicator := range(replicators) {
-		replicator.Start()
+	// the replicators, and the checkpoints of their states, only run once elected
+	var mgr manager.Manager
+	var elected <-chan struct{}
+	if f.ControllerRuntime {
+		if mgr, err = newManager(config, replicators); err != nil {
+			return err
+		}
+		if err := addBackground(mgr, options); err != nil {
+			return err
+		}
+		elected = mgr.Elected()
+	} else {
+		runBackground(options, ctx.Done())
+		always := make(chan struct{})
+		close(always)
+		elected = always
 	}
 
+	// closed once the last checkpoint is saved
+	checkpointed := make(chan struct{})
+	if checkpoints != nil {
+		if err := checkpoints.Restore(ctx, replicators); err != nil {
+			logger.Error(err, "could not restore checkpoint, handling all the objects")
+		}
+		go func() {
+			defer close(checkpointed)
+			select {
+			case <-elected:
+				checkpoints.Run(replicators, ctx.Done())
+			case <-ctx.Done():
+			}
+		}()
+	} else {
+		close(checkpointed)
+	}
+
+	// closed once the last notifications are sent
+	notified := make(chan struct{})
+	if options.Notifier != nil {
+		go func() {
+			defer close(notified)
+			options.Notifier.Run(ctx.Done())
+		}()
+	} else {
+		close(notified)
+	}
+
+	logger.Info("starting replicators", "prefix", f.AnnotationsPrefix, "shard", f.Shard.Index, "shards", f.Shard.Count)
+	if mgr != nil {
+		logger.Info("starting manager", "leaderElection", f.LeaderElect, "probes", f.HealthProbeAddress)
+		go func() {
+			// the manager only stops by itself on failure, such as a lost leader election
+			if err := mgr.Start(ctx); ctx.Err() == nil {
+				logger.Error(err, "manager stopped")
+				os.Exit(1)
+			}
+		}()
+	} else {
+		for _, replicator := range(replicators) {
+			replicator.Start()
+		}
+	}
+	go options.StartupGate.Run(replicators, ctx.Done())
+
+	if f.Once {
+		code := runOnce(ctx, replicators, options.StartupGate, checkpoints)
+		// stops as on SIGTERM, such that the last checkpoint and notifications are not lost
+		cancel()
+		<-checkpointed
+		<-notified
+		if code != 0 {
+			os.Exit(code)
+		}
+		return nil
+	}
+
+	// force a resync on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logger.Info("SIGHUP received: resyncing")
+			replicate.ResyncAll(replicators)
+		}
+	}()
+
 	h := liveness.Handler{
-		Replicators: replicators,
+		Replicators:    replicators,
+		StallThreshold: f.WatchStallThreshold,
 	}
 
-	log.Printf("starting liveness monitor at %s", f.StatusAddress)
+	logger.Info("starting liveness monitor", "address", f.StatusAddress)
 
-	http.Handle("/healthz", &h)
-	http.ListenAndServe(f.StatusAddress, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", &h)
+	mux.Handle("/readyz", &liveness.ReadinessHandler{Replicators: replicators})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/version", &versionHandler{info: info})
+	if f.EnableResync {
+		logger.Info("enabling forced resyncs", "path", "/resync")
+		mux.Handle("/resync", &replicate.ResyncHandler{Replicators: replicators})
+	}
+	if f.EnableTopology {
+		logger.Info("enabling topology", "path", "/topology")
+		mux.Handle("/topology", &replicate.TopologyHandler{Replicators: replicators})
+		mux.Handle("/topology/graph", &replicate.GraphHandler{Replicators: replicators})
+	}
+	if f.EnablePlan {
+		logger.Info("enabling plans", "path", "/plan")
+		mux.Handle("/plan", &replicate.PlanHandler{Replicators: replicators})
+	}
+	if options.Clusters != nil {
+		mux.Handle("/clusters", &replicate.ClustersHandler{Clusters: options.Clusters})
+	}
+	if f.EnablePprof {
+		logger.Info("enabling profiling", "path", "/debug/pprof/")
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	server := &http.Server{Addr: f.StatusAddress, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		logger.Info("stopping replicators")
+		for _, replicator := range replicators {
+			replicator.Stop()
+		}
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-checkpointed
+	<-notified
+	return nil
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"k8s.io/client-go/rest"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+// Returns the name of the leader election lease, one per annotations prefix and per shard
+func leaderElectionID() string {
+	id := f.AnnotationsPrefix + "-leader"
+	if f.Shard.Count > 1 {
+		id = fmt.Sprintf("%s-%d", id, f.Shard.Index)
+	}
+	return id
+}
+
+// Returns the permissions needed by the leader election, on the leases of its namespace
+// As controller-runtime, the namespace of the pod when not given, none when out of a pod
+func leaderElectionPermissions() []replicate.Permission {
+	namespace := f.LeaderNamespace
+	if namespace == "" {
+		data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if err != nil {
+			return nil
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	needed := []replicate.Permission{}
+	for _, verb := range []string{"get", "create", "update"} {
+		needed = append(needed, replicate.Permission{
+			Verb:      verb,
+			Group:     "coordination.k8s.io",
+			Resource:  "leases",
+			Namespace: namespace,
+		})
+	}
+	return needed
+}
+
+// Builds the controller-runtime manager running the replicators, for --controller-runtime
+// The objects are reconciled from its cache, the namespaces keep the informer shared by the replicators
+// Its metrics server is disabled, the metrics of the replicators are served on the status address
+// Its cache transforms the objects as the informers of the replicators do
+func newManager(config *rest.Config, replicators []replicate.Replicator) (manager.Manager, error) {
+	ctrllog.SetLogger(logger)
+	mgr, err := manager.New(config, manager.Options{
+		Logger:                        logger,
+		Cache:                         replicate.ManagerCacheOptions(replicators...),
+		Metrics:                       metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress:        f.HealthProbeAddress,
+		LeaderElection:                f.LeaderElect,
+		LeaderElectionID:              leaderElectionID(),
+		LeaderElectionNamespace:       f.LeaderNamespace,
+		LeaderElectionReleaseOnCancel: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create manager: %s", err)
+	}
+	if err := replicate.AddToManager(mgr, replicators...); err != nil {
+		return nil, err
+	}
+	return mgr, nil
+}
+
+// Adds the background loops to the manager, such that with --leader-elect they only run once elected,
+// until the context of the manager is cancelled
+func addBackground(mgr manager.Manager, options replicate.ReplicatorOptions) error {
+	err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		runBackground(options, ctx.Done())
+		<-ctx.Done()
+		return nil
+	}))
+	if err != nil {
+		return fmt.Errorf("could not add background loops to manager: %s", err)
+	}
+	return nil
+}
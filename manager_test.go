@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+// testLock is a leader election lock which can only be acquired once allowed
+type testLock struct {
+	mutex   sync.Mutex
+	allowed bool
+	record  *resourcelock.LeaderElectionRecord
+}
+
+func (l *testLock) allow() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.allowed = true
+}
+
+func (l *testLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.allowed {
+		return nil, nil, fmt.Errorf("lock is not allowed yet")
+	}
+	if l.record == nil {
+		return nil, nil, apierrors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, "test")
+	}
+	record := *l.record
+	data, err := json.Marshal(record)
+	return &record, data, err
+}
+
+func (l *testLock) Create(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	return l.Update(ctx, record)
+}
+
+func (l *testLock) Update(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.record = &record
+	return nil
+}
+
+func (l *testLock) RecordEvent(string) {}
+
+func (l *testLock) Identity() string {
+	return "test"
+}
+
+func (l *testLock) Describe() string {
+	return "test"
+}
+
+func TestAddBackground(t *testing.T) {
+	// the loop of the remote clusters lists their secrets on each run
+	lists := int32(0)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(&lists, 1)
+		return false, nil, nil
+	})
+	options := replicate.ReplicatorOptions{
+		Clusters: replicate.NewClusters(client, "clusters-ns", "local", 10*time.Millisecond, false, logr.Discard()),
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	lock := &testLock{}
+	leaseDuration, renewDeadline, retryPeriod := time.Second, 500*time.Millisecond, 10*time.Millisecond
+	mgr, err := manager.New(&rest.Config{Host: server.URL}, manager.Options{
+		Logger:                              logr.Discard(),
+		Metrics:                             metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress:              "0",
+		LeaderElection:                      true,
+		LeaderElectionResourceLockInterface: lock,
+		LeaderElectionReleaseOnCancel:       true,
+		LeaseDuration:                       &leaseDuration,
+		RenewDeadline:                       &renewDeadline,
+		RetryPeriod:                         &retryPeriod,
+	})
+	require.NoError(t, err)
+	require.NoError(t, addBackground(mgr, options))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error)
+	go func() {
+		errs <- mgr.Start(ctx)
+	}()
+	// not elected yet, the loops do not run
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&lists), "not elected")
+
+	lock.allow()
+	select {
+	case <-mgr.Elected():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "not elected")
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&lists) > 0
+	}, 5*time.Second, 10*time.Millisecond, "elected")
+
+	// stopped with the manager
+	cancel()
+	require.NoError(t, <-errs)
+	time.Sleep(50 * time.Millisecond)
+	stopped := atomic.LoadInt32(&lists)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&lists), "stopped")
+}
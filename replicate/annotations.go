@@ -5,67 +5,140 @@ import (
 )
 
 // Annotations that are used to specify this controller's behaviour
-var (
+// These are their names with the default prefix, the annotations of a replicator with other prefixes are translated
+const (
 	// ReplicateFromAnnotation tells to replicate from a source object to this object
-	ReplicateFromAnnotation         = "replicate-from"
+	ReplicateFromAnnotation         = annotationsPrefix + "replicate-from"
 	// ReplicateToAnnotation tells to replicate this object to a target object(s)
-	ReplicateToAnnotation           = "replicate-to"
+	ReplicateToAnnotation           = annotationsPrefix + "replicate-to"
 	// ReplicateToNsAnnotation tells to replicate this object to a target namespace(s)
-	ReplicateToNsAnnotation         = "replicate-to-namespaces"
+	ReplicateToNsAnnotation         = annotationsPrefix + "replicate-to-namespaces"
 	// ReplicateOnceAnnotation tells to replicate only once
-	ReplicateOnceAnnotation         = "replicate-once"
+	ReplicateOnceAnnotation         = annotationsPrefix + "replicate-once"
 	// ReplicateOnceVersionAnnotation tells to replicate once again when the annotation's value changes
-	ReplicateOnceVersionAnnotation  = "replicate-once-version"
+	ReplicateOnceVersionAnnotation  = annotationsPrefix + "replicate-once-version"
 	// ReplicatedAtAnnotation stores when this object was replicated
-	ReplicatedAtAnnotation          = "replicated-at"
+	ReplicatedAtAnnotation          = annotationsPrefix + "replicated-at"
 	// ReplicatedByAnnotation stores which object created this replication
-	ReplicatedByAnnotation          = "replicated-by"
+	ReplicatedByAnnotation          = annotationsPrefix + "replicated-by"
 	// ReplicatedFromVersionAnnotation stores the resource version of the source when replicated to this object
-	ReplicatedFromVersionAnnotation = "replicated-from-version"
+	ReplicatedFromVersionAnnotation = annotationsPrefix + "replicated-from-version"
 	// ReplicatedFromOriginAnnotation stores the object from which the data originates
-	ReplicatedFromOriginAnnotation  = "replicated-from-origin"
+	ReplicatedFromOriginAnnotation  = annotationsPrefix + "replicated-from-origin"
 	// ReplicationAllowedAnnotation explicitely allows replication
-	ReplicationAllowedAnnotation    = "replication-allowed"
+	ReplicationAllowedAnnotation    = annotationsPrefix + "replication-allowed"
 	// ReplicationAllowedNsAnnotation explicitely allows replication to the specified namespace(s)
-	ReplicationAllowedNsAnnotation  = "replication-allowed-namespaces"
+	ReplicationAllowedNsAnnotation  = annotationsPrefix + "replication-allowed-namespaces"
 	// ReplicatedFromAllowedAnnotation stores the replication permissions of the source
-	ReplicatedFromAllowedAnnotation  = "replicated-from-allowed"
+	ReplicatedFromAllowedAnnotation  = annotationsPrefix + "replicated-from-allowed"
+	// ReplicationStatusAnnotation stores a summary of the replication status of the source
+	ReplicationStatusAnnotation      = annotationsPrefix + "replication-status"
+	// ReplicatedTargetsCountAnnotation stores how many targets the source is replicated to
+	ReplicatedTargetsCountAnnotation = annotationsPrefix + "replicated-targets-count"
+	// ReplicationStateAnnotation stores the state of the target: Synced, Error or Stale
+	ReplicationStateAnnotation       = annotationsPrefix + "replication-state"
+	// ReplicationErrorAnnotation stores the last replication error of the target
+	ReplicationErrorAnnotation       = annotationsPrefix + "replication-error"
+	// ReplicateToClustersAnnotation tells to replicate this object to its targets in remote cluster(s) too
+	ReplicateToClustersAnnotation    = annotationsPrefix + "replicate-to-clusters"
+	// ReplicatedFromClusterAnnotation stores from which cluster and source a remote target was replicated
+	ReplicatedFromClusterAnnotation  = annotationsPrefix + "replicated-from-cluster"
+	// ReplicateFromClusterAnnotation tells to replicate from a source object of a remote cluster to this object
+	ReplicateFromClusterAnnotation   = annotationsPrefix + "replicate-from-cluster"
+	// ReplicateFromExternalAnnotation tells to replicate from a secret of an external store to this object
+	ReplicateFromExternalAnnotation  = annotationsPrefix + "replicate-from-external"
+	// ExportToAnnotation tells to export this object to external store(s) too
+	ExportToAnnotation               = annotationsPrefix + "export-to"
+	// DecryptSOPSAnnotation tells to replicate the decrypted SOPS document under a key of this object, instead of its data
+	DecryptSOPSAnnotation            = annotationsPrefix + "decrypt-sops"
+	// ReplicateCanaryAnnotation tells to replicate the changes of this object to the targets of the matching namespaces first
+	ReplicateCanaryAnnotation        = annotationsPrefix + "replicate-canary"
+	// CanaryApprovedAnnotation tells to replicate this version of this object to all its targets, without waiting for the soak period
+	CanaryApprovedAnnotation         = annotationsPrefix + "canary-approved-version"
+	// RequireApprovalAnnotation tells to replicate the changes of this object only once approved
+	RequireApprovalAnnotation        = annotationsPrefix + "require-approval"
+	// ApprovedVersionAnnotation tells to replicate this resourceVersion of this object, or the later ones, requiring approval
+	ApprovedVersionAnnotation        = annotationsPrefix + "approved-version"
+	// PendingApprovalAnnotation stores the resourceVersion of this object waiting for approval
+	PendingApprovalAnnotation        = annotationsPrefix + "pending-approval-version"
+	// ApprovalChecksumAnnotation stores the checksum of the data of this object waiting for approval
+	ApprovalChecksumAnnotation       = annotationsPrefix + "approval-checksum"
+	// CanaryRolloutAnnotation stores the version of this object replicated to the canary targets first, and since when
+	CanaryRolloutAnnotation          = annotationsPrefix + "canary-rollout"
 )
 
-var annotationsPrefix = ""
+// ManagedByAnnotation stores the identity of the controller managing a target
+// It does not depend on the prefix, such that controllers with different prefixes see it
+const ManagedByAnnotation = "k8s-replicator/managed-by"
 
-var annotationRefs = map[string]*string{
-	ReplicateFromAnnotation:         &ReplicateFromAnnotation,
-	ReplicateToAnnotation:           &ReplicateToAnnotation,
-	ReplicateToNsAnnotation:         &ReplicateToNsAnnotation,
-	ReplicateOnceAnnotation:         &ReplicateOnceAnnotation,
-	ReplicateOnceVersionAnnotation:  &ReplicateOnceVersionAnnotation,
-	ReplicatedAtAnnotation:          &ReplicatedAtAnnotation,
-	ReplicatedByAnnotation:          &ReplicatedByAnnotation,
-	ReplicatedFromVersionAnnotation: &ReplicatedFromVersionAnnotation,
-	ReplicatedFromOriginAnnotation:  &ReplicatedFromOriginAnnotation,
-	ReplicationAllowedAnnotation:    &ReplicationAllowedAnnotation,
-	ReplicationAllowedNsAnnotation:  &ReplicationAllowedNsAnnotation,
-	ReplicatedFromAllowedAnnotation: &ReplicatedFromAllowedAnnotation,
-}
+// DefaultAnnotationsPrefix is the prefix of the annotations of a replicator without explicit prefixes
+const DefaultAnnotationsPrefix = "k8s-replicator"
+
+// the prefix of the names of the annotations, which the annotations of all the replicators are translated to
+const annotationsPrefix = DefaultAnnotationsPrefix + "/"
+
+// the names of the annotations, by their suffix
+var annotationRefs = suffixedAnnotations(
+	ReplicateFromAnnotation,
+	ReplicateToAnnotation,
+	ReplicateToNsAnnotation,
+	ReplicateOnceAnnotation,
+	ReplicateOnceVersionAnnotation,
+	ReplicatedAtAnnotation,
+	ReplicatedByAnnotation,
+	ReplicatedFromVersionAnnotation,
+	ReplicatedFromOriginAnnotation,
+	ReplicationAllowedAnnotation,
+	ReplicationAllowedNsAnnotation,
+	ReplicatedFromAllowedAnnotation,
+	ReplicationStatusAnnotation,
+	ReplicatedTargetsCountAnnotation,
+	ReplicationStateAnnotation,
+	ReplicationErrorAnnotation,
+	ReplicateToClustersAnnotation,
+	ReplicatedFromClusterAnnotation,
+	ReplicateFromClusterAnnotation,
+	ReplicateFromExternalAnnotation,
+	ExportToAnnotation,
+	DecryptSOPSAnnotation,
+	ReplicateCanaryAnnotation,
+	CanaryApprovedAnnotation,
+	RequireApprovalAnnotation,
+	ApprovedVersionAnnotation,
+	PendingApprovalAnnotation,
+	ApprovalChecksumAnnotation,
+	CanaryRolloutAnnotation,
+)
 
-// PrefixAnnotations sets the prefix of all the annotations
-func PrefixAnnotations(prefix string){
-	if len(prefix) > 0 && prefix[len(prefix)-1] != '/' {
-		prefix = prefix + "/"
+// Returns the names of the annotations by their suffix
+func suffixedAnnotations(annotations ...string) map[string]string {
+	suffixed := make(map[string]string, len(annotations))
+	for _, annotation := range annotations {
+		suffixed[strings.TrimPrefix(annotation, annotationsPrefix)] = annotation
 	}
-	annotationsPrefix = prefix
-	for suffix, annotation := range annotationRefs {
-		*annotation = prefix + suffix
+	return suffixed
+}
+
+// Returns a prefix with its trailing slash, or empty
+func normalizePrefix(prefix string) string {
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix == "" {
+		return ""
 	}
+	return prefix + "/"
 }
 
-// UnknownAnnotations returns the list of the unknown annotations with the same prefix
+// UnknownAnnotations returns the list of the unknown annotations with the default prefix
 func UnknownAnnotations(annotations map[string]string) []string {
+	return unknownAnnotations(annotations, annotationsPrefix)
+}
+
+// Returns the list of the unknown annotations with the prefix, none without prefix
+func unknownAnnotations(annotations map[string]string, prefix string) []string {
 	var unknown []string = nil
-	if annotationsPrefix != "" {
+	if prefix != "" {
 		for key := range annotations {
-			if annotation := strings.TrimPrefix(key, annotationsPrefix); annotation == key {
+			if key == ManagedByAnnotation {
+			} else if annotation := strings.TrimPrefix(key, prefix); annotation == key {
 			} else if _, ok := annotationRefs[annotation]; !ok {
 				unknown = append(unknown, key)
 			}
@@ -6,31 +6,22 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestPrefixAnnotations(t *testing.T) {
-	original := annotationsPrefix
-	defer PrefixAnnotations(original)
-
-	PrefixAnnotations("test1")
-	assert.Equal(t, ReplicateFromAnnotation, "test1/replicate-from")
-	PrefixAnnotations("test2/")
-	assert.Equal(t, ReplicateFromAnnotation, "test2/replicate-from")
-	PrefixAnnotations("")
-	assert.Equal(t, ReplicateFromAnnotation, "replicate-from")
+func TestNewAnnotationPrefixes(t *testing.T) {
+	assert.Equal(t, "k8s-replicator/", newAnnotationPrefixes(nil, false).prefix, "default prefix")
+	assert.Equal(t, "test1/", newAnnotationPrefixes([]string{"test1"}, false).prefix)
+	assert.Equal(t, "test2/", newAnnotationPrefixes([]string{"test2/"}, false).prefix)
+	assert.Equal(t, "", newAnnotationPrefixes([]string{""}, false).prefix, "no prefix")
+	assert.Equal(t, "k8s-replicator/replicate-from", ReplicateFromAnnotation)
 }
 
 func TestUnknownAnnotations(t *testing.T) {
-	original := annotationsPrefix
-	defer PrefixAnnotations(original)
-
-	PrefixAnnotations("test")
-	unkown := UnknownAnnotations(M{
+	unkown := newAnnotationPrefixes([]string{"test"}, false).unknown(M{
 		"test/replicate-from": "any",
 		"test/replicate-to": "any",
 	})
 	assert.Nil(t, unkown, "no unknown")
 
-	PrefixAnnotations("test")
-	unkown = UnknownAnnotations(M{
+	unkown = newAnnotationPrefixes([]string{"test"}, false).unknown(M{
 		"test/replicate-invalid": "any",
 		"test/replicate-from": "any",
 		"test/replicate-to": "any",
@@ -38,12 +29,17 @@ func TestUnknownAnnotations(t *testing.T) {
 	})
 	assert.ElementsMatch(t, []string{"test/replicate-invalid", "test/replicate-not-exists"}, unkown, "2 unknown")
 
-	PrefixAnnotations("")
-	unkown = UnknownAnnotations(M{
+	unkown = newAnnotationPrefixes([]string{""}, false).unknown(M{
 		"test/replicate-invalid": "any",
 		"test/replicate-from": "any",
 		"test/replicate-to": "any",
 		"test/replicate-not-exists": "any",
 	})
 	assert.Nil(t, unkown, "no prefix")
+
+	unkown = UnknownAnnotations(M{
+		ReplicateFromAnnotation: "any",
+		annotationsPrefix + "invalid": "any",
+	})
+	assert.Equal(t, []string{annotationsPrefix + "invalid"}, unkown, "default prefix")
 }
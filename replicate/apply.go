@@ -0,0 +1,113 @@
+// Server-side apply of the installs and updates
+
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FieldManager is the field manager of the fields applied by the replicator
+const FieldManager = "k8s-replicator"
+
+// Returns the annotations set by the replicator with the prefix
+// Without prefix, only the annotations with the names of the ones of the replicator
+func ownedAnnotations(annotations map[string]string, prefix string) map[string]string {
+	owned := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if _, known := annotationRefs[key]; key == ManagedByAnnotation ||
+			(prefix != "" && strings.HasPrefix(key, prefix)) || (prefix == "" && known) {
+			owned[key] = value
+		}
+	}
+	return owned
+}
+
+// appliedMeta is the labels and annotations set by the replicator on the targets, the only ones it applies,
+// such that the ones set by other controllers are neither applied nor taken over
+type appliedMeta struct {
+	// the prefix of the annotations, with its trailing slash, or empty
+	prefix      string
+	// the labels set by the replicator
+	labels      map[string]bool
+	// the annotations set by the replicator besides the ones with the prefix
+	annotations map[string]bool
+}
+
+// Returns the labels and annotations set on the targets, see stampTarget
+func (r *ReplicatorProps) appliedMeta() *appliedMeta {
+	applied := &appliedMeta{
+		prefix:      r.prefixes.prefix,
+		labels:      map[string]bool{},
+		annotations: map[string]bool{},
+	}
+	for label := range r.Labels {
+		applied.labels[label] = true
+	}
+	for label := range r.BackupLabels {
+		applied.labels[label] = true
+	}
+	if r.SourceLabel != "" {
+		applied.labels[r.SourceLabel] = true
+	}
+	if r.Clusters != nil {
+		applied.labels[PushedTargetLabel] = true
+	}
+	for annotation := range r.Annotations {
+		applied.annotations[annotation] = true
+	}
+	if r.ArgoCD != nil {
+		applied.annotations[ArgoCDCompareOptionsAnnotation] = true
+		applied.annotations[ArgoCDSyncOptionsAnnotation] = true
+		if r.ArgoCD.App != "" {
+			applied.labels[r.ArgoCD.InstanceLabel] = true
+		}
+	}
+	return applied
+}
+
+// Returns the meta to apply, with the resource version to fail on conflict
+func (a *appliedMeta) metaToApply(meta *metav1.ObjectMeta) metav1.ObjectMeta {
+	applied := metav1.ObjectMeta{
+		Namespace:       meta.Namespace,
+		Name:            meta.Name,
+		ResourceVersion: meta.ResourceVersion,
+		Labels:          map[string]string{},
+		Annotations:     ownedAnnotations(meta.Annotations, a.prefix),
+	}
+	for key, value := range meta.Labels {
+		if a.labels[key] {
+			applied.Labels[key] = value
+		}
+	}
+	for key, value := range meta.Annotations {
+		if a.annotations[key] {
+			applied.Annotations[key] = value
+		}
+	}
+	return applied
+}
+
+// Applies the object, with its type meta set, to the core resource, and decodes the result
+// The fields previously applied by the replicator and absent from the object are removed
+func applyObject(ctx context.Context, client kubernetes.Interface, resource string, meta *metav1.ObjectMeta, object interface{}, result runtime.Object) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return client.CoreV1().RESTClient().Patch(types.ApplyPatchType).
+		Namespace(meta.Namespace).
+		Resource(resource).
+		Name(meta.Name).
+		Param("fieldManager", FieldManager).
+		Param("force", "true").
+		Body(body).
+		Do(ctx).
+		Into(result)
+}
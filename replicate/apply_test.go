@@ -0,0 +1,173 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestOwnedAnnotations(t *testing.T) {
+	assert.Equal(t, M{
+		ReplicatedByAnnotation: "source-ns/source",
+		ManagedByAnnotation:    "test",
+	}, ownedAnnotations(M{
+		ReplicatedByAnnotation: "source-ns/source",
+		ManagedByAnnotation:    "test",
+		"other/annotation":     "other",
+	}, annotationsPrefix))
+	// without prefix, only the names of the annotations of the replicator
+	assert.Equal(t, M{
+		"replicated-by":     "source-ns/source",
+		ManagedByAnnotation: "test",
+	}, ownedAnnotations(M{
+		"replicated-by":     "source-ns/source",
+		ManagedByAnnotation: "test",
+		"description":       "other",
+	}, ""))
+}
+
+func TestAppliedMeta(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{
+		Labels:       M{"team": "platform"},
+		BackupLabels: M{"velero.io/exclude-from-backup": "true"},
+	}, "source-ns", "target-ns")
+	applied := r.appliedMeta()
+	meta := applied.metaToApply(&metav1.ObjectMeta{
+		Namespace:   "target-ns",
+		Name:        "target",
+		Labels:      M{"team": "platform", "velero.io/exclude-from-backup": "true", "other-label": "other"},
+		Annotations: M{ReplicatedByAnnotation: "source-ns/source", "other/annotation": "other"},
+	})
+	assert.Equal(t, M{"team": "platform", "velero.io/exclude-from-backup": "true"}, meta.Labels)
+	assert.Equal(t, M{ReplicatedByAnnotation: "source-ns/source"}, meta.Annotations)
+}
+
+// Serves the apply requests, and records them
+func applyServer(t *testing.T, requests *[]*http.Request, bodies *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		body := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(data, &body))
+		*requests = append(*requests, req)
+		*bodies = append(*bodies, body)
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(data)
+	}))
+}
+
+func TestConfigMapActions_apply(t *testing.T) {
+	requests := []*http.Request{}
+	bodies := []map[string]interface{}{}
+	server := applyServer(t, &requests, &bodies)
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	actions := &configMapActions{serverSideApply: true, applied: &appliedMeta{
+		prefix: annotationsPrefix,
+		labels: map[string]bool{"label": true},
+	}}
+
+	source := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+		},
+		Data: M{"data": "source"},
+	}
+	target := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "target-ns",
+			Name:            "target",
+			ResourceVersion: "1",
+			Labels:          M{"other-label": "other"},
+			Annotations:     M{"other/annotation": "other"},
+		},
+		Data: M{"data": "target"},
+	}
+
+	// only the owned fields of the target, the ones of other controllers are neither applied nor taken over
+	object, err := actions.Update(context.TODO(), client, target, source, M{
+		ReplicatedFromVersionAnnotation: "2",
+		"other/annotation":              "other",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "source", object.(*v1.ConfigMap).Data["data"])
+	require.Len(t, requests, 1)
+	assert.Equal(t, http.MethodPatch, requests[0].Method)
+	assert.Equal(t, "/api/v1/namespaces/target-ns/configmaps/target", requests[0].URL.Path)
+	assert.Equal(t, "application/apply-patch+yaml", requests[0].Header.Get("Content-Type"))
+	assert.Equal(t, FieldManager, requests[0].URL.Query().Get("fieldManager"))
+	assert.Equal(t, "true", requests[0].URL.Query().Get("force"))
+	assert.Equal(t, "ConfigMap", bodies[0]["kind"])
+	metadata := bodies[0]["metadata"].(map[string]interface{})
+	assert.Equal(t, "1", metadata["resourceVersion"])
+	assert.Equal(t, map[string]interface{}{ReplicatedFromVersionAnnotation: "2"}, metadata["annotations"])
+	assert.NotContains(t, metadata, "labels")
+	assert.Equal(t, map[string]interface{}{"data": "source"}, bodies[0]["data"])
+
+	// installed with the given meta
+	_, err = actions.Install(context.TODO(), client, &metav1.ObjectMeta{
+		Namespace:   "target-ns",
+		Name:        "new",
+		Labels:      M{"label": "value", "other-label": "other"},
+		Annotations: M{ReplicatedByAnnotation: "source-ns/source", "description": "other"},
+	}, source, source)
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/api/v1/namespaces/target-ns/configmaps/new", requests[1].URL.Path)
+	metadata = bodies[1]["metadata"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"label": "value"}, metadata["labels"])
+	assert.Equal(t, map[string]interface{}{ReplicatedByAnnotation: "source-ns/source"}, metadata["annotations"])
+	assert.Equal(t, map[string]interface{}{"data": "source"}, bodies[1]["data"])
+}
+
+func TestSecretActions_apply(t *testing.T) {
+	requests := []*http.Request{}
+	bodies := []map[string]interface{}{}
+	server := applyServer(t, &requests, &bodies)
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	actions := &secretActions{serverSideApply: true, applied: &appliedMeta{prefix: annotationsPrefix}}
+
+	source := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+		},
+		Type: v1.SecretTypeTLS,
+		Data: MB{v1.TLSCertKey: []byte("cert")},
+	}
+	// without data, the empty data of the type
+	_, err = actions.Install(context.TODO(), client, &metav1.ObjectMeta{
+		Namespace: "target-ns",
+		Name:      "target",
+	}, source, nil)
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/api/v1/namespaces/target-ns/secrets/target", requests[0].URL.Path)
+	assert.Equal(t, "Secret", bodies[0]["kind"])
+	assert.Equal(t, string(v1.SecretTypeTLS), bodies[0]["type"])
+	assert.Nil(t, bodies[0]["data"])
+	assert.Contains(t, bodies[0]["stringData"], v1.TLSCertKey)
+
+	// with the data of the source
+	_, err = actions.Install(context.TODO(), client, &metav1.ObjectMeta{
+		Namespace: "target-ns",
+		Name:      "target",
+	}, source, source)
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.Equal(t, map[string]interface{}{v1.TLSCertKey: "Y2VydA=="}, bodies[1]["data"])
+}
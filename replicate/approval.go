@@ -0,0 +1,158 @@
+// Approval of the changes of the sensitive sources before they are replicated
+
+package replicate
+
+import (
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Returns true if the data of the source may not be written to the target yet
+// It gates all the writes of the data of a source: to its targets and dependents, to the remote clusters and to the exports,
+// with an empty target for the last ones
+// The mutex must be held
+func (r *ObjectReplicator) heldBack(sourceObject interface{}, target string) bool {
+	return r.approvalHeld(sourceObject, target) || r.canaryHeld(sourceObject, target)
+}
+
+// Returns true if the target already has the data of the source, false for an empty target
+func (r *ObjectReplicator) targetHasData(target string, sourceObject interface{}) bool {
+	if target == "" {
+		return false
+	}
+	targetObject, exists, err := r.objectStore.GetByKey(target)
+	if err != nil || !exists {
+		return false
+	}
+	ok, _ := r.hasSourceData(targetObject, sourceObject)
+	return ok
+}
+
+// approval is the approval state of the data of a source requiring approval
+type approval struct {
+	// the resourceVersion of the source when its data was first seen, the version to approve
+	version  string
+	// the checksum of the data
+	checksum string
+	// held back since started, or since the restart
+	held     bool
+	approved bool
+}
+
+// Returns true if the approved resourceVersion is the version to approve, or a later one
+// The resourceVersions are compared as the revisions of etcd when they are integers, and must be equal otherwise
+func versionApproved(approved string, version string) bool {
+	if approved == "" {
+		return false
+	} else if approved == version {
+		return true
+	}
+	approvedRevision, err := strconv.ParseUint(approved, 10, 64)
+	if err != nil {
+		return false
+	}
+	revision, err := strconv.ParseUint(version, 10, 64)
+	return err == nil && approvedRevision >= revision
+}
+
+// Returns the approval of the current data of the source, restored from its pending-approval-version
+// and approval-checksum annotations, or started at the current resourceVersion of the source
+// The writes of the annotations of the source change its resourceVersion, but not its data, nor so the version to approve
+func (r *ObjectReplicator) currentApproval(sourceObject interface{}) *approval {
+	meta := r.GetMeta(sourceObject)
+	key := metaKey(meta)
+	checksum := r.DataChecksum(sourceObject)
+	if current, ok := r.approvals[key]; ok && current.checksum == checksum {
+		return current
+	}
+	current := &approval{version: meta.ResourceVersion, checksum: checksum}
+	// held before a restart
+	if version := meta.Annotations[PendingApprovalAnnotation]; version != "" && meta.Annotations[ApprovalChecksumAnnotation] == checksum {
+		current.version = version
+	}
+	r.approvals[key] = current
+	return current
+}
+
+// Returns true while the data of a source with the require-approval annotation is not approved,
+// unless the target already has this data
+// The version to approve is the resourceVersion of the source when its current data was first seen,
+// and the change is approved once the approved-version annotation is this resourceVersion, or a later one
+// The held version is written onto the source with the pending-approval-version annotation, and reported once,
+// along with the checksum of the data in the approval-checksum annotation, such that it survives the restarts
+// The mutex must be held
+func (r *ObjectReplicator) approvalHeld(sourceObject interface{}, target string) bool {
+	meta := r.GetMeta(sourceObject)
+	key := metaKey(meta)
+	if _, ok := meta.Annotations[RequireApprovalAnnotation]; !ok {
+		delete(r.approvals, key)
+		return false
+	}
+	current := r.currentApproval(sourceObject)
+	if versionApproved(meta.Annotations[ApprovedVersionAnnotation], current.version) {
+		if current.held && !current.approved {
+			r.logger.Info("change approved", "source", key, "version", current.version)
+			r.event(sourceObject, v1.EventTypeNormal, ReasonApproved, "version %s approved", current.version)
+		}
+		current.approved = true
+		return false
+	}
+	if r.targetHasData(target, sourceObject) {
+		return false
+	}
+	r.metrics.approvalHeld.WithLabelValues(r.Name).Inc()
+	if current.held {
+		return true
+	}
+	current.held = true
+	// already reported before a restart
+	if meta.Annotations[PendingApprovalAnnotation] == current.version && meta.Annotations[ApprovalChecksumAnnotation] == current.checksum {
+		return true
+	}
+	r.logger.Info("change waits for approval", "source", key, "version", current.version)
+	// a pending change is not a failure, it is neither retried nor notified
+	r.event(sourceObject, v1.EventTypeNormal, ReasonApprovalRequired,
+		"version %s waits for approval, set the %s annotation to it, or to a later resourceVersion", current.version, ApprovedVersionAnnotation)
+	r.writeSourceAnnotations(sourceObject, map[string]string{
+		PendingApprovalAnnotation:  current.version,
+		ApprovalChecksumAnnotation: current.checksum,
+	})
+	return true
+}
+
+// Writes annotations onto the source, such that the state they store survives the restarts
+func (r *ObjectReplicator) writeSourceAnnotations(sourceObject interface{}, values map[string]string) {
+	meta := r.GetMeta(sourceObject)
+	key := metaKey(meta)
+	annotations := cloneSMap(meta.Annotations)
+	for annotation, value := range values {
+		annotations[annotation] = value
+	}
+	start := time.Now()
+	ctx, cancel := r.requestContext(r.ctx)
+	newObject, err := r.Update(ctx, r.client, sourceObject, sourceObject, annotations)
+	cancel()
+	r.observeAction("status", start, err)
+	r.audit("annotate", key, key, newObject, err)
+	if err != nil {
+		r.logger.Error(err, "could not write annotations", "source", key)
+		return
+	}
+	// update the object store in advance
+	if err := r.objectStore.Update(newObject); err != nil {
+		r.logger.Error(err, "could not update store", "source", key)
+	}
+}
+
+// Returns the versions of the sources waiting for approval, by source
+func (r *ObjectReplicator) pendingApprovals() map[string]string {
+	pending := map[string]string{}
+	for source, current := range r.approvals {
+		if current.held && !current.approved {
+			pending[source] = current.version
+		}
+	}
+	return pending
+}
@@ -0,0 +1,145 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApprovedTargets(t *testing.T) {
+	exporter := &testExporter{exports: map[string]*ExportedSource{}}
+	r := createTestReplicator(t, ReplicatorOptions{
+		Exporters: map[string]ExternalExporter{"vault": exporter},
+	}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation:        "target-ns/target",
+		ReplicationAllowedAnnotation: "true",
+		RequireApprovalAnnotation:    "true",
+		ExportToAnnotation:           "vault:dr/source",
+	})
+	version := source.Meta.ResourceVersion
+	dependent := updateObject(r, "target-ns", "dependent", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+
+	// held back until approved, the held version is written onto the source
+	r.ObjectAdded(source)
+	r.ObjectAdded(dependent)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, "source-ns/source", metaKey(&r.ReplicatorActions.(*testActions).Actions[0].Object.Meta))
+	source = getObject(r, "source-ns", "source")
+	assert.Equal(t, version, source.Meta.Annotations[PendingApprovalAnnotation])
+	assert.Nil(t, getObject(r, "target-ns", "target"))
+	assert.Empty(t, exporter.exports, "not exported")
+	assert.Equal(t, map[string]string{"source-ns/source": version}, r.Status().PendingApprovals)
+	assert.Empty(t, r.Status().LastError, "not a failure")
+
+	// the annotations of the source changed, the version to approve did not
+	annotated := &testObject{Type: source.Type, Data: source.Data, Meta: *source.Meta.DeepCopy()}
+	annotated.Meta.Annotations["other"] = "value"
+	annotated.Meta.ResourceVersion = "annotated"
+	require.NoError(t, r.objectStore.Update(annotated))
+	r.ObjectAdded(annotated)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, r.DataChecksum(source), r.DataChecksum(annotated))
+	assert.Equal(t, map[string]string{"source-ns/source": version}, r.Status().PendingApprovals)
+
+	// a target, after a restart, is not installed by its own events, and the change is not reported again
+	r.approvals = map[string]*approval{}
+	target := &testObject{Meta: metav1.ObjectMeta{
+		Namespace:   "target-ns",
+		Name:        "target",
+		Annotations: M{ReplicatedByAnnotation: "source-ns/source"},
+	}}
+	require.NoError(t, r.objectStore.Add(target))
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, map[string]string{"source-ns/source": version}, r.Status().PendingApprovals)
+	require.NoError(t, r.objectStore.Delete(target))
+
+	approved := &testObject{Type: annotated.Type, Data: annotated.Data, Meta: *annotated.Meta.DeepCopy()}
+	approved.Meta.Annotations[ApprovedVersionAnnotation] = version
+	approved.Meta.ResourceVersion = "approved"
+	require.NoError(t, r.objectStore.Update(approved))
+	r.ObjectAdded(approved)
+	handleExternalCalls(t, r, approved)
+	require.NotNil(t, getObject(r, "target-ns", "target"))
+	assert.Equal(t, approved.Data, getObject(r, "target-ns", "target").Data)
+	assert.Equal(t, approved.Data, getObject(r, "target-ns", "dependent").Data)
+	assert.Contains(t, exporter.exports, "dr/source")
+	assert.Empty(t, r.Status().PendingApprovals)
+
+	// a new change is held back again
+	source = updateObject(r, "source-ns", "source", nil)
+	r.ObjectAdded(source)
+	assert.NotEqual(t, source.Data, getObject(r, "target-ns", "target").Data)
+	assert.NotEqual(t, source.Data, getObject(r, "target-ns", "dependent").Data)
+	assert.Equal(t, map[string]string{"source-ns/source": source.Meta.ResourceVersion}, r.Status().PendingApprovals)
+
+	// not requiring approval anymore
+	source = getObject(r, "source-ns", "source")
+	delete(source.Meta.Annotations, RequireApprovalAnnotation)
+	r.ObjectAdded(source)
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+	assert.Empty(t, r.Status().PendingApprovals)
+}
+
+func TestApprovalPendingTarget(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{TargetConditions: true}, "source-ns", "target-ns")
+	dependent := updateObject(r, "target-ns", "dependent", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	earlier := dependent.Meta.ResourceVersion
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+		RequireApprovalAnnotation:    "true",
+	})
+	r.ObjectAdded(source)
+	r.ObjectAdded(dependent)
+	// the target is pending, the source is not failed
+	dependent = getObject(r, "target-ns", "dependent")
+	assert.Equal(t, TargetPending, dependent.Meta.Annotations[ReplicationStateAnnotation])
+	assert.NotEqual(t, source.Data, dependent.Data)
+	assert.Empty(t, r.Status().LastError)
+	assert.Zero(t, r.Status().FailedActions)
+
+	source = getObject(r, "source-ns", "source")
+	// an earlier resourceVersion does not approve the change
+	stale := &testObject{Type: source.Type, Data: source.Data, Meta: *source.Meta.DeepCopy()}
+	stale.Meta.Annotations[ApprovedVersionAnnotation] = earlier
+	stale.Meta.ResourceVersion = "stale"
+	require.NoError(t, r.objectStore.Update(stale))
+	r.ObjectAdded(stale)
+	assert.Equal(t, TargetPending, getObject(r, "target-ns", "dependent").Meta.Annotations[ReplicationStateAnnotation])
+
+	// approved with the resourceVersion of the source, later than the pending one
+	assert.NotEqual(t, source.Meta.Annotations[PendingApprovalAnnotation], source.Meta.ResourceVersion)
+	approved := &testObject{Type: source.Type, Data: source.Data, Meta: *source.Meta.DeepCopy()}
+	approved.Meta.Annotations[ApprovedVersionAnnotation] = source.Meta.ResourceVersion
+	approved.Meta.ResourceVersion = "approved"
+	require.NoError(t, r.objectStore.Update(approved))
+	r.ObjectAdded(approved)
+	dependent = getObject(r, "target-ns", "dependent")
+	assert.Equal(t, TargetSynced, dependent.Meta.Annotations[ReplicationStateAnnotation])
+	assert.Equal(t, approved.Data, dependent.Data)
+
+	// changed during a restart, the earlier approval does not approve the new data
+	r.approvals = map[string]*approval{}
+	changed := &testObject{Type: approved.Type, Data: "changed", Meta: *approved.Meta.DeepCopy()}
+	changed.Meta.ResourceVersion = "1000"
+	require.NoError(t, r.objectStore.Update(changed))
+	r.ObjectAdded(changed)
+	assert.Equal(t, approved.Data, getObject(r, "target-ns", "dependent").Data)
+	assert.Equal(t, map[string]string{"source-ns/source": "1000"}, r.Status().PendingApprovals)
+}
+
+func Test_versionApproved(t *testing.T) {
+	assert.True(t, versionApproved("12", "12"))
+	assert.True(t, versionApproved("13", "12"), "later")
+	assert.False(t, versionApproved("11", "12"), "earlier")
+	assert.False(t, versionApproved("", "12"), "not approved")
+	assert.True(t, versionApproved("a", "a"))
+	assert.False(t, versionApproved("b", "a"), "not comparable")
+}
@@ -0,0 +1,54 @@
+// Metadata of the targets for ArgoCD, such that GitOps does not fight the replicator over them
+
+package replicate
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ArgoCDCompareOptionsAnnotation tells ArgoCD how to compare the resource with the desired state
+	ArgoCDCompareOptionsAnnotation = "argocd.argoproj.io/compare-options"
+	// ArgoCDSyncOptionsAnnotation tells ArgoCD how to sync the resource
+	ArgoCDSyncOptionsAnnotation    = "argocd.argoproj.io/sync-options"
+	// ArgoCDInstanceLabel is the default label tracking the resources of an ArgoCD application
+	ArgoCDInstanceLabel            = "app.kubernetes.io/instance"
+)
+
+// ArgoCDMetadata is the metadata stamped on the created targets for ArgoCD
+type ArgoCDMetadata struct {
+	// the application the targets are tracked to, empty to not track them
+	App           string
+	// the label tracking the resources of the application
+	InstanceLabel string
+}
+
+// NewArgoCDMetadata returns the metadata ignoring the targets during the diffs and the prunes
+// With an application, the targets are also tracked to it by its instance label
+func NewArgoCDMetadata(app string, instanceLabel string) *ArgoCDMetadata {
+	if instanceLabel == "" {
+		instanceLabel = ArgoCDInstanceLabel
+	}
+	return &ArgoCDMetadata{
+		App:           app,
+		InstanceLabel: instanceLabel,
+	}
+}
+
+// Stamps the labels and annotations of a target, such that ArgoCD neither reports it as out of sync nor prunes it
+func (a *ArgoCDMetadata) stamp(meta *metav1.ObjectMeta) {
+	if a == nil {
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[ArgoCDCompareOptionsAnnotation] = "IgnoreExtraneous"
+	meta.Annotations[ArgoCDSyncOptionsAnnotation] = "Prune=false"
+	if a.App != "" {
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		meta.Labels[a.InstanceLabel] = a.App
+	}
+}
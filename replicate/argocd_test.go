@@ -0,0 +1,62 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestArgoCDMetadata_stamp(t *testing.T) {
+	meta := &metav1.ObjectMeta{Name: "target"}
+	var disabled *ArgoCDMetadata
+	disabled.stamp(meta)
+	assert.Nil(t, meta.Annotations, "disabled")
+	assert.Nil(t, meta.Labels, "disabled")
+
+	NewArgoCDMetadata("", "").stamp(meta)
+	assert.Equal(t, M{
+		ArgoCDCompareOptionsAnnotation: "IgnoreExtraneous",
+		ArgoCDSyncOptionsAnnotation:    "Prune=false",
+	}, meta.Annotations)
+	assert.Nil(t, meta.Labels, "not tracked")
+
+	meta = &metav1.ObjectMeta{Name: "target", Labels: M{"label": "value"}}
+	NewArgoCDMetadata("replicated", "").stamp(meta)
+	assert.Equal(t, M{"label": "value", ArgoCDInstanceLabel: "replicated"}, meta.Labels)
+	NewArgoCDMetadata("replicated", "argocd.argoproj.io/instance").stamp(meta)
+	assert.Equal(t, "replicated", meta.Labels["argocd.argoproj.io/instance"])
+}
+
+func TestReplicateTo_argoCD(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{
+		Labels: M{"label": "value"},
+		ArgoCD: NewArgoCDMetadata("replicated", ""),
+	}, "my-ns")
+	source := updateObject(r, "my-ns", "source", M{
+		ReplicateToAnnotation: "target",
+	})
+	r.ObjectAdded(source)
+	assertAction(t, r, 0, &testAction{
+		Action: "install",
+		Object: testObject{
+			Type: "0",
+			Data: "0",
+			Meta: metav1.ObjectMeta{
+				Name:      "target",
+				Namespace: "my-ns",
+				Labels: M{
+					"label":             "value",
+					ArgoCDInstanceLabel: "replicated",
+				},
+				Annotations: M{
+					ReplicatedFromVersionAnnotation: "0",
+					ReplicatedByAnnotation:          "my-ns/source",
+					ArgoCDCompareOptionsAnnotation:  "IgnoreExtraneous",
+					ArgoCDSyncOptionsAnnotation:     "Prune=false",
+				},
+			},
+		},
+	})
+	requireActionsLength(t, r, 1)
+}
@@ -0,0 +1,180 @@
+// Append-only audit log of the mutations performed by the replicators
+
+package replicate
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited action
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry records a mutation performed by a replicator
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	// the identity of the controller performing the action
+	Actor    string    `json:"actor"`
+	Resource string    `json:"resource"`
+	// install, update, clear or delete
+	Action   string    `json:"action"`
+	Source   string    `json:"source,omitempty"`
+	Target   string    `json:"target"`
+	// the checksum of the data of the target after the action
+	Checksum string    `json:"checksum,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	// the hash of the previous entry, chaining the entries together
+	Previous string    `json:"previous"`
+	// the hash of this entry, computed with an empty hash, keyed when the log has a key
+	Hash     string    `json:"hash"`
+}
+
+// AuditLog writes audit entries as JSON lines
+// Each entry contains the hash of the previous one, such that any removal or edition breaks the chain
+// With a key, the hashes are HMAC-SHA256, such that the entries cannot be forged again without the key
+type AuditLog struct {
+	mutex    sync.Mutex
+	writer   io.Writer
+	actor    string
+	previous string
+	key      []byte
+	now      func() time.Time
+}
+
+// NewAuditLog creates an audit log writing to the writer, after the entry with the given hash,
+// with the key of the hashes, nil for plain SHA-256 hashes
+func NewAuditLog(writer io.Writer, actor string, previous string, key []byte) *AuditLog {
+	return &AuditLog{
+		writer:   writer,
+		actor:    actor,
+		previous: previous,
+		key:      key,
+		now:      time.Now,
+	}
+}
+
+// OpenAuditLog opens the audit log file in append mode, or stdout if path is "-"
+// The entries already in the file are verified with the key, and the chain continues from the last one,
+// such that new entries are never chained onto an altered history
+func OpenAuditLog(path string, actor string, key []byte) (*AuditLog, error) {
+	if path == "-" {
+		return NewAuditLog(os.Stdout, actor, "", key), nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, previous, err := verifyAuditLog(file, key, "")
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid audit log %s: %s", path, err)
+	}
+	return NewAuditLog(file, actor, previous, key), nil
+}
+
+// Returns the hash of an entry, ignoring its current hash, keyed unless the key is nil
+func hashAuditEntry(entry AuditEntry, key []byte) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Record completes the entry with time, actor and hashes, and writes it
+func (a *AuditLog) Record(entry AuditEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entry.Time = a.now().UTC()
+	entry.Actor = a.actor
+	entry.Previous = a.previous
+	hash, err := hashAuditEntry(entry, a.key)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := a.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	a.previous = hash
+	return nil
+}
+
+// VerifyAuditLog checks that the entries read are correctly chained, with the key of the log, nil if it has none
+// The first entry must follow the given hash, empty for the start of the log, or the hash of the last entry of
+// the previous file, such that removing the first entries is detected too
+// Returns the number of valid entries
+func VerifyAuditLog(reader io.Reader, key []byte, previous string) (int, error) {
+	count, _, err := verifyAuditLog(reader, key, previous)
+	return count, err
+}
+
+// Verifies the entries read, and returns their number and the hash of the last one, previous if none
+func verifyAuditLog(reader io.Reader, key []byte, previous string) (int, string, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	count := 0
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, previous, fmt.Errorf("entry %d: %s", count+1, err)
+		}
+		if entry.Previous != previous {
+			return count, previous, fmt.Errorf("entry %d: previous hash does not match", count+1)
+		}
+		if hash, err := hashAuditEntry(entry, key); err != nil {
+			return count, previous, fmt.Errorf("entry %d: %s", count+1, err)
+		} else if hash != entry.Hash {
+			return count, previous, fmt.Errorf("entry %d: hash does not match", count+1)
+		}
+		previous = entry.Hash
+		count++
+	}
+	return count, previous, scanner.Err()
+}
+
+// Records an action in the audit log, if any
+func (r *ObjectReplicator) audit(action string, source string, target string, newObject interface{}, err error) {
+	if r.AuditLog == nil {
+		return
+	}
+	entry := AuditEntry{
+		Resource: r.Name,
+		Action:   action,
+		Source:   source,
+		Target:   target,
+		Outcome:  AuditSuccess,
+	}
+	if err != nil {
+		entry.Outcome = AuditFailure
+		entry.Error = err.Error()
+	} else if newObject != nil {
+		entry.Checksum = r.DataChecksum(newObject)
+	}
+	if err := r.AuditLog.Record(entry); err != nil {
+		r.logger.Error(err, "could not write audit log", "action", action, "source", source, "target", target)
+	}
+}
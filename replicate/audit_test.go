@@ -0,0 +1,154 @@
+package replicate
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func auditEntries(t *testing.T, buffer *bytes.Buffer) []AuditEntry {
+	entries := []AuditEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		entry := AuditEntry{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	r := createTestReplicator(t, ReplicatorOptions{
+		AuditLog: NewAuditLog(buffer, "test-actor", "", nil),
+	}, "source-ns", "target-ns")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	source.Data = "data"
+	r.ObjectAdded(source)
+	source = deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(source)
+	requireActionsLength(t, r, 2)
+
+	entries := auditEntries(t, buffer)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "install", entries[0].Action)
+	assert.Equal(t, "source-ns/source", entries[0].Source)
+	assert.Equal(t, "target-ns/target", entries[0].Target)
+	assert.Equal(t, AuditSuccess, entries[0].Outcome)
+	assert.Equal(t, "test-actor", entries[0].Actor)
+	assert.Equal(t, r.DataChecksum(source), entries[0].Checksum)
+	assert.Equal(t, "delete", entries[1].Action)
+	assert.Equal(t, "source-ns/source", entries[1].Source)
+	assert.Equal(t, entries[0].Hash, entries[1].Previous)
+
+	count, err := VerifyAuditLog(bytes.NewReader(buffer.Bytes()), nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	tampered := strings.Replace(buffer.String(), "target-ns/target", "target-ns/other", 1)
+	_, err = VerifyAuditLog(strings.NewReader(tampered), nil, "")
+	assert.Error(t, err, "modified entry")
+	lines := strings.SplitN(buffer.String(), "\n", 2)
+	_, err = VerifyAuditLog(strings.NewReader(lines[1] + lines[1]), nil, "")
+	assert.Error(t, err, "replayed entry")
+	_, err = VerifyAuditLog(strings.NewReader(lines[1]), nil, "")
+	assert.Error(t, err, "truncated log")
+	count, err = VerifyAuditLog(strings.NewReader(lines[1]), nil, entries[0].Hash)
+	require.NoError(t, err, "continued log")
+	assert.Equal(t, 1, count)
+}
+
+func TestAuditLogKey(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	log := NewAuditLog(buffer, "test-actor", "", []byte("secret"))
+	require.NoError(t, log.Record(AuditEntry{Action: "install", Target: "target-ns/target", Outcome: AuditSuccess}))
+	require.NoError(t, log.Record(AuditEntry{Action: "delete", Target: "target-ns/target", Outcome: AuditSuccess}))
+
+	count, err := VerifyAuditLog(bytes.NewReader(buffer.Bytes()), []byte("secret"), "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	_, err = VerifyAuditLog(bytes.NewReader(buffer.Bytes()), []byte("other"), "")
+	assert.Error(t, err, "wrong key")
+	_, err = VerifyAuditLog(bytes.NewReader(buffer.Bytes()), nil, "")
+	assert.Error(t, err, "no key")
+
+	// rewritten and chained again without the key
+	forged := &bytes.Buffer{}
+	forger := NewAuditLog(forged, "test-actor", "", nil)
+	require.NoError(t, forger.Record(AuditEntry{Action: "install", Target: "target-ns/other", Outcome: AuditSuccess}))
+	_, err = VerifyAuditLog(bytes.NewReader(forged.Bytes()), []byte("secret"), "")
+	assert.Error(t, err, "forged entry")
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := OpenAuditLog(path, "test-actor", []byte("secret"))
+	require.NoError(t, err)
+	require.NoError(t, log.Record(AuditEntry{Action: "install", Target: "target-ns/target", Outcome: AuditSuccess}))
+	require.NoError(t, log.Record(AuditEntry{Action: "delete", Target: "target-ns/target", Outcome: AuditSuccess}))
+
+	// resumed after the last entry
+	log, err = OpenAuditLog(path, "test-actor", []byte("secret"))
+	require.NoError(t, err)
+	require.NoError(t, log.Record(AuditEntry{Action: "install", Target: "target-ns/other", Outcome: AuditSuccess}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	count, err := VerifyAuditLog(bytes.NewReader(data), []byte("secret"), "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// not resumed after an altered history
+	_, err = OpenAuditLog(path, "test-actor", []byte("other"))
+	assert.Error(t, err, "wrong key")
+	lines := strings.SplitN(string(data), "\n", 2)
+	require.NoError(t, os.WriteFile(path, []byte(lines[1]), 0600))
+	_, err = OpenAuditLog(path, "test-actor", []byte("secret"))
+	assert.Error(t, err, "truncated log")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), "target-ns/other", "target-ns/edited", 1)), 0600))
+	_, err = OpenAuditLog(path, "test-actor", []byte("secret"))
+	assert.Error(t, err, "modified entry")
+}
+
+func TestAuditLogWrites(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	creatable, err := ParseNamespacePatterns("missing-ns")
+	require.NoError(t, err)
+	r := createTestReplicator(t, ReplicatorOptions{
+		AuditLog:            NewAuditLog(buffer, "test-actor", "", nil),
+		CreateNamespaces:    true,
+		CreatableNamespaces: creatable,
+	}, "source-ns")
+	r.client = fake.NewSimpleClientset()
+
+	// the namespace created for the target
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "missing-ns/target",
+	})
+	r.ObjectAdded(source)
+	// the annotation written onto the source waiting for approval
+	held := updateObject(r, "source-ns", "held", M{
+		ReplicateToAnnotation:     "missing-ns/held",
+		RequireApprovalAnnotation: "true",
+	})
+	r.ObjectAdded(held)
+
+	entries := auditEntries(t, buffer)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "create-namespace", entries[0].Action)
+	assert.Equal(t, "source-ns/source", entries[0].Source)
+	assert.Equal(t, "missing-ns", entries[0].Target)
+	assert.Equal(t, AuditSuccess, entries[0].Outcome)
+	assert.Equal(t, "install", entries[1].Action)
+	assert.Equal(t, "annotate", entries[2].Action)
+	assert.Equal(t, "source-ns/held", entries[2].Target)
+	assert.Equal(t, AuditSuccess, entries[2].Outcome)
+}
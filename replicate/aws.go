@@ -0,0 +1,165 @@
+// AWS Secrets Manager and SSM Parameter Store providers of external secrets, and S3 exporter of the sources
+
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// the AWS services the secrets are read from
+	awsSecretsManager = "secretsmanager"
+	awsSSM            = "ssm"
+	// the key of the data of a secret which is not a JSON object
+	externalValueKey  = "value"
+)
+
+// Returns the configuration of the region, with the web identity of IRSA assumed with STS,
+// else the default credentials of AWS, such as the static access keys
+func loadAWSConfig(region string) (aws.Config, error) {
+	if region == "" {
+		return aws.Config{}, fmt.Errorf("AWS region is required")
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	if err != nil {
+		return aws.Config{}, err
+	}
+	roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN != "" && tokenFile != "" {
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), roleARN, stscreds.IdentityTokenFile(tokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = "k8s-replicator"
+			})
+		// renewed when they are about to expire
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return cfg, nil
+}
+
+// AWSProvider reads the secrets of AWS Secrets Manager, or the parameters of SSM Parameter Store
+type AWSProvider struct {
+	service        string
+	secretsManager *secretsmanager.Client
+	ssm            *ssm.Client
+}
+
+// NewAWSProvider returns the provider of the service, secretsmanager or ssm, in the region
+func NewAWSProvider(service string, region string) (*AWSProvider, error) {
+	if service != awsSecretsManager && service != awsSSM {
+		return nil, fmt.Errorf("unknown AWS service \"%s\"", service)
+	}
+	cfg, err := loadAWSConfig(region)
+	if err != nil {
+		return nil, err
+	}
+	provider := &AWSProvider{service: service}
+	if service == awsSSM {
+		provider.ssm = ssm.NewFromConfig(cfg)
+	} else {
+		provider.secretsManager = secretsmanager.NewFromConfig(cfg)
+	}
+	return provider, nil
+}
+
+// Get returns the secret of Secrets Manager, or the parameter of Parameter Store, decrypted
+// A JSON object is split into keys, any other value is under the "value" key
+func (p *AWSProvider) Get(ctx context.Context, name string) (*ExternalSecret, error) {
+	if p.service == awsSSM {
+		output, err := p.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &ExternalSecret{
+			Data:    externalData([]byte(aws.ToString(output.Parameter.Value))),
+			Version: strconv.FormatInt(output.Parameter.Version, 10),
+		}, nil
+	}
+	output, err := p.secretsManager.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	secret := &ExternalSecret{Version: aws.ToString(output.VersionId)}
+	if output.SecretString != nil {
+		secret.Data = externalData([]byte(*output.SecretString))
+	} else {
+		secret.Data = map[string][]byte{externalValueKey: output.SecretBinary}
+	}
+	return secret, nil
+}
+
+// S3Exporter puts the sources as JSON documents into the buckets of S3
+type S3Exporter struct {
+	client *s3.Client
+}
+
+// NewS3Exporter returns the exporter to the buckets of the region
+func NewS3Exporter(region string) (*S3Exporter, error) {
+	cfg, err := loadAWSConfig(region)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Exporter{client: s3.NewFromConfig(cfg)}, nil
+}
+
+// Export puts the source at the path, "<bucket>/<key>"
+func (e *S3Exporter) Export(ctx context.Context, path string, source *ExportedSource) error {
+	split := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return fmt.Errorf("invalid path \"%s\": expected bucket/key", path)
+	}
+	body, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	_, err = e.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(split[0]),
+		Key:         aws.String(split[1]),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// Returns the data of a secret, split into keys when it is a JSON object
+func externalData(value []byte) map[string][]byte {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err != nil || object == nil {
+		return map[string][]byte{externalValueKey: value}
+	}
+	data := make(map[string][]byte, len(object))
+	for key, raw := range object {
+		var str string
+		if err := json.Unmarshal(raw, &str); err == nil {
+			data[key] = []byte(str)
+		} else {
+			data[key] = []byte(raw)
+		}
+	}
+	return data
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
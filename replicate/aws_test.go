@@ -0,0 +1,147 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Points the AWS clients to the server with the environment, isolated from the configuration of the host
+func setTestAWSEnv(t *testing.T, server *httptest.Server, env map[string]string) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_PROFILE"} {
+		t.Setenv(name, env[name])
+	}
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(os.TempDir(), "missing-aws-config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(os.TempDir(), "missing-aws-credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+}
+
+func TestNewAWSProvider(t *testing.T) {
+	_, err := NewAWSProvider("s3", "eu-west-1")
+	assert.Error(t, err, "unknown service")
+	_, err = NewAWSProvider(awsSSM, "")
+	assert.Error(t, err, "no region")
+}
+
+func TestAWSProvider_secretsManager(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", req.Header.Get("X-Amz-Target"))
+		assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		var input map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&input))
+		switch input["SecretId"] {
+		case "prod/database":
+			_, _ = res.Write([]byte(`{"SecretString":"{\"user\":\"admin\",\"port\":5432}","VersionId":"v1"}`))
+		case "prod/certificate":
+			_, _ = res.Write([]byte(`{"SecretBinary":"AAEC","VersionId":"v2"}`))
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+			_, _ = res.Write([]byte(`{"__type":"ResourceNotFoundException","Message":"not found"}`))
+		}
+	}))
+	defer server.Close()
+	setTestAWSEnv(t, server, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+	})
+	provider, err := NewAWSProvider(awsSecretsManager, "eu-west-1")
+	require.NoError(t, err)
+
+	secret, err := provider.Get(context.TODO(), "prod/database")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", secret.Version)
+	assert.Equal(t, map[string][]byte{"user": []byte("admin"), "port": []byte("5432")}, secret.Data)
+
+	secret, err = provider.Get(context.TODO(), "prod/certificate")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"value": {0, 1, 2}}, secret.Data)
+
+	_, err = provider.Get(context.TODO(), "missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ResourceNotFoundException: not found")
+}
+
+func TestAWSProvider_webIdentity(t *testing.T) {
+	assumed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Amz-Target") == "" {
+			require.NoError(t, req.ParseForm())
+			assert.Equal(t, "AssumeRoleWithWebIdentity", req.Form.Get("Action"))
+			assert.Equal(t, "arn:aws:iam::123456789012:role/replicator", req.Form.Get("RoleArn"))
+			assert.Equal(t, "token", strings.TrimSpace(req.Form.Get("WebIdentityToken")))
+			assert.Equal(t, "k8s-replicator", req.Form.Get("RoleSessionName"))
+			assumed++
+			_, _ = res.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>` +
+				`<AccessKeyId>ASIA</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>` +
+				`<Expiration>` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `</Expiration>` +
+				`</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+			return
+		}
+		assert.Equal(t, "AmazonSSM.GetParameter", req.Header.Get("X-Amz-Target"))
+		assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+		assert.Contains(t, req.Header.Get("Authorization"), "Credential=ASIA/")
+		_, _ = res.Write([]byte(`{"Parameter":{"Name":"/prod/token","Value":"plain","Version":3}}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "aws")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token\n"), 0600))
+	setTestAWSEnv(t, server, map[string]string{
+		"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/replicator",
+		"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile,
+	})
+	provider, err := NewAWSProvider(awsSSM, "eu-west-1")
+	require.NoError(t, err)
+
+	secret, err := provider.Get(context.TODO(), "/prod/token")
+	require.NoError(t, err)
+	assert.Equal(t, &ExternalSecret{Data: map[string][]byte{"value": []byte("plain")}, Version: "3"}, secret)
+	// the credentials are kept until they are about to expire
+	_, err = provider.Get(context.TODO(), "/prod/token")
+	require.NoError(t, err)
+	assert.Equal(t, 1, assumed)
+}
+
+func TestAWSProvider_noCredentials(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	setTestAWSEnv(t, server, map[string]string{})
+	provider, err := NewAWSProvider(awsSSM, "eu-west-1")
+	require.NoError(t, err)
+	_, err = provider.Get(context.TODO(), "/prod/token")
+	assert.Error(t, err)
+}
+
+func TestS3Exporter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPut, req.Method)
+		assert.Equal(t, "/dr-snapshots/prod/database.json", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Contains(t, req.Header.Get("Authorization"), "/eu-west-1/s3/aws4_request")
+		var source ExportedSource
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&source))
+		assert.Equal(t, "database", source.Name)
+	}))
+	defer server.Close()
+	setTestAWSEnv(t, server, map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"})
+	exporter, err := NewS3Exporter("eu-west-1")
+	require.NoError(t, err)
+
+	require.NoError(t, exporter.Export(context.TODO(), "dr-snapshots/prod/database.json", &ExportedSource{Name: "database"}))
+	assert.Error(t, exporter.Export(context.TODO(), "dr-snapshots", &ExportedSource{}), "no key")
+}
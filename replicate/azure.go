@@ -0,0 +1,99 @@
+// Azure Key Vault provider of external secrets
+
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+)
+
+// matches the names and the versions of the secrets of Key Vault
+var azureSecretName = regexp.MustCompile(`^[0-9a-zA-Z-]{1,127}$`)
+
+// AzureProvider reads the secrets of Azure Key Vault
+// The credential is the default one of Azure: the federated token of AZURE_FEDERATED_TOKEN_FILE, as with
+// the workload identity of AKS, the client secret of AZURE_CLIENT_SECRET, or else the managed identity
+type AzureProvider struct {
+	// the URL of a vault, with its name as "%s", and the options of its clients, replaced in tests
+	vaultURL      string
+	clientOptions *azsecrets.ClientOptions
+	// returns the credential, replaced in tests
+	newCredential func() (azcore.TokenCredential, error)
+
+	mutex         sync.Mutex
+	credential    azcore.TokenCredential
+	// the clients of the vaults, by vault
+	clients       map[string]*azsecrets.Client
+}
+
+// NewAzureProvider returns the provider of Key Vault
+func NewAzureProvider() *AzureProvider {
+	return &AzureProvider{
+		vaultURL: "https://%s.vault.azure.net/",
+		newCredential: func() (azcore.TokenCredential, error) {
+			return azidentity.NewDefaultAzureCredential(nil)
+		},
+		clients: map[string]*azsecrets.Client{},
+	}
+}
+
+// Returns the client of the vault, the credential being created on first use
+func (p *AzureProvider) getClient(vault string) (*azsecrets.Client, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if client, ok := p.clients[vault]; ok {
+		return client, nil
+	}
+	if p.credential == nil {
+		credential, err := p.newCredential()
+		if err != nil {
+			return nil, fmt.Errorf("could not get Azure credential: %s", err)
+		}
+		p.credential = credential
+	}
+	client, err := azsecrets.NewClient(fmt.Sprintf(p.vaultURL, vault), p.credential, p.clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[vault] = client
+	return client, nil
+}
+
+// Get returns the secret, named "<vault>/<secret>", at its current version, or "<vault>/<secret>/<version>"
+// A JSON object is split into keys, any other value is under the "value" key
+func (p *AzureProvider) Get(ctx context.Context, name string) (*ExternalSecret, error) {
+	split := strings.Split(name, "/")
+	if len(split) < 2 || len(split) > 3 || !validName.MatchString(split[0]) || !azureSecretName.MatchString(split[1]) {
+		return nil, fmt.Errorf("invalid secret \"%s\": expected vault/secret", name)
+	}
+	version := ""
+	if len(split) == 3 {
+		if version = split[2]; !azureSecretName.MatchString(version) {
+			return nil, fmt.Errorf("invalid secret \"%s\": invalid version", name)
+		}
+	}
+	client, err := p.getClient(split[0])
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.GetSecret(ctx, split[1], version, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := ""
+	if response.Value != nil {
+		value = *response.Value
+	}
+	secret := &ExternalSecret{Data: externalData([]byte(value))}
+	if response.ID != nil {
+		secret.Version = response.ID.Version()
+	}
+	return secret, nil
+}
@@ -0,0 +1,78 @@
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAzureCredential returns a token for the scopes of Key Vault
+type testAzureCredential struct {
+	t *testing.T
+}
+
+func (c testAzureCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	assert.Equal(c.t, []string{"https://vault.azure.net/.default"}, options.Scopes)
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestAzureProvider(t *testing.T) {
+	paths := []string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// the first request is the challenge of the tenant and the resource of the token
+		if req.Header.Get("Authorization") == "" {
+			res.Header().Set("WWW-Authenticate", `Bearer authorization="https://login.microsoftonline.com/tenant", resource="https://vault.azure.net"`)
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+		paths = append(paths, req.URL.Path)
+		if req.URL.Path != "/prod-vault/secrets/database/" && req.URL.Path != "/prod-vault/secrets/database/abc123" {
+			res.WriteHeader(http.StatusNotFound)
+			_, _ = res.Write([]byte(`{"error":{"code":"SecretNotFound","message":"not found"}}`))
+			return
+		}
+		_, _ = res.Write([]byte(`{"value":"{\"user\":\"admin\"}","id":"https://prod-vault.vault.azure.net/secrets/database/abc123"}`))
+	}))
+	defer server.Close()
+	provider := NewAzureProvider()
+	provider.vaultURL = server.URL + "/%s"
+	provider.clientOptions = &azsecrets.ClientOptions{DisableChallengeResourceVerification: true}
+	provider.clientOptions.Transport = server.Client()
+	provider.newCredential = func() (azcore.TokenCredential, error) {
+		return testAzureCredential{t: t}, nil
+	}
+
+	secret, err := provider.Get(context.TODO(), "prod-vault/database")
+	require.NoError(t, err)
+	assert.Equal(t, &ExternalSecret{Data: map[string][]byte{"user": []byte("admin")}, Version: "abc123"}, secret)
+	_, err = provider.Get(context.TODO(), "prod-vault/database/abc123")
+	require.NoError(t, err)
+	_, err = provider.Get(context.TODO(), "prod-vault/missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "SecretNotFound")
+	assert.Equal(t, []string{"/prod-vault/secrets/database/", "/prod-vault/secrets/database/abc123", "/prod-vault/secrets/missing/"}, paths)
+
+	for _, name := range []string{"database", "prod-vault/", "prod-vault/database?x=y", "prod-vault/../keys/database",
+		"prod-vault/database/abc/def", "prod-vault/database/abc?x=y", "Prod_Vault/database"} {
+		_, err = provider.Get(context.TODO(), name)
+		assert.Error(t, err, name)
+	}
+	assert.Len(t, paths, 3, "invalid names are not requested")
+
+	provider = NewAzureProvider()
+	provider.newCredential = func() (azcore.TokenCredential, error) {
+		return nil, fmt.Errorf("no credentials")
+	}
+	_, err = provider.Get(context.TODO(), "prod-vault/database")
+	assert.Error(t, err, "no credentials")
+}
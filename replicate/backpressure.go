@@ -0,0 +1,35 @@
+// Bounded work queues, and their metrics
+
+package replicate
+
+import (
+	"sync/atomic"
+)
+
+// Returns true if the queue is full, then the event is dropped
+// All the objects are handled again once the queue is drained, which recomputes the dropped events
+// The deletions are never dropped, since their last state would be lost
+func (r *ObjectReplicator) shed() bool {
+	if r.MaxQueueLength <= 0 || r.queue.Len() < r.MaxQueueLength {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&r.shedding, 0, 1) {
+		r.logger.Info("queue is full, dropping the events until it is drained", "length", r.queue.Len())
+	}
+	r.metrics.queueShed.WithLabelValues(r.Name).Inc()
+	return true
+}
+
+// Queues all the objects again once the queue is drained, if events were dropped
+// The sources replicate again to all the namespaces, so the dropped namespaces are recomputed too
+func (r *ObjectReplicator) recomputeShed() {
+	if r.queue.Len() > 0 || !atomic.CompareAndSwapInt32(&r.shedding, 1, 0) {
+		return
+	}
+	keys := r.currentObjectStore().ListKeys()
+	r.logger.Info("queue is drained, handling all the objects again", "objects", len(keys))
+	r.metrics.queueRecomputes.WithLabelValues(r.Name).Inc()
+	for _, key := range keys {
+		r.queue.Add(queueItem{key: key})
+	}
+}
@@ -0,0 +1,31 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue_shed(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{MaxQueueLength: 2})
+	r.initQueue()
+	for _, name := range []string{"a", "b", "c"} {
+		r.enqueueObject(updateObject(r, "ns", name, M{}))
+	}
+	assert.Equal(t, 2, r.queue.Len())
+	assert.Equal(t, int32(1), r.shedding)
+	// the deletions are never dropped
+	r.enqueueDeletedObject(deleteObject(r, "ns", "c"))
+	assert.Equal(t, 3, r.queue.Len())
+
+	require.True(t, r.processNextItem())
+	require.True(t, r.processNextItem())
+	assert.Equal(t, 1, r.queue.Len())
+	// drained, all the objects are handled again
+	require.True(t, r.processNextItem())
+	assert.Equal(t, 2, r.queue.Len())
+	assert.Equal(t, int32(0), r.shedding)
+	processQueue(t, r)
+	assert.Equal(t, 0, r.queue.Len())
+}
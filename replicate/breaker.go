@@ -0,0 +1,164 @@
+// Circuit breaking of the targets which keep failing
+
+package replicate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the longest a target is backed off
+const maxTargetBackoff = time.Hour
+
+// targetBreaker is the failure state of a target
+type targetBreaker struct {
+	// consecutive failures
+	failures int
+	// consecutive times the breaker opened, doubling the backoff each time
+	trips     int
+	openUntil time.Time
+}
+
+// targetBreakers backs off the targets failing repeatedly, as when denied by an admission webhook,
+// such that they do not slow down the replication to the other targets
+type targetBreakers struct {
+	mutex     sync.Mutex
+	threshold int
+	backoff   time.Duration
+	targets   map[string]*targetBreaker
+	now       func() time.Time
+}
+
+// Returns the breakers, nil if disabled
+func newTargetBreakers(threshold int, backoff time.Duration) *targetBreakers {
+	if threshold <= 0 {
+		return nil
+	}
+	return &targetBreakers{
+		threshold: threshold,
+		backoff:   backoff,
+		targets:   map[string]*targetBreaker{},
+		now:       time.Now,
+	}
+}
+
+// Returns true if the target may be written,
+// or else how long it is still backed off
+func (b *targetBreakers) allow(target string) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breaker, ok := b.targets[target]
+	if !ok {
+		return true, 0
+	}
+	if remaining := breaker.openUntil.Sub(b.now()); remaining > 0 {
+		return false, remaining
+	}
+	return true, 0
+}
+
+// Records the result of a write to the target
+// Returns true if the target is now backed off, and for how long
+func (b *targetBreakers) record(target string, err error) (bool, time.Duration) {
+	if b == nil {
+		return false, 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.targets, target)
+		return false, 0
+	}
+	breaker, ok := b.targets[target]
+	if !ok {
+		breaker = &targetBreaker{}
+		b.targets[target] = breaker
+	}
+	breaker.failures++
+	if breaker.failures < b.threshold {
+		return false, 0
+	}
+	breaker.trips++
+	delay := b.backoff
+	for i := 1; i < breaker.trips && delay < maxTargetBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxTargetBackoff {
+		delay = maxTargetBackoff
+	}
+	breaker.openUntil = b.now().Add(delay)
+	// a failure of the next attempt opens it again
+	breaker.failures = b.threshold - 1
+	return true, delay
+}
+
+// Forgets a deleted target
+func (b *targetBreakers) delete(target string) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.targets, target)
+}
+
+// Returns the count of targets currently backed off
+func (b *targetBreakers) open() int {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	count := 0
+	now := b.now()
+	for _, breaker := range b.targets {
+		if breaker.openUntil.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// Records that a target was backed off, for the handled item to be queued again once the first backoff ends
+func (s *replicatorStats) backedOff(delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.backoff == 0 || delay < s.backoff {
+		s.backoff = delay
+	}
+}
+
+// Returns the shortest backoff of the targets backed off since last called, 0 if none
+func (s *replicatorStats) takeBackoff() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delay := s.backoff
+	s.backoff = 0
+	return delay
+}
+
+// Writes the target unless it is backed off after repeated failures
+// Once backed off, the handled item is queued again when the backoff ends, instead of being retried
+// The conflicts and throttlings are retried, and so are not failures
+func (r *ObjectReplicator) throughBreaker(target string, write func() error) error {
+	if ok, remaining := r.breakers.allow(target); !ok {
+		r.metrics.breakerRejections.WithLabelValues(r.Name).Inc()
+		return fmt.Errorf("target %s is backed off after repeated failures, retrying in %s",
+			target, remaining.Round(time.Second))
+	}
+	err := write()
+	// retrying cannot fix a permanent error, the target is not backed off on it
+	if _, throttled := retryAfter(err); err != nil && (isConflict(err) || throttled || isPermanent(err)) {
+		return err
+	}
+	if opened, delay := r.breakers.record(target, err); opened {
+		r.logger.Info("target keeps failing, backing it off", "target", target, "delay", delay.String(), "error", err)
+		r.metrics.breakerTrips.WithLabelValues(r.Name).Inc()
+		r.stats.backedOff(delay)
+	}
+	return err
+}
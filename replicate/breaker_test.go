@@ -0,0 +1,97 @@
+package replicate
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetBreakers(t *testing.T) {
+	var nilBreakers *targetBreakers
+	ok, _ := nilBreakers.allow("target")
+	assert.True(t, ok)
+	assert.Nil(t, newTargetBreakers(0, time.Minute))
+
+	now := time.Unix(0, 0)
+	breakers := newTargetBreakers(2, time.Minute)
+	breakers.now = func() time.Time { return now }
+	failure := errors.New("denied")
+
+	opened, _ := breakers.record("target", failure)
+	assert.False(t, opened)
+	opened, delay := breakers.record("target", failure)
+	require.True(t, opened)
+	assert.Equal(t, time.Minute, delay)
+	ok, remaining := breakers.allow("target")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, remaining)
+	assert.Equal(t, 1, breakers.open())
+	// the other targets are not backed off
+	ok, _ = breakers.allow("other")
+	assert.True(t, ok)
+
+	// a failure once backed off doubles the backoff
+	now = now.Add(time.Minute)
+	ok, _ = breakers.allow("target")
+	assert.True(t, ok)
+	opened, delay = breakers.record("target", failure)
+	require.True(t, opened)
+	assert.Equal(t, 2*time.Minute, delay)
+
+	// up to the maximum
+	for i := 0; i < 10; i++ {
+		_, delay = breakers.record("target", failure)
+	}
+	assert.Equal(t, maxTargetBackoff, delay)
+
+	// a success forgets the failures
+	breakers.record("target", nil)
+	ok, _ = breakers.allow("target")
+	assert.True(t, ok)
+	assert.Equal(t, 0, breakers.open())
+}
+
+func TestBreaker_replicateTo(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{FailureThreshold: 2, FailureBackoff: time.Hour},
+		"source-ns", "target-ns", "other-ns")
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target,other-ns/target",
+	})
+
+	// fails twice, then is backed off
+	actions.Conflicts = map[string]int{"target-ns/target": 2 * (maxConflictRetries + 1)}
+	r.ObjectAdded(source)
+	r.ObjectAdded(source)
+	assert.Equal(t, 1, r.Status().BackedOff)
+	require.NotNil(t, getObject(r, "other-ns", "target"))
+
+	// the other target is still replicated, the backed off one is not written
+	count := len(actions.Actions)
+	source = updateObject(r, "source-ns", "source", nil)
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, count+1)
+	assert.Equal(t, "other-ns", actions.Actions[count].Object.Meta.Namespace)
+	assert.Nil(t, getObject(r, "target-ns", "target"))
+}
+
+func TestBreaker_requeue(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{FailureThreshold: 1, FailureBackoff: time.Hour, RetryBudget: 5},
+		"source-ns", "target-ns")
+	r.initQueue()
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+
+	// backed off, queued again once only, when the backoff ends
+	actions.Conflicts = map[string]int{"target-ns/target": maxConflictRetries + 1}
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	assert.Equal(t, 1, r.Status().BackedOff)
+	assert.Equal(t, 0, r.queue.Len(), "not retried meanwhile")
+	assert.Equal(t, 0, r.queue.NumRequeues(queueItem{key: "source-ns/source"}))
+}
@@ -0,0 +1,117 @@
+// Progressive replication of the changes of a source, to its canary targets first
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// canaryRollout is the rollout of a revision of a source, replicated to its canary targets only
+type canaryRollout struct {
+	// the checksum of the data of the source being rolled out, the version to approve
+	version  string
+	// when the rollout started, the soak period starts then
+	since    time.Time
+	// true once replicated to all the targets
+	released bool
+}
+
+// Returns the canary namespaces of a source with a replicate-canary annotation, nil without it
+func canarySelector(meta *metav1.ObjectMeta) (labels.Selector, error) {
+	value, ok := meta.Annotations[ReplicateCanaryAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotation %s \"%s\": %s", ReplicateCanaryAnnotation, value, err)
+	}
+	return selector, nil
+}
+
+// Returns true while a changed source with a replicate-canary annotation is only replicated to its canary targets,
+// the targets in the canary namespaces, an empty target being a remote cluster or an export
+// The other targets receive it once the soak period is over, or once the checksum of its data is approved,
+// and are never held back again for the same data, such as the targets of a new namespace
+// The rollout is keyed on the checksum of the data, and written onto the source with the canary-rollout annotation,
+// such that neither the writes of the annotations of the source nor the restarts start the soak period again
+// The source is handled again at the end of the soak period, the mutex must be held
+func (r *ObjectReplicator) canaryHeld(sourceObject interface{}, target string) bool {
+	meta := r.GetMeta(sourceObject)
+	key := metaKey(meta)
+	selector, err := canarySelector(meta)
+	if selector == nil && err == nil {
+		delete(r.canaries, key)
+		return false
+	// reported when the source is handled
+	} else if err != nil {
+		return true
+	}
+	if target != "" && r.canaryNamespace(strings.SplitN(target, "/", 2)[0], selector) {
+		return false
+	}
+	if r.targetHasData(target, sourceObject) {
+		return false
+	}
+	rollout := r.canaryRollout(sourceObject)
+	if rollout.released {
+		return false
+	}
+	// approved, or soaked long enough, replicated to all the targets
+	if meta.Annotations[CanaryApprovedAnnotation] == rollout.version {
+		r.logger.Info("canary approved, replicating to all the targets", "source", key)
+		rollout.released = true
+		return false
+	} else if soaked := r.now().Sub(rollout.since); r.CanarySoak > 0 && soaked >= r.CanarySoak {
+		r.logger.Info("canary soaked, replicating to all the targets", "source", key)
+		rollout.released = true
+		return false
+	} else if r.CanarySoak > 0 && r.queue != nil {
+		r.queue.AddAfter(queueItem{key: key}, r.CanarySoak-soaked)
+	}
+	return true
+}
+
+// Returns the rollout of the current data of the source, restored from its canary-rollout annotation,
+// or started now and written onto the source
+func (r *ObjectReplicator) canaryRollout(sourceObject interface{}) *canaryRollout {
+	meta := r.GetMeta(sourceObject)
+	key := metaKey(meta)
+	version := r.DataChecksum(sourceObject)
+	if rollout, ok := r.canaries[key]; ok && rollout.version == version {
+		return rollout
+	}
+	// started before a restart
+	if split := strings.SplitN(meta.Annotations[CanaryRolloutAnnotation], ",", 2); len(split) == 2 && split[0] == version {
+		if since, err := time.Parse(time.RFC3339, split[1]); err == nil {
+			rollout := &canaryRollout{version: version, since: since}
+			r.canaries[key] = rollout
+			return rollout
+		}
+	}
+	rollout := &canaryRollout{version: version, since: r.now()}
+	r.canaries[key] = rollout
+	r.logger.Info("replicating to the canary targets first", "source", key, "version", version,
+		"soak", r.CanarySoak.String())
+	r.event(sourceObject, v1.EventTypeNormal, ReasonCanary,
+		"replicating version %s to the canary targets first", version)
+	r.writeSourceAnnotations(sourceObject, map[string]string{
+		CanaryRolloutAnnotation: fmt.Sprintf("%s,%s", version, rollout.since.UTC().Format(time.RFC3339)),
+	})
+	return rollout
+}
+
+// Returns true if the namespace matches the selector of the canary namespaces
+func (r *ObjectReplicator) canaryNamespace(namespace string, selector labels.Selector) bool {
+	object, exists, err := r.namespaceStore.GetByKey(namespace)
+	if err != nil || !exists {
+		return false
+	}
+	return selector.Matches(labels.Set(object.(metav1.Object).GetLabels()))
+}
@@ -0,0 +1,84 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCanaryTargets(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{CanarySoak: time.Hour}, "source-ns", "other-ns")
+	require.NoError(t, r.namespaceStore.Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "canary-ns", Labels: M{"canary": "true"}},
+	}))
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation:      "canary-ns,other-ns,new-.*",
+		ReplicateCanaryAnnotation:    "canary=true",
+		ReplicationAllowedAnnotation: "true",
+	})
+	version := r.DataChecksum(source)
+	dependent := updateObject(r, "other-ns", "dependent", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+
+	// the canary targets first, the rollout is written onto the source
+	r.ObjectAdded(source)
+	r.ObjectAdded(dependent)
+	require.NotNil(t, getObject(r, "canary-ns", "source"))
+	assert.Equal(t, source.Data, getObject(r, "canary-ns", "source").Data)
+	assert.Nil(t, getObject(r, "other-ns", "source"))
+	assert.NotEqual(t, source.Data, getObject(r, "other-ns", "dependent").Data, "the dependents too")
+	require.Contains(t, r.canaries, "source-ns/source")
+	source = getObject(r, "source-ns", "source")
+	assert.Regexp(t, "^"+version+",", source.Meta.Annotations[CanaryRolloutAnnotation])
+
+	// approved, with the checksum of its data
+	approved := &testObject{Type: source.Type, Data: source.Data, Meta: *source.Meta.DeepCopy()}
+	approved.Meta.Annotations[CanaryApprovedAnnotation] = version
+	approved.Meta.ResourceVersion = "approved"
+	require.NoError(t, r.objectStore.Update(approved))
+	r.ObjectAdded(approved)
+	require.NotNil(t, getObject(r, "other-ns", "source"))
+	assert.Equal(t, source.Data, getObject(r, "other-ns", "source").Data)
+	assert.Equal(t, source.Data, getObject(r, "other-ns", "dependent").Data)
+
+	// a new namespace does not start the soak period again
+	r.NamespaceAdded(addNamespace(r, "new-ns"))
+	require.NotNil(t, getObject(r, "new-ns", "source"))
+	assert.Equal(t, source.Data, getObject(r, "new-ns", "source").Data)
+
+	// soaked long enough
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation:      "canary-ns,other-ns,new-.*",
+		ReplicateCanaryAnnotation:    "canary=true",
+		ReplicationAllowedAnnotation: "true",
+	})
+	version = r.DataChecksum(source)
+	r.ObjectAdded(source)
+	assert.Equal(t, source.Data, getObject(r, "canary-ns", "source").Data)
+	assert.NotEqual(t, source.Data, getObject(r, "other-ns", "source").Data)
+
+	// restored after a restart, the soak period goes on
+	since := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	source = updateObject(r, "source-ns", "source", nil)
+	source.Data = getObject(r, "canary-ns", "source").Data
+	source.Meta.Annotations[CanaryRolloutAnnotation] = version + "," + since
+	require.NoError(t, r.objectStore.Update(source))
+	r.canaries = map[string]*canaryRollout{}
+	r.ObjectAdded(source)
+	assert.Equal(t, source.Data, getObject(r, "other-ns", "source").Data)
+	assert.Equal(t, source.Data, getObject(r, "other-ns", "dependent").Data)
+	assert.Equal(t, version+","+since, getObject(r, "source-ns", "source").Meta.Annotations[CanaryRolloutAnnotation])
+
+	// invalid selector
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation:   "canary-ns,other-ns",
+		ReplicateCanaryAnnotation: "canary in (",
+	})
+	r.ObjectAdded(source)
+	assert.NotEqual(t, source.Data, getObject(r, "canary-ns", "source").Data)
+}
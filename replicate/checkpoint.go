@@ -0,0 +1,302 @@
+// Checkpoints of the states of the handled objects, for fast restarts
+
+package replicate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the version of the checkpoints, a checkpoint of another version is ignored
+// to be increased when the state hashes change
+const checkpointVersion = 1
+
+// the key of the checkpoint in the binary data of its configMap
+const checkpointKey = "checkpoint.json.gz"
+
+// the prefix of the checkpoint locations stored in a configMap
+const checkpointConfigMapPrefix = "configmap:"
+
+// how long the last save may take once stopped
+const checkpointFinalTimeout = 5 * time.Second
+
+// checkpoint is the saved states of the handled objects of all the replicators
+type checkpoint struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// the state hashes of the objects, by resource and key
+	States map[string]map[string]uint64 `json:"states"`
+}
+
+// checkpointed is implemented by the replicators whose states can be checkpointed
+type checkpointed interface {
+	saveStates(snapshot *checkpoint)
+	restoreStates(snapshot *checkpoint) int
+}
+
+// Checkpoints saves periodically the states of the handled objects to a file or a configMap,
+// such that after a restart, the objects unchanged meanwhile are not handled again
+type Checkpoints struct {
+	client kubernetes.Interface
+	// the path of the file, empty for a configMap
+	path      string
+	namespace string
+	name      string
+	interval  time.Duration
+	logger    logr.Logger
+}
+
+// NewCheckpoints returns the checkpoints stored at the location,
+// either a file path, or "configmap:<namespace>/<name>"
+func NewCheckpoints(client kubernetes.Interface, location string, interval time.Duration, logger logr.Logger) (*Checkpoints, error) {
+	c := &Checkpoints{
+		client:   client,
+		interval: interval,
+		logger:   logger,
+	}
+	if !strings.HasPrefix(location, checkpointConfigMapPrefix) {
+		c.path = location
+		return c, nil
+	}
+	split := strings.SplitN(strings.TrimPrefix(location, checkpointConfigMapPrefix), "/", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return nil, fmt.Errorf("expected %s<namespace>/<name>", checkpointConfigMapPrefix)
+	}
+	c.namespace = split[0]
+	c.name = split[1]
+	return c, nil
+}
+
+// ForShard keys the checkpoints by shard, suffixing the file or the configMap with the index of the shard,
+// such that the shards, handling distinct objects, do not overwrite the checkpoints of each other
+func (c *Checkpoints) ForShard(shard Shard) *Checkpoints {
+	if shard.Count <= 1 {
+		return c
+	}
+	if c.path != "" {
+		c.path = fmt.Sprintf("%s-%d", c.path, shard.Index)
+	} else {
+		c.name = fmt.Sprintf("%s-%d", c.name, shard.Index)
+	}
+	return c
+}
+
+// Returns the location of the checkpoints, for the logs
+func (c *Checkpoints) location() string {
+	if c.path != "" {
+		return c.path
+	}
+	return fmt.Sprintf("%s%s/%s", checkpointConfigMapPrefix, c.namespace, c.name)
+}
+
+// Restore restores the states of the replicators from the last checkpoint, if any
+// To be called before the replicators are started
+func (c *Checkpoints) Restore(ctx context.Context, replicators []Replicator) error {
+	data, err := c.load(ctx)
+	if err != nil || data == nil {
+		return err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %s", c.location(), err)
+	}
+	snapshot := &checkpoint{}
+	if err := json.NewDecoder(reader).Decode(snapshot); err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %s", c.location(), err)
+	}
+	if snapshot.Version != checkpointVersion {
+		c.logger.Info("checkpoint of another version ignored", "location", c.location(), "version", snapshot.Version)
+		return nil
+	}
+	for _, replicator := range replicators {
+		if r, ok := replicator.(checkpointed); ok {
+			restored := r.restoreStates(snapshot)
+			c.logger.Info("states restored from checkpoint", "location", c.location(), "objects", restored, "age", time.Since(snapshot.Time).Round(time.Second).String())
+		}
+	}
+	return nil
+}
+
+// Save saves the states of the replicators
+func (c *Checkpoints) Save(ctx context.Context, replicators []Replicator) error {
+	snapshot := &checkpoint{
+		Version: checkpointVersion,
+		Time:    time.Now(),
+		States:  map[string]map[string]uint64{},
+	}
+	for _, replicator := range replicators {
+		if r, ok := replicator.(checkpointed); ok {
+			r.saveStates(snapshot)
+		}
+	}
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if err := json.NewEncoder(writer).Encode(snapshot); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return c.save(ctx, buffer.Bytes())
+}
+
+// Run saves the states of the replicators at each interval, once they are ready
+// such that a checkpoint never misses the objects not handled yet
+// It returns once stopped, after a last save, such that a restart does not handle again the objects handled meanwhile
+func (c *Checkpoints) Run(replicators []Replicator, stop <-chan struct{}) {
+	ctx := wait.ContextForChannel(stop)
+	wait.Until(func() {
+		c.saveReady(ctx, replicators)
+	}, c.interval, stop)
+	final, cancel := context.WithTimeout(context.Background(), checkpointFinalTimeout)
+	defer cancel()
+	c.saveReady(final, replicators)
+}
+
+// Saves the states of the replicators, unless any is not ready yet
+func (c *Checkpoints) saveReady(ctx context.Context, replicators []Replicator) {
+	for _, replicator := range replicators {
+		if !replicator.Ready() {
+			return
+		}
+	}
+	if err := c.Save(ctx, replicators); err != nil {
+		c.logger.Error(err, "could not save checkpoint", "location", c.location())
+	}
+}
+
+// Returns the saved checkpoint, nil if none
+func (c *Checkpoints) load(ctx context.Context) ([]byte, error) {
+	if c.path != "" {
+		data, err := ioutil.ReadFile(c.path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return data, err
+	}
+	configMap, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return configMap.BinaryData[checkpointKey], nil
+}
+
+// Saves the checkpoint, replacing the previous one
+func (c *Checkpoints) save(ctx context.Context, data []byte) error {
+	if c.path != "" {
+		// written aside then renamed, such that a crash never leaves a partial checkpoint
+		temp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(temp.Name())
+		if _, err := temp.Write(data); err != nil {
+			temp.Close()
+			return err
+		}
+		if err := temp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(temp.Name(), c.path)
+	}
+	configMapClient := c.client.CoreV1().ConfigMaps(c.namespace)
+	configMap, err := configMapClient.Get(ctx, c.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMapClient.Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: c.namespace,
+				Name:      c.name,
+			},
+			BinaryData: map[string][]byte{checkpointKey: data},
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	configMap.BinaryData = map[string][]byte{checkpointKey: data}
+	_, err = configMapClient.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+// Adds the states of the handled objects to the checkpoint
+func (r *ReplicatorProps) saveStates(snapshot *checkpoint) {
+	if r.handledStates == nil {
+		return
+	}
+	r.handledStates.mutex.Lock()
+	defer r.handledStates.mutex.Unlock()
+	states := make(map[string]uint64, len(r.handledStates.states))
+	for key, state := range r.handledStates.states {
+		states[key] = state
+	}
+	snapshot.States[r.Name] = states
+}
+
+// Restores the states of the handled objects from the checkpoint, returns their count
+func (r *ReplicatorProps) restoreStates(snapshot *checkpoint) int {
+	if r.handledStates == nil {
+		return 0
+	}
+	r.handledStates.mutex.Lock()
+	defer r.handledStates.mutex.Unlock()
+	for key, state := range snapshot.States[r.Name] {
+		r.handledStates.states[key] = state
+	}
+	return len(snapshot.States[r.Name])
+}
+
+// Queues an added object, unless unchanged since handled before a restart, as restored from a checkpoint
+// Then the targets of a source are only registered
+func (r *ObjectReplicator) enqueueAddedObject(object interface{}) {
+	key := metaKey(r.GetMeta(object))
+	if r.handledStates != nil && r.handledStates.unchanged(key, r.receivedStateHash(object)) {
+		r.metrics.checkpointSkipped.WithLabelValues(r.Name).Inc()
+		r.watchRestored(object)
+		return
+	}
+	r.enqueueObject(object)
+}
+
+// Registers an unchanged source as handling it would, without verifying its targets
+func (r *ObjectReplicator) watchRestored(object interface{}) {
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	if len(r.prefixes.unknown(meta.Annotations)) > 0 && !r.IgnoreUnknown {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	defer r.observeBookkeeping()
+	if len(r.targetsFrom(key)) > 0 {
+		r.sourceSynced(key, syncResult{})
+	}
+	if _, ok := resolveAnnotation(meta, ReplicateFromAnnotation); ok {
+		r.handledDependents.add(key)
+	}
+	if _, ok := meta.Annotations[ReplicatedByAnnotation]; ok {
+		return
+	}
+	targets, targetPatterns, err := r.getReplicationTargets(meta)
+	if err != nil || (targets == nil && targetPatterns == nil) {
+		return
+	}
+	r.watch(key, targets, targetPatterns)
+	r.sourceSynced(key, syncResult{})
+}
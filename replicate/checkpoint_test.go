@@ -0,0 +1,126 @@
+package replicate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewCheckpoints(t *testing.T) {
+	c, err := NewCheckpoints(nil, "/tmp/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/checkpoint", c.path)
+	c, err = NewCheckpoints(nil, "configmap:replicator/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	assert.Equal(t, "replicator", c.namespace)
+	assert.Equal(t, "checkpoint", c.name)
+	_, err = NewCheckpoints(nil, "configmap:checkpoint", time.Minute, logr.Discard())
+	assert.Error(t, err)
+
+	// one checkpoint per shard
+	c, err = NewCheckpoints(nil, "configmap:replicator/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	assert.Equal(t, "checkpoint", c.ForShard(Shard{Index: 0, Count: 1}).name)
+	assert.Equal(t, "checkpoint-1", c.ForShard(Shard{Index: 1, Count: 2}).name)
+	c, err = NewCheckpoints(nil, "/tmp/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/checkpoint-1", c.ForShard(Shard{Index: 1, Count: 2}).path)
+}
+
+// A replicator always ready, whose states are checkpointed
+type readyObjectReplicator struct {
+	*ObjectReplicator
+}
+
+func (r readyObjectReplicator) Ready() bool {
+	return true
+}
+
+func TestCheckpoints_run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	checkpoints, err := NewCheckpoints(nil, path, time.Hour, logr.Discard())
+	require.NoError(t, err)
+	r := createTestReplicator(t, ReplicatorOptions{SkipUnchanged: true})
+	r.handledStates.set("source-ns/source", 1)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		checkpoints.Run([]Replicator{readyObjectReplicator{r}}, stop)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// saved once more when stopped
+	r.handledStates.set("source-ns/other", 2)
+	close(stop)
+	<-done
+	r.handledStates = newHandledStates(true)
+	require.NoError(t, checkpoints.Restore(context.TODO(), []Replicator{r}))
+	assert.True(t, r.handledStates.unchanged("source-ns/source", 1))
+	assert.True(t, r.handledStates.unchanged("source-ns/other", 2))
+}
+
+func TestCheckpoints_restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpoints, err := NewCheckpoints(nil, filepath.Join(dir, "checkpoint"), time.Minute, logr.Discard())
+	require.NoError(t, err)
+
+	r := createTestReplicator(t, ReplicatorOptions{SkipUnchanged: true}, "source-ns", "target-ns")
+	r.initQueue()
+	// nothing to restore yet
+	require.NoError(t, checkpoints.Restore(context.TODO(), []Replicator{r}))
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-.*/target",
+	})
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 1)
+	require.NoError(t, checkpoints.Save(context.TODO(), []Replicator{r}))
+
+	// restarted, the unchanged source is only watched
+	r.handledStates = newHandledStates(true)
+	r.unwatch("source-ns/source")
+	require.NoError(t, checkpoints.Restore(context.TODO(), []Replicator{r}))
+	r.enqueueAddedObject(source)
+	assert.Equal(t, 0, r.queue.Len())
+	assert.Equal(t, []string{"source-ns/source"}, r.namespaceWatchedBy("target-new").sorted())
+
+	// changed meanwhile, handled
+	source = updateObject(r, "source-ns", "source", nil)
+	r.enqueueAddedObject(source)
+	assert.Equal(t, 1, r.queue.Len())
+}
+
+func TestCheckpoints_configMap(t *testing.T) {
+	checkpoints, err := NewCheckpoints(fake.NewSimpleClientset(), "configmap:replicator/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	r := createTestReplicator(t, ReplicatorOptions{SkipUnchanged: true})
+	r.handledStates.set("source-ns/source", 1)
+
+	// created, then updated
+	require.NoError(t, checkpoints.Save(context.TODO(), []Replicator{r}))
+	r.handledStates.set("source-ns/other", 2)
+	require.NoError(t, checkpoints.Save(context.TODO(), []Replicator{r}))
+
+	r.handledStates = newHandledStates(true)
+	require.NoError(t, checkpoints.Restore(context.TODO(), []Replicator{r}))
+	assert.True(t, r.handledStates.unchanged("source-ns/source", 1))
+	assert.True(t, r.handledStates.unchanged("source-ns/other", 2))
+}
@@ -0,0 +1,30 @@
+// Clock of the replicators, replaced to test the time-dependent behaviors
+
+package replicate
+
+import (
+	"time"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// the clock of the system
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RealClock is the clock of the system, the default one of the replicators
+var RealClock Clock = realClock{}
+
+// Returns the current time, by the clock of the options
+func (r *ReplicatorProps) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
@@ -0,0 +1,61 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	r := createTestReplicator(t, ReplicatorOptions{Clock: clock, CanarySoak: time.Hour}, "source-ns", "other-ns")
+	require.NoError(t, r.namespaceStore.Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "canary-ns", Labels: M{"canary": "true"}},
+	}))
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation: "canary-ns,other-ns",
+	})
+	r.ObjectAdded(source)
+	target := getObject(r, "canary-ns", "source")
+	require.NotNil(t, target)
+	assert.Equal(t, "2020-01-02T03:04:05Z", target.Meta.Annotations[ReplicatedAtAnnotation])
+
+	// soaks by the clock
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation:   "canary-ns,other-ns",
+		ReplicateCanaryAnnotation: "canary=true",
+	})
+	r.ObjectAdded(source)
+	assert.Equal(t, source.Data, getObject(r, "canary-ns", "source").Data)
+	assert.NotEqual(t, source.Data, getObject(r, "other-ns", "source").Data)
+	clock.now = clock.now.Add(30 * time.Minute)
+	r.ObjectAdded(source)
+	assert.NotEqual(t, source.Data, getObject(r, "other-ns", "source").Data)
+	clock.now = clock.now.Add(30 * time.Minute)
+	r.ObjectAdded(source)
+	assert.Equal(t, source.Data, getObject(r, "other-ns", "source").Data)
+	assert.Equal(t, "2020-01-02T04:04:05Z", getObject(r, "other-ns", "source").Meta.Annotations[ReplicatedAtAnnotation])
+}
+
+func TestWithClock(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	props, err := NewReplicatorConfig(WithClock(clock), WithOptions(ReplicatorOptions{FailureThreshold: 1}), WithClock(clock)).
+		NewProps(nil, "test")
+	require.NoError(t, err)
+	assert.Equal(t, clock.now, props.now())
+	assert.Equal(t, clock.now, props.breakers.now())
+	assert.Equal(t, clock.now, props.sourceStatuses.now())
+	assert.NotNil(t, (&ReplicatorProps{}).now(), "system clock")
+}
@@ -0,0 +1,159 @@
+// ReplicationCluster resources, registering the remote clusters and reporting their status
+
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ClusterResourceGroup is the API group of the ReplicationCluster resources
+	ClusterResourceGroup   = "replicator.olli.ai"
+	// ClusterResourceVersion is the API version of the ReplicationCluster resources
+	ClusterResourceVersion = "v1alpha1"
+	// the path of the ReplicationCluster resources, they are cluster-scoped
+	clusterResourcesPath   = "/apis/" + ClusterResourceGroup + "/" + ClusterResourceVersion + "/replicationclusters"
+	// the type of the condition telling if the cluster is healthy
+	ClusterReady           = "Ready"
+)
+
+// ReplicationCluster is a remote cluster, whose kubeconfig is in a secret
+type ReplicationCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ReplicationClusterSpec   `json:"spec"`
+	Status            ReplicationClusterStatus `json:"status,omitempty"`
+}
+
+// ReplicationClusterSpec holds the connection details of the cluster
+type ReplicationClusterSpec struct {
+	// the secret holding the kubeconfig of the cluster
+	KubeconfigSecretRef SecretKeyRef `json:"kubeconfigSecretRef"`
+}
+
+// SecretKeyRef is a key of a secret
+type SecretKeyRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// the key of the secret, "kubeconfig" by default
+	Key       string `json:"key,omitempty"`
+}
+
+// ReplicationClusterStatus is the sync status of the cluster, reported by the replicator
+type ReplicationClusterStatus struct {
+	Conditions []ClusterCondition `json:"conditions,omitempty"`
+	// when a target was last synced with the cluster
+	LastSync   *metav1.Time `json:"lastSync,omitempty"`
+	// consecutive failures of the checks and syncs
+	Failures   int          `json:"failures"`
+	// count of the sources and targets not synced with the cluster, and the age of the oldest one
+	Pending    int          `json:"pending"`
+	LagSeconds int64        `json:"lagSeconds"`
+}
+
+// ClusterCondition is a condition of a ReplicationCluster
+type ClusterCondition struct {
+	Type               string                 `json:"type"`
+	Status             metav1.ConditionStatus `json:"status"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+}
+
+// ReplicationClusterList is a list of ReplicationCluster
+type ReplicationClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ReplicationCluster `json:"items"`
+}
+
+// clusterResources reads the ReplicationCluster resources and writes their status
+type clusterResources interface {
+	list(ctx context.Context) ([]ReplicationCluster, error)
+	updateStatus(ctx context.Context, cluster *ReplicationCluster) (*ReplicationCluster, error)
+}
+
+// restClusterResources accesses the ReplicationCluster resources through the REST client,
+// since they have no typed client
+type restClusterResources struct {
+	client kubernetes.Interface
+}
+
+func (r *restClusterResources) list(ctx context.Context) ([]ReplicationCluster, error) {
+	body, err := r.client.Discovery().RESTClient().Get().
+		AbsPath(clusterResourcesPath).
+		Do(ctx).
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := &ReplicationClusterList{}
+	if err := json.Unmarshal(body, list); err != nil {
+		return nil, fmt.Errorf("invalid ReplicationCluster list: %s", err)
+	}
+	return list.Items, nil
+}
+
+func (r *restClusterResources) updateStatus(ctx context.Context, cluster *ReplicationCluster) (*ReplicationCluster, error) {
+	body, err := json.Marshal(cluster)
+	if err != nil {
+		return nil, err
+	}
+	body, err = r.client.Discovery().RESTClient().Put().
+		AbsPath(clusterResourcesPath, cluster.Name, "status").
+		Body(body).
+		Do(ctx).
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	updated := &ReplicationCluster{}
+	if err := json.Unmarshal(body, updated); err != nil {
+		return nil, fmt.Errorf("invalid ReplicationCluster: %s", err)
+	}
+	return updated, nil
+}
+
+// Returns the status to report onto the resource of the cluster, keeping the transition time of the condition
+func (c *remoteCluster) resourceStatus(previous ReplicationClusterStatus) ReplicationClusterStatus {
+	status := c.status()
+	condition := ClusterCondition{
+		Type:   ClusterReady,
+		Status: metav1.ConditionTrue,
+		Reason: "Synced",
+	}
+	if !status.Healthy {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Failing"
+		condition.Message = status.LastError
+	}
+	condition.LastTransitionTime = metav1.Now()
+	for _, old := range previous.Conditions {
+		if old.Type == ClusterReady && old.Status == condition.Status {
+			condition.LastTransitionTime = old.LastTransitionTime
+		}
+	}
+	result := ReplicationClusterStatus{
+		Conditions: []ClusterCondition{condition},
+		Failures:   status.Failures,
+		Pending:    status.Pending,
+		LagSeconds: int64(status.LagSeconds),
+	}
+	if status.LastSync != nil {
+		lastSync := metav1.NewTime(*status.LastSync)
+		result.LastSync = &lastSync
+	}
+	return result
+}
+
+// Returns whether the statuses are the same once serialized, the times being rounded to the second
+func sameClusterStatus(a ReplicationClusterStatus, b ReplicationClusterStatus) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,494 @@
+// Registry of the remote clusters the sources are pushed to
+
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// the key of the kubeconfig in the secrets of the remote clusters
+const clusterKubeconfigKey = "kubeconfig"
+
+// ClusterStatus is the health of a remote cluster
+type ClusterStatus struct {
+	Name          string     `json:"name"`
+	Healthy       bool       `json:"healthy"`
+	// when a target was last pushed to the cluster
+	LastSync      *time.Time `json:"lastSync,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	// consecutive failures of the checks and pushes
+	Failures      int        `json:"failures"`
+	// count of the sources and targets not synced with the cluster, and the age of the oldest one
+	Pending       int        `json:"pending"`
+	LagSeconds    float64    `json:"lagSeconds"`
+}
+
+// clusterMetrics are the metrics of the remote clusters, exported by the replicators pushing to them
+type clusterMetrics struct {
+	// 1 if the remote cluster is healthy, 0 if its last check or push failed, by cluster
+	healthy *prometheus.GaugeVec
+	// age of the oldest source or target not synced with the remote cluster, by cluster
+	lag     *prometheus.GaugeVec
+}
+
+func newClusterMetrics() *clusterMetrics {
+	return &clusterMetrics{
+		healthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "cluster_healthy",
+				Help:      "Whether the remote cluster is healthy, 0 if its last check or push failed, by cluster.",
+			},
+			[]string{"cluster"},
+		),
+		lag:     prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "cluster_replication_lag_seconds",
+				Help:      "Age of the oldest source or target not synced with the remote cluster, by cluster.",
+			},
+			[]string{"cluster"},
+		),
+	}
+}
+
+// remoteCluster is a remote cluster, with its client and health
+type remoteCluster struct {
+	name   string
+	client kubernetes.Interface
+	// the metrics of the registry of the clusters
+	metrics *clusterMetrics
+	// the resource version of its secret, the client is built again when it changes
+	version string
+	// its ReplicationCluster resource, nil if read from a secret of the namespace
+	resource *ReplicationCluster
+	// canceled once the cluster is removed or its client built again
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// the informer of its namespaces, started on first use
+	namespacesOnce sync.Once
+	namespaces     cache.SharedIndexInformer
+
+	mutex         sync.Mutex
+	lastSync      time.Time
+	lastError     string
+	lastErrorTime time.Time
+	failures      int
+	// since when each source or target failed to sync, by replicator and key
+	pending       map[string]time.Time
+}
+
+// Returns the names of the namespaces of the cluster, from its informer started on first use,
+// and false until the informer is synced
+func (c *remoteCluster) namespaceNames() ([]string, bool) {
+	c.namespacesOnce.Do(func() {
+		namespaces := c.client.CoreV1().Namespaces()
+		c.namespaces = cache.NewSharedIndexInformer(&cache.ListWatch{
+			ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+				return namespaces.List(c.ctx, lo)
+			},
+			WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+				return namespaces.Watch(c.ctx, lo)
+			},
+		}, &v1.Namespace{}, 0, cache.Indexers{})
+		go c.namespaces.Run(c.ctx.Done())
+	})
+	if !c.namespaces.HasSynced() {
+		return nil, false
+	}
+	return c.namespaces.GetStore().ListKeys(), true
+}
+
+// Records the result of a check or of a push to the cluster
+func (c *remoteCluster) record(err error, push bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		c.failures++
+		c.lastError = err.Error()
+		c.lastErrorTime = time.Now()
+		c.metrics.healthy.WithLabelValues(c.name).Set(0)
+		return
+	}
+	c.failures = 0
+	if push {
+		c.lastSync = time.Now()
+	}
+	c.metrics.healthy.WithLabelValues(c.name).Set(1)
+}
+
+// Records whether a source or target is synced with the cluster, keyed by replicator and key
+// A source or target is pending from its first failure until its next success
+func (c *remoteCluster) synced(key string, err error) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		delete(c.pending, key)
+	} else if _, ok := c.pending[key]; !ok {
+		if c.pending == nil {
+			c.pending = map[string]time.Time{}
+		}
+		c.pending[key] = time.Now()
+	}
+	c.metrics.lag.WithLabelValues(c.name).Set(c.lag().Seconds())
+}
+
+// Returns the age of the oldest pending source or target, the mutex must be held
+func (c *remoteCluster) lag() time.Duration {
+	var lag time.Duration
+	for _, since := range c.pending {
+		if age := time.Since(since); age > lag {
+			lag = age
+		}
+	}
+	return lag
+}
+
+// Returns the health of the cluster
+func (c *remoteCluster) status() ClusterStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := ClusterStatus{
+		Name:       c.name,
+		Healthy:    c.failures == 0,
+		LastError:  c.lastError,
+		Failures:   c.failures,
+		Pending:    len(c.pending),
+		LagSeconds: c.lag().Seconds(),
+	}
+	if !c.lastSync.IsZero() {
+		lastSync := c.lastSync
+		status.LastSync = &lastSync
+	}
+	if !c.lastErrorTime.IsZero() {
+		lastErrorTime := c.lastErrorTime
+		status.LastErrorTime = &lastErrorTime
+	}
+	return status
+}
+
+// Clusters is the registry of the remote clusters, read from the secrets of a namespace
+// Each secret holding a kubeconfig is a cluster, named after the secret
+// The clusters can also be read from the ReplicationCluster resources, their status is reported onto them
+type Clusters struct {
+	// the local client, to read the secrets
+	client    kubernetes.Interface
+	namespace string
+	// the ReplicationCluster resources, nil if disabled
+	resources clusterResources
+	// the name of the local cluster, recorded on the remote targets
+	name      string
+	interval  time.Duration
+
+	mutex     sync.RWMutex
+	clusters  map[string]*remoteCluster
+	// builds the client of a cluster from its kubeconfig
+	newClient func(kubeconfig []byte) (kubernetes.Interface, error)
+	logger    logr.Logger
+	metrics   *clusterMetrics
+}
+
+// NewClusters returns the registry of the remote clusters whose kubeconfigs are in the namespace
+// With resources, the clusters of the ReplicationCluster resources are registered too
+// The name of the local cluster is recorded on the pushed targets
+func NewClusters(client kubernetes.Interface, namespace string, name string, interval time.Duration, resources bool, logger logr.Logger) *Clusters {
+	clusters := &Clusters{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		interval:  interval,
+		clusters:  map[string]*remoteCluster{},
+		newClient: newClusterClient,
+		logger:    logger,
+		metrics:   newClusterMetrics(),
+	}
+	if resources {
+		clusters.resources = &restClusterResources{client: client}
+	}
+	return clusters
+}
+
+// Returns a client from a kubeconfig
+func newClusterClient(kubeconfig []byte) (kubernetes.Interface, error) {
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// a kubeconfig of a cluster, with the version it is read from
+type clusterKubeconfig struct {
+	kubeconfig []byte
+	version    string
+	// the resource of the cluster, nil if read from a secret of the namespace
+	resource   *ReplicationCluster
+	// where the kubeconfig is read from, for the logs
+	secret     string
+}
+
+// Load reads the clusters from their secrets and resources, adding, updating and removing them
+func (c *Clusters) Load(ctx context.Context) error {
+	kubeconfigs := map[string]clusterKubeconfig{}
+	if c.namespace != "" {
+		secrets, err := c.client.CoreV1().Secrets(c.namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, secret := range secrets.Items {
+			if kubeconfig, ok := secret.Data[clusterKubeconfigKey]; ok {
+				kubeconfigs[secret.Name] = clusterKubeconfig{
+					kubeconfig: kubeconfig,
+					version:    secret.ResourceVersion,
+					secret:     fmt.Sprintf("%s/%s", secret.Namespace, secret.Name),
+				}
+			}
+		}
+	}
+	if c.resources != nil {
+		resources, err := c.resources.list(ctx)
+		if err != nil {
+			return err
+		}
+		for i := range resources {
+			resource := &resources[i]
+			if _, ok := kubeconfigs[resource.Name]; ok {
+				c.logger.Info("cluster is ignored", "cluster", resource.Name, "reason", "already read from a secret")
+				continue
+			}
+			kubeconfig, err := c.resourceKubeconfig(ctx, resource)
+			if err != nil {
+				c.logger.Error(err, "invalid kubeconfig of cluster", "cluster", resource.Name)
+				continue
+			}
+			kubeconfigs[resource.Name] = kubeconfig
+		}
+	}
+	clusters := map[string]*remoteCluster{}
+	c.mutex.RLock()
+	for name, cluster := range c.clusters {
+		clusters[name] = cluster
+	}
+	c.mutex.RUnlock()
+	for name, kubeconfig := range kubeconfigs {
+		if cluster, ok := clusters[name]; ok && cluster.version == kubeconfig.version {
+			cluster.mutex.Lock()
+			cluster.resource = kubeconfig.resource
+			cluster.mutex.Unlock()
+			continue
+		}
+		client, err := c.newClient(kubeconfig.kubeconfig)
+		if err != nil {
+			c.logger.Error(err, "invalid kubeconfig of cluster", "cluster", name, "secret", kubeconfig.secret)
+			delete(kubeconfigs, name)
+			continue
+		}
+		c.logger.Info("cluster loaded", "cluster", name)
+		if cluster, ok := clusters[name]; ok {
+			cluster.cancel()
+		}
+		clusterCtx, cancel := context.WithCancel(ctx)
+		clusters[name] = &remoteCluster{
+			name:     name,
+			client:   client,
+			metrics:  c.metrics,
+			version:  kubeconfig.version,
+			resource: kubeconfig.resource,
+			ctx:      clusterCtx,
+			cancel:   cancel,
+		}
+	}
+	for name, cluster := range clusters {
+		if _, ok := kubeconfigs[name]; !ok {
+			c.logger.Info("cluster removed", "cluster", name)
+			cluster.cancel()
+			delete(clusters, name)
+			c.metrics.healthy.DeleteLabelValues(name)
+			c.metrics.lag.DeleteLabelValues(name)
+		}
+	}
+	c.mutex.Lock()
+	c.clusters = clusters
+	c.mutex.Unlock()
+	return nil
+}
+
+// Returns the kubeconfig of the secret referenced by the resource
+// Its version changes along with the spec of the resource and the secret, not along with its status
+func (c *Clusters) resourceKubeconfig(ctx context.Context, resource *ReplicationCluster) (clusterKubeconfig, error) {
+	ref := resource.Spec.KubeconfigSecretRef
+	key := ref.Key
+	if key == "" {
+		key = clusterKubeconfigKey
+	}
+	secretKey := fmt.Sprintf("%s/%s", ref.Namespace, ref.Name)
+	if !validName.MatchString(ref.Namespace) || !validName.MatchString(ref.Name) {
+		return clusterKubeconfig{}, fmt.Errorf("invalid kubeconfigSecretRef \"%s\"", secretKey)
+	}
+	secret, err := c.client.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return clusterKubeconfig{}, err
+	}
+	kubeconfig, ok := secret.Data[key]
+	if !ok {
+		return clusterKubeconfig{}, fmt.Errorf("secret %s has no key %s", secretKey, key)
+	}
+	return clusterKubeconfig{
+		kubeconfig: kubeconfig,
+		version:    fmt.Sprintf("%d/%s", resource.Generation, secret.ResourceVersion),
+		resource:   resource,
+		secret:     secretKey,
+	}, nil
+}
+
+// Checks that each cluster is reachable
+func (c *Clusters) check() {
+	c.mutex.RLock()
+	clusters := make([]*remoteCluster, 0, len(c.clusters))
+	for _, cluster := range c.clusters {
+		clusters = append(clusters, cluster)
+	}
+	c.mutex.RUnlock()
+	for _, cluster := range clusters {
+		_, err := cluster.client.Discovery().ServerVersion()
+		if err != nil {
+			c.logger.Error(err, "cluster is unreachable", "cluster", cluster.name)
+		}
+		cluster.record(err, false)
+		cluster.mutex.Lock()
+		c.metrics.lag.WithLabelValues(cluster.name).Set(cluster.lag().Seconds())
+		cluster.mutex.Unlock()
+	}
+}
+
+// Reports the status of the clusters onto their ReplicationCluster resources, when it changed
+func (c *Clusters) reportStatus(ctx context.Context) {
+	if c.resources == nil {
+		return
+	}
+	c.mutex.RLock()
+	clusters := make([]*remoteCluster, 0, len(c.clusters))
+	for _, cluster := range c.clusters {
+		clusters = append(clusters, cluster)
+	}
+	c.mutex.RUnlock()
+	for _, cluster := range clusters {
+		cluster.mutex.Lock()
+		resource := cluster.resource
+		cluster.mutex.Unlock()
+		if resource == nil {
+			continue
+		}
+		status := cluster.resourceStatus(resource.Status)
+		if sameClusterStatus(status, resource.Status) {
+			continue
+		}
+		copied := *resource
+		copied.Status = status
+		updated, err := c.resources.updateStatus(ctx, &copied)
+		if err != nil {
+			c.logger.Error(err, "could not report status of cluster", "cluster", cluster.name)
+			continue
+		}
+		cluster.mutex.Lock()
+		if cluster.resource != nil && cluster.resource.Name == updated.Name {
+			cluster.resource = updated
+		}
+		cluster.mutex.Unlock()
+	}
+}
+
+// Run loads the clusters again and checks them at each interval
+func (c *Clusters) Run(stop <-chan struct{}) {
+	ctx := wait.ContextForChannel(stop)
+	wait.Until(func() {
+		if err := c.Load(ctx); err != nil {
+			c.logger.Error(err, "could not load clusters", "namespace", c.namespace)
+		}
+		c.check()
+		c.reportStatus(ctx)
+	}, c.interval, stop)
+}
+
+// Returns the cluster, nil if unknown
+func (c *Clusters) get(name string) *remoteCluster {
+	if c == nil {
+		return nil
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.clusters[name]
+}
+
+// Returns the names of the clusters, sorted
+func (c *Clusters) names() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	names := make([]string, 0, len(c.clusters))
+	for name := range c.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Forgets a deleted source or target, not pending anymore on any cluster
+func (c *Clusters) forget(key string) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, cluster := range c.clusters {
+		cluster.synced(key, nil)
+	}
+}
+
+// Status returns the health of the clusters, sorted by name
+func (c *Clusters) Status() []ClusterStatus {
+	c.mutex.RLock()
+	statuses := make([]ClusterStatus, 0, len(c.clusters))
+	for _, cluster := range c.clusters {
+		statuses = append(statuses, cluster.status())
+	}
+	c.mutex.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// ClustersHandler serves the health of the remote clusters
+type ClustersHandler struct {
+	Clusters *Clusters
+}
+
+func (h *ClustersHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Set("Allow", http.MethodGet)
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+	_ = enc.Encode(h.Clusters.Status())
+}
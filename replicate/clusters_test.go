@@ -0,0 +1,148 @@
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Returns the registry of the given remote clusters, the local cluster is "hub"
+// The informers of their namespaces are synced
+func createTestClusters(t *testing.T, remotes map[string]kubernetes.Interface) *Clusters {
+	secrets := []runtime.Object{}
+	for name := range remotes {
+		secrets = append(secrets, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "clusters", Name: name},
+			Data:       map[string][]byte{clusterKubeconfigKey: []byte(name)},
+		})
+	}
+	clusters := NewClusters(fake.NewSimpleClientset(secrets...), "clusters", "hub", time.Minute, false, logr.Discard())
+	clusters.newClient = func(kubeconfig []byte) (kubernetes.Interface, error) {
+		return remotes[string(kubeconfig)], nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, clusters.Load(ctx))
+	for _, name := range clusters.names() {
+		require.Eventually(t, func() bool {
+			_, synced := clusters.get(name).namespaceNames()
+			return synced
+		}, 5*time.Second, time.Millisecond)
+	}
+	return clusters
+}
+
+func TestClusters_load(t *testing.T) {
+	clusters := createTestClusters(t, map[string]kubernetes.Interface{
+		"prod-eu": fake.NewSimpleClientset(),
+		"prod-us": fake.NewSimpleClientset(),
+	})
+	assert.NotNil(t, clusters.get("prod-eu"))
+	assert.Nil(t, clusters.get("local"))
+
+	require.NoError(t, clusters.client.CoreV1().Secrets("clusters").Delete(context.TODO(), "prod-us", metav1.DeleteOptions{}))
+	require.NoError(t, clusters.Load(context.TODO()))
+	assert.Nil(t, clusters.get("prod-us"))
+	statuses := clusters.Status()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "prod-eu", statuses[0].Name)
+	assert.True(t, statuses[0].Healthy)
+}
+
+// testClusterResources holds the ReplicationCluster resources in memory
+type testClusterResources struct {
+	resources []ReplicationCluster
+	updated   int
+}
+
+func (r *testClusterResources) list(ctx context.Context) ([]ReplicationCluster, error) {
+	return r.resources, nil
+}
+
+func (r *testClusterResources) updateStatus(ctx context.Context, cluster *ReplicationCluster) (*ReplicationCluster, error) {
+	for i := range r.resources {
+		if r.resources[i].Name == cluster.Name {
+			r.updated++
+			r.resources[i].Status = cluster.Status
+			updated := r.resources[i]
+			return &updated, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cluster %s", cluster.Name)
+}
+
+func TestClusters_resources(t *testing.T) {
+	remote := fake.NewSimpleClientset()
+	resources := &testClusterResources{resources: []ReplicationCluster{{
+		ObjectMeta: metav1.ObjectMeta{Name: "prod-eu", Generation: 1},
+		Spec: ReplicationClusterSpec{
+			KubeconfigSecretRef: SecretKeyRef{Namespace: "secrets-ns", Name: "prod-eu-kubeconfig", Key: "config"},
+		},
+	}}}
+	clusters := NewClusters(fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "secrets-ns", Name: "prod-eu-kubeconfig"},
+		Data:       map[string][]byte{"config": []byte("prod-eu")},
+	}), "", "hub", time.Minute, false, logr.Discard())
+	clusters.resources = resources
+	clusters.newClient = func(kubeconfig []byte) (kubernetes.Interface, error) {
+		assert.Equal(t, "prod-eu", string(kubeconfig))
+		return remote, nil
+	}
+	require.NoError(t, clusters.Load(context.TODO()))
+	cluster := clusters.get("prod-eu")
+	require.NotNil(t, cluster)
+	assert.Equal(t, remote, cluster.client)
+
+	clusters.check()
+	clusters.reportStatus(context.TODO())
+	status := resources.resources[0].Status
+	require.Len(t, status.Conditions, 1)
+	assert.Equal(t, ClusterReady, status.Conditions[0].Type)
+	assert.Equal(t, metav1.ConditionTrue, status.Conditions[0].Status)
+	assert.Equal(t, 0, status.Pending)
+	// not updated again while unchanged
+	require.NoError(t, clusters.Load(context.TODO()))
+	assert.True(t, clusters.get("prod-eu") == cluster, "the status does not reload the cluster")
+	clusters.reportStatus(context.TODO())
+	assert.Equal(t, 1, resources.updated)
+
+	cluster.record(fmt.Errorf("unreachable"), true)
+	cluster.synced("secrets:default/source", fmt.Errorf("unreachable"))
+	clusters.reportStatus(context.TODO())
+	status = resources.resources[0].Status
+	assert.Equal(t, metav1.ConditionFalse, status.Conditions[0].Status)
+	assert.Equal(t, "unreachable", status.Conditions[0].Message)
+	assert.Equal(t, 1, status.Failures)
+	assert.Equal(t, 1, status.Pending)
+
+	resources.resources = nil
+	require.NoError(t, clusters.Load(context.TODO()))
+	assert.Nil(t, clusters.get("prod-eu"))
+}
+
+func TestRemoteCluster_synced(t *testing.T) {
+	cluster := &remoteCluster{name: "prod-eu", metrics: newClusterMetrics()}
+	cluster.synced("secrets:default/a", fmt.Errorf("failed"))
+	since := cluster.pending["secrets:default/a"]
+	cluster.synced("secrets:default/b", nil)
+	cluster.synced("secrets:default/a", fmt.Errorf("failed again"))
+	status := cluster.status()
+	assert.Equal(t, 1, status.Pending)
+	assert.Equal(t, since, cluster.pending["secrets:default/a"], "pending since the first failure")
+	assert.True(t, status.LagSeconds >= 0)
+
+	cluster.synced("secrets:default/a", nil)
+	status = cluster.status()
+	assert.Equal(t, 0, status.Pending)
+	assert.Equal(t, float64(0), status.LagSeconds)
+}
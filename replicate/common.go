@@ -3,14 +3,27 @@
 package replicate
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/go-logr/logr"
 )
 
 type sMap = map[string]string
@@ -19,6 +32,26 @@ type sMap = map[string]string
 var validName = regexp.MustCompile(`^[0-9a-z.-]+$`)
 var validPath = regexp.MustCompile(`^(?:[0-9a-z.-]+/)?[0-9a-z.-]+$`)
 
+// Returns the "namespace/name" key of an object
+func metaKey(meta *metav1.ObjectMeta) string {
+	return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+}
+
+// Returns the sha256 checksum of the data, independent of the order of the keys
+func checksumData(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%d:%s%d:", len(key), key, len(data[key]))
+		hash.Write(data[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 // a struct representing a pattern to match namespaces and generating targets
 type targetPattern struct {
 	namespace *regexp.Regexp
@@ -54,12 +87,123 @@ func (pattern targetPattern) Targets(namespaces []string) []string {
 
 // ReplicatorOptions is the public options to configure a replicator
 type ReplicatorOptions struct {
+	// the prefix of the annotations, then the legacy prefixes read too, in order of precedence
+	// the default prefix when empty, an empty prefix for annotations without prefix
+	Prefixes         []string
+	// when true, the annotations written by the replicator are written with the legacy prefixes too
+	CompatWrite      bool
 	// when true, "allowed" annotations are ignored
-	AllowAll      bool
+	AllowAll         bool
 	// when false, any unknown annotation will make the replicator fail
-	IgnoreUnknown bool
+	IgnoreUnknown    bool
 	// the labels to add to created resources
-	Labels        map[string]string
+	Labels           map[string]string
+	// the annotations to add to created resources, the ones of the replicator have precedence
+	Annotations      map[string]string
+	// the label referencing the source of each target, empty to not label them
+	SourceLabel      string
+	// when true, the missing namespaces of the explicit targets are created, with the namespace labels,
+	// only the ones matching the creatable patterns
+	CreateNamespaces bool
+	CreatableNamespaces []*regexp.Regexp
+	NamespaceLabels  map[string]string
+	// where to record the performed actions, nil to disable
+	AuditLog         *AuditLog
+	// where to send the failures, nil to disable
+	Notifier         *Notifier
+	// how long each request to kubernetes may take, 0 for no limit
+	RequestTimeout   time.Duration
+	// the clock telling the time of the replications, of the soak periods and of the backoffs, nil for the system clock
+	Clock            Clock
+	// the hooks called after each action on a target
+	Hooks            Hooks
+	// when true, a status summary is written onto the sources
+	SourceStatus     bool
+	// the minimum interval between two status writes on the same source
+	StatusInterval   time.Duration
+	// when true, the state of the replication is written onto the targets
+	TargetConditions bool
+	// when true, the status of each source is written onto its ReplicationStatus resource
+	StatusResources  bool
+	// the shard of the sources to act on, all of them by default
+	Shard            Shard
+	// only the sources of the namespaces matching the selector are replicated, nil for all of them
+	NamespaceSelector labels.Selector
+	// the identity recorded on the targets, targets of other identities are not modified
+	ControllerID     string
+	// how many times a failed object is retried before being parked until its next change, 0 to retry it until it succeeds
+	RetryBudget      int
+	// the delay before the first retry, doubled on each retry up to the max delay
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	// when true, installs and data updates are server-side applied, instead of updated
+	ServerSideApply  bool
+	// what to do with the targets whose source does not target them anymore
+	OrphanPolicy     string
+	// the propagation policy of the deletions of targets, empty for the default of the API server
+	Propagation      metav1.DeletionPropagation
+	// the interval between two collections of the orphaned targets, 0 to disable
+	OrphanGCInterval time.Duration
+	// holds back the deletions until all the replicators are ready, nil to not wait
+	StartupGate      *StartupGate
+	// the informers shared with the other replicators, nil for informers of its own
+	Informers        *SharedInformers
+	// when true, the last applied configuration of kubectl is not stored, nor kept on update
+	StripLastApplied bool
+	// the count of objects per page of the lists, 0 to list all the objects at once
+	ListPageSize     int64
+	// how many targets of a source are synced at once, one at once per namespace
+	ConcurrentSyncs  int
+	// how long the canary targets of a changed source soak before its other targets receive it, 0 to wait for approval
+	CanarySoak       time.Duration
+	// the selectors of the namespaces whose targets are synced first, in order, the other namespaces last
+	Priorities       []labels.Selector
+	// how long the added namespaces are aggregated before being handled, 0 to handle them one by one
+	NamespaceDelay   time.Duration
+	// the maximum count of namespaces handled per batch, 0 for no limit
+	NamespaceBatch   int
+	// the maximum fraction of the resync period randomly added to it, to spread the resyncs
+	ResyncJitter     float64
+	// the maximum count of items in the queue, the events are dropped and recomputed beyond, 0 for no limit
+	MaxQueueLength   int
+	// how many times per second each object may be handled, with bursts, 0 for no limit
+	SourceQPS        float32
+	SourceBurst      int
+	// consecutive failures after which a target is backed off, 0 to never back off
+	FailureThreshold int
+	// how long a target is first backed off, doubled each time it fails again
+	FailureBackoff   time.Duration
+	// when true, the periodic resyncs skip the objects unchanged since last handled successfully
+	SkipUnchanged    bool
+	// how long an informer may be silent before the deletions are suspended, 0 to never suspend them
+	// they are also suspended while an informer keeps failing
+	DegradedAfter    time.Duration
+	// consecutive failures of the lists and watches after which the informer is restarted, 0 to never restart it
+	RestartFailures  int
+	// the remote clusters the sources may be pushed to, nil to never push them
+	Clusters         *Clusters
+	// the providers of the external stores the sources may be pulled from, by name
+	ExternalSources  map[string]ExternalProvider
+	// the patterns of the namespaces whose sources may be pulled from the external stores
+	ExternalAllowed  []*regexp.Regexp
+	// how often the sources are pulled again from the external stores
+	ExternalInterval time.Duration
+	// the exporters of the sources to external stores, by name, nil to never export them
+	Exporters        map[string]ExternalExporter
+	// decrypts the SOPS-encrypted secrets before they are replicated, nil to replicate them as they are
+	Decrypter        *SOPSDecrypter
+	// the SealedSecrets whose unsealed secrets, or themselves, are replicated, nil to ignore them
+	SealedSecrets    *SealedSecrets
+	// the TLS secrets referenced by the Ingresses and Gateways, replicated to them, nil to ignore them
+	TLSReferences    *TLSReferences
+	// the metadata stamped on the created targets for ArgoCD, nil to not stamp them
+	ArgoCD           *ArgoCDMetadata
+	// the compatibility mode with the objects managed by Flux, nil to handle them as any other one
+	Flux             *FluxCompat
+	// the labels excluding the created targets from the backups, nil to back them up
+	BackupLabels     map[string]string
+	// when true, the sources synced by kubed are replicated to the namespaces of their sync annotation
+	Kubed            bool
 }
 
 // ReplicatorProps is all the common properties for a repicator
@@ -70,44 +214,222 @@ type ReplicatorProps struct {
 	ReplicatorOptions
 	// the kubernetes client to use
 	client              kubernetes.Interface
+	// the recorder for the events on sources and targets, nil to disable events
+	recorder            record.EventRecorder
+	// the logger, with the resource name as value
+	logger              logr.Logger
+	// the metrics, shared with the replicators registered with the same registry
+	metrics             *replicatorMetrics
+	// the prefixes of the annotations, translated when read and written
+	prefixes            *annotationPrefixes
 
 	// the store and controller for all the objects to watch replicate
-	objectStore         cache.Store
+	objectStore         cache.Indexer
 	objectController    cache.Controller
+	objectListWatch     cache.ListerWatcher
+	objectType          runtime.Object
+	objectResyncPeriod  time.Duration
+	// closed to stop the controller of the objects
+	objectStop          chan struct{}
+	// closed to stop the replicator, once
+	stop                chan struct{}
+	stopOnce            sync.Once
+	// the context of the requests to kubernetes, cancelled once stopped
+	ctx                 context.Context
+	cancel              context.CancelFunc
 
-	// the store and controller for the namespaces
+	// the store and controller for the namespaces, shared with the other replicators
+	namespaceInformer   *sharedInformer
 	namespaceStore      cache.Store
 	namespaceController cache.Controller
+	namespaceListWatch  cache.ListerWatcher
 
-	// a {source => targets} map for the "replicate-from" annotation
-	targetsFrom         map[string][]string
-	// a {source => targets} map for the "replicate-to" annotation
-	targetsTo           map[string][]string
+	// the tracking of the first list of objects
+	objectInitialSync   *initialSync
+	// true when the informer of the objects is the one of the cache of a manager, run by the manager
+	objectManaged       bool
+	// the activity of the informers, to detect stalled ones
+	objectActivity      *informerActivity
+	namespaceActivity   *informerActivity
 
+	// protects the maps below, held by the handlers while they run
+	mutex               sync.RWMutex
 	// a {source => targets} map for all the targeted objects
-	watchedTargets      map[string][]string
+	watchedTargets      map[string]keySet
 	// a {source => targetPatterns} for all the targeted objects
 	watchedPatterns     map[string][]targetPattern
+	// the indexes of the watched targets, updated along with them
+	// a {target => sources} map, a {namespace => sources} map, and a {pattern => sources} map
+	targetWatchers      map[string]keySet
+	namespaceWatchers   map[string]keySet
+	patternWatchers     map[string]*indexedPattern
+	// the dependents handled at least once, only those are updated by their source
+	// the others replicate their source when handled, whichever of them arrives first
+	handledDependents   keySet
+
+	// when each source was last successfully synced to all its targets
+	lastSyncs           *lastSyncs
+	// the handled events and errors, for the status
+	stats               *replicatorStats
+	// the rate limiting of the status annotations on the sources
+	sourceStatuses      *sourceStatuses
+	// the ReplicationStatus resources of the sources, nil if disabled, and the last written ones by source
+	statusResources     statusResources
+	statusWrites        *statusWrites
+	// the revisions of the sources written to the targets
+	written             *writtenRevisions
+	// the failures of the targets, nil if they are never backed off
+	breakers            *targetBreakers
+	// the states of the handled objects, nil if the resyncs are not differential
+	handledStates       *handledStates
+	// the targets pushed to remote clusters, by source then cluster
+	pushed              map[string]map[string]keySet
+	// the clusters whose targets pushed before a restart were recovered
+	pushRecovered       keySet
+	// the checksums of the sources exported to external stores, by source then destination
+	exported            map[string]map[string]string
+	// the calls to the external stores running without the mutex, and their results
+	externalCalls       *externalCalls
+	// the unsealed secrets whose annotations inherited from their SealedSecret are being written, without the mutex
+	inheriting          keySet
+	// the rollouts of the sources waiting for their canary targets, by source
+	canaries            map[string]*canaryRollout
+	// the approvals of the data of the sources requiring approval, by source
+	approvals           map[string]*approval
+	// 1 while a forced resync is running
+	resyncing           int32
+	// the actions waiting for the hooks until the mutex is released
+	hookEvents          *hookEvents
+	// the TLS references of the secrets, nil for the other resources
+	tlsReferences       *TLSReferences
+	// held by the handlers while the targets of a source are synced concurrently, nil otherwise
+	// set and cleared with the mutex held, before the handlers start and after they end
+	syncLock            *sync.Mutex
+
+	// the keys of the objects and namespaces to handle, filled by the informers
+	queue               workqueue.RateLimitingInterface
+	// the last state of the deleted objects in the queue
+	deleted             *deletedObjects
+	// the items which exhausted their retries
+	parked              *parkedItems
+	// the added namespaces waiting for their batch
+	pendingNamespaces   *pendingNamespaces
+	// the rate limits of the objects, nil if not limited
+	sourceLimiters      *sourceLimiters
+	// count of the items being handled
+	processing          int32
+	// the bytes of data written to the targets by the running handler, nil between the handlers
+	// set with the mutex held, when the handler starts and ends
+	handlerBytes        *atomic.Int64
+	// 1 while the events are dropped because the queue is full
+	shedding            int32
 }
 
 // Replicator describes the common interface for all replicators
 type Replicator interface {
 	Start()
+	// runs until the context is done, an error if done before the informers are synced
+	Run(ctx context.Context) error
+	// stops the replicator, which cannot be started again
+	Stop()
+	// an error if stopped, not synced, or an informer keeps failing
+	Healthy() error
+	// the counts of sources, targets and actions, and the last failure
+	Stats() ReplicatorStats
+	// if the informers are synced
 	Synced() bool
+	// if synced, and the initially listed objects have been handled
+	Ready() bool
+	// an error if an informer stopped, or received nothing for longer than the threshold
+	Stalled(threshold time.Duration) error
+	// the detailed status
+	Status() ReplicatorStatus
+	// handles again all the objects, false if already running
+	Resync() bool
 }
 
 // NewReplicatorProps inits and returns the common replicator properties for a repicator
+// Its metrics are not registered
 func NewReplicatorProps(client kubernetes.Interface, name string, options ReplicatorOptions) ReplicatorProps {
+	return NewReplicatorConfig(WithOptions(options)).newProps(client, name, newReplicatorMetrics())
+}
+
+// Returns the common replicator properties, with the recorder for the events, nil to disable them
+// The context of the replicator carries the logger, for the actions
+func newReplicatorProps(client kubernetes.Interface, name string, options ReplicatorOptions, recorder record.EventRecorder, logger logr.Logger, metrics *replicatorMetrics) ReplicatorProps {
+	syncs := newLastSyncs()
+	metrics.staleness.register(name, syncs)
+	ctx, cancel := context.WithCancel(logr.NewContext(context.Background(), logger))
+	statuses := newSourceStatuses()
+	breakers := newTargetBreakers(options.FailureThreshold, options.FailureBackoff)
+	if options.Clock != nil {
+		statuses.now = options.Clock.Now
+		if breakers != nil {
+			breakers.now = options.Clock.Now
+		}
+	}
+	var resources statusResources
+	if options.StatusResources && client != nil {
+		resources = &restStatusResources{client: client}
+	}
 	return ReplicatorProps {
 		Name:                name,
 		ReplicatorOptions:   options,
 		client:              client,
+		recorder:            recorder,
+		logger:              logger,
+		metrics:             metrics,
+		prefixes:            newAnnotationPrefixes(options.Prefixes, options.CompatWrite),
+		stop:                make(chan struct{}),
+		ctx:                 ctx,
+		cancel:              cancel,
 
-		targetsFrom:         map[string][]string{},
-		targetsTo:           map[string][]string{},
-
-		watchedTargets:      map[string][]string{},
+		watchedTargets:      map[string]keySet{},
 		watchedPatterns:     map[string][]targetPattern{},
+		targetWatchers:      map[string]keySet{},
+		namespaceWatchers:   map[string]keySet{},
+		patternWatchers:     map[string]*indexedPattern{},
+		handledDependents:   keySet{},
+
+		lastSyncs:           syncs,
+		stats:               &replicatorStats{},
+		sourceStatuses:      statuses,
+		statusResources:     resources,
+		statusWrites:        newStatusWrites(),
+		written:             newWrittenRevisions(),
+		breakers:            breakers,
+		handledStates:       newHandledStates(options.SkipUnchanged),
+		hookEvents:          &hookEvents{},
+		pushed:              map[string]map[string]keySet{},
+		pushRecovered:       keySet{},
+		exported:            map[string]map[string]string{},
+		externalCalls:       &externalCalls{calls: map[string]*externalCall{}},
+		inheriting:          keySet{},
+		canaries:            map[string]*canaryRollout{},
+		approvals:           map[string]*approval{},
+	}
+}
+
+// Returns the context of a request to kubernetes, cancelled after the request timeout, if any
+func (r *ReplicatorProps) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, r.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Records the result of a sync of the source to all its targets
+// Only successful syncs are recorded as synced, such that failing sources become stale
+func (r *ReplicatorProps) sourceSynced(key string, result syncResult) {
+	if !r.ownsSource(key) {
+		r.lastSyncs.Delete(key)
+	} else if result.err == nil {
+		r.lastSyncs.Set(key, r.now())
+	} else {
+		r.lastSyncs.Fail(key, result.targets-result.synced)
 	}
 }
 
@@ -514,11 +836,29 @@ func (r *ReplicatorProps) isReplicatedTo(object *metav1.ObjectMeta, targetObject
 func (r *ReplicatorProps) getReplicationTargets(object *metav1.ObjectMeta) ([]string, []targetPattern, error) {
 	annotationTo, okTo := object.Annotations[ReplicateToAnnotation]
 	annotationToNs, okToNs := object.Annotations[ReplicateToNsAnnotation]
+	key := fmt.Sprintf("%s/%s", object.Namespace, object.Name)
+	// the sync annotation of kubed stands for the namespaces, unless replicated with the annotations
 	if !okTo && !okToNs {
+		var err error
+		if annotationToNs, okToNs, err = r.kubedNamespaces(object); err != nil {
+			return nil, nil, err
+		}
+	}
+	// the targets referencing this secret of the central namespace from their Ingresses or Gateways,
+	// only the ones the secret allows
+	var referencing []string
+	if r.tlsReferences != nil && object.Namespace == r.tlsReferences.namespace {
+		for _, target := range r.tlsReferences.referencing(key) {
+			namespace, name, _ := cache.SplitMetaNamespaceKey(target)
+			if allowed, _, _ := r.isReplicationAllowed(&metav1.ObjectMeta{Namespace: namespace, Name: name}, object); allowed {
+				referencing = append(referencing, target)
+			}
+		}
+	}
+	if !okTo && !okToNs && len(referencing) == 0 {
 		return nil, nil, nil
 	}
 
-	key := fmt.Sprintf("%s/%s", object.Namespace, object.Name)
 	targets := []string{}
 	targetPatterns := []targetPattern{}
 	// cache of patterns, to reuse them as much as possible
@@ -610,6 +950,12 @@ func (r *ReplicatorProps) getReplicationTargets(object *metav1.ObjectMeta) ([]st
 				key, ReplicateToNsAnnotation, ns, err)
 		}
 	}
+	for _, target := range referencing {
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
 	// for all the qualified names, check if the namespace part is a pattern
 	for q := range qualified {
 		if seen[q] {
@@ -688,3 +1034,91 @@ func transferSMap(value, update, keys map[string]string) {
 		}
 	}
 }
+
+// Returns an error if the target is managed by another controller
+func (r *ReplicatorProps) checkManagedBy(object *metav1.ObjectMeta) error {
+	if owner, ok := object.Annotations[ManagedByAnnotation]; ok && owner != r.ControllerID {
+		return fmt.Errorf("target %s/%s is managed by controller \"%s\"",
+			object.Namespace, object.Name, owner)
+	}
+	return nil
+}
+
+// Sets the metadata of the policies on a target being installed, along with its labels and annotations, existing is nil if created
+func (r *ReplicatorProps) stampTarget(meta *metav1.ObjectMeta, existing *metav1.ObjectMeta, source string) {
+	r.ArgoCD.stamp(meta)
+	r.Flux.stamp(meta, existing)
+	if r.SourceLabel != "" {
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		meta.Labels[r.SourceLabel] = sourceLabelValue(source)
+	}
+	for label, value := range r.BackupLabels {
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		meta.Labels[label] = value
+	}
+	for annotation, value := range r.Annotations {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		if _, ok := meta.Annotations[annotation]; !ok {
+			meta.Annotations[annotation] = value
+		}
+	}
+}
+
+// Returns the value of the source label of a target, "namespace.name" of its source,
+// shortened with a hash of the source when too long for a label value
+func sourceLabelValue(source string) string {
+	value := strings.Replace(source, "/", ".", 1)
+	if len(value) <= 63 {
+		return value
+	}
+	sum := sha256.Sum256([]byte(source))
+	return strings.TrimRight(value[:52], "-_.") + "-" + hex.EncodeToString(sum[:])[:10]
+}
+
+// ParsePropagationPolicy returns the propagation policy of the deletions, case-insensitive
+// An empty policy is the default of the API server
+func ParsePropagationPolicy(policy string) (metav1.DeletionPropagation, error) {
+	for _, known := range []metav1.DeletionPropagation{
+		metav1.DeletePropagationOrphan,
+		metav1.DeletePropagationBackground,
+		metav1.DeletePropagationForeground,
+	} {
+		if strings.EqualFold(policy, string(known)) {
+			return known, nil
+		}
+	}
+	if policy == "" {
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown propagation policy, expected %s, %s or %s",
+		metav1.DeletePropagationOrphan, metav1.DeletePropagationBackground, metav1.DeletePropagationForeground)
+}
+
+// Returns the options deleting an object only if it did not change, and was not recreated with the same name
+func deleteOptions(meta *metav1.ObjectMeta, propagation metav1.DeletionPropagation) metav1.DeleteOptions {
+	options := metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			ResourceVersion: &meta.ResourceVersion,
+		},
+	}
+	if meta.UID != "" {
+		options.Preconditions.UID = &meta.UID
+	}
+	if propagation != "" {
+		options.PropagationPolicy = &propagation
+	}
+	return options
+}
+
+// Records the identity of this controller in the annotations of a target
+func (r *ReplicatorProps) setManagedBy(annotations map[string]string) {
+	if r.ControllerID != "" {
+		annotations[ManagedByAnnotation] = r.ControllerID
+	}
+}
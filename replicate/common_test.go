@@ -1,10 +1,18 @@
 package replicate
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -1409,3 +1417,164 @@ func Test_annotationRefersTo(t *testing.T) {
 		assert.Equal(t, example.refers, refers, example.name)
 	}
 }
+
+func TestControllerID(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{AllowAll: true, ControllerID: "blue"}, "source-ns", "target-ns")
+	// a target managed by another controller
+	updateObject(r, "target-ns", "green", M{
+		ReplicatedByAnnotation: "source-ns/source",
+		ManagedByAnnotation:    "green",
+	})
+	updateObject(r, "target-ns", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+		ManagedByAnnotation:     "green",
+	})
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/blue,target-ns/green",
+	}))
+	requireActionsLength(t, r, 1)
+	action := r.ReplicatorActions.(*testActions).Actions[0]
+	assert.Equal(t, "blue", action.Object.Meta.Name)
+	assert.Equal(t, "blue", action.Object.Meta.Annotations[ManagedByAnnotation])
+	r.ObjectAdded(getObject(r, "target-ns", "from"))
+	requireActionsLength(t, r, 1)
+	// not deleted either
+	r.ObjectDeleted(deleteObject(r, "source-ns", "source"))
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, "blue", r.ReplicatorActions.(*testActions).Actions[1].Object.Meta.Name)
+	assert.NotNil(t, getObject(r, "target-ns", "green"))
+
+	assert.Empty(t, UnknownAnnotations(M{ManagedByAnnotation: "blue"}))
+}
+
+func Test_stampTarget(t *testing.T) {
+	props := NewReplicatorProps(nil, "test", ReplicatorOptions{
+		ArgoCD:       NewArgoCDMetadata("", ""),
+		Flux:         NewFluxCompat(false),
+		BackupLabels: M{"velero.io/exclude-from-backup": "true"},
+	})
+	meta := &metav1.ObjectMeta{Labels: M{"label": "value"}, Annotations: M{}}
+	props.stampTarget(meta, &metav1.ObjectMeta{Labels: M{fluxKustomizeLabelPrefix + "name": "apps"}}, "source-ns/source")
+	assert.Equal(t, M{
+		"label":                           "value",
+		"velero.io/exclude-from-backup":   "true",
+		fluxKustomizeLabelPrefix + "name": "apps",
+	}, meta.Labels)
+	assert.Equal(t, "Prune=false", meta.Annotations[ArgoCDSyncOptionsAnnotation])
+
+	props = NewReplicatorProps(nil, "test", ReplicatorOptions{
+		Annotations: M{"owner": "platform", ReplicatedByAnnotation: "other"},
+	})
+	meta = &metav1.ObjectMeta{Annotations: M{ReplicatedByAnnotation: "source-ns/source"}}
+	props.stampTarget(meta, nil, "source-ns/source")
+	assert.Equal(t, M{"owner": "platform", ReplicatedByAnnotation: "source-ns/source"}, meta.Annotations)
+
+	props = NewReplicatorProps(nil, "test", ReplicatorOptions{SourceLabel: "test-prefix/source"})
+	meta = &metav1.ObjectMeta{}
+	props.stampTarget(meta, nil, "source-ns/source")
+	assert.Equal(t, M{"test-prefix/source": "source-ns.source"}, meta.Labels)
+
+	props = NewReplicatorProps(nil, "test", ReplicatorOptions{})
+	meta = &metav1.ObjectMeta{}
+	props.stampTarget(meta, nil, "source-ns/source")
+	assert.Nil(t, meta.Labels, "no policy")
+	assert.Nil(t, meta.Annotations, "no policy")
+}
+
+func Test_sourceLabelValue(t *testing.T) {
+	assert.Equal(t, "source-ns.source.name", sourceLabelValue("source-ns/source.name"))
+	long := sourceLabelValue("source-ns/" + strings.Repeat("a", 60))
+	assert.Len(t, long, 63)
+	assert.True(t, strings.HasPrefix(long, "source-ns.aaa"))
+	assert.NotEqual(t, long, sourceLabelValue("source-ns/"+strings.Repeat("a", 61)), "hashed")
+}
+
+func TestParsePropagationPolicy(t *testing.T) {
+	policy, err := ParsePropagationPolicy("foreground")
+	require.NoError(t, err)
+	assert.Equal(t, metav1.DeletePropagationForeground, policy)
+	policy, err = ParsePropagationPolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, metav1.DeletionPropagation(""), policy)
+	_, err = ParsePropagationPolicy("cascade")
+	assert.Error(t, err)
+}
+
+func Test_deleteOptions(t *testing.T) {
+	meta := &metav1.ObjectMeta{ResourceVersion: "12", UID: "uid"}
+	options := deleteOptions(meta, "")
+	require.NotNil(t, options.Preconditions)
+	assert.Equal(t, "12", *options.Preconditions.ResourceVersion)
+	assert.Equal(t, types.UID("uid"), *options.Preconditions.UID)
+	assert.Nil(t, options.PropagationPolicy)
+
+	options = deleteOptions(&metav1.ObjectMeta{ResourceVersion: "12"}, metav1.DeletePropagationOrphan)
+	assert.Nil(t, options.Preconditions.UID, "no uid")
+	require.NotNil(t, options.PropagationPolicy)
+	assert.Equal(t, metav1.DeletePropagationOrphan, *options.PropagationPolicy)
+}
+
+func Test_requestContext(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{RequestTimeout: time.Minute})
+	ctx, cancel := r.requestContext(r.ctx)
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok, "timeout")
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+	cancel()
+	assert.Error(t, ctx.Err())
+	assert.NoError(t, r.ctx.Err(), "only the request is cancelled")
+
+	r = createTestReplicator(t, ReplicatorOptions{})
+	ctx, cancel = r.requestContext(r.ctx)
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok, "no timeout")
+	r.Stop()
+	assert.Error(t, ctx.Err(), "cancelled on stop")
+}
+
+func Test_requestTimeout(t *testing.T) {
+	// an API server which never answers
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	r := newTestConfigMapReplicator(t, client, WithEventRecorder(nil),
+		WithOptions(ReplicatorOptions{AllowAll: true, RequestTimeout: 50 * time.Millisecond}))
+	defer r.Stop()
+
+	require.NoError(t, r.namespaceStore.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "target-ns"}}))
+	source := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations: M{
+				ReplicateToAnnotation: "target-ns/target",
+			},
+		},
+		Data: M{"key": "value"},
+	}
+	require.NoError(t, r.objectStore.Add(source))
+	done := make(chan struct{})
+	go func() {
+		r.ObjectAdded(source)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "the handler is blocked by the API server")
+	}
+	assert.Equal(t, 1, r.stats.failedCount(), "the installation timed out")
+	_, exists, err := r.objectStore.GetByKey("target-ns/target")
+	require.NoError(t, err)
+	assert.False(t, exists, "not installed")
+}
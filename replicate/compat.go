@@ -0,0 +1,280 @@
+// Translation of the annotations of the replicators with other prefixes,
+// and compatibility with the annotations of the legacy prefixes and of other replicators, read along with the prefixed ones
+
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// MittwaldPrefix is the prefix of the annotations of the upstream mittwald kubernetes-replicator
+const MittwaldPrefix = "replicator.v1.mittwald.de"
+
+// the annotations of the mittwald kubernetes-replicator, by the annotations they stand for
+// its "replicate-to" annotation lists namespaces, as the "replicate-to-namespaces" annotation
+var mittwaldAnnotations = []struct {
+	suffix     string
+	annotation string
+}{
+	{"replicate-from", ReplicateFromAnnotation},
+	{"replicate-to", ReplicateToNsAnnotation},
+	{"replication-allowed", ReplicationAllowedAnnotation},
+	{"replication-allowed-namespaces", ReplicationAllowedNsAnnotation},
+}
+
+// the annotations written by the replicator, which are written back with the first prefix only
+var statusAnnotations = []string{
+	ReplicateOnceVersionAnnotation,
+	ReplicatedAtAnnotation,
+	ReplicatedByAnnotation,
+	ReplicatedFromVersionAnnotation,
+	ReplicatedFromOriginAnnotation,
+	ReplicatedFromAllowedAnnotation,
+	ReplicationStatusAnnotation,
+	ReplicatedTargetsCountAnnotation,
+	ReplicationStateAnnotation,
+	ReplicationErrorAnnotation,
+	ReplicatedFromClusterAnnotation,
+	PendingApprovalAnnotation,
+	ApprovalChecksumAnnotation,
+	CanaryRolloutAnnotation,
+}
+
+// the prefix of the annotations with the default prefix on the objects of a replicator with another prefix
+// they are set aside while the objects are stored, not to be mistaken for the annotations of the replicator
+const shadowedPrefix = "shadowed."
+
+// compatAnnotation is an annotation read when the annotation it stands for is missing
+type compatAnnotation struct {
+	name       string
+	// the annotation it stands for, with the prefix of the replicator
+	annotation string
+	// when true, the annotation is written by the replicator, and replaced by the one it stands for on write
+	status     bool
+}
+
+// annotationPrefixes are the prefixes of the annotations of a replicator
+// Its annotations are translated to the names with the default prefix when read, and back when written,
+// such that replicators with different prefixes can run in the same process
+type annotationPrefixes struct {
+	// the prefix of the annotations, with its trailing slash, or empty
+	prefix      string
+	// the annotations of the legacy prefixes, in order of precedence
+	compat      []compatAnnotation
+	// when true, the annotations written by the replicator are written with the legacy prefixes too,
+	// such that the controllers still using a legacy prefix keep recognizing the targets
+	compatWrite bool
+}
+
+// Returns the prefixes of the annotations, in order of precedence, the default prefix when none
+// The annotations are written with the first prefix only, the others are legacy prefixes only read
+func newAnnotationPrefixes(prefixes []string, compatWrite bool) *annotationPrefixes {
+	p := &annotationPrefixes{prefix: annotationsPrefix, compatWrite: compatWrite}
+	if len(prefixes) > 0 {
+		p.prefix = normalizePrefix(prefixes[0])
+	}
+	for i, legacy := range prefixes {
+		if legacy = normalizePrefix(legacy); i > 0 && legacy != "" && legacy != p.prefix {
+			p.compat = append(p.compat, legacyAnnotations(legacy, p.prefix)...)
+		}
+	}
+	return p
+}
+
+// the prefixes of the replicators without explicit prefixes
+var defaultPrefixes = newAnnotationPrefixes(nil, false)
+
+// Returns true if the annotations of the objects are translated
+func (p *annotationPrefixes) translating() bool {
+	return p != nil && (p.prefix != annotationsPrefix || len(p.compat) > 0)
+}
+
+// Returns the annotations of a legacy prefix, by the annotations with the prefix they stand for
+// The prefix of the mittwald kubernetes-replicator has its own annotations, the others have the same ones
+func legacyAnnotations(legacy string, prefix string) []compatAnnotation {
+	annotations := []compatAnnotation{}
+	if normalizePrefix(legacy) == MittwaldPrefix+"/" {
+		for _, mittwald := range mittwaldAnnotations {
+			annotations = append(annotations, compatAnnotation{
+				MittwaldPrefix + "/" + mittwald.suffix,
+				prefix + strings.TrimPrefix(mittwald.annotation, annotationsPrefix),
+				false,
+			})
+		}
+		return annotations
+	}
+	suffixes := make([]string, 0, len(annotationRefs))
+	for suffix := range annotationRefs {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	for _, suffix := range suffixes {
+		status := false
+		for _, annotation := range statusAnnotations {
+			status = status || annotation == annotationRefs[suffix]
+		}
+		annotations = append(annotations, compatAnnotation{normalizePrefix(legacy) + suffix, prefix + suffix, status})
+	}
+	return annotations
+}
+
+// Translates the annotations of an object, in place
+// The annotations the compatibility annotations stand for are added when missing,
+// then the annotations with the prefix are renamed with the default prefix, the ones with the default prefix are set aside
+// Returns true if any annotation was changed
+func (p *annotationPrefixes) translate(annotations map[string]string) bool {
+	if p == nil {
+		p = defaultPrefixes
+	}
+	translated := false
+	for _, compat := range p.compat {
+		if value, ok := annotations[compat.name]; !ok {
+		} else if _, ok := annotations[compat.annotation]; ok {
+		} else {
+			annotations[compat.annotation] = value
+			translated = true
+		}
+	}
+	if p.prefix == annotationsPrefix {
+		return translated
+	}
+	for suffix, annotation := range annotationRefs {
+		if value, ok := annotations[annotation]; ok {
+			annotations[shadowedPrefix+annotation] = value
+			delete(annotations, annotation)
+			translated = true
+		}
+		if value, ok := annotations[p.prefix+suffix]; ok {
+			annotations[annotation] = value
+			delete(annotations, p.prefix+suffix)
+			translated = true
+		}
+	}
+	return translated
+}
+
+// Returns a copy of the annotations to write onto an object
+// The annotations are renamed with the prefix, and the ones set aside are restored
+// The annotations added by the compatibility annotations are removed, such that they are not written onto the objects,
+// and an annotation with the same value as its compatibility annotation is removed too, its meaning is kept anyway
+// The annotations written by the replicator are written with the first prefix only, their legacy ones are removed,
+// unless written with the legacy prefixes too, then their legacy ones get the same values
+func (p *annotationPrefixes) untranslated(annotations map[string]string) map[string]string {
+	if !p.translating() || annotations == nil {
+		return annotations
+	}
+	renamed := cloneSMap(annotations)
+	if p.prefix != annotationsPrefix {
+		for suffix, annotation := range annotationRefs {
+			if value, ok := annotations[annotation]; ok {
+				renamed[p.prefix+suffix] = value
+				delete(renamed, annotation)
+			}
+			if value, ok := annotations[shadowedPrefix+annotation]; ok {
+				renamed[annotation] = value
+				delete(renamed, shadowedPrefix+annotation)
+			}
+		}
+	}
+	untranslated := cloneSMap(renamed)
+	for _, compat := range p.compat {
+		if value, ok := renamed[compat.annotation]; compat.status && p.compatWrite && ok {
+			untranslated[compat.name] = value
+		} else if value, ok := renamed[compat.name]; !ok {
+		} else if compat.status {
+			delete(untranslated, compat.name)
+		} else if untranslated[compat.annotation] == value {
+			delete(untranslated, compat.annotation)
+		}
+	}
+	return untranslated
+}
+
+// Translates the annotations of an object, in place
+func (p *annotationPrefixes) translateObject(object runtime.Object) {
+	if !p.translating() {
+		return
+	}
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return
+	}
+	if annotations := accessor.GetAnnotations(); annotations != nil && p.translate(annotations) {
+		accessor.SetAnnotations(annotations)
+	}
+}
+
+// Returns the unknown annotations with the prefix, of the annotations of a stored object
+func (p *annotationPrefixes) unknown(annotations map[string]string) []string {
+	if p == nil {
+		p = defaultPrefixes
+	}
+	return unknownAnnotations(annotations, p.prefix)
+}
+
+// Translates an object returned by kubernetes, as the ones stored
+func (r *ObjectReplicator) translateResult(object interface{}, err error) (interface{}, error) {
+	if err == nil && object != nil && r.prefixes.translating() {
+		meta := r.GetMeta(object)
+		if meta.Annotations != nil {
+			r.prefixes.translate(meta.Annotations)
+		}
+	}
+	return object, err
+}
+
+// Returns the annotations set by the replicator, of the annotations of a stored object
+func (p *annotationPrefixes) owned(annotations map[string]string) map[string]string {
+	if p == nil {
+		p = defaultPrefixes
+	}
+	owned := ownedAnnotations(annotations, p.prefix)
+	for _, annotation := range annotationRefs {
+		if value, ok := annotations[annotation]; ok {
+			owned[annotation] = value
+		}
+	}
+	return owned
+}
+
+// Update updates a resource, with its annotations untranslated
+func (r *ObjectReplicator) Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+	return r.translateResult(r.ReplicatorActions.Update(ctx, client, object, sourceObject, r.prefixes.untranslated(annotations)))
+}
+
+// Clear clears a resource, with its annotations untranslated
+func (r *ObjectReplicator) Clear(ctx context.Context, client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
+	return r.translateResult(r.ReplicatorActions.Clear(ctx, client, object, r.prefixes.untranslated(annotations)))
+}
+
+// Install creates or updates a resource, with its annotations untranslated
+func (r *ObjectReplicator) Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+	if r.prefixes.translating() && meta.Annotations != nil {
+		meta = meta.DeepCopy()
+		meta.Annotations = r.prefixes.untranslated(meta.Annotations)
+	}
+	return r.translateResult(r.ReplicatorActions.Install(ctx, client, meta, sourceObject, dataObject))
+}
+
+// Delete deletes a resource
+func (r *ObjectReplicator) Delete(ctx context.Context, client kubernetes.Interface, object interface{}) error {
+	return r.ReplicatorActions.Delete(ctx, client, object)
+}
+
+// Get gets a resource from kubernetes, and translates it as the ones stored
+// It fails if the actions cannot get the resources
+func (r *ObjectReplicator) Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error) {
+	getter, ok := r.ReplicatorActions.(ObjectGetter)
+	if !ok {
+		return nil, fmt.Errorf("getting the %ss is not supported", r.Name)
+	}
+	return r.translateResult(getter.Get(ctx, client, namespace, name))
+}
@@ -0,0 +1,219 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewAnnotationPrefixes_legacy(t *testing.T) {
+	p := newAnnotationPrefixes([]string{"test", MittwaldPrefix + "/"}, false)
+	assert.Len(t, p.compat, len(mittwaldAnnotations))
+	p = newAnnotationPrefixes([]string{"test", "legacy", "test", ""}, false)
+	assert.Len(t, p.compat, len(annotationRefs), "only the legacy prefix")
+	assert.Equal(t, "test/", p.prefix)
+	p = newAnnotationPrefixes([]string{"test"}, false)
+	assert.Empty(t, p.compat)
+	assert.True(t, p.translating(), "other prefix")
+	assert.False(t, newAnnotationPrefixes(nil, false).translating())
+	var none *annotationPrefixes
+	assert.False(t, none.translating(), "default prefixes")
+}
+
+func TestTranslateAnnotations(t *testing.T) {
+	p := newAnnotationPrefixes([]string{"test"}, false)
+	annotations := M{MittwaldPrefix + "/replicate-to": "app-.*"}
+	assert.False(t, p.translate(annotations), "disabled")
+	p = newAnnotationPrefixes([]string{"test", MittwaldPrefix}, false)
+	assert.True(t, p.translate(annotations))
+	assert.Equal(t, M{
+		MittwaldPrefix + "/replicate-to": "app-.*",
+		ReplicateToNsAnnotation:          "app-.*",
+	}, annotations)
+	assert.Equal(t, M{MittwaldPrefix + "/replicate-to": "app-.*"}, p.untranslated(annotations))
+
+	// the prefixed annotations have precedence
+	annotations = M{
+		MittwaldPrefix + "/replicate-from":      "source-ns/old",
+		MittwaldPrefix + "/replication-allowed": "true",
+		"test/replicate-from":                   "source-ns/new",
+	}
+	assert.True(t, p.translate(annotations))
+	assert.Equal(t, "source-ns/new", annotations[ReplicateFromAnnotation])
+	assert.Equal(t, "true", annotations[ReplicationAllowedAnnotation])
+	assert.Equal(t, M{
+		MittwaldPrefix + "/replicate-from":      "source-ns/old",
+		MittwaldPrefix + "/replication-allowed": "true",
+		"test/replicate-from":                   "source-ns/new",
+	}, p.untranslated(annotations), "kept when set")
+
+	// the stored objects are translated
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: M{
+		MittwaldPrefix + "/replication-allowed-namespaces": "app-.*",
+	}}}
+	p.translateObject(secret)
+	assert.Equal(t, "app-.*", secret.Annotations[ReplicationAllowedNsAnnotation])
+}
+
+func TestTranslateAnnotations_prefix(t *testing.T) {
+	p := newAnnotationPrefixes([]string{"blue"}, false)
+	original := M{
+		"blue/replicate-from":   "source-ns/blue",
+		ReplicateFromAnnotation: "source-ns/default",
+		"blue/unknown":          "true",
+		"other":                 "value",
+	}
+	annotations := cloneSMap(original)
+	assert.True(t, p.translate(annotations))
+	assert.Equal(t, M{
+		ReplicateFromAnnotation:                  "source-ns/blue",
+		shadowedPrefix + ReplicateFromAnnotation: "source-ns/default",
+		"blue/unknown":                           "true",
+		"other":                                  "value",
+	}, annotations, "the annotations of the default prefix are set aside")
+	assert.Equal(t, []string{"blue/unknown"}, p.unknown(annotations))
+	assert.Equal(t, M{
+		ReplicateFromAnnotation: "source-ns/blue",
+		"blue/unknown":          "true",
+	}, p.owned(annotations))
+	assert.Equal(t, original, p.untranslated(annotations))
+
+	// without prefix
+	p = newAnnotationPrefixes([]string{""}, false)
+	annotations = M{"replicate-to": "target", "other": "value"}
+	assert.True(t, p.translate(annotations))
+	assert.Equal(t, M{ReplicateToAnnotation: "target", "other": "value"}, annotations)
+	assert.Equal(t, M{"replicate-to": "target", "other": "value"}, p.untranslated(annotations))
+}
+
+func TestTranslateAnnotations_legacy(t *testing.T) {
+	p := newAnnotationPrefixes([]string{"new", "old", "older"}, false)
+	annotations := M{
+		"older/replicate-to":          "older-target",
+		"old/replicate-to":            "old-target",
+		"older/replication-allowed":   "true",
+		"old/replicated-by":           "source-ns/source",
+		"old/replicated-from-version": "1",
+		"new/replicated-from-version": "2",
+	}
+	assert.True(t, p.translate(annotations))
+	assert.Equal(t, "old-target", annotations[ReplicateToAnnotation], "the new prefixes have precedence")
+	assert.Equal(t, "true", annotations[ReplicationAllowedAnnotation])
+	assert.Equal(t, "source-ns/source", annotations[ReplicatedByAnnotation])
+	assert.Equal(t, "2", annotations[ReplicatedFromVersionAnnotation])
+	// the status annotations are written with the first prefix only
+	assert.Equal(t, M{
+		"older/replicate-to":          "older-target",
+		"old/replicate-to":            "old-target",
+		"older/replication-allowed":   "true",
+		"new/replicated-by":           "source-ns/source",
+		"new/replicated-from-version": "2",
+	}, p.untranslated(annotations))
+}
+
+func TestReplicateFrom_mittwald(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{Prefixes: []string{DefaultAnnotationsPrefix, MittwaldPrefix}})
+	sourceAnnotations := M{MittwaldPrefix + "/replication-allowed": "true"}
+	r.prefixes.translate(sourceAnnotations)
+	r.ObjectAdded(updateObject(r, "source-ns", "source", sourceAnnotations))
+	targetAnnotations := M{MittwaldPrefix + "/replicate-from": "source-ns/source"}
+	r.prefixes.translate(targetAnnotations)
+	r.ObjectAdded(updateObject(r, "target-ns", "target", targetAnnotations))
+
+	assertAction(t, r, 0, &testAction{
+		Action: "update",
+		Object: testObject{
+			Type: "1",
+			Data: "0",
+			Meta: metav1.ObjectMeta{
+				Name:            "target",
+				Namespace:       "target-ns",
+				ResourceVersion: "1",
+				Annotations: M{
+					ReplicatedFromVersionAnnotation:   "0",
+					MittwaldPrefix + "/replicate-from": "source-ns/source",
+				},
+			},
+		},
+	})
+	actions := r.ReplicatorActions.(*testActions).Actions
+	assert.NotContains(t, actions[0].Object.Meta.Annotations, ReplicateFromAnnotation, "translation not written")
+	requireActionsLength(t, r, 1)
+}
+
+func TestUntranslatedAnnotations_write(t *testing.T) {
+	p := newAnnotationPrefixes([]string{"new", "old"}, true)
+	annotations := M{
+		"new/replicated-by":           "source-ns/source",
+		"old/replicated-from-version": "1",
+		"old/replication-error":       "failed",
+		"old/replicate-from":          "source-ns/source",
+	}
+	p.translate(annotations)
+	annotations[ReplicatedFromVersionAnnotation] = "2"
+	delete(annotations, ReplicationErrorAnnotation)
+	assert.Equal(t, M{
+		"new/replicated-by":           "source-ns/source",
+		"old/replicated-by":           "source-ns/source",
+		"new/replicated-from-version": "2",
+		"old/replicated-from-version": "2",
+		"old/replicate-from":          "source-ns/source",
+	}, p.untranslated(annotations), "written with both prefixes")
+}
+
+func TestReplicateTo_compatWrite(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{
+		Prefixes:    []string{DefaultAnnotationsPrefix, "legacy"},
+		CompatWrite: true,
+	}, "my-ns")
+	r.ObjectAdded(updateObject(r, "my-ns", "source", M{
+		ReplicateToAnnotation: "target",
+	}))
+	assertAction(t, r, 0, &testAction{
+		Action: "install",
+		Object: testObject{
+			Type: "0",
+			Data: "0",
+			Meta: metav1.ObjectMeta{
+				Name:      "target",
+				Namespace: "my-ns",
+				Annotations: M{
+					ReplicatedByAnnotation:           "my-ns/source",
+					"legacy/replicated-by":           "my-ns/source",
+					ReplicatedFromVersionAnnotation:  "0",
+					"legacy/replicated-from-version": "0",
+				},
+			},
+		},
+	})
+	requireActionsLength(t, r, 1)
+}
+
+func TestReplicateTo_prefixes(t *testing.T) {
+	blue := createTestReplicator(t, ReplicatorOptions{Prefixes: []string{"blue"}}, "my-ns")
+	green := createTestReplicator(t, ReplicatorOptions{Prefixes: []string{"green"}}, "my-ns")
+	for _, r := range []*ObjectReplicator{blue, green} {
+		annotations := M{"blue/replicate-to": "blue-target"}
+		r.prefixes.translate(annotations)
+		r.ObjectAdded(updateObject(r, "my-ns", "source", annotations))
+	}
+	assertAction(t, blue, 0, &testAction{
+		Action: "install",
+		Object: testObject{
+			Type: "0",
+			Data: "0",
+			Meta: metav1.ObjectMeta{
+				Name:      "blue-target",
+				Namespace: "my-ns",
+				Annotations: M{
+					"blue/replicated-by":           "my-ns/source",
+					"blue/replicated-from-version": "0",
+				},
+			},
+		},
+	})
+	requireActionsLength(t, blue, 1)
+	requireActionsLength(t, green, 0)
+}
@@ -0,0 +1,124 @@
+package replicate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Meant to be run with -race: the handlers share the maps of the replicator
+func TestConcurrentHandlers(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{AllowAll: true}, "source-ns")
+	count := 20
+	sources := []*testObject{}
+	namespaces := []*v1.Namespace{}
+	for i := 0; i < count; i++ {
+		sources = append(sources, updateObject(r, "source-ns", fmt.Sprintf("source-%d", i), M{
+			ReplicateToAnnotation: fmt.Sprintf("target-[0-9]+/copy-%d", i),
+		}))
+		namespace := &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("target-%d", i),
+			},
+		}
+		require.NoError(t, r.namespaceStore.Add(namespace))
+		namespaces = append(namespaces, namespace)
+	}
+
+	var group sync.WaitGroup
+	group.Add(4)
+	// the object controller
+	go func() {
+		defer group.Done()
+		for _, source := range sources {
+			r.ObjectAdded(source)
+		}
+	}()
+	// the namespace controller
+	go func() {
+		defer group.Done()
+		for _, namespace := range namespaces {
+			r.NamespaceAdded(namespace)
+		}
+	}()
+	// the liveness and topology endpoints
+	go func() {
+		defer group.Done()
+		for i := 0; i < count; i++ {
+			r.Status()
+		}
+	}()
+	go func() {
+		defer group.Done()
+		for i := 0; i < count; i++ {
+			r.Topology()
+		}
+	}()
+	group.Wait()
+
+	// every source replicated to every namespace, whatever the order
+	for _, source := range sources {
+		targets := r.targetsTo(metaKey(&source.Meta)).sorted()
+		assert.Len(t, targets, count, metaKey(&source.Meta))
+	}
+	for _, namespace := range namespaces {
+		for i := range sources {
+			name := fmt.Sprintf("copy-%d", i)
+			assert.NotNil(t, getObject(r, namespace.Name, name), "%s/%s", namespace.Name, name)
+		}
+	}
+}
+
+func TestConcurrentQueue(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{AllowAll: true}, "source-ns")
+	r.initQueue()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-[0-9]+/copy",
+	})
+	count := 20
+	namespaces := []*v1.Namespace{}
+	for i := 0; i < count; i++ {
+		namespace := &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("target-%d", i),
+			},
+		}
+		require.NoError(t, r.namespaceStore.Add(namespace))
+		namespaces = append(namespaces, namespace)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.runWorker()
+		close(done)
+	}()
+	var group sync.WaitGroup
+	group.Add(2)
+	go func() {
+		defer group.Done()
+		for i := 0; i < count; i++ {
+			r.enqueueObject(source)
+		}
+	}()
+	go func() {
+		defer group.Done()
+		for _, namespace := range namespaces {
+			r.enqueueNamespace(namespace)
+		}
+	}()
+	group.Wait()
+	// the worker handles the remaining items before stopping
+	r.queue.ShutDown()
+	<-done
+
+	assert.True(t, r.queueIdle())
+	assert.Len(t, r.targetsTo("source-ns/source"), count)
+	for _, namespace := range namespaces {
+		assert.NotNil(t, getObject(r, namespace.Name, "copy"), namespace.Name)
+	}
+}
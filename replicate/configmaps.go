@@ -1,41 +1,86 @@
 package replicate
 
 import (
-	"log"
-	"time"
+	"context"
 
+	"github.com/go-logr/logr"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
 var _configMapActions *configMapActions = &configMapActions{}
 
-// NewConfigMapReplicator creates a new config map replicator
-func NewConfigMapReplicator(client kubernetes.Interface, options ReplicatorOptions, resyncPeriod time.Duration) Replicator {
-	repl := ObjectReplicator{
-		ReplicatorProps:   NewReplicatorProps(client, "configMap", options),
-		ReplicatorActions: _configMapActions,
+// NewConfigMapReplicator creates a new config map replicator, configured by the options
+// Returns an error if its metrics cannot be registered
+func NewConfigMapReplicator(client kubernetes.Interface, opts ...Option) (Replicator, error) {
+	config := NewReplicatorConfig(opts...)
+	options := config.Options
+	repl, err := config.NewObjectReplicator(client, "configMap", _configMapActions)
+	if err != nil {
+		return nil, err
+	}
+	if options.ServerSideApply || options.Propagation != "" {
+		repl.ReplicatorActions = &configMapActions{
+			serverSideApply: options.ServerSideApply,
+			propagation:     options.Propagation,
+			applied:         repl.appliedMeta(),
+		}
 	}
 	configmaps := client.CoreV1().ConfigMaps("")
 	listWatch := cache.ListWatch{
 		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
-			return configmaps.List(lo)
+			return configmaps.List(repl.ctx, lo)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return configmaps.Watch(repl.ctx, lo)
 		},
-		WatchFunc: configmaps.Watch,
 	}
-	repl.InitStores(&listWatch, &v1.ConfigMap{}, resyncPeriod)
-	return &repl
+	repl.InitStores(&listWatch, &v1.ConfigMap{}, config.ResyncPeriod)
+	return repl, nil
 }
 
-type configMapActions struct {}
+type configMapActions struct {
+	// when true, installs and data updates are server-side applied
+	serverSideApply bool
+	// the propagation policy of the deletions, empty for the default of the API server
+	propagation     metav1.DeletionPropagation
+	// the labels and annotations applied
+	applied         *appliedMeta
+}
 
 func (*configMapActions) GetMeta(object interface{}) *metav1.ObjectMeta {
 	return &object.(*v1.ConfigMap).ObjectMeta
 }
 
+func (*configMapActions) DataChecksum(object interface{}) string {
+	configMap := object.(*v1.ConfigMap)
+	// keys are unique across data and binary data
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for key, value := range configMap.Data {
+		data[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		data[key] = value
+	}
+	return checksumData(data)
+}
+
+func (*configMapActions) DataSize(object interface{}) int {
+	configMap := object.(*v1.ConfigMap)
+	size := 0
+	for key, value := range configMap.Data {
+		size += len(key) + len(value)
+	}
+	for key, value := range configMap.BinaryData {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
 func copyConfigMapData(configMap *v1.ConfigMap, sourceObject interface{}) {
 	if sourceObject != nil {
 		sourceConfigMap := sourceObject.(*v1.ConfigMap)
@@ -62,7 +107,39 @@ func copyConfigMapData(configMap *v1.ConfigMap, sourceObject interface{}) {
 	}
 }
 
-func (*configMapActions) Update(client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+// Returns the configMap to apply, with only the fields set by the replicator
+func configMapToApply(meta *metav1.ObjectMeta, dataObject interface{}, applied *appliedMeta) *v1.ConfigMap {
+	configMap := &v1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: applied.metaToApply(meta),
+	}
+	copyConfigMapData(configMap, dataObject)
+	return configMap
+}
+
+// Server-side applies the configMap
+func applyConfigMap(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, dataObject interface{}, applied *appliedMeta) (interface{}, error) {
+	configMap := configMapToApply(meta, dataObject, applied)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("applying configMap", "target", metaKey(meta), "action", "apply")
+	update := &v1.ConfigMap{}
+	if err := applyObject(ctx, client, "configmaps", meta, configMap, update); err != nil {
+		logger.Error(err, "error while applying configMap", "target", metaKey(meta), "action", "apply")
+		return nil, err
+	}
+	return update, nil
+}
+
+func (a *configMapActions) Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+	// only apply new data, other updates don't change the owned fields
+	if a.serverSideApply && sourceObject != nil && sourceObject != object {
+		meta := object.(*v1.ConfigMap).ObjectMeta.DeepCopy()
+		meta.Annotations = annotations
+		return applyConfigMap(ctx, client, meta, sourceObject, a.applied)
+	}
 	// copy the configMap
 	configMap := object.(*v1.ConfigMap).DeepCopy()
 	// set the annotations
@@ -70,16 +147,17 @@ func (*configMapActions) Update(client kubernetes.Interface, object interface{},
 	// copy the data
 	copyConfigMapData(configMap, sourceObject)
 
-	log.Printf("updating configMap %s/%s", configMap.Namespace, configMap.Name)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("updating configMap", "target", metaKey(&configMap.ObjectMeta), "action", "update")
 	// update the configMap
-	update, err := client.CoreV1().ConfigMaps(configMap.Namespace).Update(configMap)
+	update, err := client.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
 	if err != nil {
-		log.Printf("error while updating configMap %s/%s: %s", configMap.Namespace, configMap.Name, err)
+		logger.Error(err, "error while updating configMap", "target", metaKey(&configMap.ObjectMeta), "action", "update")
 	}
 	return update, err
 }
 
-func (*configMapActions) Clear(client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
+func (*configMapActions) Clear(ctx context.Context, client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
 	// copy the configMap
 	configMap := object.(*v1.ConfigMap).DeepCopy()
 	// set the annotations
@@ -89,16 +167,20 @@ func (*configMapActions) Clear(client kubernetes.Interface, object interface{},
 	// clear the binary data
 	configMap.BinaryData = nil
 
-	log.Printf("clearing configMap %s/%s", configMap.Namespace, configMap.Name)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("clearing configMap", "target", metaKey(&configMap.ObjectMeta), "action", "clear")
 	// update the configMap
-	update, err := client.CoreV1().ConfigMaps(configMap.Namespace).Update(configMap)
+	update, err := client.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
 	if err != nil {
-		log.Printf("error while clearing configMap %s/%s", configMap.Namespace, configMap.Name)
+		logger.Error(err, "error while clearing configMap", "target", metaKey(&configMap.ObjectMeta), "action", "clear")
 	}
 	return update, err
 }
 
-func (*configMapActions) Install(client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+func (a *configMapActions) Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+	if a.serverSideApply {
+		return applyConfigMap(ctx, client, meta, dataObject, a.applied)
+	}
 	// sourceConfigMap := sourceObject.(*v1.ConfigMap)
 	// create a new configMap
 	configMap := v1.ConfigMap{
@@ -107,37 +189,53 @@ func (*configMapActions) Install(client kubernetes.Interface, meta *metav1.Objec
 	// copy the data
 	copyConfigMapData(&configMap, dataObject)
 
-	log.Printf("installing configMap %s/%s", configMap.Namespace, configMap.Name)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("installing configMap", "target", metaKey(&configMap.ObjectMeta), "action", "install")
 
 	var update *v1.ConfigMap
 	var err error
 	if configMap.ResourceVersion == "" {
 		// create the configMap
-		update, err = client.CoreV1().ConfigMaps(configMap.Namespace).Create(&configMap)
+		update, err = client.CoreV1().ConfigMaps(configMap.Namespace).Create(ctx, &configMap, metav1.CreateOptions{})
 	} else {
 		// update the configMap
-		update, err = client.CoreV1().ConfigMaps(configMap.Namespace).Update(&configMap)
+		update, err = client.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx, &configMap, metav1.UpdateOptions{})
 	}
 
 	if err != nil {
-		log.Printf("error while installing configMap %s/%s: %s", configMap.Namespace, configMap.Name, err)
+		logger.Error(err, "error while installing configMap", "target", metaKey(&configMap.ObjectMeta), "action", "install")
 	}
 	return update, err
 }
 
-func (*configMapActions) Delete(client kubernetes.Interface, object interface{}) error {
+func (a *configMapActions) Delete(ctx context.Context, client kubernetes.Interface, object interface{}) error {
 	configMap := object.(*v1.ConfigMap)
-	log.Printf("deleting configMap %s/%s", configMap.Namespace, configMap.Name)
-	// prepare the delete options
-	options := metav1.DeleteOptions{
-		Preconditions: &metav1.Preconditions{
-			ResourceVersion: &configMap.ResourceVersion,
-		},
-	}
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("deleting configMap", "target", metaKey(&configMap.ObjectMeta), "action", "delete")
 	// delete the configMap
-	err := client.CoreV1().ConfigMaps(configMap.Namespace).Delete(configMap.Name, &options)
+	err := client.CoreV1().ConfigMaps(configMap.Namespace).Delete(ctx, configMap.Name, deleteOptions(&configMap.ObjectMeta, a.propagation))
 	if err != nil {
-		log.Printf("error while deleting configMap %s/%s: %s", configMap.Namespace, configMap.Name, err)
+		logger.Error(err, "error while deleting configMap", "target", metaKey(&configMap.ObjectMeta), "action", "delete")
 	}
 	return err
 }
+
+func (*configMapActions) Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error) {
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return configMap, nil
+}
+
+func (*configMapActions) List(ctx context.Context, client kubernetes.Interface, selector string) ([]interface{}, error) {
+	list, err := client.CoreV1().ConfigMaps(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]interface{}, len(list.Items))
+	for i := range list.Items {
+		objects[i] = &list.Items[i]
+	}
+	return objects, nil
+}
@@ -1,6 +1,7 @@
 package replicate
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -32,12 +33,25 @@ func TestConfigMap_GetMeta(t *testing.T) {
 	assert.Equal(t, copy, _configMapActions.GetMeta(object))
 }
 
+func TestConfigMap_DataSize(t *testing.T) {
+	object := &v1.ConfigMap{
+		Data: M{
+			"test": "test-data",
+		},
+		BinaryData: MB{
+			"binary": []byte("binary-data"),
+		},
+	}
+	assert.Equal(t, 30, _configMapActions.DataSize(object))
+	assert.Equal(t, 0, _configMapActions.DataSize(&v1.ConfigMap{}))
+}
+
 func TestConfigMap_Update(t *testing.T) {
 	replicator, watcher := createReplicator(_configMapActions, "test-ns")
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	configmaps := replicator.client.CoreV1().ConfigMaps("test-ns")
 
-	old, err := configmaps.Create(&v1.ConfigMap{
+	old, err := configmaps.Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-update",
@@ -55,7 +69,7 @@ func TestConfigMap_Update(t *testing.T) {
 			"test-binary-data": []byte("old"),
 			"test-old": []byte("binary"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -85,7 +99,7 @@ func TestConfigMap_Update(t *testing.T) {
 
 	old2 := old.DeepCopy()
 	source2 := source.DeepCopy()
-	store, err := _configMapActions.Update(replicator.client, old2, source2, annotations)
+	store, err := _configMapActions.Update(context.TODO(), replicator.client, old2, source2, annotations)
 	require.NoError(t, err)
 	assert.Equal(t, old, old2, "old changed")
 	assert.Equal(t, source, source2, "source changed")
@@ -93,7 +107,7 @@ func TestConfigMap_Update(t *testing.T) {
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.ConfigMap)
 	require.True(t, ok, "configmap")
-	new, err := configmaps.Get("test-update", metav1.GetOptions{})
+	new, err := configmaps.Get(context.TODO(), "test-update", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.ConfigMap{
@@ -129,7 +143,7 @@ func TestConfigMap_Clear(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	configmaps := replicator.client.CoreV1().ConfigMaps("test-ns")
 
-	todo, err := configmaps.Create(&v1.ConfigMap{
+	todo, err := configmaps.Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-clear",
@@ -147,7 +161,7 @@ func TestConfigMap_Clear(t *testing.T) {
 			"test-binary-data": []byte("todo"),
 			"test-todo": []byte("binary"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -157,14 +171,14 @@ func TestConfigMap_Clear(t *testing.T) {
 	}
 
 	todo2 := todo.DeepCopy()
-	store, err := _configMapActions.Clear(replicator.client, todo2, annotations)
+	store, err := _configMapActions.Clear(context.TODO(), replicator.client, todo2, annotations)
 	require.NoError(t, err)
 	assert.Equal(t, todo, todo2, "todo changed")
 	require.Equal(t, 2, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.ConfigMap)
 	require.True(t, ok, "configmap")
-	new, err := configmaps.Get("test-clear", metav1.GetOptions{})
+	new, err := configmaps.Get(context.TODO(), "test-clear", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.ConfigMap{
@@ -224,14 +238,14 @@ func TestConfigMap_install_create_empty(t *testing.T) {
 	}
 
 	source2 := source.DeepCopy()
-	store, err := _configMapActions.Install(replicator.client, meta, source2, nil)
+	store, err := _configMapActions.Install(context.TODO(), replicator.client, meta, source2, nil)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "create", watcher.Actions[0].GetVerb())
 	sent, ok := watcher.Actions[0].(CreateAction).GetObject().(*v1.ConfigMap)
 	require.True(t, ok, "configmap")
-	new, err := configmaps.Get("test-install", metav1.GetOptions{})
+	new, err := configmaps.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.ConfigMap{
@@ -261,7 +275,7 @@ func TestConfigMap_install_update_empty(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	configmaps := replicator.client.CoreV1().ConfigMaps("test-ns")
 
-	_, err := configmaps.Create(&v1.ConfigMap{
+	_, err := configmaps.Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-install",
@@ -279,7 +293,7 @@ func TestConfigMap_install_update_empty(t *testing.T) {
 			"test-binary-data": []byte("old"),
 			"test-old": []byte("binary"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -313,14 +327,14 @@ func TestConfigMap_install_update_empty(t *testing.T) {
 	}
 
 	source2 := source.DeepCopy()
-	store, err := _configMapActions.Install(replicator.client, meta, source2, nil)
+	store, err := _configMapActions.Install(context.TODO(), replicator.client, meta, source2, nil)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	require.Equal(t, 2, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.ConfigMap)
 	require.True(t, ok, "configmap")
-	new, err := configmaps.Get("test-install", metav1.GetOptions{})
+	new, err := configmaps.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.ConfigMap{
@@ -400,7 +414,7 @@ func TestConfigMap_install_create_data(t *testing.T) {
 
 	source2 := source.DeepCopy()
 	copy2 := copy.DeepCopy()
-	store, err := _configMapActions.Install(replicator.client, meta, source2, copy2)
+	store, err := _configMapActions.Install(context.TODO(), replicator.client, meta, source2, copy2)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	assert.Equal(t, copy, copy2, "copy changed")
@@ -408,7 +422,7 @@ func TestConfigMap_install_create_data(t *testing.T) {
 	require.Equal(t, "create", watcher.Actions[0].GetVerb())
 	sent, ok := watcher.Actions[0].(CreateAction).GetObject().(*v1.ConfigMap)
 	require.True(t, ok, "configmap")
-	new, err := configmaps.Get("test-install", metav1.GetOptions{})
+	new, err := configmaps.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.ConfigMap{
@@ -444,7 +458,7 @@ func TestConfigMap_install_update_data(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	configmaps := replicator.client.CoreV1().ConfigMaps("test-ns")
 
-	_, err := configmaps.Create(&v1.ConfigMap{
+	_, err := configmaps.Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-install",
@@ -462,7 +476,7 @@ func TestConfigMap_install_update_data(t *testing.T) {
 			"test-binary-data": []byte("old"),
 			"test-old": []byte("binary"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -516,7 +530,7 @@ func TestConfigMap_install_update_data(t *testing.T) {
 
 	source2 := source.DeepCopy()
 	copy2 := copy.DeepCopy()
-	store, err := _configMapActions.Install(replicator.client, meta, source2, copy2)
+	store, err := _configMapActions.Install(context.TODO(), replicator.client, meta, source2, copy2)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	assert.Equal(t, copy, copy2, "copy changed")
@@ -524,7 +538,7 @@ func TestConfigMap_install_update_data(t *testing.T) {
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.ConfigMap)
 	require.True(t, ok, "configmap")
-	new, err := configmaps.Get("test-install", metav1.GetOptions{})
+	new, err := configmaps.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.ConfigMap{
@@ -560,7 +574,7 @@ func TestConfigMap_Delete(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	configmaps := replicator.client.CoreV1().ConfigMaps("test-ns")
 
-	todo, err := configmaps.Create(&v1.ConfigMap{
+	todo, err := configmaps.Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-delete",
@@ -578,19 +592,19 @@ func TestConfigMap_Delete(t *testing.T) {
 			"test-binary-data": []byte("todo"),
 			"test-todo": []byte("binary"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
 	todo2 := todo.DeepCopy()
-	err = _configMapActions.Delete(replicator.client, todo2)
+	err = _configMapActions.Delete(context.TODO(), replicator.client, todo2)
 	require.NoError(t, err)
 	assert.Equal(t, todo, todo2, "todo changed")
 	require.Equal(t, 2, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "delete", watcher.Actions[1].GetVerb())
 	require.Equal(t, "test-delete", watcher.Actions[1].(DeleteAction).GetName())
 	// TODO: test delete option (impossible with the current implementation of fake client)
-	_, err = configmaps.Get("test-clear", metav1.GetOptions{})
+	_, err = configmaps.Get(context.TODO(), "test-clear", metav1.GetOptions{})
 	require.Error(t, err)
 }
 
@@ -610,9 +624,9 @@ func TestNewConfigMapReplicator(t *testing.T) {
 			Name: "target-1",
 		},
 	})
-	replicator := NewConfigMapReplicator(client, ReplicatorOptions{AllowAll: true}, resyncPeriod)
+	replicator := newTestConfigMapReplicator(t, client, WithOptions(ReplicatorOptions{AllowAll: true, ListPageSize: 500}), WithResyncPeriod(resyncPeriod))
 	replicator.Start()
-	_, err := client.CoreV1().ConfigMaps("from-ns").Create(&v1.ConfigMap{
+	_, err := client.CoreV1().ConfigMaps("from-ns").Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "from-ns",
 			Name: "from",
@@ -620,9 +634,9 @@ func TestNewConfigMapReplicator(t *testing.T) {
 				ReplicateFromAnnotation: "source-ns/source",
 			},
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err, "from-ns/from")
-	_, err = client.CoreV1().ConfigMaps("to-ns").Create(&v1.ConfigMap{
+	_, err = client.CoreV1().ConfigMaps("to-ns").Create(context.TODO(), &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "to-ns",
 			Name: "to",
@@ -631,34 +645,34 @@ func TestNewConfigMapReplicator(t *testing.T) {
 				ReplicateFromAnnotation: "source-ns/source",
 			},
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err, "to-ns/to")
-	_, err = client.CoreV1().Namespaces().Create(&v1.Namespace{
+	_, err = client.CoreV1().Namespaces().Create(context.TODO(), &v1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "target-2",
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err, "target-2")
 	time.Sleep(sleep)
 
-	configmap, err := client.CoreV1().ConfigMaps("from-ns").Get("from", metav1.GetOptions{})
+	configmap, err := client.CoreV1().ConfigMaps("from-ns").Get(context.TODO(), "from", metav1.GetOptions{})
 	if assert.NoError(t, err, "from-ns/from") {
 		assert.Equal(t, "source", configmap.Data["data"], "from-ns/from")
 	}
-	configmap, err = client.CoreV1().ConfigMaps("target-1").Get("target", metav1.GetOptions{})
+	configmap, err = client.CoreV1().ConfigMaps("target-1").Get(context.TODO(), "target", metav1.GetOptions{})
 	if assert.NoError(t, err, "target-1/target") {
 		assert.Equal(t, "source", configmap.Data["data"], "target-1/target")
 	}
-	configmap, err = client.CoreV1().ConfigMaps("target-2").Get("target", metav1.GetOptions{})
+	configmap, err = client.CoreV1().ConfigMaps("target-2").Get(context.TODO(), "target", metav1.GetOptions{})
 	if assert.NoError(t, err, "target-2/target") {
 		assert.Equal(t, "source", configmap.Data["data"], "target-2/target")
 	}
 
-	err = client.CoreV1().ConfigMaps("to-ns").Delete("to", &metav1.DeleteOptions{})
+	err = client.CoreV1().ConfigMaps("to-ns").Delete(context.TODO(), "to", metav1.DeleteOptions{})
 	require.NoError(t, err, "to-ns/to")
 	time.Sleep(sleep)
-	configmap, err = client.CoreV1().ConfigMaps("target-1").Get("target", metav1.GetOptions{})
+	configmap, err = client.CoreV1().ConfigMaps("target-1").Get(context.TODO(), "target", metav1.GetOptions{})
 	assert.Error(t, err, "target-1/target")
-	configmap, err = client.CoreV1().ConfigMaps("target-2").Get("target", metav1.GetOptions{})
+	configmap, err = client.CoreV1().ConfigMaps("target-2").Get(context.TODO(), "target", metav1.GetOptions{})
 	assert.Error(t, err, "target-2/target")
 }
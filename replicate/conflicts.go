@@ -0,0 +1,79 @@
+// Retries of the actions conflicting with the current version of their target
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// how many times an action is retried on conflict, with the latest version of its target
+const maxConflictRetries = 3
+
+// Returns true if the error comes from an outdated version of the target
+func isConflict(err error) bool {
+	return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+}
+
+// Gets the latest version of an object from kubernetes, and updates the store with it
+// Returns nil if the object does not exist anymore
+func (r *ObjectReplicator) refetch(key string) (interface{}, error) {
+	split := strings.SplitN(key, "/", 2)
+	if len(split) != 2 {
+		return nil, fmt.Errorf("invalid key %s: expected namespace/name", key)
+	}
+	var object interface{}
+	var err error
+	r.unlocked(func() {
+		ctx, cancel := r.requestContext(r.ctx)
+		defer cancel()
+		object, err = r.Get(ctx, r.client, split[0], split[1])
+	})
+	if errors.IsNotFound(err) {
+		if old, exists, err := r.objectStore.GetByKey(key); err != nil {
+			return nil, err
+		} else if exists {
+			return nil, r.objectStore.Delete(old)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return object, r.objectStore.Update(object)
+}
+
+// Handles a target again later, with backoff, when its deletion failed its preconditions
+// Its deletion is then decided again with the latest version of the target and of its source,
+// such that a stale target is not left in place until the next event of its source
+// The retries are bounded by the retry budget, the retry of the item itself already has its backoff
+func (r *ObjectReplicator) retryDelete(key string) {
+	item := queueItem{key: key, deletion: true}
+	if r.queue == nil || r.queue.NumRequeues(item) > 0 {
+		return
+	}
+	r.logger.Info("deletion still conflicts, retrying later", "target", key)
+	r.metrics.deleteRetries.WithLabelValues(r.Name).Inc()
+	r.queue.AddRateLimited(item)
+}
+
+// Retries an action which failed with a conflict, with the latest version of its target
+// The action receives nil if the target does not exist anymore
+// Once the retries are exhausted, the returned error is not a conflict anymore, to avoid nested retries
+func (r *ObjectReplicator) retryOnConflict(key string, err error, action func(latest interface{}) error) error {
+	for retry := 1; isConflict(err); retry++ {
+		if retry > maxConflictRetries {
+			r.stats.conflictExhausted()
+			return fmt.Errorf("still conflicting after %d retries: %s", maxConflictRetries, err)
+		}
+		r.logger.Info("conflict, retrying with the latest version", "target", key, "retry", retry)
+		latest, fetchErr := r.refetch(key)
+		if fetchErr != nil {
+			r.logger.Error(fetchErr, "could not get the latest version", "target", key)
+			return err
+		}
+		err = action(latest)
+	}
+	return err
+}
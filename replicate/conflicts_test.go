@@ -0,0 +1,118 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflicts_replicateFrom(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{})
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+
+	// retried with the latest version
+	actions.Conflicts = map[string]int{"target-ns/target": 1}
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 2)
+	assert.True(t, actions.Actions[0].Conflict)
+	assert.False(t, actions.Actions[1].Conflict)
+	assert.Equal(t, "update", actions.Actions[1].Action)
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+	assert.Equal(t, 0, r.Status().FailedActions)
+
+	// still conflicting after all the retries
+	source = updateObject(r, "source-ns", "source", nil)
+	actions.Conflicts = map[string]int{"target-ns/target": maxConflictRetries + 1}
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, maxConflictRetries+3)
+	assert.Equal(t, 1, r.Status().FailedActions)
+	assert.NotEqual(t, source.Data, getObject(r, "target-ns", "target").Data)
+}
+
+func TestConflicts_replicateTo(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+
+	// installed on retry
+	actions.Conflicts = map[string]int{"target-ns/target": 2}
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 3)
+	assert.Equal(t, "install", actions.Actions[2].Action)
+	assert.False(t, actions.Actions[2].Conflict)
+	require.NotNil(t, getObject(r, "target-ns", "target"))
+	assert.Equal(t, 0, r.Status().FailedActions)
+
+	// deleted on retry, when still replicated by the source
+	deleteObject(r, "source-ns", "source")
+	actions.Conflicts = map[string]int{"target-ns/target": 1}
+	r.ObjectDeleted(source)
+	requireActionsLength(t, r, 5)
+	assert.Equal(t, "delete", actions.Actions[4].Action)
+	assert.False(t, actions.Actions[4].Conflict)
+	assert.Nil(t, getObject(r, "target-ns", "target"))
+	assert.Equal(t, 0, r.Status().FailedActions)
+}
+
+func TestConflicts_deleteRetried(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{RetryBudget: 2, RetryBaseDelay: time.Millisecond}, "source-ns", "target-ns")
+	r.initQueue()
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+
+	// still conflicting after all the retries, handled again later
+	deleteObject(r, "source-ns", "source")
+	actions.Conflicts = map[string]int{"target-ns/target": maxConflictRetries + 1}
+	r.ObjectDeleted(source)
+	requireActionsLength(t, r, maxConflictRetries+2)
+	require.NotNil(t, getObject(r, "target-ns", "target"))
+	item := queueItem{key: "target-ns/target", deletion: true}
+	assert.Equal(t, 1, r.queue.NumRequeues(item))
+
+	// deleted once its source is known to be deleted
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, maxConflictRetries+3)
+	assert.Equal(t, "delete", actions.Actions[maxConflictRetries+2].Action)
+	assert.False(t, actions.Actions[maxConflictRetries+2].Conflict)
+	assert.Nil(t, getObject(r, "target-ns", "target"))
+	assert.Equal(t, 0, r.queue.NumRequeues(item))
+}
+
+func TestConflicts_clear(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{})
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 1)
+
+	// cleared on retry
+	deleteObject(r, "source-ns", "source")
+	actions.Conflicts = map[string]int{"target-ns/target": 1}
+	r.ObjectDeleted(source)
+	requireActionsLength(t, r, 3)
+	assert.Equal(t, "clear", actions.Actions[2].Action)
+	assert.False(t, actions.Actions[2].Conflict)
+	assert.Equal(t, "", getObject(r, "target-ns", "target").Data)
+	assert.Equal(t, 0, r.Status().FailedActions)
+}
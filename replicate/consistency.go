@@ -0,0 +1,263 @@
+// Read-only check of the consistency between the sources and their targets
+
+package replicate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The kinds of consistency issues
+const (
+	// IssueMissing is a target that should exist but does not
+	IssueMissing = "missing"
+	// IssueOrphaned is a target whose source does not exist or does not target it anymore
+	IssueOrphaned = "orphaned"
+	// IssueDivergent is a target whose data or annotations differ from what its source expects
+	IssueDivergent = "divergent"
+	// IssueInvalid is an object with invalid annotations
+	IssueInvalid = "invalid"
+)
+
+// ConsistencyIssue is a difference between the expected and the actual state
+type ConsistencyIssue struct {
+	Kind    string `json:"kind"`
+	Source  string `json:"source,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Message string `json:"message"`
+}
+
+// ConsistencyReport lists the consistency issues of a replicator
+type ConsistencyReport struct {
+	Resource string             `json:"resource"`
+	Sources  int                `json:"sources"`
+	Targets  int                `json:"targets"`
+	Issues   []ConsistencyIssue `json:"issues"`
+}
+
+// storeLoader is implemented by the replicators able to run the commands without their informers
+type storeLoader interface {
+	// lists all the objects and namespaces once, without running the informers
+	LoadStores() error
+}
+
+// ConsistencyChecker is implemented by the replicators able to check their consistency
+type ConsistencyChecker interface {
+	storeLoader
+	// compares the expected and the actual state, without mutating anything
+	CheckConsistency() ConsistencyReport
+}
+
+// Lists all the objects into the store
+func loadStore(lw cache.ListerWatcher, store cache.Store) error {
+	object, err := lw.List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	list, err := meta.ListAccessor(object)
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(object)
+	if err != nil {
+		return err
+	}
+	copy := make([]interface{}, len(items))
+	for index, item := range items {
+		copy[index] = item
+	}
+	return store.Replace(copy, list.GetResourceVersion())
+}
+
+// LoadStores lists all the objects and namespaces once, without running the informers
+func (r *ObjectReplicator) LoadStores() error {
+	if err := loadStore(r.namespaceListWatch, r.namespaceStore); err != nil {
+		return fmt.Errorf("could not list namespaces: %s", err)
+	}
+	if err := loadStore(r.objectListWatch, r.objectStore); err != nil {
+		return fmt.Errorf("could not list %s: %s", r.Name, err)
+	}
+	return nil
+}
+
+// Returns true if the target holds the data of the source, or does not need to
+func (r *ObjectReplicator) hasSourceData(target interface{}, source interface{}) (bool, error) {
+	targetMeta := r.GetMeta(target)
+	sourceMeta := r.GetMeta(source)
+	update, once, err := r.needsDataUpdate(targetMeta, sourceMeta)
+	// replicated once, the data may differ
+	if once {
+		return true, nil
+	// an annotation is invalid
+	} else if !update && targetMeta.Annotations[ReplicatedFromVersionAnnotation] != sourceMeta.ResourceVersion {
+		return false, err
+	}
+	// the data may have been changed even if up-to-date
+	return r.DataChecksum(target) == r.DataChecksum(source), nil
+}
+
+// CheckConsistency compares the expected and the actual state, without mutating anything
+func (r *ObjectReplicator) CheckConsistency() ConsistencyReport {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	report := ConsistencyReport{
+		Resource: r.Name,
+		Issues:   []ConsistencyIssue{},
+	}
+	issue := func(kind string, source string, target string, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, ConsistencyIssue{
+			Kind:    kind,
+			Source:  source,
+			Target:  target,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	get := func(key string) (interface{}, *metav1.ObjectMeta) {
+		if object, exists, err := r.objectStore.GetByKey(key); err == nil && exists {
+			return object, r.GetMeta(object)
+		}
+		return nil, nil
+	}
+	sources := map[string]bool{}
+	namespaces := r.namespaceStore.ListKeys()
+	existingNamespaces := map[string]bool{}
+	for _, namespace := range namespaces {
+		existingNamespaces[namespace] = true
+	}
+
+	for _, object := range r.objectStore.List() {
+		objectMeta := r.GetMeta(object)
+		key := metaKey(objectMeta)
+		if unknown := r.prefixes.unknown(objectMeta.Annotations); len(unknown) > 0 && !r.IgnoreUnknown {
+			issue(IssueInvalid, "", key, "unknown annotation %s", unknown[0])
+			continue
+		}
+		_, isTarget := objectMeta.Annotations[ReplicatedByAnnotation]
+		// a target of a replicate-to annotation
+		if source, ok := objectMeta.Annotations[ReplicatedByAnnotation]; ok {
+			report.Targets++
+			if _, sourceMeta := get(source); sourceMeta == nil {
+				issue(IssueOrphaned, source, key, "source does not exist")
+			} else if ok, err := r.isReplicatedTo(sourceMeta, objectMeta); err != nil {
+				issue(IssueInvalid, source, key, "%s", err)
+			} else if !ok {
+				issue(IssueOrphaned, source, key, "source is not replicated to target")
+			}
+		}
+		// a target of a replicate-from annotation
+		if source, ok := resolveAnnotation(objectMeta, ReplicateFromAnnotation); ok {
+			if !isTarget {
+				report.Targets++
+			}
+			sources[source] = true
+			_, replicated := objectMeta.Annotations[ReplicatedFromVersionAnnotation]
+			sourceObject, sourceMeta := get(source)
+			if sourceMeta == nil {
+				if replicated {
+					issue(IssueOrphaned, source, key, "source does not exist, target is not cleared")
+				}
+			} else if ok, nok, err := r.isReplicationAllowed(objectMeta, sourceMeta); !ok && !nok {
+				issue(IssueInvalid, source, key, "%s", err)
+			} else if !ok {
+				if replicated {
+					issue(IssueDivergent, source, key, "replication is not allowed, target is not cleared: %s", err)
+				}
+			} else if _, okFrom := sourceMeta.Annotations[ReplicateFromAnnotation]; okFrom && sourceMeta.Annotations[ReplicatedFromVersionAnnotation] == "" {
+				if replicated {
+					issue(IssueDivergent, source, key, "source is cleared, target is not cleared")
+				}
+			} else if ok, err := r.hasSourceData(object, sourceObject); err != nil {
+				issue(IssueInvalid, source, key, "%s", err)
+			} else if !ok {
+				issue(IssueDivergent, source, key, "data differs from source")
+			}
+		}
+		// a source of replicate-to annotations, ignored on targets
+		if isTarget {
+			continue
+		}
+		targets, targetPatterns, err := r.getReplicationTargets(objectMeta)
+		if err != nil {
+			issue(IssueInvalid, key, "", "%s", err)
+			continue
+		} else if targets == nil && targetPatterns == nil {
+			continue
+		}
+		sources[key] = true
+		expected := map[string]bool{}
+		for _, target := range targets {
+			if existingNamespaces[strings.SplitN(target, "/", 2)[0]] {
+				expected[target] = true
+			}
+		}
+		for _, pattern := range targetPatterns {
+			for _, target := range pattern.Targets(namespaces) {
+				expected[target] = true
+			}
+		}
+		delete(expected, key)
+		_, okFrom := objectMeta.Annotations[ReplicateFromAnnotation]
+		for target := range expected {
+			targetObject, targetMeta := get(target)
+			if targetMeta == nil {
+				issue(IssueMissing, key, target, "target does not exist")
+			} else if ok, err := r.isReplicatedBy(targetMeta, objectMeta); !ok {
+				issue(IssueDivergent, key, target, "%s", err)
+			} else if okFrom {
+				if update, err := r.needsFromAnnotationsUpdate(targetMeta, objectMeta); err != nil {
+					issue(IssueInvalid, key, target, "%s", err)
+				} else if update {
+					issue(IssueDivergent, key, target, "replicate-from annotations differ from source")
+				}
+			} else if ok, err := r.hasSourceData(targetObject, object); err != nil {
+				issue(IssueInvalid, key, target, "%s", err)
+			} else if !ok {
+				issue(IssueDivergent, key, target, "data differs from source")
+			}
+		}
+	}
+	report.Sources = len(sources)
+	sort.Slice(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		} else if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Kind < b.Kind
+	})
+	return report
+}
+
+// WriteConsistencyReports writes the reports, as "text" or "json"
+func WriteConsistencyReports(writer io.Writer, reports []ConsistencyReport, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	case "text":
+		for _, report := range reports {
+			if _, err := fmt.Fprintf(writer, "%s: %d sources, %d targets, %d issues\n",
+				report.Resource, report.Sources, report.Targets, len(report.Issues)); err != nil {
+				return err
+			}
+			for _, issue := range report.Issues {
+				if _, err := fmt.Fprintf(writer, "  %-9s %s -> %s: %s\n",
+					issue.Kind, issue.Source, issue.Target, issue.Message); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %s, expected text or json", format)
+	}
+}
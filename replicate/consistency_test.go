@@ -0,0 +1,61 @@
+package replicate
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation:        "target-ns/target,target-ns/missing,missing-ns/target",
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	r.ObjectAdded(updateObject(r, "target-ns", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	}))
+	// consistent after replication
+	r.objectStore.Delete(getObject(r, "target-ns", "missing"))
+	report := r.CheckConsistency()
+	assert.Equal(t, "test", report.Resource)
+	assert.Equal(t, 1, report.Sources)
+	assert.Equal(t, 2, report.Targets)
+	require.Len(t, report.Issues, 1)
+	assert.Equal(t, ConsistencyIssue{
+		Kind:    IssueMissing,
+		Source:  "source-ns/source",
+		Target:  "target-ns/missing",
+		Message: "target does not exist",
+	}, report.Issues[0])
+	// the data of the target was changed
+	target := getObject(r, "target-ns", "target")
+	target.Data = "changed"
+	// a target which lost its source
+	updateObject(r, "target-ns", "orphan", M{
+		ReplicatedByAnnotation: "source-ns/deleted",
+	})
+	actions := len(r.ReplicatorActions.(*testActions).Actions)
+	report = r.CheckConsistency()
+	assert.Len(t, r.ReplicatorActions.(*testActions).Actions, actions, "no action")
+	require.Len(t, report.Issues, 3)
+	assert.Equal(t, IssueMissing, report.Issues[0].Kind)
+	assert.Equal(t, IssueOrphaned, report.Issues[1].Kind)
+	assert.Equal(t, "target-ns/orphan", report.Issues[1].Target)
+	assert.Equal(t, IssueDivergent, report.Issues[2].Kind)
+	assert.Equal(t, "target-ns/target", report.Issues[2].Target)
+
+	buffer := &bytes.Buffer{}
+	require.NoError(t, WriteConsistencyReports(buffer, []ConsistencyReport{report}, "json"))
+	var decoded []ConsistencyReport
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &decoded))
+	assert.Equal(t, []ConsistencyReport{report}, decoded)
+	buffer.Reset()
+	require.NoError(t, WriteConsistencyReports(buffer, []ConsistencyReport{report}, "text"))
+	assert.Contains(t, buffer.String(), "test: 1 sources, 3 targets, 3 issues\n")
+	assert.Error(t, WriteConsistencyReports(buffer, nil, "xml"))
+}
@@ -0,0 +1,83 @@
+// Aggregation of the namespaces created at once
+
+package replicate
+
+import (
+	"sync"
+)
+
+// the queue item of the pending namespaces, handled by batches
+var namespacesItem = queueItem{namespace: true}
+
+// pendingNamespaces keeps the added namespaces until their batch is handled
+type pendingNamespaces struct {
+	mutex sync.Mutex
+	names []string
+	set   map[string]bool
+}
+
+func (p *pendingNamespaces) add(names ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, name := range names {
+		if !p.set[name] {
+			p.set[name] = true
+			p.names = append(p.names, name)
+		}
+	}
+}
+
+// Returns and forgets up to max pending namespaces, all of them if max is 0
+func (p *pendingNamespaces) take(max int) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	count := len(p.names)
+	if max > 0 && max < count {
+		count = max
+	}
+	names := p.names[:count:count]
+	p.names = p.names[count:]
+	for _, name := range names {
+		delete(p.set, name)
+	}
+	return names
+}
+
+func (p *pendingNamespaces) count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.names)
+}
+
+// Queues an added namespace into the next batch, handled once the debounce delay elapsed
+// The delay is not extended by the next namespaces, such that a storm is handled by regular batches
+func (r *ObjectReplicator) enqueuePendingNamespace(name string) {
+	r.pendingNamespaces.add(name)
+	r.parked.set(namespacesItem, false)
+	r.queue.AddAfter(namespacesItem, r.NamespaceDelay)
+}
+
+// Handles the next batch of the pending namespaces, the mutex must be held
+// The namespaces of a batch failed on a transient error are pending again, and retried with it
+func (r *ObjectReplicator) namespacesBatch() error {
+	var err error
+	names := []string{}
+	for _, name := range r.pendingNamespaces.take(r.NamespaceBatch) {
+		if _, exists, err := r.namespaceStore.GetByKey(name); err != nil {
+			r.logger.Error(err, "could not get namespace", "namespace", name)
+		} else if exists {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		r.logger.V(debugLevel).Info("handling a batch of namespaces", "namespaces", len(names))
+		err = r.namespacesAdded(names)
+	}
+	if err != nil && !isPermanent(err) {
+		r.pendingNamespaces.add(names...)
+	// the next batch, after the delay again
+	} else if r.pendingNamespaces.count() > 0 {
+		r.queue.AddAfter(namespacesItem, r.NamespaceDelay)
+	}
+	return err
+}
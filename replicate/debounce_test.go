@@ -0,0 +1,49 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingNamespaces(t *testing.T) {
+	pending := &pendingNamespaces{set: map[string]bool{}}
+	pending.add("a", "b", "a")
+	pending.add("c")
+	assert.Equal(t, 3, pending.count())
+	assert.Equal(t, []string{"a", "b"}, pending.take(2))
+	pending.add("a")
+	assert.Equal(t, []string{"c", "a"}, pending.take(0))
+	assert.Equal(t, 0, pending.count())
+}
+
+func TestNamespacesBatch(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{
+		NamespaceDelay: time.Millisecond,
+		NamespaceBatch: 2,
+	}, "source-ns")
+	r.initQueue()
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation: "target-[0-9]",
+	}))
+	requireActionsLength(t, r, 0)
+
+	for _, ns := range []string{"target-1", "target-2", "target-3", "target-1"} {
+		r.enqueueNamespace(addNamespace(r, ns))
+	}
+	// aggregated during the delay
+	assert.Equal(t, 0, r.queue.Len())
+	assert.Equal(t, 3, r.pendingNamespaces.count())
+
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, 1, r.pendingNamespaces.count())
+	// the next batch is handled after the delay again
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 3)
+	assert.Equal(t, 0, r.pendingNamespaces.count())
+	assert.ElementsMatch(t, []string{"target-1/source", "target-2/source", "target-3/source"},
+		r.targetsTo("source-ns/source").sorted())
+}
@@ -0,0 +1,73 @@
+// Deduplication of the writes to the targets
+
+package replicate
+
+import (
+	"sync"
+)
+
+// writtenRevision is the revision of a source written to a target,
+// along with the version of the target it overwrote
+type writtenRevision struct {
+	source    string
+	version   string
+	overwrote string
+}
+
+// writtenRevisions remembers which revision of its source was last written to each target
+// such that a target is written at most once per revision of its source,
+// even when the store still holds the version of the target it overwrote
+// It has its own mutex, since the targets are synced concurrently
+type writtenRevisions struct {
+	mutex     sync.Mutex
+	revisions map[string]writtenRevision
+}
+
+func newWrittenRevisions() *writtenRevisions {
+	return &writtenRevisions{revisions: map[string]writtenRevision{}}
+}
+
+// Records that the revision of the source was written over the version of the target
+func (w *writtenRevisions) set(target string, source string, version string, overwrote string) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.revisions[target] = writtenRevision{source, version, overwrote}
+}
+
+// Returns true if the revision of the source was already written over this version of the target
+func (w *writtenRevisions) written(target string, source string, version string, current string) bool {
+	if w == nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.revisions[target] == writtenRevision{source, version, current}
+}
+
+// Forgets a deleted target
+func (w *writtenRevisions) delete(target string) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.revisions, target)
+}
+
+// Appends the values missing from the slice, keeping the order
+func appendMissing(values []string, added ...string) []string {
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		seen[v] = true
+	}
+	for _, v := range added {
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,59 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrittenRevisions(t *testing.T) {
+	var nilRevisions *writtenRevisions
+	nilRevisions.set("target", "source", "1", "1")
+	assert.False(t, nilRevisions.written("target", "source", "1", "1"))
+
+	revisions := newWrittenRevisions()
+	revisions.set("target", "source", "2", "1")
+	assert.True(t, revisions.written("target", "source", "2", "1"))
+	assert.False(t, revisions.written("target", "source", "3", "1"))
+	assert.False(t, revisions.written("target", "source", "2", "3"))
+	assert.False(t, revisions.written("target", "other", "2", "1"))
+	revisions.delete("target")
+	assert.False(t, revisions.written("target", "source", "2", "1"))
+}
+
+func TestReplicateTo_outdatedStore(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	outdated := getObject(r, "target-ns", "target")
+
+	source = updateObject(r, "source-ns", "source", nil)
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	// the store receives an old event of the target, this revision is not written again
+	require.NoError(t, r.objectStore.Update(outdated))
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	// a new revision is written
+	source = updateObject(r, "source-ns", "source", nil)
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 3)
+}
+
+func TestNamespaceAdded_twice(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns")
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	}))
+	requireActionsLength(t, r, 0)
+
+	namespace := addNamespace(r, "target-ns")
+	r.NamespaceAdded(namespace)
+	r.NamespaceAdded(namespace)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, []string{"target-ns/target"}, r.targetsTo("source-ns/source").sorted())
+}
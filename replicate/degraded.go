@@ -0,0 +1,36 @@
+// Suspension of the deletions while the informers are degraded
+
+package replicate
+
+import (
+	"time"
+)
+
+// how long a suspended deletion waits before being decided again
+const suspendedDeleteDelay = 30 * time.Second
+
+// Returns an error if an informer is degraded, then its store may be outdated
+func (r *ObjectReplicator) degraded() error {
+	if r.DegradedAfter <= 0 {
+		return nil
+	}
+	if err := r.namespaceActivity.degraded(r.DegradedAfter); err != nil {
+		return err
+	}
+	return r.objectActivity.degraded(r.DegradedAfter)
+}
+
+// Returns true if the deletion of the target is suspended, because an informer is degraded
+// Then the target is handled again later, the installations and updates are not suspended
+func (r *ObjectReplicator) deleteSuspended(key string) bool {
+	err := r.degraded()
+	if err == nil {
+		return false
+	}
+	r.logger.Info("deletion is suspended", "target", key, "reason", err.Error(), "delay", suspendedDeleteDelay.String())
+	r.metrics.deletesSuspended.WithLabelValues(r.Name).Inc()
+	if r.queue != nil {
+		r.queue.AddAfter(queueItem{key: key}, suspendedDeleteDelay)
+	}
+	return true
+}
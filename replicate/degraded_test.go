@@ -0,0 +1,59 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInformerActivity_degraded(t *testing.T) {
+	var nilActivity *informerActivity
+	assert.NoError(t, nilActivity.degraded(time.Minute))
+
+	now := time.Now()
+	activity := newInformerActivity("secrets", newReplicatorMetrics(), logr.Discard())
+	activity.now = func() time.Time { return now }
+	activity.running = true
+	activity.last = now
+	assert.NoError(t, activity.degraded(time.Minute))
+	activity.failures = watchFailuresThreshold
+	assert.Error(t, activity.degraded(time.Minute), "failing")
+	activity.failures = 0
+	now = now.Add(2 * time.Minute)
+	assert.Error(t, activity.degraded(time.Minute), "silent")
+}
+
+func TestDeleteSuspended(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{DegradedAfter: time.Minute}, "source-ns", "target-ns")
+	r.initQueue()
+	r.objectActivity = newInformerActivity("test", newReplicatorMetrics(), logr.Discard())
+	r.objectActivity.running = true
+	r.objectActivity.last = time.Now()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+
+	// suspended while failing, the installations go on
+	r.objectActivity.failures = watchFailuresThreshold
+	r.ObjectDeleted(deleteObject(r, "source-ns", "source"))
+	requireActionsLength(t, r, 1)
+	assertStore(t, r, "target-ns", "target", "1")
+	other := updateObject(r, "source-ns", "other", M{
+		ReplicateToAnnotation: "target-ns/other",
+	})
+	r.ObjectAdded(other)
+	requireActionsLength(t, r, 2)
+
+	// deleted once recovered
+	r.objectActivity.failures = 0
+	target, _, err := r.requireFromStore("target-ns/target")
+	require.NoError(t, err)
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 3)
+	assertStore(t, r, "target-ns", "target", "")
+}
@@ -0,0 +1,128 @@
+// Differential resyncs, skipping the objects unchanged since they were last handled
+
+package replicate
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// handledStates keeps the state hash of the objects when they were last handled successfully
+// It has its own lock, such that it can be read by the event handlers
+type handledStates struct {
+	mutex  sync.Mutex
+	states map[string]uint64
+}
+
+// Returns the states, nil if the resyncs are not differential
+func newHandledStates(enabled bool) *handledStates {
+	if !enabled {
+		return nil
+	}
+	return &handledStates{states: map[string]uint64{}}
+}
+
+// Records the state of a handled object
+func (s *handledStates) set(key string, state uint64) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.states[key] = state
+}
+
+// Returns true if the object was last handled successfully with this state
+func (s *handledStates) unchanged(key string, state uint64) bool {
+	if s == nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	last, ok := s.states[key]
+	return ok && last == state
+}
+
+// Forgets an object, such that it is handled on the next resync
+func (s *handledStates) delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.states, key)
+}
+
+// Returns the hash of the versions of the object, of its targets and of its sources
+// It changes as soon as the handling of the object may have a different result
+// The mutex must be held, see receivedStateHash
+func (r *ObjectReplicator) stateHash(object interface{}) uint64 {
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	related := newKeySet()
+	for target := range r.targetsTo(key) {
+		related.add(target)
+	}
+	for target := range r.targetsFrom(key) {
+		related.add(target)
+	}
+	if source, ok := meta.Annotations[ReplicatedByAnnotation]; ok {
+		related.add(source)
+	}
+	if source, ok := resolveAnnotation(meta, ReplicateFromAnnotation); ok {
+		related.add(source)
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(meta.ResourceVersion))
+	for _, relatedKey := range related.sorted() {
+		version := ""
+		if _, relatedMeta, exists, err := r.getFromStore(relatedKey); err == nil && exists {
+			version = relatedMeta.ResourceVersion
+		}
+		hash.Write([]byte{0})
+		hash.Write([]byte(relatedKey))
+		hash.Write([]byte{0})
+		hash.Write([]byte(version))
+	}
+	return hash.Sum64()
+}
+
+// Returns the state hash of an object received by an informer, whose handlers run without the mutex
+func (r *ObjectReplicator) receivedStateHash(object interface{}) uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.stateHash(object)
+}
+
+// Records the result of the handling of an object,
+// such that the next resync skips it when unchanged
+func (r *ObjectReplicator) recordHandled(object interface{}, failed bool) {
+	if r.handledStates == nil {
+		return
+	}
+	key := metaKey(r.GetMeta(object))
+	// the remote targets and sources, and the external secrets, are not watched, so they are read at each resync
+	annotations := r.GetMeta(object).Annotations
+	_, pushed := annotations[ReplicateToClustersAnnotation]
+	_, external := annotations[ReplicateFromExternalAnnotation]
+	if _, pulled := annotations[ReplicateFromClusterAnnotation]; failed || pushed || pulled || external {
+		r.handledStates.delete(key)
+	} else {
+		r.handledStates.set(key, r.stateHash(object))
+	}
+}
+
+// Queues an updated object, unless it is resynced while unchanged since last handled
+// A skipped source is still in sync, which keeps its staleness low
+func (r *ObjectReplicator) enqueueUpdatedObject(old interface{}, new interface{}) {
+	key := metaKey(r.GetMeta(new))
+	if r.handledStates != nil && r.GetMeta(old).ResourceVersion == r.GetMeta(new).ResourceVersion &&
+		r.handledStates.unchanged(key, r.receivedStateHash(new)) {
+		r.metrics.resyncsSkipped.WithLabelValues(r.Name).Inc()
+		if _, ok := r.lastSyncs.Get(key); ok {
+			r.lastSyncs.Set(key, r.now())
+		}
+		return
+	}
+	r.enqueueObject(new)
+}
@@ -0,0 +1,52 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandledStates(t *testing.T) {
+	var nilStates *handledStates
+	nilStates.set("object", 1)
+	assert.False(t, nilStates.unchanged("object", 1))
+	assert.Nil(t, newHandledStates(false))
+
+	states := newHandledStates(true)
+	assert.False(t, states.unchanged("object", 1))
+	states.set("object", 1)
+	assert.True(t, states.unchanged("object", 1))
+	assert.False(t, states.unchanged("object", 2))
+	states.delete("object")
+	assert.False(t, states.unchanged("object", 1))
+}
+
+func TestQueue_differentialResync(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{SkipUnchanged: true}, "source-ns", "target-ns")
+	r.initQueue()
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 1)
+
+	// resynced while unchanged, skipped
+	r.enqueueUpdatedObject(source, source)
+	assert.Equal(t, 0, r.queue.Len())
+
+	// its target changed, handled again
+	updateObject(r, "target-ns", "target", nil)
+	r.enqueueUpdatedObject(source, source)
+	require.Equal(t, 1, r.queue.Len())
+	require.True(t, r.processNextItem())
+
+	// failed, handled again on the next resync
+	source = updateObject(r, "source-ns", "source", nil)
+	actions.Conflicts = map[string]int{"target-ns/target": maxConflictRetries + 1}
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	assert.False(t, r.handledStates.unchanged("source-ns/source", r.stateHash(source)))
+}
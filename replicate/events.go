@@ -0,0 +1,96 @@
+// Kubernetes events emitted on sources and targets
+
+package replicate
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventComponent is the component reported in the emitted events
+const EventComponent = "k8s-replicator"
+
+// Reasons of the events emitted on sources and targets
+const (
+	// ReasonInstalled is emitted when a target is created or updated from its source
+	ReasonInstalled = "Installed"
+	// ReasonUpdated is emitted when a target receives the data of its source
+	ReasonUpdated = "Updated"
+	// ReasonCleared is emitted when the data of a target is cleared
+	ReasonCleared = "Cleared"
+	// ReasonDeleted is emitted when a target is deleted
+	ReasonDeleted = "Deleted"
+	// ReasonFailed is emitted when a call to kubernetes failed
+	ReasonFailed = "ReplicationFailed"
+	// ReasonNotAllowed is emitted when a source does not allow replication
+	ReasonNotAllowed = "ReplicationNotAllowed"
+	// ReasonCancelled is emitted when a target already exists, but was not replicated from the source,
+	// or when a target is managed by another controller
+	ReasonCancelled = "ReplicationCancelled"
+	// ReasonInvalid is emitted when the annotations of an object could not be parsed
+	ReasonInvalid = "InvalidAnnotations"
+	// ReasonRetriesExhausted is emitted when an object still fails after all its retries
+	ReasonRetriesExhausted = "RetriesExhausted"
+	// ReasonDisowned is emitted when an orphaned target is not replicated anymore
+	ReasonDisowned = "Disowned"
+	// ReasonNamespaceCreated is emitted when the missing namespace of a target is created
+	ReasonNamespaceCreated = "NamespaceCreated"
+	// ReasonCanary is emitted when a changed source is replicated to its canary targets first
+	ReasonCanary = "CanaryRollout"
+	// ReasonApprovalRequired is emitted when a change of a source is held back until approved
+	ReasonApprovalRequired = "ApprovalRequired"
+	// ReasonApproved is emitted when a change held back is approved
+	ReasonApproved = "Approved"
+)
+
+// Creates an event recorder sending the events to kubernetes
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{
+		Component: EventComponent,
+	})
+}
+
+// Emits an event on the object, if it is a kubernetes object and there is an event recorder
+func (r *ObjectReplicator) event(object interface{}, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if object == nil || r.recorder == nil {
+		return
+	}
+	if o, ok := object.(runtime.Object); ok {
+		r.recorder.Eventf(o, eventType, reason, messageFmt, args...)
+	}
+}
+
+// Emits a warning event on the object, and records the failure
+// An action warning both its target and its source records its failure only once
+func (r *ObjectReplicator) warning(object interface{}, reason string, messageFmt string, args ...interface{}) {
+	r.failure(object, reason, messageFmt, args...)
+	r.event(object, v1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+// Records the failure of an action on the object as last error, and sends it to the notifier, if any
+func (r *ObjectReplicator) failure(object interface{}, reason string, messageFmt string, args ...interface{}) {
+	if object == nil {
+		return
+	}
+	key := metaKey(r.GetMeta(object))
+	message := fmt.Sprintf(messageFmt, args...)
+	r.stats.failed(fmt.Sprintf("%s %s: %s", key, reason, message))
+	if r.Notifier != nil {
+		r.Notifier.Notify(Notification{
+			Resource: r.Name,
+			Object:   key,
+			Reason:   reason,
+			Message:  message,
+		})
+	}
+}
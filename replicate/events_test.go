@@ -0,0 +1,82 @@
+package replicate
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// so that events can be emitted on test objects
+func (o *testObject) GetObjectKind() schema.ObjectKind {
+	return schema.EmptyObjectKind
+}
+
+func (o *testObject) DeepCopyObject() runtime.Object {
+	return &testObject{
+		Type: o.Type,
+		Data: o.Data,
+		Meta: *o.Meta.DeepCopy(),
+	}
+}
+
+func assertEvents(t *testing.T, recorder *record.FakeRecorder, events ...string) {
+	actual := []string{}
+	for len(recorder.Events) > 0 {
+		actual = append(actual, <-recorder.Events)
+	}
+	assert.Equal(t, events, actual, "events")
+}
+
+func TestEvents(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	recorder := record.NewFakeRecorder(100)
+	r.recorder = recorder
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	assertEvents(t, recorder,
+		"Normal Installed installed from source-ns/source",
+		"Normal Installed installed target-ns/target",
+	)
+
+	other := updateObject(r, "target-ns", "other", M{})
+	r.ObjectAdded(other)
+	invalid := updateObject(r, "source-ns", "invalid", M{
+		ReplicateToAnnotation: "target-ns/other",
+	})
+	r.ObjectAdded(invalid)
+	assertEvents(t, recorder,
+		"Warning ReplicationCancelled target target-ns/other was not replicated",
+	)
+
+	invalid = updateObject(r, "source-ns", "invalid", M{
+		ReplicateToNsAnnotation: "target-ns/other",
+	})
+	r.ObjectAdded(invalid)
+	assertEvents(t, recorder,
+		"Warning InvalidAnnotations source source-ns/invalid has invalid namespace pattern on annotation " +
+			ReplicateToNsAnnotation + " \"target-ns/other\"",
+	)
+
+	from := updateObject(r, "target-ns", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(from)
+	assertEvents(t, recorder,
+		"Warning ReplicationNotAllowed source source-ns/source does not explicitely allow replication",
+		"Warning ReplicationNotAllowed replication to target-ns/from: source source-ns/source does not explicitely allow replication",
+	)
+
+	source = deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(source)
+	assertEvents(t, recorder,
+		"Normal Deleted deleted",
+		"Normal Deleted deleted target-ns/target",
+	)
+}
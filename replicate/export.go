@@ -0,0 +1,239 @@
+// Export of the sources to external stores, out of the cluster
+
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExportedSource is a source exported to an external store
+type ExportedSource struct {
+	Resource        string            `json:"resource"`
+	Namespace       string            `json:"namespace"`
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion"`
+	ExportedAt      time.Time         `json:"exportedAt"`
+	Data            map[string][]byte `json:"data"`
+}
+
+// ExternalExporter writes the sources to an external store
+type ExternalExporter interface {
+	// Export writes the source at the path, replacing the previous export
+	// It is called without the mutex of the replicator, with the context of the request
+	Export(ctx context.Context, path string, source *ExportedSource) error
+}
+
+// the constructors of the exporters, by name
+var externalExporters = map[string]func(options ExternalOptions) (ExternalExporter, error){
+	"vault": func(options ExternalOptions) (ExternalExporter, error) {
+		return NewVaultExporter(options.VaultAddress, options.VaultRole)
+	},
+	"s3": func(options ExternalOptions) (ExternalExporter, error) {
+		return NewS3Exporter(options.AWSRegion)
+	},
+	"http": func(options ExternalOptions) (ExternalExporter, error) {
+		return NewHTTPExporter(options.ExportURL)
+	},
+}
+
+// RegisterExternalExporter registers the constructor of an exporter, by name, for NewExternalExporters
+func RegisterExternalExporter(name string, newExporter func(options ExternalOptions) (ExternalExporter, error)) {
+	externalExporters[name] = newExporter
+}
+
+// NewExternalExporters returns the exporters of the given names
+func NewExternalExporters(names []string, options ExternalOptions) (map[string]ExternalExporter, error) {
+	exporters := map[string]ExternalExporter{}
+	for _, name := range names {
+		newExporter, ok := externalExporters[name]
+		if !ok {
+			available := make([]string, 0, len(externalExporters))
+			for name := range externalExporters {
+				available = append(available, name)
+			}
+			sort.Strings(available)
+			return nil, fmt.Errorf("unknown exporter \"%s\", expected one of %s", name, strings.Join(available, ", "))
+		}
+		exporter, err := newExporter(options)
+		if err != nil {
+			return nil, fmt.Errorf("exporter %s: %s", name, err)
+		}
+		exporters[name] = exporter
+	}
+	return exporters, nil
+}
+
+// Records an export of a source to an external store
+func (r *ReplicatorProps) observeExport(exporter string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	r.metrics.externalExports.WithLabelValues(exporter, result).Inc()
+}
+
+// Returns the destinations of the export-to annotation, a comma separated list of "<exporter>:<path>"
+func exportDestinations(meta *metav1.ObjectMeta) ([]string, error) {
+	annotation, ok := meta.Annotations[ExportToAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	destinations := []string{}
+	for _, destination := range strings.Split(annotation, ",") {
+		if destination = strings.TrimSpace(destination); destination == "" {
+		} else if split := strings.SplitN(destination, ":", 2); len(split) != 2 || split[0] == "" || split[1] == "" {
+			return nil, fmt.Errorf("source %s has invalid destination on annotation %s \"%s\": expected exporter:path",
+				metaKey(meta), ExportToAnnotation, destination)
+		} else {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations, nil
+}
+
+// Returns the data of a secret or configMap, as bytes
+func objectData(object interface{}) map[string][]byte {
+	switch object := object.(type) {
+	case *v1.Secret:
+		return object.Data
+	case *v1.ConfigMap:
+		data := make(map[string][]byte, len(object.Data)+len(object.BinaryData))
+		for key, value := range object.Data {
+			data[key] = []byte(value)
+		}
+		for key, value := range object.BinaryData {
+			data[key] = value
+		}
+		return data
+	default:
+		return nil
+	}
+}
+
+// Exports the source to the destinations of its export-to annotation, when its data changed since last exported
+// The exports are made in the background, without the mutex, and the source is handled again with their results
+// The exports are never deleted, since they are snapshots for disaster recovery, the mutex must be held
+func (r *ObjectReplicator) exportToStores(result *syncResult, object interface{}) {
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	if !r.ownsSource(key) {
+		return
+	}
+	destinations, err := exportDestinations(meta)
+	if err != nil {
+		r.logger.Error(err, "could not parse", "object", key)
+		r.warning(object, ReasonInvalid, "%s", err)
+		result.add(permanent(err))
+		return
+	}
+	// the change of the source is held back, exported once released
+	if len(destinations) > 0 && r.heldBack(object, "") {
+		return
+	}
+	checksum := r.DataChecksum(object)
+	exported := map[string]string{}
+	for _, destination := range destinations {
+		split := strings.SplitN(destination, ":", 2)
+		name, path := split[0], split[1]
+		if r.exported[key][destination] == checksum {
+			exported[destination] = checksum
+			continue
+		}
+		exporter, ok := r.Exporters[name]
+		if !ok {
+			err := fmt.Errorf("source %s is exported to unknown exporter %s", key, name)
+			r.logger.Error(err, "export is cancelled", "source", key, "exporter", name)
+			result.add(permanent(err))
+			continue
+		}
+		source := &ExportedSource{
+			Resource:        r.Name,
+			Namespace:       meta.Namespace,
+			Name:            meta.Name,
+			ResourceVersion: meta.ResourceVersion,
+			ExportedAt:      time.Now().UTC(),
+			Data:            objectData(object),
+		}
+		call := r.externalCalls.take(key+" "+destination, checksum, func() (*ExternalSecret, error) {
+			ctx, cancel := r.requestContext(r.ctx)
+			defer cancel()
+			return nil, exporter.Export(ctx, path, source)
+		}, func() {
+			if r.queue != nil {
+				r.queue.Add(queueItem{key: key})
+			}
+		})
+		// handled again once exported, until then the previous export is kept
+		if call == nil {
+			r.logger.Info("exporting source", "source", key, "exporter", name, "path", path, "action", "export")
+			if previous, ok := r.exported[key][destination]; ok {
+				exported[destination] = previous
+			}
+			continue
+		}
+		err := call.err
+		r.observeExport(name, err)
+		r.audit("export", key, destination, nil, err)
+		if err != nil {
+			r.logger.Error(err, "could not export source", "source", key, "exporter", name, "path", path)
+			r.warning(object, ReasonFailed, "could not export to %s: %s", destination, err)
+			result.add(err)
+			continue
+		}
+		exported[destination] = checksum
+	}
+	if len(exported) > 0 {
+		r.exported[key] = exported
+	} else {
+		delete(r.exported, key)
+	}
+}
+
+// HTTPExporter puts the sources as JSON documents under a base URL
+type HTTPExporter struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPExporter returns the exporter to the base URL, the paths are appended to it
+func NewHTTPExporter(url string) (*HTTPExporter, error) {
+	if url == "" {
+		return nil, fmt.Errorf("export URL is required")
+	}
+	return &HTTPExporter{
+		url:    strings.TrimSuffix(url, "/") + "/",
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Export puts the source at the path under the base URL
+func (e *HTTPExporter) Export(ctx context.Context, path string, source *ExportedSource) error {
+	body, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, e.url+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("PUT %s failed with status %d", req.URL.Path, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testExporter records the exports in memory, failing while err is set
+type testExporter struct {
+	mutex   sync.Mutex
+	exports map[string]*ExportedSource
+	count   int
+	err     error
+}
+
+func (e *testExporter) Export(ctx context.Context, path string, source *ExportedSource) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.count++
+	if e.err != nil {
+		return e.err
+	}
+	e.exports[path] = source
+	return nil
+}
+
+// Waits for the calls to the external stores, then handles the object again with their results
+func handleExternalCalls(t *testing.T, r *ObjectReplicator, object interface{}) {
+	waitExternalCalls(t, r)
+	r.ObjectAdded(object)
+}
+
+// Waits for the calls to the external stores running in the background
+func waitExternalCalls(t *testing.T, r *ObjectReplicator) {
+	require.Eventually(t, func() bool {
+		r.externalCalls.mutex.Lock()
+		defer r.externalCalls.mutex.Unlock()
+		for _, call := range r.externalCalls.calls {
+			if !call.done {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestExportToStores(t *testing.T) {
+	exporter := &testExporter{exports: map[string]*ExportedSource{}}
+	r := newTestSecretReplicator(t, fake.NewSimpleClientset(), WithOptions(ReplicatorOptions{
+		Exporters: map[string]ExternalExporter{"vault": exporter},
+	}), WithResyncPeriod(time.Hour))
+	source := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations: M{
+				ExportToAnnotation: "vault:secret/data/dr/source",
+			},
+		},
+		Data: map[string][]byte{"password": []byte("secret")},
+	}
+	require.NoError(t, r.objectStore.Add(source))
+	r.ObjectAdded(source)
+	assert.Empty(t, r.exported, "exported in the background")
+	handleExternalCalls(t, r, source)
+	export := exporter.exports["secret/data/dr/source"]
+	require.NotNil(t, export)
+	assert.Equal(t, "secret", export.Resource)
+	assert.Equal(t, "source-ns", export.Namespace)
+	assert.Equal(t, []byte("secret"), export.Data["password"])
+
+	// not exported again while the data is unchanged
+	source = source.DeepCopy()
+	source.ResourceVersion = "2"
+	require.NoError(t, r.objectStore.Update(source))
+	r.ObjectAdded(source)
+	assert.Equal(t, 1, exporter.count)
+
+	// retried until it succeeds
+	exporter.err = fmt.Errorf("unavailable")
+	source = source.DeepCopy()
+	source.ResourceVersion = "3"
+	source.Data["password"] = []byte("rotated")
+	require.NoError(t, r.objectStore.Update(source))
+	r.ObjectAdded(source)
+	handleExternalCalls(t, r, source)
+	assert.Equal(t, 2, exporter.count)
+	assert.Equal(t, []byte("secret"), exporter.exports["secret/data/dr/source"].Data["password"])
+	exporter.err = nil
+	r.ObjectAdded(source)
+	handleExternalCalls(t, r, source)
+	assert.Equal(t, 3, exporter.count)
+	assert.Equal(t, []byte("rotated"), exporter.exports["secret/data/dr/source"].Data["password"])
+
+	require.NoError(t, r.objectStore.Delete(source))
+	r.ObjectDeleted(source)
+	assert.Empty(t, r.exported)
+	assert.Contains(t, exporter.exports, "secret/data/dr/source", "the exports are never deleted")
+}
+
+func TestExportDestinations(t *testing.T) {
+	destinations, err := exportDestinations(&metav1.ObjectMeta{Annotations: M{
+		ExportToAnnotation: "vault:secret/data/a, s3:bucket/key,",
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vault:secret/data/a", "s3:bucket/key"}, destinations)
+
+	_, err = exportDestinations(&metav1.ObjectMeta{Annotations: M{ExportToAnnotation: "secret/data/a"}})
+	assert.Error(t, err)
+}
+
+func TestHTTPExporter(t *testing.T) {
+	var received ExportedSource
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPut, req.Method)
+		if req.URL.Path != "/backups/prod/database" {
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&received))
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	exporter, err := NewHTTPExporter(server.URL + "/backups/")
+	require.NoError(t, err)
+
+	require.NoError(t, exporter.Export(context.TODO(), "prod/database", &ExportedSource{
+		Name: "database",
+		Data: map[string][]byte{"password": []byte("secret")},
+	}))
+	assert.Equal(t, []byte("secret"), received.Data["password"])
+	assert.Error(t, exporter.Export(context.TODO(), "other", &ExportedSource{}))
+
+	_, err = NewHTTPExporter("")
+	assert.Error(t, err)
+}
@@ -0,0 +1,336 @@
+// Pull of the sources from their secrets in external stores
+
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExternalSecret is a secret read from an external store
+type ExternalSecret struct {
+	Data    map[string][]byte
+	// the version of the secret in the store, recorded in the replicate-once-version annotation
+	Version string
+}
+
+// ExternalProvider reads the secrets of an external store
+type ExternalProvider interface {
+	// Get returns the named secret
+	// It is called without the mutex of the replicator, with the context of the request
+	Get(ctx context.Context, name string) (*ExternalSecret, error)
+}
+
+// ExternalOptions configures the providers of the external stores
+type ExternalOptions struct {
+	// the region of the AWS services
+	AWSRegion    string
+	// the project of the GCP secrets not named with their project
+	GCPProject   string
+	// the address of Vault, and the role to log in with the kubernetes auth method, empty to use VAULT_TOKEN
+	VaultAddress string
+	VaultRole    string
+	// the base URL of the HTTP exports
+	ExportURL    string
+}
+
+// the constructors of the providers, by name
+var externalProviders = map[string]func(options ExternalOptions) (ExternalProvider, error){
+	"aws-secretsmanager": func(options ExternalOptions) (ExternalProvider, error) {
+		return NewAWSProvider(awsSecretsManager, options.AWSRegion)
+	},
+	"aws-ssm": func(options ExternalOptions) (ExternalProvider, error) {
+		return NewAWSProvider(awsSSM, options.AWSRegion)
+	},
+	"gcp-secretmanager": func(options ExternalOptions) (ExternalProvider, error) {
+		return NewGCPProvider(options.GCPProject), nil
+	},
+	"azure-keyvault": func(options ExternalOptions) (ExternalProvider, error) {
+		return NewAzureProvider(), nil
+	},
+}
+
+// RegisterExternalProvider registers the constructor of a provider, by name, for NewExternalProviders
+func RegisterExternalProvider(name string, newProvider func(options ExternalOptions) (ExternalProvider, error)) {
+	externalProviders[name] = newProvider
+}
+
+// NewExternalProviders returns the providers of the given names
+func NewExternalProviders(names []string, options ExternalOptions) (map[string]ExternalProvider, error) {
+	providers := map[string]ExternalProvider{}
+	for _, name := range names {
+		newProvider, ok := externalProviders[name]
+		if !ok {
+			available := make([]string, 0, len(externalProviders))
+			for name := range externalProviders {
+				available = append(available, name)
+			}
+			sort.Strings(available)
+			return nil, fmt.Errorf("unknown provider \"%s\", expected one of %s", name, strings.Join(available, ", "))
+		}
+		provider, err := newProvider(options)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %s", name, err)
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// ParseExternalNamespaces parses the comma separated names or patterns of the namespaces
+// whose sources may be pulled from the external stores
+func ParseExternalNamespaces(value string) ([]*regexp.Regexp, error) {
+	return ParseNamespacePatterns(value)
+}
+
+// externalCall is a call to an external store, made without the mutex of the replicator
+type externalCall struct {
+	// what it was called for: the annotation of a pull, or the checksum of an export
+	version string
+	done    bool
+	secret  *ExternalSecret
+	err     error
+}
+
+// externalCalls keeps the calls to the external stores, by source, or by source and destination for the exports,
+// from their start until their result is handled
+type externalCalls struct {
+	mutex sync.Mutex
+	calls map[string]*externalCall
+}
+
+// Returns the result of the call of the version, once done, and forgets it
+// Else starts the call in the background, unless it is running, and calls done once it returns
+func (c *externalCalls) take(key string, version string, call func() (*ExternalSecret, error), done func()) *externalCall {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if current, ok := c.calls[key]; ok && current.version == version {
+		if !current.done {
+			return nil
+		}
+		delete(c.calls, key)
+		return current
+	}
+	started := &externalCall{version: version}
+	c.calls[key] = started
+	go func() {
+		secret, err := call()
+		c.mutex.Lock()
+		started.done = true
+		started.secret = secret
+		started.err = err
+		c.mutex.Unlock()
+		done()
+	}()
+	return nil
+}
+
+// Forgets the calls of the source, deleted, their results are ignored
+func (c *externalCalls) forget(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for call := range c.calls {
+		if call == key || strings.HasPrefix(call, key+" ") {
+			delete(c.calls, call)
+		}
+	}
+}
+
+// Records a read of a secret of an external store
+func (r *ReplicatorProps) observeExternalFetch(provider string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	r.metrics.externalFetches.WithLabelValues(provider, result).Inc()
+}
+
+// Returns the provider and the name of the replicate-from-external annotation, "<provider>:<name>"
+func externalSource(meta *metav1.ObjectMeta) (string, string, error) {
+	annotation := meta.Annotations[ReplicateFromExternalAnnotation]
+	split := strings.SplitN(annotation, ":", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return "", "", fmt.Errorf("source %s has invalid annotation %s \"%s\": expected provider:name",
+			metaKey(meta), ReplicateFromExternalAnnotation, annotation)
+	}
+	return split[0], split[1], nil
+}
+
+// Returns a copy of the object holding the data, to update it with
+func externalObject(object interface{}, data map[string][]byte) (interface{}, error) {
+	switch object := object.(type) {
+	case *v1.Secret:
+		copy := object.DeepCopy()
+		copy.Data = data
+		return copy, nil
+	case *v1.ConfigMap:
+		copy := object.DeepCopy()
+		copy.Data = make(map[string]string, len(data))
+		for key, value := range data {
+			copy.Data[key] = string(value)
+		}
+		return copy, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", object)
+	}
+}
+
+// Returns true if the sources of the namespace may be pulled from the external stores
+func (r *ReplicatorProps) externalAllowed(namespace string) bool {
+	for _, pattern := range r.ExternalAllowed {
+		if pattern.MatchString(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replicates a source from its secret in an external store, with the replicate-from-external annotation
+// The secret is read at each resync, and every external interval, since it is not watched
+// It is read in the background, without the mutex, and the source is handled again with it once read
+// Its version is written to the replicate-once-version annotation, such that the replicate-once targets are replicated again
+// Only the sources of the allowed namespaces are pulled, such that any namespace cannot read any secret of the stores
+func (r *ObjectReplicator) pullFromExternal(object interface{}) error {
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	name, secretName, err := externalSource(meta)
+	if err != nil {
+		r.logger.Error(err, "could not parse", "object", key)
+		r.warning(object, ReasonInvalid, "%s", err)
+		return permanent(err)
+	}
+	if !r.ownsSource(key) {
+		return nil
+	}
+	if !r.externalAllowed(meta.Namespace) {
+		err := fmt.Errorf("source %s is not in a namespace allowed to pull from the external stores", key)
+		r.logger.Error(err, "replication is cancelled", "source", key, "provider", name)
+		r.warning(object, ReasonInvalid, "%s", err)
+		return permanent(err)
+	}
+	provider, ok := r.ExternalSources[name]
+	if !ok {
+		err := fmt.Errorf("source %s is replicated from unknown provider %s", key, name)
+		r.logger.Error(err, "replication is cancelled", "source", key, "provider", name)
+		r.warning(object, ReasonInvalid, "%s", err)
+		return permanent(err)
+	}
+	call := r.externalCalls.take(key, meta.Annotations[ReplicateFromExternalAnnotation], func() (*ExternalSecret, error) {
+		ctx, cancel := r.requestContext(r.ctx)
+		defer cancel()
+		secret, err := provider.Get(ctx, secretName)
+		r.observeExternalFetch(name, err)
+		return secret, err
+	}, func() {
+		if r.queue != nil {
+			r.queue.Add(queueItem{key: key})
+		}
+	})
+	// handled again once read
+	if call == nil {
+		return nil
+	}
+	if r.queue != nil {
+		r.queue.AddAfter(queueItem{key: key}, r.ExternalInterval)
+	}
+	secret, err := call.secret, call.err
+	if err != nil {
+		r.logger.Error(err, "could not get external secret", "provider", name, "secret", secretName)
+		r.warning(object, ReasonFailed, "could not read %s:%s: %s", name, secretName, err)
+		return err
+	}
+	sourceObject, err := externalObject(object, secret.Data)
+	if err != nil {
+		return err
+	}
+	if err := r.checkManagedBy(meta); err != nil {
+		r.logger.Info("replication is cancelled", "provider", name, "secret", secretName, "source", key, "reason", err)
+		return permanent(err)
+	}
+	if meta.Annotations[ReplicateOnceVersionAnnotation] == secret.Version &&
+		r.DataChecksum(object) == r.DataChecksum(sourceObject) {
+		return nil
+	}
+	if r.updateHeldBack("pull", key, key) {
+		return nil
+	}
+	annotations := cloneSMap(meta.Annotations)
+	annotations[ReplicatedAtAnnotation] = r.now().Format(time.RFC3339)
+	annotations[ReplicateOnceVersionAnnotation] = secret.Version
+	r.setManagedBy(annotations)
+	r.logger.Info("pulling external secret", "provider", name, "secret", secretName, "source", key, "version", secret.Version, "action", "update")
+	start := time.Now()
+	ctx, cancel := r.requestContext(r.ctx)
+	newObject, err := r.Update(ctx, r.client, object, sourceObject, annotations)
+	cancel()
+	r.observeAction("update", start, err)
+	if err == nil {
+		r.observeWritten(newObject)
+	}
+	r.audit("update", fmt.Sprintf("%s:%s", name, secretName), key, newObject, err)
+	r.stats.actionDone(err)
+	if err != nil {
+		r.warning(object, ReasonFailed, "could not replicate from %s:%s: %s", name, secretName, err)
+		return err
+	}
+	r.event(newObject, v1.EventTypeNormal, ReasonUpdated, "updated from %s:%s", name, secretName)
+	// update the object store in advance
+	return r.objectStore.Update(newObject)
+}
+
+// bearerToken is an OAuth2 access token of a cloud, fetched again when it is about to expire
+type bearerToken struct {
+	mutex      sync.Mutex
+	token      string
+	expiration time.Time
+	// fetches a new token, and how long it is valid
+	fetch      func() (string, time.Duration, error)
+}
+
+// how long before their expiration the tokens are fetched again
+const bearerTokenRenewal = 5 * time.Minute
+
+// Returns the token, fetched again when it is about to expire
+func (t *bearerToken) get() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.token != "" && time.Until(t.expiration) > bearerTokenRenewal {
+		return t.token, nil
+	}
+	token, validity, err := t.fetch()
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	t.expiration = time.Now().Add(validity)
+	return token, nil
+}
+
+// Sends the request, and decodes its JSON response into the output
+// The body of the errors is included in them, as the clouds describe the errors there
+func doExternalRequest(client *http.Client, req *http.Request, output interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s failed with status %d: %s", req.Method, req.URL.Path, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, output)
+}
@@ -0,0 +1,152 @@
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testExternalProvider holds the external secrets in memory
+type testExternalProvider map[string]*ExternalSecret
+
+func (p testExternalProvider) Get(ctx context.Context, name string) (*ExternalSecret, error) {
+	if secret, ok := p[name]; ok {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("secret %s not found", name)
+}
+
+func TestPullFromExternal(t *testing.T) {
+	provider := testExternalProvider{"prod/database": {
+		Data:    map[string][]byte{"password": []byte("secret")},
+		Version: "v1",
+	}}
+	source := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+			Annotations: M{
+				ReplicateFromExternalAnnotation: "aws-secretsmanager:prod/database",
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(source)
+	allowed, err := ParseExternalNamespaces("source-.*")
+	require.NoError(t, err)
+	r := newTestSecretReplicator(t, client, WithOptions(ReplicatorOptions{
+		ExternalSources: map[string]ExternalProvider{"aws-secretsmanager": provider},
+		ExternalAllowed: allowed,
+	}), WithResyncPeriod(time.Hour))
+	secretClient := client.CoreV1().Secrets("source-ns")
+
+	// read in the background, then pulled
+	require.NoError(t, r.objectStore.Add(source))
+	r.ObjectAdded(source)
+	unpulled, err := secretClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, unpulled.Data)
+	handleExternalCalls(t, r, source)
+	pulled, err := secretClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), pulled.Data["password"])
+	assert.Equal(t, "v1", pulled.Annotations[ReplicateOnceVersionAnnotation])
+
+	// not updated again while the version is unchanged
+	require.NoError(t, r.objectStore.Update(pulled))
+	r.ObjectAdded(pulled)
+	handleExternalCalls(t, r, pulled)
+	unchanged, err := secretClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, pulled.ResourceVersion, unchanged.ResourceVersion)
+
+	provider["prod/database"] = &ExternalSecret{
+		Data:    map[string][]byte{"password": []byte("rotated")},
+		Version: "v2",
+	}
+	r.ObjectAdded(getSecret(t, r, "source-ns/source"))
+	handleExternalCalls(t, r, getSecret(t, r, "source-ns/source"))
+	rotated, err := secretClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("rotated"), rotated.Data["password"])
+	assert.Equal(t, "v2", rotated.Annotations[ReplicateOnceVersionAnnotation])
+}
+
+func TestPullFromExternal_invalid(t *testing.T) {
+	source := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+			Annotations: M{
+				ReplicateFromExternalAnnotation: "unknown:prod/database",
+			},
+		},
+	}
+	allowed, err := ParseExternalNamespaces("source-ns")
+	require.NoError(t, err)
+	r := newTestSecretReplicator(t, fake.NewSimpleClientset(source), WithOptions(ReplicatorOptions{
+		ExternalSources: map[string]ExternalProvider{"aws-ssm": testExternalProvider{}},
+		ExternalAllowed: allowed,
+	}), WithResyncPeriod(time.Hour))
+	require.NoError(t, r.objectStore.Add(source))
+	assert.Error(t, r.pullFromExternal(source), "unknown provider")
+
+	source.Annotations[ReplicateFromExternalAnnotation] = "aws-ssm:/missing"
+	assert.NoError(t, r.pullFromExternal(source), "read in the background")
+	waitExternalCalls(t, r)
+	assert.Error(t, r.pullFromExternal(source), "missing secret")
+
+	other := source.DeepCopy()
+	other.Namespace = "other-ns"
+	require.NoError(t, r.objectStore.Add(other))
+	assert.Error(t, r.pullFromExternal(other), "namespace not allowed")
+	r.externalCalls.mutex.Lock()
+	assert.NotContains(t, r.externalCalls.calls, "other-ns/source")
+	r.externalCalls.mutex.Unlock()
+
+	source.Annotations[ReplicateFromExternalAnnotation] = "prod/database"
+	assert.Error(t, r.pullFromExternal(source), "invalid annotation")
+}
+
+func TestParseExternalNamespaces(t *testing.T) {
+	patterns, err := ParseExternalNamespaces("source-ns, app-.*,")
+	require.NoError(t, err)
+	require.Len(t, patterns, 2)
+	assert.True(t, patterns[1].MatchString("app-1"))
+	assert.False(t, patterns[1].MatchString("other-app-1"))
+	_, err = ParseExternalNamespaces("app-(")
+	assert.Error(t, err)
+}
+
+func TestNewExternalProviders(t *testing.T) {
+	providers, err := NewExternalProviders([]string{"aws-secretsmanager", "aws-ssm"}, ExternalOptions{AWSRegion: "eu-west-1"})
+	require.NoError(t, err)
+	assert.Len(t, providers, 2)
+
+	_, err = NewExternalProviders([]string{"aws-ssm"}, ExternalOptions{})
+	assert.Error(t, err, "missing region")
+	_, err = NewExternalProviders([]string{"vault"}, ExternalOptions{})
+	assert.Error(t, err, "unknown provider")
+
+	RegisterExternalProvider("test", func(options ExternalOptions) (ExternalProvider, error) {
+		return testExternalProvider{}, nil
+	})
+	defer delete(externalProviders, "test")
+	providers, err = NewExternalProviders([]string{"test"}, ExternalOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, testExternalProvider{}, providers["test"])
+}
+
+// Returns the secret from the store of the replicator
+func getSecret(t *testing.T, r *ObjectReplicator, key string) *v1.Secret {
+	object, exists, err := r.objectStore.GetByKey(key)
+	require.NoError(t, err)
+	require.True(t, exists)
+	return object.(*v1.Secret)
+}
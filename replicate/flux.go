@@ -0,0 +1,88 @@
+// Compatibility with Flux, such that Flux and the replicator do not thrash the objects they share
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the prefix of the labels of the objects applied by a Flux Kustomization
+	fluxKustomizeLabelPrefix = "kustomize.toolkit.fluxcd.io/"
+	// the prefix of the labels of the objects applied by a Flux HelmRelease
+	fluxHelmLabelPrefix      = "helm.toolkit.fluxcd.io/"
+)
+
+// FluxCompat is the compatibility mode with the objects managed by Flux
+type FluxCompat struct {
+	// when true, the targets managed by Flux are adopted as any other one
+	Adopt bool
+}
+
+// NewFluxCompat returns the compatibility mode with Flux
+// Without adopt, the targets managed by Flux are only written when they request the replication themselves
+func NewFluxCompat(adopt bool) *FluxCompat {
+	return &FluxCompat{Adopt: adopt}
+}
+
+// Returns true if the label is set by Flux on the objects it applies
+func isFluxLabel(label string) bool {
+	return strings.HasPrefix(label, fluxKustomizeLabelPrefix) || strings.HasPrefix(label, fluxHelmLabelPrefix)
+}
+
+// Returns the name of the Flux Kustomization or HelmRelease managing the object, empty if none
+func fluxOwner(meta *metav1.ObjectMeta) string {
+	for _, prefix := range []string{fluxKustomizeLabelPrefix, fluxHelmLabelPrefix} {
+		if name, ok := meta.Labels[prefix+"name"]; ok {
+			return fmt.Sprintf("%s/%s", meta.Labels[prefix+"namespace"], name)
+		}
+	}
+	for label := range meta.Labels {
+		if isFluxLabel(label) {
+			return label
+		}
+	}
+	return ""
+}
+
+// Returns an error if the existing target is managed by Flux, and must not be adopted
+// The targets requesting the replication with the replicate-from annotation are not adopted, but asked for it
+func (f *FluxCompat) checkAdoption(meta *metav1.ObjectMeta) error {
+	if f == nil || f.Adopt {
+		return nil
+	}
+	if _, ok := meta.Annotations[ReplicateFromAnnotation]; ok {
+		return nil
+	}
+	if owner := fluxOwner(meta); owner != "" {
+		return fmt.Errorf("target %s/%s is managed by Flux \"%s\"", meta.Namespace, meta.Name, owner)
+	}
+	return nil
+}
+
+// Sets the Flux labels of a target being installed: the created targets never have any, such that Flux does not
+// prune them, but the existing targets keep theirs, such that Flux keeps tracking them
+func (f *FluxCompat) stamp(meta *metav1.ObjectMeta, existing *metav1.ObjectMeta) {
+	if f == nil {
+		return
+	}
+	for label := range meta.Labels {
+		if isFluxLabel(label) {
+			delete(meta.Labels, label)
+		}
+	}
+	if existing == nil {
+		return
+	}
+	for label, value := range existing.Labels {
+		if isFluxLabel(label) {
+			if meta.Labels == nil {
+				meta.Labels = map[string]string{}
+			}
+			meta.Labels[label] = value
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the labels of an object applied by the apps Kustomization of flux-system
+var testFluxLabels = M{
+	fluxKustomizeLabelPrefix + "name":      "apps",
+	fluxKustomizeLabelPrefix + "namespace": "flux-system",
+}
+
+func TestFluxCompat_checkAdoption(t *testing.T) {
+	managed := &metav1.ObjectMeta{Namespace: "ns", Name: "target", Labels: testFluxLabels}
+	var disabled *FluxCompat
+	assert.NoError(t, disabled.checkAdoption(managed), "disabled")
+	assert.NoError(t, NewFluxCompat(true).checkAdoption(managed), "adopted")
+	err := NewFluxCompat(false).checkAdoption(managed)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "flux-system/apps")
+	}
+	assert.Error(t, NewFluxCompat(false).checkAdoption(&metav1.ObjectMeta{
+		Labels: M{fluxHelmLabelPrefix + "name": "app", fluxHelmLabelPrefix + "namespace": "apps"},
+	}), "HelmRelease")
+	assert.NoError(t, NewFluxCompat(false).checkAdoption(&metav1.ObjectMeta{
+		Labels:      testFluxLabels,
+		Annotations: M{ReplicateFromAnnotation: "source-ns/source"},
+	}), "replication requested")
+	assert.NoError(t, NewFluxCompat(false).checkAdoption(&metav1.ObjectMeta{
+		Labels: M{"app.kubernetes.io/name": "app"},
+	}), "not managed by Flux")
+}
+
+func TestFluxCompat_stamp(t *testing.T) {
+	meta := &metav1.ObjectMeta{Labels: M{
+		"label":                           "value",
+		fluxKustomizeLabelPrefix + "name": "stale",
+	}}
+	NewFluxCompat(false).stamp(meta, nil)
+	assert.Equal(t, M{"label": "value"}, meta.Labels, "stripped")
+
+	NewFluxCompat(false).stamp(meta, &metav1.ObjectMeta{Labels: M{
+		"other":                           "value",
+		fluxKustomizeLabelPrefix + "name": "apps",
+	}})
+	assert.Equal(t, M{"label": "value", fluxKustomizeLabelPrefix + "name": "apps"}, meta.Labels, "preserved")
+}
+
+func TestReplicateTo_flux(t *testing.T) {
+	for _, adopt := range []bool{false, true} {
+		r := createTestReplicator(t, ReplicatorOptions{
+			Labels: M{"label": "value"},
+			Flux:   NewFluxCompat(adopt),
+		}, "my-ns")
+		updateObject(r, "my-ns", "target", M{ReplicatedByAnnotation: "my-ns/source"})
+		target := getObject(r, "my-ns", "target")
+		target.Meta.Labels = testFluxLabels
+		require.NoError(t, r.objectStore.Update(target))
+		source := updateObject(r, "my-ns", "source", M{ReplicateToAnnotation: "target"})
+		r.ObjectAdded(source)
+		if !adopt {
+			requireActionsLength(t, r, 0)
+			continue
+		}
+		requireActionsLength(t, r, 1)
+		assert.Equal(t, M{
+			"label":                                "value",
+			fluxKustomizeLabelPrefix + "name":      "apps",
+			fluxKustomizeLabelPrefix + "namespace": "flux-system",
+		}, getObject(r, "my-ns", "target").Meta.Labels, "labels of Flux preserved")
+	}
+}
@@ -0,0 +1,121 @@
+// GCP Secret Manager provider of external secrets
+
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+// the scope of the tokens of GCP
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// GCPProvider reads the versions of the secrets of GCP Secret Manager
+// The client authenticates with the key of the service account of GOOGLE_APPLICATION_CREDENTIALS,
+// signing its own tokens, or else with the default credentials of Google, such as the metadata server
+// as with the workload identity of GKE
+type GCPProvider struct {
+	project       string
+	// the options of the client, replaced in tests
+	clientOptions []option.ClientOption
+
+	mutex         sync.Mutex
+	client        *secretmanager.Client
+}
+
+// NewGCPProvider returns the provider of Secret Manager, the project is the default one of the secrets
+func NewGCPProvider(project string) *GCPProvider {
+	return &GCPProvider{project: project}
+}
+
+// Returns the client, created on first use such that missing credentials fail the reads and not the startup
+func (p *GCPProvider) getClient() (*secretmanager.Client, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.client == nil {
+		options, err := gcpCredentials(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+		if err != nil {
+			return nil, err
+		}
+		client, err := secretmanager.NewRESTClient(context.TODO(), append(options, p.clientOptions...)...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create GCP client: %s", err)
+		}
+		p.client = client
+	}
+	return p.client, nil
+}
+
+// Returns the credentials of the key of a service account, as self-signed tokens such that its token_uri
+// is never called, else none to use the default credentials of Google
+func gcpCredentials(path string) ([]option.ClientOption, error) {
+	if path == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(content, &key); err != nil {
+		return nil, fmt.Errorf("invalid credentials %s: %s", path, err)
+	}
+	if key.Type != "service_account" {
+		return nil, nil
+	}
+	tokenSource, err := google.JWTAccessTokenSourceWithScope(content, gcpScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials %s: %s", path, err)
+	}
+	return []option.ClientOption{option.WithTokenSource(tokenSource)}, nil
+}
+
+// Returns the name of the version of the secret
+// A secret is "<secret>" in the project, or "projects/<project>/secrets/<secret>", at its latest version by default
+func (p *GCPProvider) versionName(name string) (string, error) {
+	if !strings.HasPrefix(name, "projects/") {
+		if p.project == "" {
+			return "", fmt.Errorf("secret %s has no project, and GCP project is not set", name)
+		}
+		name = fmt.Sprintf("projects/%s/secrets/%s", p.project, name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return name, nil
+}
+
+// Get returns the version of the secret
+// A JSON object is split into keys, any other value is under the "value" key
+func (p *GCPProvider) Get(ctx context.Context, name string) (*ExternalSecret, error) {
+	version, err := p.versionName(name)
+	if err != nil {
+		return nil, err
+	}
+	client, err := p.getClient()
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: version})
+	if err != nil {
+		return nil, err
+	}
+	// the latest version is resolved to its number
+	split := strings.Split(response.Name, "/")
+	return &ExternalSecret{
+		Data:    externalData(response.Payload.GetData()),
+		Version: split[len(split)-1],
+	}, nil
+}
@@ -0,0 +1,125 @@
+package replicate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// Isolates the default credentials of Google from the ones of the host
+func setTestGCPEnv(t *testing.T, credentials string) {
+	dir, err := ioutil.TempDir("", "gcloud")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	t.Setenv("CLOUDSDK_CONFIG", dir)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentials)
+}
+
+func TestGCPProvider_metadata(t *testing.T) {
+	tokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/computeMetadata/") {
+			assert.Equal(t, "Google", req.Header.Get("Metadata-Flavor"))
+			switch req.URL.Path {
+			case "/computeMetadata/v1/instance/service-accounts/default/token":
+				tokens++
+				_, _ = res.Write([]byte(`{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`))
+			case "/computeMetadata/v1/universe/universe-domain":
+				_, _ = res.Write([]byte("googleapis.com"))
+			default:
+				res.WriteHeader(http.StatusNotFound)
+			}
+			return
+		}
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+		switch req.URL.Path {
+		case "/v1/projects/my-project/secrets/database/versions/latest:access":
+			_, _ = res.Write([]byte(`{"name":"projects/123/secrets/database/versions/4","payload":{"data":"eyJ1c2VyIjoiYWRtaW4ifQ=="}}`))
+		case "/v1/projects/other/secrets/token/versions/2:access":
+			_, _ = res.Write([]byte(`{"name":"projects/456/secrets/token/versions/2","payload":{"data":"cGxhaW4="}}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+			_, _ = res.Write([]byte(`{"error":{"code":404,"message":"secret not found","status":"NOT_FOUND"}}`))
+		}
+	}))
+	defer server.Close()
+	setTestGCPEnv(t, "")
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	provider := NewGCPProvider("my-project")
+	provider.clientOptions = []option.ClientOption{option.WithEndpoint(server.URL)}
+
+	secret, err := provider.Get(context.TODO(), "database")
+	require.NoError(t, err)
+	assert.Equal(t, &ExternalSecret{Data: map[string][]byte{"user": []byte("admin")}, Version: "4"}, secret)
+	secret, err = provider.Get(context.TODO(), "projects/other/secrets/token/versions/2")
+	require.NoError(t, err)
+	assert.Equal(t, &ExternalSecret{Data: map[string][]byte{"value": []byte("plain")}, Version: "2"}, secret)
+	_, err = provider.Get(context.TODO(), "missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "secret not found")
+	assert.Equal(t, 1, tokens)
+
+	_, err = NewGCPProvider("").Get(context.TODO(), "database")
+	assert.Error(t, err, "no project")
+}
+
+func TestGCPProvider_serviceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// the token is a JWT signed with the key, the token URI of the key is not called
+		assert.NotEqual(t, "/oauth2", req.URL.Path)
+		token := strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), ".")
+		require.Len(t, token, 3)
+		payload, err := base64.RawURLEncoding.DecodeString(token[1])
+		require.NoError(t, err)
+		var claims map[string]interface{}
+		require.NoError(t, json.Unmarshal(payload, &claims))
+		assert.Equal(t, "replicator@my-project.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, gcpScope, claims["scope"])
+		_, _ = res.Write([]byte(`{"name":"projects/123/secrets/database/versions/1","payload":{"data":"cGxhaW4="}}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "my-project",
+		"private_key_id": "key",
+		"client_email":   "replicator@my-project.iam.gserviceaccount.com",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey})),
+		"token_uri":      server.URL + "/oauth2",
+	})
+	require.NoError(t, err)
+	path := filepath.Join(dir, "credentials.json")
+	require.NoError(t, ioutil.WriteFile(path, credentials, 0600))
+	setTestGCPEnv(t, path)
+	provider := NewGCPProvider("my-project")
+	provider.clientOptions = []option.ClientOption{option.WithEndpoint(server.URL)}
+
+	secret, err := provider.Get(context.TODO(), "database")
+	require.NoError(t, err)
+	assert.Equal(t, "1", secret.Version)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = NewGCPProvider("my-project").Get(context.TODO(), "database")
+	assert.Error(t, err, "invalid credentials")
+}
@@ -0,0 +1,157 @@
+// Export of the replication topology as a graph
+
+package replicate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Kinds of the edges of the graph
+const (
+	// a target replicating from the source with the replicate-from annotation
+	EdgeFrom    = "from"
+	// a target the source is replicated to with the replicate-to annotations
+	EdgeTo      = "to"
+	// a target the source is waiting for
+	EdgeWatched = "watched"
+	// a pattern of targets the source is waiting for
+	EdgePattern = "pattern"
+)
+
+// GraphNode is an object, or a pattern of objects, in the graph
+type GraphNode struct {
+	ID       string `json:"id"`
+	Resource string `json:"resource"`
+	Name     string `json:"name"`
+	Pattern  bool   `json:"pattern,omitempty"`
+}
+
+// GraphEdge is a replication from a source to a target
+type GraphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Kind   string `json:"kind"`
+}
+
+// Graph is the replication graph of all the resources
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// NewGraph builds the graph of the topologies
+// Node ids are "resource:namespace/name", such that resources do not collide
+func NewGraph(topologies []Topology) Graph {
+	graph := Graph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	nodes := map[string]bool{}
+	node := func(resource string, name string, pattern bool) string {
+		id := resource + ":" + name
+		if !nodes[id] {
+			nodes[id] = true
+			graph.Nodes = append(graph.Nodes, GraphNode{
+				ID:       id,
+				Resource: resource,
+				Name:     name,
+				Pattern:  pattern,
+			})
+		}
+		return id
+	}
+	for _, topology := range topologies {
+		for _, source := range topology.Sources {
+			sourceID := node(topology.Resource, source.Source, false)
+			for kind, targets := range map[string][]string{
+				EdgeFrom:    source.TargetsFrom,
+				EdgeTo:      source.TargetsTo,
+				EdgeWatched: source.WatchedTargets,
+				EdgePattern: source.WatchedPatterns,
+			} {
+				for _, target := range targets {
+					graph.Edges = append(graph.Edges, GraphEdge{
+						Source: sourceID,
+						Target: node(topology.Resource, target, kind == EdgePattern),
+						Kind:   kind,
+					})
+				}
+			}
+		}
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].ID < graph.Nodes[j].ID
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		} else if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Kind < b.Kind
+	})
+	return graph
+}
+
+// WriteDot writes the graph in the DOT format of graphviz
+// Watched targets and patterns are dashed, patterns are drawn as boxes
+func (graph Graph) WriteDot(writer io.Writer) error {
+	lines := []string{"digraph replication {"}
+	for _, node := range graph.Nodes {
+		shape := "ellipse"
+		if node.Pattern {
+			shape = "box"
+		}
+		lines = append(lines, fmt.Sprintf("  %q [label=%q, shape=%s];", node.ID, node.ID, shape))
+	}
+	for _, edge := range graph.Edges {
+		style := "solid"
+		if edge.Kind == EdgeWatched || edge.Kind == EdgePattern {
+			style = "dashed"
+		}
+		lines = append(lines, fmt.Sprintf("  %q -> %q [label=%q, style=%s];", edge.Source, edge.Target, edge.Kind, style))
+	}
+	lines = append(lines, "}", "")
+	_, err := io.WriteString(writer, strings.Join(lines, "\n"))
+	return err
+}
+
+// GraphHandler serves the replication graph
+// The "format" query parameter is "json" (default) or "dot"
+type GraphHandler struct {
+	Replicators []Replicator
+}
+
+func (h *GraphHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Set("Allow", http.MethodGet)
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	topologies := []Topology{}
+	for _, replicator := range h.Replicators {
+		if r, ok := replicator.(TopologyReplicator); ok {
+			topologies = append(topologies, r.Topology())
+		}
+	}
+	graph := NewGraph(topologies)
+
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "json":
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(res).Encode(graph)
+	case "dot":
+		res.Header().Set("Content-Type", "text/vnd.graphviz")
+		res.WriteHeader(http.StatusOK)
+		_ = graph.WriteDot(res)
+	default:
+		http.Error(res, fmt.Sprintf("unknown format \"%s\": json or dot expected", format), http.StatusBadRequest)
+	}
+}
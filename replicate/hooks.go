@@ -0,0 +1,136 @@
+// Hooks of the embedding applications, called after the actions on the targets
+
+package replicate
+
+import (
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HookEvent is an action performed on a target, given to the hooks
+type HookEvent struct {
+	// the name of the replicator
+	Resource string
+	// install, update, clear or delete
+	Action   string
+	// the key of the source, empty if unknown
+	Source   string
+	// the metadata of the source, nil if not known to the replicator anymore
+	SourceMeta *metav1.ObjectMeta
+	// the metadata of the target, as written on success, as last known otherwise
+	Target   *metav1.ObjectMeta
+	// the failure of the action, nil on success
+	Err      error
+}
+
+// InstallHook is called after a target is installed or updated from its source
+type InstallHook interface {
+	OnInstall(event HookEvent)
+}
+
+// ClearHook is called after the data of a target is cleared, its source not replicating to it anymore
+type ClearHook interface {
+	OnClear(event HookEvent)
+}
+
+// DeleteHook is called after a target is deleted
+type DeleteHook interface {
+	OnDelete(event HookEvent)
+}
+
+// ErrorHook is called after an action on a target failed
+type ErrorHook interface {
+	OnError(event HookEvent)
+}
+
+// Hooks are the hooks called after the actions on the targets, each in order
+type Hooks struct {
+	Install []InstallHook
+	Clear   []ClearHook
+	Delete  []DeleteHook
+	Error   []ErrorHook
+}
+
+// Returns true if there is no hook
+func (h *Hooks) empty() bool {
+	return len(h.Install) == 0 && len(h.Clear) == 0 && len(h.Delete) == 0 && len(h.Error) == 0
+}
+
+// Returns a copy of the hooks with the other ones appended, in order
+func (h Hooks) with(other Hooks) Hooks {
+	return Hooks{
+		Install: append(append([]InstallHook{}, h.Install...), other.Install...),
+		Clear:   append(append([]ClearHook{}, h.Clear...), other.Clear...),
+		Delete:  append(append([]DeleteHook{}, h.Delete...), other.Delete...),
+		Error:   append(append([]ErrorHook{}, h.Error...), other.Error...),
+	}
+}
+
+// Calls the hooks of the event
+func (h *Hooks) call(event HookEvent) {
+	if event.Err != nil {
+		for _, hook := range h.Error {
+			hook.OnError(event)
+		}
+		return
+	}
+	switch event.Action {
+	case "install", "update":
+		for _, hook := range h.Install {
+			hook.OnInstall(event)
+		}
+	case "clear":
+		for _, hook := range h.Clear {
+			hook.OnClear(event)
+		}
+	case "delete":
+		for _, hook := range h.Delete {
+			hook.OnDelete(event)
+		}
+	}
+}
+
+// hookEvents keeps the events of the actions made with the mutex held, until it is released
+type hookEvents struct {
+	mutex  sync.Mutex
+	events []HookEvent
+}
+
+// Records an action on a target for the hooks, called once the mutex is released
+// The target is the written object on success, its last known metadata is used otherwise
+func (r *ObjectReplicator) callHooks(action string, source string, newObject interface{}, target *metav1.ObjectMeta, err error) {
+	if r.Hooks.empty() {
+		return
+	}
+	if err == nil && newObject != nil {
+		target = r.GetMeta(newObject)
+	}
+	event := HookEvent{
+		Resource: r.Name,
+		Action:   action,
+		Source:   source,
+		Target:   target.DeepCopy(),
+		Err:      err,
+	}
+	if source != "" {
+		if object, exists, err := r.objectStore.GetByKey(source); err == nil && exists {
+			event.SourceMeta = r.GetMeta(object).DeepCopy()
+		}
+	}
+	r.hookEvents.mutex.Lock()
+	r.hookEvents.events = append(r.hookEvents.events, event)
+	r.hookEvents.mutex.Unlock()
+}
+
+// Calls the hooks of the recorded actions, in order, deferred before taking the mutex such that it is released
+// The hooks may then call the replicator, such as Stats(), they should still return quickly
+func (r *ObjectReplicator) runHooks() {
+	r.hookEvents.mutex.Lock()
+	events := r.hookEvents.events
+	r.hookEvents.events = nil
+	r.hookEvents.mutex.Unlock()
+	for _, event := range events {
+		r.Hooks.call(event)
+	}
+}
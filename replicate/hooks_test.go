@@ -0,0 +1,128 @@
+package replicate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testHooks struct {
+	installs   []HookEvent
+	clears     []HookEvent
+	deletes    []HookEvent
+	errors     []HookEvent
+	// the stats of the replicator when installed, read by the hook
+	stats      []ReplicatorStats
+	replicator *ObjectReplicator
+}
+
+func (h *testHooks) OnInstall(event HookEvent) {
+	h.installs = append(h.installs, event)
+	if h.replicator != nil {
+		h.stats = append(h.stats, h.replicator.Stats())
+	}
+}
+
+func (h *testHooks) OnClear(event HookEvent) {
+	h.clears = append(h.clears, event)
+}
+
+func (h *testHooks) OnDelete(event HookEvent) {
+	h.deletes = append(h.deletes, event)
+}
+
+func (h *testHooks) OnError(event HookEvent) {
+	h.errors = append(h.errors, event)
+}
+
+type testErrorHook struct {
+	count int
+}
+
+func (h *testErrorHook) OnError(event HookEvent) {
+	h.count++
+}
+
+func TestHooks(t *testing.T) {
+	hooks := &testHooks{}
+	errorHook := &testErrorHook{}
+	r := createTestReplicator(t, ReplicatorOptions{Hooks: Hooks{
+		Install: []InstallHook{hooks},
+		Clear:   []ClearHook{hooks},
+		Delete:  []DeleteHook{hooks},
+		Error:   []ErrorHook{hooks, errorHook},
+	}}, "source-ns", "target-ns", "other-ns")
+	hooks.replicator = r
+	actions := r.ReplicatorActions.(*testActions)
+	failure := errors.New("denied")
+	actions.Errors = map[string]error{"other-ns/target": failure}
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target,other-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	require.Len(t, hooks.installs, 1)
+	assert.Equal(t, "install", hooks.installs[0].Action)
+	assert.Equal(t, "source-ns/source", hooks.installs[0].Source)
+	require.NotNil(t, hooks.installs[0].SourceMeta)
+	assert.Equal(t, "source", hooks.installs[0].SourceMeta.Name)
+	assert.Equal(t, "target-ns/target", metaKey(hooks.installs[0].Target))
+	assert.Equal(t, "source-ns/source", hooks.installs[0].Target.Annotations[ReplicatedByAnnotation], "as written")
+	assert.NoError(t, hooks.installs[0].Err)
+	require.Len(t, hooks.stats, 1, "called once the mutex is released")
+	assert.Equal(t, 1, hooks.stats[0].Sources)
+
+	require.Len(t, hooks.errors, 1)
+	assert.Equal(t, "install", hooks.errors[0].Action)
+	assert.Equal(t, "other-ns/target", metaKey(hooks.errors[0].Target))
+	assert.Equal(t, failure, hooks.errors[0].Err)
+	assert.Equal(t, 1, errorHook.count)
+
+	source = deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(source)
+	require.Len(t, hooks.deletes, 1)
+	assert.Equal(t, "delete", hooks.deletes[0].Action)
+	assert.Equal(t, "source-ns/source", hooks.deletes[0].Source)
+	assert.Nil(t, hooks.deletes[0].SourceMeta, "deleted")
+	assert.Equal(t, "target-ns/target", metaKey(hooks.deletes[0].Target))
+	assert.Len(t, hooks.installs, 1)
+	assert.Empty(t, hooks.clears)
+}
+
+func TestHooks_clear(t *testing.T) {
+	hooks := &testHooks{}
+	r := createTestReplicator(t, ReplicatorOptions{Hooks: Hooks{Clear: []ClearHook{hooks}}},
+		"source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(target)
+	require.Empty(t, hooks.clears)
+
+	source = deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(source)
+	require.Len(t, hooks.clears, 1)
+	assert.Equal(t, "clear", hooks.clears[0].Action)
+	assert.Equal(t, "source-ns/source", hooks.clears[0].Source)
+	assert.Equal(t, "target-ns/target", metaKey(hooks.clears[0].Target))
+}
+
+func TestWithHooks(t *testing.T) {
+	hooks := &testHooks{}
+	errorHook := &testErrorHook{}
+	config := NewReplicatorConfig(
+		WithHooks(Hooks{Install: []InstallHook{hooks}, Error: []ErrorHook{hooks}}),
+		WithHooks(Hooks{Error: []ErrorHook{errorHook}}),
+	)
+	assert.Len(t, config.Options.Hooks.Install, 1)
+	require.Len(t, config.Options.Hooks.Error, 2)
+	assert.Same(t, hooks, config.Options.Hooks.Error[0])
+	assert.Same(t, errorHook, config.Options.Hooks.Error[1])
+	assert.Empty(t, config.Options.Hooks.Delete)
+}
@@ -0,0 +1,73 @@
+// Reverse lookups of the targets, by the indexes of the object store
+
+package replicate
+
+import (
+	"k8s.io/client-go/tools/cache"
+)
+
+// The indexes of the object store
+const (
+	// the targets by the source of their replicated-by annotation
+	replicatedByIndex = "replicatedBy"
+	// the targets by the source of their replicate-from annotation
+	replicateFromIndex = "replicateFrom"
+	// the sources synced by kubed by the label selector of their sync annotation
+	kubedSelectorIndex = "kubedSelector"
+)
+
+// Returns the indexers of the object store
+// They are kept up-to-date by the store itself, including after a restart
+func (r *ObjectReplicator) objectIndexers() cache.Indexers {
+	return cache.Indexers{
+		replicatedByIndex: func(object interface{}) ([]string, error) {
+			if source, ok := r.GetMeta(object).Annotations[ReplicatedByAnnotation]; ok {
+				return []string{source}, nil
+			}
+			return nil, nil
+		},
+		replicateFromIndex: func(object interface{}) ([]string, error) {
+			if source, ok := resolveAnnotation(r.GetMeta(object), ReplicateFromAnnotation); ok {
+				return []string{source}, nil
+			}
+			return nil, nil
+		},
+		kubedSelectorIndex: func(object interface{}) ([]string, error) {
+			if selector := r.GetMeta(object).Annotations[KubedSyncAnnotation]; selector != "" {
+				return []string{selector}, nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+// Returns the keys of the objects indexed with this value
+func (r *ObjectReplicator) indexed(index string, value string) keySet {
+	keys, err := r.objectStore.IndexKeys(index, value)
+	if err != nil {
+		r.logger.Error(err, "could not lookup index", "index", index, "value", value)
+		return keySet{}
+	}
+	return newKeySet(keys...)
+}
+
+// Returns the targets the source is replicated to, with the replicate-to annotation
+func (r *ObjectReplicator) targetsTo(source string) keySet {
+	return r.indexed(replicatedByIndex, source)
+}
+
+// Returns the targets replicated from the source, with the replicate-from annotation
+func (r *ObjectReplicator) targetsFrom(source string) keySet {
+	return r.indexed(replicateFromIndex, source)
+}
+
+// Returns the targets of all the sources of an index
+func (r *ObjectReplicator) indexedSources(index string) map[string]keySet {
+	sources := map[string]keySet{}
+	for _, source := range r.objectStore.ListIndexFuncValues(index) {
+		if targets := r.indexed(index, source); len(targets) > 0 {
+			sources[source] = targets
+		}
+	}
+	return sources
+}
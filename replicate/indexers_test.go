@@ -0,0 +1,66 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestObjectIndexers(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	// as after a restart, nothing was handled yet
+	updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	updateObject(r, "target-ns", "target", M{
+		ReplicatedByAnnotation: "source-ns/source",
+	})
+	updateObject(r, "source-ns", "dependent", M{
+		ReplicateFromAnnotation: "source",
+	})
+	assert.Equal(t, []string{"target-ns/target"}, r.targetsTo("source-ns/source").sorted())
+	assert.Equal(t, []string{"source-ns/dependent"}, r.targetsFrom("source-ns/source").sorted())
+	assert.Nil(t, r.targetsTo("source-ns/dependent").sorted())
+
+	r.ObjectDeleted(deleteObject(r, "source-ns", "source"))
+	assertAction(t, r, 0, &testAction{
+		Action: "delete",
+		Object: testObject{
+			Meta: metav1.ObjectMeta{
+				Namespace:       "target-ns",
+				Name:            "target",
+				ResourceVersion: "1",
+			},
+		},
+	})
+	assertStore(t, r, "target-ns", "target", "")
+	assert.Nil(t, r.targetsTo("source-ns/source").sorted())
+}
+
+func TestObjectIndexers_arrivalOrder(t *testing.T) {
+	for _, sourceFirst := range []bool{true, false} {
+		r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+		source := updateObject(r, "source-ns", "source", M{
+			ReplicationAllowedAnnotation: "true",
+		})
+		dependent := updateObject(r, "target-ns", "dependent", M{
+			ReplicateFromAnnotation: "source-ns/source",
+		})
+		if sourceFirst {
+			r.ObjectAdded(source)
+			requireActionsLength(t, r, 0)
+			r.ObjectAdded(dependent)
+		} else {
+			r.ObjectAdded(dependent)
+			r.ObjectAdded(source)
+		}
+		requireActionsLength(t, r, 1)
+		assert.Equal(t, source.Data, getObject(r, "target-ns", "dependent").Data)
+
+		// then updated by its source
+		source = updateObject(r, "source-ns", "source", nil)
+		r.ObjectAdded(source)
+		assert.Equal(t, source.Data, getObject(r, "target-ns", "dependent").Data)
+	}
+}
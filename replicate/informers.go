@@ -0,0 +1,100 @@
+// Informers shared between the replicators
+
+package replicate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/tools/cache"
+)
+
+// SharedInformers creates each informer once, such that all the replicators share it
+type SharedInformers struct {
+	mutex      sync.Mutex
+	factory    informers.SharedInformerFactory
+	// when not nil, only the metadata of the namespaces is watched
+	metadata   metadata.Interface
+	namespaces *sharedInformer
+}
+
+// sharedInformer is an informer started once, whatever the count of replicators using it
+type sharedInformer struct {
+	informer  cache.SharedIndexInformer
+	listWatch cache.ListerWatcher
+	activity  *informerActivity
+	once      sync.Once
+}
+
+// NewSharedInformers returns the informers to share between the replicators
+// With a metadata client, the namespaces are watched as PartialObjectMetadata, to save memory
+func NewSharedInformers(client kubernetes.Interface, metadataClient metadata.Interface, resyncPeriod time.Duration) *SharedInformers {
+	return &SharedInformers{
+		factory:  informers.NewSharedInformerFactory(client, resyncPeriod),
+		metadata: metadataClient,
+	}
+}
+
+// Returns the namespace informer, created on the first call, with the metrics and the logger of the calling replicator
+func (s *SharedInformers) namespaceInformer(metrics *replicatorMetrics, logger logr.Logger) *sharedInformer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.namespaces != nil {
+		return s.namespaces
+	}
+	shared := &sharedInformer{
+		activity: newInformerActivity("namespace", metrics, logger),
+	}
+	var objType runtime.Object = &v1.Namespace{}
+	if s.metadata != nil {
+		objType = &metav1.PartialObjectMetadata{}
+	}
+	// the shared informer is never stopped, its requests are never cancelled
+	shared.informer = s.factory.InformerFor(objType, func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		if s.metadata != nil {
+			namespaces := s.metadata.Resource(v1.SchemeGroupVersion.WithResource("namespaces"))
+			shared.listWatch = &cache.ListWatch{
+				ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+					return namespaces.List(context.Background(), lo)
+				},
+				WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+					return namespaces.Watch(context.Background(), lo)
+				},
+			}
+		} else {
+			namespaces := client.CoreV1().Namespaces()
+			shared.listWatch = &cache.ListWatch{
+				ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+					return namespaces.List(context.Background(), lo)
+				},
+				WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+					return namespaces.Watch(context.Background(), lo)
+				},
+			}
+		}
+		// the namespaces are never written
+		lw := transformListWatch(shared.listWatch, func(object runtime.Object) {
+			stripObject(object, true)
+		})
+		return cache.NewSharedIndexInformer(shared.activity.wrap(lw), objType, resyncPeriod, cache.Indexers{})
+	})
+	s.namespaces = shared
+	return shared
+}
+
+// Starts the informer, only on the first call
+func (i *sharedInformer) start() {
+	i.once.Do(func() {
+		go i.activity.run(i.informer, wait.NeverStop)
+	})
+}
@@ -0,0 +1,147 @@
+package replicate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestSharedInformers(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "target-1",
+		},
+	})
+	informers := NewSharedInformers(client, nil, time.Hour)
+	options := ReplicatorOptions{Informers: informers}
+	configMaps := newTestConfigMapReplicator(t, client, WithOptions(options), WithResyncPeriod(time.Hour))
+	secrets := newTestSecretReplicator(t, client, WithOptions(options), WithResyncPeriod(time.Hour))
+	assert.Same(t, configMaps.namespaceInformer, secrets.namespaceInformer)
+	assert.Same(t, configMaps.namespaceActivity, secrets.namespaceActivity)
+
+	configMaps.Start()
+	secrets.Start()
+	require.Eventually(t, func() bool {
+		return configMaps.Ready() && secrets.Ready()
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := client.CoreV1().Namespaces().Create(context.TODO(), &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "target-2",
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, exists, _ := secrets.namespaceStore.GetByKey("target-2")
+		return exists
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"target-1", "target-2"}, configMaps.namespaceStore.ListKeys())
+
+	// listed and watched only once
+	lists := 0
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "namespaces" && action.GetVerb() == "list" {
+			lists++
+		}
+	}
+	assert.Equal(t, 1, lists)
+}
+
+func TestSharedInformers_metadata(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	scheme := runtime.NewScheme()
+	require.NoError(t, metav1.AddMetaToScheme(scheme))
+	metadataClient := metadatafake.NewSimpleMetadataClient(scheme, &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Namespace",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "target-1",
+		},
+	})
+	options := ReplicatorOptions{Informers: NewSharedInformers(client, metadataClient, time.Hour)}
+	r := newTestConfigMapReplicator(t, client, WithOptions(options), WithResyncPeriod(time.Hour))
+	r.Start()
+	require.Eventually(t, r.Ready, 5*time.Second, 10*time.Millisecond)
+	object, exists, err := r.namespaceStore.GetByKey("target-1")
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.IsType(t, &metav1.PartialObjectMetadata{}, object)
+	assert.Equal(t, "target-1", namespaceName(object))
+	// the typed client is not used for the namespaces
+	for _, action := range client.Actions() {
+		assert.NotEqual(t, "namespaces", action.GetResource().Resource)
+	}
+}
+
+func TestRun_prefixes(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-ns"},
+	}, &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "my-ns",
+			Name:        "source",
+			Annotations: M{"blue/replicate-to": "blue-target", "green/replicate-to": "green-target"},
+		},
+	})
+	// each watch receives its own copies of the objects, as from an API server, since each replicator translates them
+	client.PrependWatchReactor("*", func(action clienttesting.Action) (bool, watch.Interface, error) {
+		w, err := client.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		return true, watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+			event.Object = event.Object.DeepCopyObject()
+			return event, true
+		}), nil
+	})
+	informers := NewSharedInformers(client, nil, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, prefix := range []string{"blue", "green"} {
+		options := ReplicatorOptions{Prefixes: []string{prefix}, Informers: informers}
+		r := newTestConfigMapReplicator(t, client, WithOptions(options), WithResyncPeriod(time.Hour))
+		go func() {
+			errs <- r.Run(ctx)
+		}()
+	}
+	for _, prefix := range []string{"blue", "green"} {
+		var target *v1.ConfigMap
+		require.Eventually(t, func() bool {
+			var err error
+			target, err = client.CoreV1().ConfigMaps("my-ns").Get(context.TODO(), prefix+"-target", metav1.GetOptions{})
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "my-ns/source", target.Annotations[prefix+"/replicated-by"])
+		assert.NotContains(t, target.Annotations, ReplicatedByAnnotation)
+	}
+
+	cancel()
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+}
+
+func TestStop(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	r := newTestConfigMapReplicator(t, client, WithOptions(ReplicatorOptions{Informers: NewSharedInformers(client, nil, time.Hour)}))
+	assert.EqualError(t, r.Healthy(), "configMap replicator not synced")
+	r.Start()
+	require.Eventually(t, func() bool {
+		return r.Healthy() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	r.Stop()
+	r.Stop()
+	assert.EqualError(t, r.Healthy(), "configMap replicator stopped")
+	assert.NoError(t, r.Run(context.Background()), "already stopped")
+}
@@ -0,0 +1,13 @@
+// Package testhooks gives the replicatetest package access to the internals of the replicators,
+// without exporting them from the replicate package
+package testhooks
+
+import (
+	"k8s.io/client-go/tools/cache"
+)
+
+// FakeStores inits the stores of a replicator without informers, the objects keyed by the key function
+// The caller fills the stores and calls the handlers, translating the objects first with the returned function, as the
+// informers do with the prefixes of the annotations
+// It is set by the replicate package
+var FakeStores func(replicator interface{}, keyFunc cache.KeyFunc) (objects cache.Indexer, namespaces cache.Store, translate func(object interface{}))
@@ -0,0 +1,90 @@
+// Compatibility with the sources synced by kubed, also known as config-syncer
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// KubedSyncAnnotation tells kubed to sync a source to all the namespaces, or to the ones matching its label selector
+const KubedSyncAnnotation = "kubed.appscode.com/sync"
+
+// Returns the namespaces a source synced by kubed is replicated to, as a replicate-to-namespaces annotation
+// All the namespaces with an empty selector, else the names of the stored namespaces with matching labels
+// Returns false if the source is not synced by kubed
+func (r *ReplicatorProps) kubedNamespaces(object *metav1.ObjectMeta) (string, bool, error) {
+	value, ok := object.Annotations[KubedSyncAnnotation]
+	if !ok || !r.Kubed {
+		return "", false, nil
+	} else if value == "" {
+		return ".*", true, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return "", false, fmt.Errorf("source %s has invalid label selector on annotation %s \"%s\": %s",
+			metaKey(object), KubedSyncAnnotation, value, err)
+	}
+	names := []string{}
+	for _, namespace := range r.namespaceStore.List() {
+		if meta := namespace.(metav1.Object); selector.Matches(labels.Set(meta.GetLabels())) {
+			names = append(names, meta.GetName())
+		}
+	}
+	return strings.Join(names, ","), true, nil
+}
+
+// Returns the sources synced by kubed to the namespace, because it matches their label selector
+func (r *ObjectReplicator) kubedSelecting(namespace string) keySet {
+	sources := keySet{}
+	if !r.Kubed {
+		return sources
+	}
+	object, exists, err := r.namespaceStore.GetByKey(namespace)
+	if err != nil || !exists {
+		return sources
+	}
+	return r.kubedSelectingLabels(labels.Set(object.(metav1.Object).GetLabels()))
+}
+
+// Returns the sources synced by kubed to the namespaces with these labels
+func (r *ObjectReplicator) kubedSelectingLabels(namespaceLabels labels.Set) keySet {
+	sources := keySet{}
+	for _, value := range r.objectStore.ListIndexFuncValues(kubedSelectorIndex) {
+		if selector, err := labels.Parse(value); err == nil && selector.Matches(namespaceLabels) {
+			for source := range r.indexed(kubedSelectorIndex, value) {
+				sources[source] = true
+			}
+		}
+	}
+	return sources
+}
+
+// Queues the sources synced by kubed whose label selector matched the namespace before its labels changed,
+// but not anymore, or the other way around, such that a relabeled namespace gets or loses their targets
+// without waiting for the next resync
+func (r *ObjectReplicator) enqueueRelabeledNamespace(old interface{}, new interface{}) {
+	if !r.Kubed {
+		return
+	}
+	oldLabels := labels.Set(old.(metav1.Object).GetLabels())
+	newLabels := labels.Set(new.(metav1.Object).GetLabels())
+	if labels.Equals(oldLabels, newLabels) {
+		return
+	}
+	before := r.kubedSelectingLabels(oldLabels)
+	after := r.kubedSelectingLabels(newLabels)
+	for _, source := range before.sorted() {
+		if !after[source] {
+			r.enqueue(queueItem{key: source})
+		}
+	}
+	for _, source := range after.sorted() {
+		if !before[source] {
+			r.enqueue(queueItem{key: source})
+		}
+	}
+}
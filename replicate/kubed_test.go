@@ -0,0 +1,112 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Adds a namespace with labels to the store
+func addLabeledNamespace(r *ObjectReplicator, namespace string, labels map[string]string) *v1.Namespace {
+	object := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: labels,
+		},
+	}
+	require.NoError(r.ReplicatorActions.(*testActions).T, r.namespaceStore.Update(object))
+	return object
+}
+
+func TestKubedNamespaces(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{Kubed: true}, "source-ns")
+	addLabeledNamespace(r, "app-ns", M{"app": "kubed"})
+	addLabeledNamespace(r, "other-ns", M{"app": "other"})
+
+	_, ok, _ := r.kubedNamespaces(&metav1.ObjectMeta{Annotations: M{}})
+	assert.False(t, ok, "not synced")
+	namespaces, ok, err := r.kubedNamespaces(&metav1.ObjectMeta{Annotations: M{KubedSyncAnnotation: ""}})
+	assert.True(t, ok)
+	assert.Equal(t, ".*", namespaces, "all the namespaces")
+	namespaces, ok, err = r.kubedNamespaces(&metav1.ObjectMeta{Annotations: M{KubedSyncAnnotation: "app=kubed"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "app-ns", namespaces)
+	_, _, err = r.kubedNamespaces(&metav1.ObjectMeta{Annotations: M{KubedSyncAnnotation: "app in kubed"}})
+	assert.Error(t, err)
+
+	r.Kubed = false
+	_, ok, _ = r.kubedNamespaces(&metav1.ObjectMeta{Annotations: M{KubedSyncAnnotation: ""}})
+	assert.False(t, ok, "disabled")
+}
+
+func TestReplicateTo_kubed(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{Kubed: true}, "source-ns")
+	addLabeledNamespace(r, "app-ns", M{"app": "kubed"})
+	addLabeledNamespace(r, "other-ns", M{"app": "other"})
+	source := updateObject(r, "source-ns", "source", M{
+		KubedSyncAnnotation: "app=kubed",
+	})
+	r.ObjectAdded(source)
+	assertAction(t, r, 0, &testAction{
+		Action: "install",
+		Object: testObject{
+			Type: "0",
+			Data: "0",
+			Meta: metav1.ObjectMeta{
+				Name:      "source",
+				Namespace: "app-ns",
+				Annotations: M{
+					ReplicatedFromVersionAnnotation: "0",
+					ReplicatedByAnnotation:          "source-ns/source",
+				},
+			},
+		},
+	})
+	requireActionsLength(t, r, 1)
+
+	// the added namespaces matching the selector
+	r.NamespaceAdded(addLabeledNamespace(r, "new-ns", M{"app": "kubed"}))
+	r.NamespaceAdded(addLabeledNamespace(r, "new-other-ns", nil))
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, []string{"app-ns/source", "new-ns/source"}, r.targetsTo("source-ns/source").sorted())
+
+	// the replicator annotations have precedence
+	source = updateObject(r, "source-ns", "source", M{
+		KubedSyncAnnotation:     "app=kubed",
+		ReplicateToNsAnnotation: "other-ns",
+	})
+	r.ObjectAdded(source)
+	assert.Equal(t, []string{"other-ns/source"}, r.targetsTo("source-ns/source").sorted())
+}
+
+func TestReplicateTo_kubedRelabeled(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{Kubed: true}, "source-ns")
+	r.initQueue()
+	appNs := addLabeledNamespace(r, "app-ns", M{"app": "kubed"})
+	otherNs := addLabeledNamespace(r, "other-ns", M{"app": "other"})
+	source := updateObject(r, "source-ns", "source", M{
+		KubedSyncAnnotation: "app=kubed",
+	})
+	r.ObjectAdded(source)
+	assert.Equal(t, []string{"app-ns/source"}, r.targetsTo("source-ns/source").sorted())
+
+	// relabeled into the selector
+	r.enqueueRelabeledNamespace(otherNs, addLabeledNamespace(r, "other-ns", M{"app": "kubed"}))
+	require.Equal(t, 1, r.queue.Len())
+	require.True(t, r.processNextItem())
+	assert.Equal(t, []string{"app-ns/source", "other-ns/source"}, r.targetsTo("source-ns/source").sorted())
+
+	// relabeled out of the selector
+	r.enqueueRelabeledNamespace(appNs, addLabeledNamespace(r, "app-ns", nil))
+	require.Equal(t, 1, r.queue.Len())
+	require.True(t, r.processNextItem())
+	assert.Equal(t, []string{"other-ns/source"}, r.targetsTo("source-ns/source").sorted())
+	assert.Nil(t, getObject(r, "app-ns", "source"))
+
+	// the labels did not change
+	r.enqueueRelabeledNamespace(otherNs, otherNs)
+	assert.Equal(t, 0, r.queue.Len())
+}
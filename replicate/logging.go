@@ -0,0 +1,190 @@
+// Structured logging of the replicators
+
+package replicate
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// verbosity of the debug messages
+const debugLevel = 1
+
+// NewLogger creates a logger with the given level (error, info or debug)
+// and format (text or json), writing a line per message to the writer
+func NewLogger(level string, format string, writer io.Writer) (logr.Logger, error) {
+	options := funcr.Options{
+		LogTimestamp: true,
+	}
+	switch strings.ToLower(level) {
+	case "error", "info":
+	case "debug":
+		options.Verbosity = debugLevel
+	default:
+		return logr.Discard(), fmt.Errorf("unknown log level \"%s\": error, info or debug expected", level)
+	}
+
+	var logger logr.Logger
+	switch strings.ToLower(format) {
+	case "text":
+		logger = funcr.New(func(prefix, args string) {
+			if prefix != "" {
+				fmt.Fprintln(writer, prefix, args)
+			} else {
+				fmt.Fprintln(writer, args)
+			}
+		}, options)
+	case "json":
+		logger = funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(writer, obj)
+		}, options)
+	default:
+		return logr.Discard(), fmt.Errorf("unknown log format \"%s\": text or json expected", format)
+	}
+
+	if strings.ToLower(level) == "error" {
+		logger = logr.New(errorSink{logger.GetSink()})
+	}
+	return logger, nil
+}
+
+func mustNewLogger(level string, format string, writer io.Writer) logr.Logger {
+	logger, err := NewLogger(level, format, writer)
+	if err != nil {
+		panic(err)
+	}
+	return logger
+}
+
+// a sink discarding all the non error messages
+type errorSink struct {
+	logr.LogSink
+}
+
+func (errorSink) Enabled(level int) bool {
+	return false
+}
+
+func (s errorSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return errorSink{s.LogSink.WithValues(keysAndValues...)}
+}
+
+func (s errorSink) WithName(name string) logr.LogSink {
+	return errorSink{s.LogSink.WithName(name)}
+}
+
+// RateLimitLogger wraps a logger such that an error repeated with the same message and values,
+// thus about the same object, is logged at most once per window.
+// The info messages, which report the actions and the changes, are all logged.
+// The number of suppressed errors is added to the next logged one,
+// and exported with the metrics of the replicators logging with it.
+func RateLimitLogger(logger logr.Logger, window time.Duration) logr.Logger {
+	if window <= 0 {
+		return logger
+	}
+	return logr.New(&rateLimitSink{
+		LogSink: logger.GetSink(),
+		history: &logHistory{
+			window:     window,
+			now:        time.Now,
+			seen:       map[string]*logEntry{},
+			suppressed: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Namespace: metricsNamespace,
+					Name:      "log_messages_suppressed_total",
+					Help:      "Log messages suppressed because they were repeated, by level.",
+				},
+				[]string{"level"},
+			),
+		},
+	})
+}
+
+// when each message was last logged, shared by all the derived loggers
+type logHistory struct {
+	mutex      sync.Mutex
+	window     time.Duration
+	now        func() time.Time
+	swept      time.Time
+	seen       map[string]*logEntry
+	// log messages suppressed because they were repeated, by level
+	suppressed *prometheus.CounterVec
+}
+
+type logEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+// Returns if the message should be logged, and how many times it was suppressed before
+func (h *logHistory) allow(key string) (bool, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := h.now()
+	// forget the expired messages once in a while, to limit memory usage
+	if now.Sub(h.swept) > h.window {
+		for k, entry := range h.seen {
+			if now.Sub(entry.logged) >= h.window {
+				delete(h.seen, k)
+			}
+		}
+		h.swept = now
+	}
+
+	entry, ok := h.seen[key]
+	if ok && now.Sub(entry.logged) < h.window {
+		entry.suppressed++
+		return false, 0
+	}
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	h.seen[key] = &logEntry{logged: now}
+	return true, suppressed
+}
+
+// a sink suppressing the repeated errors
+type rateLimitSink struct {
+	logr.LogSink
+	history *logHistory
+	// the values and names of the logger, part of the identity of a message
+	values  []interface{}
+}
+
+// Returns the keys and values to log, or false if the message is suppressed
+func (s *rateLimitSink) allow(level string, msg string, err error, keysAndValues []interface{}) ([]interface{}, bool) {
+	key := fmt.Sprintf("%s %s %v %v %v", level, msg, err, s.values, keysAndValues)
+	ok, suppressed := s.history.allow(key)
+	if !ok {
+		s.history.suppressed.WithLabelValues(level).Inc()
+		return nil, false
+	}
+	if suppressed > 0 {
+		keysAndValues = append(keysAndValues[:len(keysAndValues):len(keysAndValues)], "suppressed", suppressed)
+	}
+	return keysAndValues, true
+}
+
+func (s *rateLimitSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	if keysAndValues, ok := s.allow("error", msg, err, keysAndValues); ok {
+		s.LogSink.Error(err, msg, keysAndValues...)
+	}
+}
+
+func (s *rateLimitSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	values := append(s.values[:len(s.values):len(s.values)], keysAndValues...)
+	return &rateLimitSink{s.LogSink.WithValues(keysAndValues...), s.history, values}
+}
+
+func (s *rateLimitSink) WithName(name string) logr.LogSink {
+	values := append(s.values[:len(s.values):len(s.values)], "name", name)
+	return &rateLimitSink{s.LogSink.WithName(name), s.history, values}
+}
@@ -0,0 +1,106 @@
+package replicate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func logLines(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		values := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &values), line)
+		lines = append(lines, values)
+	}
+	buffer.Reset()
+	return lines
+}
+
+func TestNewLogger_levels(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	for _, example := range []struct{
+		level string
+		msgs  []string
+	}{
+		{"error", []string{"error"}},
+		{"info", []string{"info", "error"}},
+		{"debug", []string{"debug", "info", "error"}},
+	} {
+		logger, err := NewLogger(example.level, "json", buffer)
+		require.NoError(t, err, example.level)
+		logger = logger.WithValues("resource", "test")
+		logger.V(debugLevel).Info("debug")
+		logger.Info("info")
+		logger.Error(fmt.Errorf("failed"), "error")
+		msgs := []string{}
+		for _, line := range logLines(t, buffer) {
+			assert.Equal(t, "test", line["resource"], example.level)
+			msgs = append(msgs, line["msg"].(string))
+		}
+		assert.Equal(t, example.msgs, msgs, example.level)
+	}
+}
+
+func TestNewLogger_formats(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := NewLogger("info", "text", buffer)
+	require.NoError(t, err)
+	logger.Info("installing", "target", "ns/name")
+	assert.Contains(t, buffer.String(), `"msg"="installing"`)
+	assert.Contains(t, buffer.String(), `"target"="ns/name"`)
+
+	_, err = NewLogger("warning", "text", buffer)
+	assert.Error(t, err, "unknown level")
+	_, err = NewLogger("info", "xml", buffer)
+	assert.Error(t, err, "unknown format")
+}
+
+func TestRateLimitLogger(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := NewLogger("info", "json", buffer)
+	require.NoError(t, err)
+	logger = RateLimitLogger(logger, time.Minute)
+	now := time.Now()
+	history := logger.GetSink().(*rateLimitSink).history
+	history.now = func() time.Time {
+		return now
+	}
+	suppressed := testutil.ToFloat64(history.suppressed.WithLabelValues("error"))
+	logger = logger.WithValues("resource", "test")
+
+	for i := 0; i < 3; i++ {
+		logger.Error(fmt.Errorf("failed"), "could not parse", "object", "ns/first")
+		logger.Error(fmt.Errorf("failed"), "could not parse", "object", "ns/second")
+	}
+	lines := logLines(t, buffer)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "ns/first", lines[0]["object"])
+	assert.Equal(t, "ns/second", lines[1]["object"])
+	assert.Equal(t, suppressed+4, testutil.ToFloat64(history.suppressed.WithLabelValues("error")))
+
+	logger.Error(fmt.Errorf("other"), "could not parse", "object", "ns/first")
+	require.Len(t, logLines(t, buffer), 1, "different error")
+
+	now = now.Add(time.Minute)
+	logger.Error(fmt.Errorf("failed"), "could not parse", "object", "ns/first")
+	lines = logLines(t, buffer)
+	require.Len(t, lines, 1, "after window")
+	assert.Equal(t, float64(2), lines[0]["suppressed"])
+
+	// the info messages are all logged
+	for i := 0; i < 3; i++ {
+		logger.Info("source changed", "source", "ns/first")
+	}
+	assert.Len(t, logLines(t, buffer), 3)
+}
@@ -0,0 +1,187 @@
+// Running the replicators in a controller-runtime manager, reconciling their objects from the cache of the manager
+
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// managerRunnable runs a replicator in a manager, once the manager is elected leader
+// The replicator runs its workers, and the informer of its namespaces, its objects are reconciled by its controller
+type managerRunnable struct {
+	replicator Replicator
+}
+
+// Start runs the replicator until the manager stops
+// The objects of the cache are the first list of the replicator, it is ready once they are reconciled
+func (m managerRunnable) Start(ctx context.Context) error {
+	if r, ok := m.replicator.(*ObjectReplicator); ok && r.objectManaged {
+		if !toolscache.WaitForCacheSync(ctx.Done(), r.objectController.HasSynced) {
+			return fmt.Errorf("%s replicator stopped before the cache was synced", r.Name)
+		}
+		keys := map[string]bool{}
+		for _, key := range r.objectStore.ListKeys() {
+			keys[key] = true
+		}
+		r.objectInitialSync.list(keys)
+	}
+	return m.replicator.Run(ctx)
+}
+
+// NeedLeaderElection returns true, a single replica replicates the objects
+func (managerRunnable) NeedLeaderElection() bool {
+	return true
+}
+
+// managerReconciler reconciles the objects of a replicator, from the cache of the manager
+type managerReconciler struct {
+	replicator *ObjectReplicator
+}
+
+// Reconcile handles the object with its current state in the cache, as the workers of the replicator do
+// The failures are returned, such that the controller retries them with its backoff
+// The deletions are queued by the replicator, with the last state of the objects
+func (m managerReconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	r := m.replicator
+	key := request.NamespacedName.String()
+	if r.stopped() {
+		return reconcile.Result{}, nil
+	}
+	defer r.objectInitialSync.handled(key)
+	// unchanged since handled before a restart
+	if object, exists, err := r.objectStore.GetByKey(key); err == nil && exists &&
+		r.handledStates != nil && r.handledStates.unchanged(key, r.receivedStateHash(object)) {
+		r.metrics.checkpointSkipped.WithLabelValues(r.Name).Inc()
+		r.watchRestored(object)
+		return reconcile.Result{}, nil
+	}
+	_, err := r.process(queueItem{key: key})
+	failed := err != nil && !isPermanent(err)
+	// a target was backed off, reconciled again once its backoff ends, only then
+	if backoff := r.stats.takeBackoff(); failed && backoff > 0 {
+		return reconcile.Result{RequeueAfter: backoff}, nil
+	} else if failed {
+		return reconcile.Result{}, fmt.Errorf("could not reconcile %s %s: %s", r.Name, key, err)
+	}
+	return reconcile.Result{}, nil
+}
+
+// Replaces the informer of the objects by the informer of the cache of the manager, shared with its controller
+// The informer is run by the manager, and not restarted by the replicator
+func (r *ObjectReplicator) useManagerCache(mgr manager.Manager) error {
+	object, ok := r.objectType.DeepCopyObject().(client.Object)
+	if !ok {
+		return fmt.Errorf("unsupported type %T", r.objectType)
+	}
+	informer, err := mgr.GetCache().GetInformer(context.Background(), object)
+	if err != nil {
+		return err
+	}
+	shared, ok := informer.(toolscache.SharedIndexInformer)
+	if !ok {
+		return fmt.Errorf("unsupported informer %T", informer)
+	}
+	if err := shared.AddIndexers(r.objectIndexers()); err != nil {
+		return err
+	}
+	if _, err := shared.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		DeleteFunc: r.enqueueDeletedObject,
+	}); err != nil {
+		return err
+	}
+	r.objectStore = shared.GetIndexer()
+	r.objectController = shared
+	r.objectInitialSync = &initialSync{}
+	r.objectManaged = true
+	return builder.ControllerManagedBy(mgr).
+		Named(strings.ToLower(r.Name) + "-replicator").
+		For(object).
+		Complete(managerReconciler{replicator: r})
+}
+
+// ManagerCacheOptions returns the options of the cache of the manager the replicators are added to,
+// which transforms their objects as their own informers do: stripped, and their annotations translated
+func ManagerCacheOptions(replicators ...Replicator) cache.Options {
+	options := cache.Options{ByObject: map[client.Object]cache.ByObject{}}
+	for _, replicator := range replicators {
+		r, ok := replicator.(*ObjectReplicator)
+		if !ok {
+			continue
+		}
+		object, ok := r.objectType.DeepCopyObject().(client.Object)
+		if !ok {
+			continue
+		}
+		options.ByObject[object] = cache.ByObject{Transform: func(object interface{}) (interface{}, error) {
+			if object, ok := object.(runtime.Object); ok {
+				r.stripObject(object)
+			}
+			return object, nil
+		}}
+	}
+	return options
+}
+
+// AddToManager adds the replicators to a controller-runtime manager, which runs them once elected leader
+// Their objects are reconciled from the cache of the manager, by a controller per replicator,
+// the manager being created with the cache options of ManagerCacheOptions
+// Their health and readiness are added to the probes of the manager, which pass until elected,
+// such that the standby replicas are not restarted
+// Their metrics are exported by the manager once created with WithMetricsRegistry(metrics.Registry)
+func AddToManager(mgr manager.Manager, replicators ...Replicator) error {
+	for _, replicator := range replicators {
+		name := replicator.Status().Resource
+		if r, ok := replicator.(*ObjectReplicator); ok {
+			if err := r.useManagerCache(mgr); err != nil {
+				return fmt.Errorf("could not add %s controller: %s", name, err)
+			}
+		}
+		if err := mgr.Add(managerRunnable{replicator: replicator}); err != nil {
+			return fmt.Errorf("could not add %s replicator: %s", name, err)
+		}
+		healthz, readyz := managerChecks(mgr.Elected(), replicator)
+		if err := mgr.AddHealthzCheck(name, healthz); err != nil {
+			return fmt.Errorf("could not add %s health check: %s", name, err)
+		}
+		if err := mgr.AddReadyzCheck(name, readyz); err != nil {
+			return fmt.Errorf("could not add %s readiness check: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the health and readiness checks of the replicator, which pass until elected
+func managerChecks(elected <-chan struct{}, replicator Replicator) (func(*http.Request) error, func(*http.Request) error) {
+	isElected := func() bool {
+		select {
+		case <-elected:
+			return true
+		default:
+			return false
+		}
+	}
+	healthz := func(*http.Request) error {
+		if !isElected() {
+			return nil
+		}
+		return replicator.Healthy()
+	}
+	readyz := func(*http.Request) error {
+		if !isElected() || replicator.Ready() {
+			return nil
+		}
+		return fmt.Errorf("%s replicator not ready", replicator.Status().Resource)
+	}
+	return healthz, readyz
+}
@@ -0,0 +1,130 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+func Test_managerChecks(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	r := newTestConfigMapReplicator(t, client, WithOptions(ReplicatorOptions{Informers: NewSharedInformers(client, nil, time.Hour)}))
+	defer r.Stop()
+	elected := make(chan struct{})
+	healthz, readyz := managerChecks(elected, r)
+	assert.NoError(t, healthz(nil), "not elected")
+	assert.NoError(t, readyz(nil), "not elected")
+
+	close(elected)
+	assert.EqualError(t, healthz(nil), "configMap replicator not synced")
+	assert.EqualError(t, readyz(nil), "configMap replicator not ready")
+	r.Start()
+	require.Eventually(t, func() bool {
+		return healthz(nil) == nil && readyz(nil) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// Returns an API server serving the configMaps to the cache of a manager, their watch never sends any event
+func newTestAPIServer(t *testing.T, configMaps ...v1.ConfigMap) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var response interface{}
+		switch {
+		case req.URL.Path == "/api":
+			response = metav1.APIVersions{Versions: []string{"v1"}}
+		case req.URL.Path == "/apis":
+			response = metav1.APIGroupList{}
+		case req.URL.Path == "/api/v1":
+			response = metav1.APIResourceList{GroupVersion: "v1", APIResources: []metav1.APIResource{{
+				Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: metav1.Verbs{"list", "watch"},
+			}}}
+		case req.URL.Path == "/api/v1/configmaps" && req.URL.Query().Get("watch") == "true":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		case req.URL.Path == "/api/v1/configmaps":
+			response = v1.ConfigMapList{
+				TypeMeta: metav1.TypeMeta{Kind: "ConfigMapList", APIVersion: "v1"},
+				ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+				Items:    configMaps,
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(response))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAddToManager(t *testing.T) {
+	source := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations:     M{ReplicateToAnnotation: "target-ns/target"},
+			ManagedFields:   []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+	server := newTestAPIServer(t, source)
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "source-ns"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "target-ns"}},
+		&source,
+	)
+	r := newTestConfigMapReplicator(t, client, WithOptions(ReplicatorOptions{Informers: NewSharedInformers(client, nil, time.Hour)}),
+		WithMetricsRegistry(ctrlmetrics.Registry))
+	mgr, err := manager.New(&rest.Config{Host: server.URL}, manager.Options{
+		Metrics:                metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress: "0",
+		Cache:                  ManagerCacheOptions(r),
+	})
+	require.NoError(t, err)
+	require.NoError(t, AddToManager(mgr, r))
+
+	r.metrics.writesSkipped.WithLabelValues("test").Inc()
+	families, err := ctrlmetrics.Registry.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, "k8s_replicator_writes_skipped_total")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- mgr.Start(ctx)
+	}()
+	require.Eventually(t, r.Ready, 5*time.Second, 10*time.Millisecond)
+	// reconciled from the cache of the manager, transformed as by the informer of the replicator
+	cached, exists, err := r.objectStore.GetByKey("source-ns/source")
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Nil(t, cached.(*v1.ConfigMap).ManagedFields)
+	target, err := client.CoreV1().ConfigMaps("target-ns").Get(context.TODO(), "target", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, source.Data, target.Data)
+	assert.Equal(t, "source-ns/source", target.Annotations[ReplicatedByAnnotation])
+	cancel()
+	assert.NoError(t, <-errs)
+	assert.EqualError(t, r.Healthy(), "configMap replicator stopped")
+}
@@ -0,0 +1,228 @@
+// Check of the annotations of local manifests, against the namespaces and objects of a cluster
+
+package replicate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// IssueConflicting is an object whose annotations conflict with each other, or with the objects of the cluster
+const IssueConflicting = "conflicting"
+
+// Manifest is an object read from a local file, only its kind and its metadata
+type Manifest struct {
+	File string
+	Kind string
+	Meta metav1.ObjectMeta
+}
+
+// ManifestReport lists the issues and the predicted targets of a manifest
+type ManifestReport struct {
+	File    string             `json:"file"`
+	Kind    string             `json:"kind"`
+	Object  string             `json:"object"`
+	Targets []string           `json:"targets"`
+	Issues  []ConsistencyIssue `json:"issues"`
+}
+
+// ManifestChecker is implemented by the replicators able to check manifests
+type ManifestChecker interface {
+	storeLoader
+	// checks the manifest against the stores, false if the manifest is not of the replicated kind
+	CheckManifest(manifest Manifest) (ManifestReport, bool)
+}
+
+// ReadManifests reads the objects of the YAML or JSON files, the directories are read recursively
+// The objects without namespace get the default namespace
+func ReadManifests(path string, namespace string) ([]Manifest, error) {
+	manifests := []Manifest{}
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		} else if ext := filepath.Ext(file); file != path && ext != ".yaml" && ext != ".yml" && ext != ".json" {
+			return nil
+		}
+		read, err := readManifests(file, namespace)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", file, err)
+		}
+		manifests = append(manifests, read...)
+		return nil
+	})
+	return manifests, err
+}
+
+// Reads the objects of a YAML or JSON file, possibly of several documents
+func readManifests(file string, namespace string) ([]Manifest, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	manifests := []Manifest{}
+	decoder := yaml.NewYAMLOrJSONDecoder(reader, 4096)
+	for {
+		object := metav1.PartialObjectMetadata{}
+		if err := decoder.Decode(&object); err == io.EOF {
+			return manifests, nil
+		} else if err != nil {
+			return nil, err
+		} else if object.Kind == "" {
+			continue
+		}
+		if object.Namespace == "" {
+			object.Namespace = namespace
+		}
+		manifests = append(manifests, Manifest{
+			File: file,
+			Kind: object.Kind,
+			Meta: object.ObjectMeta,
+		})
+	}
+}
+
+// CheckManifest reports the invalid and conflicting annotations of the manifest, and predicts its targets
+// The stores must be filled, either by the informers or by LoadStores
+// Returns false if the manifest is not of the replicated kind
+func (r *ObjectReplicator) CheckManifest(manifest Manifest) (ManifestReport, bool) {
+	if !strings.EqualFold(manifest.Kind, r.Name) {
+		return ManifestReport{}, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	meta := manifest.Meta.DeepCopy()
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	r.prefixes.translate(meta.Annotations)
+	key := metaKey(meta)
+	report := ManifestReport{
+		File:    manifest.File,
+		Kind:    manifest.Kind,
+		Object:  key,
+		Targets: []string{},
+		Issues:  []ConsistencyIssue{},
+	}
+	issue := func(kind string, source string, target string, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, ConsistencyIssue{
+			Kind:    kind,
+			Source:  source,
+			Target:  target,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	get := func(key string) *metav1.ObjectMeta {
+		if object, exists, err := r.objectStore.GetByKey(key); err == nil && exists {
+			return r.GetMeta(object)
+		}
+		return nil
+	}
+
+	if unknown := r.prefixes.unknown(meta.Annotations); len(unknown) > 0 && !r.IgnoreUnknown {
+		for _, annotation := range unknown {
+			issue(IssueInvalid, "", key, "unknown annotation %s", annotation)
+		}
+	}
+	for _, annotation := range []string{ReplicatedByAnnotation, ReplicatedFromVersionAnnotation} {
+		if _, ok := meta.Annotations[annotation]; ok {
+			issue(IssueConflicting, "", key, "annotation %s is written by the replicator", annotation)
+		}
+	}
+	// a target of a replicate-from annotation
+	if source, ok := resolveAnnotation(meta, ReplicateFromAnnotation); ok {
+		for _, annotation := range []string{ReplicateFromClusterAnnotation, ReplicateFromExternalAnnotation} {
+			if _, ok := meta.Annotations[annotation]; ok {
+				issue(IssueConflicting, source, key, "annotations %s and %s both set the data",
+					ReplicateFromAnnotation, annotation)
+			}
+		}
+		if _, err := r.needsFromAnnotationsUpdate(&metav1.ObjectMeta{}, meta); err != nil {
+			issue(IssueInvalid, source, key, "%s", err)
+		} else if sourceMeta := get(source); sourceMeta == nil {
+			issue(IssueMissing, source, key, "source does not exist")
+		} else if ok, nok, err := r.isReplicationAllowed(meta, sourceMeta); !ok && !nok {
+			issue(IssueInvalid, source, key, "%s", err)
+		} else if !ok {
+			issue(IssueConflicting, source, key, "replication is not allowed: %s", err)
+		}
+	} else if _, ok := meta.Annotations[ReplicateOnceAnnotation]; ok {
+		if _, okTo := meta.Annotations[ReplicateToAnnotation]; !okTo {
+			if _, okToNs := meta.Annotations[ReplicateToNsAnnotation]; !okToNs {
+				issue(IssueConflicting, "", key, "annotation %s without %s has no effect",
+					ReplicateOnceAnnotation, ReplicateFromAnnotation)
+			}
+		}
+	}
+	if _, err := r.needsAllowedAnnotationsUpdate(&metav1.ObjectMeta{}, meta); err != nil {
+		issue(IssueInvalid, key, "", "%s", err)
+	}
+	// a source of replicate-to annotations
+	targets, targetPatterns, err := r.getReplicationTargets(meta)
+	if err != nil {
+		issue(IssueInvalid, key, "", "%s", err)
+		targets, targetPatterns = nil, nil
+	}
+	namespaces := r.namespaceStore.ListKeys()
+	existingNamespaces := newKeySet(namespaces...)
+	expected := keySet{}
+	for _, target := range targets {
+		if existingNamespaces[strings.SplitN(target, "/", 2)[0]] {
+			expected[target] = true
+		}
+	}
+	for _, pattern := range targetPatterns {
+		for _, target := range pattern.Targets(namespaces) {
+			expected[target] = true
+		}
+	}
+	delete(expected, key)
+	report.Targets = expected.sorted()
+	for _, target := range report.Targets {
+		if targetMeta := get(target); targetMeta == nil {
+		} else if ok, err := r.isReplicatedBy(targetMeta, meta); !ok {
+			issue(IssueConflicting, key, target, "target exists: %s", err)
+		}
+	}
+	return report, true
+}
+
+// WriteManifestReports writes the reports, as "text" or "json"
+func WriteManifestReports(writer io.Writer, reports []ManifestReport, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	case "text":
+		for _, report := range reports {
+			if _, err := fmt.Fprintf(writer, "%s %s (%s): %d targets, %d issues\n",
+				report.Kind, report.Object, report.File, len(report.Targets), len(report.Issues)); err != nil {
+				return err
+			}
+			for _, target := range report.Targets {
+				if _, err := fmt.Fprintf(writer, "  target      %s\n", target); err != nil {
+					return err
+				}
+			}
+			for _, issue := range report.Issues {
+				if _, err := fmt.Fprintf(writer, "  %-11s %s -> %s: %s\n",
+					issue.Kind, issue.Source, issue.Target, issue.Message); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %s, expected text or json", format)
+	}
+}
@@ -0,0 +1,106 @@
+package replicate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReadManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "nested", "objects.yaml"), []byte(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: source
+  annotations:
+    k8s-replicator/replicate-to-namespaces: "app-.*"
+---
+# empty document
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: target
+  namespace: other-ns
+`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "object.json"), []byte(
+		`{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "json", "namespace": "json-ns"}}`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# not a manifest"), 0600))
+
+	manifests, err := ReadManifests(dir, "my-ns")
+	require.NoError(t, err)
+	require.Len(t, manifests, 3)
+	assert.Equal(t, "Secret", manifests[0].Kind)
+	assert.Equal(t, "my-ns/source", metaKey(&manifests[0].Meta))
+	assert.Equal(t, M{ReplicateToNsAnnotation: "app-.*"}, manifests[0].Meta.Annotations)
+	assert.Equal(t, "ConfigMap", manifests[1].Kind)
+	assert.Equal(t, "other-ns/target", metaKey(&manifests[1].Meta))
+	assert.Equal(t, filepath.Join(dir, "object.json"), manifests[2].File)
+
+	_, err = ReadManifests(filepath.Join(dir, "missing"), "my-ns")
+	assert.Error(t, err)
+}
+
+func TestCheckManifest(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "app-1", "app-2", "other-ns")
+	updateObject(r, "app-2", "source", M{
+		ReplicatedByAnnotation: "other-ns/other",
+	})
+	updateObject(r, "other-ns", "source", M{})
+	check := func(annotations map[string]string) ManifestReport {
+		report, ok := r.CheckManifest(Manifest{
+			File: "manifest.yaml",
+			Kind: "Test",
+			Meta: metav1.ObjectMeta{Name: "source", Namespace: "source-ns", Annotations: annotations},
+		})
+		require.True(t, ok)
+		return report
+	}
+	_, ok := r.CheckManifest(Manifest{Kind: "Secret"})
+	assert.False(t, ok, "other kind")
+
+	report := check(M{ReplicateToNsAnnotation: "app-.*"})
+	assert.Equal(t, []string{"app-1/source", "app-2/source"}, report.Targets)
+	if assert.Len(t, report.Issues, 1) {
+		assert.Equal(t, IssueConflicting, report.Issues[0].Kind)
+		assert.Equal(t, "app-2/source", report.Issues[0].Target)
+	}
+
+	report = check(M{ReplicateToNsAnnotation: "app-(", annotationsPrefix + "unknown": "true"})
+	assert.Empty(t, report.Targets)
+	if assert.Len(t, report.Issues, 2) {
+		assert.Equal(t, IssueInvalid, report.Issues[0].Kind)
+		assert.Contains(t, report.Issues[0].Message, "unknown annotation")
+		assert.Equal(t, IssueInvalid, report.Issues[1].Kind)
+		assert.Contains(t, report.Issues[1].Message, "compilation error")
+	}
+
+	report = check(M{ReplicateFromAnnotation: "other-ns/source", ReplicateFromExternalAnnotation: "aws-ssm:/token"})
+	if assert.Len(t, report.Issues, 2) {
+		assert.Equal(t, IssueConflicting, report.Issues[0].Kind)
+		assert.Equal(t, IssueConflicting, report.Issues[1].Kind)
+		assert.Contains(t, report.Issues[1].Message, "not allowed")
+	}
+	report = check(M{ReplicateFromAnnotation: "missing", ReplicateOnceAnnotation: "true"})
+	if assert.Len(t, report.Issues, 1) {
+		assert.Equal(t, IssueMissing, report.Issues[0].Kind)
+		assert.Equal(t, "source-ns/missing", report.Issues[0].Source)
+	}
+	report = check(M{ReplicateOnceAnnotation: "true"})
+	assert.Len(t, report.Issues, 1, "no effect")
+
+	buffer := &bytes.Buffer{}
+	require.NoError(t, WriteManifestReports(buffer, []ManifestReport{report}, "text"))
+	assert.Contains(t, buffer.String(), "Test source-ns/source (manifest.yaml): 0 targets, 1 issues\n")
+	assert.Error(t, WriteManifestReports(buffer, []ManifestReport{report}, "yaml"))
+}
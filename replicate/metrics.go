@@ -0,0 +1,746 @@
+// Prometheus metrics exported by the replicators
+
+package replicate
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const metricsNamespace = "k8s_replicator"
+
+// buckets of the sizes, from 64B to 16MiB, secrets and configMaps being limited to 1MiB
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+// replicatorMetrics are the metrics of a replicator, only exported once registered by WithMetricsRegistry
+// The replicators registered with the same registry share the metrics of the first one, labelled by resource
+type replicatorMetrics struct {
+	// time spent handling an informer event, by resource and handler
+	reconcileDuration   *prometheus.HistogramVec
+	// time spent in each call to the kubernetes API, by resource and verb
+	actionDuration      *prometheus.HistogramVec
+	// writes skipped because the target already had the data of its source, by resource
+	writesSkipped       *prometheus.CounterVec
+	// targets repaired because their data was changed out-of-band, by resource
+	driftRepaired       *prometheus.CounterVec
+	// orphaned targets deleted or disowned, by resource and policy
+	orphansCollected    *prometheus.CounterVec
+	// failed lists and watches, by informer and reason
+	watchErrors         *prometheus.CounterVec
+	// lists after the initial one, by informer
+	relists             *prometheus.CounterVec
+	// failed calls to the kubernetes API, by resource, verb and reason
+	apiErrors           *prometheus.CounterVec
+	// entries of the bookkeeping of the sources and targets, by resource and structure
+	bookkeepingEntries  *prometheus.GaugeVec
+	// bytes of data written to the targets, by resource
+	bytesWritten        *prometheus.CounterVec
+	// size of the data of each written target, by resource
+	objectSize          *prometheus.HistogramVec
+	// bytes of data written while handling an informer event, by resource and handler
+	reconcileBytes      *prometheus.HistogramVec
+	// items in the queues, by resource
+	queueDepth          *prometheus.GaugeVec
+	// items added to the queues, by resource
+	queueAdds           *prometheus.CounterVec
+	// age of the items when they are handled, by resource
+	queueLatency        *prometheus.HistogramVec
+	// time spent handling the items, by resource
+	queueWorkDuration   *prometheus.HistogramVec
+	// time spent handling the items being handled, by resource
+	queueUnfinishedWork *prometheus.GaugeVec
+	// time spent handling the oldest item being handled, by resource
+	queueLongestRunning *prometheus.GaugeVec
+	// failed items queued again, by resource
+	queueRetries        *prometheus.CounterVec
+	// events dropped because the queue was full, by resource
+	queueShed           *prometheus.CounterVec
+	// times all the objects were queued again after events were dropped, by resource
+	queueRecomputes     *prometheus.CounterVec
+	// writes of the changes of the sources held back until approved, by resource
+	approvalHeld        *prometheus.CounterVec
+	// times a target was backed off, by resource
+	breakerTrips        *prometheus.CounterVec
+	// writes skipped because their target was backed off, by resource
+	breakerRejections   *prometheus.CounterVec
+	// objects not handled after a restart because unchanged since the checkpoint, by resource
+	checkpointSkipped   *prometheus.CounterVec
+	// targets handled again later because their deletion still conflicted, by resource
+	deleteRetries       *prometheus.CounterVec
+	// deletions suspended because an informer was degraded, by resource
+	deletesSuspended    *prometheus.CounterVec
+	// objects skipped on resync because unchanged, by resource
+	resyncsSkipped      *prometheus.CounterVec
+	// exports of the sources to external stores, by exporter and result
+	externalExports     *prometheus.CounterVec
+	// reads of the secrets of external stores, by provider and result
+	externalFetches     *prometheus.CounterVec
+	// installations deferred because their namespace was terminating, by resource
+	terminatingDeferred *prometheus.CounterVec
+	// actions on the targets of remote clusters, by cluster, resource, action and result
+	clusterActions      *prometheus.CounterVec
+	// times an informer was restarted, by informer
+	informerRestarts    *prometheus.CounterVec
+	// objects handled again after the delay asked by the API server, by resource
+	apiThrottled        *prometheus.CounterVec
+	// actions held back by the startup gate, by resource and action
+	startupHeldActions  *prometheus.CounterVec
+	// objects queued again because they changed too often, by resource
+	sourcesThrottled    *prometheus.CounterVec
+	// the staleness of the sources of the replicators, by resource
+	staleness           *stalenessCollector
+}
+
+func newReplicatorMetrics() *replicatorMetrics {
+	return &replicatorMetrics{
+		reconcileDuration:   prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "reconcile_duration_seconds",
+				Help:      "Time spent handling an informer event, by resource and handler.",
+				Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+			},
+			[]string{"resource", "handler"},
+		),
+		actionDuration:      prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "api_call_duration_seconds",
+				Help:      "Time spent in calls to the kubernetes API, by resource and verb.",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+			},
+			[]string{"resource", "verb"},
+		),
+		writesSkipped:       prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "writes_skipped_total",
+				Help:      "Writes skipped because the target already had the data of its source, by resource.",
+			},
+			[]string{"resource"},
+		),
+		driftRepaired:       prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "drift_repaired_total",
+				Help:      "Targets repaired because their data was changed out-of-band, by resource.",
+			},
+			[]string{"resource"},
+		),
+		orphansCollected:    prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "orphans_collected_total",
+				Help:      "Orphaned targets deleted or disowned, by resource and policy.",
+			},
+			[]string{"resource", "policy"},
+		),
+		watchErrors:         prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "watch_errors_total",
+				Help:      "Failed lists and watches of the informers, by informer and reason.",
+			},
+			[]string{"informer", "reason"},
+		),
+		relists:             prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "relists_total",
+				Help:      "Lists of the informers after the initial one, by informer.",
+			},
+			[]string{"informer"},
+		),
+		apiErrors:           prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "api_errors_total",
+				Help:      "Failed calls to the kubernetes API, by resource, verb and reason.",
+			},
+			[]string{"resource", "verb", "reason"},
+		),
+		bookkeepingEntries:  prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "bookkeeping_entries",
+				Help:      "Entries of the bookkeeping of the sources and targets, by resource and structure.",
+			},
+			[]string{"resource", "structure"},
+		),
+		bytesWritten:        prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "bytes_written_total",
+				Help:      "Bytes of data written to the targets, by resource.",
+			},
+			[]string{"resource"},
+		),
+		objectSize:          prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "object_size_bytes",
+				Help:      "Size of the data of each written target, by resource.",
+				Buckets:   sizeBuckets,
+			},
+			[]string{"resource"},
+		),
+		reconcileBytes:      prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "reconcile_bytes_written",
+				Help:      "Bytes of data written while handling an informer event, by resource and handler.",
+				Buckets:   sizeBuckets,
+			},
+			[]string{"resource", "handler"},
+		),
+		queueDepth:          prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_depth",
+				Help:      "Items in the work queue, by resource.",
+			},
+			[]string{"resource"},
+		),
+		queueAdds:           prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_adds_total",
+				Help:      "Items added to the work queue, by resource.",
+			},
+			[]string{"resource"},
+		),
+		queueLatency:        prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_latency_seconds",
+				Help:      "Time the items waited in the work queue before being handled, by resource.",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+			},
+			[]string{"resource"},
+		),
+		queueWorkDuration:   prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_work_duration_seconds",
+				Help:      "Time spent handling the items of the work queue, by resource.",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+			},
+			[]string{"resource"},
+		),
+		queueUnfinishedWork: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_unfinished_work_seconds",
+				Help:      "Time spent so far handling the items being handled, by resource.",
+			},
+			[]string{"resource"},
+		),
+		queueLongestRunning: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_longest_running_processor_seconds",
+				Help:      "Time spent so far handling the oldest item being handled, by resource.",
+			},
+			[]string{"resource"},
+		),
+		queueRetries:        prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_retries_total",
+				Help:      "Failed items queued again, by resource.",
+			},
+			[]string{"resource"},
+		),
+		queueShed:           prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_shed_total",
+				Help:      "Events dropped because the work queue was full, by resource.",
+			},
+			[]string{"resource"},
+		),
+		queueRecomputes:     prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "queue_recomputes_total",
+				Help:      "Times all the objects were queued again after events were dropped, by resource.",
+			},
+			[]string{"resource"},
+		),
+		approvalHeld:        prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "approval_held_total",
+				Help:      "Writes of the changes of the sources held back until approved, by resource.",
+			},
+			[]string{"resource"},
+		),
+		breakerTrips:        prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "circuit_breaker_trips_total",
+				Help:      "Times a target was backed off after repeated failures, by resource.",
+			},
+			[]string{"resource"},
+		),
+		breakerRejections:   prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "circuit_breaker_rejections_total",
+				Help:      "Writes skipped because their target was backed off, by resource.",
+			},
+			[]string{"resource"},
+		),
+		checkpointSkipped:   prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "checkpoint_skipped_total",
+				Help:      "Objects not handled after a restart because they did not change since the checkpoint, by resource.",
+			},
+			[]string{"resource"},
+		),
+		deleteRetries:       prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "delete_retries_total",
+				Help:      "Targets handled again later because their deletion still failed its preconditions, by resource.",
+			},
+			[]string{"resource"},
+		),
+		deletesSuspended:    prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "deletes_suspended_total",
+				Help:      "Deletions suspended because an informer was degraded, and its store possibly outdated, by resource.",
+			},
+			[]string{"resource"},
+		),
+		resyncsSkipped:      prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "resyncs_skipped_total",
+				Help:      "Objects skipped on resync because they and their related objects did not change since last handled, by resource.",
+			},
+			[]string{"resource"},
+		),
+		externalExports:     prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "external_exports_total",
+				Help:      "Exports of the sources to external stores, by exporter and result.",
+			},
+			[]string{"exporter", "result"},
+		),
+		externalFetches:     prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "external_fetches_total",
+				Help:      "Reads of the secrets of external stores, by provider and result.",
+			},
+			[]string{"provider", "result"},
+		),
+		terminatingDeferred: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "terminating_deferred_total",
+				Help:      "Installations deferred because the namespace of their target was terminating, by resource.",
+			},
+			[]string{"resource"},
+		),
+		clusterActions:      prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "cluster_actions_total",
+				Help:      "Actions on the targets of remote clusters, by cluster, resource, action and result.",
+			},
+			[]string{"cluster", "resource", "action", "result"},
+		),
+		informerRestarts:    prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "informer_restarts_total",
+				Help:      "Times an informer was restarted because it stopped or kept failing, by informer.",
+			},
+			[]string{"informer"},
+		),
+		apiThrottled:        prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "api_throttled_total",
+				Help:      "Objects handled again after the delay asked by the API server throttling them, by resource.",
+			},
+			[]string{"resource"},
+		),
+		startupHeldActions:  prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "startup_held_actions_total",
+				Help:      "Actions held back during the startup safety window, by resource and action.",
+			},
+			[]string{"resource", "action"},
+		),
+		sourcesThrottled:    prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "sources_throttled_total",
+				Help:      "Objects queued again because they changed more often than their rate limit, by resource.",
+			},
+			[]string{"resource"},
+		),
+		staleness:           newStalenessCollector(),
+	}
+}
+
+// Registers the metrics with the registry
+// The ones already registered by another replicator are used instead, such that they are exported once
+func (m *replicatorMetrics) register(registerer prometheus.Registerer) error {
+	errs := []error{
+		registerCollector(registerer, &m.reconcileDuration),
+		registerCollector(registerer, &m.actionDuration),
+		registerCollector(registerer, &m.writesSkipped),
+		registerCollector(registerer, &m.driftRepaired),
+		registerCollector(registerer, &m.orphansCollected),
+		registerCollector(registerer, &m.watchErrors),
+		registerCollector(registerer, &m.relists),
+		registerCollector(registerer, &m.apiErrors),
+		registerCollector(registerer, &m.bookkeepingEntries),
+		registerCollector(registerer, &m.bytesWritten),
+		registerCollector(registerer, &m.objectSize),
+		registerCollector(registerer, &m.reconcileBytes),
+		registerCollector(registerer, &m.queueDepth),
+		registerCollector(registerer, &m.queueAdds),
+		registerCollector(registerer, &m.queueLatency),
+		registerCollector(registerer, &m.queueWorkDuration),
+		registerCollector(registerer, &m.queueUnfinishedWork),
+		registerCollector(registerer, &m.queueLongestRunning),
+		registerCollector(registerer, &m.queueRetries),
+		registerCollector(registerer, &m.queueShed),
+		registerCollector(registerer, &m.queueRecomputes),
+		registerCollector(registerer, &m.approvalHeld),
+		registerCollector(registerer, &m.breakerTrips),
+		registerCollector(registerer, &m.breakerRejections),
+		registerCollector(registerer, &m.checkpointSkipped),
+		registerCollector(registerer, &m.deleteRetries),
+		registerCollector(registerer, &m.deletesSuspended),
+		registerCollector(registerer, &m.resyncsSkipped),
+		registerCollector(registerer, &m.externalExports),
+		registerCollector(registerer, &m.externalFetches),
+		registerCollector(registerer, &m.terminatingDeferred),
+		registerCollector(registerer, &m.clusterActions),
+		registerCollector(registerer, &m.informerRestarts),
+		registerCollector(registerer, &m.apiThrottled),
+		registerCollector(registerer, &m.startupHeldActions),
+		registerCollector(registerer, &m.sourcesThrottled),
+		registerCollector(registerer, &m.staleness),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registers the collector, replaced by the one of the same metrics if already registered
+func registerCollector[C prometheus.Collector](registerer prometheus.Registerer, collector *C) error {
+	err := registerer.Register(*collector)
+	if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		if existing, ok := registered.ExistingCollector.(C); ok {
+			*collector = existing
+			return nil
+		}
+	}
+	return err
+}
+
+// Registers the collector of a component shared by the replicators, registered by each of them
+func registerShared(registerer prometheus.Registerer, collector prometheus.Collector) error {
+	if err := registerer.Register(collector); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// The metrics of the work queue of the replicator, named after its resource
+
+func (m *replicatorMetrics) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return m.queueDepth.WithLabelValues(name)
+}
+
+func (m *replicatorMetrics) NewAddsMetric(name string) workqueue.CounterMetric {
+	return m.queueAdds.WithLabelValues(name)
+}
+
+func (m *replicatorMetrics) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return m.queueLatency.WithLabelValues(name)
+}
+
+func (m *replicatorMetrics) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return m.queueWorkDuration.WithLabelValues(name)
+}
+
+func (m *replicatorMetrics) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return m.queueUnfinishedWork.WithLabelValues(name)
+}
+
+func (m *replicatorMetrics) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return m.queueLongestRunning.WithLabelValues(name)
+}
+
+func (m *replicatorMetrics) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return m.queueRetries.WithLabelValues(name)
+}
+
+// Records the duration of an informer event handler started at `start`
+func (r *ReplicatorProps) observeReconcile(handler string, start time.Time) {
+	r.metrics.reconcileDuration.WithLabelValues(r.Name, handler).Observe(time.Since(start).Seconds())
+}
+
+// Records the duration of an API call started at `start`, and its error if any
+func (r *ReplicatorProps) observeAction(verb string, start time.Time, err error) {
+	r.metrics.actionDuration.WithLabelValues(r.Name, verb).Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.metrics.apiErrors.WithLabelValues(r.Name, verb, errorReason(err)).Inc()
+	}
+}
+
+// Records the size of the data of a written target, if the actions can tell it, and returns it
+// The whole target is written even when only its annotations change, so all the writes are recorded
+func (r *ObjectReplicator) observeSize(newObject interface{}) int64 {
+	sizer, ok := r.ReplicatorActions.(DataSizer)
+	if !ok || newObject == nil {
+		return 0
+	}
+	size := sizer.DataSize(newObject)
+	r.metrics.objectSize.WithLabelValues(r.Name).Observe(float64(size))
+	r.metrics.bytesWritten.WithLabelValues(r.Name).Add(float64(size))
+	return int64(size)
+}
+
+// Records the size of a target written by the running handler, and counts it in the bytes of the handler
+// It is called by the handler, or by its concurrent syncs while it waits for them, the writes running in the
+// background call observeSize instead
+func (r *ObjectReplicator) observeWritten(newObject interface{}) {
+	size := r.observeSize(newObject)
+	if bytes := r.handlerBytes; bytes != nil {
+		bytes.Add(size)
+	}
+}
+
+// Starts counting the bytes written by a handler, and returns the count of the handler it runs within, if any
+// The mutex must be held
+func (r *ObjectReplicator) countHandlerBytes() *atomic.Int64 {
+	outer := r.handlerBytes
+	r.handlerBytes = &atomic.Int64{}
+	return outer
+}
+
+// Records the bytes written by a handler, and counts them in the bytes of the handler it runs within, if any
+// The mutex must be held
+func (r *ObjectReplicator) observeReconcileBytes(handler string, outer *atomic.Int64) {
+	written := r.handlerBytes.Load()
+	r.handlerBytes = outer
+	if outer != nil {
+		outer.Add(written)
+	}
+	r.metrics.reconcileBytes.WithLabelValues(r.Name, handler).Observe(float64(written))
+}
+
+// Returns the reason of an API error, such that the RBAC misconfigurations,
+// the throttling and the conflicts with other writers can be told apart
+func errorReason(err error) string {
+	switch {
+	case errors.IsConflict(err):
+		return "conflict"
+	case errors.IsAlreadyExists(err):
+		return "already_exists"
+	case errors.IsForbidden(err), errors.IsUnauthorized(err):
+		return "forbidden"
+	case errors.IsNotFound(err):
+		return "not_found"
+	case errors.IsTimeout(err), errors.IsServerTimeout(err):
+		return "timeout"
+	case errors.IsTooManyRequests(err):
+		return "too_many_requests"
+	case errors.IsInvalid(err), errors.IsBadRequest(err):
+		return "invalid"
+	default:
+		return "other"
+	}
+}
+
+// lastSyncs tracks when each source was last successfully synced to all its targets, and the failing ones
+// It is shared with the metrics collector, so it is safe for concurrent use
+type lastSyncs struct {
+	mutex   sync.Mutex
+	times   map[string]time.Time
+	// the count of targets out of sync of each failing source
+	failing map[string]int
+	// the last sync while no source was failing
+	healthy time.Time
+}
+
+func newLastSyncs() *lastSyncs {
+	return &lastSyncs{
+		times:   map[string]time.Time{},
+		failing: map[string]int{},
+	}
+}
+
+// Set records a successful sync of the source
+func (s *lastSyncs) Set(key string, t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.times[key] = t
+	delete(s.failing, key)
+	if len(s.failing) == 0 {
+		s.healthy = t
+	}
+}
+
+// Fail records a failed sync of the source, with the count of its targets out of sync
+func (s *lastSyncs) Fail(key string, outOfSync int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing[key] = outOfSync
+}
+
+// Delete forgets about the source
+func (s *lastSyncs) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.times, key)
+	delete(s.failing, key)
+}
+
+// Failing returns the count of failing sources, of their targets out of sync,
+// and the last sync while no source was failing, zero if none
+func (s *lastSyncs) Failing() (int, int, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	targets := 0
+	for _, outOfSync := range s.failing {
+		targets += outOfSync
+	}
+	return len(s.failing), targets, s.healthy
+}
+
+// Get returns when the source was last successfully synced
+func (s *lastSyncs) Get(key string) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok := s.times[key]
+	return t, ok
+}
+
+// Ages returns the number of seconds since the last sync of every source
+func (s *lastSyncs) Ages(now time.Time) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ages := make([]float64, 0, len(s.times))
+	for _, t := range s.times {
+		ages = append(ages, now.Sub(t).Seconds())
+	}
+	return ages
+}
+
+// buckets of the staleness histogram, from 1 minute to 1 day
+var stalenessBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}
+
+// stalenessCollector computes the staleness and the failures of all the sources at scrape time
+// A histogram across sources is exported instead of one gauge per source,
+// to keep the cardinality low on clusters with many sources
+// The failures are exported as gauges for the alerting rules, 0 when all is well
+type stalenessCollector struct {
+	mutex     sync.Mutex
+	syncs     map[string]*lastSyncs
+	histogram *prometheus.Desc
+	max       *prometheus.Desc
+	failing   *prometheus.Desc
+	outOfSync *prometheus.Desc
+	healthy   *prometheus.Desc
+}
+
+func newStalenessCollector() *stalenessCollector {
+	return &stalenessCollector{
+		syncs:     map[string]*lastSyncs{},
+		histogram: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "source_staleness_seconds"),
+			"Seconds since the last successful sync of each source to all its targets.",
+			[]string{"resource"}, nil,
+		),
+		max:       prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "source_staleness_max_seconds"),
+			"Seconds since the last successful sync of the stalest source.",
+			[]string{"resource"}, nil,
+		),
+		failing:   prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "sources_failing"),
+			"Sources whose last sync failed for any of their targets.",
+			[]string{"resource"}, nil,
+		),
+		outOfSync: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "targets_out_of_sync"),
+			"Targets whose last sync with their source failed.",
+			[]string{"resource"}, nil,
+		),
+		healthy:   prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "last_successful_resync_timestamp_seconds"),
+			"When a source was last synced while no source was failing, such as by the periodic resyncs.",
+			[]string{"resource"}, nil,
+		),
+	}
+}
+
+// Registers the sync times of a replicator, replacing any previous one with the same resource
+func (c *stalenessCollector) register(resource string, syncs *lastSyncs) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.syncs[resource] = syncs
+}
+
+func (c *stalenessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.histogram
+	ch <- c.max
+	ch <- c.failing
+	ch <- c.outOfSync
+	ch <- c.healthy
+}
+
+func (c *stalenessCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for resource, syncs := range c.syncs {
+		ages := syncs.Ages(now)
+		buckets := make(map[float64]uint64, len(stalenessBuckets))
+		sum := 0.0
+		max := 0.0
+		for _, age := range ages {
+			sum += age
+			if age > max {
+				max = age
+			}
+			for _, bucket := range stalenessBuckets {
+				if age <= bucket {
+					buckets[bucket]++
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(c.histogram, uint64(len(ages)), sum, buckets, resource)
+		ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, max, resource)
+		failing, outOfSync, healthy := syncs.Failing()
+		ch <- prometheus.MustNewConstMetric(c.failing, prometheus.GaugeValue, float64(failing), resource)
+		ch <- prometheus.MustNewConstMetric(c.outOfSync, prometheus.GaugeValue, float64(outOfSync), resource)
+		if !healthy.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.healthy, prometheus.GaugeValue, float64(healthy.Unix()), resource)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package replicate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func histogramCount(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	metric := &dto.Metric{}
+	require.NoError(t, histogram.WithLabelValues(labels...).(prometheus.Metric).Write(metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func histogramSum(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) float64 {
+	metric := &dto.Metric{}
+	require.NoError(t, histogram.WithLabelValues(labels...).(prometheus.Metric).Write(metric))
+	return metric.GetHistogram().GetSampleSum()
+}
+
+func counterValue(t *testing.T, counter *prometheus.CounterVec, labels ...string) float64 {
+	metric := &dto.Metric{}
+	require.NoError(t, counter.WithLabelValues(labels...).(prometheus.Metric).Write(metric))
+	return metric.GetCounter().GetValue()
+}
+
+func TestMetrics_durations(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	r.Name = "metrics"
+
+	added := histogramCount(t, r.metrics.reconcileDuration, "metrics", "object_added")
+	deleted := histogramCount(t, r.metrics.reconcileDuration, "metrics", "object_deleted")
+	installs := histogramCount(t, r.metrics.actionDuration, "metrics", "install")
+	deletes := histogramCount(t, r.metrics.actionDuration, "metrics", "delete")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, added+1, histogramCount(t, r.metrics.reconcileDuration, "metrics", "object_added"))
+	assert.Equal(t, installs+1, histogramCount(t, r.metrics.actionDuration, "metrics", "install"))
+
+	source = deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(source)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, deleted+1, histogramCount(t, r.metrics.reconcileDuration, "metrics", "object_deleted"))
+	assert.Equal(t, deletes+1, histogramCount(t, r.metrics.actionDuration, "metrics", "delete"))
+}
+
+func TestMetrics_lastSyncs(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	synced, ok := r.lastSyncs.Get("source-ns/source")
+	assert.True(t, ok, "source synced")
+
+	other := updateObject(r, "target-ns", "other", M{})
+	r.ObjectAdded(other)
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/other",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	failed, ok := r.lastSyncs.Get("source-ns/source")
+	assert.True(t, ok, "source still tracked")
+	assert.Equal(t, synced, failed, "failed sync not recorded")
+	failing, outOfSync, healthy := r.lastSyncs.Failing()
+	assert.Equal(t, 1, failing)
+	assert.Equal(t, 1, outOfSync)
+	assert.Equal(t, synced, healthy, "last healthy sync")
+
+	source = deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(source)
+	_, ok = r.lastSyncs.Get("source-ns/source")
+	assert.False(t, ok, "deleted source not tracked")
+	failing, _, _ = r.lastSyncs.Failing()
+	assert.Zero(t, failing, "deleted source not failing")
+}
+
+func TestMetrics_staleness(t *testing.T) {
+	collector := newStalenessCollector()
+	syncs := newLastSyncs()
+	collector.register("test", syncs)
+	now := time.Now()
+	syncs.Set("ns/fresh", now.Add(-10*time.Second))
+	syncs.Set("ns/stale", now.Add(-2*time.Hour))
+	// the last sync before the failures
+	syncs.Fail("ns/stale", 3)
+	syncs.Fail("ns/broken", 0)
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	found := 0
+	for _, family := range families {
+		switch family.GetName() {
+		case "k8s_replicator_source_staleness_seconds":
+			found++
+			histogram := family.GetMetric()[0].GetHistogram()
+			assert.Equal(t, uint64(2), histogram.GetSampleCount())
+			for _, bucket := range histogram.GetBucket() {
+				if bucket.GetUpperBound() == 60 {
+					assert.Equal(t, uint64(1), bucket.GetCumulativeCount(), "fresh bucket")
+				} else if bucket.GetUpperBound() == 86400 {
+					assert.Equal(t, uint64(2), bucket.GetCumulativeCount(), "day bucket")
+				}
+			}
+		case "k8s_replicator_source_staleness_max_seconds":
+			found++
+			assert.InDelta(t, 7200, family.GetMetric()[0].GetGauge().GetValue(), 60)
+		case "k8s_replicator_sources_failing":
+			found++
+			assert.Equal(t, 2.0, family.GetMetric()[0].GetGauge().GetValue())
+		case "k8s_replicator_targets_out_of_sync":
+			found++
+			assert.Equal(t, 3.0, family.GetMetric()[0].GetGauge().GetValue())
+		case "k8s_replicator_last_successful_resync_timestamp_seconds":
+			found++
+			assert.Equal(t, float64(now.Add(-2*time.Hour).Unix()), family.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+	assert.Equal(t, 5, found, "metric families")
+}
+
+func TestMetrics_bytesWritten(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	r.Name = "metrics"
+	written := counterValue(t, r.metrics.bytesWritten, "metrics")
+	sizes := histogramCount(t, r.metrics.objectSize, "metrics")
+	reconciles := histogramCount(t, r.metrics.reconcileBytes, "metrics", "object_added")
+	reconciled := histogramSum(t, r.metrics.reconcileBytes, "metrics", "object_added")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target1,target-ns/target2",
+	})
+	size := len(source.Data)
+	require.NotZero(t, size)
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, written+float64(2*size), counterValue(t, r.metrics.bytesWritten, "metrics"))
+	assert.Equal(t, sizes+2, histogramCount(t, r.metrics.objectSize, "metrics"))
+	assert.Equal(t, reconciles+1, histogramCount(t, r.metrics.reconcileBytes, "metrics", "object_added"))
+	assert.Equal(t, reconciled+float64(2*size), histogramSum(t, r.metrics.reconcileBytes, "metrics", "object_added"))
+	assert.Nil(t, r.handlerBytes, "not counted once the handler ended")
+
+	// the writes of the nested handlers are counted in the outer one, not the background ones
+	outer := r.countHandlerBytes()
+	inner := r.countHandlerBytes()
+	r.observeWritten(source)
+	r.observeReconcileBytes("namespace_added", inner)
+	r.observeSize(source)
+	r.observeWritten(source)
+	r.observeReconcileBytes("object_added", outer)
+	assert.Equal(t, reconciles+2, histogramCount(t, r.metrics.reconcileBytes, "metrics", "object_added"))
+	assert.Equal(t, reconciled+float64(4*size), histogramSum(t, r.metrics.reconcileBytes, "metrics", "object_added"))
+	reconciles++
+	reconciled += float64(2 * size)
+	written += float64(3 * size)
+
+	// nothing written
+	r.ObjectAdded(getObject(r, "source-ns", "source"))
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, written+float64(2*size), counterValue(t, r.metrics.bytesWritten, "metrics"))
+	assert.Equal(t, reconciles+2, histogramCount(t, r.metrics.reconcileBytes, "metrics", "object_added"))
+	assert.Equal(t, reconciled+float64(2*size), histogramSum(t, r.metrics.reconcileBytes, "metrics", "object_added"))
+}
+
+func TestMetrics_errorReason(t *testing.T) {
+	resource := schema.GroupResource{Resource: "secrets"}
+	assert.Equal(t, "conflict", errorReason(errors.NewConflict(resource, "name", fmt.Errorf("conflict"))))
+	assert.Equal(t, "already_exists", errorReason(errors.NewAlreadyExists(resource, "name")))
+	assert.Equal(t, "forbidden", errorReason(errors.NewForbidden(resource, "name", fmt.Errorf("denied"))))
+	assert.Equal(t, "not_found", errorReason(errors.NewNotFound(resource, "name")))
+	assert.Equal(t, "timeout", errorReason(errors.NewServerTimeout(resource, "update", 1)))
+	assert.Equal(t, "too_many_requests", errorReason(errors.NewTooManyRequests("throttled", 1)))
+	assert.Equal(t, "other", errorReason(fmt.Errorf("failed")))
+}
+
+func TestMetrics_apiErrors(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	r.Name = "metrics"
+	actions := r.ReplicatorActions.(*testActions)
+	conflicts := counterValue(t, r.metrics.apiErrors, "metrics", "install", "conflict")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	actions.Conflicts = map[string]int{"target-ns/target": 1}
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, conflicts+1, counterValue(t, r.metrics.apiErrors, "metrics", "install", "conflict"))
+}
@@ -0,0 +1,99 @@
+// Migration of the annotations from a prefix to another one, without running the informers
+
+package replicate
+
+import (
+	"sort"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// AnnotationsMigration describes a migration of the annotations of a prefix to another one
+type AnnotationsMigration struct {
+	// the prefix of the migrated annotations, such as "replicator.v1.mittwald.de"
+	From    string
+	// the prefix they are migrated to, empty for no prefix
+	To      string
+	// only logs the objects that would be migrated
+	DryRun  bool
+	// waited for before each update, nil to not limit them
+	Limiter flowcontrol.RateLimiter
+}
+
+// AnnotationsMigrator is implemented by the replicators able to migrate the annotations of their objects
+type AnnotationsMigrator interface {
+	storeLoader
+	// migrates the annotations of all the objects once, returns the count of migrated and of failed objects
+	MigrateAnnotations(migration AnnotationsMigration) (int, int)
+}
+
+// Returns the migrated annotations, by their name with the prefix migrated from
+func (m AnnotationsMigration) annotations() map[string]string {
+	annotations := map[string]string{}
+	for _, legacy := range legacyAnnotations(m.From, normalizePrefix(m.To)) {
+		annotations[legacy.name] = legacy.annotation
+	}
+	return annotations
+}
+
+// Returns a copy of the annotations with the migrated ones renamed, and true if any was migrated
+// An annotation already set with the new prefix has precedence, the migrated one is only removed
+func migrateAnnotations(annotations map[string]string, migrated map[string]string) (map[string]string, bool) {
+	result := cloneSMap(annotations)
+	changed := false
+	for from, to := range migrated {
+		if value, ok := annotations[from]; ok {
+			if _, ok := annotations[to]; !ok {
+				result[to] = value
+			}
+			delete(result, from)
+			changed = true
+		}
+	}
+	return result, changed
+}
+
+// MigrateAnnotations rewrites the annotations of all the objects, sources and targets, from a prefix to another one
+// The stores must be filled, either by the informers or by LoadStores
+// Returns the count of migrated objects, or to migrate when dry-running, and of failed ones
+func (r *ObjectReplicator) MigrateAnnotations(migration AnnotationsMigration) (int, int) {
+	migrated := migration.annotations()
+	keys := r.objectStore.ListKeys()
+	sort.Strings(keys)
+	count := 0
+	failed := 0
+	for _, key := range keys {
+		object, exists, err := r.objectStore.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		annotations, ok := migrateAnnotations(r.prefixes.untranslated(r.GetMeta(object).Annotations), migrated)
+		if !ok {
+			continue
+		}
+		count++
+		if migration.DryRun {
+			r.logger.Info("would migrate annotations", "object", key, "from", migration.From, "to", migration.To)
+			continue
+		}
+		if migration.Limiter != nil {
+			migration.Limiter.Accept()
+		}
+		// not the shadowed update, the legacy annotations are explicitly migrated
+		ctx, cancel := r.requestContext(r.ctx)
+		update, err := r.translateResult(r.ReplicatorActions.Update(ctx, r.client, object, nil, annotations))
+		cancel()
+		r.audit("migrate", "", key, update, err)
+		if err == nil {
+			err = r.objectStore.Update(update)
+		}
+		if err != nil {
+			r.logger.Error(err, "could not migrate annotations", "object", key)
+			failed++
+		} else {
+			r.logger.Info("migrated annotations", "object", key, "from", migration.From, "to", migration.To)
+		}
+	}
+	r.logger.Info("migrated annotations", "objects", count, "failedObjects", failed, "dryRun", migration.DryRun)
+	return count, failed
+}
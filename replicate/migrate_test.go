@@ -0,0 +1,99 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMigrateAnnotations(t *testing.T) {
+	migrated := AnnotationsMigration{From: "old/", To: "new"}.annotations()
+	assert.Equal(t, "new/replicate-from", migrated["old/replicate-from"])
+	assert.Equal(t, "new/replicated-by", migrated["old/replicated-by"])
+	migrated = AnnotationsMigration{From: MittwaldPrefix, To: "new"}.annotations()
+	assert.Equal(t, map[string]string{
+		MittwaldPrefix + "/replicate-from":                 "new/replicate-from",
+		MittwaldPrefix + "/replicate-to":                   "new/replicate-to-namespaces",
+		MittwaldPrefix + "/replication-allowed":            "new/replication-allowed",
+		MittwaldPrefix + "/replication-allowed-namespaces": "new/replication-allowed-namespaces",
+	}, migrated)
+
+	annotations, ok := migrateAnnotations(M{"other": "value"}, migrated)
+	assert.False(t, ok)
+	assert.Equal(t, M{"other": "value"}, annotations)
+	annotations, ok = migrateAnnotations(M{
+		MittwaldPrefix + "/replicate-from":      "source-ns/old",
+		MittwaldPrefix + "/replication-allowed": "true",
+		"new/replicate-from":                    "source-ns/new",
+	}, migrated)
+	assert.True(t, ok)
+	assert.Equal(t, M{
+		"new/replicate-from":      "source-ns/new",
+		"new/replication-allowed": "true",
+	}, annotations, "the new annotations have precedence")
+}
+
+func TestMigrateAnnotations_objects(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{Prefixes: []string{"new"}}, "source-ns", "target-ns")
+	updateObject(r, "source-ns", "source", M{
+		"old/replication-allowed": "true",
+	})
+	updateObject(r, "target-ns", "target", M{
+		"old/replicate-from":          "source-ns/source",
+		"old/replicated-from-version": "0",
+	})
+	updateObject(r, "target-ns", "other", M{
+		"new/replicate-from": "source-ns/source",
+	})
+
+	migration := AnnotationsMigration{From: "old", To: "new", DryRun: true}
+	count, failed := r.MigrateAnnotations(migration)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 0, failed)
+	requireActionsLength(t, r, 0)
+
+	migration.DryRun = false
+	count, failed = r.MigrateAnnotations(migration)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 0, failed)
+	requireActionsLength(t, r, 2)
+	assertAction(t, r, 0, &testAction{
+		Action: "update",
+		Object: testObject{
+			Type: "0",
+			Meta: metav1.ObjectMeta{
+				Name:            "source",
+				Namespace:       "source-ns",
+				ResourceVersion: "0",
+				Annotations: M{
+					"new/replication-allowed": "true",
+				},
+			},
+		},
+	})
+	assertAction(t, r, 1, &testAction{
+		Action: "update",
+		Object: testObject{
+			Type: "1",
+			Meta: metav1.ObjectMeta{
+				Name:            "target",
+				Namespace:       "target-ns",
+				ResourceVersion: "1",
+				Annotations: M{
+					"new/replicate-from":          "source-ns/source",
+					"new/replicated-from-version": "0",
+				},
+			},
+		},
+	})
+	assert.Equal(t, M{
+		ReplicateFromAnnotation:         "source-ns/source",
+		ReplicatedFromVersionAnnotation: "0",
+	}, getObject(r, "target-ns", "target").Meta.Annotations)
+
+	// nothing left to migrate
+	count, failed = r.MigrateAnnotations(migration)
+	assert.Equal(t, 0, count)
+	requireActionsLength(t, r, 2)
+}
@@ -0,0 +1,107 @@
+// Creation of the missing namespaces of the explicit targets, and the targets of the terminating namespaces
+
+package replicate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the delay before a source with targets in a terminating namespace is handled again
+const terminatingNamespaceDelay = 30 * time.Second
+
+// ParseNamespacePatterns parses comma separated names or patterns of namespaces, each matching whole names
+func ParseNamespacePatterns(value string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, ns := range strings.Split(value, ",") {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(`^(?:` + ns + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %s: %s", ns, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Returns true if the missing namespace of an explicit target may be created,
+// only the namespaces matching the creatable patterns are, such that no source creates arbitrary namespaces
+func (r *ReplicatorProps) namespaceCreatable(namespace string) bool {
+	if !r.CreateNamespaces {
+		return false
+	}
+	for _, pattern := range r.CreatableNamespaces {
+		if pattern.MatchString(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates the missing namespace of an explicit target, with the namespace labels
+// Returns true if the namespace now exists, even if created meanwhile by someone else
+// The namespace store is filled by the informer, the targets are then handled again as in any added namespace
+func (r *ObjectReplicator) createNamespace(sourceObject interface{}, namespace string) bool {
+	source := metaKey(r.GetMeta(sourceObject))
+	labels := make(map[string]string, len(r.NamespaceLabels))
+	for key, value := range r.NamespaceLabels {
+		labels[key] = value
+	}
+	ctx, cancel := r.requestContext(r.ctx)
+	defer cancel()
+	var err error
+	r.unlocked(func() {
+		_, err = r.client.CoreV1().Namespaces().Create(ctx, &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   namespace,
+				Labels: labels,
+			},
+		}, metav1.CreateOptions{})
+	})
+	if errors.IsAlreadyExists(err) {
+		return true
+	}
+	r.audit("create-namespace", source, namespace, nil, err)
+	if err != nil {
+		r.logger.Error(err, "could not create namespace", "source", source, "namespace", namespace)
+		r.warning(sourceObject, ReasonFailed, "could not create namespace %s: %s", namespace, err)
+		r.stats.actionDone(err)
+		return false
+	}
+	r.logger.Info("namespace created", "source", source, "namespace", namespace, "action", "create-namespace")
+	r.event(sourceObject, v1.EventTypeNormal, ReasonNamespaceCreated, "created namespace %s", namespace)
+	return true
+}
+
+// Returns true if the namespace is being deleted, then no target can be created in it
+// The namespaces watched as metadata only have no phase, but their deletion timestamp
+func (r *ObjectReplicator) namespaceTerminating(namespace string) bool {
+	object, exists, err := r.namespaceStore.GetByKey(namespace)
+	if err != nil || !exists {
+		return false
+	}
+	if typed, ok := object.(*v1.Namespace); ok && typed.Status.Phase == v1.NamespaceTerminating {
+		return true
+	}
+	meta, ok := object.(metav1.Object)
+	return ok && meta.GetDeletionTimestamp() != nil
+}
+
+// Skips a target in a terminating namespace, without failure, and handles its source again later,
+// until the namespace is gone or created again
+func (r *ObjectReplicator) deferTerminating(target string, sourceObject interface{}) {
+	source := metaKey(r.GetMeta(sourceObject))
+	r.logger.Info("installation is deferred", "source", source, "target", target, "reason", "namespace is terminating")
+	r.metrics.terminatingDeferred.WithLabelValues(r.Name).Inc()
+	if r.queue != nil {
+		r.queue.AddAfter(queueItem{key: source}, terminatingNamespaceDelay)
+	}
+}
@@ -0,0 +1,85 @@
+package replicate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreateNamespaces(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "missing-ns/target",
+	})
+	// cancelled by default
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 0)
+
+	client := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing-ns"},
+	})
+	creatable, err := ParseNamespacePatterns("missing-ns,existing-ns")
+	require.NoError(t, err)
+	r = createTestReplicator(t, ReplicatorOptions{
+		CreateNamespaces:    true,
+		CreatableNamespaces: creatable,
+		NamespaceLabels:     M{"team": "platform"},
+	}, "source-ns")
+	r.client = client
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "missing-ns/target,existing-ns/target,kube-system/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	assert.NotNil(t, getObject(r, "missing-ns", "target"))
+	assert.NotNil(t, getObject(r, "existing-ns", "target"), "created meanwhile")
+	assert.Nil(t, getObject(r, "kube-system", "target"), "not creatable")
+	namespace, err := client.CoreV1().Namespaces().Get(context.TODO(), "missing-ns", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, M{"team": "platform"}, namespace.Labels)
+	_, err = client.CoreV1().Namespaces().Get(context.TODO(), "kube-system", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err), "not created")
+	assert.Equal(t, 0, r.Status().FailedActions)
+
+	plan, err := r.Plan("source-ns/source")
+	require.NoError(t, err)
+	assert.Len(t, plan.Unchanged, 2)
+	assert.Empty(t, plan.Actions, "not creatable")
+	assert.Contains(t, r.Permissions(), Permission{Verb: "create", Resource: "namespaces"})
+}
+
+func TestTerminatingNamespaces(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns")
+	r.initQueue()
+	now := metav1.Now()
+	require.NoError(t, r.namespaceStore.Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "deleted-ns", DeletionTimestamp: &now},
+	}))
+	require.NoError(t, r.namespaceStore.Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "terminating-ns"},
+		Status:     v1.NamespaceStatus{Phase: v1.NamespaceTerminating},
+	}))
+	assert.True(t, r.namespaceTerminating("deleted-ns"))
+	assert.True(t, r.namespaceTerminating("terminating-ns"))
+	assert.False(t, r.namespaceTerminating("source-ns"))
+	assert.False(t, r.namespaceTerminating("missing-ns"))
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "deleted-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 0)
+	assert.Equal(t, 0, r.Status().FailedActions)
+
+	// created again
+	addNamespace(r, "deleted-ns")
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	assert.NotNil(t, getObject(r, "deleted-ns", "target"))
+}
@@ -0,0 +1,142 @@
+// Batched notifications of replication failures to a chat webhook
+
+package replicate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// maximum count of distinct pending notifications, further ones are dropped
+const maxPendingNotifications = 1000
+
+// Notification is a replication failure to notify
+type Notification struct {
+	Resource string `json:"resource"`
+	Object   string `json:"object"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+	// how many times it happened since the last batch
+	Count    int    `json:"count"`
+}
+
+// Notifier batches the notifications and sends them periodically to a webhook
+// The payload has a "text" field, compatible with Slack and similar incoming webhooks
+type Notifier struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+	mutex    sync.Mutex
+	pending  []*Notification
+	// index of the pending notifications, by resource, object, reason and message
+	index    map[string]*Notification
+	dropped  int
+	logger   logr.Logger
+}
+
+// NewWebhookNotifier creates a notifier sending a batch to the url at each interval
+func NewWebhookNotifier(url string, interval time.Duration, logger logr.Logger) *Notifier {
+	return &Notifier{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		interval: interval,
+		index:    map[string]*Notification{},
+		logger:   logger,
+	}
+}
+
+// Notify adds a notification to the next batch
+// Identical notifications are counted once
+func (n *Notifier) Notify(notification Notification) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	key := strings.Join([]string{notification.Resource, notification.Object, notification.Reason, notification.Message}, "\n")
+	if pending, ok := n.index[key]; ok {
+		pending.Count++
+		return
+	}
+	if len(n.pending) >= maxPendingNotifications {
+		n.dropped++
+		return
+	}
+	notification.Count = 1
+	n.pending = append(n.pending, &notification)
+	n.index[key] = &notification
+}
+
+// Run sends the batches until stopped
+// It returns once stopped, after sending the last batch, such that a shutdown does not lose it
+func (n *Notifier) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if err := n.Flush(); err != nil {
+				n.logger.Error(err, "could not send the last notifications", "url", n.url)
+			}
+			return
+		case <-ticker.C:
+			if err := n.Flush(); err != nil {
+				n.logger.Error(err, "could not send notifications", "url", n.url)
+			}
+		}
+	}
+}
+
+type webhookPayload struct {
+	Text          string          `json:"text"`
+	Notifications []*Notification `json:"notifications"`
+	Dropped       int             `json:"dropped,omitempty"`
+}
+
+// Flush sends the pending notifications, if any
+// On failure, the notifications are lost, to avoid flooding the webhook
+func (n *Notifier) Flush() error {
+	n.mutex.Lock()
+	pending := n.pending
+	dropped := n.dropped
+	n.pending = nil
+	n.index = map[string]*Notification{}
+	n.dropped = 0
+	n.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	lines := []string{fmt.Sprintf("k8s-replicator: %d replication failures", len(pending)+dropped)}
+	for _, notification := range pending {
+		line := fmt.Sprintf("- %s %s: %s: %s", notification.Resource, notification.Object, notification.Reason, notification.Message)
+		if notification.Count > 1 {
+			line = fmt.Sprintf("%s (x%d)", line, notification.Count)
+		}
+		lines = append(lines, line)
+	}
+	if dropped > 0 {
+		lines = append(lines, fmt.Sprintf("- and %d more", dropped))
+	}
+	data, err := json.Marshal(webhookPayload{
+		Text:          strings.Join(lines, "\n"),
+		Notifications: pending,
+		Dropped:       dropped,
+	})
+	if err != nil {
+		return err
+	}
+	response, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", response.Status)
+	}
+	return nil
+}
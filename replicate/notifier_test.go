@@ -0,0 +1,92 @@
+package replicate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifier(t *testing.T) {
+	payloads := []webhookPayload{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload := webhookPayload{}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(server.URL, time.Minute, logr.Discard())
+	r := createTestReplicator(t, ReplicatorOptions{
+		Notifier: notifier,
+	}, "source-ns", "target-ns")
+
+	require.NoError(t, notifier.Flush())
+	assert.Len(t, payloads, 0, "nothing to send")
+
+	source := updateObject(r, "source-ns", "source", M{})
+	r.ObjectAdded(source)
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(target)
+	r.ObjectAdded(target)
+	require.NoError(t, notifier.Flush())
+	require.Len(t, payloads, 1)
+	notifications := payloads[0].Notifications
+	require.Len(t, notifications, 1, "notified once per action")
+	assert.Equal(t, Notification{
+		Resource: "test",
+		Object:   "source-ns/source",
+		Reason:   ReasonNotAllowed,
+		Message:  "replication to target-ns/target: source source-ns/source does not explicitely allow replication",
+		Count:    2,
+	}, *notifications[0])
+	assert.Contains(t, payloads[0].Text, "1 replication failures")
+
+	require.NoError(t, notifier.Flush())
+	assert.Len(t, payloads, 1, "batch already sent")
+}
+
+func TestNotifierRun(t *testing.T) {
+	payloads := make(chan webhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload := webhookPayload{}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+		payloads <- payload
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(server.URL, time.Hour, logr.Discard())
+	notifier.Notify(Notification{
+		Resource: "test",
+		Object:   "source-ns/source",
+		Reason:   ReasonFailed,
+		Message:  "failed",
+	})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		notifier.Run(stop)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "not stopped")
+	}
+	// the last batch is sent before returning
+	select {
+	case payload := <-payloads:
+		require.Len(t, payload.Notifications, 1)
+		assert.Equal(t, "source-ns/source", payload.Notifications[0].Object)
+	default:
+		require.Fail(t, "last batch not sent")
+	}
+}
@@ -0,0 +1,181 @@
+// Construction of the replicators with functional options
+
+package replicate
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// DefaultResyncPeriod is the resynchronization period of the replicators without WithResyncPeriod
+const DefaultResyncPeriod = 30 * time.Minute
+
+// Option configures a replicator on construction
+type Option func(*ReplicatorConfig)
+
+// ReplicatorConfig is the configuration of a replicator, set by its options
+type ReplicatorConfig struct {
+	// the options of the replicator
+	Options      ReplicatorOptions
+	// the resynchronization period of the objects
+	ResyncPeriod time.Duration
+	// the recorder for the events, instead of the one of the client, nil to disable events
+	Recorder     record.EventRecorder
+	// the registry the metrics are registered with, nil to not export them
+	Registerer   prometheus.Registerer
+	// the logger of the replicator, its resource name is added as value
+	Logger       logr.Logger
+	// true once the recorder is set, even to nil
+	recorderSet  bool
+}
+
+// NewReplicatorConfig returns the configuration of a replicator, set by the options in order
+func NewReplicatorConfig(opts ...Option) ReplicatorConfig {
+	config := ReplicatorConfig{
+		ResyncPeriod: DefaultResyncPeriod,
+		Logger:       mustNewLogger("info", "text", os.Stderr),
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// NewProps returns the common replicator properties of a replicator of this configuration
+// Its metrics are registered with the registry of the configuration, if any, an error if they cannot be
+func (c ReplicatorConfig) NewProps(client kubernetes.Interface, name string) (ReplicatorProps, error) {
+	metrics, err := c.newMetrics(name)
+	if err != nil {
+		return ReplicatorProps{}, err
+	}
+	return c.newProps(client, name, metrics), nil
+}
+
+// NewObjectReplicator returns a replicator of this configuration, with the actions of its kind of objects
+// Its stores are not initialized, an error if its metrics cannot be registered
+func (c ReplicatorConfig) NewObjectReplicator(client kubernetes.Interface, name string, actions ReplicatorActions) (*ObjectReplicator, error) {
+	metrics, err := c.newMetrics(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReplicator{
+		ReplicatorProps:   c.newProps(client, name, metrics),
+		ReplicatorActions: actions,
+	}, nil
+}
+
+// Returns the metrics of a replicator, registered with the registry of the configuration, if any
+func (c ReplicatorConfig) newMetrics(name string) (*replicatorMetrics, error) {
+	metrics := newReplicatorMetrics()
+	if c.Registerer != nil {
+		if err := c.registerMetrics(metrics); err != nil {
+			return nil, fmt.Errorf("could not register the metrics of the %s replicator: %s", name, err)
+		}
+	}
+	return metrics, nil
+}
+
+// Returns the common replicator properties, with the metrics of the replicator
+func (c ReplicatorConfig) newProps(client kubernetes.Interface, name string, metrics *replicatorMetrics) ReplicatorProps {
+	recorder := c.Recorder
+	if !c.recorderSet && client != nil {
+		recorder = newEventRecorder(client)
+	}
+	logger := c.Logger.WithValues("resource", name)
+	return newReplicatorProps(client, name, c.Options, recorder, logger, metrics)
+}
+
+// Registers the metrics of a replicator with the registry, and the ones of the components it shares with the others
+func (c ReplicatorConfig) registerMetrics(metrics *replicatorMetrics) error {
+	if err := metrics.register(c.Registerer); err != nil {
+		return err
+	}
+	collectors := []prometheus.Collector{}
+	if sink, ok := c.Logger.GetSink().(*rateLimitSink); ok {
+		collectors = append(collectors, sink.history.suppressed)
+	}
+	if c.Options.Clusters != nil {
+		collectors = append(collectors, c.Options.Clusters.metrics.healthy, c.Options.Clusters.metrics.lag)
+	}
+	if c.Options.Decrypter != nil {
+		collectors = append(collectors, c.Options.Decrypter.decryptions)
+	}
+	for _, collector := range collectors {
+		if err := registerShared(c.Registerer, collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithOptions sets all the options of the replicator, the options given after it override them
+func WithOptions(options ReplicatorOptions) Option {
+	return func(c *ReplicatorConfig) {
+		c.Options = options
+	}
+}
+
+// WithResyncPeriod sets the resynchronization period of the objects
+func WithResyncPeriod(period time.Duration) Option {
+	return func(c *ReplicatorConfig) {
+		c.ResyncPeriod = period
+	}
+}
+
+// WithLabels sets the labels to add to the created resources
+func WithLabels(labels map[string]string) Option {
+	return func(c *ReplicatorConfig) {
+		c.Options.Labels = labels
+	}
+}
+
+// WithNamespaceSelector only replicates the sources of the namespaces matching the selector
+func WithNamespaceSelector(selector labels.Selector) Option {
+	return func(c *ReplicatorConfig) {
+		c.Options.NamespaceSelector = selector
+	}
+}
+
+// WithHooks adds hooks called after each action on a target, after the hooks already added
+func WithHooks(hooks Hooks) Option {
+	return func(c *ReplicatorConfig) {
+		c.Options.Hooks = c.Options.Hooks.with(hooks)
+	}
+}
+
+// WithClock tells the time of the replications, of the soak periods and of the backoffs with the clock
+func WithClock(clock Clock) Option {
+	return func(c *ReplicatorConfig) {
+		c.Options.Clock = clock
+	}
+}
+
+// WithEventRecorder records the events with the recorder, nil to disable events
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(c *ReplicatorConfig) {
+		c.Recorder = recorder
+		c.recorderSet = true
+	}
+}
+
+// WithMetricsRegistry registers the metrics with the registry, such as the default one or the one of an embedding operator
+// The metrics are not exported without it
+func WithMetricsRegistry(registerer prometheus.Registerer) Option {
+	return func(c *ReplicatorConfig) {
+		c.Registerer = registerer
+	}
+}
+
+// WithLogger logs with the logger, instead of at the info level as text to the standard error
+func WithLogger(logger logr.Logger) Option {
+	return func(c *ReplicatorConfig) {
+		c.Logger = logger
+	}
+}
@@ -0,0 +1,113 @@
+package replicate
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNewReplicatorConfig(t *testing.T) {
+	config := NewReplicatorConfig()
+	assert.Equal(t, DefaultResyncPeriod, config.ResyncPeriod)
+	assert.Nil(t, config.Registerer)
+
+	config = NewReplicatorConfig(
+		WithLabels(M{"first": "true"}),
+		WithOptions(ReplicatorOptions{AllowAll: true, Labels: M{"options": "true"}}),
+		WithLabels(M{"last": "true"}),
+		WithResyncPeriod(time.Hour),
+	)
+	assert.True(t, config.Options.AllowAll)
+	assert.Equal(t, M{"last": "true"}, config.Options.Labels, "in order")
+	assert.Equal(t, time.Hour, config.ResyncPeriod)
+
+	client := fake.NewSimpleClientset()
+	props, err := NewReplicatorConfig().NewProps(client, "test")
+	require.NoError(t, err)
+	assert.NotNil(t, props.recorder)
+	props, err = NewReplicatorConfig(WithEventRecorder(nil)).NewProps(client, "test")
+	require.NoError(t, err)
+	assert.Nil(t, props.recorder, "disabled")
+	recorder := record.NewFakeRecorder(10)
+	props, err = NewReplicatorConfig(WithEventRecorder(recorder)).NewProps(client, "test")
+	require.NoError(t, err)
+	assert.Same(t, recorder, props.recorder)
+
+	r := newTestSecretReplicator(t, client, WithResyncPeriod(time.Hour), WithLabels(M{"team": "platform"}))
+	assert.Equal(t, M{"team": "platform"}, r.Labels)
+	assert.Equal(t, time.Hour, r.objectResyncPeriod)
+}
+
+func TestWithMetricsRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	configMaps := newTestConfigMapReplicator(t, fake.NewSimpleClientset(), WithMetricsRegistry(registry))
+	secrets := newTestSecretReplicator(t, fake.NewSimpleClientset(), WithMetricsRegistry(registry))
+	assert.Same(t, configMaps.metrics.writesSkipped, secrets.metrics.writesSkipped, "shared by the replicators of the registry")
+	assert.Same(t, configMaps.metrics.staleness, secrets.metrics.staleness)
+	secrets.metrics.writesSkipped.WithLabelValues("secret").Inc()
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, "k8s_replicator_writes_skipped_total")
+	assert.Contains(t, names, "k8s_replicator_source_staleness_seconds", "of both replicators")
+
+	other := newTestConfigMapReplicator(t, fake.NewSimpleClientset())
+	assert.False(t, configMaps.metrics.writesSkipped == other.metrics.writesSkipped, "not registered without the option")
+
+	// a conflicting metric is an error
+	conflicting := prometheus.NewRegistry()
+	require.NoError(t, conflicting.Register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_replicator_writes_skipped_total",
+		Help: "Another metric.",
+	})))
+	_, err = NewConfigMapReplicator(fake.NewSimpleClientset(), WithMetricsRegistry(conflicting))
+	assert.ErrorContains(t, err, "could not register the metrics of the configMap replicator")
+}
+
+func TestWithLogger(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := NewLogger("info", "json", buffer)
+	require.NoError(t, err)
+	r := newTestConfigMapReplicator(t, fake.NewSimpleClientset(), WithLogger(logger))
+	r.logger.Info("handled")
+	_, err = r.ReplicatorActions.Install(r.ctx, r.client, &metav1.ObjectMeta{Namespace: "ns", Name: "name"}, nil, &v1.ConfigMap{})
+	require.NoError(t, err)
+	lines := logLines(t, buffer)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "configMap", lines[0]["resource"])
+	assert.Equal(t, "installing configMap", lines[1]["msg"], "logged by the actions with the logger of the context")
+	assert.Equal(t, "configMap", lines[1]["resource"])
+}
+
+func TestWithNamespaceSelector(t *testing.T) {
+	selector, err := labels.Parse("team=platform")
+	require.NoError(t, err)
+	r := createTestReplicator(t, ReplicatorOptions{NamespaceSelector: selector}, "source-ns", "target-ns")
+	require.NoError(t, r.namespaceStore.Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "platform-ns", Labels: M{"team": "platform"}},
+	}))
+	assert.True(t, r.ownsSource("platform-ns/source"))
+	assert.False(t, r.ownsSource("source-ns/source"))
+	assert.False(t, r.ownsSource("missing-ns/source"))
+
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	}))
+	requireActionsLength(t, r, 0)
+	r.ObjectAdded(updateObject(r, "platform-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	}))
+	requireActionsLength(t, r, 1)
+}
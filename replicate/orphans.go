@@ -0,0 +1,161 @@
+// Periodic collection of the targets left behind by their source
+
+package replicate
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// The policies applied to the orphaned targets
+const (
+	// OrphanDelete deletes the orphaned targets, as if their source had been deleted
+	OrphanDelete = "delete"
+	// OrphanDisown removes the replication annotations, keeping the targets and their data
+	OrphanDisown = "disown"
+	// OrphanIgnore only logs the orphaned targets
+	OrphanIgnore = "ignore"
+)
+
+// ValidateOrphanPolicy returns an error if the policy is unknown
+func ValidateOrphanPolicy(policy string) error {
+	switch policy {
+	case OrphanDelete, OrphanDisown, OrphanIgnore:
+		return nil
+	}
+	return fmt.Errorf("unknown orphan policy, expected %s, %s or %s", OrphanDelete, OrphanDisown, OrphanIgnore)
+}
+
+// Returns why a replicate-to target is orphaned, empty if it is not
+func (r *ObjectReplicator) orphanReason(object interface{}) string {
+	meta := r.GetMeta(object)
+	source, ok := meta.Annotations[ReplicatedByAnnotation]
+	if !ok {
+		return ""
+	}
+	sourceObject, exists, err := r.objectStore.GetByKey(source)
+	if err != nil {
+		return ""
+	} else if !exists {
+		return "source does not exist"
+	}
+	// invalid annotations are reported by the source itself
+	if ok, err := r.isReplicatedTo(r.GetMeta(sourceObject), meta); err == nil && !ok {
+		return "source is not replicated to target"
+	}
+	return ""
+}
+
+// Finds the targets whose source does not exist or does not target them anymore,
+// and applies the orphan policy to them, without holding the mutex across the writes
+// Returns how many orphans were found
+func (r *ObjectReplicator) collectOrphans() int {
+	orphans := r.findOrphans()
+	for _, object := range orphans {
+		r.collectOrphan(object)
+	}
+	return len(orphans)
+}
+
+// Returns the orphaned targets to apply the orphan policy to, the deletions being deferred while not allowed yet
+func (r *ObjectReplicator) findOrphans() []interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	orphans := []interface{}{}
+	for _, object := range r.objectStore.List() {
+		reason := r.orphanReason(object)
+		if reason == "" {
+			continue
+		}
+		meta := r.GetMeta(object)
+		key := metaKey(meta)
+		source := meta.Annotations[ReplicatedByAnnotation]
+		if !r.ownsSource(source) || r.checkManagedBy(meta) != nil {
+			continue
+		}
+		r.logger.Info("target is orphaned", "source", source, "target", key, "reason", reason, "policy", r.OrphanPolicy)
+		// handled again once all the caches are filled, or once not degraded anymore
+		if r.OrphanPolicy != OrphanDelete {
+		} else if r.StartupGate.holdBack(r.Name+"/"+key, func() { r.enqueue(queueItem{key: key}) }) {
+			r.metrics.startupHeldActions.WithLabelValues(r.Name, "delete").Inc()
+			continue
+		} else if r.deleteSuspended(key) {
+			continue
+		}
+		orphans = append(orphans, object)
+	}
+	return orphans
+}
+
+// Applies the orphan policy to an orphaned target, without the mutex
+// The write fails on the preconditions if the target changed since found, it is then handled again
+func (r *ObjectReplicator) collectOrphan(object interface{}) {
+	defer r.runHooks()
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	source := meta.Annotations[ReplicatedByAnnotation]
+	ctx, cancel := r.requestContext(r.ctx)
+	defer cancel()
+	start := time.Now()
+	var newObject interface{}
+	var err error
+	switch r.OrphanPolicy {
+	case OrphanDelete:
+		err = r.Delete(ctx, r.client, object)
+		r.observeAction("delete", start, err)
+		r.audit("delete", source, key, nil, err)
+		r.callHooks("delete", source, nil, meta, err)
+	case OrphanDisown:
+		annotations := cloneSMap(meta.Annotations)
+		for annotation := range r.prefixes.owned(meta.Annotations) {
+			delete(annotations, annotation)
+		}
+		newObject, err = r.Update(ctx, r.client, object, object, annotations)
+		r.observeAction("disown", start, err)
+		r.audit("disown", source, key, newObject, err)
+	default:
+		return
+	}
+	r.stats.actionDone(err)
+	if err != nil {
+		r.logger.Error(err, "could not collect orphaned target", "target", key, "policy", r.OrphanPolicy)
+		r.warning(object, ReasonFailed, "could not %s: %s", r.OrphanPolicy, err)
+		if isConflict(err) && r.queue != nil {
+			r.enqueue(queueItem{key: key})
+		}
+		return
+	}
+	r.metrics.orphansCollected.WithLabelValues(r.Name, r.OrphanPolicy).Inc()
+	// update the object store in advance
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if newObject == nil {
+		r.event(object, v1.EventTypeNormal, ReasonDeleted, "deleted")
+		err = r.objectStore.Delete(object)
+	} else {
+		r.event(newObject, v1.EventTypeNormal, ReasonDisowned, "disowned, source %s does not target it anymore", source)
+		err = r.objectStore.Update(newObject)
+	}
+	if err != nil {
+		r.logger.Error(err, "could not update store", "target", key)
+	}
+}
+
+// Periodically collects the orphaned targets, once synced
+func (r *ObjectReplicator) runOrphanCollection(stop <-chan struct{}) {
+	if r.OrphanGCInterval <= 0 {
+		return
+	}
+	wait.Until(func() {
+		// the sources may not be listed yet
+		if !r.Ready() {
+			return
+		}
+		if count := r.collectOrphans(); count > 0 {
+			r.logger.Info("orphaned targets collected", "count", count)
+		}
+	}, r.OrphanGCInterval, stop)
+}
@@ -0,0 +1,98 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOrphanPolicy(t *testing.T) {
+	assert.NoError(t, ValidateOrphanPolicy(OrphanDelete))
+	assert.NoError(t, ValidateOrphanPolicy(OrphanDisown))
+	assert.NoError(t, ValidateOrphanPolicy(OrphanIgnore))
+	assert.Error(t, ValidateOrphanPolicy("other"))
+}
+
+// Creates a source replicated to "target-ns/target", and three targets:
+// one still targeted, one not targeted anymore and one whose source does not exist
+func createOrphans(r *ObjectReplicator) {
+	updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	updateObject(r, "target-ns", "target", M{
+		ReplicatedByAnnotation: "source-ns/source",
+	})
+	updateObject(r, "other-ns", "target", M{
+		ReplicatedByAnnotation: "source-ns/source",
+	})
+	updateObject(r, "target-ns", "deleted", M{
+		ReplicatedByAnnotation: "source-ns/missing",
+		"other/annotation":     "other",
+	})
+}
+
+func TestCollectOrphans_delete(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{OrphanPolicy: OrphanDelete})
+	createOrphans(r)
+	assert.Equal(t, 2, r.collectOrphans())
+	requireActionsLength(t, r, 2)
+	for _, action := range r.ReplicatorActions.(*testActions).Actions {
+		assert.Equal(t, "delete", action.Action)
+	}
+	assertStore(t, r, "target-ns", "target", "1")
+	assertStore(t, r, "other-ns", "target", "")
+	assertStore(t, r, "target-ns", "deleted", "")
+	// nothing left
+	assert.Equal(t, 0, r.collectOrphans())
+	requireActionsLength(t, r, 2)
+}
+
+func TestCollectOrphans_disown(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{OrphanPolicy: OrphanDisown})
+	createOrphans(r)
+	assert.Equal(t, 2, r.collectOrphans())
+	requireActionsLength(t, r, 2)
+	for _, action := range r.ReplicatorActions.(*testActions).Actions {
+		assert.Equal(t, "update", action.Action)
+		assert.NotContains(t, action.Object.Meta.Annotations, ReplicatedByAnnotation)
+	}
+	// the data and the other annotations are kept
+	object := getObject(r, "target-ns", "deleted")
+	require.NotNil(t, object)
+	assert.Equal(t, "3", object.Data)
+	assert.Equal(t, M{"other/annotation": "other"}, object.Meta.Annotations)
+	assert.Equal(t, 0, r.collectOrphans())
+}
+
+func TestCollectOrphans_ignore(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{OrphanPolicy: OrphanIgnore})
+	createOrphans(r)
+	assert.Equal(t, 2, r.collectOrphans())
+	requireActionsLength(t, r, 0)
+}
+
+func TestCollectOrphans_managedBy(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{OrphanPolicy: OrphanDelete, ControllerID: "test"})
+	updateObject(r, "target-ns", "target", M{
+		ReplicatedByAnnotation: "source-ns/missing",
+		ManagedByAnnotation:    "other",
+	})
+	assert.Equal(t, 0, r.collectOrphans())
+	requireActionsLength(t, r, 0)
+}
+
+func TestCollectOrphans_conflict(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{OrphanPolicy: OrphanDelete})
+	r.initQueue()
+	createOrphans(r)
+	r.ReplicatorActions.(*testActions).Conflicts = map[string]int{"other-ns/target": 1}
+	assert.Equal(t, 2, r.collectOrphans())
+	requireActionsLength(t, r, 2)
+	assertStore(t, r, "other-ns", "target", "2")
+	assertStore(t, r, "target-ns", "deleted", "")
+	// changed since found, handled again as any target
+	assert.Equal(t, 1, r.queue.Len())
+	require.True(t, r.processNextItem())
+	assertStore(t, r, "other-ns", "target", "")
+}
@@ -0,0 +1,70 @@
+// Paginated listing of the objects
+
+package replicate
+
+import (
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Returns a list watcher listing the objects page by page,
+// such that each request, and each response, is bounded by the page size
+// The pages are still gathered into one list, as the reflector replaces its store with it,
+// so the memory of the whole list is not reduced
+func pagedListWatch(lw cache.ListerWatcher, pageSize int64, logger logr.Logger) cache.ListerWatcher {
+	if pageSize <= 0 {
+		return lw
+	}
+	return &cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			return listPages(lw, lo, pageSize, logger)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return lw.Watch(lo)
+		},
+		// already paged
+		DisableChunking: true,
+	}
+}
+
+// Lists all the objects page by page
+// Returns a list of all the items, with the resource version of the last page
+func listPages(lw cache.ListerWatcher, lo metav1.ListOptions, pageSize int64, logger logr.Logger) (runtime.Object, error) {
+	options := lo
+	// the watch cache ignores the pages, so read from etcd
+	options.ResourceVersion = ""
+	options.Limit = pageSize
+	options.Continue = ""
+	result := &metav1.List{}
+	for {
+		page, err := lw.List(options)
+		// the first page is too old, list everything at once
+		if err != nil && options.Continue != "" && errors.IsResourceExpired(err) {
+			logger.Info("list pages expired, listing all at once", "error", err.Error())
+			return lw.List(lo)
+		} else if err != nil {
+			return nil, err
+		}
+		list, err := meta.ListAccessor(page)
+		if err != nil {
+			return nil, err
+		}
+		err = meta.EachListItem(page, func(object runtime.Object) error {
+			result.Items = append(result.Items, runtime.RawExtension{Object: object})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if list.GetContinue() == "" {
+			result.ResourceVersion = list.GetResourceVersion()
+			return result, nil
+		}
+		options.Continue = list.GetContinue()
+	}
+}
@@ -0,0 +1,87 @@
+package replicate
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Serves 5 configMaps, by pages when asked
+func pagesListWatch(requests *[]metav1.ListOptions, expired bool) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			*requests = append(*requests, lo)
+			start := 0
+			if lo.Continue != "" {
+				if expired {
+					return nil, errors.NewResourceExpired("too old")
+				}
+				fmt.Sscanf(lo.Continue, "%d", &start)
+			}
+			end := 5
+			if lo.Limit > 0 && start+int(lo.Limit) < end {
+				end = start + int(lo.Limit)
+			}
+			list := &v1.ConfigMapList{}
+			list.ResourceVersion = fmt.Sprintf("%d", 10+len(*requests))
+			for i := start; i < end; i++ {
+				list.Items = append(list.Items, v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: fmt.Sprintf("cm%d", i)},
+				})
+			}
+			if end < 5 {
+				list.Continue = fmt.Sprintf("%d", end)
+			}
+			return list, nil
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+		DisableChunking: true,
+	}
+}
+
+func TestPagedListWatch(t *testing.T) {
+	requests := []metav1.ListOptions{}
+	lw := pagedListWatch(pagesListWatch(&requests, false), 2, logr.Discard())
+	list, err := lw.List(metav1.ListOptions{ResourceVersion: "0", Limit: 500})
+	require.NoError(t, err)
+	require.Len(t, requests, 3)
+	assert.Equal(t, metav1.ListOptions{Limit: 2}, requests[0])
+	assert.Equal(t, metav1.ListOptions{Limit: 2, Continue: "2"}, requests[1])
+	assert.Equal(t, metav1.ListOptions{Limit: 2, Continue: "4"}, requests[2])
+	items, err := meta.ExtractList(list)
+	require.NoError(t, err)
+	require.Len(t, items, 5)
+	assert.Equal(t, "cm4", items[4].(*v1.ConfigMap).Name)
+	accessor, err := meta.ListAccessor(list)
+	require.NoError(t, err)
+	assert.Equal(t, "13", accessor.GetResourceVersion())
+
+	// disabled
+	requests = []metav1.ListOptions{}
+	lw = pagedListWatch(pagesListWatch(&requests, false), 0, logr.Discard())
+	_, err = lw.List(metav1.ListOptions{ResourceVersion: "0"})
+	require.NoError(t, err)
+	assert.Equal(t, []metav1.ListOptions{{ResourceVersion: "0"}}, requests)
+}
+
+func TestPagedListWatch_expired(t *testing.T) {
+	requests := []metav1.ListOptions{}
+	lw := pagedListWatch(pagesListWatch(&requests, true), 2, logr.Discard())
+	list, err := lw.List(metav1.ListOptions{ResourceVersion: "0"})
+	require.NoError(t, err)
+	require.Len(t, requests, 3)
+	assert.Equal(t, metav1.ListOptions{ResourceVersion: "0"}, requests[2])
+	assert.Len(t, list.(*v1.ConfigMapList).Items, 5)
+}
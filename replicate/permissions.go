@@ -0,0 +1,179 @@
+// Check of the permissions the controller needs, with SelfSubjectAccessReviews
+
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Permission is a verb the controller needs on a resource, in all the namespaces if no namespace
+type Permission struct {
+	Verb        string `json:"verb"`
+	Group       string `json:"group"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+}
+
+// String displays the permission as "verb resource.group/subresource in namespace"
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Namespace == "" {
+		return fmt.Sprintf("%s %s in all namespaces", p.Verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %s", p.Verb, resource, p.Namespace)
+}
+
+// PermissionsRequirer is implemented by the replicators able to list the permissions they need
+type PermissionsRequirer interface {
+	// lists the permissions needed to run the replicator
+	Permissions() []Permission
+}
+
+// MissingPermissionsError lists the permissions denied to the controller
+type MissingPermissionsError []Permission
+
+func (e MissingPermissionsError) Error() string {
+	missing := make([]string, len(e))
+	for i, permission := range e {
+		missing[i] = permission.String()
+	}
+	return fmt.Sprintf("missing permissions: %s", strings.Join(missing, ", "))
+}
+
+// Returns a permission for each verb
+func permissions(group string, resource string, namespace string, verbs ...string) []Permission {
+	permissions := make([]Permission, len(verbs))
+	for i, verb := range verbs {
+		permissions[i] = Permission{
+			Verb:      verb,
+			Group:     group,
+			Resource:  resource,
+			Namespace: namespace,
+		}
+	}
+	return permissions
+}
+
+// Permissions lists the permissions needed to run the replicator,
+// including the ones of the remote clusters, the SealedSecrets and the TLS references
+func (r *ObjectReplicator) Permissions() []Permission {
+	needed := permissions("", strings.ToLower(r.Name)+"s", "",
+		"get", "list", "watch", "create", "update", "patch", "delete")
+	needed = append(needed, permissions("", "namespaces", "", "get", "list", "watch")...)
+	if r.CreateNamespaces {
+		needed = append(needed, permissions("", "namespaces", "", "create")...)
+	}
+	if r.recorder != nil {
+		needed = append(needed, permissions("", "events", "", "create", "patch")...)
+	}
+	if r.Clusters != nil {
+		needed = append(needed, r.Clusters.permissions()...)
+	}
+	if r.SealedSecrets != nil {
+		needed = append(needed, r.SealedSecrets.permissions()...)
+	}
+	if r.TLSReferences != nil {
+		needed = append(needed, permissions("", "secrets", r.TLSReferences.namespace, "list", "watch")...)
+		needed = append(needed, permissions("networking.k8s.io", "ingresses", "", "list", "watch")...)
+		needed = append(needed, permissions(gatewayResource.Group, gatewayResource.Resource, "", "list", "watch")...)
+	}
+	if r.statusResources != nil {
+		needed = append(needed, permissions(ClusterResourceGroup, "replicationstatuses", "", "list", "get", "create", "delete")...)
+		needed = append(needed, Permission{
+			Verb:        "update",
+			Group:       ClusterResourceGroup,
+			Resource:    "replicationstatuses",
+			Subresource: "status",
+		})
+	}
+	return needed
+}
+
+// Returns the permissions needed to read the remote clusters, and report their status
+// The ReplicationClusters reference their kubeconfig secrets in any namespace
+func (c *Clusters) permissions() []Permission {
+	needed := []Permission{}
+	if c.namespace != "" {
+		needed = append(needed, permissions("", "secrets", c.namespace, "list")...)
+	}
+	if c.resources != nil {
+		needed = append(needed, permissions(ClusterResourceGroup, "replicationclusters", "", "list")...)
+		needed = append(needed, permissions("", "secrets", "", "get")...)
+		needed = append(needed, Permission{
+			Verb:        "update",
+			Group:       ClusterResourceGroup,
+			Resource:    "replicationclusters",
+			Subresource: "status",
+		})
+	}
+	return needed
+}
+
+// Returns the permissions needed to list the SealedSecrets, and to replicate them
+func (s *SealedSecrets) permissions() []Permission {
+	group := strings.SplitN(SealedSecretAPIVersion, "/", 2)[0]
+	if s.replicateSealed {
+		return permissions(group, "sealedsecrets", "", "get", "list", "watch", "create", "update", "delete")
+	}
+	return permissions(group, "sealedsecrets", "", "get", "list", "watch")
+}
+
+// Permissions lists the permissions needed to restore and save the checkpoints, none for a file
+func (c *Checkpoints) Permissions() []Permission {
+	if c.path != "" {
+		return []Permission{}
+	}
+	return permissions("", "configmaps", c.namespace, "get", "create", "update")
+}
+
+// CheckPermissions reviews the permissions with SelfSubjectAccessReviews, and returns the denied ones
+// The duplicated permissions are only reviewed once, the denied ones logged with the logger of the context
+func CheckPermissions(ctx context.Context, client kubernetes.Interface, permissions []Permission) ([]Permission, error) {
+	logger := logr.FromContextOrDiscard(ctx)
+	denied := []Permission{}
+	reviewed := map[Permission]bool{}
+	for _, permission := range permissions {
+		if reviewed[permission] {
+			continue
+		}
+		reviewed[permission] = true
+		review := &authorizationv1.SelfSubjectAccessReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: authorizationv1.SchemeGroupVersion.String(),
+				Kind:       "SelfSubjectAccessReview",
+			},
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   permission.Namespace,
+					Verb:        permission.Verb,
+					Group:       permission.Group,
+					Resource:    permission.Resource,
+					Subresource: permission.Subresource,
+				},
+			},
+		}
+		result, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not review permission to %s: %s", permission, err)
+		}
+		if !result.Status.Allowed {
+			logger.V(debugLevel).Info("permission denied", "permission", permission.String(), "reason", result.Status.Reason)
+			denied = append(denied, permission)
+		}
+	}
+	return denied, nil
+}
@@ -0,0 +1,72 @@
+package replicate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestPermissionString(t *testing.T) {
+	assert.Equal(t, "list secrets in all namespaces", Permission{Verb: "list", Resource: "secrets"}.String())
+	assert.Equal(t, "update replicationclusters.replicator.olli.ai/status in namespace ns", Permission{
+		Verb:        "update",
+		Group:       ClusterResourceGroup,
+		Resource:    "replicationclusters",
+		Subresource: "status",
+		Namespace:   "ns",
+	}.String())
+	err := MissingPermissionsError{{Verb: "get", Resource: "secrets"}, {Verb: "list", Resource: "namespaces"}}
+	assert.EqualError(t, err, "missing permissions: get secrets in all namespaces, list namespaces in all namespaces")
+}
+
+func TestReplicatorPermissions(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{})
+	r.Name = "configMap"
+	needed := r.Permissions()
+	assert.Contains(t, needed, Permission{Verb: "delete", Resource: "configmaps"})
+	assert.Contains(t, needed, Permission{Verb: "watch", Resource: "namespaces"})
+	assert.NotContains(t, needed, Permission{Verb: "list", Group: "bitnami.com", Resource: "sealedsecrets"})
+
+	r.SealedSecrets = NewSealedSecrets(fake.NewSimpleClientset(), nil, time.Minute, true, logr.Discard())
+	r.Clusters = NewClusters(fake.NewSimpleClientset(), "clusters", "hub", time.Minute, false, logr.Discard())
+	needed = r.Permissions()
+	assert.Contains(t, needed, Permission{Verb: "create", Group: "bitnami.com", Resource: "sealedsecrets"})
+	assert.Contains(t, needed, Permission{Verb: "list", Resource: "secrets", Namespace: "clusters"})
+	assert.NotContains(t, needed, Permission{Verb: "get", Resource: "secrets"})
+	r.Clusters = NewClusters(fake.NewSimpleClientset(), "", "hub", time.Minute, true, logr.Discard())
+	assert.Contains(t, r.Permissions(), Permission{Verb: "get", Resource: "secrets"}, "the kubeconfig secrets of the ReplicationClusters")
+
+	checkpoints, err := NewCheckpoints(fake.NewSimpleClientset(), "configmap:replicator/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	assert.Contains(t, checkpoints.Permissions(), Permission{Verb: "update", Resource: "configmaps", Namespace: "replicator"})
+	checkpoints, err = NewCheckpoints(fake.NewSimpleClientset(), "/tmp/checkpoint", time.Minute, logr.Discard())
+	require.NoError(t, err)
+	assert.Empty(t, checkpoints.Permissions())
+}
+
+func TestCheckPermissions(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	reviews := 0
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Verb != "delete"
+		return true, review, nil
+	})
+	denied, err := CheckPermissions(context.TODO(), client, []Permission{
+		{Verb: "get", Resource: "secrets"},
+		{Verb: "delete", Resource: "secrets"},
+		{Verb: "get", Resource: "secrets"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Permission{{Verb: "delete", Resource: "secrets"}}, denied)
+	assert.Equal(t, 2, reviews, "reviewed once")
+}
@@ -0,0 +1,241 @@
+// Preview of the actions the replicators would perform for a source, without performing them
+
+package replicate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The kinds of planned actions
+const (
+	// PlanCreate is a missing target which would be created
+	PlanCreate = "create"
+	// PlanUpdate is a target whose data or annotations would be updated, or cleared
+	PlanUpdate = "update"
+	// PlanDelete is a target which would be deleted
+	PlanDelete = "delete"
+	// PlanSkip is a target which would not be replicated, because it is not replicated from the source, or is invalid
+	PlanSkip = "skip"
+)
+
+// PlannedAction is an action a replicator would perform on a target
+type PlannedAction struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Reason string `json:"reason"`
+}
+
+// Plan lists the actions a replicator would perform for a source
+type Plan struct {
+	Resource  string          `json:"resource"`
+	Source    string          `json:"source"`
+	Actions   []PlannedAction `json:"actions"`
+	// the targets already up-to-date
+	Unchanged []string        `json:"unchanged"`
+}
+
+// Planner is implemented by the replicators able to plan their actions
+type Planner interface {
+	storeLoader
+	// lists the actions the replicator would perform for the source, without performing them
+	Plan(source string) (Plan, error)
+}
+
+// Plan lists the actions the replicator would perform for the source, as "namespace/name", without performing them
+// The stores must be filled, either by the informers or by LoadStores
+func (r *ObjectReplicator) Plan(source string) (Plan, error) {
+	if !strings.Contains(source, "/") || !validPath.MatchString(source) {
+		return Plan{}, fmt.Errorf("invalid source %s: expected namespace/name", source)
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	plan := Plan{
+		Resource:  r.Name,
+		Source:    source,
+		Actions:   []PlannedAction{},
+		Unchanged: []string{},
+	}
+	action := func(kind string, target string, format string, args ...interface{}) {
+		plan.Actions = append(plan.Actions, PlannedAction{
+			Action: kind,
+			Target: target,
+			Reason: fmt.Sprintf(format, args...),
+		})
+	}
+	get := func(key string) (interface{}, *metav1.ObjectMeta) {
+		if object, exists, err := r.objectStore.GetByKey(key); err == nil && exists {
+			return object, r.GetMeta(object)
+		}
+		return nil, nil
+	}
+
+	sourceObject, sourceMeta := get(source)
+	// the source is deleted, so are its targets, and the ones replicating from it are cleared
+	if sourceMeta == nil {
+		for _, target := range r.targetsTo(source).sorted() {
+			action(PlanDelete, target, "source does not exist")
+		}
+		for _, target := range r.targetsFrom(source).sorted() {
+			if _, targetMeta := get(target); targetMeta.Annotations[ReplicatedFromVersionAnnotation] != "" {
+				action(PlanUpdate, target, "source does not exist, target is cleared")
+			} else {
+				plan.Unchanged = append(plan.Unchanged, target)
+			}
+		}
+		return plan, nil
+	}
+
+	// the targets replicating from the source, with the replicate-from annotation
+	for _, target := range r.targetsFrom(source).sorted() {
+		targetObject, targetMeta := get(target)
+		_, replicated := targetMeta.Annotations[ReplicatedFromVersionAnnotation]
+		if ok, nok, err := r.isReplicationAllowed(targetMeta, sourceMeta); !ok && !nok {
+			action(PlanSkip, target, "%s", err)
+		} else if !ok && replicated {
+			action(PlanUpdate, target, "replication is not allowed, target is cleared: %s", err)
+		} else if !ok {
+			plan.Unchanged = append(plan.Unchanged, target)
+		} else if ok, err := r.hasSourceData(targetObject, sourceObject); err != nil {
+			action(PlanSkip, target, "%s", err)
+		} else if !ok {
+			action(PlanUpdate, target, "data differs from source")
+		} else {
+			plan.Unchanged = append(plan.Unchanged, target)
+		}
+	}
+
+	// the targets the source is replicated to, with the replicate-to annotations, unless a target itself
+	expected := keySet{}
+	var targetPatterns []targetPattern
+	namespaces := r.namespaceStore.ListKeys()
+	existingNamespaces := newKeySet(namespaces...)
+	if _, isTarget := sourceMeta.Annotations[ReplicatedByAnnotation]; !isTarget {
+		var targets []string
+		var err error
+		if targets, targetPatterns, err = r.getReplicationTargets(sourceMeta); err != nil {
+			return plan, err
+		}
+		for _, target := range targets {
+			if ns := strings.SplitN(target, "/", 2)[0]; existingNamespaces[ns] || r.namespaceCreatable(ns) {
+				expected[target] = true
+			}
+		}
+		for _, pattern := range targetPatterns {
+			for _, target := range pattern.Targets(namespaces) {
+				expected[target] = true
+			}
+		}
+		delete(expected, source)
+	}
+	_, okFrom := sourceMeta.Annotations[ReplicateFromAnnotation]
+	for _, target := range expected.sorted() {
+		targetObject, targetMeta := get(target)
+		if ns := strings.SplitN(target, "/", 2)[0]; targetMeta == nil && !existingNamespaces[ns] && r.namespaceCreatable(ns) {
+			action(PlanCreate, target, "target and its namespace do not exist")
+		} else if targetMeta == nil {
+			action(PlanCreate, target, "target does not exist")
+		} else if ok, err := r.isReplicatedBy(targetMeta, sourceMeta); !ok {
+			action(PlanSkip, target, "%s", err)
+		} else if okFrom {
+			if update, err := r.needsFromAnnotationsUpdate(targetMeta, sourceMeta); err != nil {
+				return plan, err
+			} else if update {
+				action(PlanUpdate, target, "replicate-from annotations differ from source")
+			} else {
+				plan.Unchanged = append(plan.Unchanged, target)
+			}
+		} else if ok, err := r.hasSourceData(targetObject, sourceObject); err != nil {
+			action(PlanSkip, target, "%s", err)
+		} else if !ok {
+			action(PlanUpdate, target, "data differs from source")
+		} else {
+			plan.Unchanged = append(plan.Unchanged, target)
+		}
+	}
+Targets:
+	for _, target := range r.targetsTo(source).sorted() {
+		if expected[target] {
+			continue
+		}
+		for _, pattern := range targetPatterns {
+			if pattern.MatchString(target) {
+				continue Targets
+			}
+		}
+		action(PlanDelete, target, "source is not replicated to target anymore")
+	}
+	sort.Strings(plan.Unchanged)
+	return plan, nil
+}
+
+// WritePlans writes the plans, as "text" or "json"
+func WritePlans(writer io.Writer, plans []Plan, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plans)
+	case "text":
+		for _, plan := range plans {
+			if _, err := fmt.Fprintf(writer, "%s %s: %d actions, %d unchanged\n",
+				plan.Resource, plan.Source, len(plan.Actions), len(plan.Unchanged)); err != nil {
+				return err
+			}
+			for _, action := range plan.Actions {
+				if _, err := fmt.Fprintf(writer, "  %-6s %s: %s\n",
+					action.Action, action.Target, action.Reason); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %s, expected text or json", format)
+	}
+}
+
+// PlanHandler serves the plans of the replicators for the source of the "source" query parameter, as JSON
+// The "resource" query parameter filters on a resource, case-insensitive
+type PlanHandler struct {
+	Replicators []Replicator
+}
+
+func (h *PlanHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Set("Allow", http.MethodGet)
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	source := req.URL.Query().Get("source")
+	resource := strings.ToLower(req.URL.Query().Get("resource"))
+	plans := []Plan{}
+	for _, replicator := range h.Replicators {
+		planner, ok := replicator.(Planner)
+		if !ok {
+			continue
+		}
+		plan, err := planner.Plan(source)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if resource == "" || resource == strings.ToLower(plan.Resource) {
+			plans = append(plans, plan)
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Resource < plans[j].Resource
+	})
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+	_ = enc.Encode(plans)
+}
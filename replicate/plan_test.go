@@ -0,0 +1,76 @@
+package replicate
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-1", "target-2", "target-3")
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation:      "target-[12]",
+		ReplicationAllowedAnnotation: "true",
+	}))
+	requireActionsLength(t, r, 2)
+
+	_, err := r.Plan("source")
+	assert.Error(t, err)
+	plan, err := r.Plan("source-ns/source")
+	require.NoError(t, err)
+	assert.Empty(t, plan.Actions)
+	assert.Equal(t, []string{"target-1/source", "target-2/source"}, plan.Unchanged)
+
+	updateObject(r, "target-3", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	updateObject(r, "target-3", "source", M{})
+	updateObject(r, "source-ns", "source", M{
+		ReplicateToNsAnnotation:      "target-[13]",
+		ReplicationAllowedAnnotation: "true",
+	})
+	plan, err = r.Plan("source-ns/source")
+	require.NoError(t, err)
+	assert.Equal(t, []PlannedAction{
+		{Action: PlanUpdate, Target: "target-3/from", Reason: "data differs from source"},
+		{Action: PlanUpdate, Target: "target-1/source", Reason: "data differs from source"},
+		{Action: PlanSkip, Target: "target-3/source", Reason: "target target-3/source was not replicated"},
+		{Action: PlanDelete, Target: "target-2/source", Reason: "source is not replicated to target anymore"},
+	}, plan.Actions)
+	assert.Empty(t, plan.Unchanged)
+	requireActionsLength(t, r, 2)
+
+	deleteObject(r, "source-ns", "source")
+	plan, err = r.Plan("source-ns/source")
+	require.NoError(t, err)
+	assert.Equal(t, []PlannedAction{
+		{Action: PlanDelete, Target: "target-1/source", Reason: "source does not exist"},
+		{Action: PlanDelete, Target: "target-2/source", Reason: "source does not exist"},
+	}, plan.Actions)
+	assert.Equal(t, []string{"target-3/from"}, plan.Unchanged, "never replicated")
+
+	buffer := &bytes.Buffer{}
+	require.NoError(t, WritePlans(buffer, []Plan{plan}, "text"))
+	assert.Equal(t, "test source-ns/source: 2 actions, 1 unchanged\n"+
+		"  delete target-1/source: source does not exist\n"+
+		"  delete target-2/source: source does not exist\n", buffer.String())
+
+	handler := &PlanHandler{Replicators: []Replicator{r}}
+	for query, code := range map[string]int{"?source=source-ns/source": http.StatusOK, "?source=source": http.StatusBadRequest} {
+		req, err := http.NewRequest("GET", "/plan"+query, nil)
+		require.NoError(t, err)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, code, res.Code, query)
+		if code == http.StatusOK {
+			plans := []Plan{}
+			require.NoError(t, json.Unmarshal(res.Body.Bytes(), &plans), query)
+			assert.Equal(t, []Plan{plan}, plans, query)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Pull of the targets from their sources in remote clusters
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Returns the cluster and the source key of the replicate-from-cluster annotation, "<cluster>/<namespace>/<name>"
+func pulledSource(meta *metav1.ObjectMeta) (string, string, error) {
+	annotation := meta.Annotations[ReplicateFromClusterAnnotation]
+	split := strings.SplitN(annotation, "/", 3)
+	if len(split) != 3 || !validName.MatchString(split[0]) || !validName.MatchString(split[1]) || !validName.MatchString(split[2]) {
+		return "", "", fmt.Errorf("target %s has invalid annotation %s \"%s\": expected cluster/namespace/name",
+			metaKey(meta), ReplicateFromClusterAnnotation, annotation)
+	}
+	return split[0], fmt.Sprintf("%s/%s", split[1], split[2]), nil
+}
+
+// Replicates a target from its source in a remote cluster, with the replicate-from-cluster annotation
+// The source is read at each resync, and every clusters interval, since it is not watched
+// The source must allow the replication, as a local one, the target is cleared once it is deleted
+func (r *ObjectReplicator) pullFromCluster(object interface{}) (err error) {
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	name, source, err := pulledSource(meta)
+	if err != nil {
+		r.logger.Error(err, "could not parse", "object", key)
+		r.warning(object, ReasonInvalid, "%s", err)
+		return permanent(err)
+	}
+	if !r.ownsSource(key) {
+		return nil
+	}
+	if r.queue != nil {
+		defer r.queue.AddAfter(queueItem{key: key}, r.Clusters.interval)
+	}
+	cluster := r.Clusters.get(name)
+	if cluster == nil {
+		err := fmt.Errorf("target %s is replicated from unknown cluster %s", key, name)
+		r.logger.Error(err, "replication is cancelled", "target", key, "cluster", name)
+		return permanent(err)
+	}
+	defer func() {
+		cluster.synced(r.pendingKey(key), err)
+	}()
+	split := strings.SplitN(source, "/", 2)
+	ctx, cancel := r.requestContext(r.ctx)
+	sourceObject, err := r.Get(ctx, cluster.client, split[0], split[1])
+	cancel()
+	cluster.record(ignoreNotFound(err), true)
+	if errors.IsNotFound(err) {
+		r.logger.Info("remote source deleted: clearing target", "cluster", name, "source", source, "target", key, "action", "clear")
+		return r.doClearObject(object)
+	} else if err != nil {
+		r.logger.Error(err, "could not get remote source", "cluster", name, "source", source)
+		return err
+	}
+	sourceMeta := r.GetMeta(sourceObject)
+	if allowed, _, err := r.isReplicationAllowed(meta, sourceMeta); !allowed {
+		r.logger.Info("replication is cancelled", "cluster", name, "source", source, "target", key, "reason", err)
+		r.warning(object, ReasonCancelled, "%s", err)
+		return permanent(err)
+	}
+	if err := r.checkManagedBy(meta); err != nil {
+		r.logger.Info("replication is cancelled", "cluster", name, "source", source, "target", key, "reason", err)
+		return permanent(err)
+	}
+	if meta.Annotations[ReplicatedFromVersionAnnotation] == sourceMeta.ResourceVersion &&
+		r.DataChecksum(object) == r.DataChecksum(sourceObject) {
+		return nil
+	}
+	if r.updateHeldBack("pull", key, key) {
+		return nil
+	}
+	annotations := cloneSMap(meta.Annotations)
+	annotations[ReplicatedAtAnnotation] = r.now().Format(time.RFC3339)
+	annotations[ReplicatedFromVersionAnnotation] = sourceMeta.ResourceVersion
+	r.setManagedBy(annotations)
+	r.logger.Info("pulling remote source", "cluster", name, "source", source, "target", key, "action", "update")
+	start := time.Now()
+	ctx, cancel = r.requestContext(r.ctx)
+	newObject, err := r.Update(ctx, r.client, object, sourceObject, annotations)
+	cancel()
+	r.observeAction("update", start, err)
+	r.observeClusterAction(name, r.Name, "pull", err)
+	if err == nil {
+		r.observeWritten(newObject)
+	}
+	r.audit("update", fmt.Sprintf("%s:%s", name, source), key, newObject, err)
+	r.stats.actionDone(err)
+	if err != nil {
+		r.warning(object, ReasonFailed, "could not replicate from %s:%s: %s", name, source, err)
+		return err
+	}
+	r.event(newObject, v1.EventTypeNormal, ReasonUpdated, "updated from %s:%s", name, source)
+	// update the object store in advance
+	return r.objectStore.Update(newObject)
+}
+
+// Returns the error, unless it is a not found error
+func ignoreNotFound(err error) error {
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package replicate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPullFromCluster(t *testing.T) {
+	hub := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations: M{
+				ReplicationAllowedNsAnnotation: "target-ns",
+			},
+		},
+		Data: map[string]string{"key": "value"},
+	})
+	target := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "target-ns",
+			Name:      "target",
+			Annotations: M{
+				ReplicateFromClusterAnnotation: "hub/source-ns/source",
+			},
+		},
+	}
+	local := fake.NewSimpleClientset(target)
+	clusters := createTestClusters(t, map[string]kubernetes.Interface{"hub": hub})
+	r := newTestConfigMapReplicator(t, local, WithOptions(ReplicatorOptions{Clusters: clusters}), WithResyncPeriod(time.Hour))
+	configMapClient := local.CoreV1().ConfigMaps("target-ns")
+
+	require.NoError(t, r.objectStore.Add(target))
+	r.ObjectAdded(target)
+	pulled, err := configMapClient.Get(context.TODO(), "target", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "value", pulled.Data["key"])
+	assert.Equal(t, "1", pulled.Annotations[ReplicatedFromVersionAnnotation])
+	assert.True(t, clusters.Status()[0].Healthy)
+
+	// cleared once the remote source is deleted
+	require.NoError(t, hub.CoreV1().ConfigMaps("source-ns").Delete(context.TODO(), "source", metav1.DeleteOptions{}))
+	r.ObjectAdded(getConfigMap(t, r, "target-ns/target"))
+	cleared, err := configMapClient.Get(context.TODO(), "target", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, cleared.Data)
+	assert.NotContains(t, cleared.Annotations, ReplicatedFromVersionAnnotation)
+}
+
+func TestPullFromCluster_notAllowed(t *testing.T) {
+	hub := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+			Annotations: M{
+				ReplicationAllowedNsAnnotation: "other-ns",
+			},
+		},
+		Data: map[string]string{"key": "value"},
+	})
+	target := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "target-ns",
+			Name:      "target",
+			Annotations: M{
+				ReplicateFromClusterAnnotation: "hub/source-ns/source",
+			},
+		},
+	}
+	local := fake.NewSimpleClientset(target)
+	clusters := createTestClusters(t, map[string]kubernetes.Interface{"hub": hub})
+	r := newTestConfigMapReplicator(t, local, WithOptions(ReplicatorOptions{Clusters: clusters}), WithResyncPeriod(time.Hour))
+
+	require.NoError(t, r.objectStore.Add(target))
+	assert.Error(t, r.pullFromCluster(target))
+	unchanged, err := local.CoreV1().ConfigMaps("target-ns").Get(context.TODO(), "target", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, unchanged.Data)
+
+	target.Annotations[ReplicateFromClusterAnnotation] = "hub/source"
+	assert.Error(t, r.pullFromCluster(target), "invalid annotation")
+}
+
+// Returns the configMap from the store of the replicator
+func getConfigMap(t *testing.T, r *ObjectReplicator, key string) *v1.ConfigMap {
+	object, exists, err := r.objectStore.GetByKey(key)
+	require.NoError(t, err)
+	require.True(t, exists)
+	return object.(*v1.ConfigMap)
+}
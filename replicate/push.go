@@ -0,0 +1,309 @@
+// Push of the sources to their targets in remote clusters
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PushedTargetLabel is the label of the targets pushed to the remote clusters, to find them again after a restart
+const PushedTargetLabel = "replicator.olli.ai/pushed"
+
+// Records an action on a remote target
+func (r *ReplicatorProps) observeClusterAction(cluster string, resource string, action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	r.metrics.clusterActions.WithLabelValues(cluster, resource, action, result).Inc()
+}
+
+// Returns the remote clusters the source is pushed to, from its replicate-to-clusters annotation
+func pushedClusters(meta *metav1.ObjectMeta) ([]string, error) {
+	annotation, ok := meta.Annotations[ReplicateToClustersAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	clusters := []string{}
+	for _, cluster := range strings.Split(annotation, ",") {
+		if cluster = strings.TrimSpace(cluster); cluster == "" {
+		} else if !validName.MatchString(cluster) {
+			return nil, fmt.Errorf("source %s has invalid cluster on annotation %s \"%s\"",
+				metaKey(meta), ReplicateToClustersAnnotation, cluster)
+		} else {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters, nil
+}
+
+// Returns the value of the replicated-from-cluster annotation of the remote targets of the source
+func (r *ObjectReplicator) remoteSource(sourceKey string) string {
+	return fmt.Sprintf("%s/%s", r.Clusters.name, sourceKey)
+}
+
+// Returns the key of the source or target in the pending ones of the remote clusters
+func (r *ObjectReplicator) pendingKey(key string) string {
+	return fmt.Sprintf("%s:%s", r.Name, key)
+}
+
+// Pushes the source to its targets in the remote clusters of its replicate-to-clusters annotation
+// Without replicate-to annotations, the source is pushed with its own namespace and name
+// The targets pushed before but not wanted anymore are deleted, the mutex must be held
+func (r *ObjectReplicator) pushToClusters(result *syncResult, object interface{}, targets []string, targetPatterns []targetPattern) {
+	r.recoverPushed()
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	if !r.ownsSource(key) {
+		return
+	}
+	clusters, err := pushedClusters(meta)
+	if err != nil {
+		r.logger.Error(err, "could not parse", "object", key)
+		result.add(permanent(err))
+		return
+	}
+	// the change of the source is held back, the remote targets are kept as they are
+	if len(clusters) > 0 && r.heldBack(object, "") {
+		return
+	}
+	pushed := map[string]keySet{}
+	for _, name := range clusters {
+		cluster := r.Clusters.get(name)
+		if cluster == nil {
+			err := fmt.Errorf("source %s is replicated to unknown cluster %s", key, name)
+			r.logger.Error(err, "replication is cancelled", "source", key, "cluster", name)
+			result.add(permanent(err))
+			continue
+		}
+		remoteTargets, err := r.remoteTargets(cluster, key, targets, targetPatterns)
+		if err != nil {
+			r.logger.Error(err, "could not list namespaces of cluster", "cluster", name)
+			cluster.record(err, false)
+			cluster.synced(r.pendingKey(key), err)
+			result.add(err)
+			// the targets are unknown, keep the previous ones
+			pushed[name] = r.pushed[key][name]
+			continue
+		}
+		pushed[name] = newKeySet(remoteTargets...)
+		var clusterErr error
+		for _, target := range remoteTargets {
+			err := r.pushTarget(cluster, target, object)
+			if err != nil {
+				clusterErr = err
+			}
+			result.add(err)
+		}
+		cluster.record(clusterErr, true)
+		cluster.synced(r.pendingKey(key), clusterErr)
+	}
+	// delete the targets which are not wanted anymore
+	for name, targets := range r.pushed[key] {
+		if _, ok := pushed[name]; !ok {
+			r.Clusters.get(name).synced(r.pendingKey(key), nil)
+		}
+		for _, target := range targets.sorted() {
+			if !pushed[name][target] {
+				r.unpushTarget(name, target, key)
+			}
+		}
+	}
+	if len(pushed) > 0 {
+		r.pushed[key] = pushed
+	} else {
+		delete(r.pushed, key)
+	}
+}
+
+// Finds the targets pushed to the remote clusters before a restart, from their pushed label and their
+// replicated-from-cluster annotation, once for each cluster, such that the ones not wanted anymore are deleted too
+// The ones of the sources deleted meanwhile are deleted now, the mutex must be held
+func (r *ObjectReplicator) recoverPushed() {
+	lister, ok := r.ReplicatorActions.(ObjectLister)
+	if !ok {
+		return
+	}
+	prefix := r.remoteSource("")
+	for _, name := range r.Clusters.names() {
+		cluster := r.Clusters.get(name)
+		if r.pushRecovered[name] || cluster == nil {
+			continue
+		}
+		ctx, cancel := r.requestContext(r.ctx)
+		objects, err := lister.List(ctx, cluster.client, PushedTargetLabel+"=true")
+		cancel()
+		if err != nil {
+			// recovered on the next push
+			r.logger.Error(err, "could not list pushed targets of cluster", "cluster", name)
+			continue
+		}
+		r.pushRecovered.add(name)
+		deleted := keySet{}
+		for _, object := range objects {
+			meta := r.GetMeta(object)
+			source := meta.Annotations[ReplicatedFromClusterAnnotation]
+			if !strings.HasPrefix(source, prefix) {
+				continue
+			} else if source = strings.TrimPrefix(source, prefix); !r.ownsSource(source) {
+				continue
+			}
+			if r.pushed[source] == nil {
+				r.pushed[source] = map[string]keySet{}
+			}
+			if r.pushed[source][name] == nil {
+				r.pushed[source][name] = keySet{}
+			}
+			r.pushed[source][name].add(metaKey(meta))
+			if _, _, exists, err := r.getFromStore(source); err == nil && !exists {
+				deleted.add(source)
+			}
+		}
+		for _, source := range deleted.sorted() {
+			r.logger.Info("source deleted: deleting remote targets", "source", source, "cluster", name)
+			r.unpushSource(source)
+		}
+	}
+}
+
+// Returns the targets of the source in the existing namespaces of the cluster, known by its namespace informer
+func (r *ObjectReplicator) remoteTargets(cluster *remoteCluster, key string, targets []string, targetPatterns []targetPattern) ([]string, error) {
+	if targets == nil && targetPatterns == nil {
+		targets = []string{key}
+	}
+	namespaces, synced := cluster.namespaceNames()
+	if !synced {
+		return nil, fmt.Errorf("namespaces of cluster %s are not synced yet", cluster.name)
+	}
+	exists := map[string]bool{}
+	for _, namespace := range namespaces {
+		exists[namespace] = true
+	}
+	seen := map[string]bool{}
+	remoteTargets := []string{}
+	for _, target := range targets {
+		if namespace := strings.SplitN(target, "/", 2)[0]; exists[namespace] && !seen[target] {
+			seen[target] = true
+			remoteTargets = append(remoteTargets, target)
+		}
+	}
+	for _, pattern := range targetPatterns {
+		for _, target := range pattern.Targets(namespaces) {
+			if !seen[target] {
+				seen[target] = true
+				remoteTargets = append(remoteTargets, target)
+			}
+		}
+	}
+	return remoteTargets, nil
+}
+
+// Installs or updates the target in the remote cluster, unless already up-to-date
+func (r *ObjectReplicator) pushTarget(cluster *remoteCluster, target string, sourceObject interface{}) error {
+	sourceMeta := r.GetMeta(sourceObject)
+	split := strings.SplitN(target, "/", 2)
+	ctx, cancel := r.requestContext(r.ctx)
+	targetObject, err := r.Get(ctx, cluster.client, split[0], split[1])
+	cancel()
+	if errors.IsNotFound(err) {
+		targetObject = nil
+	} else if err != nil {
+		r.logger.Error(err, "could not get remote target", "cluster", cluster.name, "target", target)
+		return err
+	}
+	annotations := sMap{
+		ReplicatedAtAnnotation:          r.now().Format(time.RFC3339),
+		ReplicatedFromClusterAnnotation: r.remoteSource(metaKey(sourceMeta)),
+		ReplicatedFromVersionAnnotation: sourceMeta.ResourceVersion,
+	}
+	r.setManagedBy(annotations)
+	if targetObject == nil {
+		r.logger.Info("installing remote target", "source", metaKey(sourceMeta), "cluster", cluster.name, "target", target, "action", "install")
+		labels := cloneSMap(r.Labels)
+		labels[PushedTargetLabel] = "true"
+		targetMeta := &metav1.ObjectMeta{
+			Namespace:   split[0],
+			Name:        split[1],
+			Labels:      labels,
+			Annotations: annotations,
+		}
+		r.stampTarget(targetMeta, nil, metaKey(sourceMeta))
+		ctx, cancel = r.requestContext(r.ctx)
+		_, err = r.Install(ctx, cluster.client, targetMeta, sourceObject, sourceObject)
+		cancel()
+		r.observeClusterAction(cluster.name, r.Name, "install", err)
+		r.audit("install", metaKey(sourceMeta), fmt.Sprintf("%s:%s", cluster.name, target), nil, err)
+		return err
+	}
+	targetMeta := r.GetMeta(targetObject)
+	if source := targetMeta.Annotations[ReplicatedFromClusterAnnotation]; source != r.remoteSource(metaKey(sourceMeta)) {
+		err := fmt.Errorf("target %s of cluster %s was not replicated from %s",
+			target, cluster.name, r.remoteSource(metaKey(sourceMeta)))
+		r.logger.Info("replication is cancelled", "source", metaKey(sourceMeta), "cluster", cluster.name, "target", target, "reason", err)
+		return permanent(err)
+	}
+	if err := r.checkManagedBy(targetMeta); err != nil {
+		return permanent(err)
+	}
+	if targetMeta.Annotations[ReplicatedFromVersionAnnotation] == sourceMeta.ResourceVersion &&
+		r.DataChecksum(targetObject) == r.DataChecksum(sourceObject) {
+		return nil
+	}
+	for k, v := range targetMeta.Annotations {
+		if _, ok := annotations[k]; !ok {
+			annotations[k] = v
+		}
+	}
+	r.logger.Info("updating remote target", "source", metaKey(sourceMeta), "cluster", cluster.name, "target", target, "action", "update")
+	ctx, cancel = r.requestContext(r.ctx)
+	_, err = r.Update(ctx, cluster.client, targetObject, sourceObject, annotations)
+	cancel()
+	r.observeClusterAction(cluster.name, r.Name, "update", err)
+	r.audit("update", metaKey(sourceMeta), fmt.Sprintf("%s:%s", cluster.name, target), nil, err)
+	return err
+}
+
+// Deletes the target in the remote cluster, if still replicated from the source
+func (r *ObjectReplicator) unpushTarget(name string, target string, sourceKey string) {
+	cluster := r.Clusters.get(name)
+	if cluster == nil {
+		r.logger.Info("remote target is not deleted", "cluster", name, "target", target, "reason", "unknown cluster")
+		return
+	}
+	split := strings.SplitN(target, "/", 2)
+	ctx, cancel := r.requestContext(r.ctx)
+	targetObject, err := r.Get(ctx, cluster.client, split[0], split[1])
+	cancel()
+	if errors.IsNotFound(err) {
+		return
+	} else if err != nil {
+		r.logger.Error(err, "could not get remote target", "cluster", name, "target", target)
+		return
+	}
+	targetMeta := r.GetMeta(targetObject)
+	if targetMeta.Annotations[ReplicatedFromClusterAnnotation] != r.remoteSource(sourceKey) || r.checkManagedBy(targetMeta) != nil {
+		return
+	}
+	r.logger.Info("deleting remote target", "source", sourceKey, "cluster", name, "target", target, "action", "delete")
+	ctx, cancel = r.requestContext(r.ctx)
+	err = r.Delete(ctx, cluster.client, targetObject)
+	cancel()
+	r.observeClusterAction(name, r.Name, "delete", err)
+	r.audit("delete", sourceKey, fmt.Sprintf("%s:%s", name, target), nil, err)
+	cluster.record(err, true)
+}
+
+// Deletes all the remote targets of a deleted source, the mutex must be held
+func (r *ObjectReplicator) unpushSource(key string) {
+	for name, targets := range r.pushed[key] {
+		for _, target := range targets.sorted() {
+			r.unpushTarget(name, target, key)
+		}
+	}
+	delete(r.pushed, key)
+}
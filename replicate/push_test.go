@@ -0,0 +1,147 @@
+package replicate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPushToClusters(t *testing.T) {
+	remote := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "target-ns"}},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "target-ns", Name: "existing"}},
+	)
+	clusters := createTestClusters(t, map[string]kubernetes.Interface{"remote": remote})
+	r := newTestConfigMapReplicator(t, fake.NewSimpleClientset(), WithOptions(ReplicatorOptions{Clusters: clusters}), WithResyncPeriod(time.Hour))
+	configMapClient := remote.CoreV1().ConfigMaps("target-ns")
+	source := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations: M{
+				ReplicateToAnnotation:         "target-ns/source,target-ns/existing,missing-ns/source",
+				ReplicateToClustersAnnotation: "remote",
+			},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+	require.NoError(t, r.objectStore.Add(source))
+	r.ObjectAdded(source)
+	target, err := configMapClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "value", target.Data["key"])
+	assert.Equal(t, "hub/source-ns/source", target.Annotations[ReplicatedFromClusterAnnotation])
+	// not replicated by this source, not overwritten
+	existing, err := configMapClient.Get(context.TODO(), "existing", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, existing.Data)
+	status := clusters.Status()[0]
+	assert.False(t, status.Healthy)
+	assert.Contains(t, status.LastError, "was not replicated from hub/source-ns/source")
+	assert.Equal(t, 1, status.Pending)
+
+	// updated along with the source
+	source = source.DeepCopy()
+	source.ResourceVersion = "2"
+	source.Data["key"] = "updated"
+	source.Annotations[ReplicateToAnnotation] = "target-ns/source"
+	require.NoError(t, r.objectStore.Update(source))
+	r.ObjectAdded(source)
+	target, err = configMapClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "updated", target.Data["key"])
+	assert.True(t, clusters.Status()[0].Healthy)
+	assert.Equal(t, 0, clusters.Status()[0].Pending)
+
+	// deleted once not targeted anymore
+	source = source.DeepCopy()
+	source.ResourceVersion = "3"
+	delete(source.Annotations, ReplicateToClustersAnnotation)
+	require.NoError(t, r.objectStore.Update(source))
+	r.ObjectAdded(source)
+	_, err = configMapClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Empty(t, r.pushed)
+}
+
+func TestPushToClusters_deleted(t *testing.T) {
+	remote := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "source-ns"}})
+	clusters := createTestClusters(t, map[string]kubernetes.Interface{"remote": remote})
+	r := newTestConfigMapReplicator(t, fake.NewSimpleClientset(), WithOptions(ReplicatorOptions{Clusters: clusters}), WithResyncPeriod(time.Hour))
+	source := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations: M{
+				ReplicateToClustersAnnotation: "remote,unknown",
+			},
+		},
+	}
+	require.NoError(t, r.objectStore.Add(source))
+	r.ObjectAdded(source)
+	// pushed with its own name
+	_, err := remote.CoreV1().ConfigMaps("source-ns").Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, r.objectStore.Delete(source))
+	r.ObjectDeleted(source)
+	_, err = remote.CoreV1().ConfigMaps("source-ns").Get(context.TODO(), "source", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestPushToClusters_restart(t *testing.T) {
+	pushed := func(name string, source string) *v1.ConfigMap {
+		return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "target-ns",
+			Name:        name,
+			Labels:      M{PushedTargetLabel: "true"},
+			Annotations: M{ReplicatedFromClusterAnnotation: source},
+		}}
+	}
+	remote := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "target-ns"}},
+		pushed("old", "hub/source-ns/source"),
+		pushed("deleted", "hub/source-ns/deleted"),
+		pushed("other", "other/source-ns/source"),
+	)
+	clusters := createTestClusters(t, map[string]kubernetes.Interface{"remote": remote})
+	r := newTestConfigMapReplicator(t, fake.NewSimpleClientset(), WithOptions(ReplicatorOptions{Clusters: clusters}), WithResyncPeriod(time.Hour))
+	configMapClient := remote.CoreV1().ConfigMaps("target-ns")
+	source := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "source-ns",
+			Name:            "source",
+			ResourceVersion: "1",
+			Annotations: M{
+				ReplicateToAnnotation:         "target-ns/source",
+				ReplicateToClustersAnnotation: "remote",
+			},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+	require.NoError(t, r.objectStore.Add(source))
+	r.ObjectAdded(source)
+	target, err := configMapClient.Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "true", target.Labels[PushedTargetLabel])
+
+	// pushed before the restart, not wanted anymore or of a deleted source
+	_, err = configMapClient.Get(context.TODO(), "old", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	_, err = configMapClient.Get(context.TODO(), "deleted", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	// pushed from another cluster
+	_, err = configMapClient.Get(context.TODO(), "other", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]keySet{"source-ns/source": {"remote": newKeySet("target-ns/source")}}, r.pushed)
+}
@@ -0,0 +1,259 @@
+// Work queue between the informers and the handlers
+
+package replicate
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// The defaults of the retries of the failed items
+const (
+	defaultRetryBaseDelay = 5 * time.Millisecond
+	defaultRetryMaxDelay  = 5 * time.Minute
+)
+
+// queueItem is the key of an object, or of a namespace, to handle
+type queueItem struct {
+	namespace bool
+	key       string
+	// a target whose deletion conflicted, retried with a backoff of its own
+	deletion  bool
+}
+
+// permanentError is a failure that retrying cannot fix until the objects change,
+// such as invalid annotations, or a replication which is not allowed
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// Marks the error as permanent, the handled item is not retried on it
+func permanent(err error) error {
+	if err == nil || isPermanent(err) {
+		return err
+	}
+	return permanentError{err}
+}
+
+// Returns true if the error is permanent, false if it is transient, as most errors of the calls to kubernetes
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// Returns the error of the handling of an item, out of two of its errors
+// A transient error wins over a permanent one, as the item is retried on it
+func handlingError(err error, other error) error {
+	if err == nil || (other != nil && isPermanent(err) && !isPermanent(other)) {
+		return other
+	}
+	return err
+}
+
+// deletedObjects keeps the last state of the deleted objects until they are handled
+type deletedObjects struct {
+	mutex   sync.Mutex
+	objects map[string]interface{}
+}
+
+func (d *deletedObjects) set(key string, object interface{}) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.objects[key] = object
+}
+
+// Returns and forgets the deleted object
+func (d *deletedObjects) pop(key string) (interface{}, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	object, ok := d.objects[key]
+	delete(d.objects, key)
+	return object, ok
+}
+
+// parkedItems keeps the items which exhausted their retries, until their next event
+type parkedItems struct {
+	mutex sync.Mutex
+	items map[queueItem]bool
+}
+
+func (p *parkedItems) set(item queueItem, parked bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if parked {
+		p.items[item] = true
+	} else {
+		delete(p.items, item)
+	}
+}
+
+func (p *parkedItems) count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.items)
+}
+
+// Inits the queue, called before the informers are created
+// The failed items are retried with an exponential backoff
+func (r *ObjectReplicator) initQueue() {
+	baseDelay := r.RetryBaseDelay
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+	maxDelay := r.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay)
+	r.queue = workqueue.NewRateLimitingQueueWithConfig(rateLimiter, workqueue.RateLimitingQueueConfig{
+		Name:            r.Name,
+		MetricsProvider: r.metrics,
+	})
+	r.deleted = &deletedObjects{objects: map[string]interface{}{}}
+	r.parked = &parkedItems{items: map[queueItem]bool{}}
+	r.pendingNamespaces = &pendingNamespaces{set: map[string]bool{}}
+	r.sourceLimiters = newSourceLimiters(r.SourceQPS, r.SourceBurst)
+}
+
+// Queues an item, a new event unparks it
+func (r *ObjectReplicator) enqueue(item queueItem) {
+	r.parked.set(item, false)
+	r.queue.Add(item)
+}
+
+// Queues an added or updated object, unless the queue is full
+func (r *ObjectReplicator) enqueueObject(object interface{}) {
+	if r.shed() {
+		return
+	}
+	r.enqueue(queueItem{key: metaKey(r.GetMeta(object))})
+}
+
+// Queues a deleted object, keeping its last state
+func (r *ObjectReplicator) enqueueDeletedObject(object interface{}) {
+	object = lastKnownState(object)
+	key := metaKey(r.GetMeta(object))
+	r.deleted.set(key, object)
+	r.enqueue(queueItem{key: key})
+}
+
+// Queues an added namespace, into the next batch when debounced, unless the queue is full
+func (r *ObjectReplicator) enqueueNamespace(object interface{}) {
+	if r.shed() {
+		return
+	}
+	if r.NamespaceDelay > 0 {
+		r.enqueuePendingNamespace(namespaceName(object))
+	} else {
+		r.enqueue(queueItem{namespace: true, key: namespaceName(object)})
+	}
+}
+
+// Returns the name of a namespace, typed or metadata only
+func namespaceName(object interface{}) string {
+	return object.(metav1.Object).GetName()
+}
+
+// Returns true if nothing is queued or being handled
+func (r *ObjectReplicator) queueIdle() bool {
+	return r.queue == nil || (r.queue.Len() == 0 && atomic.LoadInt32(&r.processing) == 0)
+}
+
+// Handles the queued items until the queue is shut down
+func (r *ObjectReplicator) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+// Handles the next queued item, returns false when the queue is shut down
+// A failed item is retried with backoff, then parked once its retry budget is exhausted
+func (r *ObjectReplicator) processNextItem() bool {
+	item, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	atomic.AddInt32(&r.processing, 1)
+	defer atomic.AddInt32(&r.processing, -1)
+	defer r.queue.Done(item)
+
+	key := item.(queueItem).key
+	object, err := r.process(item.(queueItem))
+	failed := err != nil && !isPermanent(err)
+	if err != nil && !failed {
+		r.logger.V(debugLevel).Info("not retrying", "key", key, "reason", err)
+	}
+	backoff := r.stats.takeBackoff()
+	// throttled by the API server, handled again once allowed, without using its retry budget
+	if delay := r.stats.takeRetryAfter(); delay > 0 {
+		r.logger.Info("throttled by the API server, retrying later", "key", key, "delay", delay.String())
+		r.metrics.apiThrottled.WithLabelValues(r.Name).Inc()
+		r.queue.AddAfter(item, delay)
+	} else if !failed {
+		r.queue.Forget(item)
+	// a target was backed off, handled again once its backoff ends, only then
+	} else if backoff > 0 {
+		r.logger.V(debugLevel).Info("target backed off, retrying once its backoff ends", "key", key, "delay", backoff.String())
+		r.queue.Forget(item)
+		r.queue.AddAfter(item, backoff)
+	} else if retries := r.queue.NumRequeues(item); r.RetryBudget <= 0 || retries < r.RetryBudget {
+		r.logger.V(debugLevel).Info("retrying", "key", key, "retries", retries+1)
+		r.queue.AddRateLimited(item)
+	} else {
+		r.logger.Info("giving up until next update or resync", "key", key, "retries", retries)
+		r.queue.Forget(item)
+		r.parked.set(item.(queueItem), true)
+		r.warning(object, ReasonRetriesExhausted,
+			"gave up after %d retries, waiting for the next change or resync", retries)
+	}
+	r.recomputeShed()
+	return true
+}
+
+// Handles an item with the current state of the stores
+// Returns the handled object, nil for namespaces, and the error of the handling, retried unless permanent
+func (r *ObjectReplicator) process(item queueItem) (interface{}, error) {
+	var handled, added interface{}
+	var handleErr error
+	defer r.runHooks()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if item == namespacesItem {
+		handleErr = r.namespacesBatch()
+	} else if item.namespace {
+		if namespace, exists, err := r.namespaceStore.GetByKey(item.key); err != nil {
+			r.logger.Error(err, "could not get namespace", "namespace", item.key)
+			handleErr = err
+		} else if exists {
+			handleErr = r.namespaceAdded(namespace)
+		}
+	} else if object, exists, err := r.objectStore.GetByKey(item.key); err != nil {
+		r.logger.Error(err, "could not get object", "object", item.key)
+		handleErr = err
+	// changed too often, handled again later
+	} else if exists && r.throttled(item) {
+	} else if exists {
+		// deleted then created again, the new object replaces the old one
+		r.deleted.pop(item.key)
+		handleErr = r.objectAdded(object)
+		handled = object
+		added = object
+	} else if deleted, ok := r.deleted.pop(item.key); ok {
+		handleErr = r.objectDeleted(deleted)
+		handled = deleted
+	}
+
+	if added != nil {
+		r.recordHandled(added, handleErr != nil && !isPermanent(handleErr))
+	}
+	return handled, handleErr
+}
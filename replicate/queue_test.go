@@ -0,0 +1,177 @@
+package replicate
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Handles all the queued items
+func processQueue(t *testing.T, r *ObjectReplicator) {
+	for r.queue.Len() > 0 {
+		require.True(t, r.processNextItem())
+	}
+}
+
+func TestQueue(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{})
+	r.initQueue()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	// handled by the worker only
+	r.enqueueObject(source)
+	r.enqueueObject(target)
+	r.enqueueObject(target)
+	requireActionsLength(t, r, 0)
+	assert.Equal(t, 2, r.Status().QueueDepth)
+	assert.False(t, r.queueIdle())
+
+	processQueue(t, r)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, "0", getObject(r, "target-ns", "target").Data)
+	assert.Equal(t, 0, r.Status().QueueDepth)
+	assert.True(t, r.queueIdle())
+
+	// the last state of a missed deletion
+	deleteObject(r, "source-ns", "source")
+	r.enqueueDeletedObject(cache.DeletedFinalStateUnknown{
+		Key: "source-ns/source",
+		Obj: source,
+	})
+	processQueue(t, r)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, "clear", r.ReplicatorActions.(*testActions).Actions[1].Action)
+	assert.Equal(t, "", getObject(r, "target-ns", "target").Data)
+
+	// deleted then created again
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.enqueueDeletedObject(source)
+	processQueue(t, r)
+	requireActionsLength(t, r, 3)
+	assert.Equal(t, "update", r.ReplicatorActions.(*testActions).Actions[2].Action)
+	_, deleted := r.deleted.pop("source-ns/source")
+	assert.False(t, deleted)
+}
+
+func TestQueue_retries(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{RetryBudget: 2, RetryBaseDelay: time.Millisecond})
+	r.initQueue()
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(source)
+
+	// fails even after the conflict retries, then succeeds on retry
+	actions.Conflicts = map[string]int{"target-ns/target": maxConflictRetries + 1}
+	r.enqueueObject(target)
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, maxConflictRetries+1)
+	assert.Equal(t, 1, r.queue.NumRequeues(queueItem{key: "target-ns/target"}))
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, maxConflictRetries+2)
+	assert.False(t, actions.Actions[maxConflictRetries+1].Conflict)
+	assert.Equal(t, 0, r.queue.NumRequeues(queueItem{key: "target-ns/target"}))
+	assert.Equal(t, 0, r.Status().Parked)
+
+	// exhausts its retries, and is parked until its next change
+	source = updateObject(r, "source-ns", "source", nil)
+	actions.Conflicts = map[string]int{"target-ns/target": 3 * (maxConflictRetries + 1)}
+	r.enqueueObject(source)
+	for i := 0; i < 3; i++ {
+		require.True(t, r.processNextItem())
+	}
+	requireActionsLength(t, r, 4*(maxConflictRetries+1)+1)
+	assert.Equal(t, 0, r.Status().QueueDepth)
+	assert.Equal(t, 1, r.Status().Parked)
+	assert.Contains(t, r.Status().LastError, ReasonRetriesExhausted)
+	r.enqueueObject(source)
+	assert.Equal(t, 0, r.Status().Parked)
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 4*(maxConflictRetries+1)+2)
+	assert.False(t, actions.Actions[4*(maxConflictRetries+1)+1].Conflict)
+}
+
+func TestQueue_unlimitedRetries(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{RetryBudget: 0, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 2 * time.Millisecond})
+	r.initQueue()
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(source)
+
+	// retried until it succeeds, never parked
+	actions.Conflicts = map[string]int{"target-ns/target": 10 * (maxConflictRetries + 1)}
+	r.enqueueObject(target)
+	for i := 0; i < 10; i++ {
+		require.True(t, r.processNextItem())
+		assert.Equal(t, i+1, r.queue.NumRequeues(queueItem{key: "target-ns/target"}))
+		assert.Equal(t, 0, r.Status().Parked)
+	}
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 10*(maxConflictRetries+1)+1)
+	assert.False(t, actions.Actions[10*(maxConflictRetries+1)].Conflict)
+	assert.Equal(t, 0, r.queue.NumRequeues(queueItem{key: "target-ns/target"}))
+}
+
+func TestQueue_permanentErrors(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{RetryBudget: 0, RetryBaseDelay: time.Millisecond}, "target-ns")
+	r.initQueue()
+	// invalid annotations
+	invalid := updateObject(r, "source-ns", "invalid", M{
+		ReplicateToAnnotation: "target-ns/invalid/name",
+	})
+	// the target was not replicated from the source
+	updateObject(r, "target-ns", "target", M{})
+	cancelled := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+
+	for _, object := range []interface{}{invalid, cancelled} {
+		r.enqueueObject(object)
+		require.True(t, r.processNextItem())
+		item := queueItem{key: metaKey(r.GetMeta(object))}
+		assert.Equal(t, 0, r.queue.NumRequeues(item), "not retried")
+		assert.Equal(t, 0, r.queue.Len(), "not queued again")
+	}
+	requireActionsLength(t, r, 0)
+	assert.Equal(t, 0, r.Status().Parked)
+	assert.NotContains(t, r.Status().LastError, ReasonRetriesExhausted)
+}
+
+func Test_handlingError(t *testing.T) {
+	transient := errors.New("transient")
+	other := errors.New("other")
+	config := permanent(errors.New("permanent"))
+	assert.Nil(t, permanent(nil))
+	assert.True(t, isPermanent(config))
+	assert.True(t, isPermanent(fmt.Errorf("wrapped: %w", config)))
+	assert.False(t, isPermanent(transient))
+	assert.Equal(t, config, permanent(config), "marked once")
+
+	assert.Nil(t, handlingError(nil, nil))
+	assert.Equal(t, transient, handlingError(nil, transient))
+	assert.Equal(t, transient, handlingError(transient, nil))
+	assert.Equal(t, transient, handlingError(transient, other), "first transient error")
+	assert.Equal(t, transient, handlingError(config, transient), "transient over permanent")
+	assert.Equal(t, transient, handlingError(transient, config), "transient over permanent")
+	assert.Equal(t, config, handlingError(config, permanent(other)), "first permanent error")
+}
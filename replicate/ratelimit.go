@@ -0,0 +1,38 @@
+// Rate limiting of the writes to the API server
+
+package replicate
+
+import (
+	"net/http"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// mutationRoundTripper waits for the rate limiter before each write
+type mutationRoundTripper struct {
+	limiter flowcontrol.RateLimiter
+	next    http.RoundTripper
+}
+
+func (rt *mutationRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		rt.limiter.Accept()
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// LimitMutations limits the rate of the creations, updates, patches and deletions of the clients of the config,
+// on top of its QPS, such that the reads are not delayed by a burst of writes
+func LimitMutations(config *rest.Config, qps float32, burst int) {
+	limiter := flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	config.WrapTransport = transport.Wrappers(config.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+		return &mutationRoundTripper{
+			limiter: limiter,
+			next:    rt,
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package replicate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// A rate limiter counting the waits
+type countingRateLimiter struct {
+	flowcontrol.RateLimiter
+	accepted int
+}
+
+func (l *countingRateLimiter) Accept() {
+	l.accepted++
+}
+
+func TestMutationRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	limiter := &countingRateLimiter{}
+	client := &http.Client{Transport: &mutationRoundTripper{
+		limiter: limiter,
+		next:    http.DefaultTransport,
+	}}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		req, err := http.NewRequest(method, server.URL, nil)
+		require.NoError(t, err)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+	assert.Equal(t, 4, limiter.accepted)
+}
+
+func TestLimitMutations(t *testing.T) {
+	wrapped := 0
+	config := &rest.Config{
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			wrapped++
+			return rt
+		},
+	}
+	LimitMutations(config, 1, 1)
+	rt := config.WrapTransport(http.DefaultTransport)
+	assert.Equal(t, 1, wrapped, "previous wrapper kept")
+	assert.IsType(t, &mutationRoundTripper{}, rt)
+}
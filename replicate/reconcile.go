@@ -0,0 +1,62 @@
+// Single reconcile pass, without running the informers
+
+package replicate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReconcileScope limits a reconcile pass, empty fields do not limit it
+type ReconcileScope struct {
+	// only the objects of this namespace
+	Namespace string
+	// only this source, as "namespace/name", and its targets
+	Source    string
+}
+
+// Returns true if the object is in the scope
+func (s ReconcileScope) contains(meta *metav1.ObjectMeta) bool {
+	if s.Namespace != "" && meta.Namespace != s.Namespace {
+		return false
+	}
+	if s.Source == "" || metaKey(meta) == s.Source || meta.Annotations[ReplicatedByAnnotation] == s.Source {
+		return true
+	}
+	source, ok := resolveAnnotation(meta, ReplicateFromAnnotation)
+	return ok && source == s.Source
+}
+
+// Reconciler is implemented by the replicators able to run a single reconcile pass
+type Reconciler interface {
+	storeLoader
+	// handles all the objects in the scope once, returns the count of failed actions
+	Reconcile(scope ReconcileScope) (int, error)
+}
+
+// Reconcile handles all the objects in the scope once, as if they were just added
+// The stores must be filled, either by the informers or by LoadStores
+// Returns the count of failed actions
+func (r *ObjectReplicator) Reconcile(scope ReconcileScope) (int, error) {
+	if scope.Source != "" && (!strings.Contains(scope.Source, "/") || !validPath.MatchString(scope.Source)) {
+		return 0, fmt.Errorf("invalid source %s: expected namespace/name", scope.Source)
+	}
+	before := r.Status().FailedActions
+	keys := r.objectStore.ListKeys()
+	sort.Strings(keys)
+	handled := 0
+	for _, key := range keys {
+		// the object may have been deleted or changed by a previous one
+		if object, exists, err := r.objectStore.GetByKey(key); err != nil || !exists {
+		} else if scope.contains(r.GetMeta(object)) {
+			r.ObjectAdded(object)
+			handled++
+		}
+	}
+	failed := r.Status().FailedActions - before
+	r.logger.Info("reconciled", "objects", handled, "failedActions", failed)
+	return failed, nil
+}
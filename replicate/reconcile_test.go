@@ -0,0 +1,49 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{AllowAll: true}, "source-ns", "target-ns", "other-ns")
+	updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	updateObject(r, "source-ns", "other", M{
+		ReplicateToAnnotation: "other-ns/target",
+	})
+	updateObject(r, "target-ns", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	updateObject(r, "other-ns", "from", M{
+		ReplicateFromAnnotation: "source-ns/other",
+	})
+
+	_, err := r.Reconcile(ReconcileScope{Source: "source"})
+	assert.Error(t, err)
+	// only the source and its targets
+	failed, err := r.Reconcile(ReconcileScope{Source: "source-ns/source"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, failed)
+	requireActionsLength(t, r, 2)
+	assert.NotNil(t, getObject(r, "target-ns", "target"))
+	assert.Nil(t, getObject(r, "other-ns", "target"))
+	// only the objects of the namespace
+	failed, err = r.Reconcile(ReconcileScope{Namespace: "other-ns"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, failed)
+	requireActionsLength(t, r, 3)
+	assert.Nil(t, getObject(r, "other-ns", "target"))
+	// everything
+	failed, err = r.Reconcile(ReconcileScope{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, failed)
+	requireActionsLength(t, r, 4)
+	assert.NotNil(t, getObject(r, "other-ns", "target"))
+	status := r.Status()
+	assert.Equal(t, 4, status.Actions)
+	assert.Equal(t, 0, status.FailedActions)
+}
@@ -0,0 +1,62 @@
+// Registration of the replicators, by name
+
+package replicate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// NewReplicatorFunc creates a replicator of a resource, configured by the options
+type NewReplicatorFunc func(client kubernetes.Interface, opts ...Option) (Replicator, error)
+
+// the registered replicators, by lower case name
+var registry = struct {
+	sync.RWMutex
+	funcs map[string]NewReplicatorFunc
+}{funcs: map[string]NewReplicatorFunc{}}
+
+func init() {
+	Register("configmap", NewConfigMapReplicator)
+	Register("secret", NewSecretReplicator)
+}
+
+// Register makes a replicator available by its case-insensitive name, such as to --run-replicators
+// It is meant to be called from an init function, it panics if the name is empty, "all", or already registered
+func Register(name string, factory NewReplicatorFunc) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if key == "" || key == "all" {
+		panic(fmt.Sprintf("invalid replicator name \"%s\"", name))
+	} else if factory == nil {
+		panic(fmt.Sprintf("nil factory for replicator %s", name))
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.funcs[key]; ok {
+		panic(fmt.Sprintf("replicator %s registered twice", name))
+	}
+	registry.funcs[key] = factory
+}
+
+// Registered returns the factory of the replicator registered with the case-insensitive name, nil if none
+func Registered(name string) NewReplicatorFunc {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.funcs[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// RegisteredNames returns the sorted lower case names of the registered replicators
+func RegisteredNames() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := []string{}
+	for name := range registry.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,36 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRegister(t *testing.T) {
+	assert.Equal(t, []string{"configmap", "secret"}, RegisteredNames())
+	require.NotNil(t, Registered("Secret"))
+	replicator, err := Registered("Secret")(fake.NewSimpleClientset())
+	require.NoError(t, err)
+	assert.IsType(t, &ObjectReplicator{}, replicator)
+	assert.Nil(t, Registered("missing"))
+
+	factory := func(client kubernetes.Interface, opts ...Option) (Replicator, error) {
+		return NewConfigMapReplicator(client, opts...)
+	}
+	Register("Test", factory)
+	defer func() {
+		registry.Lock()
+		delete(registry.funcs, "test")
+		registry.Unlock()
+	}()
+	assert.NotNil(t, Registered("test"))
+	assert.Equal(t, []string{"configmap", "secret", "test"}, RegisteredNames())
+
+	assert.Panics(t, func() { Register("TEST", factory) }, "registered twice")
+	assert.Panics(t, func() { Register("all", factory) })
+	assert.Panics(t, func() { Register(" ", factory) })
+	assert.Panics(t, func() { Register("other", nil) })
+}
@@ -0,0 +1,223 @@
+// Package replicatetest provides fake replicator actions, and scenarios to test the replicators with them
+package replicatetest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// FakeObject is the resource replicated by the fake actions
+type FakeObject struct {
+	Type string
+	Data string
+	Meta metav1.ObjectMeta
+}
+
+// FakeAction is an action performed by the fake actions
+type FakeAction struct {
+	// install, update, clear or delete
+	Action   string
+	// true if the action failed with a conflict
+	Conflict bool
+	// the object as sent to kubernetes
+	Object   FakeObject
+}
+
+// FakeActions replicates fake objects, recording the actions instead of calling kubernetes
+// The store is the one of the replicator, an action conflicts when its resource version is not the one in the store
+// The actions may be called concurrently, as when the targets are synced concurrently
+type FakeActions struct {
+	Store     cache.Store
+
+	mutex     sync.Mutex
+	actions   []*FakeAction
+	// count of the next actions on each "namespace/name" to fail with a conflict
+	conflicts map[string]int
+	// error of the next install on each "namespace/name", not recorded as an action
+	errors    map[string]error
+	// the last resource version given
+	version   int
+}
+
+// Recorded returns the actions performed so far
+func (a *FakeActions) Recorded() []*FakeAction {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]*FakeAction{}, a.actions...)
+}
+
+// Conflict makes the next actions on the "namespace/name" key fail with a conflict, count times
+func (a *FakeActions) Conflict(key string, count int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.conflicts == nil {
+		a.conflicts = map[string]int{}
+	}
+	a.conflicts[key] = count
+}
+
+// Fail makes the next install on the "namespace/name" key fail with the error, without recording it as an action
+func (a *FakeActions) Fail(key string, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.errors == nil {
+		a.errors = map[string]error{}
+	}
+	a.errors[key] = err
+}
+
+// KeyFunc returns the "namespace/name" key of the fake objects
+func KeyFunc(object interface{}) (string, error) {
+	meta := object.(*FakeObject).Meta
+	return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name), nil
+}
+
+// Returns a new resource version
+func (a *FakeActions) nextVersion() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.version++
+	return strconv.Itoa(a.version)
+}
+
+// Returns a copy of the object, with a new resource version
+func (a *FakeActions) refresh(object FakeObject) *FakeObject {
+	out := &FakeObject{
+		Type: object.Type,
+		Data: object.Data,
+		Meta: *object.Meta.DeepCopy(),
+	}
+	out.Meta.ResourceVersion = a.nextVersion()
+	return out
+}
+
+// Returns true if the action on the object conflicts, the mutex must be held
+func (a *FakeActions) hasConflict(meta *metav1.ObjectMeta) (bool, error) {
+	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+	if a.conflicts[key] > 0 {
+		a.conflicts[key]--
+		return true, nil
+	}
+	current, ok, err := a.Store.GetByKey(key)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return meta.ResourceVersion != "", nil
+	}
+	return meta.ResourceVersion != current.(*FakeObject).Meta.ResourceVersion, nil
+}
+
+// Records the action, returns the error of kubernetes on conflict
+func (a *FakeActions) record(action string, object FakeObject) (*FakeAction, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	conflict, err := a.hasConflict(&object.Meta)
+	if err != nil {
+		return nil, err
+	}
+	recorded := &FakeAction{Action: action, Conflict: conflict, Object: object}
+	a.actions = append(a.actions, recorded)
+	if conflict {
+		return recorded, errors.NewConflict(schema.GroupResource{Resource: "fake"},
+			fmt.Sprintf("%s/%s", object.Meta.Namespace, object.Meta.Name), fmt.Errorf("conflict"))
+	}
+	return recorded, nil
+}
+
+// GetMeta returns the meta of a fake object
+func (*FakeActions) GetMeta(object interface{}) *metav1.ObjectMeta {
+	return &object.(*FakeObject).Meta
+}
+
+// DataChecksum returns a checksum of the data of a fake object
+func (*FakeActions) DataChecksum(object interface{}) string {
+	return strconv.Quote(object.(*FakeObject).Data)
+}
+
+// DataSize returns the size of the data of a fake object
+func (*FakeActions) DataSize(object interface{}) int {
+	return len(object.(*FakeObject).Data)
+}
+
+// Get returns the fake object from the store
+func (a *FakeActions) Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error) {
+	object, ok, err := a.Store.GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "fake"}, name)
+	}
+	return object, nil
+}
+
+// Update records an update of the fake object with the data of the source and the annotations
+func (a *FakeActions) Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+	target := object.(*FakeObject)
+	updated := FakeObject{Type: target.Type, Meta: *target.Meta.DeepCopy()}
+	if sourceObject != nil {
+		updated.Data = sourceObject.(*FakeObject).Data
+	}
+	updated.Meta.Annotations = copyAnnotations(annotations)
+	if _, err := a.record("update", updated); err != nil {
+		return nil, err
+	}
+	return a.refresh(updated), nil
+}
+
+// Clear records a clear of the data of the fake object, with the annotations
+func (a *FakeActions) Clear(ctx context.Context, client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
+	target := object.(*FakeObject)
+	cleared := FakeObject{Type: target.Type, Meta: *target.Meta.DeepCopy()}
+	cleared.Meta.Annotations = copyAnnotations(annotations)
+	if _, err := a.record("clear", cleared); err != nil {
+		return nil, err
+	}
+	return a.refresh(cleared), nil
+}
+
+// Install records an install of the fake object, of the type of the source and with the data of the data object
+func (a *FakeActions) Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+	a.mutex.Lock()
+	err, ok := a.errors[key]
+	delete(a.errors, key)
+	a.mutex.Unlock()
+	if ok {
+		return nil, err
+	}
+	installed := FakeObject{Type: sourceObject.(*FakeObject).Type, Meta: *meta.DeepCopy()}
+	if dataObject != nil {
+		installed.Data = dataObject.(*FakeObject).Data
+	}
+	if _, err := a.record("install", installed); err != nil {
+		return nil, err
+	}
+	return a.refresh(installed), nil
+}
+
+// Delete records a deletion of the fake object, and removes it from the store
+func (a *FakeActions) Delete(ctx context.Context, client kubernetes.Interface, object interface{}) error {
+	target := object.(*FakeObject)
+	deleted := FakeObject{Meta: *target.Meta.DeepCopy()}
+	if _, err := a.record("delete", deleted); err != nil {
+		return err
+	}
+	return a.Store.Delete(&deleted)
+}
+
+// Returns a copy of the annotations
+func copyAnnotations(annotations map[string]string) map[string]string {
+	copy := map[string]string{}
+	for k, v := range annotations {
+		copy[k] = v
+	}
+	return copy
+}
@@ -0,0 +1,139 @@
+// Scenarios of replication, with the fake actions
+
+package replicatetest
+
+import (
+	"testing"
+
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/olli-ai/k8s-replicator/replicate/internal/testhooks"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Scenario is a replicator of fake objects, without informers nor kubernetes
+// The objects and the namespaces are put in its stores, and the handlers called, as the informers would
+// The objects are stored with their annotations translated from the prefixes of the replicator, as the informers do
+type Scenario struct {
+	T          testing.TB
+	Replicator *replicate.ObjectReplicator
+	Actions    *FakeActions
+	Objects    cache.Indexer
+	Namespaces cache.Store
+	// translates the annotations of an object, before it is stored
+	translate  func(object interface{})
+}
+
+// NewScenario creates a scenario, with a replicator of fake objects configured by the options
+func NewScenario(t testing.TB, opts ...replicate.Option) *Scenario {
+	t.Helper()
+	actions := &FakeActions{}
+	r, err := replicate.NewReplicatorConfig(opts...).NewObjectReplicator(nil, "fake", actions)
+	if err != nil {
+		t.Fatalf("could not create the replicator: %s", err)
+	}
+	objects, namespaces, translate := testhooks.FakeStores(r, KeyFunc)
+	actions.Store = objects
+	return &Scenario{
+		T:          t,
+		Replicator: r,
+		Actions:    actions,
+		Objects:    objects,
+		Namespaces: namespaces,
+		translate:  translate,
+	}
+}
+
+// Fails the scenario on an error
+func (s *Scenario) noError(err error) {
+	s.T.Helper()
+	if err != nil {
+		s.T.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// WithNamespaces puts the namespaces in the store, without calling the handlers, such as before the scenario
+func (s *Scenario) WithNamespaces(names ...string) *Scenario {
+	for _, name := range names {
+		s.putNamespace(name)
+	}
+	return s
+}
+
+// Puts the namespace in the store
+func (s *Scenario) putNamespace(name string) *v1.Namespace {
+	namespace := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+	s.noError(s.Namespaces.Update(namespace))
+	return namespace
+}
+
+// AddNamespace puts the namespace in the store, and handles it
+func (s *Scenario) AddNamespace(name string) {
+	s.Replicator.NamespaceAdded(s.putNamespace(name))
+}
+
+// Put puts a new version of the object in the store, with new data and the annotations, without handling it
+// The annotations are the ones of the current version when nil
+func (s *Scenario) Put(namespace string, name string, annotations map[string]string) *FakeObject {
+	if annotations == nil {
+		if current := s.Get(namespace, name); current != nil {
+			annotations = current.Meta.Annotations
+		}
+	}
+	version := s.Actions.nextVersion()
+	object := &FakeObject{
+		Type: version,
+		Data: version,
+		Meta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			Annotations:     copyAnnotations(annotations),
+			ResourceVersion: version,
+		},
+	}
+	s.translate(object)
+	s.noError(s.Objects.Update(object))
+	return object
+}
+
+// Apply puts a new version of the object in the store, as Put, and handles it
+func (s *Scenario) Apply(namespace string, name string, annotations map[string]string) *FakeObject {
+	object := s.Put(namespace, name, annotations)
+	s.Replicator.ObjectAdded(object)
+	return object
+}
+
+// Delete removes the object from the store, and handles its deletion
+func (s *Scenario) Delete(namespace string, name string) *FakeObject {
+	s.T.Helper()
+	object := s.Get(namespace, name)
+	if object == nil {
+		s.T.Fatalf("object %s/%s does not exist", namespace, name)
+	}
+	s.noError(s.Objects.Delete(object))
+	s.Replicator.ObjectDeleted(object)
+	return object
+}
+
+// Get returns the object in the store, with its translated annotations, nil if missing
+func (s *Scenario) Get(namespace string, name string) *FakeObject {
+	object, ok, err := s.Objects.GetByKey(namespace + "/" + name)
+	s.noError(err)
+	if !ok {
+		return nil
+	}
+	return object.(*FakeObject)
+}
+
+// RequireActions requires the count of actions performed since the start of the scenario, and returns them
+func (s *Scenario) RequireActions(count int) []*FakeAction {
+	s.T.Helper()
+	actions := s.Actions.Recorded()
+	if len(actions) != count {
+		s.T.Fatalf("expected %d actions, got %d", count, len(actions))
+	}
+	return actions
+}
@@ -0,0 +1,77 @@
+package replicatetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/olli-ai/k8s-replicator/replicate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenario(t *testing.T) {
+	s := NewScenario(t, replicate.WithLabels(map[string]string{"team": "platform"})).
+		WithNamespaces("source-ns", "target-ns")
+	source := s.Apply("source-ns", "source", map[string]string{
+		replicate.ReplicateToAnnotation: "target-ns/target",
+	})
+	actions := s.RequireActions(1)
+	assert.Equal(t, "install", actions[0].Action)
+	target := s.Get("target-ns", "target")
+	require.NotNil(t, target)
+	assert.Equal(t, source.Data, target.Data)
+	assert.Equal(t, "source-ns/source", target.Meta.Annotations[replicate.ReplicatedByAnnotation])
+	assert.Equal(t, "platform", target.Meta.Labels["team"])
+
+	// updated with the new data
+	source = s.Apply("source-ns", "source", nil)
+	s.RequireActions(2)
+	assert.Equal(t, source.Data, s.Get("target-ns", "target").Data)
+
+	// replicated to the new namespace
+	source = s.Apply("source-ns", "source", map[string]string{
+		replicate.ReplicateToAnnotation: "target-ns/target,other-ns/target",
+	})
+	s.Actions.Fail("other-ns/target", errors.New("denied"))
+	s.AddNamespace("other-ns")
+	assert.Nil(t, s.Get("other-ns", "target"), "failed")
+	s.AddNamespace("other-ns")
+	require.NotNil(t, s.Get("other-ns", "target"))
+
+	// retried on conflict
+	s.Actions.Conflict("target-ns/target", 1)
+	source = s.Apply("source-ns", "source", nil)
+	conflicts := 0
+	for _, action := range s.Actions.Recorded() {
+		if action.Conflict {
+			conflicts++
+		}
+	}
+	assert.Equal(t, 1, conflicts)
+	assert.Equal(t, source.Data, s.Get("target-ns", "target").Data)
+
+	// deleted with the source
+	s.Delete("source-ns", "source")
+	assert.Nil(t, s.Get("target-ns", "target"))
+	assert.Nil(t, s.Get("other-ns", "target"))
+	actions = s.Actions.Recorded()
+	assert.Equal(t, "delete", actions[len(actions)-1].Action)
+}
+
+func TestScenario_prefix(t *testing.T) {
+	s := NewScenario(t, replicate.WithOptions(replicate.ReplicatorOptions{Prefixes: []string{"custom"}})).
+		WithNamespaces("source-ns", "target-ns")
+	source := s.Apply("source-ns", "source", map[string]string{
+		"custom/replicate-to": "target-ns/target",
+	})
+	// stored translated, as by the informers
+	assert.Equal(t, "target-ns/target", source.Meta.Annotations[replicate.ReplicateToAnnotation])
+	actions := s.RequireActions(1)
+	assert.Equal(t, "install", actions[0].Action)
+	assert.Equal(t, "source-ns/source", actions[0].Object.Meta.Annotations["custom/replicated-by"],
+		"written with the prefix")
+	target := s.Get("target-ns", "target")
+	require.NotNil(t, target)
+	assert.Equal(t, source.Data, target.Data)
+	assert.Equal(t, "source-ns/source", target.Meta.Annotations[replicate.ReplicatedByAnnotation])
+}
@@ -1,10 +1,12 @@
 package replicate
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/api/core/v1"
@@ -22,14 +24,40 @@ type ReplicatorActions interface {
 	// Probably nothing more than `&object.(*ResourceType).ObjectMeta`
 	GetMeta(object interface{}) *metav1.ObjectMeta
 	// Updates a resource with the data from the source, and the given annotations
-	Update(client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error)
+	Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error)
 	// Clears a resource from any data, and set the given annotations
-	Clear(client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error)
+	Clear(ctx context.Context, client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error)
 	// Creates or updates the given resource with info from the source, data from the data object, and the given meta
 	// create if `object.ResourceVersion == ""`, update else
-	Install(client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error)
+	Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error)
 	// Deletes the given resource
-	Delete(client kubernetes.Interface, meta interface{}) (error)
+	Delete(ctx context.Context, client kubernetes.Interface, meta interface{}) (error)
+}
+
+// ObjectGetter is implemented by the actions able to get the current version of a resource,
+// to resolve the conflicts, and to push to and pull from the remote clusters
+type ObjectGetter interface {
+	// Gets the current version of a resource from kubernetes
+	Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error)
+}
+
+// DataChecksummer is implemented by the actions able to tell the checksum of the data of a resource,
+// without it the checksum of the whole resource but its metadata is used
+type DataChecksummer interface {
+	// Returns a checksum of the data of the resource
+	DataChecksum(object interface{}) string
+}
+
+// DataSizer is implemented by the actions able to tell the size of the data of a resource, for the metrics
+type DataSizer interface {
+	// Returns the size in bytes of the data of the resource
+	DataSize(object interface{}) int
+}
+
+// ObjectLister is implemented by the actions able to list the resources, to find the targets pushed to the remote clusters
+type ObjectLister interface {
+	// Lists the resources of all the namespaces matching the label selector
+	List(ctx context.Context, client kubernetes.Interface, selector string) ([]interface{}, error)
 }
 
 // ObjectReplicator is the structure for any replicator
@@ -39,53 +67,183 @@ type ObjectReplicator struct {
 }
 
 // Synced returns if synched with kubernetes
+// Always false before the stores are initialized
 func (r *ObjectReplicator) Synced() bool {
+	if r.namespaceController == nil || r.objectController == nil {
+		return false
+	}
 	return r.namespaceController.HasSynced() && r.objectController.HasSynced()
 }
 
-// Start starts the replicator
+// Ready returns if synched with kubernetes, and all the initially listed objects have been handled
+func (r *ObjectReplicator) Ready() bool {
+	return r.Synced() && r.objectInitialSync.Done() && r.queueIdle()
+}
+
+// Start starts the replicator, until stopped, a stopped replicator is not started again
 func (r *ObjectReplicator) Start() {
-	log.Printf("running %s object controller", r.Name)
-	go r.namespaceController.Run(wait.NeverStop)
-	go r.objectController.Run(wait.NeverStop)
+	if r.stopped() {
+		return
+	}
+	r.logger.Info("running object controller")
+	r.namespaceInformer.start()
+	r.objectStop = make(chan struct{})
+	if !r.objectManaged {
+		go r.objectActivity.run(r.objectController, r.objectStop)
+		go r.superviseObjectInformer(r.stop)
+	}
+	go r.runSourceStatuses(r.stop)
+	go r.runOrphanCollection(r.stop)
+	go wait.Until(r.runWorker, time.Second, r.stop)
+}
+
+// Run runs the replicator until the context is done, or until stopped
+// Returns an error if stopped before the informers are synced
+func (r *ObjectReplicator) Run(ctx context.Context) error {
+	r.Start()
+	select {
+	case <-ctx.Done():
+	case <-r.stop:
+	}
+	r.Stop()
+	if !r.Synced() {
+		return fmt.Errorf("%s replicator stopped before its informers were synced", r.Name)
+	}
+	return nil
+}
+
+// Stop stops the informer of the objects and the workers, the replicator cannot be started again
+// The namespace informer is shared with the other replicators, and keeps running
+func (r *ObjectReplicator) Stop() {
+	r.stopOnce.Do(func() {
+		r.logger.Info("stopping object controller")
+		close(r.stop)
+		if r.cancel != nil {
+			r.cancel()
+		}
+		if r.objectStop != nil {
+			select {
+			case <-r.objectStop:
+			default:
+				close(r.objectStop)
+			}
+		}
+		if r.queue != nil {
+			r.queue.ShutDown()
+		}
+	})
+}
+
+// Returns true once stopped
+func (r *ObjectReplicator) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 // InitStores inits namespace store and object store
+// The namespace informer is shared with the other replicators of the same SharedInformers
 func (r *ObjectReplicator) InitStores(lw cache.ListerWatcher, objType runtime.Object, resyncPeriod time.Duration) {
-	namespaces := r.client.CoreV1().Namespaces()
-	r.namespaceStore, r.namespaceController = newFilledInformer(
-		&cache.ListWatch{
-			ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
-				return namespaces.List(lo)
-			},
-			WatchFunc: namespaces.Watch,
-		},
-		&v1.Namespace{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: r.NamespaceAdded,
-		},
-	)
-	r.objectStore, r.objectController = newFilledInformer(
-		lw,
-		objType,
-		resyncPeriod,
+	if r.Informers == nil {
+		r.Informers = NewSharedInformers(r.client, nil, resyncPeriod)
+	}
+	r.namespaceInformer = r.Informers.namespaceInformer(r.metrics, r.logger)
+	r.namespaceActivity = r.namespaceInformer.activity
+	r.objectActivity = newInformerActivity(r.Name, r.metrics, r.logger)
+	r.namespaceListWatch = r.namespaceInformer.listWatch
+	r.objectListWatch = lw
+	r.initQueue()
+	r.namespaceStore = r.namespaceInformer.informer.GetStore()
+	r.namespaceController = r.namespaceInformer.informer
+	r.namespaceInformer.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueueNamespace,
+		UpdateFunc: r.enqueueRelabeledNamespace,
+	})
+	r.objectType = objType
+	r.objectResyncPeriod = jitteredPeriod(resyncPeriod, r.ResyncJitter)
+	r.logger.V(debugLevel).Info("resync period", "period", r.objectResyncPeriod.String())
+	r.objectStore, r.objectController, r.objectInitialSync = r.newObjectInformer()
+}
+
+// Returns a new informer of the objects, with its own store
+func (r *ObjectReplicator) newObjectInformer() (cache.Indexer, cache.Controller, *initialSync) {
+	return newFilledInformer(
+		r.objectActivity.wrap(transformListWatch(pagedListWatch(r.objectListWatch, r.ListPageSize, r.logger), r.stripObject)),
+		r.objectType,
+		r.objectResyncPeriod,
 		cache.ResourceEventHandlerFuncs{
-			AddFunc:    r.ObjectAdded,
-			UpdateFunc: func(old interface{}, new interface{}) {
-				r.ObjectAdded(new)
-			},
-			DeleteFunc: r.ObjectDeleted,
+			AddFunc:    r.enqueueAddedObject,
+			UpdateFunc: r.enqueueUpdatedObject,
+			DeleteFunc: r.enqueueDeletedObject,
 		},
+		r.objectIndexers(),
 	)
 }
 
-// an informer that fills the store on list call
-func newFilledInformer(lw cache.ListerWatcher, objType runtime.Object, resyncPeriod time.Duration, handlers cache.ResourceEventHandler) (cache.Store, cache.Controller) {
-	var store cache.Store
+// initialSync tracks the objects of the first list which have not been handled yet
+type initialSync struct {
+	mutex   sync.Mutex
+	listed  bool
+	pending map[string]bool
+}
+
+// Records the objects of a list, only the first list is tracked
+func (s *initialSync) list(keys map[string]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listed {
+		return
+	}
+	s.listed = true
+	s.pending = make(map[string]bool, len(keys))
+	for key := range keys {
+		s.pending[key] = true
+	}
+}
+
+// Records that an object has been handled, or deleted
+func (s *initialSync) handled(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pending, key)
+}
+
+// Done returns if all the objects of the first list have been handled
+func (s *initialSync) Done() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listed && len(s.pending) == 0
+}
+
+// Returns the last known state of a deleted object, unwrapping the tombstone of a missed deletion
+func lastKnownState(object interface{}) interface{} {
+	if deleted, ok := object.(cache.DeletedFinalStateUnknown); ok {
+		return deleted.Obj
+	}
+	return object
+}
+
+// Returns the "namespace/name" key of an informer object, even when deleted
+func informerKey(object interface{}) (string, error) {
+	object = lastKnownState(object)
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", accessor.GetNamespace(), accessor.GetName()), nil
+}
+
+// an informer that fills the store on list call, indexed with the given indexers
+// the returned initialSync tells when all the objects of the first list have been handled
+func newFilledInformer(lw cache.ListerWatcher, objType runtime.Object, resyncPeriod time.Duration, handlers cache.ResourceEventHandler, indexers cache.Indexers) (cache.Indexer, cache.Controller, *initialSync) {
+	var store cache.Indexer
 	var controller cache.Controller
 	var toAdd map[string]bool
-	store, controller = cache.NewInformer(
+	initial := &initialSync{}
+	store, controller = cache.NewIndexerInformer(
 		&cache.ListWatch{
 			ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
 				if object, err := lw.List(lo); err != nil {
@@ -108,6 +266,9 @@ func newFilledInformer(lw cache.ListerWatcher, objType runtime.Object, resyncPer
 						toAdd[fmt.Sprintf("%s/%s", accessor.GetNamespace(), accessor.GetName())] = true
 					}
 					err = store.Replace(copy, list.GetResourceVersion())
+					if err == nil {
+						initial.list(toAdd)
+					}
 					return object, err
 				}
 			},
@@ -116,213 +277,272 @@ func newFilledInformer(lw cache.ListerWatcher, objType runtime.Object, resyncPer
 		objType,
 		resyncPeriod,
 		cache.ResourceEventHandlerFuncs{
-			AddFunc:    handlers.OnAdd,
+			AddFunc:    func(object interface{}) {
+				handlers.OnAdd(object, false)
+			},
 			UpdateFunc: func(old interface{}, new interface{}) {
 				// because of the store fill up, an "update" event is sent instead of an "add" event
-				if accessor, err := meta.Accessor(old); err == nil {
-					key := fmt.Sprintf("%s/%s", accessor.GetNamespace(), accessor.GetName())
+				if key, err := informerKey(old); err == nil {
 					if toAdd[key] {
 						delete(toAdd, key)
-						handlers.OnAdd(new)
+						handlers.OnAdd(new, true)
+						initial.handled(key)
 						return
 					}
 				}
 				handlers.OnUpdate(old, new)
 			},
-			DeleteFunc: handlers.OnDelete,
+			DeleteFunc: func(object interface{}) {
+				handlers.OnDelete(object)
+				// a listed object may be deleted before being handled
+				if key, err := informerKey(object); err == nil {
+					initial.handled(key)
+				}
+			},
 		},
+		indexers,
 	)
-	return store, controller
+	return store, controller, initial
 }
 
 // NamespaceAdded is called when a namespace is seen in kubernetes
 // Creates the resouces that should be replicated in that namespace
 func (r *ObjectReplicator) NamespaceAdded(object interface{}) {
-	namespace := object.(*v1.Namespace)
-	log.Printf("new namespace %s for %s replication", namespace.Name, r.Name)
-	// find all the objects which want to replicate to that namespace
-	todo := map[string]bool{}
-
-	for source, watched := range r.watchedTargets {
-		for _, ns := range watched {
-			if namespace.Name == strings.SplitN(ns, "/", 2)[0] {
-				todo[source] = true
-				break
-			}
-		}
-	}
+	defer r.runHooks()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.namespaceAdded(object)
+}
 
-	for source, patterns := range r.watchedPatterns {
-		if todo[source] {
-			continue
-		}
+// Handles an added namespace, the mutex must be held
+// Returns the error of the handling, retried unless permanent
+func (r *ObjectReplicator) namespaceAdded(object interface{}) error {
+	return r.namespacesAdded([]string{namespaceName(object)})
+}
 
-		for _, p := range patterns {
-			if p.MatchNamespace(namespace.Name) != "" {
-				todo[source] = true
-				break
-			}
+// Handles a batch of added namespaces at once, the mutex must be held
+// Each source is replicated once to all the namespaces it targets
+// Returns the error of the handling, retried unless permanent
+func (r *ObjectReplicator) namespacesAdded(names []string) error {
+	defer r.observeReconcile("namespace_added", time.Now())
+	defer r.observeReconcileBytes("namespace_added", r.countHandlerBytes())
+	defer r.stats.eventHandled()
+	defer r.observeBookkeeping()
+	// find all the objects which want to replicate to those namespaces
+	todo := map[string][]string{}
+
+	for _, name := range names {
+		r.logger.Info("new namespace", "namespace", name)
+		for source := range r.namespaceWatchedBy(name) {
+			todo[source] = append(todo[source], name)
+		}
+		for source := range r.kubedSelecting(name) {
+			todo[source] = appendMissing(todo[source], name)
 		}
 	}
 	// get all sources and let them replicate
-	for source := range todo {
+	var handleErr error
+	for source, namespaces := range todo {
 		if sourceObject, _, exists, err := r.getFromStore(source); err != nil {
-			log.Printf("could not get %s %s: %s", r.Name, source, err)
+			r.logger.Error(err, "could not get source", "source", source)
+			handleErr = handlingError(handleErr, err)
 		// it should not happen, but maybe `ObjectDeleted` hasn't been called yet
 		// just clean watched targets to avoid this to happen again
 		} else if !exists {
-			log.Printf("%s %s not found", r.Name, source)
-			delete(r.watchedTargets, source)
-			delete(r.watchedPatterns, source)
+			r.logger.Info("source not found", "source", source)
+			r.unwatch(source)
 		// let the source replicate
 		} else {
-			log.Printf("%s %s is watching namespace %s", r.Name, source, namespace.Name)
-			r.replicateToNamespace(sourceObject, namespace.Name)
+			r.logger.V(debugLevel).Info("source is watching namespaces", "source", source, "namespaces", namespaces)
+			handleErr = handlingError(handleErr, r.replicateToNamespaces(sourceObject, namespaces))
 		}
 	}
+	return handleErr
 }
 
-// Replicates a source to a namespace, using the replicate-to annotations
-func (r *ObjectReplicator) replicateToNamespace(object interface{}, namespace string) {
+// Replicates a source to some namespaces, using the replicate-to annotations
+// Returns the error of the replication to the targets, if any
+func (r *ObjectReplicator) replicateToNamespaces(object interface{}, namespaces []string) error {
 	meta := r.GetMeta(object)
 	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
 	// those annotations have priority
 	if _, ok := meta.Annotations[ReplicatedByAnnotation]; ok {
-		return
+		return nil
 	}
 	// get all targets
 	targets, targetPatterns, err := r.getReplicationTargets(meta)
 	if err != nil {
-		log.Printf("could not parse %s %s: %s", r.Name, key, err)
-		return
+		r.logger.Error(err, "could not parse", "object", key)
+		r.warning(object, ReasonInvalid, "%s", err)
+		return permanent(err)
 	}
-	// find the ones matching with the namespace
-	existingTargets := map[string]bool{}
+	// find the ones matching with the namespaces
+	existingTargets := []string{}
 
-	for _, target := range targets {
-		if namespace == strings.SplitN(target, "/", 2)[0] {
-			existingTargets[target] = true
+	for _, namespace := range namespaces {
+		for _, target := range targets {
+			if namespace == strings.SplitN(target, "/", 2)[0] {
+				existingTargets = appendMissing(existingTargets, target)
+			}
 		}
-	}
 
-	for _, pattern := range targetPatterns {
-		if target := pattern.MatchNamespace(namespace); target != "" {
-			existingTargets[target] = true
+		for _, pattern := range targetPatterns {
+			if target := pattern.MatchNamespace(namespace); target != "" {
+				existingTargets = appendMissing(existingTargets, target)
+			}
 		}
 	}
 	// cannot target itself
-	delete(existingTargets, key)
-	if len(existingTargets) == 0 {
-		return
+	for i, target := range existingTargets {
+		if target == key {
+			existingTargets = append(existingTargets[:i], existingTargets[i+1:]...)
+			break
+		}
 	}
-	// get the current targets in order to update the slice
-	currentTargets, ok := r.targetsTo[key]
-	if !ok {
-		currentTargets = []string{}
+	if len(existingTargets) == 0 {
+		return nil
 	}
 	// install all the new targets
-	for target := range existingTargets {
-		log.Printf("%s %s is replicated to %s", r.Name, key, target)
-		currentTargets = append(currentTargets, target)
-		r.installObject(target, nil, object)
-	}
-	// update the current targets
-	r.targetsTo[key] = currentTargets
+	var result syncResult
+	r.syncTargets(&result, existingTargets, func(target string) error {
+		r.logger.V(debugLevel).Info("source is replicated to target", "source", key, "target", target)
+		return r.installObject(target, nil, object)
+	})
 	// no need to update watched namespaces nor pattern namespaces
-	// because if we are here, it means they already match this namespace
+	// because if we are here, it means they already match those namespaces
+	return result.handleErr
 }
 
 // ObjectAdded is called when a new resource is seen in kubernetes
 // Checks its replication status and does the necessaey updates
 func (r *ObjectReplicator) ObjectAdded(object interface{}) {
+	defer r.runHooks()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.objectAdded(object)
+}
+
+// Handles an added or updated resource, the mutex must be held
+// Returns the error of the handling, retried unless permanent
+func (r *ObjectReplicator) objectAdded(object interface{}) error {
+	defer r.observeReconcile("object_added", time.Now())
+	defer r.observeReconcileBytes("object_added", r.countHandlerBytes())
+	defer r.stats.eventHandled()
+	defer r.observeBookkeeping()
 	meta := r.GetMeta(object)
 	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
 	// look for unknown annotations
-	if unknown := UnknownAnnotations(meta.Annotations); len(unknown) > 0 {
+	if unknown := r.prefixes.unknown(meta.Annotations); len(unknown) > 0 {
 		for _, annotation := range unknown {
-			log.Printf("unknown annotation %s on %s %s", annotation, r.Name, key)
+			r.logger.Info("unknown annotation", "object", key, "annotation", annotation)
 		}
 		if !r.IgnoreUnknown {
-			log.Printf("could not parse %s %s: unknown annotation %s", r.Name, key, unknown[0])
-			return
+			r.logger.Error(fmt.Errorf("unknown annotation %s", unknown[0]), "could not parse", "object", key)
+			r.warning(object, ReasonInvalid, "unknown annotation %s", unknown[0])
+			return permanent(fmt.Errorf("unknown annotation %s", unknown[0]))
 		}
 	}
 	// get replication targets
 	targets, targetPatterns, err := r.getReplicationTargets(meta)
 	if err != nil {
-		log.Printf("could not parse %s %s: %s", r.Name, key, err)
-		return
+		r.logger.Error(err, "could not parse", "object", key)
+		r.warning(object, ReasonInvalid, "%s", err)
+		return permanent(err)
 	}
+	var handleErr error
 	// if it was already replicated to some targets
 	// check that the annotations still permit it
-	if oldTargets, ok := r.targetsTo[key]; ok {
-		log.Printf("source %s %s changed", r.Name, key)
+	if oldTargets := r.targetsTo(key); len(oldTargets) > 0 {
+		r.logger.Info("source changed", "source", key)
 
-		sort.Strings(oldTargets)
-		previous := ""
+		wanted := newKeySet(targets...)
 Targets:
-		for _, target := range oldTargets {
-			if target == previous {
+		for _, target := range oldTargets.sorted() {
+			if wanted[target] {
 				continue Targets
 			}
-			previous = target
-
-			for _, t := range targets {
-				if t == target {
-					continue Targets
-				}
-			}
 			for _, p := range targetPatterns {
 				if p.MatchString(target) {
 					continue Targets
 				}
 			}
 			// apparently this target is not valid anymore
-			log.Printf("annotation of source %s %s changed: deleting target %s",
-				r.Name, key, target)
-			r.deleteObject(target, object)
+			r.logger.Info("annotation of source changed: deleting target",
+				"source", key, "target", target, "action", "delete")
+			_, err := r.deleteObject(target, object)
+			handleErr = handlingError(handleErr, err)
 		}
 	}
 	// clean all thos fields, they will be refilled further anyway
-	delete(r.targetsTo, key)
-	delete(r.watchedTargets, key)
-	delete(r.watchedPatterns, key)
+	r.unwatch(key)
+	// this object is replicated from a source of a remote cluster, pull it first
+	if _, ok := meta.Annotations[ReplicateFromClusterAnnotation]; ok && r.Clusters != nil {
+		if err := r.pullFromCluster(object); err != nil {
+			handleErr = handlingError(handleErr, err)
+		// get it back after edit
+		} else if obj, m, err := r.requireFromStore(key); err == nil {
+			object = obj
+			meta = m
+		}
+	}
+	// this object is replicated from a secret of an external store, pull it first
+	if _, ok := meta.Annotations[ReplicateFromExternalAnnotation]; ok && r.ExternalSources != nil {
+		if err := r.pullFromExternal(object); err != nil {
+			handleErr = handlingError(handleErr, err)
+		// get it back after edit
+		} else if obj, m, err := r.requireFromStore(key); err == nil {
+			object = obj
+			meta = m
+		}
+	}
+	// this object is unsealed from a SealedSecret, inherit its replication annotations first
+	// handled again once written
+	if r.SealedSecrets != nil && !r.SealedSecrets.replicateSealed && unsealedFrom(meta) != "" &&
+		r.inheritSealedAnnotations(object) {
+		return handleErr
+	}
 	// check for object having dependencies, and update them
-	if replicas, ok := r.targetsFrom[key]; ok {
-		log.Printf("%s %s has %d dependents", r.Name, key, len(replicas))
-		r.updateDependents(object, replicas)
+	var result syncResult
+	if replicas := r.targetsFrom(key); len(replicas) > 0 {
+		r.logger.V(debugLevel).Info("source has dependents", "source", key, "dependents", len(replicas))
+		result = r.updateDependents(object, replicas)
+		handleErr = handlingError(handleErr, result.handleErr)
+	}
+	// this object was pushed from another cluster, its source is not here
+	if source, ok := meta.Annotations[ReplicatedFromClusterAnnotation]; ok {
+		r.logger.V(debugLevel).Info("target is replicated from another cluster", "target", key, "source", source)
+		return handleErr
 	}
 	// this object was replicated by another, update it
 	if val, ok := meta.Annotations[ReplicatedByAnnotation]; ok {
-		log.Printf("%s %s is replicated by %s", r.Name, key, val)
+		r.logger.V(debugLevel).Info("target is replicated by source", "target", key, "source", val)
 		sourceObject, sourceMeta, exists, err := r.getFromStore(val)
 
 		if err != nil {
-			log.Printf("could not get %s %s: %s", r.Name, val, err)
-			return
+			r.logger.Error(err, "could not get source", "source", val)
+			return handlingError(handleErr, err)
 		// the source has been deleted, so should this object be
 		} else if !exists {
-			log.Printf("source %s %s deleted: deleting target %s", r.Name, val, key)
+			r.logger.Info("source deleted: deleting target", "source", val, "target", key, "action", "delete")
 
 		} else if ok, err := r.isReplicatedTo(sourceMeta, meta); err != nil {
-			log.Printf("could not parse %s %s: %s", r.Name, val, err)
-			return
+			r.logger.Error(err, "could not parse source", "source", val)
+			return handlingError(handleErr, permanent(err))
 		// the source annotations have changed, this replication is deleted
 		} else if !ok {
-			log.Printf("source %s %s is not replicated to %s: deleting target", r.Name, val, key)
+			r.logger.Info("source is not replicated to target: deleting target", "source", val, "target", key, "action", "delete")
 			exists = false
 		}
 		// no source, delete it
 		if !exists {
-			r.doDeleteObject(object)
-			return
+			return handlingError(handleErr, r.doDeleteObject(object))
 		// source is here, install it
 		} else if err := r.installObject("", object, sourceObject); err != nil {
-			return
+			return handlingError(handleErr, err)
 		// get it back after edit
 		} else if obj, m, err := r.requireFromStore(key); err != nil {
-			log.Printf("could not get %s %s: %s", r.Name, key, err)
-			return
+			r.logger.Error(err, "could not get object", "object", key)
+			return handlingError(handleErr, err)
 		// continue
 		} else {
 			object = obj
@@ -331,6 +551,14 @@ Targets:
 			targetPatterns = nil
 		}
 	}
+	// this object is pushed to remote clusters too
+	if r.Clusters != nil {
+		r.pushToClusters(&result, object, targets, targetPatterns)
+	}
+	// this object is exported to external stores too
+	if r.Exporters != nil {
+		r.exportToStores(&result, object)
+	}
 	// this object is replicated to other locations
 	if targets != nil || targetPatterns != nil {
 		existsNamespaces := map[string]bool{} // a cache to remember the done lookups
@@ -348,12 +576,15 @@ Targets:
 			}
 
 			if err != nil {
-				log.Printf("could not get namespace %s: %s", ns, err)
+				r.logger.Error(err, "could not get namespace", "namespace", ns)
 			} else if exists {
 				existingTargets = append(existingTargets, t)
+			} else if r.namespaceCreatable(ns) && r.createNamespace(object, ns) {
+				existsNamespaces[ns] = true
+				existingTargets = append(existingTargets, t)
 			} else {
-				log.Printf("replication of %s %s to %s cancelled: no namespace %s",
-					r.Name, key, t, ns)
+				r.logger.Info("replication cancelled: no namespace",
+					"source", key, "target", t, "namespace", ns)
 			}
 		}
 
@@ -375,108 +606,262 @@ Targets:
 			}
 		}
 		// save all those info
-		if len(targets) > 0 {
-			r.watchedTargets[key] = targets
+		r.watch(key, targets, targetPatterns)
+
+		// the changes are replicated to the canary targets first, nowhere with invalid canary namespaces
+		if _, err := canarySelector(meta); err != nil {
+			r.logger.Error(err, "could not parse canary", "source", key)
+			r.warning(object, ReasonInvalid, "%s", err)
+			existingTargets = nil
+			result.add(permanent(err))
 		}
-
-		if len(targetPatterns) > 0 {
-			r.watchedPatterns[key] = targetPatterns
-		}
-
 		if len(existingTargets) > 0 {
-			r.targetsTo[key] = existingTargets
 			// create all targets
-			for _, t := range existingTargets {
-				log.Printf("%s %s is replicated to %s", r.Name, key, t)
-				r.installObject(t, nil, object)
-			}
+			r.syncTargets(&result, existingTargets, func(t string) error {
+				r.logger.V(debugLevel).Info("source is replicated to target", "source", key, "target", t)
+				return r.installObject(t, nil, object)
+			})
 		}
+		r.sourceSynced(key, result)
+		r.updateSourceStatus(object, result)
+		r.updateStatusResource(object, result)
 		// in this case, replicate-from annoation only refers to the target
 		// so should stop now
-		return
+		return handlingError(handleErr, result.handleErr)
+	}
+	// this object is only a source for its dependents
+	if len(r.targetsFrom(key)) > 0 {
+		r.sourceSynced(key, result)
+	} else {
+		r.lastSyncs.Delete(key)
 	}
+	r.updateSourceStatus(object, result)
+	r.updateStatusResource(object, result)
+	handleErr = handlingError(handleErr, result.handleErr)
 	// this object is replicated from another, update it
-	if val, ok := resolveAnnotation(meta, ReplicateFromAnnotation); ok {
-		log.Printf("%s %s is replicated from %s", r.Name, key, val)
-		// update the dependencies of the source, even if it maybe does not exist yet
-		if _, ok := r.targetsFrom[val]; !ok {
-			r.targetsFrom[val] = make([]string, 0, 1)
-		}
-		r.targetsFrom[val] = append(r.targetsFrom[val], key)
+	if val, ok := resolveAnnotation(meta, ReplicateFromAnnotation); !ok {
+		delete(r.handledDependents, key)
+	} else {
+		r.logger.V(debugLevel).Info("target is replicated from source", "target", key, "source", val)
+		r.handledDependents.add(key)
 
 		if sourceObject, _, exists, err := r.getFromStore(val); err != nil {
-			log.Printf("could not get %s %s: %s", r.Name, val, err)
-			return
+			r.logger.Error(err, "could not get source", "source", val)
+			return handlingError(handleErr, err)
 		// the source does not exist anymore/yet, clear the data of the target
 		} else if !exists {
-			log.Printf("source %s %s deleted: clearing target %s", r.Name, val, key)
-			r.doClearObject(object)
+			r.logger.Info("source deleted: clearing target", "source", val, "target", key, "action", "clear")
+			handleErr = handlingError(handleErr, r.doClearObject(object))
 		// update the target
 		} else {
-			r.replicateObject(object, sourceObject)
+			handleErr = handlingError(handleErr, r.replicateObject(object, sourceObject))
 		}
 	}
+	return handleErr
 }
 
 // Replicates a resource that has a replicate-from annotation from its source
-func (r *ObjectReplicator) replicateObject(object interface{}, sourceObject  interface{}) error {
+// On conflict, retries with the latest version of the resource
+// A target failing repeatedly is backed off
+func (r *ObjectReplicator) replicateObject(object interface{}, sourceObject interface{}) error {
+	key := metaKey(r.GetMeta(object))
+	// the change of the source waits for approval
+	if r.approvalHeld(sourceObject, key) {
+		r.markTarget(object, TargetPending, nil)
+		return nil
+	}
+	// the change of the source is rolled out to the canary targets first
+	if r.canaryHeld(sourceObject, key) {
+		return nil
+	}
+	return r.throughBreaker(key, func() error {
+		err := r.tryReplicateObject(object, sourceObject)
+		return r.retryOnConflict(key, err, func(latest interface{}) error {
+			// deleted meanwhile, nothing to replicate to
+			if latest == nil {
+				return nil
+			}
+			return r.tryReplicateObject(latest, sourceObject)
+		})
+	})
+}
+
+// Replicates a resource that has a replicate-from annotation from its source, once
+func (r *ObjectReplicator) tryReplicateObject(object interface{}, sourceObject  interface{}) error {
 	meta := r.GetMeta(object)
 	sourceMeta := r.GetMeta(sourceObject)
+	logger := r.logger.WithValues("source", metaKey(sourceMeta), "target", metaKey(meta))
+	if !r.ownsSource(metaKey(sourceMeta)) {
+		logger.V(debugLevel).Info("replication is skipped", "reason", "source of another shard")
+		return nil
+	}
+	if err := r.checkManagedBy(meta); err != nil {
+		logger.Info("replication is cancelled", "reason", err)
+		r.warning(object, ReasonCancelled, "%s", err)
+		return permanent(err)
+	}
 	// make sure replication is allowed
 	if ok, nok, err := r.isReplicationAllowed(meta, sourceMeta); ok {
 	} else if nok {
-		log.Printf("replication of %s %s/%s is not allowed: %s", r.Name, meta.Namespace, meta.Name, err)
+		logger.Info("replication is not allowed", "reason", err)
+		r.event(object, v1.EventTypeWarning, ReasonNotAllowed, "%s", err)
+		r.warning(sourceObject, ReasonNotAllowed, "replication to %s/%s: %s", meta.Namespace, meta.Name, err)
 		return r.doClearObject(object)
 	} else {
-		log.Printf("replication of %s %s/%s is cancelled: %s", r.Name, meta.Namespace, meta.Name, err)
-		return err
+		logger.Error(err, "replication is cancelled")
+		r.warning(object, ReasonInvalid, "%s", err)
+		r.markTarget(object, TargetError, err)
+		return permanent(err)
 	}
 	// the source doesn't get its data from
 	if _, ok := sourceMeta.Annotations[ReplicateFromAnnotation]; !ok {
 	// the source is cleared
 	} else if _, ok := sourceMeta.Annotations[ReplicatedFromVersionAnnotation]; !ok {
-		log.Printf("replication of %s %s/%s is cancelled: source %s/%s is cleared", r.Name, meta.Namespace, meta.Name, sourceMeta.Namespace, sourceMeta.Name)
+		logger.Info("replication is cancelled: source is cleared")
 		return r.doClearObject(object)
 	}
 	// check if replication is needed
 	update, once, err := r.needsDataUpdate(meta, sourceMeta);
+	if !update && !once && r.hasDrifted(object, sourceObject) {
+		logger.Info("target has drifted from its source, repairing it")
+		r.metrics.driftRepaired.WithLabelValues(r.Name).Inc()
+		update = true
+	}
 	if !update && !once {
-		log.Printf("replication of %s %s/%s is skipped: %s", r.Name, meta.Namespace, meta.Name, err)
-		return err
+		logger.V(debugLevel).Info("replication is skipped", "reason", err)
+		return nil
+	}
+	// this revision was already written over this version, the store is outdated
+	if update && r.written.written(metaKey(meta), metaKey(sourceMeta), sourceMeta.ResourceVersion, meta.ResourceVersion) {
+		logger.V(debugLevel).Info("replication is skipped", "reason", "revision of the source already written")
+		r.metrics.writesSkipped.WithLabelValues(r.Name).Inc()
+		return nil
+	}
+	// only the version annotations are outdated, writing the same data is a no-op
+	if update && r.hasSameData(object, sourceObject) {
+		logger.V(debugLevel).Info("replication is skipped", "reason", "target already has the data of the source")
+		r.metrics.writesSkipped.WithLabelValues(r.Name).Inc()
+		r.markTarget(object, TargetSynced, nil)
+		return nil
 	}
 	// check if the "replicated-from-allowed" annotation needs an uupdate
 	annotations := r.getReplicationAnnotations(meta, sourceMeta)
+	r.setManagedBy(annotations)
 	if once {
 		valOld, okOld := meta.Annotations[ReplicatedFromAllowedAnnotation]
 		valNew, okNew := meta.Annotations[ReplicatedFromAllowedAnnotation]
 		if okOld == okNew && valOld == valNew {
-			log.Printf("replication of %s %s/%s is skipped: %s", r.Name, meta.Namespace, meta.Name, err)
-			return err
+			logger.V(debugLevel).Info("replication is skipped", "reason", err)
+			return nil
 		}
 	}
 
+	// handled again once all the caches are filled, if asked
+	if r.updateHeldBack("update", metaKey(meta), metaKey(meta)) {
+		return nil
+	}
+
 	var newObject interface{}
+	start := time.Now()
 	if update {
 		updateSMap(annotations, sMap{
-			ReplicatedAtAnnotation:          time.Now().Format(time.RFC3339),
+			ReplicatedAtAnnotation:          r.now().Format(time.RFC3339),
 			ReplicatedFromVersionAnnotation: sourceMeta.ResourceVersion,
 		})
 		transferSMap(annotations, sourceMeta.Annotations, sMap{
 			ReplicateOnceVersionAnnotation: ReplicateOnceVersionAnnotation,
 		})
+		r.setTargetCondition(annotations, TargetSynced, nil)
 		// replicate data
-		log.Printf("replicating %s %s/%s: replicating data", r.Name, meta.Namespace, meta.Name)
-		newObject, err = r.Update(r.client, object, sourceObject, annotations)
+		logger.Info("replicating data", "action", "update")
+		r.unlocked(func() {
+			ctx, cancel := r.requestContext(r.ctx)
+			defer cancel()
+			newObject, err = r.Update(ctx, r.client, object, sourceObject, annotations)
+		})
 	} else {
 		// replicate annotations only
-		log.Printf("replicating %s %s/%s: replicating annotations", r.Name, meta.Namespace, meta.Name)
-		newObject, err = r.Update(r.client, object, nil, annotations)
+		logger.Info("replicating annotations", "action", "update")
+		r.unlocked(func() {
+			ctx, cancel := r.requestContext(r.ctx)
+			defer cancel()
+			newObject, err = r.Update(ctx, r.client, object, nil, annotations)
+		})
 	}
-	// update the object store in advance
+	r.observeAction("update", start, err)
 	if err == nil {
-		err = r.objectStore.Update(newObject)
+		r.observeWritten(newObject)
 	}
-	return err
+	r.audit("update", metaKey(sourceMeta), metaKey(meta), newObject, err)
+	r.callHooks("update", metaKey(sourceMeta), newObject, meta, err)
+	r.stats.actionDone(err)
+	if err != nil {
+		r.event(object, v1.EventTypeWarning, ReasonFailed, "could not replicate from %s/%s: %s", sourceMeta.Namespace, sourceMeta.Name, err)
+		r.warning(sourceObject, ReasonFailed, "could not replicate to %s/%s: %s", meta.Namespace, meta.Name, err)
+		r.markTarget(object, TargetError, err)
+		return err
+	}
+	if update {
+		r.written.set(metaKey(meta), metaKey(sourceMeta), sourceMeta.ResourceVersion, meta.ResourceVersion)
+	}
+	r.event(newObject, v1.EventTypeNormal, ReasonUpdated, "replicated from %s/%s", sourceMeta.Namespace, sourceMeta.Name)
+	r.event(sourceObject, v1.EventTypeNormal, ReasonUpdated, "replicated to %s/%s", meta.Namespace, meta.Name)
+	// update the object store in advance
+	return r.objectStore.Update(newObject)
+}
+
+// DataChecksum returns a checksum of the data of the resource, the one of the actions if they can tell it,
+// or else the checksum of the whole resource but its metadata
+func (r *ObjectReplicator) DataChecksum(object interface{}) string {
+	if checksummer, ok := r.ReplicatorActions.(DataChecksummer); ok {
+		return checksummer.DataChecksum(object)
+	}
+	return objectChecksum(object)
+}
+
+// Returns the checksum of the whole resource but its metadata, an empty string if it cannot be encoded
+func objectChecksum(object interface{}) string {
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return ""
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return ""
+	}
+	data := make(map[string][]byte, len(fields))
+	for key, value := range fields {
+		if key != "metadata" && key != "kind" && key != "apiVersion" {
+			data[key] = value
+		}
+	}
+	return checksumData(data)
+}
+
+// Returns true if the target already holds the data of the source, and has been replicated before
+// Then only its version annotations may be outdated, as after a restart or a prefix migration
+func (r *ObjectReplicator) hasSameData(object interface{}, sourceObject interface{}) bool {
+	if _, ok := r.GetMeta(object).Annotations[ReplicatedFromVersionAnnotation]; !ok {
+		return false
+	}
+	return r.DataChecksum(object) == r.DataChecksum(sourceObject)
+}
+
+// Returns true if the target is recorded as up-to-date, but its data differs from the source's
+// as when edited out-of-band, this is checked each time it is handled, and so at each resync
+// The targets replicated once are allowed to diverge
+func (r *ObjectReplicator) hasDrifted(object interface{}, sourceObject interface{}) bool {
+	meta := r.GetMeta(object)
+	sourceMeta := r.GetMeta(sourceObject)
+	if version, ok := meta.Annotations[ReplicatedFromVersionAnnotation]; !ok || version != sourceMeta.ResourceVersion {
+		return false
+	}
+	for _, annotations := range []map[string]string{meta.Annotations, sourceMeta.Annotations} {
+		if once, err := strconv.ParseBool(annotations[ReplicateOnceAnnotation]); err == nil && once {
+			return false
+		}
+	}
+	return r.DataChecksum(object) != r.DataChecksum(sourceObject)
 }
 
 type installAction int
@@ -489,9 +874,38 @@ const (
 
 // Repliates a resource that has a replicate-to annotation to its target
 // Pass either target string or targetObject object
+// On conflict, retries with the latest version of the target
+// A target failing repeatedly is backed off
 func (r *ObjectReplicator) installObject(target string, targetObject interface{}, sourceObject interface{}) error {
+	if targetObject != nil {
+		target = metaKey(r.GetMeta(targetObject))
+	}
+	// the change of the source is held back
+	if r.heldBack(sourceObject, target) {
+		return nil
+	}
+	// the namespace is being deleted, the installation would only fail
+	if r.namespaceTerminating(strings.SplitN(target, "/", 2)[0]) {
+		r.deferTerminating(target, sourceObject)
+		return nil
+	}
+	return r.throughBreaker(target, func() error {
+		err := r.tryInstallObject(target, targetObject, sourceObject)
+		return r.retryOnConflict(target, err, func(latest interface{}) error {
+			// the latest version is in the store
+			return r.tryInstallObject(target, nil, sourceObject)
+		})
+	})
+}
+
+// Repliates a resource that has a replicate-to annotation to its target, once
+func (r *ObjectReplicator) tryInstallObject(target string, targetObject interface{}, sourceObject interface{}) error {
 	var targetMeta *metav1.ObjectMeta
 	sourceMeta := r.GetMeta(sourceObject)
+	if !r.ownsSource(metaKey(sourceMeta)) {
+		r.logger.V(debugLevel).Info("installation is skipped", "source", metaKey(sourceMeta), "reason", "source of another shard")
+		return nil
+	}
 	var targetSplit []string // similar to target, but splitted in 2
 	var err error
 	var ok bool
@@ -502,21 +916,22 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 		if len(targetSplit) != 2 {
 			err = fmt.Errorf("illformed annotation %s in %s %s/%s: expected namespace/name, got %s",
 				ReplicatedByAnnotation, r.Name, sourceMeta.Namespace, sourceMeta.Name, target)
-			log.Printf("%s", err)
-			return err
+			r.logger.Error(err, "invalid target", "source", metaKey(sourceMeta), "target", target)
+			return permanent(err)
 		}
 
 		// error while getting the target
 		if targetObject, targetMeta, ok, err = r.getFromStore(target); err != nil {
-			log.Printf("could not get %s %s: %s", r.Name, target, err)
+			r.logger.Error(err, "could not get target", "target", target)
 			return err
 		// the target exists already
 		} else if ok {
 			// check if target was created by replication from source
 			if ok, err = r.isReplicatedBy(targetMeta, sourceMeta); !ok {
-				log.Printf("replication of %s %s/%s is cancelled: %s",
-					r.Name, sourceMeta.Namespace, sourceMeta.Name, err)
-				return err
+				r.logger.Info("replication is cancelled",
+					"source", metaKey(sourceMeta), "target", target, "reason", err)
+				r.warning(sourceObject, ReasonCancelled, "%s", err)
+				return permanent(err)
 			}
 		}
 	// targetObject was passed already
@@ -525,6 +940,22 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 		targetSplit = []string{targetMeta.Namespace, targetMeta.Name}
 	}
 
+	// the target is managed by another controller
+	if targetMeta != nil {
+		if err := r.checkManagedBy(targetMeta); err != nil {
+			r.logger.Info("replication is cancelled",
+				"source", metaKey(sourceMeta), "target", metaKey(targetMeta), "reason", err)
+			r.warning(sourceObject, ReasonCancelled, "%s", err)
+			return permanent(err)
+		}
+		if err := r.Flux.checkAdoption(targetMeta); err != nil {
+			r.logger.Info("replication is cancelled",
+				"source", metaKey(sourceMeta), "target", metaKey(targetMeta), "reason", err)
+			r.warning(sourceObject, ReasonCancelled, "%s", err)
+			return permanent(err)
+		}
+	}
+
 	action := installNoop
 	source, okFrom := resolveAnnotation(sourceMeta, ReplicateFromAnnotation);
 
@@ -549,9 +980,29 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 		// the target was previously replicated from another source, replicate again
 		} else if _, ok = targetMeta.Annotations[ReplicateFromAnnotation]; ok {
 			action = installData
+		// only the version annotations are outdated, writing the same data is a no-op
+		} else if ok, once, err = r.needsDataUpdate(targetMeta, sourceMeta); ok && r.hasSameData(targetObject, sourceObject) {
+			r.logger.V(debugLevel).Info("installation is skipped",
+				"source", metaKey(sourceMeta), "target", metaKey(targetMeta), "reason", "target already has the data of the source")
+			r.metrics.writesSkipped.WithLabelValues(r.Name).Inc()
+			if ok, err = r.needsAllowedAnnotationsUpdate(targetMeta, sourceMeta); ok {
+				action = installAnnotations
+			}
+		// this revision was already written over this version, the store is outdated
+		} else if ok && r.written.written(metaKey(targetMeta), metaKey(sourceMeta), sourceMeta.ResourceVersion, targetMeta.ResourceVersion) {
+			r.logger.V(debugLevel).Info("installation is skipped",
+				"source", metaKey(sourceMeta), "target", metaKey(targetMeta), "reason", "revision of the source already written")
+			r.metrics.writesSkipped.WithLabelValues(r.Name).Inc()
 		// data has changed, replicate again
-		} else if ok, once, err = r.needsDataUpdate(targetMeta, sourceMeta); ok {
+		} else if ok {
 			action = installData
+		// data was changed out-of-band, replicate again
+		} else if !once && r.hasDrifted(targetObject, sourceObject) {
+			r.logger.Info("target has drifted from its source, repairing it",
+				"source", metaKey(sourceMeta), "target", metaKey(targetMeta))
+			r.metrics.driftRepaired.WithLabelValues(r.Name).Inc()
+			action = installData
+			err = nil
 		// not an error related to "once" annotation, keep it
 		} else if !once {
 		// allowed annotations should be updated
@@ -563,11 +1014,15 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 		}
 	}
 	if err != nil {
-		log.Printf("replication of %s %s/%s is cancelled: %s",
-			r.Name, sourceMeta.Namespace, sourceMeta.Name, err)
+		r.logger.Error(err, "replication is cancelled", "source", metaKey(sourceMeta))
+	}
+	// an existing target is updated once all the caches are filled, if asked
+	if action != installNoop && targetMeta != nil && r.updateHeldBack("install", metaKey(sourceMeta), metaKey(targetMeta)) {
+		return nil
 	}
 
 	var newObject interface{}
+	start := time.Now()
 	switch action {
 	case installNoop:
 		return nil
@@ -589,14 +1044,21 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 			ReplicationAllowedAnnotation:   ReplicationAllowedAnnotation,
 			ReplicationAllowedNsAnnotation: ReplicationAllowedNsAnnotation,
 		})
+		r.setManagedBy(copyMeta.Annotations)
+		r.stampTarget(&copyMeta, targetMeta, metaKey(sourceMeta))
 		// Needs ResourceVersion for update
 		if targetMeta != nil {
 			copyMeta.ResourceVersion = targetMeta.ResourceVersion
 		}
 
-		log.Printf("installing %s %s/%s: updating replicate-from annotations", r.Name, copyMeta.Namespace, copyMeta.Name)
+		r.logger.Info("installing replicate-from annotations",
+			"source", metaKey(sourceMeta), "target", metaKey(&copyMeta), "action", "install")
 		// install it, but keeps the original data
-		newObject, err = r.Install(r.client, &copyMeta, sourceObject, targetObject)
+		r.unlocked(func() {
+			ctx, cancel := r.requestContext(r.ctx)
+			defer cancel()
+			newObject, err = r.Install(ctx, r.client, &copyMeta, sourceObject, targetObject)
+		})
 
 	case installData:
 		// create a new meta with all the annotations
@@ -605,7 +1067,7 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 			Name:        targetSplit[1],
 				Labels:      cloneSMap(r.Labels),
 			Annotations: sMap{
-				ReplicatedAtAnnotation:          time.Now().Format(time.RFC3339),
+				ReplicatedAtAnnotation:          r.now().Format(time.RFC3339),
 				ReplicatedByAnnotation:          fmt.Sprintf("%s/%s",
 					sourceMeta.Namespace, sourceMeta.Name),
 				ReplicatedFromVersionAnnotation: sourceMeta.ResourceVersion,
@@ -617,14 +1079,22 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 			ReplicationAllowedAnnotation:   ReplicationAllowedAnnotation,
 			ReplicationAllowedNsAnnotation: ReplicationAllowedNsAnnotation,
 		})
+		r.setManagedBy(copyMeta.Annotations)
+		r.stampTarget(&copyMeta, targetMeta, metaKey(sourceMeta))
+		r.setTargetCondition(copyMeta.Annotations, TargetSynced, nil)
 		// Needs ResourceVersion for update
 		if targetMeta != nil {
 			copyMeta.ResourceVersion = targetMeta.ResourceVersion
 		}
 
-		log.Printf("installing %s %s/%s: updating data", r.Name, copyMeta.Namespace, copyMeta.Name)
+		r.logger.Info("installing data",
+			"source", metaKey(sourceMeta), "target", metaKey(&copyMeta), "action", "install")
 		// install it with the source data
-		newObject, err = r.Install(r.client, &copyMeta, sourceObject, sourceObject)
+		r.unlocked(func() {
+			ctx, cancel := r.requestContext(r.ctx)
+			defer cancel()
+			newObject, err = r.Install(ctx, r.client, &copyMeta, sourceObject, sourceObject)
+		})
 
 	case installAnnotations:
 		// copy the target but update replication-allowed annotations
@@ -634,15 +1104,39 @@ func (r *ObjectReplicator) installObject(target string, targetObject interface{}
 			ReplicationAllowedNsAnnotation: ReplicationAllowedNsAnnotation,
 		})
 
-		log.Printf("installing %s %s/%s: updating replication-allowed annotations", r.Name, copyMeta.Namespace, copyMeta.Name)
+		r.logger.Info("installing replication-allowed annotations",
+			"source", metaKey(sourceMeta), "target", metaKey(copyMeta), "action", "install")
 		// install it with the original data
-		newObject, err = r.Install(r.client, copyMeta, sourceObject, targetObject)
+		r.unlocked(func() {
+			ctx, cancel := r.requestContext(r.ctx)
+			defer cancel()
+			newObject, err = r.Install(ctx, r.client, copyMeta, sourceObject, targetObject)
+		})
 	}
-	// update the object store in advance
+	r.observeAction("install", start, err)
 	if err == nil {
-		err = r.objectStore.Update(newObject)
+		r.observeWritten(newObject)
 	}
-	return err
+	r.audit("install", metaKey(sourceMeta), fmt.Sprintf("%s/%s", targetSplit[0], targetSplit[1]), newObject, err)
+	if targetMeta != nil {
+		r.callHooks("install", metaKey(sourceMeta), newObject, targetMeta, err)
+	} else {
+		r.callHooks("install", metaKey(sourceMeta), newObject, &metav1.ObjectMeta{Namespace: targetSplit[0], Name: targetSplit[1]}, err)
+	}
+	r.stats.actionDone(err)
+	if err != nil {
+		r.event(targetObject, v1.EventTypeWarning, ReasonFailed, "could not install from %s/%s: %s", sourceMeta.Namespace, sourceMeta.Name, err)
+		r.warning(sourceObject, ReasonFailed, "could not install %s/%s: %s", targetSplit[0], targetSplit[1], err)
+		r.markTarget(targetObject, TargetError, err)
+		return err
+	}
+	if action == installData && targetMeta != nil {
+		r.written.set(metaKey(targetMeta), metaKey(sourceMeta), sourceMeta.ResourceVersion, targetMeta.ResourceVersion)
+	}
+	r.event(newObject, v1.EventTypeNormal, ReasonInstalled, "installed from %s/%s", sourceMeta.Namespace, sourceMeta.Name)
+	r.event(sourceObject, v1.EventTypeNormal, ReasonInstalled, "installed %s/%s", targetSplit[0], targetSplit[1])
+	// update the object store in advance
+	return r.objectStore.Update(newObject)
 }
 
 // Gets a resource from the object store
@@ -658,12 +1152,12 @@ func (r *ObjectReplicator) getFromStore(key string) (interface{}, *metav1.Object
 	}
 	meta := r.GetMeta(object)
 	if !r.IgnoreUnknown {
-		unknown := UnknownAnnotations(r.GetMeta(object).Annotations)
+		unknown := r.prefixes.unknown(r.GetMeta(object).Annotations)
 		for _, annotation := range unknown {
-			log.Printf("unknown annotation %s on %s %s", annotation, r.Name, key)
+			r.logger.Info("unknown annotation", "object", key, "annotation", annotation)
 		}
 		if len(unknown) > 0 {
-			return nil, nil, false, fmt.Errorf("unknown annotation %s", unknown[0])
+			return nil, nil, false, permanent(fmt.Errorf("unknown annotation %s", unknown[0]))
 		}
 	}
 	return object, meta, true, nil
@@ -676,134 +1170,124 @@ func (r *ObjectReplicator) getFromStore(key string) (interface{}, *metav1.Object
 //  - err: on error or if not present
 func (r *ObjectReplicator) requireFromStore(key string) (interface{}, *metav1.ObjectMeta, error) {
 	object, meta, exists, err := r.getFromStore(key)
+	// handled again when added
 	if err == nil && !exists {
-		return nil, nil, fmt.Errorf("does not exist")
+		return nil, nil, permanent(fmt.Errorf("does not exist"))
 	}
 	return object, meta, err
 }
 
-// Updates the list of all target resources that should be notified when the source is updated
-func (r *ObjectReplicator) updateDependents(object interface{}, replicas []string) error {
+// Updates all the targets replicated from the source, with the replicate-from annotation
+// The dependents not handled yet are skipped, they replicate the source when handled
+// Returns how many dependents were synced, and the last replication error, if any
+func (r *ObjectReplicator) updateDependents(object interface{}, replicas keySet) syncResult {
 	meta := r.GetMeta(object)
 	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
 
-	sort.Strings(replicas)
-	updatedReplicas := make([]string, 0, 0)
-	var previous string
-
-	for _, dependentKey := range replicas {
-		// get rid of dupplicates in replicas
-		if previous == dependentKey {
-			continue
-		}
-		previous = dependentKey
+	updatedReplicas := make([]string, 0, len(replicas))
+	targetObjects := map[string]interface{}{}
+	var result syncResult
 
+	for _, dependentKey := range replicas.sorted() {
 		targetObject, targetMeta, err := r.requireFromStore(dependentKey)
 		if err != nil {
-			log.Printf("could not load dependent %s %s: %s", r.Name, dependentKey, err)
+			r.logger.Error(err, "could not load dependent", "source", key, "target", dependentKey)
 			continue
 		}
 
 		if val, ok := resolveAnnotation(targetMeta, ReplicateFromAnnotation); !ok || val != key {
-			log.Printf("annotation of dependent %s %s changed", r.Name, dependentKey)
+			r.logger.V(debugLevel).Info("annotation of dependent changed", "source", key, "target", dependentKey)
+			continue
+		// replicates the source when handled
+		} else if !r.handledDependents[dependentKey] {
+			r.logger.V(debugLevel).Info("dependent not handled yet", "source", key, "target", dependentKey)
 			continue
 		}
 
 		updatedReplicas = append(updatedReplicas, dependentKey)
-
-		r.replicateObject(targetObject, object)
+		targetObjects[dependentKey] = targetObject
 	}
 
-	if len(updatedReplicas) > 0 {
-		r.targetsFrom[key] = updatedReplicas
-	} else {
-		delete(r.targetsFrom, key)
-	}
+	r.syncTargets(&result, updatedReplicas, func(dependentKey string) error {
+		return r.replicateObject(targetObjects[dependentKey], object)
+	})
 
-	return nil
+	return result
 }
 
-// ObjectDeleted is called when a resource is updated
+// ObjectDeleted is called when a resource is deleted, or with its tombstone when the deletion was missed
 // Checks if a target should be cleared / deleted, or if it should be replaced by a replication
 func (r *ObjectReplicator) ObjectDeleted(object interface{}) {
+	defer r.runHooks()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.objectDeleted(lastKnownState(object))
+}
+
+// Handles a deleted resource, the mutex must be held
+// Returns the error of the handling, retried unless permanent
+func (r *ObjectReplicator) objectDeleted(object interface{}) error {
+	defer r.observeReconcile("object_deleted", time.Now())
+	defer r.observeReconcileBytes("object_deleted", r.countHandlerBytes())
+	defer r.stats.eventHandled()
+	defer r.observeBookkeeping()
 	meta := r.GetMeta(object)
 	key := fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
 	// delete targets of replicate-to annotations
-	if targets, ok := r.targetsTo[key]; ok {
-		for _, t := range targets {
-			r.deleteObject(t, object)
-		}
+	var handleErr error
+	for _, t := range r.targetsTo(key).sorted() {
+		_, err := r.deleteObject(t, object)
+		handleErr = handlingError(handleErr, err)
 	}
-	delete(r.targetsTo, key)
-	delete(r.watchedTargets, key)
-	delete(r.watchedPatterns, key)
-	// clear targets of replicate-from annotations
-	if replicas, ok := r.targetsFrom[key]; ok {
-		sort.Strings(replicas)
-		updatedReplicas := make([]string, 0, 0)
-		var previous string
-
-		for _, dependentKey := range replicas {
-			// get rid of dupplicates in replicas
-			if previous == dependentKey {
-				continue
-			}
-			previous = dependentKey
-
-			if ok, _ := r.clearObject(dependentKey, object); ok {
-				updatedReplicas = append(updatedReplicas, dependentKey)
-			}
-		}
-
-		if len(updatedReplicas) > 0 {
-			r.targetsFrom[key] = updatedReplicas
-		} else {
-			delete(r.targetsFrom, key)
-		}
+	r.unwatch(key)
+	if r.Clusters != nil {
+		r.recoverPushed()
+		r.unpushSource(key)
+		r.Clusters.forget(r.pendingKey(key))
 	}
-	// find which source want to replicate into this object, now that they can
-	todo := map[string]bool{}
-
-	for source, watched := range r.watchedTargets {
-		for _, t := range watched {
-			if key == t {
-				todo[source] = true
-				break
-			}
-		}
+	if actions, ok := r.ReplicatorActions.(*sopsActions); ok {
+		actions.decrypter.forget(key)
 	}
-
-	for source, patterns := range r.watchedPatterns {
-		if todo[source] {
-			continue
-		}
-
-		for _, p := range patterns {
-			if p.Match(meta) {
-				todo[source] = true
-				break
-			}
-		}
+	delete(r.exported, key)
+	r.externalCalls.forget(key)
+	delete(r.canaries, key)
+	delete(r.approvals, key)
+	r.lastSyncs.Delete(key)
+	r.sourceStatuses.delete(key)
+	r.deleteStatusResource(key)
+	r.written.delete(key)
+	delete(r.handledDependents, key)
+	r.sourceLimiters.delete(key)
+	r.breakers.delete(key)
+	r.handledStates.delete(key)
+	// clear targets of replicate-from annotations
+	for _, dependentKey := range r.targetsFrom(key).sorted() {
+		_, err := r.clearObject(dependentKey, object)
+		handleErr = handlingError(handleErr, err)
 	}
+	// find which source want to replicate into this object, now that they can
+	todo := r.targetWatchedBy(meta)
 	// find the first source that still wants to replicate
-	for source := range todo {
+	for _, source := range todo.sorted() {
 		if sourceObject, sourceMeta, exists, err := r.getFromStore(source); err != nil {
-			log.Printf("could not get %s %s: %s", r.Name, source, err)
+			r.logger.Error(err, "could not get source", "source", source)
+			handleErr = handlingError(handleErr, err)
 		// it should not happen, but maybe `ObjectDeleted` hasn't been called yet
 		// just clean watched targets to avoid this to happen again
 		} else if !exists {
-			log.Printf("%s %s not found", r.Name, source)
-			delete(r.watchedTargets, source)
-			delete(r.watchedPatterns, source)
+			r.logger.Info("source not found", "source", source)
+			r.unwatch(source)
 
 		} else if ok, err := r.isReplicatedTo(sourceMeta, meta); err != nil {
-			log.Printf("could not parse %s %s: %s", r.Name, source, err)
+			r.logger.Error(err, "could not parse source", "source", source)
+			handleErr = handlingError(handleErr, permanent(err))
 		// the source sitll want to be replicated, so let's do it
 		} else if ok {
-			r.installObject(key, nil, sourceObject)
+			handleErr = handlingError(handleErr, r.installObject(key, nil, sourceObject))
 			break
 		}
 	}
+	return handleErr
 }
 
 // Clear a resource's data, because its source has been deleted or doesn't allow replication anymore
@@ -812,12 +1296,12 @@ func (r *ObjectReplicator) clearObject(key string, sourceObject interface{}) (bo
 
 	targetObject, targetMeta, err := r.requireFromStore(key)
 	if err != nil {
-		log.Printf("could not load dependent %s %s: %s", r.Name, key, err)
+		r.logger.Error(err, "could not load dependent", "source", metaKey(sourceMeta), "target", key)
 		return false, err
 	}
 
 	if !annotationRefersTo(targetMeta, ReplicateFromAnnotation, sourceMeta) {
-		log.Printf("annotation of dependent %s %s changed", r.Name, key)
+		r.logger.V(debugLevel).Info("annotation of dependent changed", "source", metaKey(sourceMeta), "target", key)
 		return false, nil
 	}
 
@@ -825,8 +1309,30 @@ func (r *ObjectReplicator) clearObject(key string, sourceObject interface{}) (bo
 }
 
 // Actually clear the object, no further check needed
+// On conflict, retries with the latest version of the object
 func (r *ObjectReplicator) doClearObject(object interface{}) error {
+	err := r.tryClearObject(object)
+	return r.retryOnConflict(metaKey(r.GetMeta(object)), err, func(latest interface{}) error {
+		// deleted meanwhile, nothing to clear
+		if latest == nil {
+			return nil
+		}
+		return r.tryClearObject(latest)
+	})
+}
+
+// Actually clear the object, once
+func (r *ObjectReplicator) tryClearObject(object interface{}) error {
 	meta := r.GetMeta(object)
+	if source, _ := resolveAnnotation(meta, ReplicateFromAnnotation); !r.ownsSource(source) {
+		r.logger.V(debugLevel).Info("clearing is skipped", "target", metaKey(meta), "reason", "source of another shard")
+		return nil
+	}
+	if err := r.checkManagedBy(meta); err != nil {
+		r.logger.Info("clearing is cancelled", "target", metaKey(meta), "reason", err)
+		r.warning(object, ReasonCancelled, "%s", err)
+		return permanent(err)
+	}
 	cleared := false
 	// build the annotations
 	annotations := cloneSMap(meta.Annotations)
@@ -843,44 +1349,127 @@ func (r *ObjectReplicator) doClearObject(object interface{}) error {
 	}
 	// check if anything was changed
 	if !cleared {
-		log.Printf("%s %s/%s is already cleared", r.Name, meta.Namespace, meta.Name)
+		r.logger.V(debugLevel).Info("target is already cleared", "target", metaKey(meta))
+		return nil
+	}
+	// handled again once all the caches are filled, if asked
+	if r.updateHeldBack("clear", metaKey(meta), metaKey(meta)) {
 		return nil
 	}
 	// clear the object
-	annotations[ReplicatedAtAnnotation] = time.Now().Format(time.RFC3339)
-	newObject, err := r.Clear(r.client, object, annotations)
-	// update the object store in advance
-	if err == nil {
-		err = r.objectStore.Update(newObject)
+	annotations[ReplicatedAtAnnotation] = r.now().Format(time.RFC3339)
+	r.setManagedBy(annotations)
+	r.setTargetCondition(annotations, TargetStale, nil)
+	start := time.Now()
+	var newObject interface{}
+	var err error
+	r.unlocked(func() {
+		ctx, cancel := r.requestContext(r.ctx)
+		defer cancel()
+		newObject, err = r.Clear(ctx, r.client, object, annotations)
+	})
+	r.observeAction("clear", start, err)
+	source, _ := resolveAnnotation(meta, ReplicateFromAnnotation)
+	r.audit("clear", source, metaKey(meta), newObject, err)
+	r.callHooks("clear", source, newObject, meta, err)
+	r.stats.actionDone(err)
+	if err != nil {
+		r.warning(object, ReasonFailed, "could not clear: %s", err)
+		r.markTarget(object, TargetError, err)
+		return err
 	}
-	return err
+	r.event(newObject, v1.EventTypeNormal, ReasonCleared, "cleared")
+	// update the object store in advance
+	return r.objectStore.Update(newObject)
 }
 
 // Deletes a resource, because its source was deleted or stopped replication
 func (r *ObjectReplicator) deleteObject(key string, sourceObject interface{}) (bool, error) {
 	sourceMeta := r.GetMeta(sourceObject)
+	if !r.ownsSource(metaKey(sourceMeta)) {
+		r.logger.V(debugLevel).Info("deletion is skipped", "target", key, "reason", "source of another shard")
+		return false, nil
+	}
 
 	object, meta, err := r.requireFromStore(key)
 	if err != nil {
-		log.Printf("could not get %s %s: %s", r.Name, key, err)
+		r.logger.Error(err, "could not get object", "object", key)
 		return false, err
 	}
 
 	// make sure replication is allowed
 	if ok, err := r.isReplicatedBy(meta, sourceMeta); !ok {
-		log.Printf("deletion of %s %s is cancelled: %s", r.Name, key, err)
-		return false, err
+		r.logger.Info("deletion is cancelled", "source", metaKey(sourceMeta), "target", key, "reason", err)
+		return false, permanent(err)
 	}
 	// delete the object
-	return true, r.doDeleteObject(object)
+	if err := r.doDeleteObject(object); err != nil {
+		r.event(sourceObject, v1.EventTypeWarning, ReasonFailed, "could not delete %s: %s", key, err)
+		return true, err
+	}
+	r.event(sourceObject, v1.EventTypeNormal, ReasonDeleted, "deleted %s", key)
+	return true, nil
 }
 
 // Actually delete the object, no further check needed
+// On conflict, retries with the latest version of the object, if still replicated by the same source,
+// then handles the target again later, with backoff, if it still conflicts
 func (r *ObjectReplicator) doDeleteObject(object interface{}) error {
-	err := r.Delete(r.client, object)
-	// update the object store in advance
-	if err == nil {
-		err = r.objectStore.Delete(object)
+	meta := r.GetMeta(object)
+	err := r.tryDeleteObject(object)
+	conflicted := isConflict(err)
+	err = r.retryOnConflict(metaKey(meta), err, func(latest interface{}) error {
+		// deleted meanwhile, or replicated by another source since
+		if latest == nil || r.GetMeta(latest).Annotations[ReplicatedByAnnotation] != meta.Annotations[ReplicatedByAnnotation] {
+			return nil
+		}
+		return r.tryDeleteObject(latest)
+	})
+	if err != nil && conflicted {
+		r.retryDelete(metaKey(meta))
 	}
 	return err
 }
+
+// Actually delete the object, once
+func (r *ObjectReplicator) tryDeleteObject(object interface{}) error {
+	meta := r.GetMeta(object)
+	if !r.ownsSource(meta.Annotations[ReplicatedByAnnotation]) {
+		r.logger.V(debugLevel).Info("deletion is skipped", "target", metaKey(meta), "reason", "source of another shard")
+		return nil
+	}
+	if err := r.checkManagedBy(meta); err != nil {
+		r.logger.Info("deletion is cancelled", "target", metaKey(meta), "reason", err)
+		r.warning(object, ReasonCancelled, "%s", err)
+		return permanent(err)
+	}
+	// handled again once all the caches are filled
+	key := metaKey(meta)
+	if r.StartupGate.holdBack(r.Name+"/"+key, func() { r.enqueue(queueItem{key: key}) }) {
+		r.logger.Info("deletion is deferred", "target", key, "reason", "startup safety window")
+		r.metrics.startupHeldActions.WithLabelValues(r.Name, "delete").Inc()
+		return nil
+	}
+	// the store may be outdated, handled again later
+	if r.deleteSuspended(key) {
+		return nil
+	}
+	start := time.Now()
+	var err error
+	r.unlocked(func() {
+		ctx, cancel := r.requestContext(r.ctx)
+		defer cancel()
+		err = r.Delete(ctx, r.client, object)
+	})
+	r.observeAction("delete", start, err)
+	r.audit("delete", meta.Annotations[ReplicatedByAnnotation], metaKey(meta), nil, err)
+	r.callHooks("delete", meta.Annotations[ReplicatedByAnnotation], nil, meta, err)
+	r.stats.actionDone(err)
+	if err != nil {
+		r.warning(object, ReasonFailed, "could not delete: %s", err)
+		return err
+	}
+	r.event(object, v1.EventTypeNormal, ReasonDeleted, "deleted")
+	// update the object store in advance
+	return r.objectStore.Delete(object)
+}
@@ -1,16 +1,22 @@
 package replicate
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-logr/logr"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
@@ -47,9 +53,17 @@ type testActions struct {
 	Store   cache.Store
 	Incr    int
 	Actions []*testAction
+	// count of the next actions on each "namespace/name" to fail with a conflict
+	Conflicts map[string]int
+	// error of the next install on each "namespace/name", not recorded as an action
+	Errors map[string]error
 }
 
 func hasConflict(a *testActions, meta *metav1.ObjectMeta) (bool, error) {
+	if key := metaKey(meta); a.Conflicts[key] > 0 {
+		a.Conflicts[key]--
+		return true, nil
+	}
 	current, ok, err := a.Store.Get(&testObject{
 		Meta: *meta,
 	})
@@ -62,11 +76,36 @@ func hasConflict(a *testActions, meta *metav1.ObjectMeta) (bool, error) {
 	return meta.ResourceVersion != current.(*testObject).Meta.ResourceVersion, nil
 }
 
+// The error returned by kubernetes on conflict
+func testConflict(meta *metav1.ObjectMeta) error {
+	return errors.NewConflict(schema.GroupResource{Resource: "test"}, metaKey(meta), fmt.Errorf("conflict"))
+}
+
+func (a *testActions) Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error) {
+	object, ok, err := a.Store.GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "test"}, name)
+	}
+	return object, nil
+}
+
 func (*testActions) GetMeta(object interface{}) *metav1.ObjectMeta {
 	return &object.(*testObject).Meta
 }
 
-func (a *testActions) Update(client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+func (*testActions) DataChecksum(object interface{}) string {
+	return checksumData(map[string][]byte{
+		"data": []byte(object.(*testObject).Data),
+	})
+}
+
+func (*testActions) DataSize(object interface{}) int {
+	return len(object.(*testObject).Data)
+}
+
+func (a *testActions) Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
 	target := object.(*testObject)
 	data := ""
 	if sourceObject != nil {
@@ -91,13 +130,13 @@ func (a *testActions) Update(client kubernetes.Interface, object interface{}, so
 	a.Actions = append(a.Actions, action)
 	if conflict {
 		log.Printf("update conflict %s/%s", target.Meta.Namespace, target.Meta.Name)
-		return nil, fmt.Errorf("conflict %s/%s", target.Meta.Namespace, target.Meta.Name)
+		return nil, testConflict(&target.Meta)
 	}
 	log.Printf("updating test %s/%s with data \"%s\"", target.Meta.Namespace, target.Meta.Name, data)
 	return action.Object.Refresh(a), nil
 }
 
-func (a *testActions) Clear(client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
+func (a *testActions) Clear(ctx context.Context, client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
 	target := object.(*testObject)
 	conflict, err := hasConflict(a, &target.Meta)
 	require.NoError(a.T, err)
@@ -118,13 +157,17 @@ func (a *testActions) Clear(client kubernetes.Interface, object interface{}, ann
 	a.Actions = append(a.Actions, action)
 	if conflict {
 		log.Printf("clear conflict %s/%s", target.Meta.Namespace, target.Meta.Name)
-		return nil, fmt.Errorf("conflict %s/%s", target.Meta.Namespace, target.Meta.Name)
+		return nil, testConflict(&target.Meta)
 	}
 	log.Printf("clearing test %s/%s", target.Meta.Namespace, target.Meta.Name)
 	return action.Object.Refresh(a), nil
 }
 
-func (a *testActions) Install(client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+func (a *testActions) Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+	if err, ok := a.Errors[metaKey(meta)]; ok {
+		delete(a.Errors, metaKey(meta))
+		return nil, err
+	}
 	source := sourceObject.(*testObject)
 	data := ""
 	if dataObject != nil {
@@ -144,13 +187,13 @@ func (a *testActions) Install(client kubernetes.Interface, meta *metav1.ObjectMe
 	a.Actions = append(a.Actions, action)
 	if conflict {
 		log.Printf("install conflict %s/%s", meta.Namespace, meta.Name)
-		return nil, fmt.Errorf("conflict %s/%s", meta.Namespace, meta.Name)
+		return nil, testConflict(meta)
 	}
 	log.Printf("installing test %s/%s with type \"%s\" and data \"%s\"", meta.Namespace, meta.Name, source.Type, data)
 	return action.Object.Refresh(a), nil
 }
 
-func (a *testActions) Delete(client kubernetes.Interface, object interface{}) error {
+func (a *testActions) Delete(ctx context.Context, client kubernetes.Interface, object interface{}) error {
 	target := object.(*testObject)
 	conflict, err := hasConflict(a, &target.Meta)
 	require.NoError(a.T, err)
@@ -166,7 +209,7 @@ func (a *testActions) Delete(client kubernetes.Interface, object interface{}) er
 	a.Actions = append(a.Actions, action)
 	if conflict {
 		log.Printf("delete conflict %s/%s", target.Meta.Namespace, target.Meta.Name)
-		return fmt.Errorf("conflict %s/%s", target.Meta.Namespace, target.Meta.Name)
+		return testConflict(&target.Meta)
 	}
 	log.Printf("deleting test %s/%s", target.Meta.Namespace, target.Meta.Name)
 	require.NoError(a.T, a.Store.Delete(&action.Object))
@@ -182,17 +225,31 @@ func namespaceKey(object interface{}) (string, error) {
 	return object.(*v1.Namespace).Name, nil
 }
 
+// Returns a new config map replicator, failing the test if it could not be created
+func newTestConfigMapReplicator(t *testing.T, client kubernetes.Interface, opts ...Option) *ObjectReplicator {
+	t.Helper()
+	replicator, err := NewConfigMapReplicator(client, opts...)
+	require.NoError(t, err)
+	return replicator.(*ObjectReplicator)
+}
+
+// Returns a new secret replicator, failing the test if it could not be created
+func newTestSecretReplicator(t *testing.T, client kubernetes.Interface, opts ...Option) *ObjectReplicator {
+	t.Helper()
+	replicator, err := NewSecretReplicator(client, opts...)
+	require.NoError(t, err)
+	return replicator.(*ObjectReplicator)
+}
+
 func createTestReplicator(t *testing.T, options ReplicatorOptions, namespaces ...string) *ObjectReplicator {
-	objectStore := cache.NewStore(testKey)
 	namespaceStore := cache.NewStore(namespaceKey)
+	actions := &testActions{T: t}
 	replicator := &ObjectReplicator{
-		ReplicatorProps: NewReplicatorProps(nil, "test", options),
-		ReplicatorActions: &testActions{
-			T:     t,
-			Store: objectStore,
-		},
+		ReplicatorProps:   NewReplicatorProps(nil, "test", options),
+		ReplicatorActions: actions,
 	}
-	replicator.objectStore = objectStore
+	replicator.objectStore = cache.NewIndexer(testKey, replicator.objectIndexers())
+	actions.Store = replicator.objectStore
 	replicator.namespaceStore = namespaceStore
 	if len(namespaces) > 0 {
 		objects := []interface{}{}
@@ -411,6 +468,8 @@ func TestReplicateFrom_simple(t *testing.T) {
 		annotationsPrefix + "unknown": "...",
 		ReplicatedFromVersionAnnotation: "6",
 	})
+	// up-to-date, not drifted
+	target.Data = source.Data
 	r.ObjectAdded(target)
 	requireActionsLength(t, r, 4)
 
@@ -1138,6 +1197,8 @@ func TestReplicateTo_name(t *testing.T) {
 		ReplicatedByAnnotation: "my-ns/source",
 		annotationsPrefix + "new": "...",
 	})
+	// up-to-date, not drifted
+	other.Data = source.Data
 	r.ObjectAdded(other)
 	requireActionsLength(t, r, 4)
 
@@ -2229,7 +2290,11 @@ func Test_newFilledInformer(t *testing.T) {
 
 	var store cache.Store
 	var controller cache.Controller
+	// the handlers run in the informer goroutine
+	var mutex sync.Mutex
 	nsAdded := func (object interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
 		ns, ok := object.(*v1.Namespace)
 		require.True(t, ok)
 		assert.Truef(t, todo[ns.Name], "already added %s", ns.Name)
@@ -2250,6 +2315,8 @@ func Test_newFilledInformer(t *testing.T) {
 
 	var toUpdate *v1.Namespace
 	nsUpdated := func (old interface{}, new interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
 		ns, ok := new.(*v1.Namespace)
 		require.True(t, ok)
 		ons, ok := old.(*v1.Namespace)
@@ -2263,6 +2330,8 @@ func Test_newFilledInformer(t *testing.T) {
 
 	var toDelete *v1.Namespace
 	nsDelete := func (object interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
 		ns, ok := object.(*v1.Namespace)
 		require.True(t, ok)
 		if assert.NotNilf(t, toDelete, "unexpected delete %s", ns.Name) && assert.Equal(t, toDelete.Name, ns.Name, "unexpected delete %s, expected %s", ns.Name, toDelete.Name) {
@@ -2273,12 +2342,14 @@ func Test_newFilledInformer(t *testing.T) {
 
 	client := fake.NewSimpleClientset(objects...)
 	namespaces := client.CoreV1().Namespaces()
-	store, controller = newFilledInformer(
+	store, controller, _ = newFilledInformer(
 		&cache.ListWatch{
 			ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
-				return namespaces.List(lo)
+				return namespaces.List(context.TODO(), lo)
+			},
+			WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+				return namespaces.Watch(context.TODO(), lo)
 			},
-			WatchFunc: namespaces.Watch,
 		},
 		&v1.Namespace{},
 		resyncPeriod,
@@ -2287,10 +2358,12 @@ func Test_newFilledInformer(t *testing.T) {
 			UpdateFunc: nsUpdated,
 			DeleteFunc: nsDelete,
 		},
+		cache.Indexers{},
 	)
 	go controller.Run(wait.NeverStop)
 
 	time.Sleep(sleep)
+	mutex.Lock()
 	assert.Emptyf(t, todo, "todo")
 	toUpdate = &v1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
@@ -2304,10 +2377,290 @@ func Test_newFilledInformer(t *testing.T) {
 			},
 		},
 	}
-	namespaces.Update(toUpdate.DeepCopy())
+	update := toUpdate.DeepCopy()
 	toDelete = copies["ns2"]
-	namespaces.Delete("ns2", &metav1.DeleteOptions{})
+	mutex.Unlock()
+	namespaces.Update(context.TODO(), update, metav1.UpdateOptions{})
+	namespaces.Delete(context.TODO(), "ns2", metav1.DeleteOptions{})
 	time.Sleep(sleep)
+	mutex.Lock()
+	defer mutex.Unlock()
 	assert.Nil(t, toUpdate, "update expected")
 	assert.Nil(t, toDelete, "delete expected")
 }
+
+func Test_newFilledInformer_initialSync(t *testing.T) {
+	objects := []runtime.Object{}
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		objects = append(objects, &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: ns,
+			},
+		})
+	}
+	client := fake.NewSimpleClientset(objects...)
+	namespaces := client.CoreV1().Namespaces()
+	handled := make(chan bool)
+	_, controller, initial := newFilledInformer(
+		&cache.ListWatch{
+			ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+				return namespaces.List(context.TODO(), lo)
+			},
+			WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+				return namespaces.Watch(context.TODO(), lo)
+			},
+		},
+		&v1.Namespace{},
+		time.Hour,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(object interface{}) {
+				<-handled
+			},
+		},
+		cache.Indexers{},
+	)
+	assert.False(t, initial.Done(), "not listed")
+	go controller.Run(wait.NeverStop)
+
+	handled <- true
+	handled <- true
+	assert.False(t, initial.Done(), "one object not handled")
+	handled <- true
+	require.Eventually(t, initial.Done, time.Second, 10*time.Millisecond, "all objects handled")
+}
+
+func Test_informerActivity(t *testing.T) {
+	now := time.Now()
+	activity := newInformerActivity("namespace", newReplicatorMetrics(), logr.Discard())
+	activity.now = func() time.Time {
+		return now
+	}
+	assert.NoError(t, activity.stalled(time.Minute), "not running")
+
+	client := fake.NewSimpleClientset()
+	namespaces := client.CoreV1().Namespaces()
+	_, controller, _ := newFilledInformer(
+		activity.wrap(&cache.ListWatch{
+			ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+				return namespaces.List(context.TODO(), lo)
+			},
+			WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+				return namespaces.Watch(context.TODO(), lo)
+			},
+		}),
+		&v1.Namespace{},
+		time.Hour,
+		cache.ResourceEventHandlerFuncs{},
+		cache.Indexers{},
+	)
+	stop := make(chan struct{})
+	go activity.run(controller, stop)
+	require.Eventually(t, controller.HasSynced, time.Second, 10*time.Millisecond)
+	assert.NoError(t, activity.stalled(time.Minute), "running")
+
+	now = now.Add(2 * time.Minute)
+	assert.Error(t, activity.stalled(time.Minute), "silent")
+	assert.NoError(t, activity.stalled(0), "threshold disabled")
+	_, err := namespaces.Create(context.TODO(), &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "ns1",
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return activity.stalled(time.Minute) == nil
+	}, time.Second, 10*time.Millisecond, "event received")
+
+	close(stop)
+	require.Eventually(t, func() bool {
+		return activity.stalled(0) != nil
+	}, time.Second, 10*time.Millisecond, "stopped")
+}
+
+func Test_informerActivity_failures(t *testing.T) {
+	activity := newInformerActivity("namespace", newReplicatorMetrics(), logr.Discard())
+	delays := []time.Duration{}
+	activity.sleep = func(delay time.Duration) {
+		delays = append(delays, delay)
+	}
+	listErrors := 3
+	watcher := watch.NewFake()
+	lw := activity.wrap(&cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			if listErrors > 0 {
+				listErrors--
+				return nil, errors.NewServiceUnavailable("restarting")
+			}
+			return &v1.NamespaceList{}, nil
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	})
+
+	// backs off after each consecutive failure
+	for i := 0; i < 3; i++ {
+		_, err := lw.List(metav1.ListOptions{})
+		assert.Error(t, err)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, delays)
+	_, err := lw.List(metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, delays)
+	assert.Equal(t, 0, activity.failures)
+	assert.Equal(t, 1, activity.lists)
+
+	// an expired watch is not a failure
+	w, err := lw.Watch(metav1.ListOptions{})
+	require.NoError(t, err)
+	go watcher.Error(&errors.NewResourceExpired("too old").ErrStatus)
+	<-w.ResultChan()
+	assert.Equal(t, 0, activity.failures)
+	go watcher.Error(&errors.NewInternalError(fmt.Errorf("failed")).ErrStatus)
+	<-w.ResultChan()
+	assert.Equal(t, 1, activity.failures)
+	assert.Equal(t, time.Second, activity.backoffDelay())
+	w.Stop()
+
+	// relisted
+	_, err = lw.List(metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, activity.lists)
+	assert.Equal(t, 0, activity.failures)
+}
+
+func TestReplicateFrom_sameData(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{})
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	// the same data, with an outdated version
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation:         "source-ns/source",
+		ReplicatedFromVersionAnnotation: "outdated",
+	})
+	target.Data = source.Data
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 0)
+	// never replicated, the version must be recorded
+	target = updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	target.Data = source.Data
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 1)
+	// other data
+	target = updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation:         "source-ns/source",
+		ReplicatedFromVersionAnnotation: "outdated",
+	})
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+}
+
+func TestReplicateTo_sameData(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	// the same data, with an outdated version
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicatedByAnnotation:          "source-ns/source",
+		ReplicatedFromVersionAnnotation: "outdated",
+	})
+	target.Data = source.Data
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 0)
+	// other data
+	source = updateObject(r, "source-ns", "source", nil)
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, "install", r.ReplicatorActions.(*testActions).Actions[0].Action)
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+}
+
+func TestReplicateFrom_drift(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{})
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 1)
+	// edited out-of-band, the annotations are still up-to-date
+	target = updateObject(r, "target-ns", "target", nil)
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, "update", r.ReplicatorActions.(*testActions).Actions[1].Action)
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+	// replicated once, allowed to diverge
+	target = updateObject(r, "target-ns", "target", nil)
+	target.Meta.Annotations[ReplicateOnceAnnotation] = "true"
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 2)
+}
+
+func TestReplicateTo_drift(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	// edited out-of-band, the annotations are still up-to-date
+	updateObject(r, "target-ns", "target", nil)
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, "install", r.ReplicatorActions.(*testActions).Actions[1].Action)
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+}
+
+func TestObjectDeleted_tombstone(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+
+	// the deletion was missed, only the last known state is given
+	deleteObject(r, "source-ns", "source")
+	r.ObjectDeleted(cache.DeletedFinalStateUnknown{
+		Key: "source-ns/source",
+		Obj: source,
+	})
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, "delete", r.ReplicatorActions.(*testActions).Actions[1].Action)
+	assertStore(t, r, "target-ns", "target", "")
+}
+
+// Actions implementing only the required methods, none of the optional interfaces
+type requiredActions struct {
+	ReplicatorActions
+}
+
+func TestOptionalActions(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns")
+	r.ReplicatorActions = requiredActions{r.ReplicatorActions}
+	_, err := r.Get(context.TODO(), r.client, "source-ns", "source")
+	assert.Error(t, err)
+
+	// the checksum of the whole resource but its metadata
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "source"},
+		Data:       map[string]string{"key": "value"},
+	}
+	checksum := r.DataChecksum(configMap)
+	assert.NotEmpty(t, checksum)
+	annotated := configMap.DeepCopy()
+	annotated.Annotations = M{"other": "value"}
+	assert.Equal(t, checksum, r.DataChecksum(annotated))
+	changed := configMap.DeepCopy()
+	changed.Data["key"] = "changed"
+	assert.NotEqual(t, checksum, r.DataChecksum(changed))
+}
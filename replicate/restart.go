@@ -0,0 +1,113 @@
+// Restart of the dead or failing informers, without restarting the pod
+
+package replicate
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// how often the informers are checked
+	restartCheckInterval = 30 * time.Second
+	// the delay before restarting again an informer, doubled on each consecutive restart
+	restartBaseDelay = time.Minute
+	restartMaxDelay  = 30 * time.Minute
+)
+
+// Returns an error if the informer stopped, or its lists and watches failed the given times in a row
+func (a *informerActivity) dead(failures int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.running {
+		return nil
+	} else if a.stopped {
+		return fmt.Errorf("%s informer stopped", a.name)
+	} else if failures > 0 && a.failures >= failures {
+		return fmt.Errorf("%s informer failed %d times in a row", a.name, a.failures)
+	}
+	return nil
+}
+
+// Restarts the informer of the objects when it is dead, until stopped
+// The consecutive restarts are backed off, the backoff is reset once the informer is healthy
+// The namespace informer is shared with the other replicators, and is never restarted
+func (r *ObjectReplicator) superviseObjectInformer(stop <-chan struct{}) {
+	if r.RestartFailures <= 0 {
+		return
+	}
+	restarts := 0
+	var next time.Time
+	wait.Until(func() {
+		err := r.objectActivity.dead(r.RestartFailures)
+		if err == nil {
+			if restarts > 0 && time.Now().After(next) {
+				restarts = 0
+			}
+			return
+		} else if time.Now().Before(next) {
+			return
+		}
+		delay := restartBaseDelay
+		for i := 0; i < restarts && delay < restartMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > restartMaxDelay {
+			delay = restartMaxDelay
+		}
+		restarts++
+		next = time.Now().Add(delay)
+		r.restartObjectInformer(err)
+	}, restartCheckInterval, stop)
+}
+
+// Replaces the informer of the objects by a new one, with a new store
+// The store is swapped once the new one is synced, then the objects missing from it are deleted
+func (r *ObjectReplicator) restartObjectInformer(reason error) {
+	r.logger.Error(reason, "restarting informer", "informer", r.Name)
+	r.metrics.informerRestarts.WithLabelValues(r.Name).Inc()
+	select {
+	case <-r.objectStop:
+	default:
+		close(r.objectStop)
+	}
+	stop := make(chan struct{})
+	r.objectStop = stop
+	store, controller, initial := r.newObjectInformer()
+	go r.objectActivity.run(controller, stop)
+	if !cache.WaitForCacheSync(stop, controller.HasSynced) {
+		return
+	}
+	r.swapObjectStore(store, controller, initial)
+	r.logger.Info("informer restarted", "informer", r.Name)
+}
+
+// Returns the store of the objects for the readers without the mutex, since it is swapped with the mutex held
+func (r *ObjectReplicator) currentObjectStore() cache.Indexer {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.objectStore
+}
+
+// Swaps the store and the controller of the objects,
+// then queues the deletion of the objects missing from the new store
+func (r *ObjectReplicator) swapObjectStore(store cache.Indexer, controller cache.Controller, initial *initialSync) {
+	r.mutex.Lock()
+	old := r.objectStore
+	r.objectStore = store
+	r.objectController = controller
+	r.objectInitialSync = initial
+	r.mutex.Unlock()
+	for _, object := range old.List() {
+		key, err := cache.MetaNamespaceKeyFunc(object)
+		if err != nil {
+			continue
+		}
+		if _, exists, err := store.GetByKey(key); err == nil && !exists {
+			r.enqueueDeletedObject(object)
+		}
+	}
+}
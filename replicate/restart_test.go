@@ -0,0 +1,86 @@
+package replicate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestInformerActivity_dead(t *testing.T) {
+	activity := newInformerActivity("secrets", newReplicatorMetrics(), logr.Discard())
+	assert.NoError(t, activity.dead(3), "not running")
+	activity.running = true
+	assert.NoError(t, activity.dead(3))
+	activity.failures = 3
+	assert.Error(t, activity.dead(3), "failing")
+	assert.NoError(t, activity.dead(0), "never restarted")
+	activity.failures = 0
+	activity.stopped = true
+	assert.Error(t, activity.dead(3), "stopped")
+}
+
+func TestRestartObjectInformer(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "kept"}},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "gone"}},
+	)
+	r := newTestConfigMapReplicator(t, client, WithOptions(ReplicatorOptions{RestartFailures: 3}), WithResyncPeriod(time.Hour))
+	r.Name = "restart"
+	r.Start()
+	require.Eventually(t, r.Ready, 5*time.Second, 10*time.Millisecond)
+
+	// the controller dies, and misses a deletion
+	close(r.objectStop)
+	require.Eventually(t, func() bool {
+		return r.objectActivity.dead(r.RestartFailures) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, client.CoreV1().ConfigMaps("source-ns").Delete(context.TODO(), "gone", metav1.DeleteOptions{}))
+	old := r.objectStore
+	restarts := counterValue(t, r.metrics.informerRestarts, "restart")
+
+	r.restartObjectInformer(errors.New("stopped"))
+	assert.Equal(t, restarts+1, counterValue(t, r.metrics.informerRestarts, "restart"))
+	assert.False(t, old == r.objectStore, "new store")
+	assert.ElementsMatch(t, []string{"source-ns/kept"}, r.objectStore.ListKeys())
+	assert.NoError(t, r.objectActivity.dead(r.RestartFailures))
+	require.Eventually(t, r.Ready, 5*time.Second, 10*time.Millisecond)
+}
+
+// Meant to be run with -race: the informer handlers read the store while it is swapped
+func TestSwapObjectStore_concurrentReaders(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{SkipUnchanged: true}, "source-ns", "target-ns")
+	r.initQueue()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for i := 0; i < 100; i++ {
+			r.enqueueUpdatedObject(source, source)
+			r.recomputeShed()
+			r.Status()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		store := cache.NewIndexer(testKey, r.objectIndexers())
+		require.NoError(t, store.Add(source))
+		r.swapObjectStore(store, r.objectController, r.objectInitialSync)
+	}
+	group.Wait()
+	assert.ElementsMatch(t, []string{"source-ns/source"}, r.currentObjectStore().ListKeys())
+}
@@ -0,0 +1,67 @@
+// Forced resynchronization of all the sources
+
+package replicate
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Returns the resync period lengthened by a random fraction of up to jitter of itself
+// such that the replicators, and the replicas of the controller, do not resync at the same moment
+func jitteredPeriod(period time.Duration, jitter float64) time.Duration {
+	if period <= 0 || jitter <= 0 {
+		return period
+	}
+	return wait.Jitter(period, jitter)
+}
+
+// Resync queues again all the objects in the store, as on a periodic resync
+// They are handled by the workers, rate limited, retried and backed off as any other event
+// Returns false if a resync is already running
+func (r *ObjectReplicator) Resync() bool {
+	if !atomic.CompareAndSwapInt32(&r.resyncing, 0, 1) {
+		return false
+	}
+	defer atomic.StoreInt32(&r.resyncing, 0)
+
+	objects := r.objectStore.List()
+	r.logger.Info("forced resync", "objects", len(objects))
+	for _, object := range objects {
+		r.enqueueObject(object)
+	}
+	return true
+}
+
+// ResyncAll queues a resync of all the replicators in parallel, and waits for them
+func ResyncAll(replicators []Replicator) {
+	done := make(chan bool, len(replicators))
+	for _, replicator := range replicators {
+		go func(replicator Replicator) {
+			done <- replicator.Resync()
+		}(replicator)
+	}
+	for range replicators {
+		<-done
+	}
+}
+
+// ResyncHandler queues a resync of all the replicators on POST
+// It is not authenticated, so it must not be exposed out of the cluster
+type ResyncHandler struct {
+	Replicators []Replicator
+}
+
+func (h *ResyncHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.Header().Set("Allow", http.MethodPost)
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// the objects are only queued, the workers handle them
+	ResyncAll(h.Replicators)
+	res.WriteHeader(http.StatusAccepted)
+}
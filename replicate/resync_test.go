@@ -0,0 +1,18 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitteredPeriod(t *testing.T) {
+	assert.Equal(t, time.Hour, jitteredPeriod(time.Hour, 0))
+	assert.Equal(t, time.Duration(0), jitteredPeriod(0, 0.1))
+	for i := 0; i < 10; i++ {
+		period := jitteredPeriod(time.Hour, 0.1)
+		assert.True(t, period >= time.Hour, period.String())
+		assert.True(t, period <= time.Hour+6*time.Minute, period.String())
+	}
+}
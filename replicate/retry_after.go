@@ -0,0 +1,40 @@
+// Backoff of the actions throttled by the API server
+
+package replicate
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// how long a throttled object waits when the API server does not tell
+const defaultRetryAfter = time.Second
+
+// the longest a throttled object waits, whatever the API server tells
+const maxRetryAfter = 5 * time.Minute
+
+// Returns true if the API server throttled the action, with 429 Too Many Requests,
+// as when its priority and fairness queues are full, and how long to wait from its Retry-After
+func retryAfter(err error) (time.Duration, bool) {
+	if err == nil || !errors.IsTooManyRequests(err) {
+		return 0, false
+	}
+	delay := defaultRetryAfter
+	if seconds, ok := errors.SuggestsClientDelay(err); ok && seconds > 0 {
+		delay = time.Duration(seconds) * time.Second
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
+}
+
+// Returns the longest delay asked since last called, 0 if not throttled
+func (s *replicatorStats) takeRetryAfter() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delay := s.retryAfter
+	s.retryAfter = 0
+	return delay
+}
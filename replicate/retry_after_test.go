@@ -0,0 +1,51 @@
+package replicate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestRetryAfter(t *testing.T) {
+	_, ok := retryAfter(nil)
+	assert.False(t, ok)
+	_, ok = retryAfter(fmt.Errorf("failed"))
+	assert.False(t, ok)
+
+	delay, ok := retryAfter(errors.NewTooManyRequests("throttled", 3))
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+	delay, ok = retryAfter(errors.NewTooManyRequests("throttled", 0))
+	assert.True(t, ok)
+	assert.Equal(t, defaultRetryAfter, delay)
+	delay, _ = retryAfter(errors.NewTooManyRequests("throttled", 3600))
+	assert.Equal(t, maxRetryAfter, delay)
+}
+
+func TestQueue_retryAfter(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{RetryBudget: 1, FailureThreshold: 1, FailureBackoff: time.Hour},
+		"source-ns", "target-ns")
+	r.initQueue()
+	actions := r.ReplicatorActions.(*testActions)
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+
+	// neither a failure, nor a retry, nor a failure of the target
+	actions.Errors = map[string]error{"target-ns/target": errors.NewTooManyRequests("throttled", 1)}
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	assert.Equal(t, 0, r.Status().FailedActions)
+	assert.Equal(t, 0, r.queue.NumRequeues(queueItem{key: "source-ns/source"}))
+	assert.Equal(t, 0, r.Status().BackedOff)
+	assert.Zero(t, r.stats.takeRetryAfter())
+
+	// handled again after the delay
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 1)
+	require.NotNil(t, getObject(r, "target-ns", "target"))
+}
@@ -0,0 +1,508 @@
+// Replication of the secrets unsealed from SealedSecrets, or of the SealedSecrets themselves
+
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// SealedSecretAPIVersion is the API version of the SealedSecrets of the sealed-secrets controller
+	SealedSecretAPIVersion      = "bitnami.com/v1alpha1"
+	// the kind of the owner of the unsealed secrets
+	sealedSecretKind            = "SealedSecret"
+	// the annotation of the SealedSecrets which may be unsealed in any namespace
+	sealedClusterWideAnnotation = "sealedsecrets.bitnami.com/cluster-wide"
+)
+
+// the resource of the SealedSecrets, watched through the dynamic client
+var sealedSecretResource = schema.GroupVersionResource{Group: "bitnami.com", Version: "v1alpha1", Resource: "sealedsecrets"}
+
+// SealedSecret is a secret encrypted for the sealed-secrets controller, which unseals it into a secret of the same name
+// The spec is kept as it is, to replicate it without knowing all its fields
+type SealedSecret struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              json.RawMessage `json:"spec"`
+}
+
+// Returns the annotations of the template of the unsealed secret
+func (s *SealedSecret) templateAnnotations() map[string]string {
+	var spec struct {
+		Template struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		} `json:"template"`
+	}
+	_ = json.Unmarshal(s.Spec, &spec)
+	return spec.Template.Metadata.Annotations
+}
+
+// sealedSecretsClient reads and writes the SealedSecrets
+type sealedSecretsClient interface {
+	get(ctx context.Context, namespace string, name string) (*SealedSecret, error)
+	create(ctx context.Context, sealed *SealedSecret) (*SealedSecret, error)
+	update(ctx context.Context, sealed *SealedSecret) (*SealedSecret, error)
+	delete(ctx context.Context, namespace string, name string) error
+}
+
+// restSealedSecrets accesses the SealedSecrets through the REST client, since they have no typed client
+type restSealedSecrets struct {
+	client kubernetes.Interface
+}
+
+// Returns the path of the SealedSecrets of the namespace
+func sealedSecretsNamespacePath(namespace string) string {
+	return fmt.Sprintf("/apis/%s/namespaces/%s/sealedsecrets", SealedSecretAPIVersion, namespace)
+}
+
+// Decodes a SealedSecret returned by the API server
+func decodeSealedSecret(body []byte, err error) (*SealedSecret, error) {
+	if err != nil {
+		return nil, err
+	}
+	sealed := &SealedSecret{}
+	if err := json.Unmarshal(body, sealed); err != nil {
+		return nil, fmt.Errorf("invalid SealedSecret: %s", err)
+	}
+	return sealed, nil
+}
+
+func (r *restSealedSecrets) get(ctx context.Context, namespace string, name string) (*SealedSecret, error) {
+	return decodeSealedSecret(r.client.Discovery().RESTClient().Get().
+		AbsPath(sealedSecretsNamespacePath(namespace), name).
+		Do(ctx).
+		Raw())
+}
+
+func (r *restSealedSecrets) create(ctx context.Context, sealed *SealedSecret) (*SealedSecret, error) {
+	body, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSealedSecret(r.client.Discovery().RESTClient().Post().
+		AbsPath(sealedSecretsNamespacePath(sealed.Namespace)).
+		Body(body).
+		Do(ctx).
+		Raw())
+}
+
+func (r *restSealedSecrets) update(ctx context.Context, sealed *SealedSecret) (*SealedSecret, error) {
+	body, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSealedSecret(r.client.Discovery().RESTClient().Put().
+		AbsPath(sealedSecretsNamespacePath(sealed.Namespace), sealed.Name).
+		Body(body).
+		Do(ctx).
+		Raw())
+}
+
+func (r *restSealedSecrets) delete(ctx context.Context, namespace string, name string) error {
+	return r.client.Discovery().RESTClient().Delete().
+		AbsPath(sealedSecretsNamespacePath(namespace), name).
+		Do(ctx).
+		Error()
+}
+
+// SealedSecrets is the cache of the SealedSecrets, kept by an informer
+// The handlers are notified of the SealedSecrets added, changed or deleted
+type SealedSecrets struct {
+	client          sealedSecretsClient
+	dynamic         dynamic.Interface
+	// how often the changes not handled yet are notified again
+	interval        time.Duration
+	// when true, the SealedSecrets are replicated themselves, else their unsealed secrets are
+	replicateSealed bool
+
+	mutex           sync.RWMutex
+	sealed          map[string]*SealedSecret
+	// handle the key of a changed SealedSecret, false to be notified again at the next interval
+	handlers        []func(key string) bool
+	// the keys whose handling is postponed to the next interval
+	pending         keySet
+	logger          logr.Logger
+}
+
+// NewSealedSecrets returns the cache of the SealedSecrets, watched through the dynamic client
+// With replicateSealed, the SealedSecrets themselves are replicated, for the targets managed by GitOps
+func NewSealedSecrets(client kubernetes.Interface, dynamicClient dynamic.Interface, interval time.Duration, replicateSealed bool, logger logr.Logger) *SealedSecrets {
+	return &SealedSecrets{
+		client:          &restSealedSecrets{client: client},
+		dynamic:         dynamicClient,
+		interval:        interval,
+		replicateSealed: replicateSealed,
+		sealed:          map[string]*SealedSecret{},
+		pending:         keySet{},
+		logger:          logger,
+	}
+}
+
+// Registers a handler of the changed SealedSecrets
+func (s *SealedSecrets) subscribe(handler func(key string) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Stores the SealedSecret received by the informer, nil once deleted, and notifies it when added, changed or deleted
+func (s *SealedSecrets) stored(key string, sealed *SealedSecret) {
+	s.mutex.Lock()
+	old, ok := s.sealed[key]
+	if sealed != nil {
+		s.sealed[key] = sealed
+	} else {
+		delete(s.sealed, key)
+	}
+	s.mutex.Unlock()
+	if (sealed == nil && !ok) || (sealed != nil && ok && old.ResourceVersion == sealed.ResourceVersion) {
+		return
+	}
+	s.notify(key)
+}
+
+// Notifies the handlers of the key, postponed to the next interval until they are registered and handle it
+func (s *SealedSecrets) notify(key string) {
+	s.mutex.RLock()
+	handlers := s.handlers
+	s.mutex.RUnlock()
+	handled := len(handlers) > 0
+	for _, handler := range handlers {
+		if !handler(key) {
+			handled = false
+		}
+	}
+	if !handled {
+		s.mutex.Lock()
+		s.pending[key] = true
+		s.mutex.Unlock()
+	}
+}
+
+// Notifies again the keys which were not handled yet
+func (s *SealedSecrets) notifyPending() {
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = keySet{}
+	s.mutex.Unlock()
+	for _, key := range pending.sorted() {
+		s.notify(key)
+	}
+}
+
+// Run watches the SealedSecrets, and notifies again at each interval the changes not handled yet, until stopped
+func (s *SealedSecrets) Run(stop <-chan struct{}) {
+	ctx := wait.ContextForChannel(stop)
+	sealedSecrets := s.dynamic.Resource(sealedSecretResource).Namespace(metav1.NamespaceAll)
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			return sealedSecrets.List(ctx, lo)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return sealedSecrets.Watch(ctx, lo)
+		},
+	}, &unstructured.Unstructured{}, 0, cache.Indexers{})
+	informer.AddEventHandler(tlsEventHandler(func(key string, object interface{}) {
+		var sealed *SealedSecret
+		if u, ok := object.(*unstructured.Unstructured); ok {
+			var err error
+			if sealed, err = decodeSealedSecret(u.MarshalJSON()); err != nil {
+				s.logger.Error(err, "could not read SealedSecret", "sealedSecret", key)
+				return
+			}
+		}
+		s.stored(key, sealed)
+	}))
+	go informer.Run(stop)
+	wait.Until(s.notifyPending, s.interval, stop)
+}
+
+// Returns the SealedSecret, read from the API server when not listed yet, as when just created, nil if it does not exist
+func (s *SealedSecrets) get(ctx context.Context, key string) (*SealedSecret, error) {
+	if sealed := s.cached(key); sealed != nil {
+		return sealed, nil
+	}
+	split := strings.SplitN(key, "/", 2)
+	sealed, err := s.client.get(ctx, split[0], split[1])
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s.set(sealed)
+	return sealed, nil
+}
+
+// Returns the SealedSecret received by the informer or written by the replicator, nil if none
+func (s *SealedSecrets) cached(key string) *SealedSecret {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sealed[key]
+}
+
+// Stores the SealedSecret, as written by the replicator
+func (s *SealedSecrets) set(sealed *SealedSecret) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sealed[metaKey(&sealed.ObjectMeta)] = sealed
+}
+
+// Returns the copies of the SealedSecret, by key
+func (s *SealedSecrets) copies(key string) map[string]*SealedSecret {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	copies := map[string]*SealedSecret{}
+	for copyKey, sealed := range s.sealed {
+		if sealed.Annotations[ReplicatedByAnnotation] == key {
+			copies[copyKey] = sealed
+		}
+	}
+	return copies
+}
+
+// Returns the key of the SealedSecret the secret is unsealed from, empty if none
+func unsealedFrom(meta *metav1.ObjectMeta) string {
+	for _, owner := range meta.OwnerReferences {
+		if owner.Kind == sealedSecretKind && owner.APIVersion == SealedSecretAPIVersion {
+			return fmt.Sprintf("%s/%s", meta.Namespace, owner.Name)
+		}
+	}
+	return ""
+}
+
+// Returns the annotations of the sources which the unsealed secrets inherit from their SealedSecret
+func sealedAnnotations() []string {
+	return []string{
+		ReplicateToAnnotation,
+		ReplicateToNsAnnotation,
+		ReplicateOnceAnnotation,
+		ReplicationAllowedAnnotation,
+		ReplicationAllowedNsAnnotation,
+		ReplicateToClustersAnnotation,
+		ExportToAnnotation,
+	}
+}
+
+// Handles a SealedSecret which changed, replicating it or its unsealed secret again
+// Returns false when the replicator is not synced yet, to be notified again
+func (r *ObjectReplicator) sealedSecretChanged(key string) bool {
+	if !r.Synced() {
+		return false
+	}
+	defer r.runHooks()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.SealedSecrets.replicateSealed {
+		r.replicateSealedSecret(key)
+	} else if object, _, exists, err := r.getFromStore(key); err == nil && exists {
+		r.objectAdded(object)
+	}
+	return true
+}
+
+// Sets the replication annotations of the SealedSecret onto its unsealed secret, such that it is replicated as soon as
+// it is unsealed, and again each time it is renewed
+// The annotations of the SealedSecret override the ones of its template, and are removed from the secret when removed
+// from both
+// The SealedSecret is read from the cache, the secret being handled again when the informer receives it, and the
+// secret is written in the background, without the mutex
+// Returns true while the annotations are written, the secret being handled again once written, the mutex must be held
+func (r *ObjectReplicator) inheritSealedAnnotations(object interface{}) bool {
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	if r.inheriting[key] {
+		return true
+	}
+	sealedKey := unsealedFrom(meta)
+	sealed := r.SealedSecrets.cached(sealedKey)
+	if sealed == nil {
+		return false
+	}
+	inherited := map[string]string{}
+	for _, annotations := range []map[string]string{sealed.templateAnnotations(), sealed.Annotations} {
+		for _, annotation := range sealedAnnotations() {
+			if value, ok := annotations[annotation]; ok {
+				inherited[annotation] = value
+			}
+		}
+	}
+	annotations := cloneSMap(meta.Annotations)
+	changed := false
+	for _, annotation := range sealedAnnotations() {
+		value, ok := inherited[annotation]
+		if old, had := annotations[annotation]; ok && (!had || old != value) {
+			annotations[annotation] = value
+			changed = true
+		} else if !ok && had {
+			delete(annotations, annotation)
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+	r.logger.Info("inheriting annotations of SealedSecret", "sealedSecret", sealedKey, "source", key, "action", "update")
+	r.inheriting[key] = true
+	go func() {
+		ctx, cancel := r.requestContext(r.ctx)
+		defer cancel()
+		start := time.Now()
+		newObject, err := r.Update(ctx, r.client, object, nil, annotations)
+		r.observeAction("update", start, err)
+		if err == nil {
+			r.observeSize(newObject)
+		}
+		r.audit("update", sealedKey, key, newObject, err)
+		r.stats.actionDone(err)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.inheriting, key)
+		if err != nil {
+			r.logger.Error(err, "could not inherit annotations of SealedSecret", "sealedSecret", sealedKey, "source", key)
+			r.warning(object, ReasonFailed, "could not inherit the annotations of SealedSecret %s: %s", sealedKey, err)
+			return
+		}
+		// update the object store in advance, the informer handles the secret again
+		if err := r.objectStore.Update(newObject); err != nil {
+			r.logger.Error(err, "could not update store", "source", key)
+		}
+	}()
+	return true
+}
+
+// Replicates the SealedSecret to the targets of its replication annotations, as SealedSecrets unsealed there by the
+// sealed-secrets controller, and deletes its copies which are not targeted anymore
+// Only the cluster-wide SealedSecrets can be unsealed in other namespaces, the mutex must be held
+func (r *ObjectReplicator) replicateSealedSecret(key string) {
+	ctx, cancel := r.requestContext(r.ctx)
+	sealed, err := r.SealedSecrets.get(ctx, key)
+	cancel()
+	if err != nil {
+		r.logger.Error(err, "could not get SealedSecret", "sealedSecret", key)
+		return
+	}
+	targets := keySet{}
+	if sealed != nil && sealed.Annotations[ReplicatedByAnnotation] == "" {
+		names, patterns, err := r.getReplicationTargets(&sealed.ObjectMeta)
+		if err != nil {
+			r.logger.Error(err, "could not parse", "sealedSecret", key)
+			return
+		}
+		if len(names)+len(patterns) > 0 && sealed.Annotations[sealedClusterWideAnnotation] != "true" {
+			err := fmt.Errorf("SealedSecret %s is not cluster-wide, it cannot be unsealed in other namespaces", key)
+			r.logger.Error(err, "replication is cancelled", "sealedSecret", key)
+			names, patterns = nil, nil
+		}
+		for _, name := range names {
+			targets[name] = true
+		}
+		for _, pattern := range patterns {
+			for _, target := range pattern.Targets(r.namespaceStore.ListKeys()) {
+				targets[target] = true
+			}
+		}
+		delete(targets, key)
+	}
+	copies := r.SealedSecrets.copies(key)
+	for _, target := range targets.sorted() {
+		r.copySealedSecret(sealed, target, copies[target])
+	}
+	for copyKey, copy := range copies {
+		if targets[copyKey] {
+			continue
+		}
+		r.logger.Info("deleting SealedSecret copy", "sealedSecret", key, "target", copyKey, "action", "delete")
+		start := time.Now()
+		ctx, cancel := r.requestContext(r.ctx)
+		err := r.SealedSecrets.client.delete(ctx, copy.Namespace, copy.Name)
+		cancel()
+		if errors.IsNotFound(err) {
+			err = nil
+		}
+		r.observeAction("delete", start, err)
+		r.audit("delete", key, copyKey, nil, err)
+		if err != nil {
+			r.logger.Error(err, "could not delete SealedSecret copy", "sealedSecret", key, "target", copyKey)
+		}
+	}
+}
+
+// Creates or updates the copy of the SealedSecret at the target, unless it already has its spec
+// The SealedSecrets which are not copies of this one are left untouched
+func (r *ObjectReplicator) copySealedSecret(sealed *SealedSecret, target string, existing *SealedSecret) {
+	key := metaKey(&sealed.ObjectMeta)
+	split := strings.SplitN(target, "/", 2)
+	ctx, cancel := r.requestContext(r.ctx)
+	defer cancel()
+	if existing == nil {
+		other, err := r.SealedSecrets.get(ctx, target)
+		if err != nil {
+			r.logger.Error(err, "could not get SealedSecret", "sealedSecret", target)
+			return
+		} else if other != nil {
+			r.logger.Info("replication is cancelled", "sealedSecret", key, "target", target,
+				"reason", "target is not a copy of the SealedSecret")
+			return
+		}
+	} else if string(existing.Spec) == string(sealed.Spec) &&
+		existing.Annotations[ReplicatedFromVersionAnnotation] == sealed.ResourceVersion {
+		return
+	}
+	copy := &SealedSecret{
+		TypeMeta: metav1.TypeMeta{APIVersion: SealedSecretAPIVersion, Kind: sealedSecretKind},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: split[0],
+			Name:      split[1],
+			Labels:    cloneSMap(r.Labels),
+			Annotations: map[string]string{
+				ReplicatedByAnnotation:          key,
+				ReplicatedFromVersionAnnotation: sealed.ResourceVersion,
+				ReplicatedAtAnnotation:          r.now().Format(time.RFC3339),
+				sealedClusterWideAnnotation:     "true",
+			},
+		},
+		Spec: sealed.Spec,
+	}
+	r.setManagedBy(copy.Annotations)
+	r.stampTarget(&copy.ObjectMeta, nil, key)
+	action := "install"
+	var newCopy *SealedSecret
+	var err error
+	start := time.Now()
+	if existing == nil {
+		r.logger.Info("creating SealedSecret copy", "sealedSecret", key, "target", target, "action", action)
+		newCopy, err = r.SealedSecrets.client.create(ctx, copy)
+	} else {
+		action = "update"
+		copy.ResourceVersion = existing.ResourceVersion
+		r.logger.Info("updating SealedSecret copy", "sealedSecret", key, "target", target, "action", action)
+		newCopy, err = r.SealedSecrets.client.update(ctx, copy)
+	}
+	r.observeAction(action, start, err)
+	r.audit(action, key, target, nil, err)
+	if err != nil {
+		r.logger.Error(err, "could not replicate SealedSecret", "sealedSecret", key, "target", target)
+		return
+	}
+	r.SealedSecrets.set(newCopy)
+}
+
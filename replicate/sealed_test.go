@@ -0,0 +1,262 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testSealedSecrets holds the SealedSecrets in memory
+type testSealedSecrets struct {
+	sealed  map[string]*SealedSecret
+	version int
+}
+
+func (c *testSealedSecrets) get(ctx context.Context, namespace string, name string) (*SealedSecret, error) {
+	if sealed, ok := c.sealed[namespace+"/"+name]; ok {
+		return sealed, nil
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Group: "bitnami.com", Resource: "sealedsecrets"}, name)
+}
+
+func (c *testSealedSecrets) create(ctx context.Context, sealed *SealedSecret) (*SealedSecret, error) {
+	if _, ok := c.sealed[metaKey(&sealed.ObjectMeta)]; ok {
+		return nil, fmt.Errorf("SealedSecret %s already exists", metaKey(&sealed.ObjectMeta))
+	}
+	return c.update(ctx, sealed)
+}
+
+func (c *testSealedSecrets) update(ctx context.Context, sealed *SealedSecret) (*SealedSecret, error) {
+	c.version++
+	copy := *sealed
+	copy.ResourceVersion = fmt.Sprint(c.version)
+	c.sealed[metaKey(&copy.ObjectMeta)] = &copy
+	return &copy, nil
+}
+
+func (c *testSealedSecrets) delete(ctx context.Context, namespace string, name string) error {
+	if _, err := c.get(ctx, namespace, name); err != nil {
+		return err
+	}
+	delete(c.sealed, namespace+"/"+name)
+	return nil
+}
+
+// Returns a SealedSecret, whose template has the annotations
+func createTestSealedSecret(namespace string, name string, annotations M, templateAnnotations M) *SealedSecret {
+	spec, _ := json.Marshal(M{"encryptedData": "AgBy3i4OJSWK+PiTySYZZA=="})
+	if templateAnnotations != nil {
+		spec, _ = json.Marshal(map[string]interface{}{
+			"encryptedData": M{"password": "AgBy3i4OJSWK+PiTySYZZA=="},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"annotations": templateAnnotations},
+			},
+		})
+	}
+	return &SealedSecret{
+		TypeMeta: metav1.TypeMeta{APIVersion: SealedSecretAPIVersion, Kind: sealedSecretKind},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			ResourceVersion: "1",
+			Annotations:     annotations,
+		},
+		Spec: spec,
+	}
+}
+
+// Returns the cache of the SealedSecrets, in memory, holding the SealedSecrets as if received by the informer
+func createTestSealedSecrets(replicateSealed bool, sealed ...*SealedSecret) (*SealedSecrets, *testSealedSecrets) {
+	client := &testSealedSecrets{sealed: map[string]*SealedSecret{}, version: 1}
+	sealedSecrets := NewSealedSecrets(nil, nil, time.Minute, replicateSealed, logr.Discard())
+	sealedSecrets.client = client
+	for _, s := range sealed {
+		client.sealed[metaKey(&s.ObjectMeta)] = s
+		sealedSecrets.set(s)
+	}
+	return sealedSecrets, client
+}
+
+func TestSealedSecrets_stored(t *testing.T) {
+	sealedSecrets, _ := createTestSealedSecrets(false)
+	// notified once the handlers are registered
+	sealedSecrets.stored("ns/a", createTestSealedSecret("ns", "a", nil, nil))
+	sealedSecrets.stored("ns/b", createTestSealedSecret("ns", "b", nil, nil))
+	notified := []string{}
+	handled := true
+	sealedSecrets.subscribe(func(key string) bool {
+		notified = append(notified, key)
+		return handled
+	})
+	sealedSecrets.notifyPending()
+	assert.Equal(t, []string{"ns/a", "ns/b"}, notified)
+
+	// only the changed ones
+	notified = nil
+	changed := createTestSealedSecret("ns", "a", nil, nil)
+	changed.ResourceVersion = "2"
+	handled = false
+	sealedSecrets.stored("ns/a", changed)
+	sealedSecrets.stored("ns/b", createTestSealedSecret("ns", "b", nil, nil))
+	sealedSecrets.stored("ns/b", nil)
+	sealedSecrets.stored("ns/c", nil)
+	assert.Equal(t, []string{"ns/a", "ns/b"}, notified)
+	assert.Equal(t, changed, sealedSecrets.cached("ns/a"))
+	assert.Nil(t, sealedSecrets.cached("ns/b"))
+	// notified again until handled
+	notified = nil
+	handled = true
+	sealedSecrets.notifyPending()
+	assert.Equal(t, []string{"ns/a", "ns/b"}, notified)
+	notified = nil
+	sealedSecrets.notifyPending()
+	assert.Empty(t, notified)
+}
+
+// Returns the SealedSecret as returned by the dynamic client
+func unstructuredSealedSecret(t *testing.T, sealed *SealedSecret) *unstructured.Unstructured {
+	body, err := json.Marshal(sealed)
+	require.NoError(t, err)
+	object := &unstructured.Unstructured{}
+	require.NoError(t, object.UnmarshalJSON(body))
+	return object
+}
+
+func TestSealedSecrets_run(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{sealedSecretResource: "SealedSecretList"},
+		unstructuredSealedSecret(t, createTestSealedSecret("ns", "a", M{ReplicateToAnnotation: "other/a"}, nil)))
+	sealedSecrets := NewSealedSecrets(nil, dynamicClient, 10*time.Millisecond, false, logr.Discard())
+	var mutex sync.Mutex
+	notified := []string{}
+	sealedSecrets.subscribe(func(key string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		notified = append(notified, key)
+		return true
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go sealedSecrets.Run(stop)
+
+	require.Eventually(t, func() bool {
+		return sealedSecrets.cached("ns/a") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, M{ReplicateToAnnotation: "other/a"}, sealedSecrets.cached("ns/a").Annotations)
+	assert.JSONEq(t, string(createTestSealedSecret("ns", "a", nil, nil).Spec), string(sealedSecrets.cached("ns/a").Spec))
+
+	// the changes are watched
+	resource := dynamicClient.Resource(sealedSecretResource)
+	_, err := resource.Namespace("ns").Create(context.TODO(),
+		unstructuredSealedSecret(t, createTestSealedSecret("ns", "b", nil, nil)), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, resource.Namespace("ns").Delete(context.TODO(), "a", metav1.DeleteOptions{}))
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(notified) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"ns/a", "ns/b", "ns/a"}, notified)
+	assert.Nil(t, sealedSecrets.cached("ns/a"))
+	assert.NotNil(t, sealedSecrets.cached("ns/b"))
+}
+
+func TestInheritSealedAnnotations(t *testing.T) {
+	sealedSecrets, _ := createTestSealedSecrets(false, createTestSealedSecret("source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+		"other/annotation":    "other",
+	}, M{
+		ReplicateToAnnotation:        "target-ns/template",
+		ReplicationAllowedAnnotation: "true",
+	}))
+	source := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+			Annotations: M{
+				ExportToAnnotation: "vault:secret/data/source",
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: SealedSecretAPIVersion,
+				Kind:       sealedSecretKind,
+				Name:       "source",
+			}},
+		},
+		Data: map[string][]byte{"password": []byte("secret")},
+	}
+	client := fake.NewSimpleClientset(source)
+	r := newTestSecretReplicator(t, client, WithOptions(ReplicatorOptions{SealedSecrets: sealedSecrets}), WithResyncPeriod(time.Hour))
+	require.NoError(t, r.objectStore.Add(source))
+	r.ObjectAdded(source)
+	// written in the background, without the mutex
+	require.Eventually(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return len(r.inheriting) == 0
+	}, 5*time.Second, time.Millisecond)
+
+	unsealed, err := client.CoreV1().Secrets("source-ns").Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, M{
+		ReplicateToAnnotation:        "target-ns/target",
+		ReplicationAllowedAnnotation: "true",
+	}, unsealed.Annotations)
+	assert.Equal(t, []byte("secret"), unsealed.Data["password"])
+
+	// not owned by a SealedSecret
+	assert.Equal(t, "", unsealedFrom(&metav1.ObjectMeta{Namespace: "ns", Name: "secret"}))
+}
+
+func TestReplicateSealedSecret(t *testing.T) {
+	sealedSecrets, sealedClient := createTestSealedSecrets(true,
+		createTestSealedSecret("source-ns", "source", M{
+			ReplicateToNsAnnotation:     "app-.*",
+			sealedClusterWideAnnotation: "true",
+		}, M{}),
+		createTestSealedSecret("app-2", "source", M{"other/annotation": "other"}, nil))
+	client := fake.NewSimpleClientset()
+	r := newTestSecretReplicator(t, client, WithOptions(ReplicatorOptions{SealedSecrets: sealedSecrets}), WithResyncPeriod(time.Hour))
+	for _, namespace := range []string{"source-ns", "app-1", "app-2", "other"} {
+		require.NoError(t, r.namespaceStore.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}))
+	}
+
+	r.replicateSealedSecret("source-ns/source")
+	copy := sealedClient.sealed["app-1/source"]
+	require.NotNil(t, copy)
+	assert.Equal(t, "source-ns/source", copy.Annotations[ReplicatedByAnnotation])
+	assert.Equal(t, "true", copy.Annotations[sealedClusterWideAnnotation])
+	assert.JSONEq(t, string(sealedClient.sealed["source-ns/source"].Spec), string(copy.Spec))
+	assert.Equal(t, M{"other/annotation": "other"}, sealedClient.sealed["app-2/source"].Annotations,
+		"not a copy, left untouched")
+	assert.NotContains(t, sealedClient.sealed, "other/source")
+
+	// not updated while unchanged
+	version := copy.ResourceVersion
+	r.replicateSealedSecret("source-ns/source")
+	assert.Equal(t, version, sealedClient.sealed["app-1/source"].ResourceVersion)
+
+	// not cluster-wide anymore, the copies are deleted
+	_, err := sealedClient.update(context.TODO(), createTestSealedSecret("source-ns", "source", M{
+		ReplicateToNsAnnotation: "app-.*",
+	}, M{}))
+	require.NoError(t, err)
+	sealedSecrets.stored("source-ns/source", sealedClient.sealed["source-ns/source"])
+	r.replicateSealedSecret("source-ns/source")
+	assert.NotContains(t, sealedClient.sealed, "app-1/source")
+	assert.Contains(t, sealedClient.sealed, "app-2/source")
+}
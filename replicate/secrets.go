@@ -1,43 +1,85 @@
 package replicate
 
 import (
+	"context"
 	"crypto/rand"
-	"log"
 	"math/big"
-	"time"
 
+	"github.com/go-logr/logr"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
 var _secretActions *secretActions = &secretActions{}
 
-// NewSecretReplicator creates a new secret replicator
-func NewSecretReplicator(client kubernetes.Interface, options ReplicatorOptions, resyncPeriod time.Duration) Replicator {
-	repl := ObjectReplicator{
-		ReplicatorProps:   NewReplicatorProps(client, "secret", options),
-		ReplicatorActions: _secretActions,
+// NewSecretReplicator creates a new secret replicator, configured by the options
+// Returns an error if its metrics cannot be registered
+func NewSecretReplicator(client kubernetes.Interface, opts ...Option) (Replicator, error) {
+	config := NewReplicatorConfig(opts...)
+	options := config.Options
+	repl, err := config.NewObjectReplicator(client, "secret", _secretActions)
+	if err != nil {
+		return nil, err
+	}
+	if options.ServerSideApply || options.Propagation != "" {
+		repl.ReplicatorActions = &secretActions{
+			serverSideApply: options.ServerSideApply,
+			propagation:     options.Propagation,
+			applied:         repl.appliedMeta(),
+		}
+	}
+	if options.Decrypter != nil {
+		repl.ReplicatorActions = &sopsActions{ReplicatorActions: repl.ReplicatorActions, decrypter: options.Decrypter}
+	}
+	if options.SealedSecrets != nil {
+		options.SealedSecrets.subscribe(repl.sealedSecretChanged)
+	}
+	if options.TLSReferences != nil {
+		repl.tlsReferences = options.TLSReferences
+		options.TLSReferences.subscribe(repl.tlsReferencesChanged)
 	}
 	secrets := client.CoreV1().Secrets("")
 	listWatch := cache.ListWatch{
 		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
-			return secrets.List(lo)
+			return secrets.List(repl.ctx, lo)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return secrets.Watch(repl.ctx, lo)
 		},
-		WatchFunc: secrets.Watch,
 	}
-	repl.InitStores(&listWatch, &v1.Secret{}, resyncPeriod)
-	return &repl
+	repl.InitStores(&listWatch, &v1.Secret{}, config.ResyncPeriod)
+	return repl, nil
 }
 
-type secretActions struct {}
+type secretActions struct {
+	// when true, installs and data updates are server-side applied
+	serverSideApply bool
+	// the propagation policy of the deletions, empty for the default of the API server
+	propagation     metav1.DeletionPropagation
+	// the labels and annotations applied
+	applied         *appliedMeta
+}
 
 func (*secretActions) GetMeta(object interface{}) *metav1.ObjectMeta {
 	return &object.(*v1.Secret).ObjectMeta
 }
 
+func (*secretActions) DataChecksum(object interface{}) string {
+	return checksumData(object.(*v1.Secret).Data)
+}
+
+func (*secretActions) DataSize(object interface{}) int {
+	size := 0
+	for key, value := range object.(*v1.Secret).Data {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
 const passwordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 const passwordLength = 128
 
@@ -87,7 +129,59 @@ var emptySecretFuncs emptySecretFuncsType = emptySecretFuncsType{
 	},
 }
 
-func (*secretActions) Update(client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+// Returns the secret to apply, with only the fields set by the replicator
+func secretToApply(meta *metav1.ObjectMeta, secretType v1.SecretType, dataObject interface{}, applied *appliedMeta) (*v1.Secret, error) {
+	secret := &v1.Secret{
+		TypeMeta:   metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: applied.metaToApply(meta),
+		Type:       secretType,
+	}
+	if dataObject != nil {
+		dataSecret := dataObject.(*v1.Secret)
+		if dataSecret.Data != nil {
+			secret.Data = make(map[string][]byte, len(dataSecret.Data))
+			for key, value := range dataSecret.Data {
+				newValue := make([]byte, len(value))
+				copy(newValue, value)
+				secret.Data[key] = newValue
+			}
+		}
+	} else if emptyFunc, ok := emptySecretFuncs[secret.Type]; ok {
+		var err error
+		if secret.StringData, err = emptyFunc(); err != nil {
+			return nil, err
+		}
+	}
+	return secret, nil
+}
+
+// Server-side applies the secret
+func applySecret(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, secretType v1.SecretType, dataObject interface{}, applied *appliedMeta) (interface{}, error) {
+	secret, err := secretToApply(meta, secretType, dataObject, applied)
+	if err != nil {
+		return nil, err
+	}
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("applying secret", "target", metaKey(meta), "action", "apply")
+	update := &v1.Secret{}
+	if err := applyObject(ctx, client, "secrets", meta, secret, update); err != nil {
+		logger.Error(err, "error while applying secret", "target", metaKey(meta), "action", "apply")
+		return nil, err
+	}
+	return update, nil
+}
+
+func (a *secretActions) Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+	// only apply new data, other updates don't change the owned fields
+	if a.serverSideApply && sourceObject != nil && sourceObject != object {
+		target := object.(*v1.Secret)
+		meta := target.ObjectMeta.DeepCopy()
+		meta.Annotations = annotations
+		return applySecret(ctx, client, meta, target.Type, sourceObject, a.applied)
+	}
 	// copy the secret
 	secret := object.(*v1.Secret).DeepCopy()
 	// set the annotations
@@ -107,16 +201,17 @@ func (*secretActions) Update(client kubernetes.Interface, object interface{}, so
 		}
 	}
 
-	log.Printf("updating secret %s/%s", secret.Namespace, secret.Name)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("updating secret", "target", metaKey(&secret.ObjectMeta), "action", "update")
 	// update the secret
-	update, err := client.CoreV1().Secrets(secret.Namespace).Update(secret)
+	update, err := client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
 	if err != nil {
-		log.Printf("error while updating secret %s/%s: %s", secret.Namespace, secret.Name, err)
+		logger.Error(err, "error while updating secret", "target", metaKey(&secret.ObjectMeta), "action", "update")
 	}
 	return update, err
 }
 
-func (*secretActions) Clear(client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
+func (*secretActions) Clear(ctx context.Context, client kubernetes.Interface, object interface{}, annotations map[string]string) (interface{}, error) {
 	// copy the secret
 	secret := object.(*v1.Secret).DeepCopy()
 	// set the annotations
@@ -131,17 +226,21 @@ func (*secretActions) Clear(client kubernetes.Interface, object interface{}, ann
 		}
 	}
 
-	log.Printf("clearing secret %s/%s", secret.Namespace, secret.Name)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("clearing secret", "target", metaKey(&secret.ObjectMeta), "action", "clear")
 	// update the secret
-	update, err := client.CoreV1().Secrets(secret.Namespace).Update(secret)
+	update, err := client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
 	if err != nil {
-		log.Printf("error while clearing secret %s/%s", secret.Namespace, secret.Name)
+		logger.Error(err, "error while clearing secret", "target", metaKey(&secret.ObjectMeta), "action", "clear")
 	}
 	return update, err
 }
 
-func (*secretActions) Install(client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+func (a *secretActions) Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
 	sourceSecret := sourceObject.(*v1.Secret)
+	if a.serverSideApply {
+		return applySecret(ctx, client, meta, sourceSecret.Type, dataObject, a.applied)
+	}
 	// create a new secret
 	secret := v1.Secret{
 		Type: sourceSecret.Type,
@@ -167,37 +266,53 @@ func (*secretActions) Install(client kubernetes.Interface, meta *metav1.ObjectMe
 		}
 	}
 
-	log.Printf("installing secret %s/%s", secret.Namespace, secret.Name)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("installing secret", "target", metaKey(&secret.ObjectMeta), "action", "install")
 
 	var update *v1.Secret
 	var err error
 	if secret.ResourceVersion == "" {
 		// create the secret
-		update, err = client.CoreV1().Secrets(secret.Namespace).Create(&secret)
+		update, err = client.CoreV1().Secrets(secret.Namespace).Create(ctx, &secret, metav1.CreateOptions{})
 	} else {
 		// update the secret
-		update, err = client.CoreV1().Secrets(secret.Namespace).Update(&secret)
+		update, err = client.CoreV1().Secrets(secret.Namespace).Update(ctx, &secret, metav1.UpdateOptions{})
 	}
 
 	if err != nil {
-		log.Printf("error while installing secret %s/%s: %s", secret.Namespace, secret.Name, err)
+		logger.Error(err, "error while installing secret", "target", metaKey(&secret.ObjectMeta), "action", "install")
 	}
 	return update, err
 }
 
-func (*secretActions) Delete(client kubernetes.Interface, object interface{}) error {
+func (a *secretActions) Delete(ctx context.Context, client kubernetes.Interface, object interface{}) error {
 	secret := object.(*v1.Secret)
-	log.Printf("deleting secret %s/%s", secret.Namespace, secret.Name)
-	// prepare the delete options
-	options := metav1.DeleteOptions{
-		Preconditions: &metav1.Preconditions{
-			ResourceVersion: &secret.ResourceVersion,
-		},
-	}
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("deleting secret", "target", metaKey(&secret.ObjectMeta), "action", "delete")
 	// delete the secret
-	err := client.CoreV1().Secrets(secret.Namespace).Delete(secret.Name, &options)
+	err := client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, deleteOptions(&secret.ObjectMeta, a.propagation))
 	if err != nil {
-		log.Printf("error while deleting secret %s/%s: %s", secret.Namespace, secret.Name, err)
+		logger.Error(err, "error while deleting secret", "target", metaKey(&secret.ObjectMeta), "action", "delete")
 	}
 	return err
 }
+
+func (*secretActions) Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (*secretActions) List(ctx context.Context, client kubernetes.Interface, selector string) ([]interface{}, error) {
+	list, err := client.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]interface{}, len(list.Items))
+	for i := range list.Items {
+		objects[i] = &list.Items[i]
+	}
+	return objects, nil
+}
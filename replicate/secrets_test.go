@@ -1,6 +1,7 @@
 package replicate
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"testing"
@@ -32,12 +33,23 @@ func TestSecret_GetMeta(t *testing.T) {
 	assert.Equal(t, copy, _secretActions.GetMeta(object))
 }
 
+func TestSecret_DataSize(t *testing.T) {
+	object := &v1.Secret{
+		Data: MB{
+			"test":  []byte("test-data"),
+			"other": []byte("other-data"),
+		},
+	}
+	assert.Equal(t, 28, _secretActions.DataSize(object))
+	assert.Equal(t, 0, _secretActions.DataSize(&v1.Secret{}))
+}
+
 func TestSecret_Update(t *testing.T) {
 	replicator, watcher := createReplicator(_secretActions, "test-ns")
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	secrets := replicator.client.CoreV1().Secrets("test-ns")
 
-	old, err := secrets.Create(&v1.Secret{
+	old, err := secrets.Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-update",
@@ -52,7 +64,7 @@ func TestSecret_Update(t *testing.T) {
 			"test-data": []byte("old"),
 			"test-old": []byte("data"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -79,7 +91,7 @@ func TestSecret_Update(t *testing.T) {
 
 	old2 := old.DeepCopy()
 	source2 := source.DeepCopy()
-	store, err := _secretActions.Update(replicator.client, old2, source2, annotations)
+	store, err := _secretActions.Update(context.TODO(), replicator.client, old2, source2, annotations)
 	require.NoError(t, err)
 	assert.Equal(t, old, old2, "old changed")
 	assert.Equal(t, source, source2, "source changed")
@@ -87,7 +99,7 @@ func TestSecret_Update(t *testing.T) {
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.Secret)
 	require.True(t, ok, "secret")
-	new, err := secrets.Get("test-update", metav1.GetOptions{})
+	new, err := secrets.Get(context.TODO(), "test-update", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.Secret{
@@ -120,7 +132,7 @@ func TestSecret_Clear(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	secrets := replicator.client.CoreV1().Secrets("test-ns")
 
-	todo, err := secrets.Create(&v1.Secret{
+	todo, err := secrets.Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-clear",
@@ -135,7 +147,7 @@ func TestSecret_Clear(t *testing.T) {
 			"test-data": []byte("todo"),
 			"test-todo": []byte("data"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -145,14 +157,14 @@ func TestSecret_Clear(t *testing.T) {
 	}
 
 	todo2 := todo.DeepCopy()
-	store, err := _secretActions.Clear(replicator.client, todo2, annotations)
+	store, err := _secretActions.Clear(context.TODO(), replicator.client, todo2, annotations)
 	require.NoError(t, err)
 	assert.Equal(t, todo, todo2, "todo changed")
 	require.Equal(t, 2, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.Secret)
 	require.True(t, ok, "secret")
-	new, err := secrets.Get("test-clear", metav1.GetOptions{})
+	new, err := secrets.Get(context.TODO(), "test-clear", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.Secret{
@@ -209,14 +221,14 @@ func TestSecret_install_create_empty(t *testing.T) {
 	}
 
 	source2 := source.DeepCopy()
-	store, err := _secretActions.Install(replicator.client, meta, source2, nil)
+	store, err := _secretActions.Install(context.TODO(), replicator.client, meta, source2, nil)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "create", watcher.Actions[0].GetVerb())
 	sent, ok := watcher.Actions[0].(CreateAction).GetObject().(*v1.Secret)
 	require.True(t, ok, "secret")
-	new, err := secrets.Get("test-install", metav1.GetOptions{})
+	new, err := secrets.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.Secret{
@@ -246,7 +258,7 @@ func TestSecret_install_update_empty(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	secrets := replicator.client.CoreV1().Secrets("test-ns")
 
-	_, err := secrets.Create(&v1.Secret{
+	_, err := secrets.Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-install",
@@ -261,7 +273,7 @@ func TestSecret_install_update_empty(t *testing.T) {
 			"test-data": []byte("old"),
 			"test-old": []byte("data"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -292,14 +304,14 @@ func TestSecret_install_update_empty(t *testing.T) {
 	}
 
 	source2 := source.DeepCopy()
-	store, err := _secretActions.Install(replicator.client, meta, source2, nil)
+	store, err := _secretActions.Install(context.TODO(), replicator.client, meta, source2, nil)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	require.Equal(t, 2, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.Secret)
 	require.True(t, ok, "secret")
-	new, err := secrets.Get("test-install", metav1.GetOptions{})
+	new, err := secrets.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.Secret{
@@ -373,7 +385,7 @@ func TestSecret_install_create_data(t *testing.T) {
 
 	source2 := source.DeepCopy()
 	copy2 := copy.DeepCopy()
-	store, err := _secretActions.Install(replicator.client, meta, source2, copy2)
+	store, err := _secretActions.Install(context.TODO(), replicator.client, meta, source2, copy2)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	assert.Equal(t, copy, copy2, "copy changed")
@@ -381,7 +393,7 @@ func TestSecret_install_create_data(t *testing.T) {
 	require.Equal(t, "create", watcher.Actions[0].GetVerb())
 	sent, ok := watcher.Actions[0].(CreateAction).GetObject().(*v1.Secret)
 	require.True(t, ok, "secret")
-	new, err := secrets.Get("test-install", metav1.GetOptions{})
+	new, err := secrets.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.Secret{
@@ -414,7 +426,7 @@ func TestSecret_install_update_data(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	secrets := replicator.client.CoreV1().Secrets("test-ns")
 
-	_, err := secrets.Create(&v1.Secret{
+	_, err := secrets.Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-install",
@@ -429,7 +441,7 @@ func TestSecret_install_update_data(t *testing.T) {
 			"test-data": []byte("old"),
 			"test-old": []byte("data"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
@@ -477,7 +489,7 @@ func TestSecret_install_update_data(t *testing.T) {
 
 	source2 := source.DeepCopy()
 	copy2 := copy.DeepCopy()
-	store, err := _secretActions.Install(replicator.client, meta, source2, copy2)
+	store, err := _secretActions.Install(context.TODO(), replicator.client, meta, source2, copy2)
 	require.NoError(t, err)
 	assert.Equal(t, source, source2, "source changed")
 	assert.Equal(t, copy, copy2, "copy changed")
@@ -485,7 +497,7 @@ func TestSecret_install_update_data(t *testing.T) {
 	require.Equal(t, "update", watcher.Actions[1].GetVerb())
 	sent, ok := watcher.Actions[1].(UpdateAction).GetObject().(*v1.Secret)
 	require.True(t, ok, "secret")
-	new, err := secrets.Get("test-install", metav1.GetOptions{})
+	new, err := secrets.Get(context.TODO(), "test-install", metav1.GetOptions{})
 	require.NoError(t, err)
 
 	expected := &v1.Secret{
@@ -518,7 +530,7 @@ func TestSecret_Delete(t *testing.T) {
 	require.Equal(t, 0, len(watcher.Actions), "len(actions)")
 	secrets := replicator.client.CoreV1().Secrets("test-ns")
 
-	todo, err := secrets.Create(&v1.Secret{
+	todo, err := secrets.Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "test-ns",
 			Name: "test-delete",
@@ -533,19 +545,19 @@ func TestSecret_Delete(t *testing.T) {
 			"test-data": []byte("todo"),
 			"test-todo": []byte("data"),
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(watcher.Actions), "len(actions)")
 
 	todo2 := todo.DeepCopy()
-	err = _secretActions.Delete(replicator.client, todo2)
+	err = _secretActions.Delete(context.TODO(), replicator.client, todo2)
 	require.NoError(t, err)
 	assert.Equal(t, todo, todo2, "todo changed")
 	require.Equal(t, 2, len(watcher.Actions), "len(actions)")
 	require.Equal(t, "delete", watcher.Actions[1].GetVerb())
 	require.Equal(t, "test-delete", watcher.Actions[1].(DeleteAction).GetName())
 	// TODO: test delete option (impossible with the current implementation of fake client)
-	_, err = secrets.Get("test-clear", metav1.GetOptions{})
+	_, err = secrets.Get(context.TODO(), "test-clear", metav1.GetOptions{})
 	require.Error(t, err)
 }
 
@@ -633,7 +645,7 @@ func TestSecret_typesEmpty(t *testing.T) {
 		require.Equalf(t, 0, len(watcher.Actions), "len(actions) %s", example.name)
 		secrets := replicator.client.CoreV1().Secrets("test-ns")
 
-		secret1, err := secrets.Create(&v1.Secret{
+		secret1, err := secrets.Create(context.TODO(), &v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: "test-ns",
 				Name: "secret1",
@@ -642,15 +654,15 @@ func TestSecret_typesEmpty(t *testing.T) {
 			Data: MB{
 				"test64": []byte("dGVzdDY0"),
 			},
-		})
+		}, metav1.CreateOptions{})
 		require.NoError(t, err, example.name)
 		require.Equalf(t, 1, len(watcher.Actions), "len(actions) %s", example.name)
 
-		update1, err := _secretActions.Clear(replicator.client, secret1, M{})
+		update1, err := _secretActions.Clear(context.TODO(), replicator.client, secret1, M{})
 		require.NoError(t, err, example.name)
 		require.Equalf(t, 2, len(watcher.Actions), "len(actions) %s", example.name)
 
-		stored1, err := secrets.Get("secret1", metav1.GetOptions{})
+		stored1, err := secrets.Get(context.TODO(), "secret1", metav1.GetOptions{})
 		require.NoError(t, err, example.name)
 		require.Equalf(t, 3, len(watcher.Actions), "len(actions) %s", example.name)
 		assert.Equal(t, update1, stored1, example.name)
@@ -668,7 +680,7 @@ func TestSecret_typesEmpty(t *testing.T) {
 			example.check(t, data1)
 		}
 
-		secret2, err := secrets.Create(&v1.Secret{
+		secret2, err := secrets.Create(context.TODO(), &v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: "test-ns",
 				Name: "secret2",
@@ -677,7 +689,7 @@ func TestSecret_typesEmpty(t *testing.T) {
 			Data: MB{
 				"test64": []byte("dGVzdDY0"),
 			},
-		})
+		}, metav1.CreateOptions{})
 		require.NoError(t, err, example.name)
 		require.Equalf(t, 4, len(watcher.Actions), "len(actions) %s", example.name)
 
@@ -685,11 +697,11 @@ func TestSecret_typesEmpty(t *testing.T) {
 			Namespace: "test-ns",
 			Name: "secret3",
 		}
-		update3, err := _secretActions.Install(replicator.client, meta3, secret2, nil)
+		update3, err := _secretActions.Install(context.TODO(), replicator.client, meta3, secret2, nil)
 		require.NoError(t, err, example.name)
 		require.Equalf(t, 5, len(watcher.Actions), "len(actions) %s", example.name)
 
-		stored3, err := secrets.Get(meta3.Name, metav1.GetOptions{})
+		stored3, err := secrets.Get(context.TODO(), meta3.Name, metav1.GetOptions{})
 		require.NoError(t, err, example.name)
 		require.Equalf(t, 6, len(watcher.Actions), "len(actions) %s", example.name)
 		assert.Equal(t, update3, stored3)
@@ -730,9 +742,9 @@ func TestNewSecretReplicator(t *testing.T) {
 			Name: "target-1",
 		},
 	})
-	replicator := NewSecretReplicator(client, ReplicatorOptions{AllowAll: true}, resyncPeriod)
+	replicator := newTestSecretReplicator(t, client, WithOptions(ReplicatorOptions{AllowAll: true}), WithResyncPeriod(resyncPeriod))
 	replicator.Start()
-	_, err := client.CoreV1().Secrets("from-ns").Create(&v1.Secret{
+	_, err := client.CoreV1().Secrets("from-ns").Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "from-ns",
 			Name: "from",
@@ -740,9 +752,9 @@ func TestNewSecretReplicator(t *testing.T) {
 				ReplicateFromAnnotation: "source-ns/source",
 			},
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err, "from-ns/from")
-	_, err = client.CoreV1().Secrets("to-ns").Create(&v1.Secret{
+	_, err = client.CoreV1().Secrets("to-ns").Create(context.TODO(), &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "to-ns",
 			Name: "to",
@@ -751,34 +763,34 @@ func TestNewSecretReplicator(t *testing.T) {
 				ReplicateFromAnnotation: "source-ns/source",
 			},
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err, "to-ns/to")
-	_, err = client.CoreV1().Namespaces().Create(&v1.Namespace{
+	_, err = client.CoreV1().Namespaces().Create(context.TODO(), &v1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "target-2",
 		},
-	})
+	}, metav1.CreateOptions{})
 	require.NoError(t, err, "target-2")
 	time.Sleep(sleep)
 
-	secret, err := client.CoreV1().Secrets("from-ns").Get("from", metav1.GetOptions{})
+	secret, err := client.CoreV1().Secrets("from-ns").Get(context.TODO(), "from", metav1.GetOptions{})
 	if assert.NoError(t, err, "from-ns/from") {
 		assert.Equal(t, []byte("source"), secret.Data["data"], "from-ns/from")
 	}
-	secret, err = client.CoreV1().Secrets("target-1").Get("target", metav1.GetOptions{})
+	secret, err = client.CoreV1().Secrets("target-1").Get(context.TODO(), "target", metav1.GetOptions{})
 	if assert.NoError(t, err, "target-1/target") {
 		assert.Equal(t, []byte("source"), secret.Data["data"], "target-1/target")
 	}
-	secret, err = client.CoreV1().Secrets("target-2").Get("target", metav1.GetOptions{})
+	secret, err = client.CoreV1().Secrets("target-2").Get(context.TODO(), "target", metav1.GetOptions{})
 	if assert.NoError(t, err, "target-2/target") {
 		assert.Equal(t, []byte("source"), secret.Data["data"], "target-2/target")
 	}
 
-	err = client.CoreV1().Secrets("to-ns").Delete("to", &metav1.DeleteOptions{})
+	err = client.CoreV1().Secrets("to-ns").Delete(context.TODO(), "to", metav1.DeleteOptions{})
 	require.NoError(t, err, "to-ns/to")
 	time.Sleep(sleep)
-	secret, err = client.CoreV1().Secrets("target-1").Get("target", metav1.GetOptions{})
+	secret, err = client.CoreV1().Secrets("target-1").Get(context.TODO(), "target", metav1.GetOptions{})
 	assert.Error(t, err, "target-1/target")
-	secret, err = client.CoreV1().Secrets("target-2").Get("target", metav1.GetOptions{})
+	secret, err = client.CoreV1().Secrets("target-2").Get(context.TODO(), "target", metav1.GetOptions{})
 	assert.Error(t, err, "target-2/target")
 }
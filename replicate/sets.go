@@ -0,0 +1,148 @@
+// Set-based bookkeeping of the sources and their targets
+
+package replicate
+
+import (
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// keySet is a set of object keys, or namespaces
+type keySet map[string]bool
+
+func newKeySet(keys ...string) keySet {
+	set := make(keySet, len(keys))
+	set.add(keys...)
+	return set
+}
+
+func (s keySet) add(keys ...string) {
+	for _, key := range keys {
+		s[key] = true
+	}
+}
+
+// Returns the keys in order, nil if empty
+func (s keySet) sorted() []string {
+	if len(s) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Adds a key to the set of an index, creating it if needed
+func indexAdd(index map[string]keySet, key string, value string) {
+	if set, ok := index[key]; ok {
+		set[value] = true
+	} else {
+		index[key] = newKeySet(value)
+	}
+}
+
+// Removes a key from the set of an index, removing it once empty
+func indexRemove(index map[string]keySet, key string, value string) {
+	if set, ok := index[key]; ok {
+		delete(set, value)
+		if len(set) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+// indexedPattern is a pattern, compiled once, with all the sources waiting for it
+type indexedPattern struct {
+	pattern targetPattern
+	sources keySet
+}
+
+// Records the targets and patterns a source is waiting for, replacing the previous ones
+func (r *ReplicatorProps) watch(source string, targets []string, patterns []targetPattern) {
+	r.unwatch(source)
+	if len(targets) > 0 {
+		r.watchedTargets[source] = newKeySet(targets...)
+		for _, target := range targets {
+			indexAdd(r.targetWatchers, target, source)
+			indexAdd(r.namespaceWatchers, strings.SplitN(target, "/", 2)[0], source)
+		}
+	}
+	if len(patterns) > 0 {
+		r.watchedPatterns[source] = patterns
+		for _, pattern := range patterns {
+			indexed, ok := r.patternWatchers[pattern.String()]
+			if !ok {
+				indexed = &indexedPattern{pattern: pattern, sources: keySet{}}
+				r.patternWatchers[pattern.String()] = indexed
+			}
+			indexed.sources[source] = true
+		}
+	}
+}
+
+// Forgets the targets and patterns a source is waiting for
+func (r *ReplicatorProps) unwatch(source string) {
+	for target := range r.watchedTargets[source] {
+		indexRemove(r.targetWatchers, target, source)
+		indexRemove(r.namespaceWatchers, strings.SplitN(target, "/", 2)[0], source)
+	}
+	for _, pattern := range r.watchedPatterns[source] {
+		if indexed, ok := r.patternWatchers[pattern.String()]; ok {
+			delete(indexed.sources, source)
+			if len(indexed.sources) == 0 {
+				delete(r.patternWatchers, pattern.String())
+			}
+		}
+	}
+	delete(r.watchedTargets, source)
+	delete(r.watchedPatterns, source)
+}
+
+// Returns the sources waiting for a namespace, by a target or by a pattern
+func (r *ReplicatorProps) namespaceWatchedBy(namespace string) keySet {
+	sources := keySet{}
+	for source := range r.namespaceWatchers[namespace] {
+		sources[source] = true
+	}
+	for _, indexed := range r.patternWatchers {
+		if indexed.pattern.namespace.MatchString(namespace) {
+			for source := range indexed.sources {
+				sources[source] = true
+			}
+		}
+	}
+	return sources
+}
+
+// Returns the sources waiting for a target, by its key or by a pattern
+func (r *ReplicatorProps) targetWatchedBy(meta *metav1.ObjectMeta) keySet {
+	sources := keySet{}
+	for source := range r.targetWatchers[metaKey(meta)] {
+		sources[source] = true
+	}
+	for _, indexed := range r.patternWatchers {
+		if indexed.pattern.Match(meta) {
+			for source := range indexed.sources {
+				sources[source] = true
+			}
+		}
+	}
+	return sources
+}
+
+// Updates the sizes of the bookkeeping structures
+func (r *ReplicatorProps) observeBookkeeping() {
+	for structure, size := range map[string]int{
+		"watched_targets":    len(r.watchedTargets),
+		"watched_patterns":   len(r.watchedPatterns),
+		"watched_namespaces": len(r.namespaceWatchers),
+		"patterns":           len(r.patternWatchers),
+	} {
+		r.metrics.bookkeepingEntries.WithLabelValues(r.Name, structure).Set(float64(size))
+	}
+}
@@ -0,0 +1,46 @@
+package replicate
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestKeySet(t *testing.T) {
+	set := newKeySet("b", "a", "b")
+	set.add("c")
+	assert.Equal(t, []string{"a", "b", "c"}, set.sorted())
+	assert.Nil(t, keySet{}.sorted())
+}
+
+func TestWatch(t *testing.T) {
+	r := NewReplicatorProps(nil, "test", ReplicatorOptions{})
+	pattern := targetPattern{namespace: regexp.MustCompile(`^(?:target-.*)$`), name: "target"}
+	r.watch("source-ns/a", []string{"ns-1/target", "ns-2/target"}, []targetPattern{pattern})
+	r.watch("source-ns/b", []string{"ns-1/target"}, []targetPattern{pattern})
+
+	assert.Equal(t, []string{"source-ns/a", "source-ns/b"}, r.namespaceWatchedBy("ns-1").sorted())
+	assert.Equal(t, []string{"source-ns/a"}, r.namespaceWatchedBy("ns-2").sorted())
+	assert.Equal(t, []string{"source-ns/a", "source-ns/b"}, r.namespaceWatchedBy("target-1").sorted())
+	assert.Nil(t, r.namespaceWatchedBy("other").sorted())
+	assert.Equal(t, []string{"source-ns/a", "source-ns/b"},
+		r.targetWatchedBy(&metav1.ObjectMeta{Namespace: "target-1", Name: "target"}).sorted())
+	assert.Nil(t, r.targetWatchedBy(&metav1.ObjectMeta{Namespace: "target-1", Name: "other"}).sorted())
+	assert.Len(t, r.patternWatchers, 1)
+
+	// replaced
+	r.watch("source-ns/a", []string{"ns-3/target"}, nil)
+	assert.Equal(t, []string{"source-ns/b"}, r.namespaceWatchedBy("target-1").sorted())
+	assert.Nil(t, r.namespaceWatchedBy("ns-2").sorted())
+	assert.Equal(t, []string{"source-ns/a"}, r.namespaceWatchedBy("ns-3").sorted())
+
+	r.unwatch("source-ns/a")
+	r.unwatch("source-ns/b")
+	assert.Empty(t, r.watchedTargets)
+	assert.Empty(t, r.watchedPatterns)
+	assert.Empty(t, r.targetWatchers)
+	assert.Empty(t, r.namespaceWatchers)
+	assert.Empty(t, r.patternWatchers)
+}
@@ -0,0 +1,86 @@
+// Sharding of the sources across multiple instances
+
+package replicate
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Shard selects the sources an instance acts on, by consistent hashing of their namespace
+// Each instance watches all the objects, but only acts on the sources of its shard
+type Shard struct {
+	// the index of this instance, from 0 to Count-1
+	Index int
+	// the count of instances, 0 or 1 to disable sharding
+	Count int
+}
+
+// Validate returns an error if the index is out of range
+func (s Shard) Validate() error {
+	if s.Count < 0 {
+		return fmt.Errorf("invalid shard count %d", s.Count)
+	} else if s.Count > 1 && (s.Index < 0 || s.Index >= s.Count) {
+		return fmt.Errorf("invalid shard index %d: expected from 0 to %d", s.Index, s.Count-1)
+	}
+	return nil
+}
+
+// Contains returns if the sources of the namespace belong to this shard
+func (s Shard) Contains(namespace string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(namespace))
+	return jumpHash(hash.Sum64(), s.Count) == s.Index
+}
+
+// Jump consistent hash (Lamping and Veach): only 1/n of the keys move when adding a bucket
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardIndexFromHostname returns the ordinal of a StatefulSet pod, from its "name-<ordinal>" hostname
+func ShardIndexFromHostname(hostname string) (int, error) {
+	index := strings.LastIndex(hostname, "-")
+	if index < 0 {
+		return 0, fmt.Errorf("hostname %s has no ordinal", hostname)
+	}
+	ordinal, err := strconv.Atoi(hostname[index+1:])
+	if err != nil {
+		return 0, fmt.Errorf("hostname %s has no ordinal: %s", hostname, err)
+	}
+	return ordinal, nil
+}
+
+// Returns if the source, as "namespace/name", belongs to the shard of this instance,
+// and its namespace matches the namespace selector
+func (r *ReplicatorProps) ownsSource(source string) bool {
+	namespace := strings.SplitN(source, "/", 2)[0]
+	return r.Shard.Contains(namespace) && r.selectsNamespace(namespace)
+}
+
+// Returns if the namespace matches the namespace selector, always without selector
+// The namespaces missing from the store match no selector
+func (r *ReplicatorProps) selectsNamespace(namespace string) bool {
+	if r.NamespaceSelector == nil {
+		return true
+	}
+	object, exists, err := r.namespaceStore.GetByKey(namespace)
+	if err != nil || !exists {
+		return false
+	}
+	return r.NamespaceSelector.Matches(labels.Set(object.(metav1.Object).GetLabels()))
+}
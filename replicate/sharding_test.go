@@ -0,0 +1,81 @@
+package replicate
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShard(t *testing.T) {
+	assert.True(t, Shard{}.Contains("any"))
+	assert.NoError(t, Shard{Index: 1, Count: 2}.Validate())
+	assert.Error(t, Shard{Index: 2, Count: 2}.Validate())
+	assert.Error(t, Shard{Count: -1}.Validate())
+	// each namespace belongs to exactly one shard, and the shards are balanced
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		namespace := fmt.Sprintf("namespace-%d", i)
+		found := 0
+		for index := range counts {
+			if (Shard{Index: index, Count: len(counts)}).Contains(namespace) {
+				counts[index]++
+				found++
+			}
+		}
+		require.Equal(t, 1, found, namespace)
+	}
+	for index, count := range counts {
+		assert.InDeltaf(t, 250, count, 50, "shard %d", index)
+	}
+	// adding a shard only moves namespaces to the new shard
+	for i := 0; i < 1000; i++ {
+		namespace := fmt.Sprintf("namespace-%d", i)
+		for index := 0; index < 4; index++ {
+			if (Shard{Index: index, Count: 5}).Contains(namespace) {
+				assert.True(t, Shard{Index: index, Count: 4}.Contains(namespace), namespace)
+			}
+		}
+	}
+
+	index, err := ShardIndexFromHostname("k8s-replicator-3")
+	require.NoError(t, err)
+	assert.Equal(t, 3, index)
+	_, err = ShardIndexFromHostname("k8s-replicator")
+	assert.Error(t, err)
+}
+
+func TestShard_replication(t *testing.T) {
+	shard := Shard{Index: 0, Count: 2}
+	// find a namespace of each shard
+	var owned, other string
+	for i := 0; owned == "" || other == ""; i++ {
+		namespace := fmt.Sprintf("source-%d", i)
+		if shard.Contains(namespace) {
+			owned = namespace
+		} else {
+			other = namespace
+		}
+	}
+	r := createTestReplicator(t, ReplicatorOptions{AllowAll: true, Shard: shard}, owned, other, "target-ns")
+	r.ObjectAdded(updateObject(r, other, "source", M{
+		ReplicateToAnnotation: "target-ns/other",
+	}))
+	r.ObjectAdded(updateObject(r, "target-ns", "from-other", M{
+		ReplicateFromAnnotation: other + "/source",
+	}))
+	requireActionsLength(t, r, 0)
+	r.ObjectAdded(updateObject(r, owned, "source", M{
+		ReplicateToAnnotation: "target-ns/owned",
+	}))
+	r.ObjectAdded(updateObject(r, "target-ns", "from-owned", M{
+		ReplicateFromAnnotation: owned + "/source",
+	}))
+	requireActionsLength(t, r, 2)
+	// the deletion is left to the other shard
+	r.ObjectDeleted(deleteObject(r, other, "source"))
+	requireActionsLength(t, r, 2)
+	r.ObjectDeleted(deleteObject(r, owned, "source"))
+	requireActionsLength(t, r, 4)
+}
@@ -0,0 +1,352 @@
+// Decryption of the SOPS-encrypted sources, such that only their targets hold the plaintext
+
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SOPSDecrypter decrypts the documents encrypted by SOPS, with age identities or the other keys of SOPS, such as AWS KMS
+// The decrypted data of a source is cached until its document changes or it is deleted, to not call KMS on each checksum
+// Only the sources of the allowed namespaces are decrypted, such that the keys cannot be used by any namespace
+type SOPSDecrypter struct {
+	// decrypts the data keys of the documents
+	keys        *sopsKeyService
+	// the patterns of the namespaces whose sources may be decrypted
+	namespaces  []*regexp.Regexp
+
+	mutex       sync.Mutex
+	// the decrypted data of the sources, by source
+	sources     map[string]*sopsSource
+	// decryptions of the SOPS documents of the sources, by result
+	decryptions *prometheus.CounterVec
+}
+
+// sopsSource is the decrypted data of a source
+type sopsSource struct {
+	// the checksum of the encrypted document
+	checksum string
+	data     map[string][]byte
+}
+
+// sopsKeyService is the key service decrypting the data keys, with the age identities of the keys file
+// The local key service of SOPS cannot be given identities, it reads them from the environment only,
+// so it is only used for the other keys, authenticated by the environment as the SOPS command
+type sopsKeyService struct {
+	// the age identities of the keys file, if any
+	identities sopsage.ParsedIdentities
+	// decrypts the other keys, replaced in tests
+	local      keyservice.KeyServiceClient
+}
+
+// NewSOPSDecrypter returns the decrypter with the age identities of the keys file, if any, and the other keys of SOPS,
+// decrypting the sources of the namespaces matching the patterns only
+func NewSOPSDecrypter(ageKeysFile string, allowedNamespaces []string) (*SOPSDecrypter, error) {
+	if len(allowedNamespaces) == 0 {
+		return nil, fmt.Errorf("no namespace allowed to decrypt")
+	}
+	namespaces := []*regexp.Regexp{}
+	for _, ns := range allowedNamespaces {
+		pattern, err := regexp.Compile(`^(?:` + ns + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern \"%s\": %s", ns, err)
+		}
+		namespaces = append(namespaces, pattern)
+	}
+	decrypter := &SOPSDecrypter{
+		namespaces:  namespaces,
+		keys:        &sopsKeyService{local: keyservice.NewLocalClient()},
+		sources:     map[string]*sopsSource{},
+		decryptions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "sops_decryptions_total",
+				Help:      "Decryptions of the SOPS documents of the sources, by result.",
+			},
+			[]string{"result"},
+		),
+	}
+	if ageKeysFile != "" {
+		content, err := ioutil.ReadFile(ageKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ageKeysFile, err)
+		}
+		decrypter.keys.identities = identities
+	}
+	return decrypter, nil
+}
+
+// Decrypt returns the data of the SOPS document, YAML or JSON, once its MAC is verified
+// The data of a Secret manifest is its data and stringData, else its top-level values, the strings as they are
+// and the other values as JSON
+func (d *SOPSDecrypter) Decrypt(document []byte) (map[string][]byte, error) {
+	var store sops.Store = sopsyaml.NewStore(&config.YAMLStoreConfig{})
+	if trimmed := bytes.TrimSpace(document); len(trimmed) > 0 && trimmed[0] == '{' {
+		store = sopsjson.NewStore(&config.JSONStoreConfig{})
+	}
+	tree, err := store.LoadEncryptedFile(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOPS document: %s", err)
+	}
+	key, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{d.keys}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data key: %s", err)
+	}
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
+	if err != nil {
+		return nil, err
+	}
+	// the MAC authenticates the whole tree, such that no value can be removed, added or moved
+	expectedMac, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, key, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the MAC: %s", err)
+	}
+	if expectedMac != mac {
+		return nil, fmt.Errorf("MAC mismatch, the document was altered")
+	}
+	// emitted as JSON to keep the numbers as they are
+	plain, err := sopsjson.NewStore(&config.JSONStoreConfig{}).EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("invalid document: %s", err)
+	}
+	return sopsData(values)
+}
+
+// Returns true if the sources of the namespace may be decrypted
+func (d *SOPSDecrypter) allowed(namespace string) bool {
+	for _, pattern := range d.namespaces {
+		if pattern.MatchString(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the decrypted data of the source, decrypted again only when its document changed
+// The sources of the other namespaces are refused
+func (d *SOPSDecrypter) decryptSource(key string, document []byte) (map[string][]byte, error) {
+	if namespace := strings.SplitN(key, "/", 2)[0]; !d.allowed(namespace) {
+		d.decryptions.WithLabelValues("refused").Inc()
+		return nil, fmt.Errorf("namespace %s is not allowed to decrypt", namespace)
+	}
+	checksum := hexSHA256(document)
+	d.mutex.Lock()
+	source, ok := d.sources[key]
+	d.mutex.Unlock()
+	if ok && source.checksum == checksum {
+		return source.data, nil
+	}
+	data, err := d.Decrypt(document)
+	if err != nil {
+		d.decryptions.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	d.decryptions.WithLabelValues("success").Inc()
+	d.mutex.Lock()
+	d.sources[key] = &sopsSource{checksum: checksum, data: data}
+	d.mutex.Unlock()
+	return data, nil
+}
+
+// Forgets the decrypted data of the source, deleted or not encrypted anymore
+func (d *SOPSDecrypter) forget(key string) {
+	d.mutex.Lock()
+	delete(d.sources, key)
+	d.mutex.Unlock()
+}
+
+// Encrypt encrypts a data key, with the local key service since the documents are never encrypted here
+func (s *sopsKeyService) Encrypt(ctx context.Context, request *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return s.local.Encrypt(ctx, request, opts...)
+}
+
+// Decrypt decrypts a data key, the age ones with the identities of the keys file and the others with the local key service
+func (s *sopsKeyService) Decrypt(ctx context.Context, request *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	ageKey, ok := request.Key.KeyType.(*keyservice.Key_AgeKey)
+	if !ok || len(s.identities) == 0 {
+		return s.local.Decrypt(ctx, request, opts...)
+	}
+	masterKey := &sopsage.MasterKey{Recipient: ageKey.AgeKey.Recipient, EncryptedKey: string(request.Ciphertext)}
+	s.identities.ApplyToMasterKey(masterKey)
+	plaintext, err := masterKey.Decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// Returns the data of the decrypted document
+func sopsData(tree map[string]interface{}) (map[string][]byte, error) {
+	data := map[string][]byte{}
+	if tree["kind"] == "Secret" {
+		encoded, _ := tree["data"].(map[string]interface{})
+		for key, value := range encoded {
+			text, _ := value.(string)
+			decoded, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid data %s: %s", key, err)
+			}
+			data[key] = decoded
+		}
+		stringData, _ := tree["stringData"].(map[string]interface{})
+		for key, value := range stringData {
+			var err error
+			if data[key], err = sopsBytes(value); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+	for key, value := range tree {
+		var err error
+		if data[key], err = sopsBytes(value); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Returns the bytes of a decrypted value, the strings as they are and the other values as JSON
+func sopsBytes(value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case string:
+		return []byte(value), nil
+	case []byte:
+		return value, nil
+	default:
+		return json.Marshal(value)
+	}
+}
+
+// sopsActions are the actions of the secrets, replicating the decrypted data of the SOPS-encrypted sources
+// The sources themselves are updated as they are, encrypted
+type sopsActions struct {
+	ReplicatorActions
+	decrypter *SOPSDecrypter
+}
+
+// Returns if the secret is a SOPS-encrypted source
+func isSOPSEncrypted(object interface{}) bool {
+	secret, ok := object.(*v1.Secret)
+	if !ok {
+		return false
+	}
+	_, ok = secret.Annotations[DecryptSOPSAnnotation]
+	return ok
+}
+
+// Returns a copy of the source holding its decrypted data, or the object itself when it is not encrypted
+func (a *sopsActions) decrypted(object interface{}) (interface{}, error) {
+	if !isSOPSEncrypted(object) {
+		if secret, ok := object.(*v1.Secret); ok {
+			a.decrypter.forget(metaKey(&secret.ObjectMeta))
+		}
+		return object, nil
+	}
+	secret := object.(*v1.Secret)
+	key := metaKey(&secret.ObjectMeta)
+	dataKey := secret.Annotations[DecryptSOPSAnnotation]
+	document, ok := secret.Data[dataKey]
+	if !ok {
+		return nil, fmt.Errorf("source %s has no key %s to decrypt, from annotation %s", key, dataKey, DecryptSOPSAnnotation)
+	}
+	data, err := a.decrypter.decryptSource(key, document)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt source %s: %s", key, err)
+	}
+	copy := secret.DeepCopy()
+	copy.Data = data
+	return copy, nil
+}
+
+// DataChecksum returns the checksum of the decrypted data, such that the targets are up to date with it
+// The checksum of the encrypted data is returned when it cannot be decrypted, the update then failing
+func (a *sopsActions) DataChecksum(object interface{}) string {
+	if decrypted, err := a.decrypted(object); err == nil {
+		object = decrypted
+	}
+	if checksummer, ok := a.ReplicatorActions.(DataChecksummer); ok {
+		return checksummer.DataChecksum(object)
+	}
+	return objectChecksum(object)
+}
+
+// Get gets the current version of a resource
+func (a *sopsActions) Get(ctx context.Context, client kubernetes.Interface, namespace string, name string) (interface{}, error) {
+	if getter, ok := a.ReplicatorActions.(ObjectGetter); ok {
+		return getter.Get(ctx, client, namespace, name)
+	}
+	return nil, fmt.Errorf("getting the resources is not supported")
+}
+
+// DataSize returns the size of the data of the written targets, which are not encrypted
+func (a *sopsActions) DataSize(object interface{}) int {
+	if sizer, ok := a.ReplicatorActions.(DataSizer); ok {
+		return sizer.DataSize(object)
+	}
+	return 0
+}
+
+// List lists the targets, which are not encrypted
+func (a *sopsActions) List(ctx context.Context, client kubernetes.Interface, selector string) ([]interface{}, error) {
+	if lister, ok := a.ReplicatorActions.(ObjectLister); ok {
+		return lister.List(ctx, client, selector)
+	}
+	return nil, fmt.Errorf("the targets cannot be listed")
+}
+
+// Update updates the target with the decrypted data of the source
+func (a *sopsActions) Update(ctx context.Context, client kubernetes.Interface, object interface{}, sourceObject interface{}, annotations map[string]string) (interface{}, error) {
+	if sourceObject != nil && !isSOPSEncrypted(object) {
+		var err error
+		if sourceObject, err = a.decrypted(sourceObject); err != nil {
+			return nil, err
+		}
+	}
+	return a.ReplicatorActions.Update(ctx, client, object, sourceObject, annotations)
+}
+
+// Install installs the target with the decrypted data of the source
+func (a *sopsActions) Install(ctx context.Context, client kubernetes.Interface, meta *metav1.ObjectMeta, sourceObject interface{}, dataObject interface{}) (interface{}, error) {
+	if dataObject != nil {
+		var err error
+		if dataObject, err = a.decrypted(dataObject); err != nil {
+			return nil, err
+		}
+	}
+	return a.ReplicatorActions.Install(ctx, client, meta, sourceObject, dataObject)
+}
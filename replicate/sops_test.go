@@ -0,0 +1,283 @@
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/kms"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// the values of the test documents
+const testSOPSValues = `{"user": "admin", "port": 5432, "database": {"password": "secret"}, "host_unencrypted": "db.local"}`
+
+// Returns a new age identity, and a decrypter with it
+func createTestSOPSDecrypter(t *testing.T) (*age.X25519Identity, *SOPSDecrypter) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	decrypter, err := NewSOPSDecrypter("", []string{"source-ns"})
+	require.NoError(t, err)
+	decrypter.keys.identities = sopsage.ParsedIdentities{identity}
+	return identity, decrypter
+}
+
+// Returns the age master key of the recipient, encrypting the data key
+func ageTestKey(t *testing.T, identity *age.X25519Identity, dataKey []byte) keys.MasterKey {
+	key, err := sopsage.MasterKeyFromRecipient(identity.Recipient().String())
+	require.NoError(t, err)
+	require.NoError(t, key.Encrypt(dataKey))
+	return key
+}
+
+// Returns the document of the values, JSON or YAML, encrypted by SOPS with a new data key and its MAC,
+// the data key being encrypted with the master keys
+func createTestSOPSDocument(t *testing.T, values string, masterKeys func(dataKey []byte) []keys.MasterKey) []byte {
+	var store sops.Store = sopsyaml.NewStore(&config.YAMLStoreConfig{})
+	if strings.HasPrefix(values, "{") {
+		store = sopsjson.NewStore(&config.JSONStoreConfig{})
+	}
+	branches, err := store.LoadPlainFile([]byte(values))
+	require.NoError(t, err)
+	dataKey := make([]byte, 32)
+	_, err = rand.Read(dataKey)
+	require.NoError(t, err)
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:         []sops.KeyGroup{masterKeys(dataKey)},
+			UnencryptedSuffix: "_unencrypted",
+			Version:           "3.12.2",
+		},
+	}
+	cipher := aes.NewCipher()
+	mac, err := tree.Encrypt(dataKey, cipher)
+	require.NoError(t, err)
+	tree.Metadata.LastModified = time.Now().UTC()
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(mac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	require.NoError(t, err)
+	document, err := store.EmitEncryptedFile(tree)
+	require.NoError(t, err)
+	return document
+}
+
+func TestNewSOPSDecrypter(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	file := filepath.Join(os.TempDir(), fmt.Sprintf("sops-age-keys-%d.txt", time.Now().UnixNano()))
+	defer os.Remove(file)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("# created: today\n"+identity.String()+"\n\n"), 0600))
+	decrypter, err := NewSOPSDecrypter(file, []string{"source-ns"})
+	require.NoError(t, err)
+	assert.Len(t, decrypter.keys.identities, 1)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("# no identity\n"), 0600))
+	_, err = NewSOPSDecrypter(file, []string{"source-ns"})
+	assert.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(file, []byte(identity.Recipient().String()+"\n"), 0600))
+	_, err = NewSOPSDecrypter(file, []string{"source-ns"})
+	assert.Error(t, err, "recipient instead of identity")
+	_, err = NewSOPSDecrypter(file + ".missing", []string{"source-ns"})
+	assert.Error(t, err)
+
+	_, err = NewSOPSDecrypter("", nil)
+	assert.Error(t, err, "no namespace allowed")
+	_, err = NewSOPSDecrypter("", []string{"source-("})
+	assert.Error(t, err)
+}
+
+func TestSOPSDecrypter_age(t *testing.T) {
+	identity, decrypter := createTestSOPSDecrypter(t)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	for _, values := range []string{testSOPSValues, "user: admin\nport: 5432\ndatabase:\n  password: secret\nhost_unencrypted: db.local\n"} {
+		document := createTestSOPSDocument(t, values, func(dataKey []byte) []keys.MasterKey {
+			return []keys.MasterKey{ageTestKey(t, other, dataKey), ageTestKey(t, identity, dataKey)}
+		})
+		data, err := decrypter.Decrypt(document)
+		require.NoError(t, err)
+		assert.Equal(t, map[string][]byte{
+			"user":             []byte("admin"),
+			"port":             []byte("5432"),
+			"database":         []byte(`{"password":"secret"}`),
+			"host_unencrypted": []byte("db.local"),
+		}, data)
+	}
+
+	document := createTestSOPSDocument(t, testSOPSValues, func(dataKey []byte) []keys.MasterKey {
+		return []keys.MasterKey{ageTestKey(t, identity, dataKey)}
+	})
+	// tampered values are detected
+	tampered := bytes.Replace(document, []byte(`"user": "ENC[AES256_GCM,data:`), []byte(`"user": "ENC[AES256_GCM,data:AA`), 1)
+	require.NotEqual(t, document, tampered)
+	_, err = decrypter.Decrypt(tampered)
+	assert.Error(t, err)
+	// removed values are detected by the MAC
+	var tree map[string]interface{}
+	require.NoError(t, json.Unmarshal(document, &tree))
+	delete(tree, "user")
+	removed, err := json.Marshal(tree)
+	require.NoError(t, err)
+	_, err = decrypter.Decrypt(removed)
+	assert.EqualError(t, err, "MAC mismatch, the document was altered")
+
+	document = createTestSOPSDocument(t, testSOPSValues, func(dataKey []byte) []keys.MasterKey {
+		return []keys.MasterKey{ageTestKey(t, other, dataKey)}
+	})
+	_, err = decrypter.Decrypt(document)
+	assert.Error(t, err, "no matching identity")
+
+	_, err = decrypter.Decrypt([]byte("user: admin\n"))
+	assert.Error(t, err, "not encrypted")
+}
+
+func TestSOPSDecrypter_kms(t *testing.T) {
+	var dataKey []byte
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		assert.Equal(t, "TrentService.Decrypt", req.Header.Get("X-Amz-Target"))
+		assert.Contains(t, req.Header.Get("Authorization"), "/eu-west-3/kms/")
+		var input struct {
+			CiphertextBlob    []byte
+			KeyId             string
+			EncryptionContext map[string]string
+		}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&input))
+		assert.Equal(t, []byte("blob"), input.CiphertextBlob)
+		assert.Equal(t, "arn:aws:kms:eu-west-3:123456789012:key/test", input.KeyId)
+		assert.Equal(t, map[string]string{"app": "test"}, input.EncryptionContext)
+		_ = json.NewEncoder(res).Encode(map[string][]byte{"Plaintext": dataKey})
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(os.TempDir(), "missing-aws-config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(os.TempDir(), "missing-aws-credentials"))
+	decrypter, err := NewSOPSDecrypter("", []string{"source-ns"})
+	require.NoError(t, err)
+
+	document := createTestSOPSDocument(t, testSOPSValues, func(key []byte) []keys.MasterKey {
+		dataKey = key
+		app := "test"
+		return []keys.MasterKey{&kms.MasterKey{
+			Arn:               "arn:aws:kms:eu-west-3:123456789012:key/test",
+			EncryptedKey:      "YmxvYg==",
+			EncryptionContext: map[string]*string{"app": &app},
+			CreationDate:      time.Now().UTC(),
+		}}
+	})
+	data, err := decrypter.decryptSource("source-ns/source", document)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"password":"secret"}`), data["database"])
+	// cached until the document changes
+	_, err = decrypter.decryptSource("source-ns/source", document)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	// decrypted again once forgotten
+	decrypter.forget("source-ns/source")
+	_, err = decrypter.decryptSource("source-ns/source", document)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	// the other namespaces are refused, without calling KMS
+	_, err = decrypter.decryptSource("other-ns/source", document)
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestSOPSDecrypter_secretManifest(t *testing.T) {
+	identity, decrypter := createTestSOPSDecrypter(t)
+	document := createTestSOPSDocument(t, `apiVersion: v1
+kind: Secret
+metadata:
+  name: database
+data:
+  password: c2VjcmV0
+stringData:
+  user: admin
+`, func(dataKey []byte) []keys.MasterKey {
+		return []keys.MasterKey{ageTestKey(t, identity, dataKey)}
+	})
+	data, err := decrypter.Decrypt(document)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"password": []byte("secret"), "user": []byte("admin")}, data)
+}
+
+func TestSOPSActions(t *testing.T) {
+	identity, decrypter := createTestSOPSDecrypter(t)
+	document := createTestSOPSDocument(t, testSOPSValues, func(dataKey []byte) []keys.MasterKey {
+		return []keys.MasterKey{ageTestKey(t, identity, dataKey)}
+	})
+	source := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      "source",
+			Annotations: M{
+				ReplicationAllowedAnnotation: "true",
+				DecryptSOPSAnnotation:        "database.enc.json",
+			},
+		},
+		Data: map[string][]byte{"database.enc.json": document},
+	}
+	target := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "target-ns",
+			Name:      "target",
+			Annotations: M{
+				ReplicateFromAnnotation: "source-ns/source",
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(source, target)
+	r := newTestSecretReplicator(t, client, WithOptions(ReplicatorOptions{Decrypter: decrypter}), WithResyncPeriod(time.Hour))
+	require.NoError(t, r.objectStore.Add(source))
+	require.NoError(t, r.objectStore.Add(target))
+	r.ObjectAdded(target)
+
+	replicated, err := client.CoreV1().Secrets("target-ns").Get(context.TODO(), "target", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("admin"), replicated.Data["user"])
+	assert.NotContains(t, replicated.Data, "database.enc.json")
+	assert.Equal(t, r.DataChecksum(source), r.DataChecksum(replicated))
+
+	// the source is kept encrypted
+	unchanged, err := client.CoreV1().Secrets("source-ns").Get(context.TODO(), "source", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, source.Data, unchanged.Data)
+
+	// the source cannot be decrypted
+	source = source.DeepCopy()
+	source.Data["database.enc.json"] = []byte("user: admin\n")
+	_, err = r.Update(context.TODO(), client, replicated, source, replicated.Annotations)
+	assert.Error(t, err)
+
+	// the decrypted data is forgotten with the source
+	assert.Contains(t, decrypter.sources, "source-ns/source")
+	r.ObjectDeleted(source)
+	assert.NotContains(t, decrypter.sources, "source-ns/source")
+}
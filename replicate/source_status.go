@@ -0,0 +1,159 @@
+// Status summary written back onto the sources
+
+package replicate
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// maximum length of the error messages in the status and condition annotations
+const maxStatusErrorLength = 256
+
+// syncResult counts the targets of a source, and how many were synced
+type syncResult struct {
+	targets   int
+	synced    int
+	err       error
+	// the error the source is handled again on, a transient one over a permanent one
+	handleErr error
+}
+
+// Records the result of the replication to a target
+func (s *syncResult) add(err error) {
+	s.targets++
+	if err == nil {
+		s.synced++
+	} else {
+		s.err = err
+		s.handleErr = handlingError(s.handleErr, err)
+	}
+}
+
+// Returns the status annotations of the source, nil if it has no target
+func (s syncResult) annotations() map[string]string {
+	if s.targets == 0 {
+		return nil
+	}
+	status := fmt.Sprintf("%d/%d targets synced", s.synced, s.targets)
+	if s.err != nil {
+		status = fmt.Sprintf("%s, last error: %s", status, truncateMessage(s.err.Error()))
+	}
+	return map[string]string{
+		ReplicationStatusAnnotation:      status,
+		ReplicatedTargetsCountAnnotation: strconv.Itoa(s.targets),
+	}
+}
+
+// sourceStatuses rate limits the writes of the status annotations
+// It is protected by the replicator's mutex
+type sourceStatuses struct {
+	// when the status of each source was last written
+	written map[string]time.Time
+	// the statuses waiting for the interval to elapse
+	pending map[string]syncResult
+	now     func() time.Time
+}
+
+func newSourceStatuses() *sourceStatuses {
+	return &sourceStatuses{
+		written: map[string]time.Time{},
+		pending: map[string]syncResult{},
+		now:     time.Now,
+	}
+}
+
+// Forgets a deleted source
+func (s *sourceStatuses) delete(key string) {
+	delete(s.written, key)
+	delete(s.pending, key)
+}
+
+// Writes the status annotations onto the source if they changed
+// Writes happen at most once per StatusInterval, later ones are delayed
+func (r *ObjectReplicator) updateSourceStatus(object interface{}, result syncResult) {
+	if !r.SourceStatus {
+		return
+	}
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	if !r.ownsSource(key) {
+		return
+	}
+	expected := result.annotations()
+	changed := false
+	for _, annotation := range []string{ReplicationStatusAnnotation, ReplicatedTargetsCountAnnotation} {
+		value, ok := meta.Annotations[annotation]
+		if expectedValue, expectedOk := expected[annotation]; ok != expectedOk || value != expectedValue {
+			changed = true
+		}
+	}
+	if !changed {
+		delete(r.sourceStatuses.pending, key)
+		return
+	}
+	if last, ok := r.sourceStatuses.written[key]; ok && r.sourceStatuses.now().Sub(last) < r.StatusInterval {
+		r.logger.V(debugLevel).Info("status update is delayed", "source", key)
+		r.sourceStatuses.pending[key] = result
+		return
+	}
+	delete(r.sourceStatuses.pending, key)
+	r.sourceStatuses.written[key] = r.sourceStatuses.now()
+
+	annotations := cloneSMap(meta.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	delete(annotations, ReplicationStatusAnnotation)
+	delete(annotations, ReplicatedTargetsCountAnnotation)
+	for annotation, value := range expected {
+		annotations[annotation] = value
+	}
+	r.logger.V(debugLevel).Info("updating status annotations", "source", key, "status", expected[ReplicationStatusAnnotation])
+	start := time.Now()
+	ctx, cancel := r.requestContext(r.ctx)
+	newObject, err := r.Update(ctx, r.client, object, object, annotations)
+	cancel()
+	r.observeAction("status", start, err)
+	r.audit("status", key, key, newObject, err)
+	if err != nil {
+		r.logger.Error(err, "could not update status annotations", "source", key)
+		return
+	}
+	// update the object store in advance
+	if err := r.objectStore.Update(newObject); err != nil {
+		r.logger.Error(err, "could not update store", "source", key)
+	}
+}
+
+// Writes the delayed statuses whose interval has elapsed
+func (r *ObjectReplicator) flushSourceStatuses() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, result := range r.sourceStatuses.pending {
+		if last, ok := r.sourceStatuses.written[key]; ok && r.sourceStatuses.now().Sub(last) < r.StatusInterval {
+			continue
+		}
+		delete(r.sourceStatuses.pending, key)
+		if object, _, exists, err := r.getFromStore(key); err != nil {
+			r.logger.Error(err, "could not get source", "source", key)
+		} else if exists {
+			r.updateSourceStatus(object, result)
+		}
+	}
+}
+
+// Periodically writes the delayed statuses
+func (r *ObjectReplicator) runSourceStatuses(stop <-chan struct{}) {
+	if !r.SourceStatus {
+		return
+	}
+	interval := r.StatusInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	wait.Until(r.flushSourceStatuses, interval, stop)
+}
@@ -0,0 +1,61 @@
+package replicate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceStatus(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{
+		SourceStatus:   true,
+		StatusInterval: time.Minute,
+	}, "source-ns", "target-ns")
+	now := time.Now()
+	r.sourceStatuses.now = func() time.Time {
+		return now
+	}
+	// not created by replication, so cannot be replaced
+	updateObject(r, "target-ns", "other", M{})
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target,target-ns/other",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	action := r.ReplicatorActions.(*testActions).Actions[1]
+	assert.Equal(t, "update", action.Action)
+	assert.Equal(t, "source", action.Object.Meta.Name)
+	assert.Equal(t, source.Data, action.Object.Data, "data is kept")
+	assert.Regexp(t, `^1/2 targets synced, last error: `, action.Object.Meta.Annotations[ReplicationStatusAnnotation])
+	assert.Equal(t, "2", action.Object.Meta.Annotations[ReplicatedTargetsCountAnnotation])
+	// the status update is seen, the status does not change, and the target has the same data
+	r.ObjectAdded(getObject(r, "source-ns", "source"))
+	requireActionsLength(t, r, 2)
+	// the blocking object is deleted, the status is delayed
+	r.ObjectDeleted(deleteObject(r, "target-ns", "other"))
+	requireActionsLength(t, r, 3)
+	r.ObjectAdded(getObject(r, "source-ns", "source"))
+	requireActionsLength(t, r, 3)
+	r.flushSourceStatuses()
+	requireActionsLength(t, r, 3)
+	// then written once the interval elapsed
+	now = now.Add(2 * time.Minute)
+	r.flushSourceStatuses()
+	requireActionsLength(t, r, 4)
+	action = r.ReplicatorActions.(*testActions).Actions[3]
+	assert.Equal(t, "update", action.Action)
+	assert.Equal(t, "2/2 targets synced", action.Object.Meta.Annotations[ReplicationStatusAnnotation])
+	require.Empty(t, r.sourceStatuses.pending)
+}
+
+func TestSourceStatus_disabled(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, "install", r.ReplicatorActions.(*testActions).Actions[0].Action)
+}
@@ -0,0 +1,138 @@
+// Safety window holding back the deletions after startup
+
+package replicate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// StartupGate holds back the deletions after startup, until all the replicators are ready,
+// and a delay has elapsed, such that a partially filled cache never deletes valid targets
+// A nil gate never holds back anything
+type StartupGate struct {
+	mutex    sync.Mutex
+	delay    time.Duration
+	opened   bool
+	// called when the gate opens, by key
+	deferred map[string]func()
+	// the observe-only window from the start, and if the updates are held back too
+	started  time.Time
+	grace    time.Duration
+	updates  bool
+	logger   logr.Logger
+}
+
+// NewStartupGate returns a closed gate, opened by Run
+func NewStartupGate(delay time.Duration, logger logr.Logger) *StartupGate {
+	return &StartupGate{
+		delay:    delay,
+		deferred: map[string]func(){},
+		started:  time.Now(),
+		logger:   logger,
+	}
+}
+
+// SetGrace keeps the gate closed for at least the grace window from the start,
+// and holds back the updates of the existing targets too while closed if asked
+func (g *StartupGate) SetGrace(grace time.Duration, updates bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.grace = grace
+	g.updates = updates
+}
+
+// Opened returns if the deletions are allowed
+func (g *StartupGate) Opened() bool {
+	if g == nil {
+		return true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.opened
+}
+
+// Returns true if the gate is still closed, then `retry` is called once it opens
+// Only the last `retry` of each key is called
+func (g *StartupGate) holdBack(key string, retry func()) bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.opened {
+		return false
+	}
+	g.deferred[key] = retry
+	return true
+}
+
+// Returns true if the updates are held back, and the gate is still closed,
+// then `retry` is called once it opens
+func (g *StartupGate) holdBackUpdate(key string, retry func()) bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	updates := g.updates
+	g.mutex.Unlock()
+	return updates && g.holdBack(key, retry)
+}
+
+// Allows the deletions, and retries the ones held back
+func (g *StartupGate) open() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.opened {
+		return
+	}
+	g.logger.Info("startup safety window elapsed, allowing deletions", "deferred", len(g.deferred))
+	// before opening, such that the retries are queued once opened
+	for _, retry := range g.deferred {
+		retry()
+	}
+	g.deferred = nil
+	g.opened = true
+}
+
+// Run waits for all the replicators to be ready, then for the delay, and opens the gate
+func (g *StartupGate) Run(replicators []Replicator, stop <-chan struct{}) {
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		for _, replicator := range replicators {
+			if !replicator.Ready() {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, stop)
+	if err != nil {
+		return
+	}
+	delay := g.delay
+	// not before the end of the grace window
+	g.mutex.Lock()
+	if remaining := g.grace - time.Since(g.started); remaining > delay {
+		delay = remaining
+	}
+	g.mutex.Unlock()
+	g.logger.Info("all replicators are ready, waiting before allowing deletions", "delay", delay.String())
+	select {
+	case <-time.After(delay):
+		g.open()
+	case <-stop:
+	}
+}
+
+// Returns true if the update of the target is held back by the startup gate,
+// then the object of the given key is handled again once it opens
+func (r *ObjectReplicator) updateHeldBack(action string, key string, target string) bool {
+	if !r.StartupGate.holdBackUpdate(r.Name+"/"+key, func() { r.enqueue(queueItem{key: key}) }) {
+		return false
+	}
+	r.logger.Info("update is deferred", "target", target, "action", action, "reason", "startup safety window")
+	r.metrics.startupHeldActions.WithLabelValues(r.Name, action).Inc()
+	return true
+}
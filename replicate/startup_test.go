@@ -0,0 +1,127 @@
+package replicate
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A replicator ready on demand, read by the gate in its own goroutine
+type readyReplicator struct {
+	Replicator
+	ready atomic.Bool
+}
+
+func (r *readyReplicator) Ready() bool {
+	return r.ready.Load()
+}
+
+func TestStartupGate(t *testing.T) {
+	var nilGate *StartupGate
+	assert.True(t, nilGate.Opened())
+	assert.False(t, nilGate.holdBack("key", nil))
+
+	gate := NewStartupGate(time.Millisecond, logr.Discard())
+	retried := []string{}
+	assert.False(t, gate.Opened())
+	assert.True(t, gate.holdBack("a", func() { retried = append(retried, "a1") }))
+	assert.True(t, gate.holdBack("a", func() { retried = append(retried, "a2") }))
+	assert.True(t, gate.holdBack("b", func() { retried = append(retried, "b") }))
+
+	replicator := &readyReplicator{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		gate.Run([]Replicator{replicator}, stop)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, gate.Opened())
+	replicator.ready.Store(true)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gate not opened")
+	}
+	close(stop)
+	assert.True(t, gate.Opened())
+	assert.ElementsMatch(t, []string{"a2", "b"}, retried)
+	assert.False(t, gate.holdBack("c", nil))
+}
+
+func TestStartupGate_deletions(t *testing.T) {
+	gate := NewStartupGate(0, logr.Discard())
+	r := createTestReplicator(t, ReplicatorOptions{StartupGate: gate}, "source-ns", "target-ns")
+	r.initQueue()
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	}))
+	requireActionsLength(t, r, 1)
+
+	// held back
+	r.ObjectDeleted(deleteObject(r, "source-ns", "source"))
+	requireActionsLength(t, r, 1)
+	assertStore(t, r, "target-ns", "target", "1")
+	assert.Equal(t, 0, r.queue.Len())
+
+	// handled again once opened
+	gate.open()
+	assert.Equal(t, 1, r.queue.Len())
+	processQueue(t, r)
+	requireActionsLength(t, r, 2)
+	assertAction(t, r, 1, &testAction{
+		Action: "delete",
+		Object: testObject{
+			Meta: metav1.ObjectMeta{
+				Namespace:       "target-ns",
+				Name:            "target",
+				ResourceVersion: "1",
+			},
+		},
+	})
+	assertStore(t, r, "target-ns", "target", "")
+}
+
+func TestStartupGate_grace(t *testing.T) {
+	gate := NewStartupGate(0, logr.Discard())
+	gate.SetGrace(100*time.Millisecond, false)
+	assert.False(t, gate.holdBackUpdate("a", nil))
+
+	start := time.Now()
+	stop := make(chan struct{})
+	defer close(stop)
+	replicator := &readyReplicator{}
+	replicator.ready.Store(true)
+	gate.Run([]Replicator{replicator}, stop)
+	assert.True(t, gate.Opened())
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, "opened after the grace window")
+}
+
+func TestStartupGate_updates(t *testing.T) {
+	gate := NewStartupGate(0, logr.Discard())
+	gate.SetGrace(0, true)
+	r := createTestReplicator(t, ReplicatorOptions{StartupGate: gate}, "source-ns", "target-ns")
+	r.initQueue()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	// the missing targets are created
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+
+	// held back
+	r.ObjectAdded(updateObject(r, "source-ns", "source", nil))
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, 0, r.queue.Len())
+
+	// handled again once opened
+	gate.open()
+	assert.Equal(t, 1, r.queue.Len())
+	processQueue(t, r)
+	requireActionsLength(t, r, 2)
+	assert.Equal(t, "install", r.ReplicatorActions.(*testActions).Actions[1].Action)
+}
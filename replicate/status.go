@@ -0,0 +1,178 @@
+// Detailed status of the replicators
+
+package replicate
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplicatorStatus is the detailed status of a replicator
+type ReplicatorStatus struct {
+	Resource      string     `json:"resource"`
+	Synced        bool       `json:"synced"`
+	Ready         bool       `json:"ready"`
+	// when an informer event was last handled
+	LastEvent     *time.Time `json:"lastEvent,omitempty"`
+	// the last failure, as emitted in warning events
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	// count of objects in the store
+	Objects       int        `json:"objects"`
+	// count of sources replicated to or from, and of their targets
+	Sources       int        `json:"sources"`
+	Targets       int        `json:"targets"`
+	// count of the performed actions, and of the failed ones
+	Actions       int        `json:"actions"`
+	FailedActions int        `json:"failedActions"`
+	// count of the objects and namespaces waiting to be handled
+	QueueDepth    int        `json:"queueDepth"`
+	// count of the objects which exhausted their retries, until their next change
+	Parked        int        `json:"parked"`
+	// count of the targets backed off after repeated failures
+	BackedOff     int        `json:"backedOff"`
+	// the versions of the sources whose changes wait for approval, by source
+	PendingApprovals map[string]string `json:"pendingApprovals,omitempty"`
+}
+
+// replicatorStats tracks the handled events and errors
+// It has its own lock, such that it can be read while a handler is running
+type replicatorStats struct {
+	mutex         sync.Mutex
+	lastEvent     time.Time
+	lastError     string
+	lastErrorTime time.Time
+	actions       int
+	failedActions int
+	// the longest delay asked by the API server throttling the actions
+	retryAfter    time.Duration
+	// the shortest backoff of the targets backed off
+	backoff       time.Duration
+}
+
+// Records that an informer event was handled
+func (s *replicatorStats) eventHandled() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastEvent = time.Now()
+}
+
+// Records an action on kubernetes, and whether it failed
+// A conflict only counts as failed once its retries are exhausted
+// A throttled action does not count as failed, it is performed again once allowed
+func (s *replicatorStats) actionDone(err error) {
+	delay, throttled := retryAfter(err)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.actions++
+	if throttled {
+		if delay > s.retryAfter {
+			s.retryAfter = delay
+		}
+	} else if err != nil && !isConflict(err) {
+		s.failedActions++
+	}
+}
+
+// Records an action which still conflicts after all its retries
+func (s *replicatorStats) conflictExhausted() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failedActions++
+}
+
+// Returns the count of failed actions
+func (s *replicatorStats) failedCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failedActions
+}
+
+// Records a failure
+func (s *replicatorStats) failed(message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastError = message
+	s.lastErrorTime = time.Now()
+}
+
+// Status returns the detailed status of the replicator
+func (r *ObjectReplicator) Status() ReplicatorStatus {
+	status := ReplicatorStatus{
+		Resource: r.Name,
+		Synced:   r.Synced(),
+		Ready:    r.Ready(),
+		Objects:  len(r.currentObjectStore().ListKeys()),
+	}
+	if r.queue != nil {
+		status.QueueDepth = r.queue.Len()
+		status.Parked = r.parked.count()
+	}
+	status.BackedOff = r.breakers.open()
+
+	r.stats.mutex.Lock()
+	status.Actions = r.stats.actions
+	status.FailedActions = r.stats.failedActions
+	if !r.stats.lastEvent.IsZero() {
+		lastEvent := r.stats.lastEvent
+		status.LastEvent = &lastEvent
+	}
+	if !r.stats.lastErrorTime.IsZero() {
+		lastErrorTime := r.stats.lastErrorTime
+		status.LastError = r.stats.lastError
+		status.LastErrorTime = &lastErrorTime
+	}
+	r.stats.mutex.Unlock()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	status.Sources, status.Targets = r.countSources()
+	if pending := r.pendingApprovals(); len(pending) > 0 {
+		status.PendingApprovals = pending
+	}
+	return status
+}
+
+// ReplicatorStats are the counts of a replicator, and its last failure
+type ReplicatorStats struct {
+	// count of sources replicated to or from, and of their targets
+	Sources       int       `json:"sources"`
+	Targets       int       `json:"targets"`
+	// count of the performed actions, and of the failed ones
+	Actions       int       `json:"actions"`
+	FailedActions int       `json:"failedActions"`
+	// the last failure, as emitted in warning events, and when, zero without failure
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+}
+
+// Stats returns the counts of the replicator, lighter than its status
+func (r *ObjectReplicator) Stats() ReplicatorStats {
+	r.stats.mutex.Lock()
+	stats := ReplicatorStats{
+		Actions:       r.stats.actions,
+		FailedActions: r.stats.failedActions,
+		LastError:     r.stats.lastError,
+		LastErrorTime: r.stats.lastErrorTime,
+	}
+	r.stats.mutex.Unlock()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	stats.Sources, stats.Targets = r.countSources()
+	return stats
+}
+
+// Returns the count of sources replicated to or from, and of their targets
+// The mutex must be held
+func (r *ObjectReplicator) countSources() (int, int) {
+	sources := map[string]bool{}
+	targets := 0
+	for _, indexed := range []map[string]keySet{r.indexedSources(replicateFromIndex), r.indexedSources(replicatedByIndex)} {
+		for source, t := range indexed {
+			sources[source] = true
+			targets += len(t)
+		}
+	}
+	return len(sources), targets
+}
@@ -0,0 +1,446 @@
+// ReplicationStatus resources, reporting the replication status of each source
+
+package replicate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// the path of the ReplicationStatus resources of a namespace, they are namespaced
+	statusResourcesPath    = "/apis/" + ClusterResourceGroup + "/" + ClusterResourceVersion + "/namespaces/%s/replicationstatuses"
+	// the path of the ReplicationStatus resources of all the namespaces
+	allStatusResourcesPath = "/apis/" + ClusterResourceGroup + "/" + ClusterResourceVersion + "/replicationstatuses"
+	// the type of the condition telling if all the targets of the source are synced
+	StatusSynced           = "Synced"
+)
+
+// ReplicationStatus is the replication status of a source, in the namespace of the source
+type ReplicationStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ReplicationStatusSpec   `json:"spec"`
+	Status            ReplicationStatusStatus `json:"status,omitempty"`
+}
+
+// ReplicationStatusSpec is the source whose status is reported
+type ReplicationStatusSpec struct {
+	// the resource of the source, such as "secret" or "configMap"
+	Resource string `json:"resource"`
+	// the name of the source, in the namespace of the status
+	Source   string `json:"source"`
+}
+
+// ReplicationStatusStatus is the replication status of the source, reported by the replicator
+type ReplicationStatusStatus struct {
+	Conditions    []ClusterCondition `json:"conditions,omitempty"`
+	// count of the targets of the source, and of the synced ones
+	Targets       int                `json:"targets"`
+	SyncedTargets int                `json:"syncedTargets"`
+	// the last failure of a target, empty when all are synced
+	LastError     string             `json:"lastError,omitempty"`
+}
+
+// ReplicationStatusList is a list of ReplicationStatus
+type ReplicationStatusList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ReplicationStatus `json:"items"`
+}
+
+// DeepCopy returns a copy of the ReplicationStatus
+func (s *ReplicationStatus) DeepCopy() *ReplicationStatus {
+	out := *s
+	s.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Status.Conditions = append([]ClusterCondition{}, s.Status.Conditions...)
+	return &out
+}
+
+// statusResources reads and writes the ReplicationStatus resources
+type statusResources interface {
+	list(ctx context.Context) (*ReplicationStatusList, error)
+	get(ctx context.Context, namespace string, name string) (*ReplicationStatus, error)
+	create(ctx context.Context, status *ReplicationStatus) (*ReplicationStatus, error)
+	updateStatus(ctx context.Context, status *ReplicationStatus) (*ReplicationStatus, error)
+	delete(ctx context.Context, namespace string, name string) error
+}
+
+// restStatusResources accesses the ReplicationStatus resources through the REST client,
+// since they have no typed client
+type restStatusResources struct {
+	client kubernetes.Interface
+}
+
+// Decodes the ReplicationStatus returned by kubernetes
+func decodeReplicationStatus(body []byte, err error) (*ReplicationStatus, error) {
+	if err != nil {
+		return nil, err
+	}
+	status := &ReplicationStatus{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, fmt.Errorf("invalid ReplicationStatus: %s", err)
+	}
+	return status, nil
+}
+
+func (r *restStatusResources) list(ctx context.Context) (*ReplicationStatusList, error) {
+	body, err := r.client.Discovery().RESTClient().Get().
+		AbsPath(allStatusResourcesPath).
+		Do(ctx).
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := &ReplicationStatusList{}
+	if err := json.Unmarshal(body, list); err != nil {
+		return nil, fmt.Errorf("invalid ReplicationStatusList: %s", err)
+	}
+	return list, nil
+}
+
+func (r *restStatusResources) get(ctx context.Context, namespace string, name string) (*ReplicationStatus, error) {
+	return decodeReplicationStatus(r.client.Discovery().RESTClient().Get().
+		AbsPath(fmt.Sprintf(statusResourcesPath, namespace), name).
+		Do(ctx).
+		Raw())
+}
+
+func (r *restStatusResources) create(ctx context.Context, status *ReplicationStatus) (*ReplicationStatus, error) {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	return decodeReplicationStatus(r.client.Discovery().RESTClient().Post().
+		AbsPath(fmt.Sprintf(statusResourcesPath, status.Namespace)).
+		Body(body).
+		Do(ctx).
+		Raw())
+}
+
+func (r *restStatusResources) updateStatus(ctx context.Context, status *ReplicationStatus) (*ReplicationStatus, error) {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	return decodeReplicationStatus(r.client.Discovery().RESTClient().Put().
+		AbsPath(fmt.Sprintf(statusResourcesPath, status.Namespace), status.Name, "status").
+		Body(body).
+		Do(ctx).
+		Raw())
+}
+
+func (r *restStatusResources) delete(ctx context.Context, namespace string, name string) error {
+	return r.client.Discovery().RESTClient().Delete().
+		AbsPath(fmt.Sprintf(statusResourcesPath, namespace), name).
+		Do(ctx).
+		Error()
+}
+
+// Returns the name of the ReplicationStatus of a source, prefixed with the resource,
+// such that a secret and a configMap of the same name have their own, hashed when too long
+func statusResourceName(resource string, source string) string {
+	name := strings.ToLower(resource) + "-" + source
+	if len(name) <= 253 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return strings.TrimRight(name[:242], "-.") + "-" + hex.EncodeToString(sum[:])[:10]
+}
+
+// Returns the status to report onto the resource of the source, keeping the transition time of the condition
+func (s syncResult) resourceStatus(previous ReplicationStatusStatus, now time.Time) ReplicationStatusStatus {
+	condition := ClusterCondition{
+		Type:   StatusSynced,
+		Status: metav1.ConditionTrue,
+		Reason: "Synced",
+	}
+	result := ReplicationStatusStatus{
+		Targets:       s.targets,
+		SyncedTargets: s.synced,
+	}
+	if s.synced < s.targets {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Failing"
+		if s.err != nil {
+			result.LastError = truncateMessage(s.err.Error())
+			condition.Message = result.LastError
+		}
+	}
+	condition.LastTransitionTime = metav1.NewTime(now)
+	for _, old := range previous.Conditions {
+		if old.Type == StatusSynced && old.Status == condition.Status {
+			condition.LastTransitionTime = old.LastTransitionTime
+		}
+	}
+	result.Conditions = []ClusterCondition{condition}
+	return result
+}
+
+// Returns whether the statuses are the same once serialized, the times being rounded to the second
+func sameReplicationStatus(a ReplicationStatusStatus, b ReplicationStatusStatus) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
+
+// statusWrite is the status to write onto the ReplicationStatus of a source
+type statusWrite struct {
+	namespace string
+	source    string
+	// the source, owning its ReplicationStatus such that it is garbage collected with it
+	owner     *metav1.OwnerReference
+	result    syncResult
+}
+
+// statusWrites keeps the ReplicationStatus resources, written in the background without the mutex of the replicator
+type statusWrites struct {
+	mutex     sync.Mutex
+	// the ReplicationStatus resources by source, listed first such that the ones of the sources
+	// without target anymore are deleted after a restart too
+	resources map[string]*ReplicationStatus
+	listed    bool
+	// the writes to do by source, the last one replacing the pending one, nil to delete
+	pending   map[string]*statusWrite
+	running   bool
+}
+
+func newStatusWrites() *statusWrites {
+	return &statusWrites{
+		resources: map[string]*ReplicationStatus{},
+		pending:   map[string]*statusWrite{},
+	}
+}
+
+// Records the write of the ReplicationStatus of a source, and returns true if the writes must be started
+// The deletions of the unknown ReplicationStatus resources are skipped once listed
+func (w *statusWrites) add(key string, write *statusWrite) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.resources[key]; write == nil && w.listed && !ok {
+		delete(w.pending, key)
+		return false
+	}
+	w.pending[key] = write
+	if w.running {
+		return false
+	}
+	w.running = true
+	return true
+}
+
+// Returns the next write to do, or false once there is none, the writes being stopped
+func (w *statusWrites) next() (string, *statusWrite, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for key, write := range w.pending {
+		delete(w.pending, key)
+		return key, write, true
+	}
+	w.running = false
+	return "", nil, false
+}
+
+// Returns the known ReplicationStatus of a source, nil if unknown
+func (w *statusWrites) get(key string) *ReplicationStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.resources[key]
+}
+
+// Records the ReplicationStatus of a source, nil to forget it
+func (w *statusWrites) set(key string, resource *ReplicationStatus) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if resource == nil {
+		delete(w.resources, key)
+	} else {
+		w.resources[key] = resource
+	}
+}
+
+// Returns the reference to the source owning its ReplicationStatus, nil without uid
+func (r *ObjectReplicator) statusOwner(meta *metav1.ObjectMeta) *metav1.OwnerReference {
+	if meta.UID == "" {
+		return nil
+	}
+	return &metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       strings.ToUpper(r.Name[:1]) + r.Name[1:],
+		Name:       meta.Name,
+		UID:        meta.UID,
+	}
+}
+
+// Writes the ReplicationStatus of the source in the background if its status changed, creating it if missing
+// The ReplicationStatus of a source without target is deleted
+// The mutex must be held
+func (r *ObjectReplicator) updateStatusResource(object interface{}, result syncResult) {
+	if r.statusResources == nil {
+		return
+	}
+	meta := r.GetMeta(object)
+	key := metaKey(meta)
+	if !r.ownsSource(key) {
+		return
+	}
+	var write *statusWrite
+	if result.targets > 0 {
+		write = &statusWrite{
+			namespace: meta.Namespace,
+			source:    meta.Name,
+			owner:     r.statusOwner(meta),
+			result:    result,
+		}
+	}
+	if r.statusWrites.add(key, write) {
+		go r.writeStatusResources()
+	}
+}
+
+// Deletes the ReplicationStatus of a deleted source in the background,
+// the ones unknown after a restart are garbage collected with their source
+// The mutex must be held
+func (r *ObjectReplicator) deleteStatusResource(key string) {
+	if r.statusResources == nil {
+		return
+	}
+	if r.statusWrites.add(key, nil) {
+		go r.writeStatusResources()
+	}
+}
+
+// Does the pending writes of the ReplicationStatus resources, without the mutex
+func (r *ObjectReplicator) writeStatusResources() {
+	r.listStatusResources()
+	for {
+		key, write, ok := r.statusWrites.next()
+		if !ok {
+			return
+		}
+		if write == nil {
+			r.deleteStatusWrite(key)
+		} else {
+			r.writeStatus(key, write)
+		}
+	}
+}
+
+// Lists the ReplicationStatus resources of the replicator once
+func (r *ObjectReplicator) listStatusResources() {
+	r.statusWrites.mutex.Lock()
+	listed := r.statusWrites.listed
+	r.statusWrites.mutex.Unlock()
+	if listed {
+		return
+	}
+	ctx, cancel := r.requestContext(r.ctx)
+	defer cancel()
+	start := time.Now()
+	list, err := r.statusResources.list(ctx)
+	r.observeAction("status", start, err)
+	if err != nil {
+		// listed again with the next writes
+		r.logger.Error(err, "could not list ReplicationStatus")
+		return
+	}
+	r.statusWrites.mutex.Lock()
+	defer r.statusWrites.mutex.Unlock()
+	for i := range list.Items {
+		resource := &list.Items[i]
+		key := resource.Namespace + "/" + resource.Spec.Source
+		if _, ok := r.statusWrites.resources[key]; resource.Spec.Resource == r.Name && !ok {
+			r.statusWrites.resources[key] = resource
+		}
+	}
+	r.statusWrites.listed = true
+}
+
+// Writes the status of a source onto its ReplicationStatus, without the mutex
+func (r *ObjectReplicator) writeStatus(key string, write *statusWrite) {
+	ctx, cancel := r.requestContext(r.ctx)
+	defer cancel()
+	name := statusResourceName(r.Name, write.source)
+	resource := r.statusWrites.get(key)
+	if resource == nil {
+		created := &ReplicationStatus{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: ClusterResourceGroup + "/" + ClusterResourceVersion,
+				Kind:       "ReplicationStatus",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: write.namespace,
+				Name:      name,
+				Labels:    r.Labels,
+			},
+			Spec: ReplicationStatusSpec{
+				Resource: r.Name,
+				Source:   write.source,
+			},
+		}
+		if write.owner != nil {
+			created.OwnerReferences = []metav1.OwnerReference{*write.owner}
+		}
+		start := time.Now()
+		var err error
+		resource, err = r.statusResources.create(ctx, created)
+		if errors.IsAlreadyExists(err) {
+			resource, err = r.statusResources.get(ctx, write.namespace, name)
+		}
+		r.observeAction("status", start, err)
+		r.audit("status", key, write.namespace+"/"+name, nil, err)
+		if err != nil {
+			r.logger.Error(err, "could not create ReplicationStatus", "source", key, "status", name)
+			return
+		}
+		r.statusWrites.set(key, resource)
+	}
+	status := write.result.resourceStatus(resource.Status, r.now())
+	if sameReplicationStatus(resource.Status, status) {
+		return
+	}
+	resource = resource.DeepCopy()
+	resource.Status = status
+	r.logger.V(debugLevel).Info("updating ReplicationStatus", "source", key, "status", name)
+	start := time.Now()
+	updated, err := r.statusResources.updateStatus(ctx, resource)
+	r.observeAction("status", start, err)
+	r.audit("status", key, resource.Namespace+"/"+name, nil, err)
+	if err != nil {
+		// read again on next update
+		r.statusWrites.set(key, nil)
+		r.logger.Error(err, "could not update ReplicationStatus", "source", key, "status", name)
+		return
+	}
+	r.statusWrites.set(key, updated)
+}
+
+// Deletes the ReplicationStatus of a source, if known, without the mutex
+func (r *ObjectReplicator) deleteStatusWrite(key string) {
+	resource := r.statusWrites.get(key)
+	if resource == nil {
+		return
+	}
+	r.statusWrites.set(key, nil)
+	ctx, cancel := r.requestContext(r.ctx)
+	defer cancel()
+	start := time.Now()
+	err := r.statusResources.delete(ctx, resource.Namespace, resource.Name)
+	r.observeAction("status", start, err)
+	if !errors.IsNotFound(err) {
+		r.audit("delete-status", key, resource.Namespace+"/"+resource.Name, nil, err)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		r.logger.Error(err, "could not delete ReplicationStatus", "source", key, "status", resource.Name)
+	}
+}
@@ -0,0 +1,174 @@
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type testStatusResources struct {
+	mutex    sync.Mutex
+	statuses map[string]*ReplicationStatus
+	// count of the writes: creations, status updates and deletions
+	writes   int
+}
+
+func (s *testStatusResources) list(ctx context.Context) (*ReplicationStatusList, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := &ReplicationStatusList{}
+	for _, status := range s.statuses {
+		list.Items = append(list.Items, *status.DeepCopy())
+	}
+	return list, nil
+}
+
+func (s *testStatusResources) get(ctx context.Context, namespace string, name string) (*ReplicationStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if status, ok := s.statuses[namespace+"/"+name]; ok {
+		return status.DeepCopy(), nil
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Group: ClusterResourceGroup, Resource: "replicationstatuses"}, name)
+}
+
+func (s *testStatusResources) create(ctx context.Context, status *ReplicationStatus) (*ReplicationStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.statuses[metaKey(&status.ObjectMeta)]; ok {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Group: ClusterResourceGroup, Resource: "replicationstatuses"}, status.Name)
+	}
+	s.writes++
+	created := status.DeepCopy()
+	created.Status = ReplicationStatusStatus{}
+	s.statuses[metaKey(&status.ObjectMeta)] = created
+	return created.DeepCopy(), nil
+}
+
+func (s *testStatusResources) updateStatus(ctx context.Context, status *ReplicationStatus) (*ReplicationStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.statuses[metaKey(&status.ObjectMeta)]; !ok {
+		return nil, fmt.Errorf("ReplicationStatus %s not found", metaKey(&status.ObjectMeta))
+	}
+	s.writes++
+	s.statuses[metaKey(&status.ObjectMeta)] = status.DeepCopy()
+	return status.DeepCopy(), nil
+}
+
+func (s *testStatusResources) delete(ctx context.Context, namespace string, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writes++
+	delete(s.statuses, namespace+"/"+name)
+	return nil
+}
+
+// Waits for the writes of the ReplicationStatus resources running in the background
+func waitStatusWrites(t *testing.T, r *ObjectReplicator) {
+	require.Eventually(t, func() bool {
+		r.statusWrites.mutex.Lock()
+		defer r.statusWrites.mutex.Unlock()
+		return !r.statusWrites.running
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestStatusResources(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	resources := &testStatusResources{statuses: map[string]*ReplicationStatus{}}
+	r.statusResources = resources
+	// not created by replication, so cannot be replaced
+	updateObject(r, "target-ns", "other", M{})
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target,target-ns/other",
+	})
+	source.Meta.UID = "source-uid"
+	r.ObjectAdded(source)
+	waitStatusWrites(t, r)
+	require.Contains(t, resources.statuses, "source-ns/test-source")
+	status := resources.statuses["source-ns/test-source"]
+	assert.Equal(t, ReplicationStatusSpec{Resource: "test", Source: "source"}, status.Spec)
+	assert.Equal(t, []metav1.OwnerReference{{APIVersion: "v1", Kind: "Test", Name: "source", UID: "source-uid"}},
+		status.OwnerReferences, "garbage collected with its source")
+	assert.Equal(t, 2, status.Status.Targets)
+	assert.Equal(t, 1, status.Status.SyncedTargets)
+	assert.NotEmpty(t, status.Status.LastError)
+	require.Len(t, status.Status.Conditions, 1)
+	assert.Equal(t, StatusSynced, status.Status.Conditions[0].Type)
+	assert.Equal(t, metav1.ConditionFalse, status.Status.Conditions[0].Status)
+	assert.Equal(t, 2, resources.writes, "created then updated")
+
+	// unchanged
+	r.ObjectAdded(getObject(r, "source-ns", "source"))
+	waitStatusWrites(t, r)
+	assert.Equal(t, 2, resources.writes)
+
+	// the blocking object is deleted
+	r.ObjectDeleted(deleteObject(r, "target-ns", "other"))
+	r.ObjectAdded(getObject(r, "source-ns", "source"))
+	waitStatusWrites(t, r)
+	status = resources.statuses["source-ns/test-source"]
+	assert.Equal(t, 2, status.Status.SyncedTargets)
+	assert.Empty(t, status.Status.LastError)
+	assert.Equal(t, metav1.ConditionTrue, status.Status.Conditions[0].Status)
+	assert.Equal(t, 3, resources.writes)
+
+	// deleted with its source
+	r.ObjectDeleted(deleteObject(r, "source-ns", "source"))
+	waitStatusWrites(t, r)
+	assert.NotContains(t, resources.statuses, "source-ns/test-source")
+	assert.Empty(t, r.statusWrites.resources)
+}
+
+func TestStatusResources_noTarget(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	resources := &testStatusResources{statuses: map[string]*ReplicationStatus{}}
+	r.statusResources = resources
+	r.ObjectAdded(updateObject(r, "source-ns", "other", M{}))
+	waitStatusWrites(t, r)
+	assert.Zero(t, resources.writes, "not a source")
+
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	}))
+	waitStatusWrites(t, r)
+	require.Contains(t, resources.statuses, "source-ns/test-source")
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{}))
+	waitStatusWrites(t, r)
+	assert.NotContains(t, resources.statuses, "source-ns/test-source", "no more target")
+}
+
+func TestStatusResources_restart(t *testing.T) {
+	resources := &testStatusResources{statuses: map[string]*ReplicationStatus{}}
+	for _, status := range []*ReplicationStatus{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "test-source"}, Spec: ReplicationStatusSpec{Resource: "test", Source: "source"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "other-source"}, Spec: ReplicationStatusSpec{Resource: "other", Source: "source"}},
+	} {
+		resources.statuses[metaKey(&status.ObjectMeta)] = status
+	}
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	r.statusResources = resources
+
+	// written before the restart, and no target anymore
+	r.ObjectAdded(updateObject(r, "source-ns", "source", M{}))
+	waitStatusWrites(t, r)
+	assert.NotContains(t, resources.statuses, "source-ns/test-source")
+	assert.Contains(t, resources.statuses, "source-ns/other-source", "of another resource")
+	assert.Equal(t, 1, resources.writes)
+}
+
+func Test_statusResourceName(t *testing.T) {
+	assert.Equal(t, "configmap-my-config", statusResourceName("configMap", "my-config"))
+	long := statusResourceName("secret", strings.Repeat("a", 250))
+	assert.Len(t, long, 253)
+	assert.NotEqual(t, long, statusResourceName("secret", strings.Repeat("a", 251)), "hashed")
+}
@@ -0,0 +1,89 @@
+package replicate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	status := r.Status()
+	assert.Nil(t, status.LastEvent, "no event")
+	assert.Empty(t, status.LastError, "no error")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	from := updateObject(r, "target-ns", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(from)
+
+	status = r.Status()
+	assert.Equal(t, "test", status.Resource)
+	assert.NotNil(t, status.LastEvent, "events handled")
+	assert.Equal(t, 3, status.Objects)
+	assert.Equal(t, 1, status.Sources)
+	assert.Equal(t, 2, status.Targets)
+	assert.Equal(t, "source-ns/source ReplicationNotAllowed: replication to target-ns/from: source source-ns/source does not explicitely allow replication", status.LastError)
+	assert.NotNil(t, status.LastErrorTime)
+
+	stats := r.Stats()
+	assert.Equal(t, 1, stats.Sources)
+	assert.Equal(t, 2, stats.Targets)
+	assert.Equal(t, status.Actions, stats.Actions)
+	assert.Equal(t, status.LastError, stats.LastError)
+	assert.Equal(t, *status.LastErrorTime, stats.LastErrorTime)
+}
+
+func TestResync(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	r.initQueue()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	// the target was edited out of band
+	deleteObject(r, "target-ns", "target")
+
+	handler := &ResyncHandler{Replicators: []Replicator{r}}
+	req, err := http.NewRequest("GET", "/resync", nil)
+	require.NoError(t, err)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+
+	// queued, not handled
+	assert.True(t, r.Resync())
+	requireActionsLength(t, r, 1)
+	assert.Equal(t, 1, r.queue.Len())
+	processQueue(t, r)
+	requireActionsLength(t, r, 2)
+	action := r.ReplicatorActions.(*testActions).Actions[1]
+	assert.Equal(t, "install", action.Action)
+	assert.Equal(t, "target-ns", action.Object.Meta.Namespace)
+	assert.Equal(t, "target", action.Object.Meta.Name)
+	target := getObject(r, "target-ns", "target")
+	require.NotNil(t, target)
+	assert.Equal(t, source.Data, target.Data)
+	assert.Equal(t, "source-ns/source", target.Meta.Annotations[ReplicatedByAnnotation])
+
+	// queued on POST, handled by the workers
+	deleteObject(r, "target-ns", "target")
+	req, err = http.NewRequest("POST", "/resync", nil)
+	require.NoError(t, err)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusAccepted, res.Code)
+	assert.Nil(t, getObject(r, "target-ns", "target"))
+	assert.Equal(t, 1, r.queue.Len())
+	processQueue(t, r)
+	require.NotNil(t, getObject(r, "target-ns", "target"))
+	assert.Equal(t, source.Data, getObject(r, "target-ns", "target").Data)
+}
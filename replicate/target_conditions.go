@@ -0,0 +1,80 @@
+// Condition annotations on the targets
+
+package replicate
+
+import (
+	"time"
+)
+
+// The values of the replication-state annotation
+const (
+	// TargetSynced means the target holds the data of the current version of its source
+	TargetSynced = "Synced"
+	// TargetError means the last replication to the target failed
+	TargetError = "Error"
+	// TargetStale means the target does not receive the data of its source anymore
+	TargetStale = "Stale"
+	// TargetPending means the change of the source of the target waits for approval
+	TargetPending = "Pending"
+)
+
+// Truncates a message to fit in an annotation
+func truncateMessage(message string) string {
+	if len(message) > maxStatusErrorLength {
+		return message[:maxStatusErrorLength-3] + "..."
+	}
+	return message
+}
+
+// Sets the condition annotations of a target, if enabled
+// Returns true if the annotations were changed
+func (r *ReplicatorProps) setTargetCondition(annotations map[string]string, state string, err error) bool {
+	if !r.TargetConditions {
+		return false
+	}
+	changed := annotations[ReplicationStateAnnotation] != state
+	annotations[ReplicationStateAnnotation] = state
+	if err != nil {
+		message := truncateMessage(err.Error())
+		changed = changed || annotations[ReplicationErrorAnnotation] != message
+		annotations[ReplicationErrorAnnotation] = message
+	} else if _, ok := annotations[ReplicationErrorAnnotation]; ok {
+		delete(annotations, ReplicationErrorAnnotation)
+		changed = true
+	}
+	return changed
+}
+
+// Writes the condition annotations onto an existing target, if they changed
+// This is a best effort: a failure is only logged
+func (r *ObjectReplicator) markTarget(object interface{}, state string, err error) {
+	if !r.TargetConditions || object == nil {
+		return
+	}
+	meta := r.GetMeta(object)
+	if r.checkManagedBy(meta) != nil {
+		return
+	}
+	annotations := cloneSMap(meta.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if !r.setTargetCondition(annotations, state, err) {
+		return
+	}
+	r.logger.V(debugLevel).Info("updating condition annotations", "target", metaKey(meta), "state", state)
+	start := time.Now()
+	ctx, cancel := r.requestContext(r.ctx)
+	newObject, updateErr := r.Update(ctx, r.client, object, object, annotations)
+	cancel()
+	r.observeAction("condition", start, updateErr)
+	r.audit("condition", meta.Annotations[ReplicatedByAnnotation], metaKey(meta), newObject, updateErr)
+	if updateErr != nil {
+		r.logger.Error(updateErr, "could not update condition annotations", "target", metaKey(meta))
+		return
+	}
+	// update the object store in advance
+	if err := r.objectStore.Update(newObject); err != nil {
+		r.logger.Error(err, "could not update store", "target", metaKey(meta))
+	}
+}
@@ -0,0 +1,70 @@
+package replicate
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetConditions(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{TargetConditions: true}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	target := updateObject(r, "target-ns", "target", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(target)
+	requireActionsLength(t, r, 1)
+	assertAction(t, r, 0, &testAction{
+		Action: "update",
+		Object: testObject{
+			Type: target.Type,
+			Data: source.Data,
+			Meta: metav1.ObjectMeta{
+				Namespace:       "target-ns",
+				Name:            "target",
+				ResourceVersion: target.Meta.ResourceVersion,
+				Annotations:     M{
+					ReplicationStateAnnotation: TargetSynced,
+				},
+			},
+		},
+	})
+	assert.NotContains(t, r.ReplicatorActions.(*testActions).Actions[0].Object.Meta.Annotations, ReplicationErrorAnnotation)
+	// the source disallows replication, the target is cleared
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "false",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 2)
+	action := r.ReplicatorActions.(*testActions).Actions[1]
+	assert.Equal(t, "clear", action.Action)
+	assert.Equal(t, TargetStale, action.Object.Meta.Annotations[ReplicationStateAnnotation])
+	// the source is invalid, the target keeps its data
+	source = updateObject(r, "source-ns", "source", M{
+		ReplicationAllowedAnnotation: "invalid",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 3)
+	action = r.ReplicatorActions.(*testActions).Actions[2]
+	assert.Equal(t, "update", action.Action)
+	assert.Equal(t, TargetError, action.Object.Meta.Annotations[ReplicationStateAnnotation])
+	assert.Contains(t, action.Object.Meta.Annotations[ReplicationErrorAnnotation], "illformed annotation")
+	// the same error is not written again
+	r.ObjectAdded(getObject(r, "target-ns", "target"))
+	requireActionsLength(t, r, 3)
+}
+
+func TestTargetConditions_disabled(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-ns")
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.ObjectAdded(source)
+	requireActionsLength(t, r, 1)
+	assert.NotContains(t, r.ReplicatorActions.(*testActions).Actions[0].Object.Meta.Annotations, ReplicationStateAnnotation)
+}
@@ -0,0 +1,19 @@
+// Access of the replicatetest package to the stores of the replicators
+
+package replicate
+
+import (
+	"github.com/olli-ai/k8s-replicator/replicate/internal/testhooks"
+	"k8s.io/client-go/tools/cache"
+)
+
+func init() {
+	testhooks.FakeStores = func(replicator interface{}, keyFunc cache.KeyFunc) (cache.Indexer, cache.Store, func(object interface{})) {
+		r := replicator.(*ObjectReplicator)
+		r.objectStore = cache.NewIndexer(keyFunc, r.objectIndexers())
+		r.namespaceStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		return r.objectStore, r.namespaceStore, func(object interface{}) {
+			_, _ = r.translateResult(object, nil)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Rate limiting of the handling of each source
+
+package replicate
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// sourceLimiters keeps a token bucket per object, such that an object changing all the time
+// cannot monopolize the writes, and starve the replication of the other ones
+type sourceLimiters struct {
+	mutex    sync.Mutex
+	qps      float32
+	burst    int
+	limiters map[string]flowcontrol.RateLimiter
+}
+
+// Returns the limiters, nil if not limited
+func newSourceLimiters(qps float32, burst int) *sourceLimiters {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &sourceLimiters{
+		qps:      qps,
+		burst:    burst,
+		limiters: map[string]flowcontrol.RateLimiter{},
+	}
+}
+
+// Takes a token of the object, returns 0 if there was one,
+// or the delay after which the object should be handled again
+func (s *sourceLimiters) delay(key string) time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	limiter, ok := s.limiters[key]
+	if !ok {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(s.qps, s.burst)
+		s.limiters[key] = limiter
+	}
+	if limiter.TryAccept() {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / float64(s.qps))
+}
+
+// Forgets a deleted object
+func (s *sourceLimiters) delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.limiters, key)
+}
+
+// Returns true if the object is handled too often, then it is queued again later
+// Its changes meanwhile are coalesced, such that only its latest version is handled
+func (r *ObjectReplicator) throttled(item queueItem) bool {
+	delay := r.sourceLimiters.delay(item.key)
+	if delay <= 0 {
+		return false
+	}
+	r.logger.V(debugLevel).Info("object changes too often, handling it later", "object", item.key, "delay", delay.String())
+	r.metrics.sourcesThrottled.WithLabelValues(r.Name).Inc()
+	r.queue.AddAfter(item, delay)
+	return true
+}
@@ -0,0 +1,42 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceLimiters(t *testing.T) {
+	var nilLimiters *sourceLimiters
+	assert.Zero(t, nilLimiters.delay("source"))
+	assert.Nil(t, newSourceLimiters(0, 1))
+
+	limiters := newSourceLimiters(0.001, 2)
+	assert.Zero(t, limiters.delay("source"))
+	assert.Zero(t, limiters.delay("source"))
+	assert.NotZero(t, limiters.delay("source"))
+	// each object has its own bucket
+	assert.Zero(t, limiters.delay("other"))
+	limiters.delete("source")
+	assert.Zero(t, limiters.delay("source"))
+}
+
+func TestQueue_throttled(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{SourceQPS: 0.001, SourceBurst: 1}, "source-ns", "target-ns")
+	r.initQueue()
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation: "target-ns/target",
+	})
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 1)
+
+	updateObject(r, "source-ns", "source", nil)
+	r.enqueueObject(source)
+	require.True(t, r.processNextItem())
+	requireActionsLength(t, r, 1)
+	// queued again later
+	assert.Equal(t, 0, r.queue.Len())
+	assert.Equal(t, 0, r.Status().Parked)
+}
@@ -0,0 +1,356 @@
+// Replication of the TLS secrets of a central namespace to the namespaces of the Ingresses and Gateways using them
+
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the resource of the Gateways, served only when the Gateway API is installed
+var gatewayResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+
+// the certificates of the listeners of a Gateway
+type tlsGateway struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Listeners []struct {
+			TLS *struct {
+				CertificateRefs []struct {
+					Group     string `json:"group"`
+					Kind      string `json:"kind"`
+					Name      string `json:"name"`
+					Namespace string `json:"namespace"`
+				} `json:"certificateRefs"`
+			} `json:"tls"`
+		} `json:"listeners"`
+	} `json:"spec"`
+}
+
+// TLSReferences is the cache of the TLS secrets referenced by the Ingresses and Gateways, kept by informers
+// A TLS secret of the central namespace is replicated to each namespace referencing a secret of the same name,
+// when the secret allows it with its replication-allowed annotations, or with --allow-all
+type TLSReferences struct {
+	client    kubernetes.Interface
+	dynamic   dynamic.Interface
+	namespace string
+	// the resync period of the informers
+	interval  time.Duration
+
+	mutex     sync.RWMutex
+	// the targets referenced by each Ingress and Gateway, by kind and key
+	objects   map[string]keySet
+	// the count of the objects referencing each target, by secret of the central namespace
+	targets   map[string]map[string]int
+	// the TLS secrets of the central namespace, the other secrets are never referenced
+	secrets   keySet
+	// handle the key of a secret whose targets changed
+	handlers  []func(key string)
+	logger    logr.Logger
+}
+
+// NewTLSReferences returns the cache of the TLS references to the secrets of the namespace, resynced every interval
+func NewTLSReferences(client kubernetes.Interface, dynamicClient dynamic.Interface, namespace string, interval time.Duration, logger logr.Logger) *TLSReferences {
+	return &TLSReferences{
+		client:    client,
+		dynamic:   dynamicClient,
+		namespace: namespace,
+		interval:  interval,
+		objects:   map[string]keySet{},
+		targets:   map[string]map[string]int{},
+		secrets:   keySet{},
+		logger:    logger,
+	}
+}
+
+// Registers a handler of the secrets whose targets changed
+func (t *TLSReferences) subscribe(handler func(key string)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.handlers = append(t.handlers, handler)
+}
+
+// Adds a target referencing a secret by name, in the namespace of the referencing object
+func (t *TLSReferences) reference(targets keySet, namespace string, name string) {
+	if name == "" || namespace == t.namespace {
+		return
+	}
+	targets[fmt.Sprintf("%s/%s", namespace, name)] = true
+}
+
+// Returns the targets referenced by an Ingress
+func (t *TLSReferences) ingressTargets(ingress *networkingv1.Ingress) keySet {
+	targets := keySet{}
+	for _, tls := range ingress.Spec.TLS {
+		t.reference(targets, ingress.Namespace, tls.SecretName)
+	}
+	return targets
+}
+
+// Returns the targets referenced by a Gateway
+func (t *TLSReferences) gatewayTargets(object *unstructured.Unstructured) (keySet, error) {
+	gateway := &tlsGateway{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), gateway); err != nil {
+		return nil, fmt.Errorf("invalid Gateway %s/%s: %s", object.GetNamespace(), object.GetName(), err)
+	}
+	targets := keySet{}
+	for _, listener := range gateway.Spec.Listeners {
+		if listener.TLS == nil {
+			continue
+		}
+		for _, ref := range listener.TLS.CertificateRefs {
+			// only the secrets of the namespace of the Gateway, the others need a ReferenceGrant instead
+			if (ref.Kind == "" || ref.Kind == "Secret") && ref.Group == "" &&
+				(ref.Namespace == "" || ref.Namespace == gateway.Metadata.Namespace) {
+				t.reference(targets, gateway.Metadata.Namespace, ref.Name)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// Returns the key of the secret of the central namespace a target stands for
+func (t *TLSReferences) secretKey(target string) string {
+	_, name, _ := cache.SplitMetaNamespaceKey(target)
+	return fmt.Sprintf("%s/%s", t.namespace, name)
+}
+
+// Sets the targets referenced by an Ingress or a Gateway, none when deleted,
+// and notifies the TLS secrets whose targets changed
+func (t *TLSReferences) setReferences(object string, targets keySet) {
+	t.mutex.Lock()
+	changed := keySet{}
+	previous := t.objects[object]
+	for target := range previous {
+		if targets[target] {
+			continue
+		}
+		key := t.secretKey(target)
+		if t.targets[key][target]--; t.targets[key][target] <= 0 {
+			delete(t.targets[key], target)
+			changed[key] = true
+		}
+		if len(t.targets[key]) == 0 {
+			delete(t.targets, key)
+		}
+	}
+	for target := range targets {
+		if previous[target] {
+			continue
+		}
+		key := t.secretKey(target)
+		if t.targets[key] == nil {
+			t.targets[key] = map[string]int{}
+		}
+		if t.targets[key][target]++; t.targets[key][target] == 1 {
+			changed[key] = true
+		}
+	}
+	if len(targets) > 0 {
+		t.objects[object] = targets
+	} else {
+		delete(t.objects, object)
+	}
+	for key := range changed {
+		if !t.secrets[key] {
+			delete(changed, key)
+		}
+	}
+	handlers := t.handlers
+	t.mutex.Unlock()
+	t.notify(handlers, changed)
+}
+
+// Sets whether a secret of the central namespace is a TLS secret, and notifies it if referenced
+func (t *TLSReferences) setSecret(key string, tls bool) {
+	t.mutex.Lock()
+	changed := keySet{}
+	if t.secrets[key] != tls && len(t.targets[key]) > 0 {
+		changed[key] = true
+	}
+	if tls {
+		t.secrets[key] = true
+	} else {
+		delete(t.secrets, key)
+	}
+	handlers := t.handlers
+	t.mutex.Unlock()
+	t.notify(handlers, changed)
+}
+
+// Notifies the handlers of the secrets whose targets changed, without the mutex held
+func (t *TLSReferences) notify(handlers []func(key string), changed keySet) {
+	for _, key := range changed.sorted() {
+		for _, handler := range handlers {
+			handler(key)
+		}
+	}
+}
+
+// Returns the event handler of an informer, calling update with the object, or with nil once deleted
+func tlsEventHandler(update func(key string, object interface{})) cache.ResourceEventHandler {
+	handle := func(object interface{}) {
+		if key, err := cache.MetaNamespaceKeyFunc(object); err == nil {
+			update(key, object)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    handle,
+		UpdateFunc: func(old interface{}, new interface{}) {
+			handle(new)
+		},
+		DeleteFunc: func(object interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(object); err == nil {
+				update(key, nil)
+			}
+		},
+	}
+}
+
+// Returns true if the Gateways are served by the cluster
+func (t *TLSReferences) gatewaysServed() (bool, error) {
+	resources, err := t.client.Discovery().ServerResourcesForGroupVersion(gatewayResource.GroupVersion().String())
+	if errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == gatewayResource.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the informers of the TLS secrets of the central namespace, of the Ingresses, and of the Gateways when served
+// The informers list their resources by pages, then watch them
+func (t *TLSReferences) informers(ctx context.Context) ([]cache.SharedIndexInformer, error) {
+	secrets := t.client.CoreV1().Secrets(t.namespace)
+	tlsSelector := fields.OneTermEqualSelector("type", string(v1.SecretTypeTLS)).String()
+	secretInformer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			lo.FieldSelector = tlsSelector
+			return secrets.List(ctx, lo)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			lo.FieldSelector = tlsSelector
+			return secrets.Watch(ctx, lo)
+		},
+	}, &v1.Secret{}, t.interval, cache.Indexers{})
+	secretInformer.AddEventHandler(tlsEventHandler(func(key string, object interface{}) {
+		t.setSecret(key, object != nil)
+	}))
+
+	ingresses := t.client.NetworkingV1().Ingresses(metav1.NamespaceAll)
+	ingressInformer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			return ingresses.List(ctx, lo)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return ingresses.Watch(ctx, lo)
+		},
+	}, &networkingv1.Ingress{}, t.interval, cache.Indexers{})
+	ingressInformer.AddEventHandler(tlsEventHandler(func(key string, object interface{}) {
+		targets := keySet{}
+		if ingress, ok := object.(*networkingv1.Ingress); ok {
+			targets = t.ingressTargets(ingress)
+		}
+		t.setReferences("Ingress/"+key, targets)
+	}))
+	informers := []cache.SharedIndexInformer{secretInformer, ingressInformer}
+
+	if served, err := t.gatewaysServed(); err != nil {
+		return nil, fmt.Errorf("could not discover the Gateways: %s", err)
+	} else if !served {
+		t.logger.Info("the Gateways are not served, only the Ingresses reference TLS secrets")
+		return informers, nil
+	}
+	gateways := t.dynamic.Resource(gatewayResource).Namespace(metav1.NamespaceAll)
+	gatewayInformer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			return gateways.List(ctx, lo)
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return gateways.Watch(ctx, lo)
+		},
+	}, &unstructured.Unstructured{}, t.interval, cache.Indexers{})
+	gatewayInformer.AddEventHandler(tlsEventHandler(func(key string, object interface{}) {
+		targets := keySet{}
+		if gateway, ok := object.(*unstructured.Unstructured); ok {
+			var err error
+			if targets, err = t.gatewayTargets(gateway); err != nil {
+				t.logger.Error(err, "could not read TLS references")
+				targets = keySet{}
+			}
+		}
+		t.setReferences("Gateway/"+key, targets)
+	}))
+	return append(informers, gatewayInformer), nil
+}
+
+// Run watches the TLS secrets of the central namespace, the Ingresses and the Gateways, until stopped
+func (t *TLSReferences) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	var informers []cache.SharedIndexInformer
+	// retried until the Gateways are discovered, or known not to be served
+	for {
+		var err error
+		if informers, err = t.informers(ctx); err == nil {
+			break
+		}
+		t.logger.Error(err, "could not watch TLS references")
+		select {
+		case <-stop:
+			return
+		case <-time.After(t.interval):
+		}
+	}
+	for _, informer := range informers {
+		go informer.Run(stop)
+	}
+	<-stop
+}
+
+// Returns the targets referencing the secret, sorted, none unless a TLS secret
+func (t *TLSReferences) referencing(key string) []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if !t.secrets[key] {
+		return nil
+	}
+	targets := make(keySet, len(t.targets[key]))
+	for target := range t.targets[key] {
+		targets[target] = true
+	}
+	return targets.sorted()
+}
+
+// Queues a secret whose referencing targets changed, to replicate it again
+// A secret not stored yet is handled once added, with its targets at that time
+func (r *ObjectReplicator) tlsReferencesChanged(key string) {
+	if _, exists, err := r.currentObjectStore().GetByKey(key); err == nil && exists {
+		r.enqueue(queueItem{key: key})
+	}
+}
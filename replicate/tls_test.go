@@ -0,0 +1,184 @@
+package replicate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// Returns an Ingress of the namespace, referencing the TLS secrets
+func tlsIngress(namespace string, name string, secretNames ...string) *networkingv1.Ingress {
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+	for _, secretName := range secretNames {
+		ingress.Spec.TLS = append(ingress.Spec.TLS, networkingv1.IngressTLS{SecretName: secretName})
+	}
+	return ingress
+}
+
+// Returns a Gateway of the namespace, with the certificate references of its listeners
+func tlsGatewayObject(namespace string, name string, listeners ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "Gateway",
+		"metadata": map[string]interface{}{
+			"namespace": namespace,
+			"name":      name,
+		},
+		"spec": map[string]interface{}{
+			"listeners": listeners,
+		},
+	}}
+}
+
+func TestTLSReferences_references(t *testing.T) {
+	references := NewTLSReferences(nil, nil, "certs", time.Minute, logr.Discard())
+	notified := []string{}
+	references.subscribe(func(key string) {
+		notified = append(notified, key)
+	})
+
+	assert.Equal(t, newKeySet("app-1/wildcard", "app-1/api"),
+		references.ingressTargets(tlsIngress("app-1", "web", "wildcard", "api")))
+	assert.Empty(t, references.ingressTargets(tlsIngress("app-2", "web")))
+	assert.Empty(t, references.ingressTargets(tlsIngress("certs", "web", "wildcard")), "the central namespace")
+	gatewayTargets, err := references.gatewayTargets(tlsGatewayObject("app-3", "gateway",
+		map[string]interface{}{"name": "http", "port": int64(80)},
+		map[string]interface{}{"name": "https", "port": int64(443), "tls": map[string]interface{}{
+			"certificateRefs": []interface{}{
+				map[string]interface{}{"name": "wildcard"},
+				map[string]interface{}{"kind": "Secret", "group": "", "namespace": "app-3", "name": "api"},
+				map[string]interface{}{"kind": "Secret", "namespace": "other", "name": "other"},
+				map[string]interface{}{"kind": "Certificate", "group": "example.com", "name": "custom"},
+			},
+		}},
+	))
+	require.NoError(t, err)
+	assert.Equal(t, newKeySet("app-3/wildcard", "app-3/api"), gatewayTargets)
+	_, err = references.gatewayTargets(tlsGatewayObject("app-3", "invalid", "listener"))
+	assert.Error(t, err)
+
+	// the TLS secrets only
+	references.setReferences("Ingress/app-1/web", newKeySet("app-1/wildcard", "app-1/api"))
+	references.setReferences("Gateway/app-3/gateway", gatewayTargets)
+	assert.Empty(t, notified, "not TLS secrets yet")
+	assert.Empty(t, references.referencing("certs/wildcard"))
+	references.setSecret("certs/wildcard", true)
+	references.setSecret("certs/api", true)
+	references.setSecret("certs/unreferenced", true)
+	assert.Equal(t, []string{"certs/wildcard", "certs/api"}, notified)
+	assert.Equal(t, []string{"app-1/wildcard", "app-3/wildcard"}, references.referencing("certs/wildcard"))
+	assert.Equal(t, []string{"app-1/api", "app-3/api"}, references.referencing("certs/api"))
+	assert.Empty(t, references.referencing("certs/unreferenced"))
+
+	// only the changed ones
+	notified = nil
+	references.setReferences("Ingress/app-1/other", newKeySet("app-1/wildcard"))
+	assert.Empty(t, notified, "already referenced by another Ingress")
+	references.setReferences("Ingress/app-1/web", newKeySet("app-1/wildcard"))
+	assert.Equal(t, []string{"certs/api"}, notified)
+	assert.Equal(t, []string{"app-3/api"}, references.referencing("certs/api"))
+	notified = nil
+	references.setReferences("Ingress/app-1/other", nil)
+	references.setReferences("Ingress/app-1/web", nil)
+	assert.Equal(t, []string{"certs/wildcard"}, notified)
+	assert.Equal(t, []string{"app-3/wildcard"}, references.referencing("certs/wildcard"))
+
+	// deleted secret
+	notified = nil
+	references.setSecret("certs/api", false)
+	assert.Equal(t, []string{"certs/api"}, notified)
+	assert.Empty(t, references.referencing("certs/api"))
+}
+
+func TestTLSReferences_run(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		tlsIngress("app-1", "web", "wildcard", "missing"),
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "certs", Name: "wildcard"},
+			Type:       v1.SecretTypeTLS,
+		},
+	)
+	client.Fake.Resources = []*metav1.APIResourceList{{
+		GroupVersion: gatewayResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: gatewayResource.Resource, Namespaced: true, Kind: "Gateway"}},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gatewayResource: "GatewayList"})
+	_, err := dynamicClient.Resource(gatewayResource).Namespace("app-2").Create(context.TODO(),
+		tlsGatewayObject("app-2", "gateway", map[string]interface{}{"name": "https", "tls": map[string]interface{}{
+			"certificateRefs": []interface{}{map[string]interface{}{"name": "wildcard"}},
+		}}), metav1.CreateOptions{})
+	require.NoError(t, err)
+	references := NewTLSReferences(client, dynamicClient, "certs", time.Hour, logr.Discard())
+	stop := make(chan struct{})
+	defer close(stop)
+	go references.Run(stop)
+
+	require.Eventually(t, func() bool {
+		return len(references.referencing("certs/wildcard")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"app-1/wildcard", "app-2/wildcard"}, references.referencing("certs/wildcard"))
+	assert.Empty(t, references.referencing("certs/missing"))
+	// only the TLS secrets are listed
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "secrets" && action.GetVerb() == "list" {
+			assert.Equal(t, "type=kubernetes.io/tls", action.(clienttesting.ListAction).GetListRestrictions().Fields.String())
+		}
+	}
+}
+
+func TestTLSReferences_replication(t *testing.T) {
+	references := NewTLSReferences(nil, nil, "certs", time.Minute, logr.Discard())
+	references.setSecret("certs/wildcard", true)
+	references.setReferences("Ingress/app-1/web", newKeySet("app-1/wildcard"))
+	references.setReferences("Ingress/app-2/web", newKeySet("app-2/wildcard"))
+	references.setReferences("Ingress/other/web", newKeySet("other/wildcard"))
+	r := createTestReplicator(t, ReplicatorOptions{}, "certs", "app-1", "app-2", "app-3", "other")
+	r.tlsReferences = references
+
+	// not allowed
+	source := updateObject(r, "certs", "wildcard", M{})
+	r.ObjectAdded(source)
+	assert.Empty(t, r.targetsTo("certs/wildcard"))
+	assert.Nil(t, getObject(r, "app-1", "wildcard"))
+
+	source = updateObject(r, "certs", "wildcard", M{ReplicationAllowedNsAnnotation: "app-.*"})
+	other := updateObject(r, "app-3", "wildcard", M{})
+	r.ObjectAdded(source)
+	assert.Equal(t, []string{"app-1/wildcard", "app-2/wildcard"}, r.targetsTo("certs/wildcard").sorted())
+	require.NotNil(t, getObject(r, "app-1", "wildcard"))
+	assert.Equal(t, "certs/wildcard", getObject(r, "app-1", "wildcard").Meta.Annotations[ReplicatedByAnnotation])
+	require.NotNil(t, getObject(r, "app-2", "wildcard"))
+	assert.Equal(t, other, getObject(r, "app-3", "wildcard"), "not referenced")
+	assert.Nil(t, getObject(r, "other", "wildcard"), "not allowed")
+
+	// not referenced anymore
+	references.setReferences("Ingress/app-2/web", nil)
+	r.ObjectAdded(source)
+	assert.Equal(t, []string{"app-1/wildcard"}, r.targetsTo("certs/wildcard").sorted())
+	assert.NotNil(t, getObject(r, "app-1", "wildcard"))
+	assert.Nil(t, getObject(r, "app-2", "wildcard"))
+
+	// the other secrets are not replicated
+	unreferenced := updateObject(r, "certs", "unreferenced", M{ReplicationAllowedAnnotation: "true"})
+	r.ObjectAdded(unreferenced)
+	assert.Empty(t, r.targetsTo("certs/unreferenced"))
+}
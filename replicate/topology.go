@@ -0,0 +1,139 @@
+// Read-only view of the replication topology, as known by the replicators
+
+package replicate
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SourceTopology describes the targets of a source
+type SourceTopology struct {
+	Source          string     `json:"source"`
+	// the targets replicating from this source, using the replicate-from annotation
+	TargetsFrom     []string   `json:"targetsFrom,omitempty"`
+	// the targets this source is replicated to, using the replicate-to annotations
+	TargetsTo       []string   `json:"targetsTo,omitempty"`
+	// the targets this source wants to replicate to, existing or not
+	WatchedTargets  []string   `json:"watchedTargets,omitempty"`
+	// the "namespace_pattern/name" patterns this source wants to replicate to
+	WatchedPatterns []string   `json:"watchedPatterns,omitempty"`
+	// when this source was last synced to all its targets, if ever
+	LastSync        *time.Time `json:"lastSync,omitempty"`
+}
+
+// Topology describes all the sources of a replicator
+type Topology struct {
+	Resource string           `json:"resource"`
+	Sources  []SourceTopology `json:"sources"`
+}
+
+// TopologyReplicator is implemented by the replicators exposing their topology
+type TopologyReplicator interface {
+	Topology() Topology
+}
+
+// Returns the pattern as written in the annotations
+func (pattern targetPattern) String() string {
+	namespace := strings.TrimSuffix(strings.TrimPrefix(pattern.namespace.String(), "^(?:"), ")$")
+	return namespace + "/" + pattern.name
+}
+
+// Returns a sorted copy of the slice, without duplicates
+func sortedUnique(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	unique := sorted[:1]
+	for _, value := range sorted[1:] {
+		if value != unique[len(unique)-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// Topology returns a snapshot of the sources and their targets
+func (r *ObjectReplicator) Topology() Topology {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sources := map[string]*SourceTopology{}
+	get := func(key string) *SourceTopology {
+		if source, ok := sources[key]; ok {
+			return source
+		}
+		source := &SourceTopology{Source: key}
+		if synced, ok := r.lastSyncs.Get(key); ok {
+			source.LastSync = &synced
+		}
+		sources[key] = source
+		return source
+	}
+	for key, targets := range r.indexedSources(replicateFromIndex) {
+		get(key).TargetsFrom = targets.sorted()
+	}
+	for key, targets := range r.indexedSources(replicatedByIndex) {
+		get(key).TargetsTo = targets.sorted()
+	}
+	for key, targets := range r.watchedTargets {
+		get(key).WatchedTargets = targets.sorted()
+	}
+	for key, patterns := range r.watchedPatterns {
+		values := make([]string, 0, len(patterns))
+		for _, pattern := range patterns {
+			values = append(values, pattern.String())
+		}
+		get(key).WatchedPatterns = sortedUnique(values)
+	}
+
+	topology := Topology{
+		Resource: r.Name,
+		Sources:  make([]SourceTopology, 0, len(sources)),
+	}
+	for _, source := range sources {
+		topology.Sources = append(topology.Sources, *source)
+	}
+	sort.Slice(topology.Sources, func(i, j int) bool {
+		return topology.Sources[i].Source < topology.Sources[j].Source
+	})
+	return topology
+}
+
+// TopologyHandler serves the topology of the replicators as JSON
+// The "resource" query parameter filters on a resource, case-insensitive
+type TopologyHandler struct {
+	Replicators []Replicator
+}
+
+func (h *TopologyHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Set("Allow", http.MethodGet)
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resource := strings.ToLower(req.URL.Query().Get("resource"))
+	topologies := []Topology{}
+	for _, replicator := range h.Replicators {
+		if r, ok := replicator.(TopologyReplicator); ok {
+			topology := r.Topology()
+			if resource == "" || resource == strings.ToLower(topology.Resource) {
+				topologies = append(topologies, topology)
+			}
+		}
+	}
+	sort.Slice(topologies, func(i, j int) bool {
+		return topologies[i].Resource < topologies[j].Resource
+	})
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+	_ = enc.Encode(topologies)
+}
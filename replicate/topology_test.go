@@ -0,0 +1,88 @@
+package replicate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopology(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns", "target-1", "target-2")
+
+	source := updateObject(r, "source-ns", "source", M{
+		ReplicateToAnnotation:        "target-[0-9]/copy,other-ns/copy",
+		ReplicationAllowedAnnotation: "true",
+	})
+	r.ObjectAdded(source)
+	from := updateObject(r, "target-1", "from", M{
+		ReplicateFromAnnotation: "source-ns/source",
+	})
+	r.ObjectAdded(from)
+
+	topology := r.Topology()
+	assert.Equal(t, "test", topology.Resource)
+	require.Len(t, topology.Sources, 1)
+	sourceTopology := topology.Sources[0]
+	assert.Equal(t, "source-ns/source", sourceTopology.Source)
+	assert.Equal(t, []string{"target-1/from"}, sourceTopology.TargetsFrom)
+	assert.Equal(t, []string{"target-1/copy", "target-2/copy"}, sourceTopology.TargetsTo)
+	assert.Equal(t, []string{"other-ns/copy"}, sourceTopology.WatchedTargets)
+	assert.Equal(t, []string{"target-[0-9]/copy"}, sourceTopology.WatchedPatterns)
+	assert.NotNil(t, sourceTopology.LastSync, "synced")
+
+	handler := &TopologyHandler{Replicators: []Replicator{r}}
+	for query, count := range map[string]int{"": 1, "?resource=Test": 1, "?resource=secret": 0} {
+		req, err := http.NewRequest("GET", "/topology"+query, nil)
+		require.NoError(t, err)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code, query)
+		topologies := []Topology{}
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &topologies), query)
+		assert.Len(t, topologies, count, query)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	graph := NewGraph([]Topology{{
+		Resource: "secret",
+		Sources: []SourceTopology{{
+			Source:          "source-ns/source",
+			TargetsFrom:     []string{"target-1/from"},
+			TargetsTo:       []string{"target-1/copy"},
+			WatchedPatterns: []string{"target-[0-9]/copy"},
+		}},
+	}})
+	assert.Equal(t, []GraphNode{
+		{ID: "secret:source-ns/source", Resource: "secret", Name: "source-ns/source"},
+		{ID: "secret:target-1/copy", Resource: "secret", Name: "target-1/copy"},
+		{ID: "secret:target-1/from", Resource: "secret", Name: "target-1/from"},
+		{ID: "secret:target-[0-9]/copy", Resource: "secret", Name: "target-[0-9]/copy", Pattern: true},
+	}, graph.Nodes)
+	assert.Equal(t, []GraphEdge{
+		{Source: "secret:source-ns/source", Target: "secret:target-1/copy", Kind: EdgeTo},
+		{Source: "secret:source-ns/source", Target: "secret:target-1/from", Kind: EdgeFrom},
+		{Source: "secret:source-ns/source", Target: "secret:target-[0-9]/copy", Kind: EdgePattern},
+	}, graph.Edges)
+
+	dot := &strings.Builder{}
+	require.NoError(t, graph.WriteDot(dot))
+	assert.Contains(t, dot.String(), `"secret:target-[0-9]/copy" [label="secret:target-[0-9]/copy", shape=box];`)
+	assert.Contains(t, dot.String(), `"secret:source-ns/source" -> "secret:target-1/from" [label="from", style=solid];`)
+	assert.Contains(t, dot.String(), `"secret:source-ns/source" -> "secret:target-[0-9]/copy" [label="pattern", style=dashed];`)
+
+	r := createTestReplicator(t, ReplicatorOptions{}, "source-ns")
+	handler := &GraphHandler{Replicators: []Replicator{r}}
+	for query, code := range map[string]int{"": http.StatusOK, "?format=dot": http.StatusOK, "?format=xml": http.StatusBadRequest} {
+		req, err := http.NewRequest("GET", "/graph"+query, nil)
+		require.NoError(t, err)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, code, res.Code, query)
+	}
+}
@@ -0,0 +1,78 @@
+// Stripping of the fields the replication does not need, before they are stored
+
+package replicate
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Returns a list watcher transforming all the listed and watched objects, in place
+func transformListWatch(lw cache.ListerWatcher, transform func(runtime.Object)) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			list, err := lw.List(lo)
+			if err != nil {
+				return list, err
+			}
+			err = meta.EachListItem(list, func(object runtime.Object) error {
+				transform(object)
+				return nil
+			})
+			return list, err
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.Watch(lo)
+			if err != nil {
+				return w, err
+			}
+			return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+				if event.Type != watch.Error {
+					transform(event.Object)
+				}
+				return event, true
+			}), nil
+		},
+	}
+}
+
+// Removes the managed fields of an object, and its last applied configuration if asked
+// The managed fields are kept by the API server on update when they are missing
+func stripObject(object runtime.Object, lastApplied bool) {
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return
+	}
+	accessor.SetManagedFields(nil)
+	if !lastApplied {
+		return
+	}
+	if annotations := accessor.GetAnnotations(); annotations != nil {
+		if _, ok := annotations[v1.LastAppliedConfigAnnotation]; ok {
+			delete(annotations, v1.LastAppliedConfigAnnotation)
+			accessor.SetAnnotations(annotations)
+		}
+	}
+}
+
+// Strips the objects before they are stored, and translates their compatibility annotations
+// The last applied configuration is only stripped from the targets created by replication,
+// the writes of the annotations of the sources would otherwise remove it from them
+func (r *ReplicatorProps) stripObject(object runtime.Object) {
+	r.prefixes.translateObject(object)
+	stripObject(object, r.StripLastApplied && isReplicatedTarget(object))
+}
+
+// Returns true if the translated object is a target created by replication
+func isReplicatedTarget(object runtime.Object) bool {
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return false
+	}
+	_, ok := accessor.GetAnnotations()[ReplicatedByAnnotation]
+	return ok
+}
@@ -0,0 +1,79 @@
+package replicate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Returns a configMap with managed fields and a last applied configuration
+func appliedConfigMap(name string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "source-ns",
+			Name:      name,
+			Annotations: M{
+				v1.LastAppliedConfigAnnotation: "{}",
+				ReplicateToAnnotation:          "target-ns",
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+	}
+}
+
+func TestTransformListWatch(t *testing.T) {
+	watcher := watch.NewFake()
+	lw := transformListWatch(&cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			return &v1.ConfigMapList{
+				Items: []v1.ConfigMap{*appliedConfigMap("listed")},
+			}, nil
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	}, func(object runtime.Object) {
+		stripObject(object, false)
+	})
+
+	list, err := lw.List(metav1.ListOptions{})
+	require.NoError(t, err)
+	listed := list.(*v1.ConfigMapList).Items[0]
+	assert.Nil(t, listed.ManagedFields)
+	assert.Contains(t, listed.Annotations, v1.LastAppliedConfigAnnotation)
+
+	w, err := lw.Watch(metav1.ListOptions{})
+	require.NoError(t, err)
+	go watcher.Add(appliedConfigMap("watched"))
+	event := <-w.ResultChan()
+	assert.Nil(t, event.Object.(*v1.ConfigMap).ManagedFields)
+	w.Stop()
+}
+
+func TestStripObject_lastApplied(t *testing.T) {
+	configMap := appliedConfigMap("source")
+	stripObject(configMap, true)
+	assert.Nil(t, configMap.ManagedFields)
+	assert.Equal(t, M{ReplicateToAnnotation: "target-ns"}, configMap.Annotations)
+}
+
+func TestReplicatorStripObject(t *testing.T) {
+	r := createTestReplicator(t, ReplicatorOptions{StripLastApplied: true})
+
+	// the sources keep their last applied configuration
+	source := appliedConfigMap("source")
+	r.stripObject(source)
+	assert.Nil(t, source.ManagedFields)
+	assert.Contains(t, source.Annotations, v1.LastAppliedConfigAnnotation)
+
+	target := appliedConfigMap("target")
+	target.Annotations = M{v1.LastAppliedConfigAnnotation: "{}", ReplicatedByAnnotation: "source-ns/source"}
+	r.stripObject(target)
+	assert.Equal(t, M{ReplicatedByAnnotation: "source-ns/source"}, target.Annotations)
+}
@@ -11,10 +11,6 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-func init() {
-	PrefixAnnotations("test-prefix")
-}
-
 type M = map[string]string
 type MB = map[string][]byte
 
@@ -43,10 +39,10 @@ func createReplicator(actions ReplicatorActions, namespaces ...string) (*Replica
 	client := fake.NewSimpleClientset(objects...)
 	watcher := &actionsWatcher{}
 	client.PrependReactor("*", "*", watcher.react)
-	store := cache.NewStore(func(object interface{}) (string, error) {
+	store := cache.NewIndexer(func(object interface{}) (string, error) {
 		meta := actions.GetMeta(object)
 		return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name), nil
-	})
+	}, cache.Indexers{})
 	return &ReplicatorProps{
 		client: client,
 		objectStore: store,
@@ -0,0 +1,119 @@
+// HashiCorp Vault exporter of the sources
+
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// the token of the service account, for the kubernetes auth method of Vault
+const serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultExporter writes the sources to the secrets engines of Vault
+// The token is obtained with the kubernetes auth method when a role is set, else read from VAULT_TOKEN
+type VaultExporter struct {
+	address   string
+	role      string
+	// the token of the service account, replaced in tests
+	tokenFile string
+	client    *http.Client
+	// reads the environment, replaced in tests
+	getenv    func(string) string
+	token     *bearerToken
+}
+
+// NewVaultExporter returns the exporter to the Vault at the address, logging in with the kubernetes role if any
+func NewVaultExporter(address string, role string) (*VaultExporter, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Vault address is required")
+	}
+	exporter := &VaultExporter{
+		address:   strings.TrimSuffix(address, "/") + "/v1/",
+		role:      role,
+		tokenFile: serviceAccountTokenFile,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		getenv:    os.Getenv,
+	}
+	exporter.token = &bearerToken{fetch: exporter.fetchToken}
+	return exporter, nil
+}
+
+// Export writes the data of the source at the path, as strings
+// The data is wrapped for the version 2 of the KV engine, whose paths have "/data/"
+func (e *VaultExporter) Export(ctx context.Context, path string, source *ExportedSource) error {
+	data := make(map[string]string, len(source.Data))
+	for key, value := range source.Data {
+		data[key] = string(value)
+	}
+	var payload interface{} = data
+	if strings.Contains(path, "/data/") {
+		payload = map[string]interface{}{"data": data}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	token, err := e.token.get()
+	if err != nil {
+		return fmt.Errorf("could not get Vault token: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.address+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", token)
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("POST %s failed with status %d: %s", req.URL.Path, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Logs in with the token of the service account when a role is set, else returns the token of VAULT_TOKEN
+func (e *VaultExporter) fetchToken() (string, time.Duration, error) {
+	if e.role == "" {
+		token := e.getenv("VAULT_TOKEN")
+		if token == "" {
+			return "", 0, fmt.Errorf("no Vault credentials: expected a role or VAULT_TOKEN")
+		}
+		// read again from the environment once in a while
+		return token, time.Hour, nil
+	}
+	jwt, err := ioutil.ReadFile(e.tokenFile)
+	if err != nil {
+		return "", 0, err
+	}
+	body, err := json.Marshal(map[string]string{"role": e.role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.address+"auth/kubernetes/login", bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := doExternalRequest(e.client, req, &response); err != nil {
+		return "", 0, err
+	}
+	return response.Auth.ClientToken, time.Duration(response.Auth.LeaseDuration) * time.Second, nil
+}
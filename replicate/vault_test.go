@@ -0,0 +1,68 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultExporter(t *testing.T) {
+	logins := 0
+	written := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1/auth/kubernetes/login" {
+			var login map[string]string
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&login))
+			assert.Equal(t, map[string]string{"role": "replicator", "jwt": "jwt"}, login)
+			logins++
+			_, _ = res.Write([]byte(`{"auth":{"client_token":"token","lease_duration":3600}}`))
+			return
+		}
+		assert.Equal(t, "token", req.Header.Get("X-Vault-Token"))
+		var body interface{}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		written[req.URL.Path] = body
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "vault")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("jwt\n"), 0600))
+	exporter, err := NewVaultExporter(server.URL, "replicator")
+	require.NoError(t, err)
+	exporter.tokenFile = tokenFile
+	source := &ExportedSource{Data: map[string][]byte{"password": []byte("secret")}}
+
+	require.NoError(t, exporter.Export(context.TODO(), "secret/data/dr/database", source))
+	require.NoError(t, exporter.Export(context.TODO(), "kv/dr/database", source))
+	assert.Equal(t, map[string]interface{}{
+		"/v1/secret/data/dr/database": map[string]interface{}{"data": map[string]interface{}{"password": "secret"}},
+		"/v1/kv/dr/database":          map[string]interface{}{"password": "secret"},
+	}, written)
+	assert.Equal(t, 1, logins)
+
+	_, err = NewVaultExporter("", "")
+	assert.Error(t, err)
+}
+
+func TestVaultExporter_token(t *testing.T) {
+	exporter, err := NewVaultExporter("http://127.0.0.1:1", "")
+	require.NoError(t, err)
+	exporter.getenv = func(string) string { return "" }
+	assert.Error(t, exporter.Export(context.TODO(), "secret/data/a", &ExportedSource{}), "no token")
+
+	exporter.getenv = func(string) string { return "static" }
+	token, err := exporter.token.get()
+	require.NoError(t, err)
+	assert.Equal(t, "static", token)
+}
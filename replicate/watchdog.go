@@ -0,0 +1,238 @@
+// Detection of stalled informers
+
+package replicate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// the delay before reconnecting after a failure, doubled on each consecutive failure
+	watchRetryBaseDelay = time.Second
+	watchRetryMaxDelay  = time.Minute
+	// consecutive failures after which each failure is logged as an error
+	watchFailuresThreshold = 3
+)
+
+// informerActivity tracks when an informer last received anything from kubernetes
+// Watches are restarted every few minutes, so a long silence means a stalled informer
+type informerActivity struct {
+	mutex   sync.Mutex
+	name    string
+	last    time.Time
+	running bool
+	stopped bool
+	// incremented on each run, such that a replaced controller stopping is ignored
+	runs    int
+	// how many lists succeeded, the next ones are relists
+	lists    int
+	// consecutive failures of the lists and watches
+	failures int
+	now      func() time.Time
+	sleep    func(time.Duration)
+	metrics  *replicatorMetrics
+	logger   logr.Logger
+}
+
+func newInformerActivity(name string, metrics *replicatorMetrics, logger logr.Logger) *informerActivity {
+	return &informerActivity{
+		name:    name,
+		now:     time.Now,
+		sleep:   time.Sleep,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Records an activity
+func (a *informerActivity) touch() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.last = a.now()
+}
+
+// Returns a list watcher recording the lists, watches, and watch events
+// It also records the failures, and backs off the reconnections after them
+func (a *informerActivity) wrap(lw cache.ListerWatcher) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(lo metav1.ListOptions) (runtime.Object, error) {
+			a.backoff()
+			object, err := lw.List(lo)
+			if err != nil {
+				a.failed("list", err)
+				return object, err
+			}
+			a.listed()
+			return object, err
+		},
+		WatchFunc: func(lo metav1.ListOptions) (watch.Interface, error) {
+			a.backoff()
+			w, err := lw.Watch(lo)
+			if err != nil {
+				a.failed("watch", err)
+				return w, err
+			}
+			a.touch()
+			return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+				a.touch()
+				if event.Type != watch.Error {
+					a.succeeded()
+				// the resource version is too old, the informer relists
+				} else if err := errors.FromObject(event.Object); errors.IsGone(err) || errors.IsResourceExpired(err) {
+					a.metrics.watchErrors.WithLabelValues(a.name, "expired").Inc()
+					a.logger.Info("watch expired, relisting", "informer", a.name, "reason", err)
+				} else {
+					a.failed("watch", err)
+				}
+				return event, true
+			}), nil
+		},
+	}
+}
+
+// Records a successful list
+func (a *informerActivity) listed() {
+	a.mutex.Lock()
+	a.lists++
+	relist := a.lists > 1
+	a.mutex.Unlock()
+	if relist {
+		a.metrics.relists.WithLabelValues(a.name).Inc()
+	}
+	a.touch()
+	a.succeeded()
+}
+
+// Records a success, resetting the backoff
+func (a *informerActivity) succeeded() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.failures >= watchFailuresThreshold {
+		a.logger.Info("informer recovered", "informer", a.name, "failures", a.failures)
+	}
+	a.failures = 0
+}
+
+// Records a failed list or watch
+func (a *informerActivity) failed(reason string, err error) {
+	a.metrics.watchErrors.WithLabelValues(a.name, reason).Inc()
+	a.mutex.Lock()
+	a.failures++
+	failures := a.failures
+	a.mutex.Unlock()
+	if failures >= watchFailuresThreshold {
+		a.logger.Error(err, "informer keeps failing", "informer", a.name, "reason", reason, "failures", failures)
+	} else {
+		a.logger.Info("informer failed, retrying", "informer", a.name, "reason", reason, "error", err.Error())
+	}
+}
+
+// Waits before reconnecting after consecutive failures
+func (a *informerActivity) backoff() {
+	if delay := a.backoffDelay(); delay > 0 {
+		a.sleep(delay)
+	}
+}
+
+// Returns the delay before the next reconnection
+func (a *informerActivity) backoffDelay() time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.failures == 0 {
+		return 0
+	}
+	delay := watchRetryBaseDelay
+	for i := 1; i < a.failures && delay < watchRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > watchRetryMaxDelay {
+		delay = watchRetryMaxDelay
+	}
+	return delay
+}
+
+// Runs the controller, recording when it stops
+// Running a new controller replaces the previous one, with a fresh activity
+func (a *informerActivity) run(controller cache.Controller, stop <-chan struct{}) {
+	a.mutex.Lock()
+	a.running = true
+	a.stopped = false
+	a.failures = 0
+	a.runs++
+	run := a.runs
+	a.last = a.now()
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		if a.runs == run {
+			a.stopped = true
+		}
+		a.mutex.Unlock()
+	}()
+	controller.Run(stop)
+}
+
+// Returns an error if the informer stopped, or was silent for longer than the threshold
+func (a *informerActivity) stalled(threshold time.Duration) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.running {
+		return nil
+	} else if a.stopped {
+		return fmt.Errorf("%s informer stopped", a.name)
+	} else if silence := a.now().Sub(a.last); threshold > 0 && silence > threshold {
+		return fmt.Errorf("%s informer silent for %s", a.name, silence.Round(time.Second))
+	}
+	return nil
+}
+
+// Returns an error if the informer stopped, keeps failing, or was silent for longer than the threshold,
+// then its store may be outdated
+func (a *informerActivity) degraded(threshold time.Duration) error {
+	if a == nil {
+		return nil
+	}
+	if err := a.stalled(threshold); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.running && a.failures >= watchFailuresThreshold {
+		return fmt.Errorf("%s informer failed %d times in a row", a.name, a.failures)
+	}
+	return nil
+}
+
+// Healthy returns an error if the replicator is stopped, is not synced, or an informer keeps failing
+func (r *ObjectReplicator) Healthy() error {
+	if r.stopped() {
+		return fmt.Errorf("%s replicator stopped", r.Name)
+	} else if !r.Synced() {
+		return fmt.Errorf("%s replicator not synced", r.Name)
+	}
+	for _, activity := range []*informerActivity{r.namespaceActivity, r.objectActivity} {
+		if activity == nil {
+		} else if err := activity.dead(watchFailuresThreshold); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stalled returns an error if an informer stopped, or received nothing for longer than the threshold
+// A threshold of 0 only checks for stopped informers
+func (r *ObjectReplicator) Stalled(threshold time.Duration) error {
+	if err := r.namespaceActivity.stalled(threshold); err != nil {
+		return err
+	}
+	return r.objectActivity.stalled(threshold)
+}
@@ -0,0 +1,127 @@
+// Parallel syncs of the targets of a source, by priority of their namespaces
+
+package replicate
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ParseNamespacePriorities parses the label selectors of the namespaces synced first, separated by ";"
+// such as "tier=critical;tier in (high,medium)"
+func ParseNamespacePriorities(value string) ([]labels.Selector, error) {
+	priorities := []labels.Selector{}
+	for _, s := range strings.Split(value, ";") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		selector, err := labels.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %s: %s", s, err)
+		}
+		priorities = append(priorities, selector)
+	}
+	return priorities, nil
+}
+
+// Syncs the targets by priority of their namespaces, all the targets of a priority before the ones of the next
+// The results are added to the given result
+// The mutex must be held, the handlers synced concurrently are serialized by the sync lock, see syncPrioritized
+func (r *ObjectReplicator) syncTargets(result *syncResult, targets []string, handle func(target string) error) {
+	for _, prioritized := range r.prioritizeTargets(targets) {
+		r.syncPrioritized(result, prioritized, handle)
+	}
+}
+
+// Splits the targets by priority of their namespaces, the first matching selector, the others last
+// The order of the targets is kept within a priority
+func (r *ObjectReplicator) prioritizeTargets(targets []string) [][]string {
+	if len(r.Priorities) == 0 {
+		return [][]string{targets}
+	}
+	byPriority := make([][]string, len(r.Priorities)+1)
+	priorities := map[string]int{}
+	for _, target := range targets {
+		namespace := strings.SplitN(target, "/", 2)[0]
+		priority, ok := priorities[namespace]
+		if !ok {
+			priority = len(r.Priorities)
+			if object, exists, err := r.namespaceStore.GetByKey(namespace); err == nil && exists {
+				namespaceLabels := labels.Set(object.(metav1.Object).GetLabels())
+				for i, selector := range r.Priorities {
+					if selector.Matches(namespaceLabels) {
+						priority = i
+						break
+					}
+				}
+			}
+			priorities[namespace] = priority
+		}
+		byPriority[priority] = append(byPriority[priority], target)
+	}
+	prioritized := [][]string{}
+	for _, targets := range byPriority {
+		if len(targets) > 0 {
+			prioritized = append(prioritized, targets)
+		}
+	}
+	return prioritized
+}
+
+// Syncs the targets, up to ConcurrentSyncs at once, and one at once per target namespace
+// Only the calls to kubernetes run concurrently: each handler holds the sync lock while it runs,
+// and releases it only during its calls, with unlocked. So the shared state, the bookkeeping, the stores,
+// the breakers, the audit and the hooks, is still modified by one handler at once
+func (r *ObjectReplicator) syncPrioritized(result *syncResult, targets []string, handle func(target string) error) {
+	if r.ConcurrentSyncs <= 1 || len(targets) <= 1 {
+		for _, target := range targets {
+			result.add(handle(target))
+		}
+		return
+	}
+	// the targets of each namespace are synced in order
+	namespaces := []string{}
+	byNamespace := map[string][]string{}
+	for _, target := range targets {
+		namespace := strings.SplitN(target, "/", 2)[0]
+		if _, ok := byNamespace[namespace]; !ok {
+			namespaces = append(namespaces, namespace)
+		}
+		byNamespace[namespace] = append(byNamespace[namespace], target)
+	}
+	var lock sync.Mutex
+	r.syncLock = &lock
+	defer func() {
+		r.syncLock = nil
+	}()
+	var group sync.WaitGroup
+	slots := make(chan struct{}, r.ConcurrentSyncs)
+	for _, namespace := range namespaces {
+		group.Add(1)
+		go func(targets []string) {
+			defer group.Done()
+			for _, target := range targets {
+				slots <- struct{}{}
+				lock.Lock()
+				result.add(handle(target))
+				lock.Unlock()
+				<-slots
+			}
+		}(byNamespace[namespace])
+	}
+	group.Wait()
+}
+
+// Calls kubernetes without the sync lock, such that the targets synced concurrently do not wait for each other's calls
+// The call must not touch the shared state, it is a plain call when the targets are not synced concurrently
+func (r *ObjectReplicator) unlocked(call func()) {
+	if lock := r.syncLock; lock != nil {
+		lock.Unlock()
+		defer lock.Lock()
+	}
+	call()
+}
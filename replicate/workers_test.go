@@ -0,0 +1,112 @@
+package replicate
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSyncTargets(t *testing.T) {
+	r := &ObjectReplicator{ReplicatorProps: ReplicatorProps{ReplicatorOptions: ReplicatorOptions{ConcurrentSyncs: 2}}}
+	targets := []string{"ns-1/a", "ns-1/b", "ns-2/a", "ns-3/a", "ns-3/b"}
+
+	var mutex sync.Mutex
+	running := 0
+	maxRunning := 0
+	// the handlers outside of their calls, the shared state being modified by one at once
+	var locked int32
+	namespaces := map[string]bool{}
+	order := []string{}
+	var result syncResult
+	r.syncTargets(&result, targets, func(target string) error {
+		namespace := strings.SplitN(target, "/", 2)[0]
+		assert.Equal(t, int32(1), atomic.AddInt32(&locked, 1), "shared state modified concurrently")
+		mutex.Lock()
+		assert.False(t, namespaces[namespace], "concurrent syncs in %s", namespace)
+		namespaces[namespace] = true
+		mutex.Unlock()
+		atomic.AddInt32(&locked, -1)
+		r.unlocked(func() {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+		assert.Equal(t, int32(1), atomic.AddInt32(&locked, 1), "shared state modified concurrently")
+		mutex.Lock()
+		namespaces[namespace] = false
+		order = append(order, target)
+		mutex.Unlock()
+		atomic.AddInt32(&locked, -1)
+		if target == "ns-2/a" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	assert.Equal(t, 2, maxRunning, "calls run concurrently")
+	assert.Nil(t, r.syncLock)
+	assert.ElementsMatch(t, targets, order)
+	assert.Equal(t, 5, result.targets)
+	assert.Equal(t, 4, result.synced)
+	assert.Error(t, result.err)
+	// the targets of a namespace are synced in order
+	assert.True(t, indexOf(order, "ns-1/a") < indexOf(order, "ns-1/b"))
+	assert.True(t, indexOf(order, "ns-3/a") < indexOf(order, "ns-3/b"))
+}
+
+func TestSyncTargets_priorities(t *testing.T) {
+	priorities, err := ParseNamespacePriorities("tier=critical; tier in (high)")
+	require.NoError(t, err)
+	_, err = ParseNamespacePriorities("tier=critical;tier in (")
+	assert.Error(t, err)
+
+	r := createTestReplicator(t, ReplicatorOptions{ConcurrentSyncs: 4, Priorities: priorities}, "ns-1")
+	for namespace, tier := range map[string]string{"ns-2": "high", "ns-3": "critical", "ns-4": "low"} {
+		require.NoError(t, r.namespaceStore.Add(&v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: M{"tier": tier}},
+		}))
+	}
+	targets := []string{"ns-1/a", "ns-2/a", "ns-3/a", "ns-4/a", "ns-3/b", "missing/a"}
+	assert.Equal(t, [][]string{
+		{"ns-3/a", "ns-3/b"},
+		{"ns-2/a"},
+		{"ns-1/a", "ns-4/a", "missing/a"},
+	}, r.prioritizeTargets(targets))
+
+	var mutex sync.Mutex
+	order := []string{}
+	var result syncResult
+	r.syncTargets(&result, targets, func(target string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		order = append(order, target)
+		return nil
+	})
+	assert.ElementsMatch(t, []string{"ns-3/a", "ns-3/b"}, order[:2])
+	assert.Equal(t, "ns-2/a", order[2])
+	assert.Equal(t, 6, result.synced)
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+)
+
+// build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+func getVersionInfo() versionInfo {
+	return versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// a constant metric with the build information as labels
+func newBuildInfoMetric(info versionInfo) prometheus.Gauge {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "k8s_replicator",
+		Name:      "build_info",
+		Help:      "Build information of the running k8s-replicator, always 1.",
+		ConstLabels: prometheus.Labels{
+			"version":    info.Version,
+			"commit":     info.Commit,
+			"build_date": info.BuildDate,
+			"go_version": info.GoVersion,
+		},
+	})
+	gauge.Set(1)
+	return gauge
+}
+
+// serves the build information as JSON
+type versionHandler struct {
+	info versionInfo
+}
+
+func (h *versionHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(res).Encode(h.info)
+}
+
+// The "version" subcommand, prints the build information
+func newVersionCommand() *cobra.Command {
+	var format string
+	command := &cobra.Command{
+		Use:   "version",
+		Short: "Print the build information",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			info := getVersionInfo()
+			switch format {
+			case "json":
+				return json.NewEncoder(os.Stdout).Encode(info)
+			case "text":
+				_, err := fmt.Printf("k8s-replicator %s (commit %s, built %s, %s)\n",
+					info.Version, info.Commit, info.BuildDate, info.GoVersion)
+				return err
+			default:
+				return fmt.Errorf("invalid --format \"%s\": expected text or json", format)
+			}
+		},
+	}
+	command.Flags().StringVar(&format, "format", "text", "format of the build information: text or json")
+	return command
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionInfo(t *testing.T) {
+	info := getVersionInfo()
+	assert.Equal(t, versionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}, info)
+
+	// served as JSON
+	info = versionInfo{Version: "v1.2.3", Commit: "abc123", BuildDate: "2024-01-02T03:04:05Z", GoVersion: "go1.22.0"}
+	res := httptest.NewRecorder()
+	(&versionHandler{info: info}).ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	served := versionInfo{}
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &served))
+	assert.Equal(t, info, served)
+	assert.JSONEq(t, `{"version":"v1.2.3","commit":"abc123","buildDate":"2024-01-02T03:04:05Z","goVersion":"go1.22.0"}`, res.Body.String())
+
+	// exported as a metric, with the information as labels
+	gauge := newBuildInfoMetric(info)
+	assert.Equal(t, float64(1), testutil.ToFloat64(gauge))
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(gauge))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	assert.Equal(t, "k8s_replicator_build_info", families[0].GetName())
+	labels := map[string]string{}
+	for _, label := range families[0].GetMetric()[0].GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	assert.Equal(t, map[string]string{
+		"version":    "v1.2.3",
+		"commit":     "abc123",
+		"build_date": "2024-01-02T03:04:05Z",
+		"go_version": "go1.22.0",
+	}, labels)
+}